@@ -65,6 +65,27 @@ func (m *Pinecone) SetMulticastEnabled(enabled bool) {
 	}
 }
 
+// SetLowPowerMode should be called when the host reports low battery or
+// that the application has moved into the background, and again with
+// false when the application returns to the foreground.
+func (m *Pinecone) SetLowPowerMode(enabled bool) {
+	if enabled {
+		m.PineconeRouter.SetPowerMode(pineconeRouter.PowerModeLowPower)
+	} else {
+		m.PineconeRouter.SetPowerMode(pineconeRouter.PowerModeNormal)
+	}
+}
+
+// Suspend should be called before the operating system suspends the
+// application, and Resume as soon as it wakes up again.
+func (m *Pinecone) Suspend() {
+	m.PineconeRouter.Suspend()
+}
+
+func (m *Pinecone) Resume() {
+	m.PineconeRouter.Resume()
+}
+
 func (m *Pinecone) SetStaticPeer(uri string) {
 	m.PineconeManager.RemovePeers()
 	if uri != "" {
@@ -93,6 +114,14 @@ func (m *Pinecone) DisconnectPort(port int) {
 }
 
 func (m *Pinecone) Conduit(zone string, peertype int) (*Conduit, error) {
+	return m.ConduitWithMTU(zone, peertype, 0)
+}
+
+// ConduitWithMTU works like Conduit, but each read from the conduit will
+// return no more than mtu bytes, so that it can be sent as a single packet
+// on links that can only carry small packets, e.g. Bluetooth LE. An mtu of
+// zero means no limit.
+func (m *Pinecone) ConduitWithMTU(zone string, peertype int, mtu int) (*Conduit, error) {
 	l, r := net.Pipe()
 	conduit := &Conduit{conn: r, port: 0}
 	go func() {
@@ -105,6 +134,7 @@ func (m *Pinecone) Conduit(zone string, peertype int) (*Conduit, error) {
 				l,
 				pineconeRouter.ConnectionZone(zone),
 				pineconeRouter.ConnectionPeerType(peertype),
+				pineconeRouter.ConnectionMTU(mtu),
 			)
 			switch err {
 			case io.ErrClosedPipe:
@@ -0,0 +1,387 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gobind
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/matrix-org/pinecone/connections"
+	"github.com/matrix-org/pinecone/multicast"
+	"github.com/matrix-org/pinecone/router"
+	"github.com/matrix-org/pinecone/sessions"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// messageProtocol is the session protocol used for Send and for
+// delivering messages to the MessageHandler.
+const messageProtocol = "pinecone-mobile"
+
+// maxMessageSize is the largest message that Send will accept.
+const maxMessageSize = 1024 * 1024
+
+// Logger receives log lines from the node.
+type Logger interface {
+	Log(message string)
+}
+
+// MessageHandler receives messages sent to this node with Send. The
+// sender is the hex-encoded public key of the remote node.
+type MessageHandler interface {
+	HandleMessage(sender string, message []byte)
+}
+
+// Stats is a snapshot of the state of the node.
+type Stats struct {
+	PublicKey      string
+	Coordinates    string
+	PeerCount      int
+	RemotePeers    int
+	MulticastPeers int
+	BluetoothPeers int
+	SessionCount   int
+}
+
+// Node is a simplified API for embedding a Pinecone node with multicast,
+// static peers and sessions into Android and iOS applications. Everything
+// exported by it only uses types that gomobile can bind, so applications
+// can use it directly instead of maintaining their own shims around the
+// Pinecone type.
+type Node struct {
+	ctx       context.Context
+	cancel    context.CancelFunc
+	logger    *log.Logger
+	router    *router.Router
+	multicast *multicast.Multicast
+	manager   *connections.ConnectionManager
+	sessions  *sessions.Sessions
+	protocol  *sessions.SessionProtocol
+	handlerMu sync.Mutex
+	handler   MessageHandler
+	streamsMu sync.Mutex
+	streams   map[types.PublicKey]*messageStream
+}
+
+// messageStream is a session stream used by Send. Writes are serialised
+// so that messages sent at the same time don't interleave.
+type messageStream struct {
+	net.Conn
+	writeMu sync.Mutex
+}
+
+type logWriter struct {
+	logger Logger
+}
+
+func (w logWriter) Write(p []byte) (int, error) {
+	w.logger.Log(string(p))
+	return len(p), nil
+}
+
+// NewNode creates a node from a hex-encoded ed25519 seed. If the seed is
+// empty then a new identity will be generated. The logger may be nil.
+// The node doesn't do anything until Start is called.
+func NewNode(seed string, logger Logger) (*Node, error) {
+	var sk ed25519.PrivateKey
+	if seed == "" {
+		var err error
+		if _, sk, err = ed25519.GenerateKey(nil); err != nil {
+			return nil, fmt.Errorf("ed25519.GenerateKey: %w", err)
+		}
+	} else {
+		seedBytes, err := hex.DecodeString(seed)
+		if err != nil {
+			return nil, fmt.Errorf("hex.DecodeString: %w", err)
+		}
+		if len(seedBytes) != ed25519.SeedSize {
+			return nil, fmt.Errorf("seed must be %d bytes", ed25519.SeedSize)
+		}
+		sk = ed25519.NewKeyFromSeed(seedBytes)
+	}
+	n := &Node{
+		logger:  log.New(io.Discard, "", 0),
+		streams: map[types.PublicKey]*messageStream{},
+	}
+	if logger != nil {
+		n.logger = log.New(logWriter{logger}, "Pinecone: ", 0)
+	}
+	n.ctx, n.cancel = context.WithCancel(context.Background())
+	n.router = router.NewRouter(n.logger, sk)
+	return n, nil
+}
+
+// Start starts the sessions listener and the connection manager. Multicast
+// is not started until SetMulticastEnabled is called.
+func (n *Node) Start() {
+	n.multicast = multicast.NewMulticast(n.logger, n.router)
+	n.manager = connections.NewConnectionManager(n.router, nil)
+	n.sessions = sessions.NewSessions(n.logger, n.router, []string{messageProtocol})
+	n.protocol = n.sessions.Protocol(messageProtocol)
+	go n.accept()
+}
+
+// Stop shuts down the node. It can't be started again afterwards.
+func (n *Node) Stop() {
+	n.cancel()
+	if n.multicast != nil {
+		n.multicast.Stop()
+	}
+	if n.protocol != nil {
+		_ = n.protocol.Close()
+	}
+	if n.sessions != nil {
+		_ = n.sessions.Close()
+	}
+	n.streamsMu.Lock()
+	for key, stream := range n.streams {
+		_ = stream.Close()
+		delete(n.streams, key)
+	}
+	n.streamsMu.Unlock()
+	_ = n.router.Close()
+}
+
+// PublicKey returns the hex-encoded public key of the node.
+func (n *Node) PublicKey() string {
+	return n.router.PublicKey().String()
+}
+
+// PrivateSeed returns the hex-encoded seed for the node, which can be
+// passed to NewNode to restore the same identity later.
+func (n *Node) PrivateSeed() string {
+	sk := n.router.PrivateKey()
+	return hex.EncodeToString(ed25519.PrivateKey(sk[:]).Seed())
+}
+
+// ConnectPeer adds a static peer by URI, which will be reconnected by the
+// connection manager if the connection drops. It has no effect before the
+// node is started.
+func (n *Node) ConnectPeer(uri string) {
+	if n.manager == nil {
+		return
+	}
+	n.manager.AddPeer(uri)
+}
+
+// DisconnectPeer removes a static peer that was added by ConnectPeer.
+func (n *Node) DisconnectPeer(uri string) {
+	if n.manager == nil {
+		return
+	}
+	n.manager.RemovePeer(uri)
+}
+
+// SetMulticastEnabled starts or stops multicast discovery of peers on the
+// local network. Stopping multicast also disconnects multicast peers. It
+// has no effect before the node is started.
+func (n *Node) SetMulticastEnabled(enabled bool) {
+	if n.multicast == nil {
+		return
+	}
+	if enabled {
+		n.multicast.Start()
+		return
+	}
+	n.multicast.Stop()
+	for _, p := range n.router.Peers() {
+		if p.PeerType == router.PeerTypeMulticast {
+			n.router.Disconnect(types.SwitchPortID(p.Port), nil)
+		}
+	}
+}
+
+// SetLowPowerMode switches the router in or out of low power mode.
+func (n *Node) SetLowPowerMode(enabled bool) {
+	if enabled {
+		n.router.SetPowerMode(router.PowerModeLowPower)
+	} else {
+		n.router.SetPowerMode(router.PowerModeNormal)
+	}
+}
+
+// Suspend should be called before the operating system suspends the
+// application, and Resume as soon as it wakes up again.
+func (n *Node) Suspend() {
+	n.router.Suspend()
+}
+
+func (n *Node) Resume() {
+	n.router.Resume()
+}
+
+// PeerCount returns the number of peerings of the given type, or of all
+// types if the peer type is negative.
+func (n *Node) PeerCount(peertype int) int {
+	return n.router.PeerCount(peertype)
+}
+
+// Stats returns a snapshot of the state of the node.
+func (n *Node) Stats() *Stats {
+	stats := &Stats{
+		PublicKey:   n.PublicKey(),
+		Coordinates: n.router.Coords().String(),
+	}
+	for _, p := range n.router.Peers() {
+		if p.Port == 0 {
+			// This is the router itself.
+			continue
+		}
+		stats.PeerCount++
+		switch p.PeerType {
+		case router.PeerTypeRemote:
+			stats.RemotePeers++
+		case router.PeerTypeMulticast:
+			stats.MulticastPeers++
+		case router.PeerTypeBluetooth:
+			stats.BluetoothPeers++
+		}
+	}
+	if n.protocol != nil {
+		stats.SessionCount = len(n.protocol.Sessions())
+	}
+	return stats
+}
+
+// SetMessageHandler sets the handler that receives messages from other
+// nodes. Messages that arrive while no handler is set are dropped.
+func (n *Node) SetMessageHandler(handler MessageHandler) {
+	n.handlerMu.Lock()
+	defer n.handlerMu.Unlock()
+	n.handler = handler
+}
+
+// Send sends a message to the node with the given hex-encoded public key,
+// opening a session to it first if needed.
+func (n *Node) Send(publicKey string, message []byte) error {
+	if len(message) > maxMessageSize {
+		return fmt.Errorf("message exceeds maximum size of %d bytes", maxMessageSize)
+	}
+	var key types.PublicKey
+	keyBytes, err := hex.DecodeString(publicKey)
+	if err != nil {
+		return fmt.Errorf("hex.DecodeString: %w", err)
+	}
+	if len(keyBytes) != ed25519.PublicKeySize {
+		return fmt.Errorf("public key must be %d bytes", ed25519.PublicKeySize)
+	}
+	copy(key[:], keyBytes)
+	if n.protocol == nil {
+		return fmt.Errorf("the node hasn't been started")
+	}
+
+	stream, err := n.stream(key)
+	if err != nil {
+		return err
+	}
+	stream.writeMu.Lock()
+	err = writeMessage(stream, message)
+	stream.writeMu.Unlock()
+	if err != nil {
+		_ = stream.Close()
+		n.streamsMu.Lock()
+		if n.streams[key] == stream {
+			delete(n.streams, key)
+		}
+		n.streamsMu.Unlock()
+		return fmt.Errorf("writeMessage: %w", err)
+	}
+	return nil
+}
+
+// stream returns the stream for sending messages to the given node,
+// opening one first if needed. Dialling can take a while, so it happens
+// without holding the lock, and if another stream was opened meanwhile
+// then that one is used instead.
+func (n *Node) stream(key types.PublicKey) (*messageStream, error) {
+	n.streamsMu.Lock()
+	stream, ok := n.streams[key]
+	n.streamsMu.Unlock()
+	if ok {
+		return stream, nil
+	}
+	conn, err := n.protocol.DialContext(n.ctx, "ed25519", net.JoinHostPort(key.String(), "0"))
+	if err != nil {
+		return nil, fmt.Errorf("n.protocol.DialContext: %w", err)
+	}
+	n.streamsMu.Lock()
+	defer n.streamsMu.Unlock()
+	if stream, ok := n.streams[key]; ok {
+		_ = conn.Close()
+		return stream, nil
+	}
+	stream = &messageStream{Conn: conn}
+	n.streams[key] = stream
+	return stream, nil
+}
+
+func (n *Node) accept() {
+	for {
+		stream, err := n.protocol.Accept()
+		if err != nil {
+			return
+		}
+		go n.receive(stream)
+	}
+}
+
+func (n *Node) receive(stream net.Conn) {
+	defer stream.Close() // nolint:errcheck
+	sender := stream.RemoteAddr().String()
+	for {
+		message, err := readMessage(stream)
+		if err != nil {
+			return
+		}
+		n.handlerMu.Lock()
+		handler := n.handler
+		n.handlerMu.Unlock()
+		if handler != nil {
+			handler.HandleMessage(sender, message)
+		}
+	}
+}
+
+// Messages are sent over session streams with a four byte big-endian
+// length prefix.
+func writeMessage(w io.Writer, message []byte) error {
+	buf := make([]byte, 4+len(message))
+	binary.BigEndian.PutUint32(buf, uint32(len(message)))
+	copy(buf[4:], message)
+	_, err := w.Write(buf)
+	return err
+}
+
+func readMessage(r io.Reader) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header[:])
+	if length > maxMessageSize {
+		return nil, fmt.Errorf("message exceeds maximum size of %d bytes", maxMessageSize)
+	}
+	message := make([]byte, length)
+	if _, err := io.ReadFull(r, message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
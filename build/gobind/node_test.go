@@ -0,0 +1,80 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gobind
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestMessageFraming(t *testing.T) {
+	var buf bytes.Buffer
+	for _, message := range [][]byte{[]byte("hello"), {}, []byte("world")} {
+		if err := writeMessage(&buf, message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, expected := range []string{"hello", "", "world"} {
+		message, err := readMessage(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(message) != expected {
+			t.Fatalf("expected %q, got %q", expected, message)
+		}
+	}
+	if _, err := readMessage(&buf); err == nil {
+		t.Fatalf("expected an error reading past the end")
+	}
+
+	// A length prefix that is too large is refused before anything is
+	// allocated for it.
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], maxMessageSize+1)
+	if _, err := readMessage(bytes.NewReader(header[:])); err == nil {
+		t.Fatalf("expected an oversized message to be refused")
+	}
+}
+
+func TestNodeBeforeStart(t *testing.T) {
+	n, err := NewNode("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Stop()
+
+	// The identity survives a round trip through the seed.
+	restored, err := NewNode(n.PrivateSeed(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Stop()
+	if restored.PublicKey() != n.PublicKey() {
+		t.Fatalf("expected %s, got %s", n.PublicKey(), restored.PublicKey())
+	}
+
+	// Nothing that needs the node to be started should panic before then.
+	n.ConnectPeer("ws://localhost:1")
+	n.DisconnectPeer("ws://localhost:1")
+	n.SetMulticastEnabled(true)
+	n.SetMulticastEnabled(false)
+	if err := n.Send(restored.PublicKey(), []byte("hello")); err == nil {
+		t.Fatalf("expected sending before starting to fail")
+	}
+	if stats := n.Stats(); stats.PeerCount != 0 || stats.SessionCount != 0 {
+		t.Fatalf("expected no peers or sessions, got %+v", stats)
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build js && wasm
+// +build js,wasm
+
+// Command wasm runs a Pinecone node in the browser. Build it with
+// "GOOS=js GOARCH=wasm go build -o pinecone.wasm ./build/wasm" and load it
+// with the wasm_exec.js from the Go distribution. It registers a global
+// "pinecone" object with the following functions:
+//
+//	pinecone.start(seed, onLog)      starts the node, returns the public key
+//	pinecone.stop()                  stops the node
+//	pinecone.connect(uri)            adds a ws:// or wss:// static peer
+//	pinecone.disconnect(uri)         removes a static peer
+//	pinecone.send(key, bytes)        returns a Promise that resolves once sent
+//	pinecone.onMessage(fn)           calls fn(sender, bytes) for each message
+//	pinecone.stats()                 returns an object with node statistics
+//
+// Only WebSocket peerings are possible in the browser, so there is no
+// multicast or TCP support.
+package main
+
+import (
+	"fmt"
+	"syscall/js"
+
+	"github.com/matrix-org/pinecone/build/gobind"
+)
+
+type jsLogger struct {
+	fn js.Value
+}
+
+func (l jsLogger) Log(message string) {
+	l.fn.Invoke(message)
+}
+
+type jsMessageHandler struct {
+	fn js.Value
+}
+
+func (h jsMessageHandler) HandleMessage(sender string, message []byte) {
+	data := js.Global().Get("Uint8Array").New(len(message))
+	js.CopyBytesToJS(data, message)
+	h.fn.Invoke(sender, data)
+}
+
+func main() {
+	var node *gobind.Node
+	requireNode := func() error {
+		if node == nil {
+			return fmt.Errorf("pinecone.start() hasn't been called")
+		}
+		return nil
+	}
+
+	api := map[string]interface{}{
+		"start": js.FuncOf(func(_ js.Value, args []js.Value) interface{} {
+			if node != nil {
+				return node.PublicKey()
+			}
+			seed := ""
+			if len(args) > 0 && args[0].Type() == js.TypeString {
+				seed = args[0].String()
+			}
+			var logger gobind.Logger
+			if len(args) > 1 && args[1].Type() == js.TypeFunction {
+				logger = jsLogger{args[1]}
+			}
+			var err error
+			if node, err = gobind.NewNode(seed, logger); err != nil {
+				return jsError(err)
+			}
+			node.Start()
+			return node.PublicKey()
+		}),
+		"stop": js.FuncOf(func(_ js.Value, _ []js.Value) interface{} {
+			if node != nil {
+				node.Stop()
+				node = nil
+			}
+			return nil
+		}),
+		"connect": js.FuncOf(func(_ js.Value, args []js.Value) interface{} {
+			if err := requireNode(); err != nil {
+				return jsError(err)
+			}
+			if len(args) < 1 {
+				return jsError(fmt.Errorf("missing peer URI"))
+			}
+			node.ConnectPeer(args[0].String())
+			return nil
+		}),
+		"disconnect": js.FuncOf(func(_ js.Value, args []js.Value) interface{} {
+			if err := requireNode(); err != nil {
+				return jsError(err)
+			}
+			if len(args) < 1 {
+				return jsError(fmt.Errorf("missing peer URI"))
+			}
+			node.DisconnectPeer(args[0].String())
+			return nil
+		}),
+		"send": js.FuncOf(func(_ js.Value, args []js.Value) interface{} {
+			return promise(func() (interface{}, error) {
+				if err := requireNode(); err != nil {
+					return nil, err
+				}
+				if len(args) < 2 {
+					return nil, fmt.Errorf("expected public key and message")
+				}
+				message := make([]byte, args[1].Get("length").Int())
+				js.CopyBytesToGo(message, args[1])
+				return nil, node.Send(args[0].String(), message)
+			})
+		}),
+		"onMessage": js.FuncOf(func(_ js.Value, args []js.Value) interface{} {
+			if err := requireNode(); err != nil {
+				return jsError(err)
+			}
+			if len(args) < 1 || args[0].Type() != js.TypeFunction {
+				node.SetMessageHandler(nil)
+				return nil
+			}
+			node.SetMessageHandler(jsMessageHandler{args[0]})
+			return nil
+		}),
+		"stats": js.FuncOf(func(_ js.Value, _ []js.Value) interface{} {
+			if err := requireNode(); err != nil {
+				return jsError(err)
+			}
+			stats := node.Stats()
+			return map[string]interface{}{
+				"publicKey":    stats.PublicKey,
+				"coordinates":  stats.Coordinates,
+				"peerCount":    stats.PeerCount,
+				"sessionCount": stats.SessionCount,
+			}
+		}),
+	}
+	js.Global().Set("pinecone", js.ValueOf(api))
+
+	// Keep the Go runtime alive so that the callbacks keep working.
+	select {}
+}
+
+func jsError(err error) js.Value {
+	return js.Global().Get("Error").New(err.Error())
+}
+
+// promise runs the function in a goroutine, since blocking calls aren't
+// allowed from inside JavaScript callbacks, and returns a Promise for the
+// result.
+func promise(fn func() (interface{}, error)) js.Value {
+	var handler js.Func
+	handler = js.FuncOf(func(_ js.Value, args []js.Value) interface{} {
+		resolve, reject := args[0], args[1]
+		go func() {
+			defer handler.Release()
+			result, err := fn()
+			if err != nil {
+				reject.Invoke(jsError(err))
+				return
+			}
+			resolve.Invoke(result)
+		}()
+		return nil
+	})
+	return js.Global().Get("Promise").New(handler)
+}
@@ -31,8 +31,10 @@ import (
 
 	"github.com/gorilla/websocket"
 	"github.com/matrix-org/pinecone/connections"
+	"github.com/matrix-org/pinecone/control"
 	"github.com/matrix-org/pinecone/multicast"
 	"github.com/matrix-org/pinecone/router"
+	"github.com/matrix-org/pinecone/types"
 	"github.com/matrix-org/pinecone/util"
 )
 
@@ -42,9 +44,21 @@ func main() {
 
 	listentcp := flag.String("listen", ":0", "address to listen for TCP connections")
 	listenws := flag.String("listenws", ":0", "address to listen for WebSockets connections")
-	connect := flag.String("connect", "", "peers to connect to")
+	listenunix := flag.String("listenunix", "", "path of a unix socket to listen for local connections on")
+	connect := flag.String("connect", "", "peers to connect to, use unix:///path for unix sockets and separate alternative URIs for the same peer with |")
+	reserved := flag.String("reserved", "", "peers to connect to with reserved peering slots")
 	secretkey := flag.String("secretkey", "", "hexadecimal encoded ed25519 key")
+	controlsocket := flag.String("control", "", "path of a unix socket to accept control connections on")
 	manhole := flag.Bool("manhole", false, "enable the manhole (requires WebSocket listener to be active)")
+	debugkeys := flag.String("debugkeys", "", "hexadecimal public keys that are allowed to make debug queries, separated by commas")
+	acceptrate := flag.Float64("acceptrate", 0, "inbound connections to accept per second, 0 for no limit")
+	maxpersource := flag.Int("maxpersource", 0, "peerings to allow with each remote host, 0 for no limit")
+	maxhandshakes := flag.Int("maxhandshakes", 0, "handshakes to allow in progress at once, 0 for no limit")
+	network := flag.String("network", "", "name of the network to join, only peering with nodes in the same network")
+	encrypt := flag.Bool("encrypt", false, "encrypt peerings with nodes that also encrypt them")
+	peerstore := flag.String("peerstore", "", "path of a file to remember the peers that we connected to in")
+	reconnect := flag.Int("reconnect", 3, "remembered peers to reconnect to at once, best reputation first")
+	policy := flag.String("policy", "", "path of a file of traffic policy rules to apply to the traffic that we send and forward")
 	flag.Parse()
 
 	var sk ed25519.PrivateKey
@@ -73,14 +87,67 @@ func main() {
 
 	listener := net.ListenConfig{}
 
-	pineconeRouter := router.NewRouter(logger, sk, router.RouterOptionBlackhole(true))
+	options := []router.RouterOption{router.RouterOptionBlackhole(true)}
+	if debugkeys != nil && *debugkeys != "" {
+		var keys router.RouterOptionDebugQueries
+		for _, key := range strings.Split(*debugkeys, ",") {
+			var pk types.PublicKey
+			b, err := hex.DecodeString(strings.TrimSpace(key))
+			if err != nil || len(b) != ed25519.PublicKeySize {
+				panic(fmt.Sprintf("invalid debug key %q", key))
+			}
+			copy(pk[:], b)
+			keys = append(keys, pk)
+		}
+		options = append(options, keys)
+	}
+
+	if network != nil && *network != "" {
+		options = append(options, router.RouterOptionNetworkName(*network))
+	}
+	if encrypt != nil && *encrypt {
+		options = append(options, router.RouterOptionLinkEncryption{})
+	}
+
+	if policy != nil && *policy != "" {
+		file, err := os.Open(*policy)
+		if err != nil {
+			panic(err)
+		}
+		rules, err := router.ParseTrafficPolicy(file)
+		_ = file.Close()
+		if err != nil {
+			panic(fmt.Sprintf("invalid traffic policy %q: %s", *policy, err))
+		}
+		options = append(options, router.RouterOptionTrafficPolicy(rules))
+	}
+	options = append(options,
+		router.RouterOptionAcceptLimits{Rate: *acceptrate, MaxPeersPerSource: *maxpersource},
+		router.RouterOptionHandshakeLimits{MaxPending: *maxhandshakes},
+	)
+
+	pineconeRouter := router.NewRouter(logger, sk, options...)
 	pineconeMulticast := multicast.NewMulticast(logger, pineconeRouter)
 	pineconeMulticast.Start()
 	pineconeManager := connections.NewConnectionManager(pineconeRouter, nil)
+	if peerstore != nil && *peerstore != "" {
+		if err := pineconeManager.SetPeerStore(connections.FilePeerStore(*peerstore), *reconnect); err != nil {
+			panic(err)
+		}
+	}
 
 	if connect != nil && *connect != "" {
-		for _, uri := range strings.Split(*connect, ",") {
-			pineconeManager.AddPeer(strings.TrimSpace(uri))
+		for _, peer := range strings.Split(*connect, ",") {
+			var uris []string
+			for _, uri := range strings.Split(peer, "|") {
+				uris = append(uris, strings.TrimSpace(uri))
+			}
+			pineconeManager.AddPeerCandidates(uris...)
+		}
+	}
+	if reserved != nil && *reserved != "" {
+		for _, uri := range strings.Split(*reserved, ",") {
+			pineconeManager.AddReservedPeer(strings.TrimSpace(uri))
 		}
 	}
 
@@ -98,6 +165,7 @@ func main() {
 					util.WrapWebSocketConn(conn),
 					router.ConnectionURI(conn.RemoteAddr().String()),
 					router.ConnectionPeerType(router.PeerTypeRemote),
+					router.ConnectionInbound(true),
 					router.ConnectionZone("websocket"),
 				); err != nil {
 					fmt.Println("Inbound WS connection", conn.RemoteAddr(), "error:", err)
@@ -127,6 +195,24 @@ func main() {
 		}()
 	}
 
+	if controlsocket != nil && *controlsocket != "" {
+		server := control.NewServer(pineconeRouter, pineconeManager, nil)
+		if err := server.ListenUnix(*controlsocket); err != nil {
+			panic(err)
+		}
+		defer server.Close() // nolint:errcheck
+		fmt.Println("Listening for control connections on", *controlsocket)
+	}
+
+	if listenunix != nil && *listenunix != "" {
+		listener, err := connections.ListenUnix(pineconeRouter, *listenunix)
+		if err != nil {
+			panic(err)
+		}
+		defer listener.Close() // nolint:errcheck
+		fmt.Println("Listening on", listener.Addr())
+	}
+
 	if listentcp != nil && *listentcp != "" {
 		go func() {
 			listener, err := listener.Listen(context.Background(), "tcp", *listentcp)
@@ -146,6 +232,7 @@ func main() {
 					conn,
 					router.ConnectionURI(conn.RemoteAddr().String()),
 					router.ConnectionPeerType(router.PeerTypeRemote),
+					router.ConnectionInbound(true),
 				); err != nil {
 					fmt.Println("Inbound TCP connection", conn.RemoteAddr(), "error:", err)
 					_ = conn.Close()
@@ -157,4 +244,9 @@ func main() {
 	}
 
 	<-sigs
+	if peerstore != nil && *peerstore != "" {
+		if err := pineconeManager.SavePeers(); err != nil {
+			logger.Println("Failed to save peers:", err)
+		}
+	}
 }
@@ -0,0 +1,293 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/pinecone/router"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// The diff is written in three sections, for the peers, the node's place in
+// the tree and its SNEK entries, with a line for each thing that was added
+// (+), removed (-) or changed (~). Things that change all the time without
+// meaning anything, like byte counters and the sequence numbers of paths
+// that are being refreshed, are left out. RTTs are only mentioned when they
+// have at least doubled or halved, since they wander a bit on any link.
+
+// differ writes the differences between two snapshots.
+type differ struct {
+	w        io.Writer
+	fullKeys bool
+	changes  int
+	err      error
+}
+
+func (d *differ) key(k types.PublicKey) string {
+	if d.fullKeys {
+		return k.String()
+	}
+	return k.String()[:16]
+}
+
+func (d *differ) section(name string) {
+	d.printf("%s\n", name)
+}
+
+func (d *differ) change(mark, format string, args ...interface{}) {
+	d.changes++
+	d.printf("  %s "+format+"\n", append([]interface{}{mark}, args...)...)
+}
+
+func (d *differ) printf(format string, args ...interface{}) {
+	if d.err == nil {
+		_, d.err = fmt.Fprintf(d.w, format, args...)
+	}
+}
+
+// diff writes the differences between the snapshots and returns how many
+// there were.
+func (d *differ) diff(before, after *snapshot) (int, error) {
+	if before.Public != after.Public {
+		d.printf("Warning: the snapshots are of different nodes, %s and %s\n\n", d.key(before.Public), d.key(after.Public))
+	} else {
+		d.printf("Node %s\n\n", d.key(before.Public))
+	}
+	d.diffPeers(before, after)
+	d.diffTree(before, after)
+	d.diffSNEK(before, after)
+	if d.changes == 0 {
+		d.printf("No differences\n")
+	}
+	return d.changes, d.err
+}
+
+func peerType(t router.ConnectionPeerType) string {
+	switch int(t) {
+	case router.PeerTypePipe:
+		return "pipe"
+	case router.PeerTypeMulticast:
+		return "multicast"
+	case router.PeerTypeBonjour:
+		return "bonjour"
+	case router.PeerTypeRemote:
+		return "remote"
+	case router.PeerTypeBluetooth:
+		return "bluetooth"
+	default:
+		return fmt.Sprintf("type %d", t)
+	}
+}
+
+func (d *differ) describePeering(p snapshotPeer) string {
+	s := fmt.Sprintf("port %d, %s", p.Port, peerType(p.PeerType))
+	if p.PeerZone != "" {
+		s += fmt.Sprintf(", zone %s", p.PeerZone)
+	}
+	if p.PeerURI != "" {
+		s += fmt.Sprintf(", %s", p.PeerURI)
+	}
+	return s
+}
+
+func (d *differ) diffPeers(before, after *snapshot) {
+	d.section(fmt.Sprintf("Peers (%d nodes before, %d after)", len(before.Peers), len(after.Peers)))
+	keys := map[string]struct{}{}
+	for k := range before.Peers {
+		keys[k] = struct{}{}
+	}
+	for k := range after.Peers {
+		keys[k] = struct{}{}
+	}
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+	for _, k := range sorted {
+		name := k
+		if !d.fullKeys && len(name) > 16 {
+			name = name[:16]
+		}
+		b, a := before.Peers[k], after.Peers[k]
+		switch {
+		case len(b) == 0:
+			for _, p := range a {
+				d.change("+", "%s on %s", name, d.describePeering(p))
+			}
+			continue
+		case len(a) == 0:
+			for _, p := range b {
+				d.change("-", "%s on %s", name, d.describePeering(p))
+			}
+			continue
+		}
+		// The node is a peer in both, so compare its peerings by port. A
+		// peering that came back on a new port shows as one removed and one
+		// added, which is what happened.
+		ports := map[types.SwitchPortID]snapshotPeer{}
+		for _, p := range b {
+			ports[p.Port] = p
+		}
+		for _, p := range a {
+			old, ok := ports[p.Port]
+			if !ok {
+				d.change("+", "%s on %s", name, d.describePeering(p))
+				continue
+			}
+			delete(ports, p.Port)
+			if changed := d.peeringChanges(old, p); len(changed) > 0 {
+				d.change("~", "%s on port %d: %s", name, p.Port, strings.Join(changed, ", "))
+			}
+		}
+		for _, p := range b {
+			if _, ok := ports[p.Port]; ok {
+				d.change("-", "%s on %s", name, d.describePeering(p))
+			}
+		}
+	}
+	d.printf("\n")
+}
+
+func (d *differ) peeringChanges(b, a snapshotPeer) []string {
+	var changed []string
+	if !b.Coords.EqualTo(a.Coords) {
+		changed = append(changed, fmt.Sprintf("coords %s -> %s", b.Coords, a.Coords))
+	}
+	if b.PeerType != a.PeerType {
+		changed = append(changed, fmt.Sprintf("type %s -> %s", peerType(b.PeerType), peerType(a.PeerType)))
+	}
+	if b.PeerZone != a.PeerZone {
+		changed = append(changed, fmt.Sprintf("zone %q -> %q", b.PeerZone, a.PeerZone))
+	}
+	if b.Quality != a.Quality {
+		changed = append(changed, fmt.Sprintf("quality %d -> %d", b.Quality, a.Quality))
+	}
+	if b.Demoted != a.Demoted {
+		changed = append(changed, fmt.Sprintf("demoted %v -> %v", b.Demoted, a.Demoted))
+	}
+	if rttChanged(b.RTT, a.RTT) {
+		changed = append(changed, fmt.Sprintf("rtt %s -> %s", b.RTT, a.RTT))
+	}
+	return changed
+}
+
+// rttChanged returns true if the RTT has at least doubled or halved, or if
+// it was only known in one of the snapshots.
+func rttChanged(b, a time.Duration) bool {
+	switch {
+	case b == a:
+		return false
+	case b == 0 || a == 0:
+		return true
+	default:
+		return a >= b*2 || b >= a*2
+	}
+}
+
+func (d *differ) root(r *types.Root) string {
+	if r == nil {
+		return "none"
+	}
+	return fmt.Sprintf("%s (sequence %d)", d.key(r.RootPublicKey), r.RootSequence)
+}
+
+func (d *differ) port(p *snapshotPort) string {
+	switch {
+	case p == nil:
+		return "none"
+	case p.Port == 0:
+		return "us"
+	default:
+		return fmt.Sprintf("%s on port %d", d.key(p.PublicKey), p.Port)
+	}
+}
+
+func (d *differ) diffTree(before, after *snapshot) {
+	d.section("Tree")
+	if b, a := d.root(before.Root), d.root(after.Root); b != a {
+		d.change("~", "root %s -> %s", b, a)
+	}
+	if !before.Coords.EqualTo(after.Coords) {
+		d.change("~", "coords %s (depth %d) -> %s (depth %d)", before.Coords, len(before.Coords), after.Coords, len(after.Coords))
+	}
+	if b, a := d.port(before.Parent), d.port(after.Parent); b != a {
+		d.change("~", "parent %s -> %s", b, a)
+	}
+	d.printf("\n")
+}
+
+func (d *differ) path(p snapshotPath) string {
+	return fmt.Sprintf("%s from %s to %s", d.key(p.PublicKey), d.port(p.Source), d.port(p.Destination))
+}
+
+func (d *differ) diffSNEK(before, after *snapshot) {
+	d.section(fmt.Sprintf("SNEK (%d paths before, %d after)", len(before.SNEK.Paths), len(after.SNEK.Paths)))
+	descending := func(p *snapshotPath) string {
+		if p == nil {
+			return "none"
+		}
+		return d.key(p.PublicKey)
+	}
+	if b, a := descending(before.SNEK.Descending), descending(after.SNEK.Descending); b != a {
+		d.change("~", "descending %s -> %s", b, a)
+	}
+	paths := map[types.PublicKey]snapshotPath{}
+	for _, p := range before.SNEK.Paths {
+		paths[p.PublicKey] = p
+	}
+	var added []snapshotPath
+	for _, p := range after.SNEK.Paths {
+		old, ok := paths[p.PublicKey]
+		if !ok {
+			added = append(added, p)
+			continue
+		}
+		delete(paths, p.PublicKey)
+		var changed []string
+		if b, a := d.port(old.Source), d.port(p.Source); b != a {
+			changed = append(changed, fmt.Sprintf("from %s -> %s", b, a))
+		}
+		if b, a := d.port(old.Destination), d.port(p.Destination); b != a {
+			changed = append(changed, fmt.Sprintf("to %s -> %s", b, a))
+		}
+		if old.Root != p.Root {
+			changed = append(changed, fmt.Sprintf("root %s -> %s", d.root(&old.Root), d.root(&p.Root)))
+		}
+		if len(changed) > 0 {
+			d.change("~", "path %s: %s", d.key(p.PublicKey), strings.Join(changed, ", "))
+		}
+	}
+	var removed []snapshotPath
+	for _, p := range paths {
+		removed = append(removed, p)
+	}
+	for _, list := range [][]snapshotPath{removed, added} {
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].PublicKey.CompareTo(list[j].PublicKey) < 0
+		})
+	}
+	for _, p := range removed {
+		d.change("-", "path %s", d.path(p))
+	}
+	for _, p := range added {
+		d.change("+", "path %s", d.path(p))
+	}
+}
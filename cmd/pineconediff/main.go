@@ -0,0 +1,65 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command pineconediff compares two snapshots of a node, as written by the
+// manhole, and prints what changed in its peers, its place in the tree and
+// its SNEK entries, so that a snapshot from when things worked can be
+// compared with one from when they broke. Either snapshot can be read from
+// stdin by giving "-". Like diff, it exits with 0 if the snapshots are the
+// same, 1 if they differ and 2 if something went wrong.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+func main() {
+	full := flag.Bool("full", false, "print public keys in full instead of the first 16 digits")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options] before.json after.json\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if flag.Arg(0) == "-" && flag.Arg(1) == "-" {
+		fmt.Fprintln(os.Stderr, "Only one snapshot can be read from stdin")
+		os.Exit(2)
+	}
+	before, err := loadSnapshot(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read snapshot: %s\n", err)
+		os.Exit(2)
+	}
+	after, err := loadSnapshot(flag.Arg(1))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read snapshot: %s\n", err)
+		os.Exit(2)
+	}
+
+	d := &differ{w: os.Stdout, fullKeys: *full}
+	changes, err := d.diff(before, after)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write diff: %s\n", err)
+		os.Exit(2)
+	}
+	if changes > 0 {
+		os.Exit(1)
+	}
+}
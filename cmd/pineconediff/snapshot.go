@@ -0,0 +1,105 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/matrix-org/pinecone/router"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// Snapshots are the JSON that the manhole handler writes, which is what
+// users attach to bug reports. Only the parts that the diff looks at are
+// read, and anything else in the snapshot is ignored, so that snapshots
+// from older and newer versions can still be compared.
+
+// snapshot is the state of a node as written by the manhole.
+type snapshot struct {
+	Public types.PublicKey           `json:"public_key"`
+	Coords types.Coordinates         `json:"coords"`
+	Root   *types.Root               `json:"root"`
+	Parent *snapshotPort             `json:"parent"`
+	Peers  map[string][]snapshotPeer `json:"peers"`
+	SNEK   struct {
+		Descending *snapshotPath  `json:"descending"`
+		Paths      []snapshotPath `json:"paths"`
+	} `json:"snek"`
+}
+
+// snapshotPort is a peering as written in SNEK entries and for the parent.
+type snapshotPort struct {
+	Port      types.SwitchPortID `json:"port"`
+	PublicKey types.PublicKey    `json:"public_key"`
+}
+
+type snapshotPeer struct {
+	Coords   types.Coordinates         `json:"coords"`
+	Port     types.SwitchPortID        `json:"port"`
+	PeerType router.ConnectionPeerType `json:"type"`
+	PeerZone router.ConnectionZone     `json:"zone"`
+	PeerURI  router.ConnectionURI      `json:"uri"`
+	Quality  int                       `json:"quality"`
+	Demoted  bool                      `json:"demoted"`
+	RTT      time.Duration             `json:"rtt"`
+}
+
+type snapshotPath struct {
+	PublicKey   types.PublicKey `json:"public_key"`
+	Source      *snapshotPort   `json:"source"`
+	Destination *snapshotPort   `json:"destination"`
+	Root        types.Root      `json:"root"`
+}
+
+// loadSnapshot reads a snapshot from a file, or from stdin if the path is
+// "-".
+func loadSnapshot(path string) (*snapshot, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close() // nolint:errcheck
+		r = f
+	}
+	var s snapshot
+	if err := json.NewDecoder(r).Decode(&s); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for key, peers := range s.Peers {
+		// The manhole lists our own router on port 0 among the peers.
+		remote := peers[:0]
+		for _, p := range peers {
+			if p.Port != 0 {
+				remote = append(remote, p)
+			}
+		}
+		if len(remote) == 0 {
+			delete(s.Peers, key)
+			continue
+		}
+		sort.Slice(remote, func(i, j int) bool {
+			return remote[i].Port < remote[j].Port
+		})
+		s.Peers[key] = remote
+	}
+	return &s, nil
+}
@@ -95,6 +95,7 @@ func main() {
 				conn,
 				router.ConnectionURI(conn.RemoteAddr().String()),
 				router.ConnectionPeerType(router.PeerTypeRemote),
+				router.ConnectionInbound(true),
 			)
 			if err != nil {
 				panic(err)
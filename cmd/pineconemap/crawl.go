@@ -0,0 +1,262 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/pinecone/router"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// The crawler starts from the seed nodes and asks each node that it finds
+// for its node info and for a debug summary. The node info says what the
+// node is, and the debug summary gives its place in the tree, its SNEK
+// neighbours and its peers, which are then crawled in turn. Nodes only
+// answer debug queries from keys that they allow, so the crawler needs to
+// run with such a key to find more than the seeds. Nodes that answer
+// neither are still put on the map if another node says that it peers with
+// them, but they aren't crawled any further.
+
+// Node is a node on the map.
+type Node struct {
+	PublicKey  string            `json:"public_key"`
+	Name       string            `json:"name,omitempty"`
+	Software   string            `json:"software,omitempty"`
+	Contact    string            `json:"contact,omitempty"`
+	Version    uint8             `json:"version,omitempty"`
+	Peers      int               `json:"peers,omitempty"`
+	Uptime     string            `json:"uptime,omitempty"`
+	Root       string            `json:"root,omitempty"`
+	Coords     types.Coordinates `json:"coords,omitempty"`
+	Depth      int               `json:"depth"` // Distance from the root, -1 if not known
+	Parent     string            `json:"parent,omitempty"`
+	Ascending  string            `json:"ascending,omitempty"`
+	Descending string            `json:"descending,omitempty"`
+	Paths      int               `json:"paths,omitempty"`
+	NodeInfo   bool              `json:"node_info"` // Did the node answer the node info query?
+	Debug      bool              `json:"debug"`     // Did the node answer the debug query?
+}
+
+// Edge is a link between two nodes on the map. Peer edges are undirected
+// and always go from the lower key to the higher key. Tree edges go from
+// child to parent and snake edges go from a node to its ascending node.
+type Edge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	Kind string `json:"kind"`
+}
+
+const (
+	edgePeer  = "peer"
+	edgeTree  = "tree"
+	edgeSnake = "snake"
+)
+
+// Map is the result of a crawl.
+type Map struct {
+	Crawled time.Time      `json:"crawled"`
+	Roots   map[string]int `json:"roots"` // How many nodes report each root
+	Nodes   []*Node        `json:"nodes"`
+	Edges   []Edge         `json:"edges"`
+}
+
+type crawler struct {
+	router   *router.Router
+	timeout  time.Duration
+	parallel int
+	limit    int
+	mutex    sync.Mutex
+	nodes    map[types.PublicKey]*Node // protected by mutex
+	edges    map[Edge]struct{}         // protected by mutex
+}
+
+// crawl walks the overlay from the seeds until there is nothing new to
+// crawl or until the limit on the number of nodes is reached.
+func (c *crawler) crawl(ctx context.Context, seeds []types.PublicKey) *Map {
+	c.nodes = map[types.PublicKey]*Node{}
+	c.edges = map[Edge]struct{}{}
+	queue := make(chan types.PublicKey, c.limit)
+	var wg sync.WaitGroup
+	enqueue := func(pk types.PublicKey) {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		if _, ok := c.nodes[pk]; ok || pk == c.router.PublicKey() || len(c.nodes) >= c.limit {
+			return
+		}
+		c.nodes[pk] = &Node{PublicKey: pk.String(), Depth: -1}
+		wg.Add(1)
+		queue <- pk
+	}
+	for _, pk := range seeds {
+		enqueue(pk)
+	}
+	for i := 0; i < c.parallel; i++ {
+		go func() {
+			for pk := range queue {
+				for _, next := range c.visit(ctx, pk) {
+					enqueue(next)
+				}
+				wg.Done()
+			}
+		}()
+	}
+	wg.Wait()
+	close(queue)
+	return c.result()
+}
+
+// visit queries the node and returns the nodes that it knows about.
+func (c *crawler) visit(ctx context.Context, pk types.PublicKey) []types.PublicKey {
+	infoCtx, infoCancel := context.WithTimeout(ctx, c.timeout)
+	info, infoErr := c.router.QueryNodeInfo(infoCtx, pk)
+	infoCancel()
+	debugCtx, debugCancel := context.WithTimeout(ctx, c.timeout)
+	debug, debugErr := c.router.QueryDebug(debugCtx, pk)
+	debugCancel()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	node := c.nodes[pk]
+	if infoErr == nil {
+		node.NodeInfo = true
+		node.Name = info.Metadata.Name
+		node.Software = info.Metadata.Software
+		node.Contact = info.Metadata.Contact
+		node.Version = info.ProtocolVersion
+		node.Peers = info.Peers
+		node.Uptime = info.Uptime.String()
+	}
+	if debugErr != nil {
+		return nil
+	}
+	var found []types.PublicKey
+	link := func(from, to types.PublicKey, kind string) {
+		if from == c.router.PublicKey() || to == c.router.PublicKey() {
+			return
+		}
+		if kind == edgePeer && to.CompareTo(from) < 0 {
+			from, to = to, from
+		}
+		c.edges[Edge{From: from.String(), To: to.String(), Kind: kind}] = struct{}{}
+	}
+	node.Debug = true
+	node.Root = debug.Root.RootPublicKey.String()
+	node.Coords = debug.Coords
+	node.Depth = len(debug.Coords)
+	node.Paths = debug.Paths
+	if debug.Parent != (types.PublicKey{}) {
+		node.Parent = debug.Parent.String()
+		link(pk, debug.Parent, edgeTree)
+		found = append(found, debug.Parent)
+	}
+	if debug.Ascending != (types.PublicKey{}) {
+		node.Ascending = debug.Ascending.String()
+		link(pk, debug.Ascending, edgeSnake)
+		found = append(found, debug.Ascending)
+	}
+	if debug.Descending != (types.PublicKey{}) {
+		node.Descending = debug.Descending.String()
+		found = append(found, debug.Descending)
+	}
+	for _, peer := range debug.Peers {
+		link(pk, peer.PublicKey, edgePeer)
+		found = append(found, peer.PublicKey)
+	}
+	return found
+}
+
+// result returns the map of everything that has been crawled, in a stable
+// order so that maps of the same network can be compared.
+func (c *crawler) result() *Map {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	m := &Map{
+		Crawled: time.Now().UTC(),
+		Roots:   map[string]int{},
+	}
+	for _, node := range c.nodes {
+		if node.Root != "" {
+			m.Roots[node.Root]++
+		}
+		m.Nodes = append(m.Nodes, node)
+	}
+	sort.Slice(m.Nodes, func(i, j int) bool {
+		return m.Nodes[i].PublicKey < m.Nodes[j].PublicKey
+	})
+	for edge := range c.edges {
+		m.Edges = append(m.Edges, edge)
+	}
+	sort.Slice(m.Edges, func(i, j int) bool {
+		a, b := m.Edges[i], m.Edges[j]
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		if a.From != b.From {
+			return a.From < b.From
+		}
+		return a.To < b.To
+	})
+	return m
+}
+
+// writeDOT writes the map in the Graphviz format. Peerings are drawn as
+// plain lines, tree edges as bold arrows towards the parent and snake edges
+// as dashed arrows towards the ascending node. Roots are drawn as boxes.
+func (m *Map) writeDOT(w io.Writer) error {
+	if _, err := fmt.Fprintln(w, "digraph pinecone {"); err != nil {
+		return err
+	}
+	for _, node := range m.Nodes {
+		label := node.PublicKey[:8]
+		if node.Name != "" {
+			label = fmt.Sprintf("%s\n%s", node.Name, label)
+		}
+		if node.Depth >= 0 {
+			label = fmt.Sprintf("%s\ndepth %d", label, node.Depth)
+		}
+		attrs := fmt.Sprintf("label=%q", label)
+		switch {
+		case m.Roots[node.PublicKey] > 0:
+			attrs += " shape=box"
+		case !node.Debug && !node.NodeInfo:
+			attrs += " style=dotted"
+		}
+		if _, err := fmt.Fprintf(w, "  %q [%s];\n", node.PublicKey, attrs); err != nil {
+			return err
+		}
+	}
+	for _, edge := range m.Edges {
+		var attrs string
+		switch edge.Kind {
+		case edgePeer:
+			attrs = "dir=none color=gray"
+		case edgeTree:
+			attrs = "style=bold"
+		case edgeSnake:
+			attrs = "style=dashed color=blue constraint=false"
+		}
+		if _, err := fmt.Fprintf(w, "  %q -> %q [%s];\n", edge.From, edge.To, attrs); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintln(w, "}")
+	return err
+}
@@ -0,0 +1,162 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command pineconemap crawls a Pinecone network and writes out a map of it,
+// for operators of public test networks. It joins the network through the
+// given peers and then walks it using node info and debug queries, starting
+// from the seed nodes, or from the nodes that it peers with if no seeds are
+// given. The map can be written as JSON or in the Graphviz format.
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/matrix-org/pinecone/connections"
+	"github.com/matrix-org/pinecone/router"
+	"github.com/matrix-org/pinecone/types"
+)
+
+func main() {
+	connect := flag.String("connect", "", "peers to join the network through, separated by commas")
+	seeds := flag.String("seeds", "", "hexadecimal public keys of the nodes to start crawling from, separated by commas")
+	secretkey := flag.String("secretkey", "", "hexadecimal encoded ed25519 key, which nodes must allow to make debug queries")
+	format := flag.String("format", "json", "output format, either json or dot")
+	output := flag.String("output", "", "file to write the map to instead of stdout")
+	limit := flag.Int("limit", 1000, "maximum number of nodes to crawl")
+	parallel := flag.Int("parallel", 8, "number of nodes to query at once")
+	timeout := flag.Duration("timeout", time.Second*5, "how long to wait for each node to answer")
+	wait := flag.Duration("wait", time.Second*30, "how long to wait for the router to join the network")
+	verbose := flag.Bool("verbose", false, "log what the router is doing")
+	flag.Parse()
+
+	if *format != "json" && *format != "dot" {
+		log.Fatalf("Unknown format %q", *format)
+	}
+	if *connect == "" {
+		log.Fatalf("At least one peer must be given with -connect")
+	}
+
+	var sk ed25519.PrivateKey
+	if len(*secretkey) != 0 {
+		secretkeyHex, err := hex.DecodeString(*secretkey)
+		if err != nil {
+			log.Fatalf("Invalid secret key: %s", err)
+		}
+		sk = ed25519.NewKeyFromSeed(secretkeyHex)
+	} else {
+		var err error
+		if _, sk, err = ed25519.GenerateKey(nil); err != nil {
+			panic(err)
+		}
+	}
+
+	var seedKeys []types.PublicKey
+	if *seeds != "" {
+		for _, seed := range strings.Split(*seeds, ",") {
+			var pk types.PublicKey
+			b, err := hex.DecodeString(strings.TrimSpace(seed))
+			if err != nil || len(b) != ed25519.PublicKeySize {
+				log.Fatalf("Invalid seed %q", seed)
+			}
+			copy(pk[:], b)
+			seedKeys = append(seedKeys, pk)
+		}
+	}
+
+	var logger types.Logger
+	if *verbose {
+		logger = log.New(os.Stderr, "", 0)
+	}
+	pineconeRouter := router.NewRouter(logger, sk, router.RouterOptionBlackhole(true))
+	defer pineconeRouter.Close() // nolint:errcheck
+	pineconeManager := connections.NewConnectionManager(pineconeRouter, nil)
+	defer pineconeManager.Close()
+	for _, peer := range strings.Split(*connect, ",") {
+		pineconeManager.AddPeer(strings.TrimSpace(peer))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		<-sigs
+		cancel()
+	}()
+
+	// Wait until we have joined the tree, so that queries can be routed.
+	deadline := time.Now().Add(*wait)
+	for pineconeRouter.TotalPeerCount() == 0 || len(pineconeRouter.Coords()) == 0 {
+		if time.Now().After(deadline) || ctx.Err() != nil {
+			log.Fatalf("Failed to join the network")
+		}
+		time.Sleep(time.Millisecond * 250)
+	}
+	if len(seedKeys) == 0 {
+		for _, peer := range pineconeRouter.Peers() {
+			if peer.Port == 0 {
+				continue
+			}
+			pk, err := hex.DecodeString(peer.PublicKey)
+			if err != nil || len(pk) != ed25519.PublicKeySize {
+				continue
+			}
+			var seed types.PublicKey
+			copy(seed[:], pk)
+			seedKeys = append(seedKeys, seed)
+		}
+	}
+
+	c := &crawler{
+		router:   pineconeRouter,
+		timeout:  *timeout,
+		parallel: *parallel,
+		limit:    *limit,
+	}
+	m := c.crawl(ctx, seedKeys)
+	fmt.Fprintf(os.Stderr, "Crawled %d nodes with %d edges and %d roots\n", len(m.Nodes), len(m.Edges), len(m.Roots))
+
+	w := os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			log.Fatalf("Failed to create output file: %s", err)
+		}
+		defer f.Close() // nolint:errcheck
+		w = f
+	}
+	switch *format {
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(m); err != nil {
+			log.Fatalf("Failed to write map: %s", err)
+		}
+	case "dot":
+		if err := m.writeDOT(w); err != nil {
+			log.Fatalf("Failed to write map: %s", err)
+		}
+	}
+}
@@ -16,6 +16,7 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
@@ -39,17 +40,28 @@ const maxBatchSize int = 50
 var ConnUID atomic.Uint64 = atomic.Uint64{}
 
 func main() {
-	go func() {
-		panic(http.ListenAndServe(":65432", nil))
-	}()
-
 	filename := flag.String("filename", "cmd/pineconesim/graphs/empty.txt", "the file that describes the simulated topology")
 	sockets := flag.Bool("sockets", false, "use real TCP sockets to connect simulated nodes")
 	chaos := flag.Int("chaos", 0, "randomly connect and disconnect a certain number of links")
 	acceptCommands := flag.Bool("acceptCommands", true, "whether the sim can be commanded from the ui")
 	hopLimiting := flag.Bool("hopLimiting", false, "whether to enable hop limiting for protocol and overlay frames")
+	scenario := flag.String("scenario", "", "run the given event sequence file without the ui, write the metrics and exit")
+	metrics := flag.String("metrics", "-", "the file to write the metrics of a scenario to, or - for stdout")
+	format := flag.String("format", "json", "the format of the metrics of a scenario, either json or csv")
+	convergeTimeout := flag.Duration("convergeTimeout", time.Minute, "how long to wait for the network to converge at the end of a scenario")
 	flag.Parse()
 
+	headless := *scenario != ""
+	if headless && *format != "json" && *format != "csv" {
+		fmt.Fprintf(os.Stderr, "unknown metrics format %q\n", *format)
+		os.Exit(2)
+	}
+	if !headless {
+		go func() {
+			panic(http.ListenAndServe(":65432", nil))
+		}()
+	}
+
 	file, err := os.Open(*filename)
 	if err != nil {
 		panic(err)
@@ -78,9 +90,16 @@ func main() {
 		}
 	}
 
-	log := log.New(os.Stdout, "\u001b[36m***\u001b[0m ", 0)
+	logOutput := os.Stdout
+	if headless {
+		// Keep stdout for the metrics.
+		logOutput = os.Stderr
+	}
+	log := log.New(logOutput, "\u001b[36m***\u001b[0m ", 0)
 	sim := simulator.NewSimulator(log, *sockets, *acceptCommands, *hopLimiting)
-	configureHTTPRouting(log, sim)
+	if !headless {
+		configureHTTPRouting(log, sim)
+	}
 
 	for n := range nodes {
 		if err := sim.CreateNode(n, simulator.DefaultNode); err != nil {
@@ -156,11 +175,60 @@ func main() {
 		}()
 	}
 
+	if headless {
+		os.Exit(runScenario(log, sim, *scenario, *metrics, *format, *convergeTimeout))
+	}
+
 	log.Println("Configuring HTTP listener")
 
 	select {}
 }
 
+// runScenario runs the scenario without the ui and writes the metrics, and
+// returns the exit code: 1 if any of the scenario's assertions failed, or 2
+// if the scenario couldn't be run.
+func runScenario(log *log.Logger, sim *simulator.Simulator, filename, output, format string, timeout time.Duration) int {
+	scenario, err := simulator.LoadScenario(filename)
+	if err != nil {
+		log.Printf("Failed loading scenario %s: %s", filename, err)
+		return 2
+	}
+	metrics, err := sim.RunScenario(filename, scenario, timeout)
+	if err != nil {
+		log.Printf("Failed running scenario %s: %s", filename, err)
+		return 2
+	}
+
+	w := os.Stdout
+	if output != "-" {
+		if w, err = os.Create(output); err != nil {
+			log.Printf("Failed creating metrics file: %s", err)
+			return 2
+		}
+		defer w.Close() // nolint:errcheck
+	}
+	switch format {
+	case "csv":
+		err = metrics.WriteCSV(w)
+	default:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(metrics)
+	}
+	if err != nil {
+		log.Printf("Failed writing metrics: %s", err)
+		return 2
+	}
+
+	for _, failure := range metrics.Failures {
+		log.Printf("Assertion failed: %s", failure)
+	}
+	if len(metrics.Failures) > 0 {
+		return 1
+	}
+	return 0
+}
+
 func configureHTTPRouting(log *log.Logger, sim *simulator.Simulator) {
 	var upgrader = websocket.Upgrader{}
 	http.Handle("/ui/", http.StripPrefix("/ui/", http.FileServer(http.Dir("./cmd/pineconesim/ui"))))
@@ -223,6 +291,16 @@ func configureHTTPRouting(log *log.Logger, sim *simulator.Simulator) {
 		node.SimRouter.ManholeHandler(w, r)
 	})
 
+	http.DefaultServeMux.HandleFunc("/history", func(w http.ResponseWriter, r *http.Request) {
+		nodeID := r.URL.Query().Get("node")
+		node := sim.Node(nodeID)
+		if node == nil {
+			w.WriteHeader(404)
+			return
+		}
+		node.SimRouter.ProtocolHistoryHandler(w, r)
+	})
+
 	http.DefaultServeMux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		_ = template.Must(template.ParseFiles("./cmd/pineconesim/page.html")).Execute(w, "")
 	})
@@ -391,6 +469,10 @@ func handleSimEvents(log *log.Logger, conn *websocket.Conn, ch <-chan simulator.
 			eventType = simulator.SimBroadcastReceived
 		case simulator.BandwidthReport:
 			eventType = simulator.SimBandwidthReport
+		case simulator.HandoverReport:
+			eventType = simulator.SimHandoverReport
+		case simulator.TrafficReport:
+			eventType = simulator.SimTrafficReport
 		}
 
 		if err := conn.WriteJSON(simulator.StateUpdateMsg{
@@ -143,6 +143,18 @@ func (a *AdversaryRouter) Coords() types.Coordinates {
 	return a.rtr.Coords()
 }
 
+func (a *AdversaryRouter) WriteToWithClass(p []byte, addr net.Addr, class types.TrafficClass) (int, error) {
+	return a.rtr.WriteToWithClass(p, addr, class)
+}
+
+func (a *AdversaryRouter) EnergyStats() router.EnergyStats {
+	return a.rtr.EnergyStats()
+}
+
+func (a *AdversaryRouter) HopLimitExpiries() uint64 {
+	return a.rtr.HopLimitExpiries()
+}
+
 func (a *AdversaryRouter) ConfigureFilterDefaults(rates DropRates) {
 	a.dropSettings.overall = rates
 }
@@ -155,6 +167,18 @@ func (a *AdversaryRouter) ManholeHandler(w http.ResponseWriter, req *http.Reques
 	a.rtr.ManholeHandler(w, req)
 }
 
+func (a *AdversaryRouter) ProtocolHistoryHandler(w http.ResponseWriter, req *http.Request) {
+	a.rtr.ProtocolHistoryHandler(w, req)
+}
+
+func (a *AdversaryRouter) SNEKSnapshot() router.SNEKSnapshot {
+	return a.rtr.SNEKSnapshot()
+}
+
+func (a *AdversaryRouter) ProtocolHistory(q router.ProtocolHistoryQuery) []router.ProtocolEvent {
+	return a.rtr.ProtocolHistory(q)
+}
+
 func (a *AdversaryRouter) updatePacketCounts(from types.PublicKey, frameType types.FrameType) {
 	a.packetsRx.overall.Inc()
 	a.packetsRx.peers[from].overall.Inc()
@@ -47,6 +47,8 @@ const (
 	SimNetworkStatsUpdated
 	SimBroadcastReceived
 	SimBandwidthReport
+	SimHandoverReport
+	SimTrafficReport
 )
 
 const (
@@ -63,12 +65,16 @@ const (
 	SimConfigureAdversaryPeer
 	SimStartPings
 	SimStopPings
+	SimHandover
+	SimStartTraffic
+	SimStopTraffic
 )
 
 const (
 	UnknownType APINodeType = iota
 	DefaultNode
 	GeneralAdversaryNode
+	LegacyNode
 )
 
 type InitialNodeState struct {
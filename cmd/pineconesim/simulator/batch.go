@@ -0,0 +1,567 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/router"
+)
+
+// A batch run plays a scenario straight through without the UI and then
+// measures the network, so that experiments can be scripted. While the
+// scenario runs, the network is checked every batchConvergencePoll to see
+// whether it has converged: in each connected part of the network, every
+// node must have the strongest key in that part as its root and the next
+// key down as its descending node. Each topology change is converged once
+// the network is next seen to be converged, so a change that is followed by
+// another before the network settles is timed until both have settled. At
+// the end, every node pings every other node that it can reach, and the
+// answers give the delivery rate and the stretch. The control overhead is
+// everything sent over the links while the scenario ran, which includes any
+// pings or generated traffic that the scenario started itself. Traffic
+// generators that are still running at the end are stopped, and the reports
+// of all of them are included. The work that each node did while the
+// scenario ran, which is what would drain its battery, is measured at the
+// same point as the control overhead, so the final pings aren't included.
+//
+// With hop limiting enabled, frames that run out of hops are almost always
+// going round in a loop. These are counted throughout, and the ones that
+// happen while the network is converged, which includes the final pings,
+// are counted separately, since there shouldn't be any. Pings that end up
+// at a node other than the destination are answered as unreachable, so a
+// ping is also sent from each part of the network to every other part to
+// check that they are, and any ping to a node that could be reached which
+// comes back unreachable is counted.
+
+// batchConvergencePoll is how often the network is checked for convergence
+// during a batch run.
+const batchConvergencePoll = time.Millisecond * 100
+
+// ConvergenceTime is how long the network took to converge after a
+// topology change.
+type ConvergenceTime struct {
+	Command   string
+	Time      uint64 // Time from the change until the network converged in ms
+	Converged bool   // Whether the network converged before the timeout
+}
+
+// BatchMetrics are the results of a batch run.
+type BatchMetrics struct {
+	Scenario            string
+	Nodes               int
+	Links               int
+	Duration            uint64 // Time taken to run the scenario in ms
+	Changes             []ConvergenceTime
+	Converged           int     // Topology changes that converged
+	Unconverged         int     // Topology changes that didn't converge in time
+	MeanConvergence     float64 // Average time to converge in ms
+	MaxConvergence      uint64  // Longest time to converge in ms
+	PingsSent           int
+	PingsAnswered       int
+	PingsUnreachable    int     // Pings to nodes that could be reached which came back unreachable
+	DeliveryRate        float64 // Percentage of pings that were answered
+	AverageStretch      float64
+	ControlBytes        uint64  // Bytes sent over the links while the scenario ran
+	ControlOverhead     float64 // Link bytes per node per second
+	HopLimiting         bool
+	HopLimitExpiries    uint64 // Frames that ran out of hops
+	StableExpiries      uint64 // Frames that ran out of hops while the network was converged
+	UnreachableSent     int    // Pings to nodes in other parts of the network
+	UnreachableReported int    // Of those, the ones that came back unreachable
+	Handovers           []HandoverReport
+	Traffic             []TrafficReport
+	Energy              []NodeEnergy           // Work done by each node while the scenario ran
+	EnergyTotal         router.EnergyStats     // Work done by all of the nodes
+	SNEKViolations      []router.SNEKViolation // Found by router.VerifySNEK at the end
+	Failures            []string               // Assertions that weren't met
+}
+
+type pendingChange struct {
+	index   int
+	started time.Time
+}
+
+// RunScenario runs the scenario to completion, waiting up to the given
+// timeout for the network to converge after the last command, and returns
+// the metrics with any assertions that failed.
+func (sim *Simulator) RunScenario(name string, scenario *Scenario, timeout time.Duration) (*BatchMetrics, error) {
+	commands, err := scenario.Commands()
+	if err != nil {
+		return nil, err
+	}
+	metrics := &BatchMetrics{Scenario: name, HopLimiting: sim.hopLimitingEnabled}
+
+	// Collect the handover reports as they are published.
+	events := make(chan SimEvent)
+	sim.State.Subscribe(events)
+	var handovers []HandoverReport
+	collected := make(chan struct{})
+	stopCollecting := make(chan struct{})
+	go func() {
+		defer close(collected)
+		for {
+			select {
+			case <-stopCollecting:
+				return
+			case event := <-events:
+				if report, ok := event.(HandoverReport); ok {
+					handovers = append(handovers, report)
+				}
+			}
+		}
+	}()
+
+	var mutex sync.Mutex
+	var pending []pendingChange
+	settled := func(now time.Time) {
+		for _, change := range pending {
+			metrics.Changes[change.index].Time = uint64(now.Sub(change.started).Milliseconds())
+			metrics.Changes[change.index].Converged = true
+		}
+		pending = pending[:0]
+	}
+	stopPolling := make(chan struct{})
+	polled := make(chan struct{})
+	go func() {
+		defer close(polled)
+		ticker := time.NewTicker(batchConvergencePoll)
+		defer ticker.Stop()
+		last, wasStable := sim.hopLimitExpiries(), false
+		for {
+			select {
+			case <-stopPolling:
+				return
+			case <-ticker.C:
+			}
+			expiries, converged := sim.hopLimitExpiries(), sim.converged()
+			mutex.Lock()
+			// Loops are only counted against a stable network if it was
+			// converged with nothing waiting both before and after.
+			stable := converged && len(pending) == 0
+			if expiries > last {
+				metrics.HopLimitExpiries += expiries - last
+				if stable && wasStable {
+					metrics.StableExpiries += expiries - last
+				}
+			}
+			last, wasStable = expiries, stable
+			if converged {
+				settled(time.Now())
+			}
+			mutex.Unlock()
+		}
+	}()
+
+	start, energy := sim.linkBytes.Load(), sim.energyStats()
+	started := time.Now()
+	for _, cmd := range commands {
+		switch cmd.(type) {
+		case Play, Pause:
+			// There is nothing to pause in a batch run.
+			continue
+		case AddNode, RemoveNode, AddPeer, RemovePeer:
+			mutex.Lock()
+			pending = append(pending, pendingChange{len(metrics.Changes), time.Now()})
+			metrics.Changes = append(metrics.Changes, ConvergenceTime{Command: fmt.Sprint(cmd)})
+			mutex.Unlock()
+		}
+		cmd.Run(sim.log, sim)
+	}
+
+	// Give the network a chance to converge after the last command.
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		mutex.Lock()
+		waiting := len(pending)
+		mutex.Unlock()
+		if waiting == 0 && sim.converged() {
+			break
+		}
+		time.Sleep(batchConvergencePoll)
+	}
+	close(stopPolling)
+	<-polled
+	metrics.Traffic = sim.stopAllTraffic()
+	for _, change := range pending {
+		metrics.Changes[change.index].Time = uint64(time.Since(change.started).Milliseconds())
+	}
+	elapsed := time.Since(started)
+	metrics.Duration = uint64(elapsed.Milliseconds())
+	metrics.ControlBytes = sim.linkBytes.Load() - start
+	metrics.Energy, metrics.EnergyTotal = energyUsed(energy, sim.energyStats())
+	if sim.pingEnabled {
+		sim.StopPings()
+	}
+
+	metrics.Nodes, metrics.Links = len(sim.Nodes()), sim.linkCount()
+	if metrics.Nodes > 0 && elapsed > 0 {
+		metrics.ControlOverhead = float64(metrics.ControlBytes) / float64(metrics.Nodes) / elapsed.Seconds()
+	}
+	var total uint64
+	for _, change := range metrics.Changes {
+		if !change.Converged {
+			metrics.Unconverged++
+			continue
+		}
+		metrics.Converged++
+		total += change.Time
+		if change.Time > metrics.MaxConvergence {
+			metrics.MaxConvergence = change.Time
+		}
+	}
+	if metrics.Converged > 0 {
+		metrics.MeanConvergence = float64(total) / float64(metrics.Converged)
+	}
+
+	sim.GenerateNetworkGraph()
+	sim.UpdateRealDistances()
+	stable, expiries := sim.converged(), sim.hopLimitExpiries()
+	metrics.SNEKViolations = sim.verifySNEK()
+	metrics.PingsSent, metrics.PingsAnswered, metrics.PingsUnreachable, metrics.AverageStretch = sim.pingAll()
+	if metrics.PingsSent > 0 {
+		metrics.DeliveryRate = float64(metrics.PingsAnswered) / float64(metrics.PingsSent) * 100
+	}
+	metrics.UnreachableSent, metrics.UnreachableReported = sim.probeUnreachable()
+	if after := sim.hopLimitExpiries(); after > expiries {
+		metrics.HopLimitExpiries += after - expiries
+		if stable {
+			metrics.StableExpiries += after - expiries
+		}
+	}
+
+	close(stopCollecting)
+	<-collected
+	metrics.Handovers = handovers
+	metrics.Failures = scenario.Assertions.check(metrics)
+	return metrics, nil
+}
+
+// components returns the nodes in each connected part of the network.
+func (sim *Simulator) components() [][]string {
+	links := map[string][]string{}
+	sim.wiresMutex.RLock()
+	for a, aa := range sim.wires {
+		for b, conn := range aa {
+			if conn != nil {
+				links[a] = append(links[a], b)
+				links[b] = append(links[b], a)
+			}
+		}
+	}
+	sim.wiresMutex.RUnlock()
+
+	seen := map[string]bool{}
+	var components [][]string
+	for start := range sim.Nodes() {
+		if seen[start] {
+			continue
+		}
+		seen[start] = true
+		component := []string{start}
+		for i := 0; i < len(component); i++ {
+			for _, next := range links[component[i]] {
+				if !seen[next] {
+					seen[next] = true
+					component = append(component, next)
+				}
+			}
+		}
+		components = append(components, component)
+	}
+	return components
+}
+
+// linkCount returns the number of links that are connected.
+func (sim *Simulator) linkCount() int {
+	sim.wiresMutex.RLock()
+	defer sim.wiresMutex.RUnlock()
+	count := 0
+	for _, aa := range sim.wires {
+		for _, conn := range aa {
+			if conn != nil {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// converged returns true if every node agrees on the root and has the right
+// descending node for the part of the network that it is in.
+func (sim *Simulator) converged() bool {
+	type nodeState struct {
+		key, root, descending string
+	}
+	states := map[string]nodeState{}
+	phony.Block(sim.State, func() {
+		for name, node := range sim.State._state.Nodes {
+			states[name] = nodeState{node.PeerID, node.Announcement.Root, node.DescendingPeer}
+		}
+	})
+	for _, component := range sim.components() {
+		for _, name := range component {
+			if _, ok := states[name]; !ok {
+				return false
+			}
+		}
+		// The keys are hex encoded, so they sort in the same order as the
+		// keys themselves.
+		sort.Slice(component, func(i, j int) bool {
+			return states[component[i]].key < states[component[j]].key
+		})
+		root := component[len(component)-1]
+		for i, name := range component {
+			descending := ""
+			if i > 0 {
+				descending = component[i-1]
+			}
+			if state := states[name]; state.root != root || state.descending != descending {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// pingAll pings from every default node to every other default node that it
+// is connected to, and returns how many pings were sent, answered and came
+// back unreachable, and the average stretch of the answered pings.
+func (sim *Simulator) pingAll() (sent, answered, unreachable int, stretch float64) {
+	nodes, dists := sim.Nodes(), sim.Distances()
+	tasks := make(chan pair, len(nodes)*len(nodes))
+	for _, component := range sim.components() {
+		for _, from := range component {
+			for _, to := range component {
+				if from != to && nodes[from].answersPings() && nodes[to].answersPings() {
+					tasks <- pair{from, to}
+				}
+			}
+		}
+	}
+	close(tasks)
+	sent = len(tasks)
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	numWorkers := int(math.Min(12, float64(runtime.NumCPU())))
+	wg.Add(numWorkers)
+	for i := 0; i < numWorkers; i++ {
+		go func() {
+			defer wg.Done()
+			for pair := range tasks {
+				hops, _, err := sim.Ping(pair.from, pair.to)
+				if errors.Is(err, ErrDestinationUnreachable) {
+					mutex.Lock()
+					unreachable++
+					mutex.Unlock()
+				}
+				if err != nil {
+					continue
+				}
+				mutex.Lock()
+				answered++
+				if dist := dists[pair.from][pair.to]; dist != nil && dist.Real > 0 {
+					stretch += float64(hops) / float64(dist.Real)
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if answered > 0 {
+		stretch /= float64(answered)
+	}
+	return sent, answered, unreachable, stretch
+}
+
+// probeUnreachable pings from a default node in each part of the network to
+// a default node in every other part, and returns how many pings were sent
+// and how many came back unreachable, which they all should.
+func (sim *Simulator) probeUnreachable() (sent, reported int) {
+	nodes := sim.Nodes()
+	var chosen []string
+	for _, component := range sim.components() {
+		for _, name := range component {
+			if nodes[name].answersPings() {
+				chosen = append(chosen, name)
+				break
+			}
+		}
+	}
+	tasks := make(chan pair, len(chosen)*len(chosen))
+	for _, from := range chosen {
+		for _, to := range chosen {
+			if from != to {
+				tasks <- pair{from, to}
+			}
+		}
+	}
+	close(tasks)
+	sent = len(tasks)
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	numWorkers := int(math.Min(12, float64(runtime.NumCPU())))
+	wg.Add(numWorkers)
+	for i := 0; i < numWorkers; i++ {
+		go func() {
+			defer wg.Done()
+			for pair := range tasks {
+				if _, _, err := sim.Ping(pair.from, pair.to); errors.Is(err, ErrDestinationUnreachable) {
+					mutex.Lock()
+					reported++
+					mutex.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return sent, reported
+}
+
+// verifySNEK checks the SNEK state of all of the nodes against each other.
+func (sim *Simulator) verifySNEK() []router.SNEKViolation {
+	sim.nodesMutex.RLock()
+	nodes := make([]router.SNEKVerifiable, 0, len(sim.nodes))
+	for _, node := range sim.nodes {
+		nodes = append(nodes, node)
+	}
+	sim.nodesMutex.RUnlock()
+	return router.VerifySNEK(nodes)
+}
+
+// hopLimitExpiries returns how many frames have run out of hops on all of
+// the nodes that are still there.
+func (sim *Simulator) hopLimitExpiries() uint64 {
+	sim.nodesMutex.RLock()
+	defer sim.nodesMutex.RUnlock()
+	var total uint64
+	for _, node := range sim.nodes {
+		total += node.HopLimitExpiries()
+	}
+	return total
+}
+
+func (a ScenarioAssertions) check(metrics *BatchMetrics) []string {
+	var failures []string
+	if a.Converged && metrics.Unconverged > 0 {
+		failures = append(failures, fmt.Sprintf("%d topology changes didn't converge", metrics.Unconverged))
+	}
+	if a.MaxConvergenceTime != nil && metrics.MaxConvergence > *a.MaxConvergenceTime {
+		failures = append(failures, fmt.Sprintf("convergence took %dms, more than %dms", metrics.MaxConvergence, *a.MaxConvergenceTime))
+	}
+	if a.MinDeliveryRate != nil && metrics.DeliveryRate < *a.MinDeliveryRate {
+		failures = append(failures, fmt.Sprintf("delivery rate was %.1f%%, less than %.1f%%", metrics.DeliveryRate, *a.MinDeliveryRate))
+	}
+	if a.MaxStretch != nil && metrics.AverageStretch > *a.MaxStretch {
+		failures = append(failures, fmt.Sprintf("stretch was %.2f, more than %.2f", metrics.AverageStretch, *a.MaxStretch))
+	}
+	if a.MaxControlOverhead != nil && metrics.ControlOverhead > *a.MaxControlOverhead {
+		failures = append(failures, fmt.Sprintf("control overhead was %.0f bytes/node/s, more than %.0f", metrics.ControlOverhead, *a.MaxControlOverhead))
+	}
+	if a.NoLoops {
+		switch {
+		case !metrics.HopLimiting:
+			failures = append(failures, "hop limiting is disabled, so loops can't be detected")
+		case metrics.StableExpiries > 0:
+			failures = append(failures, fmt.Sprintf("%d frames ran out of hops while the network was converged", metrics.StableExpiries))
+		}
+	}
+	if a.SNEKInvariants && len(metrics.SNEKViolations) > 0 {
+		failures = append(failures, fmt.Sprintf("%d SNEK invariants were violated, the first was %s", len(metrics.SNEKViolations), metrics.SNEKViolations[0]))
+	}
+	if a.Unreachable {
+		if missed := metrics.UnreachableSent - metrics.UnreachableReported; missed > 0 {
+			failures = append(failures, fmt.Sprintf("%d of %d pings to unreachable nodes didn't come back unreachable", missed, metrics.UnreachableSent))
+		}
+		if metrics.PingsUnreachable > 0 {
+			failures = append(failures, fmt.Sprintf("%d pings to reachable nodes came back unreachable", metrics.PingsUnreachable))
+		}
+	}
+	return failures
+}
+
+// WriteCSV writes the metrics as a header and a single row, leaving out the
+// individual changes, handovers and nodes, so that the rows from many runs
+// can be put together.
+func (m *BatchMetrics) WriteCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	_ = writer.Write([]string{
+		"Scenario", "Nodes", "Links", "Duration", "Converged", "Unconverged",
+		"MeanConvergence", "MaxConvergence", "PingsSent", "PingsAnswered",
+		"DeliveryRate", "AverageStretch", "ControlBytes", "ControlOverhead",
+		"PingsUnreachable", "HopLimitExpiries", "StableExpiries",
+		"UnreachableSent", "UnreachableReported",
+		"Handovers", "TrafficSent", "TrafficDelivered", "TrafficLatency",
+		"FramesSent", "FramesReceived", "Signatures", "Verifications", "Wakeups",
+		"SNEKViolations", "Failures",
+	})
+	var sent, delivered uint64
+	var latency float64
+	for _, report := range m.Traffic {
+		sent += report.Sent
+		delivered += report.Delivered
+		latency += report.Latency * float64(report.Delivered)
+	}
+	if delivered > 0 {
+		latency /= float64(delivered)
+	}
+	_ = writer.Write([]string{
+		m.Scenario,
+		strconv.Itoa(m.Nodes),
+		strconv.Itoa(m.Links),
+		strconv.FormatUint(m.Duration, 10),
+		strconv.Itoa(m.Converged),
+		strconv.Itoa(m.Unconverged),
+		strconv.FormatFloat(m.MeanConvergence, 'f', 1, 64),
+		strconv.FormatUint(m.MaxConvergence, 10),
+		strconv.Itoa(m.PingsSent),
+		strconv.Itoa(m.PingsAnswered),
+		strconv.FormatFloat(m.DeliveryRate, 'f', 2, 64),
+		strconv.FormatFloat(m.AverageStretch, 'f', 3, 64),
+		strconv.FormatUint(m.ControlBytes, 10),
+		strconv.FormatFloat(m.ControlOverhead, 'f', 1, 64),
+		strconv.Itoa(m.PingsUnreachable),
+		strconv.FormatUint(m.HopLimitExpiries, 10),
+		strconv.FormatUint(m.StableExpiries, 10),
+		strconv.Itoa(m.UnreachableSent),
+		strconv.Itoa(m.UnreachableReported),
+		strconv.Itoa(len(m.Handovers)),
+		strconv.FormatUint(sent, 10),
+		strconv.FormatUint(delivered, 10),
+		strconv.FormatFloat(latency, 'f', 2, 64),
+		strconv.FormatUint(m.EnergyTotal.FramesSent, 10),
+		strconv.FormatUint(m.EnergyTotal.FramesReceived, 10),
+		strconv.FormatUint(m.EnergyTotal.Signatures, 10),
+		strconv.FormatUint(m.EnergyTotal.Verifications, 10),
+		strconv.FormatUint(m.EnergyTotal.Wakeups, 10),
+		strconv.Itoa(len(m.SNEKViolations)),
+		strings.Join(m.Failures, "; "),
+	})
+	writer.Flush()
+	return writer.Error()
+}
@@ -207,6 +207,97 @@ func UnmarshalCommandJSON(command *SimCommandMsg) (SimCommand, error) {
 		msg = StartPings{}
 	case SimStopPings:
 		msg = StopPings{}
+	case SimHandover:
+		node := ""
+		from := ""
+		to := ""
+		peer := ""
+		gap := uint64(0)
+		settle := uint64(0)
+		if val, ok := command.Event.(map[string]interface{})["Node"]; ok {
+			node = val.(string)
+		} else {
+			err = fmt.Errorf("%sHandover.Node field doesn't exist", FAILURE_PREAMBLE)
+		}
+		if val, ok := command.Event.(map[string]interface{})["From"]; ok {
+			from = val.(string)
+		} else {
+			err = fmt.Errorf("%sHandover.From field doesn't exist", FAILURE_PREAMBLE)
+		}
+		if val, ok := command.Event.(map[string]interface{})["To"]; ok {
+			to = val.(string)
+		} else {
+			err = fmt.Errorf("%sHandover.To field doesn't exist", FAILURE_PREAMBLE)
+		}
+		if val, ok := command.Event.(map[string]interface{})["Peer"]; ok {
+			peer = val.(string)
+		} else {
+			err = fmt.Errorf("%sHandover.Peer field doesn't exist", FAILURE_PREAMBLE)
+		}
+		if val, ok := command.Event.(map[string]interface{})["Gap"]; ok {
+			gap = uint64(val.(float64))
+		} else {
+			err = fmt.Errorf("%sHandover.Gap field doesn't exist", FAILURE_PREAMBLE)
+		}
+		if val, ok := command.Event.(map[string]interface{})["Settle"]; ok {
+			settle = uint64(val.(float64))
+		}
+		msg = Handover{node, from, to, peer, gap, settle}
+	case SimStartTraffic:
+		node := ""
+		peer := ""
+		profile := UnknownTrafficProfile
+		rate := float64(trafficDefaultRate)
+		size := uint64(trafficDefaultSize)
+		duration := uint64(0)
+		class := ""
+		if val, ok := command.Event.(map[string]interface{})["Node"]; ok {
+			node = val.(string)
+		} else {
+			err = fmt.Errorf("%sStartTraffic.Node field doesn't exist", FAILURE_PREAMBLE)
+		}
+		if val, ok := command.Event.(map[string]interface{})["Peer"]; ok {
+			peer = val.(string)
+		} else {
+			err = fmt.Errorf("%sStartTraffic.Peer field doesn't exist", FAILURE_PREAMBLE)
+		}
+		if val, ok := command.Event.(map[string]interface{})["Profile"]; ok {
+			if profile, ok = trafficProfiles[val.(string)]; !ok {
+				err = fmt.Errorf("%sStartTraffic.Profile %q is unknown", FAILURE_PREAMBLE, val)
+			}
+		} else {
+			err = fmt.Errorf("%sStartTraffic.Profile field doesn't exist", FAILURE_PREAMBLE)
+		}
+		if val, ok := command.Event.(map[string]interface{})["Rate"]; ok {
+			rate = val.(float64)
+		}
+		if val, ok := command.Event.(map[string]interface{})["Size"]; ok {
+			size = uint64(val.(float64))
+		}
+		if val, ok := command.Event.(map[string]interface{})["Duration"]; ok {
+			duration = uint64(val.(float64))
+		}
+		if val, ok := command.Event.(map[string]interface{})["Class"]; ok {
+			class = val.(string)
+			if _, ok := trafficClasses[class]; !ok {
+				err = fmt.Errorf("%sStartTraffic.Class %q is unknown", FAILURE_PREAMBLE, class)
+			}
+		}
+		msg = StartTraffic{node, peer, profile, rate, size, duration, class}
+	case SimStopTraffic:
+		node := ""
+		peer := ""
+		if val, ok := command.Event.(map[string]interface{})["Node"]; ok {
+			node = val.(string)
+		} else {
+			err = fmt.Errorf("%sStopTraffic.Node field doesn't exist", FAILURE_PREAMBLE)
+		}
+		if val, ok := command.Event.(map[string]interface{})["Peer"]; ok {
+			peer = val.(string)
+		} else {
+			err = fmt.Errorf("%sStopTraffic.Peer field doesn't exist", FAILURE_PREAMBLE)
+		}
+		msg = StopTraffic{node, peer}
 	default:
 		err = fmt.Errorf("%sUnknown Event ID=%v", FAILURE_PREAMBLE, command.MsgID)
 	}
@@ -394,3 +485,77 @@ func (c StopPings) Run(log *log.Logger, sim *Simulator) {
 func (c StopPings) String() string {
 	return "StopPings{}"
 }
+
+type Handover struct {
+	Node   string
+	From   string // attachment point that the node leaves
+	To     string // attachment point that the node joins
+	Peer   string // correspondent that the node sends probes to
+	Gap    uint64 // time between dropping and adding the links in ms
+	Settle uint64 // time to keep probing after the handover in ms
+}
+
+// Tag Handover as a Command
+func (c Handover) Run(log *log.Logger, sim *Simulator) {
+	log.Printf("Executing command %s", c)
+	report, err := sim.Handover(c.Node, c.From, c.To, c.Peer, time.Duration(c.Gap)*time.Millisecond, time.Duration(c.Settle)*time.Millisecond)
+	if err != nil {
+		log.Printf("Failed handing over node %s from node %s to node %s: %s", c.Node, c.From, c.To, err)
+		return
+	}
+	log.Printf("Handover of node %s: survived %v, outage %dms, lost %d of %d probes (%.1f%%)",
+		c.Node, report.Survived, report.Outage, report.ProbesLost, report.ProbesSent, report.LossRate)
+}
+
+func (c Handover) String() string {
+	return fmt.Sprintf("Handover{Node:%s, From:%s, To:%s, Peer:%s, Gap:%d, Settle:%d}", c.Node, c.From, c.To, c.Peer, c.Gap, c.Settle)
+}
+
+type StartTraffic struct {
+	Node     string
+	Peer     string
+	Profile  TrafficProfile
+	Rate     float64 // frames per second
+	Size     uint64  // payload size of each frame in bytes
+	Duration uint64  // how long to send for in ms, or until stopped if zero
+	Class    string  // traffic class, bulk for bulk traffic and interactive otherwise if empty
+}
+
+// Tag StartTraffic as a Command
+func (c StartTraffic) Run(log *log.Logger, sim *Simulator) {
+	log.Printf("Executing command %s", c)
+	config := TrafficConfig{
+		Profile:  c.Profile,
+		Rate:     c.Rate,
+		Size:     int(c.Size),
+		Duration: time.Duration(c.Duration) * time.Millisecond,
+		Class:    types.TrafficClassInteractive,
+	}
+	if class, ok := trafficClasses[c.Class]; ok {
+		config.Class = class
+	} else if c.Profile == BulkTraffic {
+		config.Class = types.TrafficClassBulk
+	}
+	if err := sim.StartTraffic(c.Node, c.Peer, config); err != nil {
+		log.Printf("Failed starting traffic from node %s to node %s: %s", c.Node, c.Peer, err)
+	}
+}
+
+func (c StartTraffic) String() string {
+	return fmt.Sprintf("StartTraffic{Node:%s, Peer:%s, Profile:%s, Rate:%g, Size:%d, Duration:%d, Class:%s}", c.Node, c.Peer, c.Profile, c.Rate, c.Size, c.Duration, c.Class)
+}
+
+type StopTraffic struct {
+	Node string
+	Peer string
+}
+
+// Tag StopTraffic as a Command
+func (c StopTraffic) Run(log *log.Logger, sim *Simulator) {
+	log.Printf("Executing command %s", c)
+	sim.StopTraffic(c.Node, c.Peer)
+}
+
+func (c StopTraffic) String() string {
+	return fmt.Sprintf("StopTraffic{Node:%s, Peer:%s}", c.Node, c.Peer)
+}
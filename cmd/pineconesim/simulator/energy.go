@@ -0,0 +1,95 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"sort"
+
+	"github.com/matrix-org/pinecone/router"
+)
+
+// Each router counts the frames that it sends and receives, the signatures
+// that it makes and checks and the timers that wake it up, which are what
+// would drain the battery of a mobile node. A batch run reports how much
+// each of these went up on every node while the scenario ran. The counts of
+// a node that is removed are kept, and are added to if a node with the same
+// name is added again, so that nodes which come and go are still reported.
+
+// NodeEnergy is the work that a node did while a scenario ran.
+type NodeEnergy struct {
+	Node string
+	router.EnergyStats
+}
+
+// energyStats returns the work done by every node so far, including the
+// nodes that have been removed.
+func (sim *Simulator) energyStats() map[string]router.EnergyStats {
+	sim.nodesMutex.RLock()
+	defer sim.nodesMutex.RUnlock()
+	stats := make(map[string]router.EnergyStats, len(sim.nodes)+len(sim.retiredEnergy))
+	for name, s := range sim.retiredEnergy {
+		stats[name] = s
+	}
+	for name, node := range sim.nodes {
+		stats[name] = addEnergy(stats[name], node.EnergyStats())
+	}
+	return stats
+}
+
+// retireEnergy keeps the counts of a node that is being removed. The nodes
+// mutex must be held.
+func (sim *Simulator) retireEnergy(name string, node *Node) {
+	sim.retiredEnergy[name] = addEnergy(sim.retiredEnergy[name], node.EnergyStats())
+}
+
+// energyUsed returns the work done by each node between the two snapshots,
+// sorted by node name, and the total for all of the nodes.
+func energyUsed(before, after map[string]router.EnergyStats) ([]NodeEnergy, router.EnergyStats) {
+	var total router.EnergyStats
+	used := make([]NodeEnergy, 0, len(after))
+	for name, stats := range after {
+		diff := subtractEnergy(stats, before[name])
+		used = append(used, NodeEnergy{Node: name, EnergyStats: diff})
+		total = addEnergy(total, diff)
+	}
+	sort.Slice(used, func(i, j int) bool {
+		return used[i].Node < used[j].Node
+	})
+	return used, total
+}
+
+func addEnergy(a, b router.EnergyStats) router.EnergyStats {
+	return router.EnergyStats{
+		FramesSent:     a.FramesSent + b.FramesSent,
+		FramesReceived: a.FramesReceived + b.FramesReceived,
+		BytesSent:      a.BytesSent + b.BytesSent,
+		BytesReceived:  a.BytesReceived + b.BytesReceived,
+		Signatures:     a.Signatures + b.Signatures,
+		Verifications:  a.Verifications + b.Verifications,
+		Wakeups:        a.Wakeups + b.Wakeups,
+	}
+}
+
+func subtractEnergy(a, b router.EnergyStats) router.EnergyStats {
+	return router.EnergyStats{
+		FramesSent:     a.FramesSent - b.FramesSent,
+		FramesReceived: a.FramesReceived - b.FramesReceived,
+		BytesSent:      a.BytesSent - b.BytesSent,
+		BytesReceived:  a.BytesReceived - b.BytesReceived,
+		Signatures:     a.Signatures - b.Signatures,
+		Verifications:  a.Verifications - b.Verifications,
+		Wakeups:        a.Wakeups - b.Wakeups,
+	}
+}
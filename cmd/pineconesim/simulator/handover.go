@@ -0,0 +1,166 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// A handover models a mobile node moving from one attachment point to
+// another: the link to the old attachment point is dropped and, after a
+// gap, a link to the new one is added. While this happens the mobile node
+// sends a steady stream of probes to a correspondent node, so that we can
+// see how much traffic is lost and whether the conversation survives.
+
+// handoverProbeInterval is how often probes are sent during a handover.
+const handoverProbeInterval = time.Millisecond * 50
+
+// handoverProbeTimeout is how long we wait for a probe to be answered
+// before counting it as lost.
+const handoverProbeTimeout = time.Millisecond * 500
+
+// handoverWarmup is how long probes are sent for before the old link is
+// dropped, so that there is a baseline to compare against.
+const handoverWarmup = time.Second
+
+// handoverDefaultSettle is how long probes are sent for after the new link
+// is added, if the scenario doesn't say.
+const handoverDefaultSettle = time.Second * 10
+
+// HandoverReport describes how traffic between a mobile node and its
+// correspondent fared during a handover.
+type HandoverReport struct {
+	Node         string
+	From         string
+	To           string
+	Peer         string
+	Gap          uint64  // Time between dropping and adding the links in ms
+	ProbesBefore uint64  // Probes sent before the old link was dropped
+	LostBefore   uint64  // Of which were lost
+	ProbesSent   uint64  // Probes sent after the old link was dropped
+	ProbesLost   uint64  // Of which were lost
+	LossRate     float64 // Percentage of probes lost after the old link was dropped
+	Outage       uint64  // Time from dropping the old link to the first answered probe in ms
+	Survived     bool    // Whether probes were answered again before the end
+}
+
+// Tag HandoverReport as an Event
+func (e HandoverReport) isEvent() {}
+
+type handoverProbe struct {
+	sent     time.Time
+	answered bool
+}
+
+// Handover moves the given node from one attachment point to another,
+// leaving the given gap between dropping the old link and adding the new
+// one, and measures the traffic between the node and the given peer until
+// the settle time has passed.
+func (sim *Simulator) Handover(node, from, to, peer string, gap, settle time.Duration) (HandoverReport, error) {
+	report := HandoverReport{
+		Node: node,
+		From: from,
+		To:   to,
+		Peer: peer,
+		Gap:  uint64(gap.Milliseconds()),
+	}
+	mobile, correspondent := sim.Node(node), sim.Node(peer)
+	if mobile == nil || correspondent == nil {
+		return report, fmt.Errorf("node or peer doesn't exist")
+	}
+	if settle <= 0 {
+		settle = handoverDefaultSettle
+	}
+
+	var mutex sync.Mutex
+	var probes []handoverProbe
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(handoverProbeInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			probe := handoverProbe{sent: time.Now()}
+			pctx, pcancel := context.WithTimeout(ctx, handoverProbeTimeout)
+			_, _, err := mobile.Ping(pctx, correspondent.PublicKey())
+			pcancel()
+			if ctx.Err() != nil {
+				return
+			}
+			probe.answered = err == nil
+			mutex.Lock()
+			probes = append(probes, probe)
+			mutex.Unlock()
+		}
+	}()
+
+	time.Sleep(handoverWarmup)
+	dropped := time.Now()
+	if err := sim.DisconnectNodes(node, from); err != nil {
+		sim.log.Printf("Failed disconnecting node %s and node %s: %s", node, from, err)
+	}
+	time.Sleep(gap)
+	if err := sim.ConnectNodes(node, to); err != nil {
+		cancel()
+		<-done
+		return report, fmt.Errorf("sim.ConnectNodes: %w", err)
+	}
+	sim.GenerateNetworkGraph()
+	sim.UpdateRealDistances()
+	time.Sleep(settle)
+	cancel()
+	<-done
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, probe := range probes {
+		switch {
+		case probe.sent.Before(dropped):
+			report.ProbesBefore++
+			if !probe.answered {
+				report.LostBefore++
+			}
+		case !probe.answered:
+			report.ProbesSent++
+			report.ProbesLost++
+		default:
+			report.ProbesSent++
+			if !report.Survived {
+				report.Survived = true
+				report.Outage = uint64(probe.sent.Sub(dropped).Milliseconds())
+			}
+		}
+	}
+	if report.ProbesSent > 0 {
+		report.LossRate = float64(report.ProbesLost) / float64(report.ProbesSent) * 100
+	}
+	if !report.Survived {
+		report.Outage = uint64(time.Since(dropped).Milliseconds())
+	}
+
+	sim.State.Act(nil, func() {
+		sim.State._publish(report)
+	})
+	return report, nil
+}
@@ -21,6 +21,7 @@ import (
 
 	"github.com/matrix-org/pinecone/router"
 	"github.com/matrix-org/pinecone/util"
+	"go.uber.org/atomic"
 )
 
 func (sim *Simulator) ConnectNodes(a, b string) error {
@@ -60,7 +61,10 @@ func (sim *Simulator) ConnectNodes(a, b string) error {
 		if err := c.SetNoDelay(true); err != nil {
 			panic(err)
 		}
-		sc := &util.SlowConn{Conn: c, ReadJitter: 5 * time.Millisecond}
+		sc := &countingConn{
+			Conn:  &util.SlowConn{Conn: c, ReadJitter: 5 * time.Millisecond},
+			count: &sim.linkBytes,
+		}
 		if _, err := nb.Connect(
 			sc,
 			router.ConnectionKeepalives(true),
@@ -73,6 +77,7 @@ func (sim *Simulator) ConnectNodes(a, b string) error {
 		pa, pb := net.Pipe()
 		pa = &util.SlowConn{Conn: pa, ReadJitter: 1 * time.Millisecond}
 		pb = &util.SlowConn{Conn: pb, ReadJitter: 1 * time.Millisecond}
+		pa = &countingConn{Conn: pa, count: &sim.linkBytes}
 		go func() {
 			if _, err := na.Connect(
 				pa,
@@ -100,6 +105,25 @@ func (sim *Simulator) ConnectNodes(a, b string) error {
 	return nil
 }
 
+// countingConn counts the bytes sent in both directions over a link, so it
+// only needs to wrap one end.
+type countingConn struct {
+	net.Conn
+	count *atomic.Uint64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.count.Add(uint64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.count.Add(uint64(n))
+	return n, err
+}
+
 func (sim *Simulator) DisconnectNodes(a, b string) error {
 	sim.wiresMutex.RLock()
 	wire := sim.wires[a][b]
@@ -26,6 +26,7 @@ import (
 	"github.com/matrix-org/pinecone/cmd/pineconesim/simulator/adversary"
 	"github.com/matrix-org/pinecone/router"
 	"github.com/matrix-org/pinecone/router/events"
+	"github.com/matrix-org/pinecone/types"
 )
 
 func (sim *Simulator) Node(t string) *Node {
@@ -65,7 +66,7 @@ func (sim *Simulator) CreateNode(t string, nodeType APINodeType) error {
 	logger := log.New(sim.log.Writer(), fmt.Sprintf("\033[%dmNode %s:\033[0m ", color, t), 0)
 
 	quit := make(chan bool)
-	routerConfig := RouterConfig{HopLimiting: sim.hopLimitingEnabled}
+	routerConfig := RouterConfig{HopLimiting: sim.hopLimitingEnabled, traffic: sim.traffic}
 	n := &Node{
 		SimRouter:  sim.routerCreationMap[nodeType](logger, sk, routerConfig, quit),
 		l:          l,
@@ -152,6 +153,9 @@ func (sim *Simulator) RemoveNode(node string) {
 
 	// Remove the node from the simulators list of nodes
 	sim.nodesMutex.Lock()
+	if n, ok := sim.nodes[node]; ok {
+		sim.retireEnergy(node, n)
+	}
 	delete(sim.nodes, node)
 	sim.nodesMutex.Unlock()
 
@@ -182,8 +186,36 @@ func createDefaultRouter(
 	options RouterConfig,
 	quit <-chan bool,
 ) SimRouter {
+	return newDefaultRouter(log, sk, options, quit)
+}
+
+// legacyWireProfile pins the legacy nodes to the wire protocol as it was
+// before any frame types were added after the wakeup broadcast, and before
+// any of the optional handshake features, so that networks with a mix of
+// older and newer nodes can be tested.
+var legacyWireProfile = router.RouterOptionWireProfile{
+	LastFrameType: types.TypeWakeupBroadcast,
+}
+
+func createLegacyRouter(
+	log *log.Logger,
+	sk ed25519.PrivateKey,
+	options RouterConfig,
+	quit <-chan bool,
+) SimRouter {
+	return newDefaultRouter(log, sk, options, quit, legacyWireProfile)
+}
+
+func newDefaultRouter(
+	log *log.Logger,
+	sk ed25519.PrivateKey,
+	options RouterConfig,
+	quit <-chan bool,
+	routerOptions ...router.RouterOption,
+) *DefaultRouter {
 	rtr := &DefaultRouter{
-		rtr: router.NewRouter(log, sk),
+		rtr:     router.NewRouter(log, sk, routerOptions...),
+		traffic: options.traffic,
 	}
 	rtr.rtr.InjectPacketFilter(rtr.PingFilter)
 
@@ -17,6 +17,7 @@ package simulator
 import (
 	"crypto/ed25519"
 	"encoding/binary"
+	"errors"
 	"fmt"
 
 	"github.com/matrix-org/pinecone/types"
@@ -27,8 +28,16 @@ type PingType uint8
 const (
 	Ping PingType = iota
 	Pong
+	// Unreachable is sent back to the origin by the node that a ping ends
+	// up at if it isn't the destination, i.e. because the destination isn't
+	// in the same part of the network or no longer exists.
+	Unreachable
 )
 
+// ErrDestinationUnreachable is returned by Ping when the ping ended up at a
+// node other than the destination.
+var ErrDestinationUnreachable = errors.New("destination unreachable")
+
 const pingPreamble = "pineping"
 const pingSize = len(pingPreamble) + (ed25519.PublicKeySize * 2) + 3
 
@@ -26,7 +26,11 @@ func (sim *Simulator) GenerateNetworkGraph() {
 		sim.maps[n] = sim.graph.AddMappedVertex(n)
 	}
 	for a, aa := range sim.wires {
-		for b := range aa {
+		for b, conn := range aa {
+			if conn == nil {
+				// The link has been disconnected.
+				continue
+			}
 			if err := sim.graph.AddMappedArc(a, b, 1); err != nil {
 				panic(err)
 			}
@@ -34,14 +34,21 @@ type SimRouter interface {
 	Subscribe(ch chan events.Event)
 	Ping(ctx context.Context, a types.PublicKey) (uint16, time.Duration, error)
 	Coords() types.Coordinates
+	WriteToWithClass(p []byte, addr net.Addr, class types.TrafficClass) (int, error)
+	EnergyStats() router.EnergyStats
+	HopLimitExpiries() uint64
 	ConfigureFilterDefaults(rates adversary.DropRates)
 	ConfigureFilterPeer(peer types.PublicKey, rates adversary.DropRates)
 	ManholeHandler(w http.ResponseWriter, req *http.Request)
+	ProtocolHistoryHandler(w http.ResponseWriter, req *http.Request)
+	SNEKSnapshot() router.SNEKSnapshot
+	ProtocolHistory(q router.ProtocolHistoryQuery) []router.ProtocolEvent
 }
 
 type DefaultRouter struct {
-	rtr   *router.Router
-	pings sync.Map // types.PublicKey -> chan struct{}
+	rtr     *router.Router
+	pings   sync.Map // types.PublicKey -> chan struct{}
+	traffic *trafficRegistry
 }
 
 func (r *DefaultRouter) Subscribe(ch chan events.Event) {
@@ -60,6 +67,18 @@ func (r *DefaultRouter) Coords() types.Coordinates {
 	return r.rtr.Coords()
 }
 
+func (r *DefaultRouter) WriteToWithClass(p []byte, addr net.Addr, class types.TrafficClass) (int, error) {
+	return r.rtr.WriteToWithClass(p, addr, class)
+}
+
+func (r *DefaultRouter) EnergyStats() router.EnergyStats {
+	return r.rtr.EnergyStats()
+}
+
+func (r *DefaultRouter) HopLimitExpiries() uint64 {
+	return r.rtr.HopLimitExpiries()
+}
+
 func (r *DefaultRouter) EnableHopLimiting() {
 	r.rtr.EnableHopLimiting()
 }
@@ -80,6 +99,18 @@ func (r *DefaultRouter) ManholeHandler(w http.ResponseWriter, req *http.Request)
 	r.rtr.ManholeHandler(w, req)
 }
 
+func (r *DefaultRouter) ProtocolHistoryHandler(w http.ResponseWriter, req *http.Request) {
+	r.rtr.ProtocolHistoryHandler(w, req)
+}
+
+func (r *DefaultRouter) SNEKSnapshot() router.SNEKSnapshot {
+	return r.rtr.SNEKSnapshot()
+}
+
+func (r *DefaultRouter) ProtocolHistory(q router.ProtocolHistoryQuery) []router.ProtocolEvent {
+	return r.rtr.ProtocolHistory(q)
+}
+
 func (r *DefaultRouter) Ping(ctx context.Context, destination types.PublicKey) (uint16, time.Duration, error) {
 	id := destination.String()
 	payload := PingPayload{
@@ -94,22 +125,35 @@ func (r *DefaultRouter) Ping(ctx context.Context, destination types.PublicKey) (
 		return 0, 0, fmt.Errorf("failed marshalling ping payload: %w", err)
 	}
 
-	_, writeErr := r.rtr.WriteTo(p, destination)
-	if writeErr != nil {
-		return 0, 0, fmt.Errorf("failed sending ping to node: %w", writeErr)
+	// If we are the closest node to the destination that we know of then
+	// the ping would end with us, so there is no one else to tell us.
+	start := time.Now()
+	if explanation, err := r.rtr.NextHop(destination); err == nil && explanation.Local && destination != r.PublicKey() {
+		return 0, time.Since(start), ErrDestinationUnreachable
 	}
 
-	start := time.Now()
+	// Wait for the answer before sending, since an unreachable answer can
+	// come back from a nearby node very quickly.
 	v, existing := r.pings.LoadOrStore(id, make(chan uint16))
 	if existing {
 		return 0, 0, fmt.Errorf("a ping to this node is already in progress")
 	}
 	defer r.pings.Delete(id)
 	ch := v.(chan uint16)
+
+	_, writeErr := r.rtr.WriteTo(p, destination)
+	if writeErr != nil {
+		return 0, 0, fmt.Errorf("failed sending ping to node: %w", writeErr)
+	}
 	select {
 	case <-ctx.Done():
 		return 0, 0, fmt.Errorf("ping timed out")
-	case hops := <-ch:
+	case hops, ok := <-ch:
+		if !ok {
+			// The channel is closed without a value if the destination
+			// was unreachable.
+			return 0, time.Since(start), ErrDestinationUnreachable
+		}
 		return hops, time.Since(start), nil
 	}
 }
@@ -145,10 +189,13 @@ func (r *DefaultRouter) OverlayReadHandler(quit <-chan bool) {
 		if err := r.rtr.SetReadDeadline(time.Now().Add(time.Millisecond * 300)); err != nil {
 			panic(err)
 		}
-		n, _, err := r.rtr.ReadFrom(buf)
+		n, from, err := r.rtr.ReadFrom(buf)
 		if err != nil || n == 0 {
 			continue
 		}
+		if r.handleTraffic(buf[:n], from) {
+			continue
+		}
 
 		payload := PingPayload{}
 		if _, err = payload.UnmarshalBinary(buf[:n]); err != nil {
@@ -160,8 +207,9 @@ func (r *DefaultRouter) OverlayReadHandler(quit <-chan bool) {
 			if payload.destination == r.PublicKey() {
 				payload.pingType = Pong
 			} else {
-				println("PING: hit deadend at:", r.PublicKey().String(), "for:", payload.origin.String(), "to:", payload.destination.String())
-				continue
+				// The ping was routed as close to the destination as it
+				// could get and it isn't us, so tell the origin.
+				payload.pingType = Unreachable
 			}
 		case Pong:
 			if payload.origin == r.PublicKey() {
@@ -179,6 +227,13 @@ func (r *DefaultRouter) OverlayReadHandler(quit <-chan bool) {
 				println("PONG: hit deadend at:", r.PublicKey().String(), "for:", payload.origin.String(), "to:", payload.destination.String())
 				continue
 			}
+		case Unreachable:
+			if payload.origin == r.PublicKey() {
+				if v, ok := r.pings.LoadAndDelete(payload.destination.String()); ok {
+					close(v.(chan uint16))
+				}
+			}
+			continue
 		default:
 			continue
 		}
@@ -191,3 +246,28 @@ func (r *DefaultRouter) OverlayReadHandler(quit <-chan bool) {
 		}
 	}
 }
+
+// handleTraffic records a frame from a traffic generator, answering it if it
+// is a request, and returns false if the frame wasn't from a generator.
+func (r *DefaultRouter) handleTraffic(buf []byte, from net.Addr) bool {
+	payload := TrafficPayload{}
+	if _, err := payload.UnmarshalBinary(buf); err != nil {
+		return false
+	}
+	if r.traffic == nil {
+		return true
+	}
+	switch payload.kind {
+	case trafficData:
+		r.traffic.received(payload)
+	case trafficRequest:
+		r.traffic.received(payload)
+		payload.kind = trafficResponse
+		if n, err := payload.MarshalBinary(buf); err == nil {
+			_, _ = r.rtr.WriteTo(buf[:n], from)
+		}
+	case trafficResponse:
+		r.traffic.responded(payload)
+	}
+	return true
+}
@@ -0,0 +1,118 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// A scenario is an event sequence file, in the same format that the UI
+// imports, with optional assertions that are checked against the metrics
+// once the scenario has been run headless.
+
+// Scenario is an event sequence file.
+type Scenario struct {
+	EventSequence []ScenarioCommand
+	Assertions    ScenarioAssertions
+}
+
+// ScenarioCommand is a single command in an event sequence file, named as
+// in the UI.
+type ScenarioCommand struct {
+	Command string
+	Data    map[string]interface{}
+}
+
+// ScenarioAssertions are checked against the metrics at the end of a
+// headless run. Any that are left unset aren't checked.
+type ScenarioAssertions struct {
+	Converged          bool     // Every topology change must have converged
+	MaxConvergenceTime *uint64  // Longest time to converge in ms
+	MinDeliveryRate    *float64 // Percentage of pings that must be answered
+	MaxStretch         *float64 // Average ratio of observed to real path length
+	MaxControlOverhead *float64 // Link bytes per node per second
+	NoLoops            bool     // No frames may run out of hops while converged
+	Unreachable        bool     // Only pings to unreachable nodes may come back unreachable
+	SNEKInvariants     bool     // The SNEK must be consistent across all nodes at the end
+}
+
+var scenarioCommandIDs = map[string]APICommandID{
+	"Debug":                      SimDebug,
+	"Play":                       SimPlay,
+	"Pause":                      SimPause,
+	"Delay":                      SimDelay,
+	"AddNode":                    SimAddNode,
+	"RemoveNode":                 SimRemoveNode,
+	"AddPeer":                    SimAddPeer,
+	"RemovePeer":                 SimRemovePeer,
+	"ConfigureAdversaryDefaults": SimConfigureAdversaryDefaults,
+	"ConfigureAdversaryPeer":     SimConfigureAdversaryPeer,
+	"StartPings":                 SimStartPings,
+	"StopPings":                  SimStopPings,
+	"Handover":                   SimHandover,
+	"StartTraffic":               SimStartTraffic,
+	"StopTraffic":                SimStopTraffic,
+}
+
+var scenarioNodeTypes = map[string]APINodeType{
+	"Default":          DefaultNode,
+	"GeneralAdversary": GeneralAdversaryNode,
+	"Legacy":           LegacyNode,
+}
+
+// LoadScenario reads an event sequence file.
+func LoadScenario(filename string) (*Scenario, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var scenario Scenario
+	if err := json.Unmarshal(data, &scenario); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	return &scenario, nil
+}
+
+// Commands converts the event sequence into commands that can be run.
+func (s *Scenario) Commands() ([]SimCommand, error) {
+	commands := make([]SimCommand, 0, len(s.EventSequence))
+	for i, c := range s.EventSequence {
+		id, ok := scenarioCommandIDs[c.Command]
+		if !ok {
+			return nil, fmt.Errorf("index %d: unknown command %q", i, c.Command)
+		}
+		data := make(map[string]interface{}, len(c.Data))
+		for k, v := range c.Data {
+			data[k] = v
+		}
+		if id == SimAddNode {
+			name, _ := data["NodeType"].(string)
+			nodeType, ok := scenarioNodeTypes[name]
+			if !ok {
+				return nil, fmt.Errorf("index %d: unknown node type %q", i, name)
+			}
+			// UnmarshalCommandJSON expects numbers, as sent by the UI.
+			data["NodeType"] = float64(nodeType)
+		}
+		command, err := UnmarshalCommandJSON(&SimCommandMsg{MsgID: id, Event: data})
+		if err != nil {
+			return nil, fmt.Errorf("index %d: %w", i, err)
+		}
+		commands = append(commands, command)
+	}
+	return commands, nil
+}
@@ -25,6 +25,7 @@ import (
 
 	"github.com/Arceliar/phony"
 	"github.com/RyanCarrier/dijkstra"
+	"github.com/matrix-org/pinecone/router"
 	"github.com/matrix-org/pinecone/router/events"
 	"github.com/matrix-org/pinecone/types"
 	"go.uber.org/atomic"
@@ -98,6 +99,9 @@ type Simulator struct {
 	eventRunner             *EventSequenceRunner
 	routerCreationMap       map[APINodeType]RouterCreatorFn
 	pingControlChannel      chan<- bool
+	linkBytes               atomic.Uint64
+	traffic                 *trafficRegistry
+	retiredEnergy           map[string]router.EnergyStats
 }
 
 func NewSimulator(log *log.Logger, sockets, acceptCommands, hopLimiting bool) *Simulator {
@@ -119,10 +123,13 @@ func NewSimulator(log *log.Logger, sockets, acceptCommands, hopLimiting bool) *S
 		eventRunner:        &EventSequenceRunner{_playlist: make(chan []SimCommand)},
 		routerCreationMap:  make(map[APINodeType]RouterCreatorFn, 2),
 		pingControlChannel: make(chan<- bool),
+		traffic:            newTrafficRegistry(),
+		retiredEnergy:      make(map[string]router.EnergyStats),
 	}
 
 	sim.routerCreationMap[DefaultNode] = createDefaultRouter
 	sim.routerCreationMap[GeneralAdversaryNode] = createAdversaryRouter
+	sim.routerCreationMap[LegacyNode] = createLegacyRouter
 
 	go sim.eventRunner.Run(sim)
 	sim.Play()
@@ -145,9 +152,9 @@ func (sim *Simulator) StartPinging(ping_period time.Duration) {
 				tasks := make(chan pair, 2*(len(sim.nodes)*len(sim.nodes)))
 
 				for from, fromNode := range sim.nodes {
-					if fromNode.Type == DefaultNode {
+					if fromNode.answersPings() {
 						for to, toNode := range sim.nodes {
-							if toNode.Type == DefaultNode {
+							if toNode.answersPings() {
 								if sim.dists[from][to].Real <= int64(types.NetworkHorizonDistance) {
 									tasks <- pair{from, to}
 								}
@@ -0,0 +1,424 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+	"go.uber.org/atomic"
+)
+
+// Without traffic, the only frames on the links are protocol frames and the
+// odd ping, so the queues never fill and the scheduler and congestion
+// handling never have anything to do. A traffic generator sends a stream of
+// traffic frames from one node to another with a given profile:
+//
+//   - Constant sends frames at a fixed rate.
+//   - Poisson sends frames at random intervals that average out to the rate.
+//   - RequestResponse sends one request at a time, which the peer answers,
+//     and doesn't send the next until the answer arrives or the request
+//     times out, or until the interval has passed if that is later.
+//   - Bulk sends frames as fast as the router will take them.
+//
+// Every frame carries the generator, a sequence number and the time that it
+// was sent, so the node that it arrives at can record the latency. Since all
+// of the nodes run in the same process, the clocks agree. Once a generator
+// stops, it waits a moment for the last frames to arrive and then publishes
+// a report of what was delivered.
+
+type TrafficProfile int
+
+const (
+	UnknownTrafficProfile TrafficProfile = iota
+	ConstantTraffic
+	PoissonTraffic
+	RequestResponseTraffic
+	BulkTraffic
+)
+
+var trafficProfiles = map[string]TrafficProfile{
+	"Constant":        ConstantTraffic,
+	"Poisson":         PoissonTraffic,
+	"RequestResponse": RequestResponseTraffic,
+	"Bulk":            BulkTraffic,
+}
+
+func (p TrafficProfile) String() string {
+	for name, profile := range trafficProfiles {
+		if profile == p {
+			return name
+		}
+	}
+	return "Unknown"
+}
+
+var trafficClasses = map[string]types.TrafficClass{
+	"Interactive": types.TrafficClassInteractive,
+	"Control":     types.TrafficClassControl,
+	"Bulk":        types.TrafficClassBulk,
+	"Background":  types.TrafficClassBackground,
+}
+
+const trafficPreamble = "pinetraf"
+const trafficHeaderSize = len(trafficPreamble) + 1 + 4 + 8 + 8
+
+// trafficDefaultRate is how many frames a second are sent if the command
+// doesn't say.
+const trafficDefaultRate = 10
+
+// trafficDefaultSize is how big the payload of each frame is if the command
+// doesn't say.
+const trafficDefaultSize = 512
+
+// trafficRequestTimeout is how long a request waits for an answer before it
+// is counted as lost.
+const trafficRequestTimeout = time.Second
+
+// trafficDrain is how long a generator waits after it stops for the last
+// frames to arrive.
+const trafficDrain = time.Second
+
+type trafficKind uint8
+
+const (
+	trafficData trafficKind = iota
+	trafficRequest
+	trafficResponse
+)
+
+type TrafficPayload struct {
+	kind      trafficKind
+	generator uint32
+	sequence  uint64
+	sent      time.Time
+}
+
+func (p *TrafficPayload) MarshalBinary(buffer []byte) (int, error) {
+	if len(buffer) < trafficHeaderSize {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	offset := copy(buffer, []byte(trafficPreamble))
+	buffer[offset] = uint8(p.kind)
+	offset++
+	binary.BigEndian.PutUint32(buffer[offset:offset+4], p.generator)
+	offset += 4
+	binary.BigEndian.PutUint64(buffer[offset:offset+8], p.sequence)
+	offset += 8
+	binary.BigEndian.PutUint64(buffer[offset:offset+8], uint64(p.sent.UnixNano()))
+	offset += 8
+	return offset, nil
+}
+
+func (p *TrafficPayload) UnmarshalBinary(buffer []byte) (int, error) {
+	if len(buffer) < trafficHeaderSize {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	if string(buffer[:len(trafficPreamble)]) != trafficPreamble {
+		return 0, fmt.Errorf("not traffic")
+	}
+	offset := len(trafficPreamble)
+	p.kind = trafficKind(buffer[offset])
+	offset++
+	p.generator = binary.BigEndian.Uint32(buffer[offset : offset+4])
+	offset += 4
+	p.sequence = binary.BigEndian.Uint64(buffer[offset : offset+8])
+	offset += 8
+	p.sent = time.Unix(0, int64(binary.BigEndian.Uint64(buffer[offset:offset+8])))
+	offset += 8
+	return offset, nil
+}
+
+// TrafficConfig describes the traffic that a generator sends.
+type TrafficConfig struct {
+	Profile  TrafficProfile
+	Rate     float64       // Frames per second, ignored for bulk traffic
+	Size     int           // Payload size of each frame in bytes
+	Duration time.Duration // How long to send for, or until stopped if zero
+	Class    types.TrafficClass
+}
+
+// TrafficReport describes how the traffic from a generator fared.
+type TrafficReport struct {
+	Node       string
+	Peer       string
+	Profile    string
+	Class      string
+	Duration   uint64  // Time that frames were sent for in ms
+	Sent       uint64  // Frames sent
+	Delivered  uint64  // Of which arrived at the peer
+	Answered   uint64  // Requests that were answered
+	LossRate   float64 // Percentage of frames that didn't arrive
+	Latency    float64 // Average time for a frame to arrive in ms
+	RTT        float64 // Average time for a request to be answered in ms
+	Throughput float64 // Payload bytes delivered per second
+}
+
+// Tag TrafficReport as an Event
+func (e TrafficReport) isEvent() {}
+
+type trafficGenerator struct {
+	id        uint32
+	node      string
+	peer      string
+	config    TrafficConfig
+	from      SimRouter
+	to        types.PublicKey
+	cancel    context.CancelFunc
+	finished  chan struct{}
+	answers   chan uint64
+	started   time.Time
+	sent      atomic.Uint64
+	delivered atomic.Uint64
+	answered  atomic.Uint64
+	latency   atomic.Int64 // Total of the latencies in ns
+	rtt       atomic.Int64 // Total of the round trip times in ns
+}
+
+// trafficRegistry keeps track of the generators that are running, so that
+// nodes can record the traffic that arrives for them.
+type trafficRegistry struct {
+	mutex      sync.Mutex
+	next       uint32
+	generators map[uint32]*trafficGenerator
+	reports    []TrafficReport
+}
+
+func newTrafficRegistry() *trafficRegistry {
+	return &trafficRegistry{
+		generators: make(map[uint32]*trafficGenerator),
+	}
+}
+
+func (t *trafficRegistry) lookup(id uint32) *trafficGenerator {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.generators[id]
+}
+
+// received records a frame that arrived at the peer.
+func (t *trafficRegistry) received(p TrafficPayload) {
+	if g := t.lookup(p.generator); g != nil {
+		g.delivered.Inc()
+		g.latency.Add(int64(time.Since(p.sent)))
+	}
+}
+
+// responded records an answer to a request that arrived back at the node.
+func (t *trafficRegistry) responded(p TrafficPayload) {
+	if g := t.lookup(p.generator); g != nil {
+		g.answered.Inc()
+		g.rtt.Add(int64(time.Since(p.sent)))
+		select {
+		case g.answers <- p.sequence:
+		default:
+		}
+	}
+}
+
+// StartTraffic starts a generator that sends traffic from the node to the
+// peer.
+func (sim *Simulator) StartTraffic(node, peer string, config TrafficConfig) error {
+	from, to := sim.Node(node), sim.Node(peer)
+	if from == nil || to == nil {
+		return fmt.Errorf("node or peer doesn't exist")
+	}
+	if config.Size < trafficHeaderSize || config.Size > types.MaxPayloadSize {
+		return fmt.Errorf("size must be between %d and %d bytes", trafficHeaderSize, types.MaxPayloadSize)
+	}
+	if config.Profile != BulkTraffic && config.Rate <= 0 {
+		return fmt.Errorf("rate must be above zero")
+	}
+
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if config.Duration > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), config.Duration)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	g := &trafficGenerator{
+		node:     node,
+		peer:     peer,
+		config:   config,
+		from:     from,
+		to:       to.PublicKey(),
+		cancel:   cancel,
+		finished: make(chan struct{}),
+		answers:  make(chan uint64, 1),
+		started:  time.Now(),
+	}
+	sim.traffic.mutex.Lock()
+	sim.traffic.next++
+	g.id = sim.traffic.next
+	sim.traffic.generators[g.id] = g
+	sim.traffic.mutex.Unlock()
+
+	go func() {
+		g.run(ctx)
+		stopped := time.Now()
+		time.Sleep(trafficDrain)
+		report := g.report(stopped)
+		sim.traffic.mutex.Lock()
+		delete(sim.traffic.generators, g.id)
+		sim.traffic.reports = append(sim.traffic.reports, report)
+		sim.traffic.mutex.Unlock()
+		sim.log.Printf("Traffic from node %s to node %s: delivered %d of %d frames (%.1f%% lost), latency %.1fms",
+			node, peer, report.Delivered, report.Sent, report.LossRate, report.Latency)
+		sim.State.Act(nil, func() {
+			sim.State._publish(report)
+		})
+		close(g.finished)
+	}()
+	return nil
+}
+
+// StopTraffic stops the generators that send traffic from the node to the
+// peer, and waits for their reports.
+func (sim *Simulator) StopTraffic(node, peer string) {
+	var stopping []*trafficGenerator
+	sim.traffic.mutex.Lock()
+	for _, g := range sim.traffic.generators {
+		if g.node == node && g.peer == peer {
+			stopping = append(stopping, g)
+		}
+	}
+	sim.traffic.mutex.Unlock()
+	for _, g := range stopping {
+		g.cancel()
+	}
+	for _, g := range stopping {
+		<-g.finished
+	}
+}
+
+// stopAllTraffic stops every generator and returns all of the reports.
+func (sim *Simulator) stopAllTraffic() []TrafficReport {
+	var stopping []*trafficGenerator
+	sim.traffic.mutex.Lock()
+	for _, g := range sim.traffic.generators {
+		stopping = append(stopping, g)
+	}
+	sim.traffic.mutex.Unlock()
+	for _, g := range stopping {
+		g.cancel()
+	}
+	for _, g := range stopping {
+		<-g.finished
+	}
+	sim.traffic.mutex.Lock()
+	defer sim.traffic.mutex.Unlock()
+	return append([]TrafficReport{}, sim.traffic.reports...)
+}
+
+func (g *trafficGenerator) run(ctx context.Context) {
+	buf := make([]byte, g.config.Size)
+	var interval time.Duration
+	if g.config.Rate > 0 {
+		interval = time.Duration(float64(time.Second) / g.config.Rate)
+	}
+	for sequence := uint64(0); ctx.Err() == nil; sequence++ {
+		payload := TrafficPayload{
+			kind:      trafficData,
+			generator: g.id,
+			sequence:  sequence,
+			sent:      time.Now(),
+		}
+		if g.config.Profile == RequestResponseTraffic {
+			payload.kind = trafficRequest
+		}
+		if _, err := payload.MarshalBinary(buf); err != nil {
+			return
+		}
+		if _, err := g.from.WriteToWithClass(buf, g.to, g.config.Class); err == nil {
+			g.sent.Inc()
+		}
+
+		var wait time.Duration
+		switch g.config.Profile {
+		case ConstantTraffic:
+			wait = interval
+		case PoissonTraffic:
+			wait = time.Duration(rand.ExpFloat64() * float64(interval))
+		case RequestResponseTraffic:
+			if !g.awaitAnswer(ctx, sequence) {
+				return
+			}
+			wait = interval - time.Since(payload.sent)
+		case BulkTraffic:
+			continue
+		}
+		if wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+		}
+	}
+}
+
+// awaitAnswer waits for the request with the given sequence number to be
+// answered or to time out, and returns false if the generator was stopped.
+func (g *trafficGenerator) awaitAnswer(ctx context.Context, sequence uint64) bool {
+	timer := time.NewTimer(trafficRequestTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-timer.C:
+			return true
+		case answered := <-g.answers:
+			if answered == sequence {
+				return true
+			}
+			// An answer to an earlier request that timed out.
+		}
+	}
+}
+
+func (g *trafficGenerator) report(stopped time.Time) TrafficReport {
+	report := TrafficReport{
+		Node:      g.node,
+		Peer:      g.peer,
+		Profile:   g.config.Profile.String(),
+		Class:     g.config.Class.String(),
+		Duration:  uint64(stopped.Sub(g.started).Milliseconds()),
+		Sent:      g.sent.Load(),
+		Delivered: g.delivered.Load(),
+		Answered:  g.answered.Load(),
+	}
+	if report.Sent > 0 && report.Delivered < report.Sent {
+		report.LossRate = float64(report.Sent-report.Delivered) / float64(report.Sent) * 100
+	}
+	if report.Delivered > 0 {
+		report.Latency = float64(g.latency.Load()) / float64(report.Delivered) / float64(time.Millisecond)
+	}
+	if report.Answered > 0 {
+		report.RTT = float64(g.rtt.Load()) / float64(report.Answered) / float64(time.Millisecond)
+	}
+	if seconds := stopped.Sub(g.started).Seconds(); seconds > 0 {
+		report.Throughput = float64(report.Delivered) * float64(g.config.Size) / seconds
+	}
+	return report
+}
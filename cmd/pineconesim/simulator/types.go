@@ -25,6 +25,12 @@ type Node struct {
 	Type       APINodeType
 }
 
+// answersPings returns true if the node answers the simulator's pings, which
+// the adversaries don't.
+func (n *Node) answersPings() bool {
+	return n.Type == DefaultNode || n.Type == LegacyNode
+}
+
 type Distance struct {
 	Real     int64
 	Observed int64
@@ -32,4 +38,5 @@ type Distance struct {
 
 type RouterConfig struct {
 	HopLimiting bool
+	traffic     *trafficRegistry
 }
@@ -101,6 +101,15 @@ function handleSimMessage(msg) {
         case APIUpdateID.BandwidthReport:
             graph.addBandwidthReport(event.Node, event.Bandwidth);
             break;
+        case APIUpdateID.HandoverReport:
+            console.log("Handover of " + event.Node + " from " + event.From + " to " + event.To +
+                        ": survived " + event.Survived + ", outage " + event.Outage + "ms, lost " +
+                        event.ProbesLost + " of " + event.ProbesSent + " probes");
+            break;
+        case APIUpdateID.TrafficReport:
+            console.log(event.Profile + " traffic from " + event.Node + " to " + event.Peer + ": delivered " +
+                        event.Delivered + " of " + event.Sent + " frames, latency " + event.Latency.toFixed(1) + "ms");
+            break;
         }
         break;
     default:
@@ -219,6 +219,8 @@ class Graph {
         let colour = getComputedStyle(document.documentElement).getPropertyValue('--color-router-blue');
         if (type === APINodeType.GeneralAdversary) {
             colour = getComputedStyle(document.documentElement).getPropertyValue('--color-dark-red');
+        } else if (type === APINodeType.Legacy) {
+            colour = getComputedStyle(document.documentElement).getPropertyValue('--color-ems-purple');
         }
         this.peerData.nodes.add({ id: id, label: id, color: {
             background: colour, border: colour, hover: {
@@ -25,6 +25,8 @@ export const APIUpdateID = {
     NetworkStatsUpdated: 12,
     BroadcastReceived: 13,
     BandwidthReport: 14,
+    HandoverReport: 15,
+    TrafficReport: 16,
 };
 
 export const APICommandID = {
@@ -41,12 +43,16 @@ export const APICommandID = {
     ConfigureAdversaryPeer: 10,
     StartPings: 11,
     StopPings: 12,
+    Handover: 13,
+    StartTraffic: 14,
+    StopTraffic: 15,
 };
 
 export const APINodeType = {
     Unknown: 0,
     Default: 1,
     GeneralAdversary: 2,
+    Legacy: 3,
 };
 
 var serverWorker;
@@ -75,6 +81,9 @@ export function ConvertNodeTypeToString(nodeType) {
     case APINodeType.GeneralAdversary:
         val = "General Adversary";
         break;
+    case APINodeType.Legacy:
+        val = "Legacy";
+        break;
     }
 
     return val;
@@ -330,6 +330,9 @@ function validateEventSequence(content) {
         validSimCommands.set("ConfigureAdversaryPeer", ["Node", "Peer", "DropRates"]);
         validSimCommands.set("StartPings", []);
         validSimCommands.set("StopPings", []);
+        validSimCommands.set("Handover", ["Node", "From", "To", "Peer", "Gap"]);
+        validSimCommands.set("StartTraffic", ["Node", "Peer", "Profile"]);
+        validSimCommands.set("StopTraffic", ["Node", "Peer"]);
 
         let validSubcommands = new Map();
         validSubcommands.set("DropRates", ["Overall", "Keepalive", "TreeAnnouncement", "VirtualSnakeBootstrap", "WakeupBroadcast", "OverlayTraffic"]);
@@ -575,8 +578,19 @@ function convertCommandToID(command) {
         break;
     case "StartPings":
         id = APICommandID.StartPings;
+        break;
     case "StopPings":
         id = APICommandID.StopPings;
+        break;
+    case "Handover":
+        id = APICommandID.Handover;
+        break;
+    case "StartTraffic":
+        id = APICommandID.StartTraffic;
+        break;
+    case "StopTraffic":
+        id = APICommandID.StopTraffic;
+        break;
     default:
         break;
     }
@@ -1,6 +1,7 @@
 export let nodeTypeToOptions = new Map();
 nodeTypeToOptions.set("Default", createNodeOptionsDefault);
 nodeTypeToOptions.set("GeneralAdversary", createNodeOptionsGeneralAdversary);
+nodeTypeToOptions.set("Legacy", createNodeOptionsDefault);
 
 export let nodeOptionsIndex = 2;
 
@@ -13,6 +14,9 @@ export function convertNodeTypeToID(nodeType) {
     case "GeneralAdversary":
         typeID = 2;
         break;
+    case "Legacy":
+        typeID = 3;
+        break;
     }
 
     return typeID;
@@ -27,6 +31,9 @@ export function convertTypeIDToNodeType(typeID) {
     case 2:
         nodeType = "GeneralAdversary";
         break;
+    case 3:
+        nodeType = "Legacy";
+        break;
     }
 
     return nodeType;
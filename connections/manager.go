@@ -16,8 +16,8 @@ package connections
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"math"
 	"net"
 	"net/http"
 	"strings"
@@ -25,43 +25,88 @@ import (
 
 	"github.com/Arceliar/phony"
 	"github.com/matrix-org/pinecone/router"
+	"github.com/matrix-org/pinecone/router/events"
 	"github.com/matrix-org/pinecone/types"
+	"go.uber.org/atomic"
 	"nhooyr.io/websocket"
 )
 
 const interval = time.Second * 5
 
+// unixScheme is the URI prefix for static peers that are reached
+// over a unix domain socket.
+const unixScheme = "unix://"
+
+// UnixZone is the connection zone used for peerings over unix domain
+// sockets, so that they can be told apart from network peerings.
+const UnixZone = "unix"
+
+// raceDelay is how long we wait for one candidate URI of a static peer
+// before we start dialling the next, as recommended by RFC 8305.
+const raceDelay = time.Millisecond * 250
+
+// errLostRace is the reason given for closing a peering to a static peer
+// because another candidate URI completed the handshake first.
+var errLostRace = errors.New("another candidate connected first")
+
+// reservedBackoffMax is the longest that we will wait between
+// attempts to reconnect to a reserved static peer.
+const reservedBackoffMax = time.Second * 30
+
 type ConnectionManager struct {
 	phony.Inbox
-	ctx             context.Context
-	cancel          context.CancelFunc
-	router          *router.Router
-	client          *http.Client
-	ws              *websocket.DialOptions
-	_staticPeers    map[string]*connectionAttempts
-	_connectedPeers map[string]struct{}
+	ctx              context.Context
+	cancel           context.CancelFunc
+	router           *router.Router
+	client           *http.Client
+	ws               *websocket.DialOptions
+	resolver         *net.Resolver
+	_staticPeers     map[string]*connectionAttempts
+	_connectedPeers  map[string]struct{}
+	_options         []router.ConnectionOption
+	_resolveInterval time.Duration
+	_subscribers     map[chan<- events.Event]*phony.Inbox
+	_store           PeerStore             // Where the known peers are kept, nil if they aren't
+	_known           map[string]*KnownPeer // Peers that we have connected to, by URI
+	_reconnectKnown  int                   // How many known peers to connect to at once
+	_lastSave        time.Time             // When the known peers were last saved
 }
 
 type connectionAttempts struct {
-	attempts float64
-	next     time.Time
+	attempts    float64
+	next        time.Time
+	reserved    bool
+	candidates  []string        // The URIs that the peer can be reached at, in order of preference
+	endpoint    *staticEndpoint // Where we last connected to the peer, nil if we haven't
+	policy      ReconnectPolicy
+	connectedAt time.Time // When we last connected, zero if we aren't connected
+	lastErr     error     // Why the last attempt failed
+	gaveUp      bool      // Have we stopped trying because of the policy?
+	known       bool      // Restored from the peer store rather than added
 }
 
 func NewConnectionManager(r *router.Router, client *http.Client) *ConnectionManager {
-	ctx, cancel := context.WithCancel(context.Background())
+	return NewConnectionManagerWithContext(context.Background(), r, client)
+}
+
+// NewConnectionManagerWithContext is like NewConnectionManager, but the
+// connection manager stops once the given context is cancelled. Any dials
+// or handshakes that are in progress at that point are abandoned, and no
+// more connection attempts are made to static peers.
+func NewConnectionManagerWithContext(ctx context.Context, r *router.Router, client *http.Client) *ConnectionManager {
+	ctx, cancel := context.WithCancel(ctx)
 	m := &ConnectionManager{
-		ctx:    ctx,
-		cancel: cancel,
-		router: r,
-		client: client,
-		ws: &websocket.DialOptions{
-			HTTPClient: client,
-		},
-		_staticPeers:    map[string]*connectionAttempts{},
-		_connectedPeers: map[string]struct{}{},
-	}
-	if m.ws.HTTPClient == nil {
-		m.ws.HTTPClient = http.DefaultClient
+		ctx:              ctx,
+		cancel:           cancel,
+		router:           r,
+		client:           client,
+		ws:               newDialOptions(client),
+		resolver:         net.DefaultResolver,
+		_staticPeers:     map[string]*connectionAttempts{},
+		_connectedPeers:  map[string]struct{}{},
+		_resolveInterval: resolveInterval,
+		_subscribers:     map[chan<- events.Event]*phony.Inbox{},
+		_known:           map[string]*KnownPeer{},
 	}
 	time.AfterFunc(interval, m._worker)
 	return m
@@ -74,70 +119,190 @@ func (m *ConnectionManager) _connect(uri string) {
 			return
 		}
 		if err != nil {
-			attempts.attempts++
-			until := time.Second * time.Duration(math.Exp2(attempts.attempts))
-			if until > time.Hour {
-				until = time.Hour
-			}
-			attempts.next = time.Now().Add(until)
+			m._failed(uri, attempts, err)
 		} else {
-			attempts.attempts = 0
-			attempts.next = time.Now()
+			m._succeeded(attempts)
 		}
 	}
-	ctx, cancel := context.WithTimeout(m.ctx, interval)
+	candidates := []string{uri}
+	if attempts := m._staticPeers[uri]; attempts != nil {
+		candidates = attempts.candidates
+	}
+	endpoint, err := m.race(candidates, m._options)
+	if attempts := m._staticPeers[uri]; attempts != nil && endpoint != nil {
+		attempts.endpoint = endpoint
+	}
+	result(err)
+}
+
+// race connects to the first of the candidates that completes the
+// handshake, following Happy Eyeballs (RFC 8305). The candidates are dialled
+// in order, each one starting either once the one before has failed or
+// after raceDelay, whichever is sooner. Once one has completed the handshake
+// the others are abandoned, and if another completes the handshake at the
+// same moment then it is disconnected again.
+func (m *ConnectionManager) race(candidates []string, options []router.ConnectionOption) (*staticEndpoint, error) {
+	if len(candidates) == 1 {
+		return m.dial(m.ctx, candidates[0], options)
+	}
+	ctx, cancel := context.WithCancel(m.ctx)
+	defer cancel()
+	type outcome struct {
+		endpoint *staticEndpoint
+		err      error
+	}
+	var won atomic.Bool
+	results := make(chan outcome, len(candidates))
+	next := 0
+	start := func() <-chan time.Time {
+		candidate := candidates[next]
+		next++
+		go func() {
+			endpoint, err := m.dial(ctx, candidate, options)
+			if err == nil && !won.CAS(false, true) {
+				m.router.Disconnect(endpoint.port, errLostRace)
+				err = errLostRace
+			}
+			results <- outcome{endpoint, err}
+		}()
+		if next == len(candidates) {
+			return nil
+		}
+		return time.After(raceDelay)
+	}
+	stagger := start()
+	var errs []string
+	for running := 1; running > 0; {
+		select {
+		case <-stagger:
+			stagger = start()
+			running++
+		case result := <-results:
+			running--
+			if result.err == nil {
+				return result.endpoint, nil
+			}
+			errs = append(errs, result.err.Error())
+			if next < len(candidates) {
+				// Don't wait for the delay if the last one failed.
+				stagger = start()
+				running++
+			}
+		}
+	}
+	return nil, fmt.Errorf("all candidates failed: %s", strings.Join(errs, "; "))
+}
+
+// dial connects to a single candidate URI and completes the handshake.
+// The handshake is abandoned if the context is cancelled.
+func (m *ConnectionManager) dial(ctx context.Context, uri string, options []router.ConnectionOption) (*staticEndpoint, error) {
+	dialCtx, cancel := context.WithTimeout(ctx, interval)
 	defer cancel()
 	var parent net.Conn
 	switch {
 	case strings.HasPrefix(uri, "ws://"):
 		fallthrough
 	case strings.HasPrefix(uri, "wss://"):
-		c, _, err := websocket.Dial(ctx, uri, m.ws)
+		c, _, err := websocket.Dial(dialCtx, uri, m.ws)
 		if err != nil {
-			result(err)
-			return
+			return nil, err
 		}
 		parent = websocket.NetConn(m.ctx, c, websocket.MessageBinary)
-	default:
+	case strings.HasPrefix(uri, unixScheme):
 		var err error
-		dialer := net.Dialer{
-			Timeout: interval,
+		parent, err = dialUnix(dialCtx, strings.TrimPrefix(uri, unixScheme))
+		if err != nil {
+			return nil, err
 		}
-		parent, err = dialer.DialContext(ctx, "tcp", uri)
+	default:
+		var err error
+		parent, err = dialTCP(dialCtx, uri)
 		if err != nil {
-			result(err)
-			return
+			return nil, err
 		}
 	}
 	if parent == nil {
-		result(fmt.Errorf("no parent connection"))
-		return
+		return nil, fmt.Errorf("no parent connection")
+	}
+	zone := "static"
+	if strings.HasPrefix(uri, unixScheme) {
+		zone = UnixZone
 	}
-	_, err := m.router.Connect(
-		parent,
-		router.ConnectionZone("static"),
+	// The dial timeout doesn't apply to the handshake, which has its own
+	// timeout, but the handshake is still abandoned if we are closed.
+	options = append([]router.ConnectionOption{
+		router.ConnectionZone(zone),
 		router.ConnectionPeerType(router.PeerTypeRemote),
 		router.ConnectionURI(uri),
-	)
-	result(err)
+	}, options...)
+	ip := remoteIP(parent)
+	port, err := m.router.ConnectWithContext(ctx, parent, options...)
+	if err != nil {
+		return nil, err
+	}
+	return &staticEndpoint{
+		uri:      uri,
+		port:     port,
+		ip:       ip,
+		resolved: time.Now(),
+	}, nil
 }
 
 func (m *ConnectionManager) _worker() {
+	if m.ctx.Err() != nil {
+		return
+	}
 	for k := range m._connectedPeers {
 		delete(m._connectedPeers, k)
 	}
+	peerInfos := map[string]router.PeerInfo{}
 	for _, peerInfo := range m.router.Peers() {
 		m._connectedPeers[peerInfo.URI] = struct{}{}
+		peerInfos[peerInfo.URI] = peerInfo
 	}
 
-	for peer, attempts := range m._staticPeers {
-		if _, ok := m._connectedPeers[peer]; !ok && time.Now().After(attempts.next) {
-			uri := peer
-			m.Act(nil, func() {
-				m._connect(uri)
-			})
+	m.Act(nil, m._refreshEndpoints)
+
+	// Reserved peers are queued up first so that they are reconnected
+	// before any others, and then the rest in order of reputation. Known
+	// peers from the peer store are only connected to while we have fewer
+	// than we want.
+	now := time.Now()
+	wanted := m._reconnectKnown
+	var due []string
+	for _, peer := range m._reconnectOrder() {
+		attempts := m._staticPeers[peer]
+		connected := m._connected(attempts)
+		m._checkUptime(peer, attempts, connected)
+		if connected {
+			for _, uri := range attempts.candidates {
+				if peerInfo, ok := peerInfos[uri]; ok {
+					m._observeKnownPeer(peer, peerInfo, now)
+					break
+				}
+			}
+			if attempts.known {
+				wanted--
+			}
+			continue
+		}
+		if !attempts.gaveUp && now.After(attempts.next) {
+			due = append(due, peer)
 		}
 	}
+	for _, peer := range due {
+		if m._staticPeers[peer].known {
+			if wanted <= 0 {
+				continue
+			}
+			wanted--
+		}
+		uri := peer
+		m.Act(nil, func() {
+			m._connect(uri)
+		})
+	}
+	m._maintainPeerStore(now)
 
 	select {
 	case <-m.ctx.Done():
@@ -146,14 +311,80 @@ func (m *ConnectionManager) _worker() {
 	}
 }
 
+// _connected returns true if we are peered with the static peer at any of
+// its candidate URIs.
+func (m *ConnectionManager) _connected(attempts *connectionAttempts) bool {
+	for _, uri := range attempts.candidates {
+		if _, ok := m._connectedPeers[uri]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Close stops the connection manager from making any more connection
+// attempts to static peers. Existing peerings are left alone.
+func (m *ConnectionManager) Close() {
+	m.cancel()
+}
+
+// SetConnectionOptions sets extra options, such as socket options or write
+// coalescing, which are used for all future connections to static peers.
+func (m *ConnectionManager) SetConnectionOptions(options ...router.ConnectionOption) {
+	phony.Block(m, func() {
+		m._options = append(m._options[:0:0], options...)
+	})
+}
+
 func (m *ConnectionManager) AddPeer(uri string) {
+	m.addPeer([]string{uri}, false)
+}
+
+// AddPeerCandidates adds a static peer which can be reached at any of the
+// given URIs, e.g. over both IPv4 and IPv6, or over both TCP and WebSockets.
+// When connecting, the URIs are raced against each other with staggered
+// starts, in the order given, and the first to complete the handshake is
+// kept. The peer is known by the first URI, which is the one to give to
+// RemovePeer.
+func (m *ConnectionManager) AddPeerCandidates(uris ...string) {
+	if len(uris) == 0 {
+		return
+	}
+	m.addPeer(uris, false)
+}
+
+// AddReservedPeer adds a static peer which is given a reserved slot on
+// the router, so that it is never evicted when the maximum peer count is
+// reached, and which is retried more aggressively than other static peers.
+func (m *ConnectionManager) AddReservedPeer(uri string) {
+	m.router.ReservePeer(router.ReservedPeer{URIPattern: uri})
+	m.addPeer([]string{uri}, true)
+}
+
+func (m *ConnectionManager) addPeer(candidates []string, reserved bool) {
+	uri := candidates[0]
 	phony.Block(m, func() {
-		if _, existing := m._staticPeers[uri]; existing {
+		if existing, ok := m._staticPeers[uri]; ok {
+			existing.reserved = existing.reserved || reserved
+			if existing.known {
+				// The peer was restored from the peer store, but now it
+				// has been added as a static peer.
+				existing.known = false
+				existing.candidates = append([]string(nil), candidates...)
+			}
+			if existing.gaveUp {
+				// Adding a peer that we gave up on starts again.
+				existing.gaveUp = false
+				existing.attempts = 0
+				m._connect(uri)
+			}
 			return
 		}
 		m._staticPeers[uri] = &connectionAttempts{
-			attempts: 0,
-			next:     time.Now(),
+			attempts:   0,
+			next:       time.Now(),
+			reserved:   reserved,
+			candidates: append([]string(nil), candidates...),
 		}
 		m._connect(uri)
 	})
@@ -161,13 +392,17 @@ func (m *ConnectionManager) AddPeer(uri string) {
 
 func (m *ConnectionManager) RemovePeer(uri string) {
 	phony.Block(m, func() {
-		if _, existing := m._staticPeers[uri]; !existing {
+		attempts, existing := m._staticPeers[uri]
+		if !existing {
 			return
 		}
 		delete(m._staticPeers, uri)
+		delete(m._known, uri)
 		for _, peerInfo := range m.router.Peers() {
-			if peerInfo.URI == uri {
-				m.router.Disconnect(types.SwitchPortID(peerInfo.Port), fmt.Errorf("removing peer"))
+			for _, candidate := range attempts.candidates {
+				if peerInfo.URI == candidate {
+					m.router.Disconnect(types.SwitchPortID(peerInfo.Port), fmt.Errorf("removing peer"))
+				}
 			}
 		}
 	})
@@ -175,13 +410,20 @@ func (m *ConnectionManager) RemovePeer(uri string) {
 
 func (m *ConnectionManager) RemovePeers() {
 	phony.Block(m, func() {
+		static := map[string]struct{}{}
+		for _, attempts := range m._staticPeers {
+			for _, candidate := range attempts.candidates {
+				static[candidate] = struct{}{}
+			}
+		}
 		for _, peerInfo := range m.router.Peers() {
-			if _, ok := m._staticPeers[peerInfo.URI]; ok {
+			if _, ok := static[peerInfo.URI]; ok {
 				m.router.Disconnect(types.SwitchPortID(peerInfo.Port), fmt.Errorf("removing peer"))
 			}
 		}
 		for uri := range m._staticPeers {
 			delete(m._staticPeers, uri)
+			delete(m._known, uri)
 		}
 	})
 }
@@ -0,0 +1,269 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connections
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/router"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+// The connection manager forgets everything when the process exits, so
+// after a restart the only peers that it knows about are the static peers
+// that are added again. With a PeerStore, it keeps a record of each peer
+// that it has connected to, with how good the peering has been, and saves
+// the records to the store. After a restart the records are loaded again,
+// and up to a given number of the known peers that weren't added as static
+// peers are connected to as well, best reputation first.
+//
+// A peer's reputation is its smoothed quality score, scaled by how long we
+// have been connected to it in total and cut by each failed attempt to
+// reconnect since we were last connected. A peer that has been good for
+// hours is therefore preferred over one that was discovered a moment ago
+// and looks good so far. Static peers are also reconnected in order of
+// reputation, after reserved peers. Peers that we haven't been connected to
+// for knownPeerExpiry are forgotten.
+
+// knownPeerExpiry is how long a known peer is remembered for after we were
+// last connected to it.
+const knownPeerExpiry = time.Hour * 24 * 30
+
+// knownPeerTrust is how long we need to have been connected to a peer in
+// total for its reputation to reach half of its quality score.
+const knownPeerTrust = time.Hour
+
+// peerStoreInterval is how often the known peers are saved to the store.
+const peerStoreInterval = time.Minute
+
+// KnownPeer is the record of a peer that the connection manager has
+// connected to.
+type KnownPeer struct {
+	URI       string          `json:"uri"`
+	PublicKey types.PublicKey `json:"public_key"`
+	FirstSeen time.Time       `json:"first_seen"` // When we first connected to the peer
+	LastSeen  time.Time       `json:"last_seen"`  // When we were last connected to the peer
+	Uptime    time.Duration   `json:"uptime"`     // How long we have been connected to the peer in total
+	Quality   float64         `json:"quality"`    // Smoothed quality score, up to router.MaxPeerQuality
+	Failures  int             `json:"failures"`   // Failed attempts to connect since we were last connected
+}
+
+// Reputation returns how much the peer is preferred when reconnecting.
+func (k KnownPeer) Reputation() float64 {
+	uptime := k.Uptime.Seconds()
+	reputation := k.Quality * uptime / (uptime + knownPeerTrust.Seconds())
+	return reputation / float64(1+k.Failures)
+}
+
+// PeerStore keeps the known peers between restarts. It is supplied by the
+// embedder, e.g. backed by a file or a database.
+type PeerStore interface {
+	LoadPeers() ([]KnownPeer, error)
+	SavePeers(peers []KnownPeer) error
+}
+
+// FilePeerStore is a PeerStore that keeps the known peers in a JSON file
+// at the given path. A file that doesn't exist yet holds no peers.
+type FilePeerStore string
+
+func (f FilePeerStore) LoadPeers() ([]KnownPeer, error) {
+	data, err := os.ReadFile(string(f))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var peers []KnownPeer
+	if err := json.Unmarshal(data, &peers); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	return peers, nil
+}
+
+func (f FilePeerStore) SavePeers(peers []KnownPeer) error {
+	data, err := json.MarshalIndent(peers, "", "  ")
+	if err != nil {
+		return fmt.Errorf("json.MarshalIndent: %w", err)
+	}
+	// Write to a temporary file first so that a crash part way through
+	// doesn't lose the peers that were there before.
+	tmp := string(f) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, string(f))
+}
+
+// SetPeerStore loads the known peers from the store and keeps it up to date
+// from now on. Up to reconnect of the known peers that haven't been added
+// as static peers are connected to at once, best reputation first.
+func (m *ConnectionManager) SetPeerStore(store PeerStore, reconnect int) error {
+	peers, err := store.LoadPeers()
+	if err != nil {
+		return fmt.Errorf("store.LoadPeers: %w", err)
+	}
+	phony.Block(m, func() {
+		m._store, m._reconnectKnown = store, reconnect
+		now := time.Now()
+		for _, known := range peers {
+			if known.URI == "" || now.Sub(known.LastSeen) > knownPeerExpiry {
+				continue
+			}
+			known := known
+			m._known[known.URI] = &known
+			if _, ok := m._staticPeers[known.URI]; !ok {
+				m._staticPeers[known.URI] = &connectionAttempts{
+					next:       now,
+					known:      true,
+					candidates: []string{known.URI},
+				}
+			}
+		}
+	})
+	return nil
+}
+
+// KnownPeers returns the peers that we have connected to, best reputation
+// first.
+func (m *ConnectionManager) KnownPeers() []KnownPeer {
+	var peers []KnownPeer
+	phony.Block(m, func() {
+		peers = m._knownPeers()
+	})
+	return peers
+}
+
+// SavePeers saves the known peers to the store straight away, rather than
+// waiting for them to be saved in the background.
+func (m *ConnectionManager) SavePeers() error {
+	var store PeerStore
+	var peers []KnownPeer
+	phony.Block(m, func() {
+		store, peers = m._store, m._knownPeers()
+		m._lastSave = time.Now()
+	})
+	if store == nil {
+		return fmt.Errorf("no peer store")
+	}
+	return store.SavePeers(peers)
+}
+
+func (m *ConnectionManager) _knownPeers() []KnownPeer {
+	peers := make([]KnownPeer, 0, len(m._known))
+	for _, known := range m._known {
+		peers = append(peers, *known)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].Reputation() > peers[j].Reputation()
+	})
+	return peers
+}
+
+// _reputation returns the reputation of a static or known peer, or zero if
+// we haven't connected to it.
+func (m *ConnectionManager) _reputation(uri string) float64 {
+	if known := m._known[uri]; known != nil {
+		return known.Reputation()
+	}
+	return 0
+}
+
+// _reconnectOrder returns the static and known peers in the order that they
+// should be reconnected in, reserved peers first and then by reputation.
+func (m *ConnectionManager) _reconnectOrder() []string {
+	order := make([]string, 0, len(m._staticPeers))
+	for uri := range m._staticPeers {
+		order = append(order, uri)
+	}
+	sort.Slice(order, func(i, j int) bool {
+		a, b := m._staticPeers[order[i]], m._staticPeers[order[j]]
+		if a.reserved != b.reserved {
+			return a.reserved
+		}
+		if ra, rb := m._reputation(order[i]), m._reputation(order[j]); ra != rb {
+			return ra > rb
+		}
+		return order[i] < order[j]
+	})
+	return order
+}
+
+// _observeKnownPeer updates the record of a peer that we are connected to.
+func (m *ConnectionManager) _observeKnownPeer(uri string, info router.PeerInfo, now time.Time) {
+	if m._store == nil {
+		return
+	}
+	known := m._known[uri]
+	if known == nil {
+		known = &KnownPeer{
+			URI:       uri,
+			FirstSeen: now,
+			Quality:   float64(info.Quality),
+		}
+		m._known[uri] = known
+	} else if since := now.Sub(known.LastSeen); since <= interval*2 {
+		// Only count the time since the last check if we were connected
+		// the whole time, as far as we know.
+		known.Uptime += since
+	}
+	if key, err := hex.DecodeString(info.PublicKey); err == nil {
+		copy(known.PublicKey[:], key)
+	}
+	known.LastSeen = now
+	known.Quality += (float64(info.Quality) - known.Quality) / 8
+	known.Failures = 0
+}
+
+// _knownPeerFailed records a failed attempt to connect to a known peer.
+func (m *ConnectionManager) _knownPeerFailed(uri string) {
+	if known := m._known[uri]; known != nil {
+		known.Failures++
+	}
+}
+
+// _maintainPeerStore forgets known peers that have expired and saves the
+// rest to the store, if it is time to.
+func (m *ConnectionManager) _maintainPeerStore(now time.Time) {
+	if m._store == nil || now.Sub(m._lastSave) < peerStoreInterval {
+		return
+	}
+	for uri, known := range m._known {
+		if now.Sub(known.LastSeen) <= knownPeerExpiry {
+			continue
+		}
+		delete(m._known, uri)
+		if attempts := m._staticPeers[uri]; attempts != nil && attempts.known {
+			delete(m._staticPeers, uri)
+		}
+	}
+	m._lastSave = now
+	store, peers := m._store, m._knownPeers()
+	go func() {
+		// Errors are left for the next save to try again. Embedders that
+		// want to see them can call SavePeers.
+		_ = store.SavePeers(peers)
+	}()
+}
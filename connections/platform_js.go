@@ -0,0 +1,41 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build js
+// +build js
+
+package connections
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+
+	"nhooyr.io/websocket"
+)
+
+// In the browser, WebSocket connections are made by the browser itself,
+// so there is no HTTP client to configure.
+func newDialOptions(_ *http.Client) *websocket.DialOptions {
+	return &websocket.DialOptions{}
+}
+
+func dialTCP(_ context.Context, uri string) (net.Conn, error) {
+	return nil, fmt.Errorf("can't connect to %q: only ws:// and wss:// peers are supported in the browser", uri)
+}
+
+func dialUnix(_ context.Context, path string) (net.Conn, error) {
+	return nil, fmt.Errorf("can't connect to %q: unix sockets are not supported in the browser", path)
+}
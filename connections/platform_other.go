@@ -0,0 +1,42 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !js
+// +build !js
+
+package connections
+
+import (
+	"context"
+	"net"
+	"net/http"
+
+	"nhooyr.io/websocket"
+)
+
+func newDialOptions(client *http.Client) *websocket.DialOptions {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &websocket.DialOptions{
+		HTTPClient: client,
+	}
+}
+
+func dialTCP(ctx context.Context, uri string) (net.Conn, error) {
+	dialer := net.Dialer{
+		Timeout: interval,
+	}
+	return dialer.DialContext(ctx, "tcp", uri)
+}
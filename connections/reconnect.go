@@ -0,0 +1,179 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connections
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/router/events"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+// ReconnectPolicy controls how often we try to connect to a static peer
+// that we aren't connected to. After each failed attempt we wait for the
+// delay before trying again, which starts at InitialDelay and is multiplied
+// by Multiplier after each failure up to MaxDelay. Each delay is moved up
+// or down by a random fraction of up to Jitter, so that many nodes that
+// lost the same peer at the same moment don't all retry together. After
+// MaxAttempts failures in a row we give up and send an
+// events.StaticPeerGaveUp event, until the peer is added again. A peering
+// that goes down within ResetAfter of coming up counts as a failure, so
+// that a peer that accepts connections and then drops them is backed off
+// too, and the failures are only forgotten once a peering has stayed up
+// for that long. Zero fields take the values from DefaultReconnectPolicy,
+// except for Jitter, MaxAttempts and ResetAfter, which are off when zero.
+type ReconnectPolicy struct {
+	InitialDelay time.Duration
+	Multiplier   float64
+	MaxDelay     time.Duration
+	Jitter       float64 // Between 0 and 1
+	MaxAttempts  int     // Zero to never give up
+	ResetAfter   time.Duration
+}
+
+// DefaultReconnectPolicy is used for static peers that haven't been given a
+// policy of their own. Reserved peers use a MaxDelay of 30 seconds instead.
+var DefaultReconnectPolicy = ReconnectPolicy{
+	InitialDelay: time.Second * 2,
+	Multiplier:   2,
+	MaxDelay:     time.Hour,
+}
+
+// withDefaults returns the policy with the zero fields filled in.
+func (p ReconnectPolicy) withDefaults(reserved bool) ReconnectPolicy {
+	if p.InitialDelay <= 0 {
+		p.InitialDelay = DefaultReconnectPolicy.InitialDelay
+	}
+	if p.Multiplier < 1 {
+		p.Multiplier = DefaultReconnectPolicy.Multiplier
+	}
+	if p.MaxDelay <= 0 {
+		p.MaxDelay = DefaultReconnectPolicy.MaxDelay
+		if reserved {
+			p.MaxDelay = reservedBackoffMax
+		}
+	}
+	if p.Jitter < 0 {
+		p.Jitter = 0
+	} else if p.Jitter > 1 {
+		p.Jitter = 1
+	}
+	return p
+}
+
+// delay returns how long to wait after the given number of failures in a
+// row. The random number must be between 0 and 1.
+func (p ReconnectPolicy) delay(failures int, random float64) time.Duration {
+	delay := float64(p.InitialDelay) * math.Pow(p.Multiplier, float64(failures-1))
+	if delay > float64(p.MaxDelay) {
+		delay = float64(p.MaxDelay)
+	}
+	delay *= 1 + p.Jitter*(random*2-1)
+	return time.Duration(delay)
+}
+
+// _policy returns the policy for a static peer.
+func (a *connectionAttempts) _policy() ReconnectPolicy {
+	return a.policy.withDefaults(a.reserved)
+}
+
+// _failed records a failed attempt to connect to a static peer, or a
+// peering to it that went down too soon, and works out when to try again.
+func (m *ConnectionManager) _failed(uri string, attempts *connectionAttempts, err error) {
+	policy := attempts._policy()
+	attempts.attempts++
+	attempts.lastErr = err
+	m._knownPeerFailed(uri)
+	if policy.MaxAttempts > 0 && int(attempts.attempts) >= policy.MaxAttempts {
+		attempts.gaveUp = true
+		m._publish(events.StaticPeerGaveUp{
+			URI:      uri,
+			Attempts: int(attempts.attempts),
+			Error:    err.Error(),
+		})
+		return
+	}
+	attempts.next = time.Now().Add(policy.delay(int(attempts.attempts), rand.Float64()))
+}
+
+// _succeeded records that we connected to a static peer.
+func (m *ConnectionManager) _succeeded(attempts *connectionAttempts) {
+	if attempts._policy().ResetAfter <= 0 {
+		attempts.attempts = 0
+	}
+	attempts.lastErr = nil
+	attempts.connectedAt = time.Now()
+	attempts.next = time.Now()
+}
+
+// _checkUptime is called by the worker for each static peer, to notice
+// peerings that have gone down too soon or stayed up long enough for the
+// failures to be forgotten.
+func (m *ConnectionManager) _checkUptime(uri string, attempts *connectionAttempts, connected bool) {
+	if attempts.connectedAt.IsZero() {
+		return
+	}
+	resetAfter := attempts._policy().ResetAfter
+	up := time.Since(attempts.connectedAt)
+	switch {
+	case connected && up >= resetAfter:
+		attempts.attempts = 0
+	case !connected:
+		attempts.connectedAt = time.Time{}
+		if up < resetAfter {
+			m._failed(uri, attempts, fmt.Errorf("peering went down after %s", up.Round(time.Millisecond)))
+		}
+	}
+}
+
+// SetReconnectPolicy sets the policy for reconnecting to a static peer that
+// has already been added, which is known by the first URI that it was added
+// with.
+func (m *ConnectionManager) SetReconnectPolicy(uri string, policy ReconnectPolicy) error {
+	var err error
+	phony.Block(m, func() {
+		attempts, ok := m._staticPeers[uri]
+		if !ok {
+			err = fmt.Errorf("no static peer %q", uri)
+			return
+		}
+		attempts.policy = policy
+	})
+	return err
+}
+
+// Subscribe registers a subscriber to the connection manager's events,
+// such as events.StaticPeerGaveUp.
+func (m *ConnectionManager) Subscribe(ch chan<- events.Event) {
+	phony.Block(m, func() {
+		m._subscribers[ch] = &phony.Inbox{}
+	})
+}
+
+func (m *ConnectionManager) _publish(event events.Event) {
+	for ch, inbox := range m._subscribers {
+		// Create a copy of the pointer before passing into the lambda
+		chCopy := ch
+		inbox.Act(nil, func() {
+			chCopy <- event
+		})
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connections
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+// Static peers are often given by hostname, and the address behind it can
+// change, e.g. with dynamic DNS or a load balancer. Hostnames are looked up
+// again on every connection attempt, since nothing is cached between dials,
+// but a peering that stays up would otherwise keep using the old address
+// for as long as it lasts. So the hostnames of connected static peers are
+// looked up again regularly too, and if the address that we are connected
+// to is no longer one of the answers, the peering is closed and we
+// reconnect straight away to wherever the hostname points now. Failed
+// lookups are ignored, so that a DNS outage doesn't take peerings down.
+
+// resolveInterval is how often the hostnames of connected static peers are
+// looked up again, unless changed with SetResolveInterval.
+const resolveInterval = time.Minute * 5
+
+// staticEndpoint is where we are connected to a static peer.
+type staticEndpoint struct {
+	uri      string             // The candidate URI that we connected to
+	port     types.SwitchPortID // The switch port of the peering
+	ip       net.IP             // The address that the hostname resolved to, nil if unknown
+	resolved time.Time          // When we last looked up the hostname
+}
+
+// endpointHost returns the hostname in the URI if it needs looking up, or
+// an empty string if the URI isn't a TCP address or is an IP literal.
+func endpointHost(uri string) string {
+	if strings.Contains(uri, "://") {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(uri)
+	if err != nil || net.ParseIP(host) != nil {
+		return ""
+	}
+	return host
+}
+
+// remoteIP returns the address of the remote end of the connection, or nil
+// if it isn't an IP connection.
+func remoteIP(conn net.Conn) net.IP {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
+
+// SetResolveInterval changes how often the hostnames of connected static
+// peers are looked up again to see if they have moved. Zero stops them from
+// being looked up while they are connected.
+func (m *ConnectionManager) SetResolveInterval(d time.Duration) {
+	m.Act(nil, func() {
+		m._resolveInterval = d
+	})
+}
+
+// _refreshEndpoints looks up the hostnames of connected static peers that
+// are due to be looked up again.
+func (m *ConnectionManager) _refreshEndpoints() {
+	if m._resolveInterval <= 0 {
+		return
+	}
+	for peer, attempts := range m._staticPeers {
+		endpoint := attempts.endpoint
+		if endpoint == nil || endpoint.ip == nil || time.Since(endpoint.resolved) < m._resolveInterval {
+			continue
+		}
+		host := endpointHost(endpoint.uri)
+		if host == "" {
+			continue
+		}
+		endpoint.resolved = time.Now()
+		peer := peer
+		go func() {
+			ctx, cancel := context.WithTimeout(m.ctx, interval)
+			defer cancel()
+			addrs, err := m.resolver.LookupIPAddr(ctx, host)
+			m.Act(nil, func() {
+				m._checkEndpoint(peer, endpoint, host, addrs, err)
+			})
+		}()
+	}
+}
+
+// _checkEndpoint closes the peering to a static peer if its hostname no
+// longer resolves to the address that we are connected to.
+func (m *ConnectionManager) _checkEndpoint(peer string, endpoint *staticEndpoint, host string, addrs []net.IPAddr, err error) {
+	attempts := m._staticPeers[peer]
+	if err != nil || attempts == nil || attempts.endpoint != endpoint {
+		return
+	}
+	for _, addr := range addrs {
+		if addr.IP.Equal(endpoint.ip) {
+			return
+		}
+	}
+	attempts.endpoint = nil
+	attempts.next = time.Now()
+	for _, peerInfo := range m.router.Peers() {
+		if types.SwitchPortID(peerInfo.Port) == endpoint.port && peerInfo.URI == endpoint.uri {
+			m.router.Disconnect(endpoint.port, fmt.Errorf("%s no longer resolves to %s", host, endpoint.ip))
+		}
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !js
+// +build !js
+
+package connections
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+
+	"github.com/matrix-org/pinecone/router"
+)
+
+func dialUnix(ctx context.Context, path string) (net.Conn, error) {
+	dialer := net.Dialer{
+		Timeout: interval,
+	}
+	return dialer.DialContext(ctx, "unix", path)
+}
+
+// ListenUnix listens for peerings on a unix domain socket at the given
+// path, which lets multiple processes on the same machine peer with each
+// other without going through loopback TCP or multicast. Other processes
+// can connect to it by adding a static peer with a "unix://" URI, e.g.
+// "unix:///run/pinecone.sock". Unix domain sockets are also supported on
+// Windows 10 and later, so this is used there in place of named pipes.
+// Any stale socket left behind by a previous process will be removed.
+// Closing the returned listener stops accepting new peerings.
+func ListenUnix(r *router.Router, path string) (net.Listener, error) {
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("os.Remove: %w", err)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("net.Listen: %w", err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				if _, err := r.Connect(
+					conn,
+					router.ConnectionURI(unixScheme+path),
+					router.ConnectionZone(UnixZone),
+					router.ConnectionPeerType(router.PeerTypeRemote),
+					router.ConnectionInbound(true),
+				); err != nil {
+					_ = conn.Close()
+				}
+			}()
+		}
+	}()
+	return listener, nil
+}
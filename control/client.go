@@ -0,0 +1,134 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/matrix-org/pinecone/router"
+)
+
+// Client sends requests to a control server. It is safe to use from
+// multiple goroutines, although requests are sent one at a time.
+type Client struct {
+	conn  net.Conn
+	mutex sync.Mutex
+	next  uint64
+}
+
+// DialUnix connects to a control server on a unix domain socket.
+func DialUnix(path string) (*Client, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("net.Dial: %w", err)
+	}
+	return NewClient(conn), nil
+}
+
+// NewClient creates a client using an existing connection to a control
+// server.
+func NewClient(conn net.Conn) *Client {
+	return &Client{conn: conn}
+}
+
+// Close closes the connection to the control server.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Call runs a command on the server. The arguments and result are encoded
+// as JSON and either may be nil.
+func (c *Client) Call(command string, args, result interface{}) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.next++
+	req := Request{
+		ID:      c.next,
+		Command: command,
+	}
+	if args != nil {
+		var err error
+		if req.Args, err = json.Marshal(args); err != nil {
+			return fmt.Errorf("json.Marshal: %w", err)
+		}
+	}
+	if err := writeMessage(c.conn, req); err != nil {
+		return fmt.Errorf("writeMessage: %w", err)
+	}
+	var res Response
+	if err := readMessage(c.conn, &res); err != nil {
+		return fmt.Errorf("readMessage: %w", err)
+	}
+	switch {
+	case res.ID != req.ID:
+		return fmt.Errorf("expected response %d, got %d", req.ID, res.ID)
+	case res.Error != "":
+		return errors.New(res.Error)
+	case result != nil && len(res.Result) > 0:
+		if err := json.Unmarshal(res.Result, result); err != nil {
+			return fmt.Errorf("json.Unmarshal: %w", err)
+		}
+	}
+	return nil
+}
+
+// AddPeer asks the server to add a static peer.
+func (c *Client) AddPeer(uri string) error {
+	return c.Call(CommandAddPeer, PeerArgs{URI: uri}, nil)
+}
+
+// RemovePeer asks the server to remove a static peer.
+func (c *Client) RemovePeer(uri string) error {
+	return c.Call(CommandRemovePeer, PeerArgs{URI: uri}, nil)
+}
+
+// Peers returns the peerings of the router.
+func (c *Client) Peers() ([]router.PeerInfo, error) {
+	var peers []router.PeerInfo
+	err := c.Call(CommandPeers, nil, &peers)
+	return peers, err
+}
+
+// Stats returns statistics about the router.
+func (c *Client) Stats() (Stats, error) {
+	var stats Stats
+	err := c.Call(CommandStats, nil, &stats)
+	return stats, err
+}
+
+// Frames returns the breakdown of the frames that the router handled
+// recently, if its frame analyzer is enabled.
+func (c *Client) Frames() (router.FrameAnalysis, error) {
+	var analysis router.FrameAnalysis
+	err := c.Call(CommandFrames, nil, &analysis)
+	return analysis, err
+}
+
+// Health returns the health summary of the router, which says whether it
+// is ready to be used and why not.
+func (c *Client) Health() (router.HealthReport, error) {
+	var report router.HealthReport
+	err := c.Call(CommandHealth, nil, &report)
+	return report, err
+}
+
+// RotateLogs asks the server to reopen its log files.
+func (c *Client) RotateLogs() error {
+	return c.Call(CommandRotateLogs, nil, nil)
+}
@@ -0,0 +1,90 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package control
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync/atomic"
+	"testing"
+
+	"github.com/matrix-org/pinecone/router"
+)
+
+func TestControlSocket(t *testing.T) {
+	_, sk, _ := ed25519.GenerateKey(nil)
+	r := router.NewRouter(nil, sk)
+	defer r.Close()
+
+	var rotated int32
+	server := NewServer(r, nil, func() error {
+		atomic.AddInt32(&rotated, 1)
+		return nil
+	})
+	defer server.Close()
+	path := filepath.Join(t.TempDir(), "control.sock")
+	if err := server.ListenUnix(path); err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS != "windows" {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0600 {
+			t.Fatalf("expected the socket to be private, got %s", info.Mode().Perm())
+		}
+	}
+	if entries, err := os.ReadDir(filepath.Dir(path)); err != nil || len(entries) != 1 {
+		t.Fatalf("expected only the socket to be left behind, got %v (%v)", entries, err)
+	}
+
+	client, err := DialUnix(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	stats, err := client.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.PublicKey != r.PublicKey().String() || stats.Version != Version {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	health, err := client.Health()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if health.Ready || health.Peers != 0 {
+		t.Fatalf("expected a router without peers not to be ready, got %+v", health)
+	}
+	if err := client.RotateLogs(); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&rotated); n != 1 {
+		t.Fatalf("expected logs to be rotated once, got %d", n)
+	}
+	// There's no connection manager, so this should fail cleanly.
+	if err := client.AddPeer("localhost:1"); err == nil {
+		t.Fatalf("expected an error adding a peer")
+	}
+	if err := client.Call("nonsense", nil, nil); err == nil || err.Error() != fmt.Sprintf("unknown command %q", "nonsense") {
+		t.Fatalf("expected unknown command error, got %v", err)
+	}
+}
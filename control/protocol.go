@@ -0,0 +1,115 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package control implements a control socket through which a supervising
+// process can manage a router that is embedded into another application,
+// i.e. to add and remove peers, fetch statistics and rotate logs.
+//
+// Messages on the socket are JSON objects, each preceded by its length as
+// a four byte big-endian integer. The client sends a Request and the server
+// replies with a Response carrying the same ID.
+package control
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/matrix-org/pinecone/router"
+)
+
+// maxMessageSize is the largest message that will be accepted on the
+// control socket in either direction.
+const maxMessageSize = 1024 * 1024
+
+// Commands understood by the server.
+const (
+	CommandAddPeer    = "add_peer"
+	CommandRemovePeer = "remove_peer"
+	CommandPeers      = "peers"
+	CommandStats      = "stats"
+	CommandRotateLogs = "rotate_logs"
+	CommandFrames     = "frames"
+	CommandHealth     = "health"
+)
+
+// Request is sent by the client to run a command.
+type Request struct {
+	ID      uint64          `json:"id"`
+	Command string          `json:"command"`
+	Args    json.RawMessage `json:"args,omitempty"`
+}
+
+// Response is sent by the server once the command has finished. If the
+// command failed then Error is set and Result is empty.
+type Response struct {
+	ID     uint64          `json:"id"`
+	Error  string          `json:"error,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+}
+
+// PeerArgs are the arguments to CommandAddPeer and CommandRemovePeer.
+type PeerArgs struct {
+	URI string `json:"uri"`
+}
+
+// Stats is the result of CommandStats.
+type Stats struct {
+	Version   int                  `json:"version"`
+	PublicKey string               `json:"public_key"`
+	Coords    string               `json:"coords"`
+	PeerCount int                  `json:"peer_count"`
+	PowerMode string               `json:"power_mode"`
+	Suspended bool                 `json:"suspended"`
+	Rollups   []router.StatsRollup `json:"rollups,omitempty"` // Recent counts of frames forwarded and so on
+}
+
+// Version is the version of the control protocol, which is reported in
+// the stats so that supervisors can tell which commands are available.
+const Version = 3
+
+func writeMessage(w io.Writer, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %w", err)
+	}
+	if len(body) > maxMessageSize {
+		return fmt.Errorf("message exceeds maximum size of %d bytes", maxMessageSize)
+	}
+	buf := make([]byte, 4+len(body))
+	binary.BigEndian.PutUint32(buf, uint32(len(body)))
+	copy(buf[4:], body)
+	_, err = w.Write(buf)
+	return err
+}
+
+func readMessage(r io.Reader, v interface{}) error {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return err
+	}
+	length := binary.BigEndian.Uint32(header[:])
+	if length > maxMessageSize {
+		return fmt.Errorf("message exceeds maximum size of %d bytes", maxMessageSize)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	return nil
+}
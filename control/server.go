@@ -0,0 +1,204 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !js
+// +build !js
+
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/matrix-org/pinecone/connections"
+	"github.com/matrix-org/pinecone/router"
+)
+
+// Server answers requests on a control socket. Each connection is handled
+// separately and requests on a connection are answered in order.
+type Server struct {
+	router     *router.Router
+	manager    *connections.ConnectionManager
+	rotateLogs func() error
+	mutex      sync.Mutex
+	listeners  []net.Listener
+}
+
+// NewServer creates a control server for the router. The connection
+// manager is used for adding and removing peers. The rotateLogs function
+// is called for CommandRotateLogs and may be nil if the embedder doesn't
+// support log rotation.
+func NewServer(r *router.Router, m *connections.ConnectionManager, rotateLogs func() error) *Server {
+	return &Server{
+		router:     r,
+		manager:    m,
+		rotateLogs: rotateLogs,
+	}
+}
+
+// ListenUnix starts accepting control connections on a unix domain socket
+// at the given path. Any stale socket left behind by a previous process
+// is removed first. The socket is only accessible to the current user.
+func (s *Server) ListenUnix(path string) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("os.Remove: %w", err)
+	}
+	// The socket accepts connections as soon as it is bound, so it is
+	// bound inside a directory that only we can get into and only moved
+	// into place once its permissions have been restricted. Otherwise
+	// someone else could connect before the chmod.
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".pinecone-control-")
+	if err != nil {
+		return fmt.Errorf("os.MkdirTemp: %w", err)
+	}
+	defer os.RemoveAll(dir) // nolint:errcheck
+	private := filepath.Join(dir, "control.sock")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: private, Net: "unix"})
+	if err != nil {
+		return fmt.Errorf("net.ListenUnix: %w", err)
+	}
+	// The listener would only try to remove the private path when closed.
+	listener.SetUnlinkOnClose(false)
+	if err := os.Chmod(private, 0600); err != nil {
+		_ = listener.Close()
+		return fmt.Errorf("os.Chmod: %w", err)
+	}
+	if err := os.Rename(private, path); err != nil {
+		_ = listener.Close()
+		return fmt.Errorf("os.Rename: %w", err)
+	}
+	go s.Serve(unixListener{listener, path}) // nolint:errcheck
+	return nil
+}
+
+// unixListener removes the socket from its final path when closed.
+type unixListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (l unixListener) Close() error {
+	err := l.UnixListener.Close()
+	_ = os.Remove(l.path)
+	return err
+}
+
+// Serve accepts control connections from the listener until it is closed.
+func (s *Server) Serve(listener net.Listener) error {
+	s.mutex.Lock()
+	s.listeners = append(s.listeners, listener)
+	s.mutex.Unlock()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+// Close stops all of the listeners. Connections that are already open
+// are closed once their next request has been answered.
+func (s *Server) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, listener := range s.listeners {
+		_ = listener.Close()
+	}
+	s.listeners = nil
+	return nil
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close() // nolint:errcheck
+	for {
+		var req Request
+		if err := readMessage(conn, &req); err != nil {
+			return
+		}
+		res := Response{ID: req.ID}
+		result, err := s.run(req)
+		if err != nil {
+			res.Error = err.Error()
+		} else if result != nil {
+			if res.Result, err = json.Marshal(result); err != nil {
+				res.Error = fmt.Sprintf("json.Marshal: %s", err)
+			}
+		}
+		if err := writeMessage(conn, res); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) run(req Request) (interface{}, error) {
+	switch req.Command {
+	case CommandAddPeer, CommandRemovePeer:
+		var args PeerArgs
+		if err := json.Unmarshal(req.Args, &args); err != nil {
+			return nil, fmt.Errorf("invalid arguments: %w", err)
+		}
+		if args.URI == "" {
+			return nil, fmt.Errorf("no peer URI given")
+		}
+		if s.manager == nil {
+			return nil, fmt.Errorf("no connection manager")
+		}
+		if req.Command == CommandAddPeer {
+			s.manager.AddPeer(args.URI)
+		} else {
+			s.manager.RemovePeer(args.URI)
+		}
+		return nil, nil
+
+	case CommandPeers:
+		return s.router.Peers(), nil
+
+	case CommandStats:
+		return Stats{
+			Version:   Version,
+			PublicKey: s.router.PublicKey().String(),
+			Coords:    s.router.Coords().String(),
+			PeerCount: s.router.TotalPeerCount(),
+			PowerMode: s.router.PowerMode().String(),
+			Suspended: s.router.Suspended(),
+			Rollups:   s.router.StatsRollups(),
+		}, nil
+
+	case CommandFrames:
+		analysis, ok := s.router.FrameAnalysis()
+		if !ok {
+			return nil, fmt.Errorf("the frame analyzer is not enabled")
+		}
+		return analysis, nil
+
+	case CommandHealth:
+		return s.router.Health(), nil
+
+	case CommandRotateLogs:
+		if s.rotateLogs == nil {
+			return nil, fmt.Errorf("log rotation is not supported")
+		}
+		return nil, s.rotateLogs()
+
+	default:
+		return nil, fmt.Errorf("unknown command %q", req.Command)
+	}
+}
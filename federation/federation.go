@@ -0,0 +1,260 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package federation has the pieces needed to run Matrix federation over
+// Pinecone, as P2P homeservers such as Dendrite do. The server name of each
+// homeserver is the public key of its node in hex, so federation requests
+// can be sent straight to the node over a session without any DNS or
+// certificates. Connections to each server are kept open and reused, and
+// the embedder is told when servers become reachable or unreachable, so
+// that it can retry or back off from them.
+package federation
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/pinecone/router"
+	"github.com/matrix-org/pinecone/router/events"
+	"github.com/matrix-org/pinecone/sessions"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// Protocol is the session protocol that federation traffic is sent over,
+// which must be one of the protocols given to sessions.NewSessions.
+const Protocol = "matrix"
+
+// defaultIdleTimeout is how long an unused connection to another server is
+// kept open if the options don't say.
+const defaultIdleTimeout = time.Minute * 5
+
+// defaultDialTimeout is how long we will wait to open a connection to
+// another server if the options don't say.
+const defaultDialTimeout = time.Second * 30
+
+// Options configures the federation helpers. All of the fields are
+// optional.
+type Options struct {
+	IdleTimeout   time.Duration                      // How long unused connections are kept open
+	DialTimeout   time.Duration                      // How long to wait when opening a connection
+	OnReachable   func(serverName string)            // Called when a server becomes reachable
+	OnUnreachable func(serverName string, err error) // Called when a server becomes unreachable
+}
+
+// Federation sends and serves Matrix federation requests over Pinecone.
+type Federation struct {
+	router    *router.Router
+	proto     *sessions.SessionProtocol
+	options   Options
+	transport *http.Transport
+	client    *http.Client
+	context   context.Context
+	cancel    context.CancelFunc
+	mutex     sync.Mutex
+	reachable map[types.PublicKey]bool // protected by mutex
+}
+
+// New returns the federation helpers for the given router and sessions.
+// The sessions must have been created with Protocol.
+func New(r *router.Router, s *sessions.Sessions, options Options) (*Federation, error) {
+	proto := s.Protocol(Protocol)
+	if proto == nil {
+		return nil, fmt.Errorf("sessions don't include the %q protocol", Protocol)
+	}
+	if options.IdleTimeout <= 0 {
+		options.IdleTimeout = defaultIdleTimeout
+	}
+	if options.DialTimeout <= 0 {
+		options.DialTimeout = defaultDialTimeout
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	f := &Federation{
+		router:    r,
+		proto:     proto,
+		options:   options,
+		context:   ctx,
+		cancel:    cancel,
+		reachable: map[types.PublicKey]bool{},
+	}
+	f.transport = &http.Transport{
+		DialContext:         f.DialContext,
+		DialTLSContext:      f.DialContext,
+		IdleConnTimeout:     options.IdleTimeout,
+		MaxIdleConnsPerHost: 4,
+	}
+	f.client = &http.Client{
+		Transport: f,
+	}
+	ch := make(chan events.Event, 16)
+	r.Subscribe(ch)
+	go f.watchPeers(ch)
+	return f, nil
+}
+
+// Close stops the federation helpers and closes idle connections.
+func (f *Federation) Close() {
+	f.cancel()
+	f.transport.CloseIdleConnections()
+}
+
+// ServerName returns the Matrix server name of the node with the given
+// public key.
+func ServerName(pk types.PublicKey) string {
+	return pk.String()
+}
+
+// ResolveServerName returns the public key of the node with the given
+// Matrix server name, which can have a port.
+func ResolveServerName(serverName string) (types.PublicKey, error) {
+	var pk types.PublicKey
+	host := serverName
+	if h, _, err := net.SplitHostPort(serverName); err == nil {
+		host = h
+	}
+	b, err := hex.DecodeString(strings.ToLower(host))
+	if err != nil {
+		return pk, fmt.Errorf("server name %q isn't a public key: %w", serverName, err)
+	}
+	if len(b) != ed25519.PublicKeySize {
+		return pk, fmt.Errorf("server name %q isn't a public key", serverName)
+	}
+	copy(pk[:], b)
+	return pk, nil
+}
+
+// Client returns an HTTP client that sends requests to other servers over
+// Pinecone.
+func (f *Federation) Client() *http.Client {
+	return f.client
+}
+
+// RoundTrip sends a federation request to the server named by the host of
+// the URL. The "matrix", "https" and "http" schemes are all accepted, since
+// sessions are always encrypted and authenticated.
+func (f *Federation) RoundTrip(req *http.Request) (*http.Response, error) {
+	pk, err := ResolveServerName(req.URL.Host)
+	if err != nil {
+		return nil, err
+	}
+	if req.URL.Scheme != "http" {
+		req = req.Clone(req.Context())
+		req.URL.Scheme = "http"
+	}
+	res, err := f.transport.RoundTrip(req)
+	if err != nil {
+		if req.Context().Err() == nil {
+			f.setReachable(pk, err)
+		}
+		return nil, err
+	}
+	f.setReachable(pk, nil)
+	return res, nil
+}
+
+// DialContext opens a stream to the server with the given name. The
+// network is ignored.
+func (f *Federation) DialContext(ctx context.Context, _, serverName string) (net.Conn, error) {
+	pk, err := ResolveServerName(serverName)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, f.options.DialTimeout)
+	defer cancel()
+	conn, err := f.proto.DialContext(ctx, "ed25519", net.JoinHostPort(pk.String(), "0"))
+	if err != nil {
+		if !errors.Is(err, context.Canceled) {
+			f.setReachable(pk, err)
+		}
+		return nil, err
+	}
+	f.setReachable(pk, nil)
+	return conn, nil
+}
+
+// Serve serves federation requests from other servers with the handler,
+// until the sessions are closed. The server name of the sender of each
+// request can be found with RequestServerName.
+func (f *Federation) Serve(handler http.Handler) error {
+	return f.proto.ServeHandler(handler)
+}
+
+// RequestServerName returns the server name of the node that sent a
+// request to a handler served with Serve. Unlike the origin in the request's
+// Authorization header, it is authenticated by the session.
+func RequestServerName(r *http.Request) (string, bool) {
+	pk, ok := sessions.RequestPublicKey(r)
+	if !ok {
+		return "", false
+	}
+	return ServerName(pk), true
+}
+
+// Reachable returns true if the last attempt to reach the server worked,
+// or if we are peered with it directly.
+func (f *Federation) Reachable(serverName string) bool {
+	pk, err := ResolveServerName(serverName)
+	if err != nil {
+		return false
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.reachable[pk]
+}
+
+// setReachable records whether the server could be reached, and calls the
+// callbacks if that has changed.
+func (f *Federation) setReachable(pk types.PublicKey, err error) {
+	reachable := err == nil
+	f.mutex.Lock()
+	was, known := f.reachable[pk]
+	f.reachable[pk] = reachable
+	f.mutex.Unlock()
+	if known && was == reachable {
+		return
+	}
+	switch {
+	case reachable && f.options.OnReachable != nil:
+		f.options.OnReachable(ServerName(pk))
+	case !reachable && f.options.OnUnreachable != nil:
+		f.options.OnUnreachable(ServerName(pk), err)
+	}
+}
+
+// watchPeers marks servers as reachable when we peer with them directly.
+func (f *Federation) watchPeers(ch <-chan events.Event) {
+	for {
+		select {
+		case <-f.context.Done():
+			return
+		case event := <-ch:
+			added, ok := event.(events.PeerAdded)
+			if !ok {
+				continue
+			}
+			pk, err := ResolveServerName(added.PeerID)
+			if err != nil {
+				continue
+			}
+			f.setReachable(pk, nil)
+		}
+	}
+}
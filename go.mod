@@ -9,6 +9,7 @@ require (
 	github.com/quic-go/quic-go v0.32.0
 	github.com/vishvananda/netlink v1.1.0
 	go.uber.org/atomic v1.9.0
+	golang.org/x/crypto v0.4.0
 	golang.org/x/mobile v0.0.0-20220722155234-aaac322e2105
 	golang.org/x/net v0.4.0
 	golang.org/x/sys v0.3.0
@@ -27,7 +28,6 @@ require (
 	github.com/quic-go/qtls-go1-20 v0.1.0 // indirect
 	github.com/stretchr/testify v1.7.0 // indirect
 	github.com/vishvananda/netns v0.0.0-20211101163701-50045581ed74 // indirect
-	golang.org/x/crypto v0.4.0 // indirect
 	golang.org/x/exp v0.0.0-20221205204356-47842c84f3db // indirect
 	golang.org/x/mod v0.6.0 // indirect
 	golang.org/x/tools v0.2.0 // indirect
@@ -0,0 +1,214 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package multicast
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/matrix-org/pinecone/router"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// A neighbour that shares more than one network with us, or that has both
+// IPv4 and IPv6, sends us a beacon from each of its addresses. Dialling
+// every one of them would give us a peering for each, all to the same node.
+// Instead, the addresses that a neighbour's beacons come from are gathered
+// for a moment, and then dialled in order of preference, each one a little
+// after the last unless the one before has already failed. The first to
+// connect is used and the rest are given up on. Nodes that we already have
+// a multicast peering with aren't dialled again, whichever interface the
+// peering is on.
+//
+// Both sides of a new pair of neighbours will hear each other's beacons at
+// about the same time. To make it less likely that both of them dial, the
+// node with the higher key waits a little longer before dialling, so that
+// it usually finds that the other node has already connected to it.
+
+// multicastGatherWindow is how long we wait after the first beacon from a
+// neighbour for beacons from its other addresses.
+const multicastGatherWindow = time.Millisecond * 500
+
+// multicastDialStagger is how long we give each address to connect before
+// also dialling the next one.
+const multicastDialStagger = time.Millisecond * 250
+
+// multicastCandidate is an address that we heard a neighbour's beacon from.
+type multicastCandidate struct {
+	addr   *net.TCPAddr
+	intf   string     // The interface that the beacon arrived on
+	dialer net.Dialer // Bound to our address on that interface
+}
+
+// addCandidate remembers an address that a neighbour's beacon came from,
+// and dials the neighbour once its other addresses have been gathered.
+func (m *Multicast) addCandidate(key types.PublicKey, candidate multicastCandidate) {
+	m.candidatesMutex.Lock()
+	defer m.candidatesMutex.Unlock()
+	if m.candidates == nil {
+		m.candidates = map[types.PublicKey]map[string]multicastCandidate{}
+	}
+	straddr := candidate.addr.String()
+	if gathering, ok := m.candidates[key]; ok {
+		if gathering != nil {
+			gathering[straddr] = candidate
+		}
+		return
+	}
+	m.candidates[key] = map[string]multicastCandidate{straddr: candidate}
+	wait := multicastGatherWindow
+	if ours := m.r.PublicKey(); bytes.Compare(ours[:], key[:]) > 0 {
+		wait *= 2
+	}
+	time.AfterFunc(wait, func() {
+		m.dialCandidates(key)
+	})
+}
+
+// dialCandidates dials the addresses that were gathered for the neighbour
+// and peers with it over the first one to connect.
+func (m *Multicast) dialCandidates(key types.PublicKey) {
+	m.candidatesMutex.Lock()
+	gathered := m.candidates[key]
+	// Keep the entry, but without anywhere to gather, so that beacons that
+	// arrive while we are dialling are ignored.
+	m.candidates[key] = nil
+	m.candidatesMutex.Unlock()
+	defer func() {
+		m.candidatesMutex.Lock()
+		delete(m.candidates, key)
+		m.candidatesMutex.Unlock()
+	}()
+
+	if !m.started.Load() || m.r.IsPeered(key, router.PeerTypeMulticast) {
+		return
+	}
+	candidates := make([]multicastCandidate, 0, len(gathered))
+	for _, candidate := range gathered {
+		candidates = append(candidates, candidate)
+	}
+	m.sortCandidates(candidates)
+
+	winner, conn := m.dialFirst(candidates)
+	if conn == nil {
+		return
+	}
+	if !m.started.Load() || m.r.IsPeered(key, router.PeerTypeMulticast) {
+		// The neighbour connected to us while we were dialling it.
+		_ = conn.Close()
+		return
+	}
+
+	tcpconn := conn.(*net.TCPConn)
+	if err := m.tcpGeneralOptions(tcpconn); err != nil {
+		m.log.Printf("m.tcpSocketOptions: %s\n", err)
+	}
+	options := append([]router.ConnectionOption{
+		router.ConnectionZone(winner.addr.Zone),
+		router.ConnectionPeerType(router.PeerTypeMulticast),
+	}, m.peeringTags(winner.intf)...)
+	if _, err := m.r.Connect(tcpconn, options...); err != nil {
+		m.log.Println("m.s.AuthenticatedConnect:", err)
+		_ = conn.Close()
+	}
+}
+
+// sortCandidates puts the addresses that we would rather peer over first.
+// LAN interfaces are better than cellular ones, which may be metered, and
+// IPv6 link-local addresses are better than IPv4 ones, since they don't
+// change when the network hands out a new lease. Otherwise the order is
+// stable so that we keep choosing the same interface.
+func (m *Multicast) sortCandidates(candidates []multicastCandidate) {
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if za, zb := m.zoneFor(a.intf) == ZoneLAN, m.zoneFor(b.intf) == ZoneLAN; za != zb {
+			return za
+		}
+		if va, vb := a.addr.IP.To4() == nil, b.addr.IP.To4() == nil; va != vb {
+			return va
+		}
+		if a.intf != b.intf {
+			return a.intf < b.intf
+		}
+		return a.addr.String() < b.addr.String()
+	})
+}
+
+// dialFirst dials the candidates in order, starting the next one if the one
+// before hasn't connected within the stagger or as soon as it fails, and
+// returns the first connection to succeed. Any other connections that
+// succeed are closed.
+func (m *Multicast) dialFirst(candidates []multicastCandidate) (multicastCandidate, net.Conn) {
+	ctx, cancel := context.WithCancel(m.ctx)
+	defer cancel()
+
+	type result struct {
+		candidate multicastCandidate
+		conn      net.Conn
+	}
+	results := make(chan result, len(candidates))
+	dial := func(candidate multicastCandidate) {
+		// The connection is nil if the dial failed.
+		conn, _ := candidate.dialer.DialContext(ctx, "tcp", candidate.addr.String())
+		results <- result{candidate, conn}
+	}
+	// closeRest closes anything else that connects before it notices that
+	// it has been cancelled.
+	closeRest := func(pending int) {
+		for ; pending > 0; pending-- {
+			if other := <-results; other.conn != nil {
+				_ = other.conn.Close()
+			}
+		}
+	}
+
+	next, pending := 0, 0
+	stagger := time.NewTimer(0)
+	defer stagger.Stop()
+	for next < len(candidates) || pending > 0 {
+		select {
+		case <-stagger.C:
+			if next < len(candidates) {
+				go dial(candidates[next])
+				next, pending = next+1, pending+1
+				stagger.Reset(multicastDialStagger)
+			}
+		case res := <-results:
+			pending--
+			if res.conn != nil {
+				cancel()
+				go closeRest(pending)
+				return res.candidate, res.conn
+			}
+			if next < len(candidates) {
+				// Don't wait for the stagger after a failure.
+				if !stagger.Stop() {
+					select {
+					case <-stagger.C:
+					default:
+					}
+				}
+				stagger.Reset(0)
+			}
+		case <-ctx.Done():
+			go closeRest(pending)
+			return multicastCandidate{}, nil
+		}
+	}
+	return multicastCandidate{}, nil
+}
@@ -15,6 +15,7 @@
 package multicast
 
 import (
+	"bytes"
 	"context"
 	"crypto/ed25519"
 	"encoding/binary"
@@ -62,7 +63,10 @@ type Multicast struct {
 	id                string
 	started           atomic.Bool
 	interfaces        sync.Map // -> *multicastInterface
-	dialling          sync.Map
+	candidates        map[types.PublicKey]map[string]multicastCandidate
+	candidatesMutex   sync.Mutex
+	zones             sync.Map // interface name -> zone
+	sources           sync.Map // source IP -> interface name
 	listener          net.Listener
 	dialer            net.Dialer
 	tcpLC             net.ListenConfig
@@ -282,11 +286,15 @@ func (m *Multicast) accept(listener net.Listener) {
 				m.log.Println("m.tcpSocketOptions: %w", err)
 			}
 
-			if _, err := m.r.Connect(
-				tcpconn,
+			options := []router.ConnectionOption{
 				router.ConnectionZone(tcpaddr.Zone),
 				router.ConnectionPeerType(router.PeerTypeMulticast),
-			); err != nil {
+				router.ConnectionInbound(true),
+			}
+			if local, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+				options = append(options, m.peeringTags(m.interfaceFor(local))...)
+			}
+			if _, err := m.r.Connect(tcpconn, options...); err != nil {
 				//m.log.Println("m.s.AuthenticatedConnect:", err)
 				_ = conn.Close()
 			}
@@ -428,6 +436,9 @@ func (m *Multicast) advertise(intf *multicastInterface, conn net.PacketConn, add
 	first := make(chan struct{}, 1)
 	first <- struct{}{}
 	ourPublicKey := m.r.PublicKey()
+	// Routers with a network name add its hash to the beacon, so that
+	// nodes in other networks don't try to peer with us.
+	beacon := append(append(ourPublicKey[:], portBytes...), m.r.NetworkTag()...)
 	for {
 		select {
 		case <-m.ctx.Done():
@@ -438,7 +449,7 @@ func (m *Multicast) advertise(intf *multicastInterface, conn net.PacketConn, add
 		case <-first:
 		}
 		_, err := conn.WriteTo(
-			append(ourPublicKey[:], portBytes...),
+			beacon,
 			addr,
 		)
 		if err != nil {
@@ -450,12 +461,19 @@ func (m *Multicast) advertise(intf *multicastInterface, conn net.PacketConn, add
 
 func (m *Multicast) listen(intf *multicastInterface, conn net.PacketConn, srcaddr net.Addr) {
 	defer m.interfaces.Delete(intf.Name)
+	if tcpaddr, ok := srcaddr.(*net.TCPAddr); ok {
+		// Remember which interface the address belongs to, so that we
+		// know where the connections that we accept came from.
+		m.sources.Store(tcpaddr.IP.String(), intf.Name)
+		defer m.sources.Delete(tcpaddr.IP.String())
+	}
 	// defer m.log.Println("Stop listening on", intf.Name)
 	dialer := m.dialer
 	dialer.LocalAddr = srcaddr
 	dialer.Control = m.tcpOptions
 	buf := make([]byte, 512)
 	ourPublicKey := m.r.PublicKey()
+	ourNetwork := m.r.NetworkTag()
 	neighborKey := types.PublicKey{}
 	publicKey := buf[:ed25519.PublicKeySize]
 	listenPort := buf[ed25519.PublicKeySize : ed25519.PublicKeySize+2]
@@ -480,58 +498,33 @@ func (m *Multicast) listen(intf *multicastInterface, conn net.PacketConn, srcadd
 			continue
 		}
 
-		udpaddr, ok := addr.(*net.UDPAddr)
-		if !ok {
+		// Nodes in other networks would refuse to peer with us anyway.
+		if !bytes.Equal(buf[ed25519.PublicKeySize+2:n], ourNetwork) {
 			continue
 		}
 
-		if m.r.IsConnected(neighborKey, udpaddr.Zone) {
+		udpaddr, ok := addr.(*net.UDPAddr)
+		if !ok {
 			continue
 		}
 
-		tcpaddr := &net.TCPAddr{
-			IP:   udpaddr.IP,
-			Port: int(binary.BigEndian.Uint16(listenPort)),
-			Zone: udpaddr.Zone,
+		if m.r.IsPeered(neighborKey, router.PeerTypeMulticast) {
+			continue
 		}
 
 		if !m.started.Load() {
 			return
 		}
 
-		straddr := tcpaddr.String()
-		if _, ok := m.dialling.LoadOrStore(straddr, true); ok {
-			continue
-		}
-
-		go func() {
-			defer m.dialling.Delete(straddr)
-
-			conn, err := dialer.Dial("tcp", straddr)
-			if err != nil {
-				// m.log.Println("dialer.Dial:", err)
-				return
-			}
-
-			if !m.started.Load() {
-				conn.Close()
-				return
-			}
-
-			tcpconn := conn.(*net.TCPConn)
-			if err := m.tcpGeneralOptions(tcpconn); err != nil {
-				m.log.Println("m.tcpSocketOptions: %w", err)
-			}
-
-			if _, err := m.r.Connect(
-				tcpconn,
-				router.ConnectionZone(udpaddr.Zone),
-				router.ConnectionPeerType(router.PeerTypeMulticast),
-			); err != nil {
-				m.log.Println("m.s.AuthenticatedConnect:", err)
-				_ = conn.Close()
-			}
-		}()
+		m.addCandidate(neighborKey, multicastCandidate{
+			addr: &net.TCPAddr{
+				IP:   append(net.IP(nil), udpaddr.IP...),
+				Port: int(binary.BigEndian.Uint16(listenPort)),
+				Zone: udpaddr.Zone,
+			},
+			intf:   intf.Name,
+			dialer: dialer,
+		})
 	}
 }
 
@@ -0,0 +1,83 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package multicast
+
+import (
+	"net"
+	"strings"
+
+	"github.com/matrix-org/pinecone/router"
+)
+
+// Every peering that multicast discovery makes is tagged with the interface
+// that the peer was found on and the zone that the interface is in, so that
+// they show up in the peer information and so that policies can be set for
+// them with router.RouterOptionTagPolicy, i.e. to never take a parent over
+// a cellular interface. The zone is guessed from the name of the interface
+// unless it has been set with SetInterfaceZone.
+
+// Zones that interfaces can be in.
+const (
+	ZoneLAN      = "lan"
+	ZoneCellular = "cellular"
+)
+
+// cellularInterfacePrefixes are the names that Android and iOS give to
+// their cellular data interfaces.
+var cellularInterfacePrefixes = []string{"rmnet", "v4-rmnet", "ccmni", "pdp_ip", "wwan"}
+
+// SetInterfaceZone puts the named interface in the given zone, instead of
+// the zone that would be guessed from its name. It only applies to
+// peerings made after it is called.
+func (m *Multicast) SetInterfaceZone(name, zone string) {
+	m.zones.Store(name, zone)
+}
+
+// zoneFor returns the zone that the named interface is in.
+func (m *Multicast) zoneFor(name string) string {
+	if zone, ok := m.zones.Load(name); ok {
+		return zone.(string)
+	}
+	for _, prefix := range cellularInterfacePrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return ZoneCellular
+		}
+	}
+	return ZoneLAN
+}
+
+// interfaceFor returns the name of the interface that a connection was
+// accepted on, from its local address, or an empty string if it isn't one
+// of the interfaces that we are using.
+func (m *Multicast) interfaceFor(local *net.TCPAddr) string {
+	if local.Zone != "" {
+		return local.Zone
+	}
+	if name, ok := m.sources.Load(local.IP.String()); ok {
+		return name.(string)
+	}
+	return ""
+}
+
+// peeringTags returns the tags for a peering made on the named interface.
+func (m *Multicast) peeringTags(name string) []router.ConnectionOption {
+	if name == "" {
+		return nil
+	}
+	return []router.ConnectionOption{
+		router.ConnectionTag(router.PeerTagInterfacePrefix + name),
+		router.ConnectionTag(router.PeerTagZonePrefix + m.zoneFor(name)),
+	}
+}
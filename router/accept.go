@@ -0,0 +1,114 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+// When a large deployment restarts, thousands of nodes can dial the same
+// relays at once. Handshakes are expensive, so without some protection the
+// relays spend all of their time on handshakes that mostly time out, and
+// the network takes far longer to come back than if the nodes had arrived
+// a few at a time. With RouterOptionAcceptLimits, connections that are
+// marked with ConnectionInbound are refused straight away, before the
+// handshake starts, once they arrive faster than the accept rate allows,
+// and are refused after the handshake if the remote host already has too
+// many peerings with us. Refused nodes will retry with their usual backoff,
+// which spreads them out. The number of handshakes in progress at once is
+// limited separately by RouterOptionHandshakeLimits.
+//
+// Connections whose remote address has no host, such as pipes and unix
+// sockets, are only limited by the accept rate.
+
+type acceptLimiter struct {
+	clock        Clock
+	rate         float64 // Connections per second, zero means no limit
+	burst        float64 // Connections that can be accepted at once
+	maxPerSource int     // Zero means no limit
+	mutex        sync.Mutex
+	tokens       float64
+	last         time.Time
+}
+
+func newAcceptLimiter(o RouterOptionAcceptLimits, clock Clock) *acceptLimiter {
+	l := &acceptLimiter{
+		clock:        clock,
+		rate:         o.Rate,
+		burst:        float64(o.Burst),
+		maxPerSource: o.MaxPeersPerSource,
+		last:         clock.Now(),
+	}
+	if l.burst < 1 {
+		l.burst = l.rate
+	}
+	if l.burst < 1 {
+		l.burst = 1
+	}
+	l.tokens = l.burst
+	return l
+}
+
+// allow takes a token for a new inbound connection, returning an error if
+// there isn't one because connections are arriving too quickly.
+func (l *acceptLimiter) allow() error {
+	if l.rate <= 0 {
+		return nil
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := l.clock.Now()
+	if elapsed := now.Sub(l.last); elapsed > 0 {
+		l.tokens += elapsed.Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return fmt.Errorf("%w: accepting more than %g connections per second", ErrTooManyConnections, l.rate)
+	}
+	l.tokens--
+	return nil
+}
+
+// _checkSourceLimit returns an error if the remote host of the connection
+// already has as many peerings with us as it is allowed.
+func (s *state) _checkSourceLimit(conn net.Conn) error {
+	max := s.r.accept.maxPerSource
+	source := handshakeSource(conn.RemoteAddr())
+	if max <= 0 || source == "" {
+		return nil
+	}
+	count := 0
+	for _, p := range s._peers {
+		if p == nil || p == s.r.local || !p.started.Load() || p.conn == nil {
+			continue
+		}
+		if handshakeSource(p.conn.RemoteAddr()) == source {
+			count++
+		}
+	}
+	if count >= max {
+		return fmt.Errorf("%w: %d peerings with %s", ErrTooManyConnections, count, source)
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+	"go.uber.org/atomic"
+)
+
+func TestAcceptRate(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	l := newAcceptLimiter(RouterOptionAcceptLimits{Rate: 2, Burst: 3}, clock)
+
+	for i := 0; i < 3; i++ {
+		if err := l.allow(); err != nil {
+			t.Fatalf("connection %d within the burst was refused: %v", i, err)
+		}
+	}
+	if err := l.allow(); !errors.Is(err, ErrTooManyConnections) {
+		t.Fatalf("expected ErrTooManyConnections once the burst was used, got %v", err)
+	}
+
+	// Two tokens come back every second, up to the burst.
+	clock.Advance(time.Second)
+	for i := 0; i < 2; i++ {
+		if err := l.allow(); err != nil {
+			t.Fatalf("connection %d was refused after the bucket refilled: %v", i, err)
+		}
+	}
+	if err := l.allow(); !errors.Is(err, ErrTooManyConnections) {
+		t.Fatalf("expected ErrTooManyConnections, got %v", err)
+	}
+	clock.Advance(time.Hour)
+	for i := 0; i < 3; i++ {
+		if err := l.allow(); err != nil {
+			t.Fatalf("connection %d was refused after a long wait: %v", i, err)
+		}
+	}
+	if err := l.allow(); !errors.Is(err, ErrTooManyConnections) {
+		t.Fatalf("expected the bucket to hold no more than the burst, got %v", err)
+	}
+
+	// Without a rate, connections aren't limited.
+	l = newAcceptLimiter(RouterOptionAcceptLimits{}, clock)
+	for i := 0; i < 100; i++ {
+		if err := l.allow(); err != nil {
+			t.Fatalf("connection %d was refused without a limit: %v", i, err)
+		}
+	}
+}
+
+func TestAcceptRateRefusesInbound(t *testing.T) {
+	_, sk, _ := ed25519.GenerateKey(nil)
+	r := NewRouter(nil, sk, RouterOptionAcceptLimits{Rate: 0.001, Burst: 1})
+	t.Cleanup(func() { _ = r.Close() })
+
+	// Use up the only token with a handshake that never finishes.
+	first, remote := net.Pipe()
+	defer remote.Close()
+	go func() {
+		_, _ = r.ConnectWithContext(r.context, first, ConnectionInbound(true))
+	}()
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		r.accept.mutex.Lock()
+		tokens := r.accept.tokens
+		r.accept.mutex.Unlock()
+		if tokens < 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("first connection wasn't accepted")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	second, other := net.Pipe()
+	defer other.Close()
+	if _, err := r.Connect(second, ConnectionInbound(true)); !errors.Is(err, ErrTooManyConnections) {
+		t.Fatalf("expected ErrTooManyConnections, got %v", err)
+	}
+	if _, err := second.Write([]byte{0}); err == nil {
+		t.Fatalf("refused connection wasn't closed")
+	}
+}
+
+func TestAcceptPerSource(t *testing.T) {
+	s := newTestState(types.PublicKey{1}, NewManualClock(time.Unix(1000, 0)))
+	s.r.accept = newAcceptLimiter(RouterOptionAcceptLimits{MaxPeersPerSource: 2}, systemClock{})
+	from := func(addr string) net.Conn {
+		tcp, err := net.ResolveTCPAddr("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return addrConn{remote: tcp}
+	}
+	pipe, _ := net.Pipe()
+	s._peers = append(s._peers, []*peer{
+		{started: *atomic.NewBool(true), conn: from("192.0.2.1:1000")},
+		{started: *atomic.NewBool(true), conn: from("192.0.2.1:1001")},
+		{started: *atomic.NewBool(false), conn: from("192.0.2.2:1000")},
+		{started: *atomic.NewBool(true), conn: from("192.0.2.2:1001")},
+		{started: *atomic.NewBool(true), conn: pipe},
+		{started: *atomic.NewBool(true), conn: pipe},
+		nil,
+	}...)
+
+	if err := s._checkSourceLimit(from("192.0.2.1:1002")); !errors.Is(err, ErrTooManyConnections) {
+		t.Fatalf("expected a third peering with the same host to be refused, got %v", err)
+	}
+	// Peers that have stopped don't count.
+	if err := s._checkSourceLimit(from("192.0.2.2:1002")); err != nil {
+		t.Fatalf("second peering with another host was refused: %v", err)
+	}
+	// Connections without a host aren't limited.
+	if err := s._checkSourceLimit(pipe); err != nil {
+		t.Fatalf("connection over a pipe was refused: %v", err)
+	}
+}
@@ -0,0 +1,238 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/router/events"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+// Traffic for a key goes to the node closest to it in the keyspace, so a
+// node that lies about where it is in the keyspace can attract traffic
+// that isn't meant for it, which is the basis of a sybil routing attack.
+// With RouterOptionAdjacencyProofs, each node regularly sends a signed
+// statement of who its ascending and descending nodes are to both of them.
+// A node that receives one checks it against what it knows: a node that
+// confirmed our bootstrap should name us as its descending node, a node
+// that bootstrapped to us should name us as its ascending node, and a node
+// that names us as a neighbour shouldn't have another node that we know
+// about between it and us. While the SNEK is converging the statements can
+// disagree for a moment, so an inconsistency is only reported if two
+// statements in a row from the same node show it. The statements are kept
+// with the report, since they are signed and so can be shown to others.
+
+// adjacencyMaxStatements is how many nodes we remember statements from.
+const adjacencyMaxStatements = 64
+
+// adjacencyMaxInconsistencies is how many inconsistencies are kept for the
+// AdjacencyInconsistencies API.
+const adjacencyMaxInconsistencies = 32
+
+// AdjacencyInconsistency describes a node whose signed statement about its
+// keyspace neighbours disagreed with what we know.
+type AdjacencyInconsistency struct {
+	PublicKey types.PublicKey             `json:"public_key"` // The node that made the statement
+	Reason    string                      `json:"reason"`
+	At        time.Time                   `json:"at"`
+	Statement types.VirtualSnakeAdjacency `json:"statement"`
+}
+
+type adjacencyRecord struct {
+	statement types.VirtualSnakeAdjacency
+	received  time.Time
+	suspect   string // Why the last statement looked wrong, if it did
+}
+
+type adjacencyTracker struct {
+	lastSent        time.Time
+	statements      map[types.PublicKey]*adjacencyRecord
+	inconsistencies []AdjacencyInconsistency // Oldest first
+}
+
+// _ascendingKey returns the key of the node that last confirmed one of our
+// bootstraps, if the confirmation is recent enough to still be true.
+func (s *state) _ascendingKey() types.PublicKey {
+	if c := s._bootstrapConfirm; c != nil && since(s.r.clock, c.At) < s.r.timings.PathExpiry {
+		return c.PublicKey
+	}
+	return types.PublicKey{}
+}
+
+// _descendingKey returns the key of our descending node, if we have one.
+func (s *state) _descendingKey() types.PublicKey {
+	if s._descending != nil {
+		return s._descending.PublicKey
+	}
+	return types.PublicKey{}
+}
+
+// _sendAdjacency sends a signed statement of who our neighbours are to each
+// of them, once per bootstrap interval. It is called during SNEK
+// maintenance.
+func (s *state) _sendAdjacency() {
+	a := &s._adjacency
+	if !s.r.adjacency || since(s.r.clock, a.lastSent) < s.r.timings.BootstrapInterval {
+		return
+	}
+	a.lastSent = s.r.clock.Now()
+	for key, rec := range a.statements {
+		if since(s.r.clock, rec.received) >= s.r.timings.PathExpiry {
+			delete(a.statements, key)
+		}
+	}
+	statement := types.VirtualSnakeAdjacency{
+		Sequence:   types.Varu64(s.r.clock.Now().UnixMilli()),
+		Ascending:  s._ascendingKey(),
+		Descending: s._descendingKey(),
+	}
+	if s.r.secure {
+		protected, err := statement.ProtectedPayload()
+		if err != nil {
+			return
+		}
+		copy(statement.Signature[:], s.r.sign(protected))
+	}
+	for _, key := range []types.PublicKey{statement.Ascending, statement.Descending} {
+		if key.IsEmpty() {
+			continue
+		}
+		frame := getFrame()
+		frame.Type = types.TypeSNEKAdjacency
+		frame.DestinationKey = key
+		frame.SourceKey = s.r.public
+		frame.Watermark = types.VirtualSnakeWatermark{
+			PublicKey: types.FullMask,
+			Sequence:  0,
+		}
+		n, err := statement.MarshalBinary(frame.Payload[:cap(frame.Payload)])
+		if err != nil {
+			framePool.Put(frame)
+			return
+		}
+		frame.Payload = frame.Payload[:n]
+		_ = s._forward(s.r.local, frame)
+	}
+}
+
+// _handleAdjacency is called when a statement from another node about its
+// neighbours arrives.
+func (s *state) _handleAdjacency(rx *types.Frame) error {
+	if !s.r.adjacency {
+		return nil
+	}
+	var statement types.VirtualSnakeAdjacency
+	if _, err := types.Decode(&statement, rx.Payload); err != nil {
+		return fmt.Errorf("statement.UnmarshalBinary: %w", err)
+	}
+	if s.r.secure {
+		protected, err := statement.ProtectedPayload()
+		if err != nil {
+			return fmt.Errorf("statement.ProtectedPayload: %w", err)
+		}
+		if !s.r.verify(rx.SourceKey[:], protected, statement.Signature[:]) {
+			return nil
+		}
+	}
+	a := &s._adjacency
+	if a.statements == nil {
+		a.statements = map[types.PublicKey]*adjacencyRecord{}
+	}
+	rec := a.statements[rx.SourceKey]
+	switch {
+	case rec == nil && len(a.statements) >= adjacencyMaxStatements:
+		return nil
+	case rec == nil:
+		rec = &adjacencyRecord{}
+		a.statements[rx.SourceKey] = rec
+	case statement.Sequence <= rec.statement.Sequence:
+		// The statement is older than one that we already have.
+		return nil
+	}
+	rec.statement = statement
+	rec.received = s.r.clock.Now()
+
+	reason := s._checkAdjacency(rx.SourceKey, &statement)
+	if reason != "" && reason == rec.suspect {
+		s._adjacencyInconsistent(rx.SourceKey, &statement, reason)
+	}
+	rec.suspect = reason
+	return nil
+}
+
+// _checkAdjacency returns why the statement from the given node disagrees
+// with what we know, or an empty string if it doesn't.
+func (s *state) _checkAdjacency(from types.PublicKey, st *types.VirtualSnakeAdjacency) string {
+	us, asc, desc := s.r.public, s._ascendingKey(), s._descendingKey()
+	between := func(key, low, high types.PublicKey) bool {
+		return key.CompareTo(low) > 0 && key.CompareTo(high) < 0
+	}
+	switch {
+	case !st.Descending.IsEmpty() && st.Descending.CompareTo(from) >= 0:
+		return fmt.Sprintf("claims %s, which isn't lower than its own key, as its descending node", st.Descending)
+	case !st.Ascending.IsEmpty() && st.Ascending.CompareTo(from) <= 0:
+		return fmt.Sprintf("claims %s, which isn't higher than its own key, as its ascending node", st.Ascending)
+	case from == asc && st.Descending != us:
+		return fmt.Sprintf("confirmed our bootstrap but claims %s as its descending node", st.Descending)
+	case from == desc && st.Ascending != us:
+		return fmt.Sprintf("bootstrapped to us but claims %s as its ascending node", st.Ascending)
+	case st.Descending == us && !asc.IsEmpty() && between(asc, us, from):
+		return fmt.Sprintf("claims us as its descending node but %s is between us", asc)
+	case st.Ascending == us && !desc.IsEmpty() && between(desc, from, us):
+		return fmt.Sprintf("claims us as its ascending node but %s is between us", desc)
+	}
+	return ""
+}
+
+// _adjacencyInconsistent reports a statement that disagrees with what we
+// know.
+func (s *state) _adjacencyInconsistent(from types.PublicKey, st *types.VirtualSnakeAdjacency, reason string) {
+	a := &s._adjacency
+	if len(a.inconsistencies) >= adjacencyMaxInconsistencies {
+		a.inconsistencies = a.inconsistencies[1:]
+	}
+	a.inconsistencies = append(a.inconsistencies, AdjacencyInconsistency{
+		PublicKey: from,
+		Reason:    reason,
+		At:        s.r.clock.Now(),
+		Statement: *st,
+	})
+	s.r.log.Printf("Node %s is inconsistent about its keyspace neighbours: %s", from, reason)
+	s._recordEvent(ProtocolAdjacencyInconsistent, from, nil, reason)
+	s.r.Act(nil, func() {
+		s.r._publish(events.AdjacencyInconsistent{
+			PeerID: from.String(),
+			Reason: reason,
+		})
+	})
+}
+
+// AdjacencyInconsistencies returns the most recent nodes whose signed
+// statements about their keyspace neighbours disagreed with what we know,
+// oldest first. It is only populated if RouterOptionAdjacencyProofs is
+// given.
+func (r *Router) AdjacencyInconsistencies() []AdjacencyInconsistency {
+	var result []AdjacencyInconsistency
+	phony.Block(r.state, func() {
+		result = append(result, r.state._adjacency.inconsistencies...)
+	})
+	return result
+}
@@ -0,0 +1,130 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestCheckAdjacency(t *testing.T) {
+	s := newTestState(types.PublicKey{5}, systemClock{})
+	s._descending = &virtualSnakeEntry{
+		virtualSnakeIndex: &virtualSnakeIndex{PublicKey: types.PublicKey{3}},
+	}
+	s._bootstrapConfirm = &bootstrapConfirmation{
+		PublicKey: types.PublicKey{7},
+		At:        time.Now(),
+	}
+	cases := []struct {
+		desc      string
+		from      types.PublicKey
+		statement types.VirtualSnakeAdjacency
+		expected  bool
+	}{
+		{"ascending agrees", types.PublicKey{7}, types.VirtualSnakeAdjacency{Ascending: types.PublicKey{8}, Descending: types.PublicKey{5}}, false},
+		{"descending agrees", types.PublicKey{3}, types.VirtualSnakeAdjacency{Ascending: types.PublicKey{5}, Descending: types.PublicKey{1}}, false},
+		{"ascending names another", types.PublicKey{7}, types.VirtualSnakeAdjacency{Descending: types.PublicKey{6}}, true},
+		{"descending names another", types.PublicKey{3}, types.VirtualSnakeAdjacency{Ascending: types.PublicKey{4}}, true},
+		{"descending above itself", types.PublicKey{2}, types.VirtualSnakeAdjacency{Descending: types.PublicKey{9}}, true},
+		{"ascending below itself", types.PublicKey{9}, types.VirtualSnakeAdjacency{Ascending: types.PublicKey{8}}, true},
+		{"claims us past our ascending", types.PublicKey{9}, types.VirtualSnakeAdjacency{Descending: types.PublicKey{5}}, true},
+		{"claims us past our descending", types.PublicKey{1}, types.VirtualSnakeAdjacency{Ascending: types.PublicKey{5}}, true},
+		{"unrelated", types.PublicKey{9}, types.VirtualSnakeAdjacency{Descending: types.PublicKey{8}}, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			if reason := s._checkAdjacency(tc.from, &tc.statement); (reason != "") != tc.expected {
+				t.Fatalf("expected inconsistent: %t, got reason %q", tc.expected, reason)
+			}
+		})
+	}
+}
+
+func TestAdjacencyNeedsTwoStatements(t *testing.T) {
+	s := newTestState(types.PublicKey{5}, systemClock{})
+	s.r.adjacency = true
+	liar := types.PublicKey{9}
+	send := func(sequence types.Varu64) {
+		statement := types.VirtualSnakeAdjacency{Sequence: sequence, Descending: types.PublicKey{10}}
+		frame := &types.Frame{SourceKey: liar, Payload: make([]byte, 256)}
+		n, err := statement.MarshalBinary(frame.Payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frame.Payload = frame.Payload[:n]
+		if err := s._handleAdjacency(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	send(1)
+	if len(s._adjacency.inconsistencies) != 0 {
+		t.Fatalf("expected a single statement not to be reported")
+	}
+	send(1)
+	if len(s._adjacency.inconsistencies) != 0 {
+		t.Fatalf("expected a replayed statement to be ignored")
+	}
+	send(2)
+	if len(s._adjacency.inconsistencies) != 1 || s._adjacency.inconsistencies[0].PublicKey != liar {
+		t.Fatalf("expected the node to be reported, got %v", s._adjacency.inconsistencies)
+	}
+}
+
+func TestAdjacencyProofsExchanged(t *testing.T) {
+	var routers [2]*Router
+	for i := range routers {
+		_, sk, _ := ed25519.GenerateKey(nil)
+		routers[i] = NewRouter(nil, sk, RouterOptionAdjacencyProofs(true))
+		r := routers[i]
+		t.Cleanup(func() { _ = r.Close() })
+	}
+	if errA, errB := connectTestRouters(t, routers[0], routers[1]); errA != nil || errB != nil {
+		t.Fatalf("failed to peer routers: %v, %v", errA, errB)
+	}
+
+	// Each node should hear from the other once they are neighbours, and
+	// the statements should agree.
+	deadline := time.Now().Add(time.Second * 10)
+	for _, r := range routers {
+		for {
+			var statements int
+			phony.Block(r.state, func() {
+				statements = len(r.state._adjacency.statements)
+				if statements == 0 {
+					// Don't wait for the next bootstrap interval.
+					r.state._adjacency.lastSent = time.Time{}
+				}
+			})
+			if statements > 0 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected a statement from the other node")
+			}
+			time.Sleep(time.Millisecond * 100)
+		}
+	}
+	for _, r := range routers {
+		if inconsistencies := r.AdjacencyInconsistencies(); len(inconsistencies) != 0 {
+			t.Fatalf("expected no inconsistencies, got %v", inconsistencies)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestAggregateSignatures(t *testing.T) {
+	newRouter := func(opts ...RouterOption) *Router {
+		_, sk, _ := ed25519.GenerateKey(nil)
+		r := NewRouter(nil, sk, opts...)
+		t.Cleanup(func() { _ = r.Close() })
+		return r
+	}
+	secret := RouterOptionAggregateSignatures("network secret")
+
+	// Nodes that aggregate signatures can't peer with nodes that don't.
+	errA, errB := connectTestRouters(t, newRouter(secret), newRouter())
+	if !errors.Is(errA, ErrIncompatiblePeer) || !errors.Is(errB, ErrIncompatiblePeer) {
+		t.Fatalf("expected incompatible peers, got %v, %v", errA, errB)
+	}
+
+	// In a line of three nodes, the announcement has to pass through the
+	// middle node for the tree to converge.
+	a, b, c := newRouter(secret), newRouter(secret), newRouter(secret)
+	if errA, errB := connectTestRouters(t, a, b); errA != nil || errB != nil {
+		t.Fatalf("failed to peer: %v, %v", errA, errB)
+	}
+	if errB, errC := connectTestRouters(t, b, c); errB != nil || errC != nil {
+		t.Fatalf("failed to peer: %v, %v", errB, errC)
+	}
+	root := func(r *Router) (key types.PublicKey) {
+		phony.Block(r.state, func() {
+			key = r.state._rootAnnouncement().RootPublicKey
+		})
+		return
+	}
+	deadline := time.Now().Add(time.Second * 10)
+	for {
+		if root(a) == root(b) && root(b) == root(c) {
+			depth := len(a.Coords()) + len(b.Coords()) + len(c.Coords())
+			if depth == 3 || (depth == 2 && len(b.Coords()) == 0) {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("tree didn't converge")
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+}
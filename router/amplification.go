@@ -0,0 +1,133 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"crypto/ed25519"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+// Some requests are answered without the source key being checked, i.e.
+// echo requests, searches and lookups that we answer from a continuity
+// record, so anybody can send one of them with the key of a victim as the
+// source and we will send the reply to the victim instead. If the replies
+// are bigger than the requests, or there are many of us, then we would be
+// amplifying the attack. With RouterOptionAmplificationLimit, the replies
+// to each source key are limited to a multiple of the bytes that we
+// received from it within a window, and anything over that is dropped.
+// Peerings aren't affected, since we don't handle any frames from a peer
+// until it has completed the handshake and proved that it holds its key.
+
+// amplificationConfig is set by RouterOptionAmplificationLimit.
+type amplificationConfig struct {
+	factor uint64
+	window time.Duration
+}
+
+func newAmplificationConfig(o RouterOptionAmplificationLimit) *amplificationConfig {
+	c := &amplificationConfig{
+		factor: uint64(o.Factor),
+		window: o.Window,
+	}
+	if o.Factor <= 0 {
+		c.factor = amplificationDefaultFactor
+	}
+	if c.window <= 0 {
+		c.window = amplificationDefaultWindow
+	}
+	return c
+}
+
+// amplificationCounts are the bytes that we received from and sent to a
+// source key since the start of its window.
+type amplificationCounts struct {
+	received uint64
+	sent     uint64
+	since    time.Time
+}
+
+type amplificationState struct {
+	sources map[types.PublicKey]*amplificationCounts
+	refused uint64
+}
+
+// AmplificationStats shows how the amplification limit is being applied.
+type AmplificationStats struct {
+	Sources int    // Source keys that we are counting bytes for
+	Refused uint64 // Replies dropped because they were over the limit
+}
+
+// AmplificationStats returns how the amplification limit is being applied.
+func (r *Router) AmplificationStats() (stats AmplificationStats) {
+	phony.Block(r.state, func() {
+		stats.Sources = len(r.state._amplification.sources)
+		stats.Refused = r.state._amplification.refused
+	})
+	return
+}
+
+// amplificationSize is roughly how many bytes the frame takes on the wire.
+// Requests and replies are addressed in the same way, so the estimate only
+// has to be consistent between them.
+func amplificationSize(f *types.Frame) uint64 {
+	return uint64(types.FrameHeaderLength + ed25519.PublicKeySize*2 + len(f.Destination) + len(f.Source) + len(f.Payload))
+}
+
+// _replyAllowed counts the request and returns true if the reply to it can
+// be sent without going over the amplification limit for the source key of
+// the request. The reply must be dropped otherwise.
+func (s *state) _replyAllowed(request, reply *types.Frame) bool {
+	c := s.r.amplification
+	if c == nil {
+		return true
+	}
+	a := &s._amplification
+	if a.sources == nil {
+		a.sources = map[types.PublicKey]*amplificationCounts{}
+	}
+	now := s.r.clock.Now()
+	counts := a.sources[request.SourceKey]
+	if counts == nil || now.Sub(counts.since) >= c.window {
+		if counts == nil && len(a.sources) >= amplificationMaxSources {
+			// Forget the sources whose windows have ended, so that the
+			// map doesn't grow without bound.
+			for k, v := range a.sources {
+				if now.Sub(v.since) >= c.window {
+					delete(a.sources, k)
+				}
+			}
+			if len(a.sources) >= amplificationMaxSources {
+				a.refused++
+				return false
+			}
+		}
+		counts = &amplificationCounts{since: now}
+		a.sources[request.SourceKey] = counts
+	}
+	counts.received += amplificationSize(request)
+	size := amplificationSize(reply)
+	if counts.sent+size > counts.received*c.factor {
+		a.refused++
+		return false
+	}
+	counts.sent += size
+	return true
+}
@@ -0,0 +1,61 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestAmplificationLimit(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	_, sk, _ := ed25519.GenerateKey(nil)
+	r := NewRouter(nil, sk, RouterOptionClock{clock}, RouterOptionAmplificationLimit{
+		Factor: 2,
+		Window: time.Minute,
+	})
+	t.Cleanup(func() { _ = r.Close() })
+
+	// Each request is counted as 74 bytes and each reply as 174 bytes, so
+	// the first reply is more than twice the first request. After that the
+	// replies fit within twice the requests so far, until the replies have
+	// caught up with the requests.
+	request := &types.Frame{Type: types.TypeEchoRequest, SourceKey: types.PublicKey{1}}
+	reply := &types.Frame{Type: types.TypeEchoReply, Payload: make([]byte, 100)}
+	allowed := func() (ok bool) {
+		phony.Block(r.state, func() {
+			ok = r.state._replyAllowed(request, reply)
+		})
+		return
+	}
+	for i, expected := range []bool{false, true, true, true, true, true, false} {
+		if ok := allowed(); ok != expected {
+			t.Fatalf("reply %d: expected allowed to be %v", i, expected)
+		}
+	}
+
+	// Once the window has passed, the counts start again.
+	clock.Advance(time.Minute)
+	if allowed() {
+		t.Fatalf("expected the counts to start again after the window")
+	}
+	if stats := r.AmplificationStats(); stats.Sources != 1 || stats.Refused != 3 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
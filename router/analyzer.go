@@ -0,0 +1,279 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"encoding/hex"
+	"math/bits"
+	"sort"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+// With RouterOptionFrameAnalyzer, every frame that we handle, whether we
+// sent it, received it or are forwarding it, is counted by type, by payload
+// size and by the first bytes of its source and destination keys. The
+// counts are kept in a ring of buckets that together cover the window, so
+// that old traffic falls out of the figures as the buckets are reused. This
+// answers questions like "what is all of this protocol chatter and who is
+// sending it" without having to capture frames with a tap.
+
+// analyzerDefaultWindow is how much traffic the analyzer covers if the
+// option doesn't say.
+const analyzerDefaultWindow = time.Minute
+
+// analyzerBuckets is how many buckets the window is split into.
+const analyzerBuckets = 12
+
+// analyzerSizeClasses is how many payload size classes there are. Each
+// class holds payloads up to twice the size of the class before it.
+const analyzerSizeClasses = 20
+
+// analyzerTopPrefixes is how many key prefixes are reported for each of
+// the sources and destinations.
+const analyzerTopPrefixes = 16
+
+// FrameAnalysis breaks down the frames that we handled within the window.
+type FrameAnalysis struct {
+	Window       time.Duration    `json:"window"`
+	Frames       uint64           `json:"frames"`
+	Bytes        uint64           `json:"bytes"` // Payload bytes
+	Types        []FrameTypeStats `json:"types"` // Busiest first
+	Sizes        []FrameSizeStats `json:"sizes"` // Smallest first
+	Sources      []KeyPrefixStats `json:"sources"`
+	Destinations []KeyPrefixStats `json:"destinations"`
+}
+
+// FrameTypeStats counts the frames of one type.
+type FrameTypeStats struct {
+	Type   string `json:"type"`
+	Frames uint64 `json:"frames"`
+	Bytes  uint64 `json:"bytes"`
+}
+
+// FrameSizeStats counts the frames with payloads in one size class.
+type FrameSizeStats struct {
+	UpTo   int    `json:"up_to"` // The largest payload in the class
+	Frames uint64 `json:"frames"`
+}
+
+// KeyPrefixStats counts the frames from or to keys with the same prefix.
+type KeyPrefixStats struct {
+	Prefix string `json:"prefix"` // In hex
+	Frames uint64 `json:"frames"`
+	Bytes  uint64 `json:"bytes"`
+}
+
+type analyzerCount struct {
+	frames uint64
+	bytes  uint64
+}
+
+func (c *analyzerCount) add(size int) {
+	c.frames++
+	c.bytes += uint64(size)
+}
+
+type analyzerBucket struct {
+	start        time.Time
+	types        map[types.FrameType]*analyzerCount
+	sizes        [analyzerSizeClasses]uint64
+	sources      map[uint16]*analyzerCount
+	destinations map[uint16]*analyzerCount
+}
+
+// frameAnalyzer holds the counts for the window.
+type frameAnalyzer struct {
+	window      time.Duration
+	prefixBytes int
+	buckets     [analyzerBuckets]analyzerBucket
+}
+
+func newFrameAnalyzer(o RouterOptionFrameAnalyzer) *frameAnalyzer {
+	a := &frameAnalyzer{
+		window:      o.Window,
+		prefixBytes: o.PrefixBytes,
+	}
+	if a.window <= 0 {
+		a.window = analyzerDefaultWindow
+	}
+	if a.prefixBytes != 2 {
+		a.prefixBytes = 1
+	}
+	return a
+}
+
+// prefix returns the first bytes of the key.
+func (a *frameAnalyzer) prefix(key types.PublicKey) uint16 {
+	if a.prefixBytes == 2 {
+		return uint16(key[0])<<8 | uint16(key[1])
+	}
+	return uint16(key[0])
+}
+
+// bucket returns the bucket for the given time, resetting it if it was last
+// used for an earlier part of the ring.
+func (a *frameAnalyzer) bucket(now time.Time) *analyzerBucket {
+	width := a.window / analyzerBuckets
+	start := now.Truncate(width)
+	b := &a.buckets[(start.UnixNano()/int64(width))%analyzerBuckets]
+	if !b.start.Equal(start) {
+		*b = analyzerBucket{
+			start:        start,
+			types:        map[types.FrameType]*analyzerCount{},
+			sources:      map[uint16]*analyzerCount{},
+			destinations: map[uint16]*analyzerCount{},
+		}
+	}
+	return b
+}
+
+// observe counts a frame.
+func (a *frameAnalyzer) observe(f *types.Frame, now time.Time) {
+	b := a.bucket(now)
+	size := len(f.Payload)
+	count := func(m map[uint16]*analyzerCount, key uint16) {
+		c, ok := m[key]
+		if !ok {
+			c = &analyzerCount{}
+			m[key] = c
+		}
+		c.add(size)
+	}
+	c, ok := b.types[f.Type]
+	if !ok {
+		c = &analyzerCount{}
+		b.types[f.Type] = c
+	}
+	c.add(size)
+	class := bits.Len(uint(size))
+	if class >= analyzerSizeClasses {
+		class = analyzerSizeClasses - 1
+	}
+	b.sizes[class]++
+	if f.SourceKey != (types.PublicKey{}) {
+		count(b.sources, a.prefix(f.SourceKey))
+	}
+	if f.DestinationKey != (types.PublicKey{}) {
+		count(b.destinations, a.prefix(f.DestinationKey))
+	}
+}
+
+// analysis adds up the buckets that are within the window.
+func (a *frameAnalyzer) analysis(now time.Time) FrameAnalysis {
+	analysis := FrameAnalysis{
+		Window: a.window,
+	}
+	byType := map[types.FrameType]*analyzerCount{}
+	sources := map[uint16]*analyzerCount{}
+	destinations := map[uint16]*analyzerCount{}
+	var sizes [analyzerSizeClasses]uint64
+	merge := func(into, from map[uint16]*analyzerCount) {
+		for k, c := range from {
+			if into[k] == nil {
+				into[k] = &analyzerCount{}
+			}
+			into[k].frames += c.frames
+			into[k].bytes += c.bytes
+		}
+	}
+	oldest := now.Add(-a.window)
+	for i := range a.buckets {
+		b := &a.buckets[i]
+		if b.start.IsZero() || !b.start.After(oldest) {
+			continue
+		}
+		for t, c := range b.types {
+			if byType[t] == nil {
+				byType[t] = &analyzerCount{}
+			}
+			byType[t].frames += c.frames
+			byType[t].bytes += c.bytes
+			analysis.Frames += c.frames
+			analysis.Bytes += c.bytes
+		}
+		for class, n := range b.sizes {
+			sizes[class] += n
+		}
+		merge(sources, b.sources)
+		merge(destinations, b.destinations)
+	}
+
+	for t, c := range byType {
+		analysis.Types = append(analysis.Types, FrameTypeStats{
+			Type:   t.String(),
+			Frames: c.frames,
+			Bytes:  c.bytes,
+		})
+	}
+	sort.Slice(analysis.Types, func(i, j int) bool {
+		if analysis.Types[i].Frames != analysis.Types[j].Frames {
+			return analysis.Types[i].Frames > analysis.Types[j].Frames
+		}
+		return analysis.Types[i].Type < analysis.Types[j].Type
+	})
+	for class, n := range sizes {
+		if n > 0 {
+			analysis.Sizes = append(analysis.Sizes, FrameSizeStats{
+				UpTo:   1<<class - 1,
+				Frames: n,
+			})
+		}
+	}
+	analysis.Sources = a.topPrefixes(sources)
+	analysis.Destinations = a.topPrefixes(destinations)
+	return analysis
+}
+
+// topPrefixes returns the busiest of the prefixes.
+func (a *frameAnalyzer) topPrefixes(counts map[uint16]*analyzerCount) []KeyPrefixStats {
+	top := make([]KeyPrefixStats, 0, len(counts))
+	for prefix, c := range counts {
+		b := []byte{byte(prefix >> 8), byte(prefix)}
+		top = append(top, KeyPrefixStats{
+			Prefix: hex.EncodeToString(b[2-a.prefixBytes:]),
+			Frames: c.frames,
+			Bytes:  c.bytes,
+		})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Frames != top[j].Frames {
+			return top[i].Frames > top[j].Frames
+		}
+		return top[i].Prefix < top[j].Prefix
+	})
+	if len(top) > analyzerTopPrefixes {
+		top = top[:analyzerTopPrefixes]
+	}
+	return top
+}
+
+// FrameAnalysis returns a breakdown of the frames that we handled within
+// the window, if the analyzer was enabled with RouterOptionFrameAnalyzer.
+func (r *Router) FrameAnalysis() (FrameAnalysis, bool) {
+	var analysis FrameAnalysis
+	var ok bool
+	phony.Block(r.state, func() {
+		if r.state._analyzer != nil {
+			analysis, ok = r.state._analyzer.analysis(r.clock.Now()), true
+		}
+	})
+	return analysis, ok
+}
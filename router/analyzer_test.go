@@ -0,0 +1,74 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestFrameAnalyzer(t *testing.T) {
+	a := newFrameAnalyzer(RouterOptionFrameAnalyzer{Window: time.Minute})
+	now := time.Unix(1200, 0)
+	src, dst := types.PublicKey{0xab, 0x01}, types.PublicKey{0xcd, 0x02}
+	for i := 0; i < 3; i++ {
+		a.observe(&types.Frame{
+			Type:           types.TypeTraffic,
+			SourceKey:      src,
+			DestinationKey: dst,
+			Payload:        make([]byte, 100),
+		}, now)
+	}
+	a.observe(&types.Frame{Type: types.TypeKeepalive}, now.Add(time.Second*30))
+
+	analysis := a.analysis(now.Add(time.Second * 30))
+	if analysis.Frames != 4 || analysis.Bytes != 300 {
+		t.Fatalf("expected 4 frames and 300 bytes, got %d and %d", analysis.Frames, analysis.Bytes)
+	}
+	if len(analysis.Types) != 2 || analysis.Types[0].Type != types.TypeTraffic.String() || analysis.Types[0].Frames != 3 {
+		t.Fatalf("expected traffic to be the busiest type, got %+v", analysis.Types)
+	}
+	if len(analysis.Sizes) != 2 || analysis.Sizes[0].UpTo != 0 || analysis.Sizes[1].UpTo != 127 || analysis.Sizes[1].Frames != 3 {
+		t.Fatalf("unexpected size classes %+v", analysis.Sizes)
+	}
+	if len(analysis.Sources) != 1 || analysis.Sources[0].Prefix != "ab" || analysis.Sources[0].Bytes != 300 {
+		t.Fatalf("unexpected sources %+v", analysis.Sources)
+	}
+	if len(analysis.Destinations) != 1 || analysis.Destinations[0].Prefix != "cd" {
+		t.Fatalf("unexpected destinations %+v", analysis.Destinations)
+	}
+
+	// Once the window has passed, only the keepalive is left.
+	analysis = a.analysis(now.Add(time.Second * 70))
+	if analysis.Frames != 1 || len(analysis.Sources) != 0 {
+		t.Fatalf("expected old traffic to fall out of the window, got %+v", analysis)
+	}
+}
+
+func TestFrameAnalyzerPrefixBytes(t *testing.T) {
+	a := newFrameAnalyzer(RouterOptionFrameAnalyzer{PrefixBytes: 2})
+	now := time.Unix(1200, 0)
+	a.observe(&types.Frame{Type: types.TypeTraffic, SourceKey: types.PublicKey{0x0a, 0x0b}}, now)
+	a.observe(&types.Frame{Type: types.TypeTraffic, SourceKey: types.PublicKey{0x0a, 0x0c}}, now)
+	analysis := a.analysis(now)
+	if analysis.Window != analyzerDefaultWindow {
+		t.Fatalf("expected the default window, got %s", analysis.Window)
+	}
+	if len(analysis.Sources) != 2 || analysis.Sources[0].Prefix != "0a0b" || analysis.Sources[1].Prefix != "0a0c" {
+		t.Fatalf("unexpected sources %+v", analysis.Sources)
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/router/events"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+// We keep the last tree announcement from each peering, and each of them
+// carries a signature for every hop from the root, so the announcements
+// take more memory the more peers we have and the deeper we are in the
+// tree. Announcements are normally forgotten when their peering stops, but
+// a node on a busy public network that runs for months can still build up
+// announcements that nothing will ever clean up, i.e. from peerings that
+// stopped without being removed properly or from peers that have gone
+// quiet without disconnecting. The announcement store counts roughly how
+// many bytes each announcement holds, and every announcement interval it
+// evicts the announcements of peerings that have stopped and of peers,
+// other than our parent, that haven't sent one for longer than the
+// announcement timeout, which couldn't be used for routing anyway.
+//
+// The store also has a soft limit. When it is over the limit, it evicts
+// what it can and then refuses announcements from peerings that it doesn't
+// already have one for, rather than stopping them, until there is room
+// again. Announcements from peerings that we already have one for are
+// always accepted, since refusing those would leave us with stale
+// coordinates for them.
+
+// AnnouncementStats describes the announcement store.
+type AnnouncementStats struct {
+	Entries int    `json:"entries"` // Announcements that are stored
+	Memory  uint64 `json:"memory"`  // Estimated bytes held by the stored announcements
+	Limit   uint64 `json:"limit"`   // The soft limit on Memory
+	Evicted uint64 `json:"evicted"` // Announcements evicted from stopped or quiet peerings
+	Refused uint64 `json:"refused"` // Announcements refused because the store was full
+}
+
+// AnnouncementStats returns how big the announcement store is and how many
+// announcements it has evicted or refused.
+func (r *Router) AnnouncementStats() AnnouncementStats {
+	var stats AnnouncementStats
+	phony.Block(r.state, func() {
+		stats = r.state._announcementStatistics()
+	})
+	return stats
+}
+
+func (s *state) _announcementStatistics() AnnouncementStats {
+	stats := s._announcementStats
+	stats.Entries = len(s._announcements)
+	stats.Memory = s._announcementMemory
+	stats.Limit = s.r.announcementLimit
+	return stats
+}
+
+// announcementMemory returns roughly how much memory a stored announcement
+// holds, including its signatures.
+func announcementMemory(ann *rootAnnouncementWithTime) uint64 {
+	if ann == nil {
+		return 0
+	}
+	return announcementEntryMemory + uint64(len(ann.Signatures))*announcementSignatureMemory
+}
+
+// _storeAnnouncement stores the announcement from the peering, replacing
+// any that was there before.
+func (s *state) _storeAnnouncement(p *peer, ann *rootAnnouncementWithTime) {
+	s._forgetAnnouncement(p)
+	s._announcements[p] = ann
+	s._announcementMemory += announcementMemory(ann)
+}
+
+// _forgetAnnouncement removes the announcement from the peering, if there
+// is one.
+func (s *state) _forgetAnnouncement(p *peer) {
+	ann, ok := s._announcements[p]
+	if !ok {
+		return
+	}
+	delete(s._announcements, p)
+	if n := announcementMemory(ann); n < s._announcementMemory {
+		s._announcementMemory -= n
+	} else {
+		s._announcementMemory = 0
+	}
+}
+
+// _evictDefunctAnnouncements evicts the announcements of peerings that have
+// stopped and of peers, other than our parent, that haven't sent one within
+// the announcement timeout. It returns how many were evicted.
+func (s *state) _evictDefunctAnnouncements() int {
+	evicted := 0
+	for p, ann := range s._announcements {
+		switch {
+		case p == nil || !p.started.Load():
+		case p != s._parent && (ann == nil || since(s.r.clock, ann.receiveTime) >= s.r.timings.AnnouncementTimeout):
+		default:
+			continue
+		}
+		s._forgetAnnouncement(p)
+		s._announcementStats.Evicted++
+		evicted++
+		if p != nil {
+			s._publishRoute(events.TreeAnnouncementChanged{
+				Change:       events.RouteRemoved,
+				Announcement: events.TreeAnnouncement{Port: p.port, PeerID: p.public.String()},
+			})
+		}
+	}
+	return evicted
+}
+
+// _makeRoomForAnnouncement is called before storing the first announcement
+// from a peering. It returns false, and counts the announcement as refused,
+// if the store is over its limit even after evicting defunct announcements.
+func (s *state) _makeRoomForAnnouncement(update *types.SwitchAnnouncement) bool {
+	limit := s.r.announcementLimit
+	if limit == 0 {
+		return true
+	}
+	needed := announcementEntryMemory + uint64(len(update.Signatures))*announcementSignatureMemory
+	if s._announcementMemory+needed <= limit {
+		return true
+	}
+	if s._evictDefunctAnnouncements() > 0 && s._announcementMemory+needed <= limit {
+		return true
+	}
+	if s._announcementStats.Refused == 0 {
+		s.r.log.Println("Announcement store is full, refusing announcements from new peerings")
+	}
+	s._announcementStats.Refused++
+	return false
+}
@@ -0,0 +1,98 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+	"go.uber.org/atomic"
+)
+
+func TestAnnouncementStore(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	s := newTestState(types.PublicKey{}, clock)
+	s.r.timings = Timings{AnnouncementTimeout: time.Minute}
+	announcement := func(depth int) *rootAnnouncementWithTime {
+		return &rootAnnouncementWithTime{
+			SwitchAnnouncement: types.SwitchAnnouncement{
+				Signatures: make([]types.SignatureWithHop, depth),
+			},
+			receiveTime: clock.Now(),
+		}
+	}
+	var peers []*peer
+	for i := 1; i <= 3; i++ {
+		p := &peer{started: *atomic.NewBool(true), public: types.PublicKey{byte(i)}, port: types.SwitchPortID(i)}
+		peers = append(peers, p)
+	}
+	parent, quiet, stopped := peers[0], peers[1], peers[2]
+	s._parent = parent
+
+	// Memory is counted as announcements are stored, replaced and removed.
+	s._storeAnnouncement(parent, announcement(2))
+	s._storeAnnouncement(quiet, announcement(2))
+	s._storeAnnouncement(quiet, announcement(3))
+	expected := 2*announcementEntryMemory + 5*announcementSignatureMemory
+	if s._announcementMemory != uint64(expected) {
+		t.Fatalf("expected %d bytes, got %d", expected, s._announcementMemory)
+	}
+	s._forgetAnnouncement(quiet)
+	s._forgetAnnouncement(quiet)
+	expected = announcementEntryMemory + 2*announcementSignatureMemory
+	if s._announcementMemory != uint64(expected) {
+		t.Fatalf("expected %d bytes after forgetting, got %d", expected, s._announcementMemory)
+	}
+
+	// Announcements from stopped peerings and from quiet peers are evicted,
+	// but our parent's never is for being quiet.
+	s._storeAnnouncement(quiet, announcement(2))
+	s._storeAnnouncement(stopped, announcement(2))
+	stopped.started.Store(false)
+	if evicted := s._evictDefunctAnnouncements(); evicted != 1 {
+		t.Fatalf("expected only the stopped peering to be evicted, got %d", evicted)
+	}
+	clock.Advance(time.Minute)
+	if evicted := s._evictDefunctAnnouncements(); evicted != 1 {
+		t.Fatalf("expected the quiet peer to be evicted, got %d", evicted)
+	}
+	if _, ok := s._announcements[parent]; !ok || len(s._announcements) != 1 {
+		t.Fatalf("expected only the parent's announcement to be left")
+	}
+	expected = announcementEntryMemory + 2*announcementSignatureMemory
+	if s._announcementMemory != uint64(expected) {
+		t.Fatalf("expected %d bytes after evicting, got %d", expected, s._announcementMemory)
+	}
+
+	// Over the limit, announcements from new peerings are refused once
+	// nothing more can be evicted.
+	update := &announcement(2).SwitchAnnouncement
+	s.r.announcementLimit = uint64(2*announcementEntryMemory + 4*announcementSignatureMemory)
+	if !s._makeRoomForAnnouncement(update) {
+		t.Fatalf("expected there to be room for one more announcement")
+	}
+	s._storeAnnouncement(quiet, announcement(2))
+	if s._makeRoomForAnnouncement(update) {
+		t.Fatalf("expected the store to be full")
+	}
+	clock.Advance(time.Minute)
+	if !s._makeRoomForAnnouncement(update) {
+		t.Fatalf("expected the quiet peer to be evicted to make room")
+	}
+	if stats := s._announcementStatistics(); stats.Entries != 1 || stats.Evicted != 3 || stats.Refused != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
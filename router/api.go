@@ -19,6 +19,7 @@ package router
 
 import (
 	"encoding/hex"
+	"time"
 
 	"github.com/Arceliar/phony"
 	"github.com/matrix-org/pinecone/router/events"
@@ -30,11 +31,55 @@ type NeighbourInfo struct {
 }
 
 type PeerInfo struct {
-	URI       string
-	Port      int
-	PublicKey string
-	PeerType  int
-	Zone      string
+	URI             string
+	Port            int
+	PublicKey       string
+	PeerType        int
+	Zone            string
+	MalformedFrames int
+	Quality         int
+	Demoted         bool
+	Congested       bool
+	Reserved        bool
+	Tags            []string
+	RTT             time.Duration
+	RTTVariance     time.Duration
+	ControlQueue    QueueStats
+	ProtoQueue      QueueStats
+	TrafficQueue    QueueStats
+	TrafficClasses  []TrafficClassStats
+	// Bootstraps that were sent to the peer again because they weren't
+	// acknowledged, and that were given up on after being sent again.
+	BootstrapRetransmits uint64
+	BootstrapsLost       uint64
+	// Tree announcements from the peer that were replaced by a later one
+	// before being handled, with RouterOptionAnnouncementDamping.
+	SuppressedAnnouncements uint64
+	// The largest traffic payload that can be sent as a jumbo frame over
+	// the peering, or zero if the peering doesn't carry jumbo frames.
+	JumboFrames int
+	// Whether frames that carry coordinates are sent to the peer in the
+	// compact encoding.
+	CompactFrames bool
+	// Whether the peering is encrypted with RouterOptionLinkEncryption.
+	Encrypted bool
+	// The locality hint that the peer gave us, if both of us have one.
+	Locality string
+	// What the peer told us about itself in the handshake. These are empty
+	// if the peering was set up with a known public key, which skips the
+	// handshake. The name, software version and contact are chosen by the
+	// peer and should only be displayed. The metadata signature, if the
+	// peer signed its metadata, can be checked with PeerMetadata.Verify.
+	ProtocolVersion   int
+	Capabilities      []string
+	WireFeatures      []string
+	NodeName          string
+	SoftwareVersion   string
+	Contact           string
+	MetadataSignature string
+	// How quickly the peering drains in bytes per second, as estimated
+	// from writes that had to wait, or zero if it isn't known yet.
+	Throughput uint64
 }
 
 // Subscribe registers a subscriber to this node's events
@@ -55,13 +100,45 @@ func (r *Router) Peers() []PeerInfo {
 			if p == nil {
 				continue
 			}
-			infos = append(infos, PeerInfo{
+			info := PeerInfo{
 				URI:       string(p.uri),
 				Port:      int(p.port),
 				PublicKey: hex.EncodeToString(p.public[:]),
 				PeerType:  int(p.peertype),
 				Zone:      string(p.zone),
-			})
+				Quality:   p.quality(r.state._handshakeFailures[p.public]),
+				Demoted:   p._demoted,
+				Congested: p.congested.Load(),
+				Reserved:  r.state._isReserved(p.public, p.uri),
+				Tags:      p.tags.List(),
+			}
+			info.JumboFrames, info.CompactFrames = p.jumbo, p.compact
+			info.Encrypted = r.linkEncrypted(p.handshook.features)
+			info.Locality = p.locality
+			info.ProtocolVersion = int(p.handshook.version)
+			info.Capabilities = capabilityList(p.handshook.capabilities)
+			info.WireFeatures = wireFeatureList(p.handshook.features)
+			info.NodeName, info.SoftwareVersion = p.handshook.metadata.Name, p.handshook.metadata.Software
+			info.Contact = p.handshook.metadata.Contact
+			if p.handshook.signature != (types.Signature{}) {
+				info.MetadataSignature = hex.EncodeToString(p.handshook.signature[:])
+			}
+			info.Throughput = uint64(p.throughput.rate.Load())
+			info.BootstrapRetransmits, info.BootstrapsLost = p._bootstrapRetx, p._bootstrapLost
+			info.SuppressedAnnouncements = p._annSuppressed
+			info.RTT, info.RTTVariance = p._rtt.Smoothed, p._rtt.Variance
+			if p.proto != nil && p.traffic != nil {
+				// The local peer doesn't have any queues.
+				info.ProtoQueue, info.TrafficQueue = p.proto.queueStats(), p.traffic.queueStats()
+			}
+			if p.control != nil {
+				info.ControlQueue = p.control.queueStats()
+			}
+			if q, ok := p.traffic.(*fairFIFOQueue); ok {
+				info.TrafficClasses = q.classStats()
+			}
+			info.MalformedFrames = int(p.statistics.malformed.Load())
+			infos = append(infos, info)
 		}
 	})
 	return infos
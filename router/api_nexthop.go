@@ -0,0 +1,122 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !minimal
+// +build !minimal
+
+package router
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// NextHopCandidate is a peering that was chosen as the best next-hop at
+// some point while working out the route.
+type NextHopCandidate struct {
+	Port      types.SwitchPortID // The port of the peering
+	PublicKey types.PublicKey    // The key of the peer
+	Towards   types.PublicKey    // The key that the peering leads to, for SNEK routing
+	Distance  int64              // The tree distance to the destination, for tree routing
+	Rule      string             // Why the candidate was chosen
+}
+
+// NextHopExplanation describes how a route to a destination was chosen.
+type NextHopExplanation struct {
+	Found      bool               // Was a next-hop found at all?
+	Local      bool               // Is the destination handled by us?
+	Port       types.SwitchPortID // The port of the chosen next-hop
+	PublicKey  types.PublicKey    // The key of the chosen next-hop
+	Candidates []NextHopCandidate // Each of the best candidates in turn, the last is chosen
+}
+
+// NextHop works out where traffic for the given destination, which is
+// either a types.PublicKey for SNEK routing or types.Coordinates for tree
+// routing, would currently be sent and why. Nothing is sent.
+func (r *Router) NextHop(dest net.Addr) (NextHopExplanation, error) {
+	var explanation NextHopExplanation
+	var err error
+	phony.Block(r.state, func() {
+		switch dest := dest.(type) {
+		case types.PublicKey:
+			explanation = explainSNEK(virtualSnakeNextHopParams{
+				false,
+				dest,
+				r.public,
+				types.VirtualSnakeWatermark{PublicKey: types.FullMask},
+				r.state._parent,
+				r.local,
+				r.state._rootAnnouncement(),
+				r.state._announcements,
+				r.state._table,
+				r.clock.Now(),
+				r.timings.PathExpiry,
+			})
+		case types.Coordinates:
+			explanation = explainTree(treeNextHopParams{
+				dest,
+				r.state._coords(),
+				r.local,
+				r.local,
+				r.state._rootAnnouncement(),
+				&r.state._announcements,
+			})
+		default:
+			err = fmt.Errorf("unsupported destination type %T", dest)
+		}
+	})
+	return explanation, err
+}
+
+// explainSNEK runs the SNEK next-hop rules and explains the result.
+func explainSNEK(params virtualSnakeNextHopParams) NextHopExplanation {
+	var explanation NextHopExplanation
+	nexthop, _ := explainNextHopSNEK(params, func(key types.PublicKey, p *peer, rule string) {
+		explanation.Candidates = append(explanation.Candidates, NextHopCandidate{
+			Port:      p.port,
+			PublicKey: p.public,
+			Towards:   key,
+			Rule:      rule,
+		})
+	})
+	explanation.chose(nexthop, params.selfPeer)
+	return explanation
+}
+
+// explainTree runs the tree next-hop rules and explains the result.
+func explainTree(params treeNextHopParams) NextHopExplanation {
+	var explanation NextHopExplanation
+	nexthop := explainNextHopTree(params, func(p *peer, distance int64, rule string) {
+		explanation.Candidates = append(explanation.Candidates, NextHopCandidate{
+			Port:      p.port,
+			PublicKey: p.public,
+			Distance:  distance,
+			Rule:      rule,
+		})
+	})
+	explanation.chose(nexthop, params.selfPeer)
+	return explanation
+}
+
+func (e *NextHopExplanation) chose(nexthop, local *peer) {
+	if nexthop != nil {
+		e.Found = true
+		e.Local = nexthop == local
+		e.Port = nexthop.port
+		e.PublicKey = nexthop.public
+	}
+}
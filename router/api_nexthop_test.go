@@ -0,0 +1,60 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !minimal
+// +build !minimal
+
+package router
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNextHopExplain(t *testing.T) {
+	low, high := newTestRouterPair(t)
+
+	deadline := time.Now().Add(time.Second * 10)
+	for len(low.Coords()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("tree didn't converge")
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+
+	for name, dest := range map[string]net.Addr{
+		"SNEK": high.PublicKey(),
+		"tree": high.Coords(),
+	} {
+		explanation, err := low.NextHop(dest)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if !explanation.Found || explanation.Local || explanation.PublicKey != high.PublicKey() {
+			t.Fatalf("%s: expected next-hop to be the other router, got %+v", name, explanation)
+		}
+		if n := len(explanation.Candidates); n == 0 || explanation.Candidates[n-1].Port != explanation.Port {
+			t.Fatalf("%s: expected last candidate to be the chosen one, got %+v", name, explanation.Candidates)
+		}
+	}
+
+	explanation, err := low.NextHop(low.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !explanation.Local {
+		t.Fatalf("expected our own key to be handled locally, got %+v", explanation)
+	}
+}
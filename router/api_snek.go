@@ -0,0 +1,157 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !minimal
+// +build !minimal
+
+package router
+
+import (
+	"sort"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+// SNEKNeighbour describes one of our neighbours in the keyspace.
+type SNEKNeighbour struct {
+	PublicKey types.PublicKey    // The key of the neighbour
+	Sequence  uint64             // The bootstrap sequence that set up the path
+	Age       time.Duration      // Time since the path was last refreshed
+	Root      types.Root         // The root that the path was set up under
+	Port      types.SwitchPortID // The port that the path leaves us through
+	Confirmed bool               // Has the neighbour confirmed the path end-to-end
+}
+
+// Descending returns the node with the next lowest key to ours, whose
+// bootstraps have reached us, or false if we don't have one.
+func (r *Router) Descending() (SNEKNeighbour, bool) {
+	var neigh SNEKNeighbour
+	var ok bool
+	phony.Block(r.state, func() {
+		neigh, ok = r.state._descendingNeighbour()
+	})
+	return neigh, ok
+}
+
+func (s *state) _descendingNeighbour() (SNEKNeighbour, bool) {
+	desc := s._descending
+	if desc == nil || !desc.valid(s.r.clock.Now(), s.r.timings.PathExpiry) || desc.Source == nil {
+		return SNEKNeighbour{}, false
+	}
+	return SNEKNeighbour{
+		PublicKey: desc.PublicKey,
+		Sequence:  uint64(desc.Watermark.Sequence),
+		Age:       since(s.r.clock, desc.LastSeen),
+		Root:      desc.Root,
+		Port:      desc.Source.port,
+	}, true
+}
+
+// Ascending returns the node with the next highest key to ours, as far as
+// we know. If our last bootstrap was confirmed then this is the node that
+// confirmed it, otherwise it is the node that our bootstraps are currently
+// being routed towards. The sequence refers to our last bootstrap and the
+// age to when we last bootstrapped or refreshed our path.
+// Returns false if we're the root or if there is nowhere for our bootstraps
+// to go.
+func (r *Router) Ascending() (SNEKNeighbour, bool) {
+	var neigh SNEKNeighbour
+	var ok bool
+	phony.Block(r.state, func() {
+		neigh, ok = r.state._ascendingNeighbour()
+	})
+	return neigh, ok
+}
+
+func (s *state) _ascendingNeighbour() (SNEKNeighbour, bool) {
+	if s._parent == nil {
+		return SNEKNeighbour{}, false
+	}
+	p, w := s._nextHopsSNEK(s.r.public, types.TypeBootstrap, types.VirtualSnakeWatermark{
+		PublicKey: types.FullMask,
+	})
+	if p == nil || w.PublicKey == s.r.public {
+		return SNEKNeighbour{}, false
+	}
+	neigh := SNEKNeighbour{
+		PublicKey: w.PublicKey,
+		Sequence:  uint64(s._bootstrapSequence),
+		Age:       since(s.r.clock, s._lastbootstrap),
+		Root:      s._rootAnnouncement().Root,
+		Port:      p.port,
+	}
+	if c := s._bootstrapConfirm; c != nil && c.Sequence == s._bootstrapSequence {
+		neigh.PublicKey, neigh.Confirmed = c.PublicKey, true
+	}
+	return neigh, true
+}
+
+// TransitSNEKEntries returns the number of valid SNEK paths that pass
+// through this node on their way to somewhere else, i.e. not counting
+// paths that end here.
+func (r *Router) TransitSNEKEntries() int {
+	return r.state.transitPaths()
+}
+
+// BootstrapAttempt describes one of our bootstraps that hasn't been
+// confirmed yet.
+type BootstrapAttempt struct {
+	Sequence uint64             // The sequence number of the bootstrap
+	Target   types.PublicKey    // The node that the bootstrap was routed towards
+	Port     types.SwitchPortID // The port that the bootstrap was sent through
+	Age      time.Duration      // Time since the bootstrap was sent
+}
+
+// BootstrapStatus describes how our bootstraps are getting on.
+type BootstrapStatus struct {
+	Outstanding   []BootstrapAttempt // Bootstraps that haven't been resolved yet
+	Failures      int                // Failures in a row towards the same node
+	TotalFailures uint64             // Failures since the router started
+	LastFailure   string             // Why the last bootstrap failed, if any did
+	LastFailureAt time.Time          // When the last bootstrap failed
+	Backoff       time.Duration      // How long we wait before retrying a failure
+}
+
+// Bootstraps returns the status of our bootstraps, including any that are
+// still outstanding and why the last one failed.
+func (r *Router) Bootstraps() BootstrapStatus {
+	var status BootstrapStatus
+	phony.Block(r.state, func() {
+		t := r.state._bootstrapAttempts
+		status = BootstrapStatus{
+			Failures:      t.failures,
+			TotalFailures: t.total,
+			LastFailure:   t.lastFailure,
+			LastFailureAt: t.lastFailureAt,
+			Backoff:       t.backoff(r.timings.BootstrapInterval),
+		}
+		for _, a := range t.outstanding {
+			status.Outstanding = append(status.Outstanding, BootstrapAttempt{
+				Sequence: uint64(a.Sequence),
+				Target:   a.Target,
+				Port:     a.Port,
+				Age:      since(r.clock, a.Sent),
+			})
+		}
+	})
+	sort.Slice(status.Outstanding, func(i, j int) bool {
+		return status.Outstanding[i].Sequence < status.Outstanding[j].Sequence
+	})
+	return status
+}
@@ -0,0 +1,208 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !minimal
+// +build !minimal
+
+package router
+
+import (
+	"crypto/ed25519"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+	"github.com/matrix-org/pinecone/util"
+)
+
+// newTestRouterPair returns two routers that are peered with each other
+// over a loopback connection, sorted so that the lower key comes first.
+func newTestRouterPair(t *testing.T) (low, high *Router) {
+	_, sk1, _ := ed25519.GenerateKey(nil)
+	_, sk2, _ := ed25519.GenerateKey(nil)
+	r1, r2 := NewRouter(nil, sk1), NewRouter(nil, sk2)
+	t.Cleanup(func() {
+		_ = r1.Close()
+		_ = r2.Close()
+	})
+	low, high = r1, r2
+	if util.LessThan(high.PublicKey(), low.PublicKey()) {
+		low, high = high, low
+	}
+
+	// net.Pipe is unbuffered, so both sides of the handshake would block
+	// on writing, so use a real loopback connection instead.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		if c, err := listener.Accept(); err == nil {
+			_, _ = r1.Connect(c)
+		}
+	}()
+	c, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r2.Connect(c); err != nil {
+		t.Fatal(err)
+	}
+	return low, high
+}
+
+func TestSNEKNeighbours(t *testing.T) {
+	low, high := newTestRouterPair(t)
+
+	deadline := time.Now().Add(time.Second * 10)
+	for {
+		asc, ascOK := low.Ascending()
+		desc, descOK := high.Descending()
+		if ascOK && descOK {
+			if asc.PublicKey != high.PublicKey() {
+				t.Fatalf("expected ascending node %s, got %s", high.PublicKey(), asc.PublicKey)
+			}
+			if desc.PublicKey != low.PublicKey() {
+				t.Fatalf("expected descending node %s, got %s", low.PublicKey(), desc.PublicKey)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("SNEK neighbours didn't converge (ascending %v, descending %v)", ascOK, descOK)
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	if _, ok := high.Ascending(); ok {
+		t.Fatalf("the root node shouldn't have an ascending node")
+	}
+	if n := high.TransitSNEKEntries(); n != 0 {
+		t.Fatalf("expected no transit entries, got %d", n)
+	}
+}
+
+func TestSNEKAscendingConfirmed(t *testing.T) {
+	low, high := newTestRouterPair(t)
+
+	deadline := time.Now().Add(time.Second * 15)
+	for {
+		if asc, ok := low.Ascending(); ok && asc.Confirmed {
+			if asc.PublicKey != high.PublicKey() {
+				t.Fatalf("expected confirmation from %s, got %s", high.PublicKey(), asc.PublicKey)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("bootstrap wasn't confirmed")
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+}
+
+func TestSNEKRepairsWhileSaturated(t *testing.T) {
+	timings := RouterOptionTimings{
+		SNEKMaintainInterval: time.Millisecond * 200,
+		BootstrapInterval:    time.Second,
+		PathExpiry:           time.Second * 2,
+	}
+	_, sk1, _ := ed25519.GenerateKey(nil)
+	_, sk2, _ := ed25519.GenerateKey(nil)
+	low, high := NewRouter(nil, sk1, timings), NewRouter(nil, sk2, timings)
+	t.Cleanup(func() {
+		_ = low.Close()
+		_ = high.Close()
+	})
+	if util.LessThan(high.PublicKey(), low.PublicKey()) {
+		low, high = high, low
+	}
+
+	// Pace the link in both directions so that it is easy to saturate.
+	const rate = 32 * 1024
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		if c, err := listener.Accept(); err == nil {
+			_, _ = low.Connect(c, ConnectionPacingRate(rate))
+		}
+	}()
+	c, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := high.Connect(c, ConnectionPacingRate(rate)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Flood the link in both directions with bulk traffic, many times
+	// faster than it can carry it, and with more echo requests than it can
+	// carry too, so that the protocol queue backs up as well.
+	stop := make(chan struct{})
+	defer close(stop)
+	flood := func(from, to *Router) {
+		payload := make([]byte, 1024)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			_, _ = from.WriteToWithClass(payload, to.PublicKey(), types.TrafficClassBulk)
+			phony.Block(from.state, func() {
+				if _, f, err := from.state._newEchoRequest(to.PublicKey(), func(LookupResult) {}); err == nil {
+					_ = from.state._forward(from.local, f)
+				}
+			})
+			time.Sleep(time.Millisecond)
+		}
+	}
+	go flood(low, high)
+	go flood(high, low)
+
+	// Our path must keep being refreshed and confirmed for longer than
+	// paths last, even though the link stays saturated. If a refresh or
+	// bootstrap doesn't get through in time, the path is no longer
+	// confirmed or it expires.
+	var start time.Time
+	deadline := time.Now().Add(time.Second * 20)
+	for {
+		asc, ascOK := low.Ascending()
+		desc, descOK := high.Descending()
+		if ascOK && asc.Confirmed && descOK && desc.PublicKey == low.PublicKey() {
+			if start.IsZero() {
+				start = time.Now()
+			}
+			if time.Since(start) >= timings.PathExpiry*2 {
+				break
+			}
+		} else {
+			start = time.Time{}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("SNEK wasn't maintained (ascending %+v, descending %+v)", asc, desc)
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	for _, r := range []*Router{low, high} {
+		for _, p := range r.Peers() {
+			if p.Port != 0 && p.TrafficQueue.Dropped == 0 {
+				t.Fatalf("expected the link to be saturated with traffic")
+			}
+		}
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import "github.com/matrix-org/pinecone/types"
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+// Bootstraps are the only frames that build SNEK paths, so if one is lost on
+// the way then the path isn't refreshed until the next bootstrap, which might
+// be long enough for the path to expire. To avoid this, each node that
+// receives a bootstrap acknowledges it to the peer that sent it, and the
+// bootstrap is sent again a limited number of times if the acknowledgement
+// doesn't arrive. Since older nodes don't acknowledge bootstraps, we only
+// wait for acknowledgements from peers that have sent us one before.
+
+type pendingBootstrapKey struct {
+	peer     *peer
+	key      types.PublicKey
+	sequence types.Varu64
+}
+
+type pendingBootstrap struct {
+	frame    *types.Frame // A copy of the bootstrap, for sending again
+	attempts int          // How many times it has been sent again
+}
+
+type pendingBootstrapTable map[pendingBootstrapKey]*pendingBootstrap
+
+// bootstrapSequence returns the sequence number of a bootstrap frame.
+func bootstrapSequence(f *types.Frame) (types.Varu64, bool) {
+	var bootstrap types.VirtualSnakeBootstrap
+	if _, err := types.Decode(&bootstrap, f.Payload); err != nil {
+		return 0, false
+	}
+	return bootstrap.Sequence, true
+}
+
+// copyBootstrap returns a copy of a bootstrap frame from the frame pool.
+func copyBootstrap(f *types.Frame) *types.Frame {
+	c := getFrame()
+	f.CopyInto(c)
+	c.Source = append(c.Source[:0], f.Source...)
+	return c
+}
+
+// _trackBootstrap remembers a bootstrap that is about to be sent to the
+// given peer so that it can be sent again if it isn't acknowledged.
+func (s *state) _trackBootstrap(p *peer, f *types.Frame) {
+	if !p._bootstrapACKs {
+		return
+	}
+	sequence, ok := bootstrapSequence(f)
+	if !ok {
+		return
+	}
+	key := pendingBootstrapKey{p, f.DestinationKey, sequence}
+	if existing, ok := s._pendingBootstraps[key]; ok {
+		framePool.Put(existing.frame)
+	}
+	s._pendingBootstraps[key] = &pendingBootstrap{
+		frame: copyBootstrap(f),
+	}
+	s._retransmitBootstrapIn(key)
+}
+
+func (s *state) _retransmitBootstrapIn(key pendingBootstrapKey) {
+	s.r.clock.AfterFunc(bootstrapRetransmitInterval, func() {
+		s.Act(nil, func() {
+			s._retransmitBootstrap(key)
+		})
+	})
+}
+
+// _retransmitBootstrap sends a bootstrap again if it still hasn't been
+// acknowledged, or gives up on it if it has been sent too many times.
+func (s *state) _retransmitBootstrap(key pendingBootstrapKey) {
+	pending, ok := s._pendingBootstraps[key]
+	if !ok {
+		// The bootstrap has already been acknowledged.
+		return
+	}
+	if !key.peer.started.Load() || pending.attempts >= bootstrapMaxRetransmits {
+		delete(s._pendingBootstraps, key)
+		framePool.Put(pending.frame)
+		key.peer._bootstrapLost++
+		s._recordPathEvent(ProtocolBootstrapLost, PathID{key.key, key.sequence}, key.peer, "not acknowledged")
+		if key.key == s.r.public {
+			s._bootstrapLost(key.sequence, key.peer)
+		}
+		return
+	}
+	pending.attempts++
+	key.peer._bootstrapRetx++
+	s._recordPathEvent(ProtocolBootstrapRetransmitted, PathID{key.key, key.sequence}, key.peer, "")
+	if f := copyBootstrap(pending.frame); !key.peer.send(f) {
+		framePool.Put(f)
+	}
+	s._retransmitBootstrapIn(key)
+}
+
+// _acknowledgeBootstrap acknowledges a bootstrap frame that arrived from
+// the given peer. We acknowledge it even if we don't act on it, i.e. if it
+// is a copy of one that we already had, since the peer only needs to know
+// that it arrived.
+func (s *state) _acknowledgeBootstrap(p *peer, rx *types.Frame) {
+	sequence, ok := bootstrapSequence(rx)
+	if !ok || p.proto == nil {
+		return
+	}
+	ack := types.VirtualSnakeBootstrapACK{
+		PublicKey: rx.DestinationKey,
+		Sequence:  sequence,
+	}
+	frame := getFrame()
+	frame.Type = types.TypeBootstrapACK
+	if err := frame.AppendPayload(&ack); err != nil {
+		framePool.Put(frame)
+		return
+	}
+	if !p.send(frame) {
+		framePool.Put(frame)
+	}
+}
+
+// _handleBootstrapACK is called when a peer acknowledges a bootstrap that
+// we sent to it.
+func (s *state) _handleBootstrapACK(p *peer, rx *types.Frame) error {
+	var ack types.VirtualSnakeBootstrapACK
+	if _, err := types.Decode(&ack, rx.Payload); err != nil {
+		return err
+	}
+	p._bootstrapACKs = true
+	key := pendingBootstrapKey{p, ack.PublicKey, ack.Sequence}
+	if pending, ok := s._pendingBootstraps[key]; ok {
+		delete(s._pendingBootstraps, key)
+		framePool.Put(pending.frame)
+		s._recordPathEvent(ProtocolBootstrapAcknowledged, PathID{ack.PublicKey, ack.Sequence}, p, "")
+	}
+	return nil
+}
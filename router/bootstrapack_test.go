@@ -0,0 +1,87 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"testing"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestBootstrapRetransmission(t *testing.T) {
+	s := newTestState(types.PublicKey{}, systemClock{})
+	p := &peer{
+		port:  1,
+		proto: newFIFOQueue(fifoNoMax, nil, nil),
+	}
+	p.started.Store(true)
+
+	bootstrap := types.VirtualSnakeBootstrap{Sequence: 42}
+	f := getFrame()
+	f.Type = types.TypeBootstrap
+	f.DestinationKey[0] = 1
+	n, err := bootstrap.MarshalBinary(f.Payload[:cap(f.Payload)])
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Payload = f.Payload[:n]
+
+	// Bootstraps aren't tracked until the peer has shown that it will
+	// acknowledge them.
+	s._trackBootstrap(p, f)
+	if len(s._pendingBootstraps) != 0 {
+		t.Fatalf("bootstrap shouldn't be tracked before the peer acknowledges bootstraps")
+	}
+
+	// An acknowledgement from the peer, even for a bootstrap that we don't
+	// know about, tells us that it acknowledges bootstraps.
+	ack := func(sequence types.Varu64) {
+		a := types.VirtualSnakeBootstrapACK{PublicKey: f.DestinationKey, Sequence: sequence}
+		rx := getFrame()
+		rx.Type = types.TypeBootstrapACK
+		n, _ := a.MarshalBinary(rx.Payload[:cap(rx.Payload)])
+		rx.Payload = rx.Payload[:n]
+		if err := s._handleBootstrapACK(p, rx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ack(1)
+	s._trackBootstrap(p, f)
+	key := pendingBootstrapKey{p, f.DestinationKey, 42}
+	if _, ok := s._pendingBootstraps[key]; !ok {
+		t.Fatalf("bootstrap should be tracked")
+	}
+
+	// Without an acknowledgement, the bootstrap is sent again a limited
+	// number of times before we give up.
+	for i := 0; i < bootstrapMaxRetransmits; i++ {
+		s._retransmitBootstrap(key)
+	}
+	if p.proto.queuecount() != bootstrapMaxRetransmits || p._bootstrapRetx != bootstrapMaxRetransmits {
+		t.Fatalf("expected %d retransmissions, got %d", bootstrapMaxRetransmits, p._bootstrapRetx)
+	}
+	s._retransmitBootstrap(key)
+	if _, ok := s._pendingBootstraps[key]; ok || p._bootstrapLost != 1 {
+		t.Fatalf("expected bootstrap to be given up on")
+	}
+
+	// An acknowledgement stops the bootstrap from being sent again.
+	s._trackBootstrap(p, f)
+	ack(42)
+	s._retransmitBootstrap(key)
+	if p._bootstrapRetx != bootstrapMaxRetransmits {
+		t.Fatalf("acknowledged bootstrap shouldn't be sent again")
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+// Each of our bootstraps is tracked by its sequence number until it is
+// confirmed, it is lost on the way, or it times out. A bootstrap that fails
+// is retried before the next bootstrap interval, but if bootstraps towards
+// the same node keep failing then we wait longer between each retry, so
+// that a broken path doesn't cause a constant stream of bootstraps.
+
+// bootstrapAttempt is one of our bootstraps that hasn't been resolved yet.
+type bootstrapAttempt struct {
+	Sequence types.Varu64       `json:"sequence"`
+	Target   types.PublicKey    `json:"target"`
+	Port     types.SwitchPortID `json:"port"`
+	Sent     time.Time          `json:"sent"`
+}
+
+type bootstrapTracker struct {
+	outstanding   map[types.Varu64]*bootstrapAttempt
+	target        types.PublicKey // The node that recent failures were routed towards
+	failures      int             // Consecutive failures towards the target
+	total         uint64          // Total failures since the router started
+	lastFailure   string          // Why the last bootstrap failed
+	lastFailureAt time.Time       // When the last bootstrap failed
+}
+
+func newBootstrapTracker() *bootstrapTracker {
+	return &bootstrapTracker{
+		outstanding: map[types.Varu64]*bootstrapAttempt{},
+	}
+}
+
+// backoff returns how long to wait before retrying a failed bootstrap. This
+// doubles with each consecutive failure towards the same node, up to the
+// given bootstrap interval.
+func (t *bootstrapTracker) backoff(interval time.Duration) time.Duration {
+	if t.failures == 0 {
+		return 0
+	}
+	backoff := bootstrapRetryInterval
+	for i := 1; i < t.failures && backoff < interval; i++ {
+		backoff *= 2
+	}
+	if backoff > interval {
+		backoff = interval
+	}
+	return backoff
+}
+
+// _bootstrapSent starts tracking a bootstrap that we have just sent towards
+// the given node through the given peer.
+func (s *state) _bootstrapSent(sequence types.Varu64, target types.PublicKey, p *peer) {
+	s._bootstrapAttempts.outstanding[sequence] = &bootstrapAttempt{
+		Sequence: sequence,
+		Target:   target,
+		Port:     p.port,
+		Sent:     s.r.clock.Now(),
+	}
+}
+
+// _bootstrapSucceeded stops tracking a bootstrap that was confirmed.
+func (s *state) _bootstrapSucceeded(sequence types.Varu64) {
+	delete(s._bootstrapAttempts.outstanding, sequence)
+	s._bootstrapAttempts.failures = 0
+}
+
+// _bootstrapFailed records why a bootstrap failed and, if it was our most
+// recent bootstrap, arranges for us to bootstrap again after the backoff.
+func (s *state) _bootstrapFailed(sequence types.Varu64, target types.PublicKey, reason string) {
+	t := s._bootstrapAttempts
+	delete(t.outstanding, sequence)
+	// Whatever went wrong, the next attempt must set the path up again.
+	s._refresh = nil
+	s._recordPathEvent(ProtocolBootstrapFailed, PathID{s.r.public, sequence}, nil, reason)
+	if target != t.target {
+		t.target, t.failures = target, 0
+	}
+	t.failures++
+	t.total++
+	t.lastFailure, t.lastFailureAt = reason, s.r.clock.Now()
+	if sequence == s._bootstrapSequence {
+		s._bootstrapIn(t.backoff(s.r.timings.BootstrapInterval))
+	}
+}
+
+// _bootstrapLost is called when one of our bootstraps wasn't acknowledged
+// by the peer that we sent it to.
+func (s *state) _bootstrapLost(sequence types.Varu64, p *peer) {
+	if attempt, ok := s._bootstrapAttempts.outstanding[sequence]; ok {
+		s._bootstrapFailed(sequence, attempt.Target, fmt.Sprintf("not acknowledged by peer on port %d", p.port))
+	}
+}
+
+// _bootstrapTimedOut is called once a bootstrap has had time to be
+// confirmed. It only counts as a failure if we expect confirmations, as
+// older nodes don't send them.
+func (s *state) _bootstrapTimedOut(sequence types.Varu64) {
+	attempt, ok := s._bootstrapAttempts.outstanding[sequence]
+	if !ok {
+		return
+	}
+	if s._bootstrapConfirm == nil {
+		delete(s._bootstrapAttempts.outstanding, sequence)
+		return
+	}
+	s._bootstrapFailed(sequence, attempt.Target, "not confirmed in time")
+}
+
+// _bootstrapIn resets the bootstrap timer so that we will bootstrap on the
+// first maintenance interval after the given duration.
+func (s *state) _bootstrapIn(d time.Duration) {
+	s._lastbootstrap = s.r.clock.Now().Add(d - s.r.timings.BootstrapInterval)
+}
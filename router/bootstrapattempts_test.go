@@ -0,0 +1,93 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestBootstrapBackoff(t *testing.T) {
+	s := newTestState(types.PublicKey{}, systemClock{})
+	p := &peer{port: 1}
+	target := types.PublicKey{1}
+	fail := func(sequence types.Varu64, target types.PublicKey) {
+		s._bootstrapSequence = sequence
+		s._bootstrapSent(sequence, target, p)
+		s._bootstrapFailed(sequence, target, "test")
+	}
+
+	// Each failure in a row towards the same node doubles the backoff, up
+	// to the bootstrap interval.
+	expected := []time.Duration{
+		bootstrapRetryInterval,
+		bootstrapRetryInterval * 2,
+		bootstrapRetryInterval * 4,
+		virtualSnakeBootstrapInterval,
+		virtualSnakeBootstrapInterval,
+	}
+	for i, backoff := range expected {
+		fail(types.Varu64(i+1), target)
+		if got := s._bootstrapAttempts.backoff(virtualSnakeBootstrapInterval); got != backoff {
+			t.Fatalf("failure %d: expected backoff %s, got %s", i+1, backoff, got)
+		}
+		if until := time.Until(s._lastbootstrap.Add(virtualSnakeBootstrapInterval)); until > backoff {
+			t.Fatalf("failure %d: next bootstrap is in %s, expected %s", i+1, until, backoff)
+		}
+	}
+	if n := len(s._bootstrapAttempts.outstanding); n != 0 {
+		t.Fatalf("expected no outstanding bootstraps, got %d", n)
+	}
+
+	// A failure towards a different node starts the backoff again.
+	fail(10, types.PublicKey{2})
+	if got := s._bootstrapAttempts.backoff(virtualSnakeBootstrapInterval); got != bootstrapRetryInterval {
+		t.Fatalf("expected backoff to be reset, got %s", got)
+	}
+
+	// As does a confirmation.
+	s._bootstrapSequence = 11
+	s._bootstrapSent(11, target, p)
+	s._bootstrapSucceeded(11)
+	if got := s._bootstrapAttempts.backoff(virtualSnakeBootstrapInterval); got != 0 {
+		t.Fatalf("expected no backoff after a confirmation, got %s", got)
+	}
+	if s._bootstrapAttempts.total != 6 || s._bootstrapAttempts.lastFailure != "test" {
+		t.Fatalf("failure diagnostics weren't kept")
+	}
+}
+
+func TestBootstrapTimeoutWithoutConfirmations(t *testing.T) {
+	s := newTestState(types.PublicKey{}, systemClock{})
+	s._bootstrapSequence = 1
+	s._bootstrapSent(1, types.PublicKey{1}, &peer{port: 1})
+
+	// We've never had a confirmation, so the bootstrap timing out doesn't
+	// count as a failure.
+	s._bootstrapTimedOut(1)
+	if len(s._bootstrapAttempts.outstanding) != 0 || s._bootstrapAttempts.failures != 0 {
+		t.Fatalf("bootstrap without confirmations shouldn't fail")
+	}
+
+	s._bootstrapConfirm = &bootstrapConfirmation{}
+	s._bootstrapSequence = 2
+	s._bootstrapSent(2, types.PublicKey{1}, &peer{port: 1})
+	s._bootstrapTimedOut(2)
+	if s._bootstrapAttempts.failures != 1 || s._bootstrapAttempts.lastFailure != "not confirmed in time" {
+		t.Fatalf("expected unconfirmed bootstrap to fail")
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+// When a bootstrap reaches the node that takes us as its descending node,
+// that node sends a confirmation back to us. This tells us that our path
+// is live end-to-end, and which node is really our ascending node, rather
+// than us having to infer it. If a confirmation doesn't arrive in time then
+// we bootstrap again, with a new sequence number, instead of waiting for
+// the next bootstrap interval. Older nodes don't confirm our
+// bootstraps, so we only do this once we've had a confirmation before.
+
+// bootstrapConfirmation records which node confirmed one of our bootstraps.
+type bootstrapConfirmation struct {
+	PublicKey types.PublicKey
+	Sequence  types.Varu64
+	At        time.Time
+}
+
+// _confirmBootstrap tells the node that sent the bootstrap that its path
+// ends with us.
+func (s *state) _confirmBootstrap(rx *types.Frame, sequence types.Varu64) {
+	s._sendBootstrapConfirm(rx.DestinationKey, rx.Source, sequence)
+}
+
+// _sendBootstrapConfirm tells the given node that the path with the given
+// sequence ends with us. The confirmation is tree routed to the coordinates
+// if they are known, or SNEK routed to the node if not.
+func (s *state) _sendBootstrapConfirm(origin types.PublicKey, coords types.Coordinates, sequence types.Varu64) {
+	confirm := types.VirtualSnakeBootstrapConfirm{
+		Sequence: sequence,
+	}
+	if s.r.secure {
+		protected, err := confirm.ProtectedPayload(origin)
+		if err != nil {
+			return
+		}
+		copy(confirm.Signature[:], s.r.sign(protected))
+	}
+	frame := getFrame()
+	frame.Type = types.TypeBootstrapConfirm
+	frame.Destination = append(frame.Destination[:0], coords...)
+	frame.DestinationKey = origin
+	frame.Source = s._coords()
+	frame.SourceKey = s.r.public
+	frame.Watermark = types.VirtualSnakeWatermark{
+		PublicKey: types.FullMask,
+		Sequence:  0,
+	}
+	if err := frame.AppendPayload(&confirm); err != nil {
+		framePool.Put(frame)
+		return
+	}
+	s._recordPathEvent(ProtocolConfirmSent, PathID{origin, sequence}, nil, "")
+	_ = s._forward(s.r.local, frame)
+}
+
+// _handleBootstrapConfirm is called when a confirmation for one of our
+// bootstraps arrives.
+func (s *state) _handleBootstrapConfirm(rx *types.Frame) error {
+	var confirm types.VirtualSnakeBootstrapConfirm
+	if _, err := types.Decode(&confirm, rx.Payload); err != nil {
+		return fmt.Errorf("confirm.UnmarshalBinary: %w", err)
+	}
+	path := PathID{s.r.public, confirm.Sequence}
+	if s.r.secure {
+		protected, err := confirm.ProtectedPayload(s.r.public)
+		if err != nil {
+			return fmt.Errorf("confirm.ProtectedPayload: %w", err)
+		}
+		if !s.r.verify(rx.SourceKey[:], protected, confirm.Signature[:]) {
+			s._recordPathEvent(ProtocolConfirmIgnored, path, nil, fmt.Sprintf("invalid signature from %s", rx.SourceKey))
+			return nil
+		}
+	}
+	if confirm.Sequence != s._bootstrapSequence {
+		// The confirmation is for an older bootstrap.
+		s._recordPathEvent(ProtocolConfirmIgnored, path, nil, fmt.Sprintf("older bootstrap confirmed by %s", rx.SourceKey))
+		return nil
+	}
+	s._recordPathEvent(ProtocolBootstrapConfirmed, path, nil, fmt.Sprintf("confirmed by %s", rx.SourceKey))
+	s._bootstrapConfirm = &bootstrapConfirmation{
+		PublicKey: rx.SourceKey,
+		Sequence:  confirm.Sequence,
+		At:        s.r.clock.Now(),
+	}
+	s._pathConfirmed(confirm.Sequence)
+	s._bootstrapSucceeded(confirm.Sequence)
+	s._ascendingConfirmed(rx.SourceKey)
+	return nil
+}
+
+// _awaitBootstrapConfirm checks, once the timeout has passed, that the
+// bootstrap with the given sequence was confirmed, and bootstraps again
+// after the backoff if it wasn't.
+func (s *state) _awaitBootstrapConfirm(sequence types.Varu64) {
+	s.r.clock.AfterFunc(bootstrapConfirmTimeout, func() {
+		s.Act(nil, func() {
+			s._bootstrapTimedOut(sequence)
+		})
+	})
+}
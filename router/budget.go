@@ -0,0 +1,212 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"sync"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+	"go.uber.org/atomic"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+// Queue limits are otherwise counted in frames, and every peering has its
+// own queues, so the memory that a node uses grows with the number of
+// peers. With RouterOptionMemoryBudget, queued frames are counted in the
+// bytes that they really hold, which for a pooled frame is the whole
+// capacity of its payload buffer, and the budget is shared out between the
+// peerings. Each peering can use an equal share of the budget for its
+// traffic queue, and the oldest frames in the longest flows are dropped to
+// stay within it. Protocol frames can go over a peering's share, since
+// losing them is worse for the network than losing traffic, but not over
+// the budget as a whole. A small part of the budget is set aside for the
+// routing tables. The parts of the tables that are only caches, such as
+// cached coordinates, stop growing when it runs out, but paths and tree
+// announcements are always kept, since the network doesn't work without
+// them.
+
+// memoryBudgetTableShare is the fraction of the budget, as a divisor, that
+// is set aside for the routing tables.
+const memoryBudgetTableShare = 8
+
+// frameOverhead is roughly how much memory a queued frame uses besides its
+// payload buffer, i.e. the frame itself, its coordinates and queue entry.
+const frameOverhead = 256
+
+// Rough sizes of routing table entries, including the map overhead.
+const (
+	snekEntryMemory         = 256
+	coordsCacheEntryMemory  = 128
+	announcementEntryMemory = 512
+	// Each signature in an announcement adds this much.
+	announcementSignatureMemory = 112
+)
+
+// MemoryStats describes how much of the memory budget is in use.
+type MemoryStats struct {
+	Budget    uint64 `json:"budget"`     // The whole budget, zero if there isn't one
+	Queued    uint64 `json:"queued"`     // Bytes held by queued frames
+	Tables    uint64 `json:"tables"`     // Estimated bytes held by the routing tables
+	PeerQuota uint64 `json:"peer_quota"` // Bytes that each peering can queue
+	Peers     int    `json:"peers"`      // Peerings sharing the budget, including the local one
+	Dropped   uint64 `json:"dropped"`    // Frames dropped or refused to stay within the budget
+}
+
+// frameMemory returns how much memory the frame holds while it is queued.
+func frameMemory(frame *types.Frame) uint64 {
+	return uint64(cap(frame.Payload)) + frameOverhead
+}
+
+// memoryBudget is shared by all of the queues of a router.
+type memoryBudget struct {
+	limit   uint64 // Zero means that there's no budget
+	used    atomic.Uint64
+	peers   atomic.Int64
+	dropped atomic.Uint64
+}
+
+func newMemoryBudget(limit uint64) *memoryBudget {
+	if limit == 0 {
+		return nil
+	}
+	return &memoryBudget{limit: limit}
+}
+
+// queueLimit returns how much of the budget the queues can use.
+func (b *memoryBudget) queueLimit() uint64 {
+	return b.limit - b.limit/memoryBudgetTableShare
+}
+
+// tableLimit returns how much of the budget the routing tables can use.
+func (b *memoryBudget) tableLimit() uint64 {
+	return b.limit / memoryBudgetTableShare
+}
+
+// quota returns how much each peering can queue.
+func (b *memoryBudget) quota() uint64 {
+	peers := b.peers.Load()
+	if peers < 1 {
+		peers = 1
+	}
+	return b.queueLimit() / uint64(peers)
+}
+
+// forPeer returns the share of the budget for a new peering, or nil if
+// there's no budget.
+func (b *memoryBudget) forPeer() *peerBudget {
+	if b == nil {
+		return nil
+	}
+	b.peers.Inc()
+	return &peerBudget{budget: b}
+}
+
+// peerBudget is the share of the memory budget used by the queues of one
+// peering.
+type peerBudget struct {
+	budget *memoryBudget
+	mutex  sync.Mutex
+	used   uint64
+	closed bool
+}
+
+// reserve takes the given number of bytes from the budget, returning false
+// if they don't fit. Protocol queues only have to stay within the budget as
+// a whole.
+func (p *peerBudget) reserve(n uint64, protocol bool) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	switch {
+	case p.closed:
+		return false
+	case p.budget.used.Load()+n > p.budget.queueLimit():
+		return false
+	case !protocol && p.used+n > p.budget.quota():
+		return false
+	}
+	p.used += n
+	p.budget.used.Add(n)
+	return true
+}
+
+func (p *peerBudget) give(n uint64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if !p.closed {
+		p.used -= n
+		p.budget.used.Sub(n)
+	}
+}
+
+// close gives the whole share back when the peering goes away.
+func (p *peerBudget) close() {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if !p.closed {
+		p.closed = true
+		p.budget.used.Sub(p.used)
+		p.budget.peers.Dec()
+		p.used = 0
+	}
+}
+
+// _tableMemory returns roughly how much memory the routing tables use.
+func (s *state) _tableMemory() uint64 {
+	return uint64(len(s._table))*snekEntryMemory +
+		uint64(len(s._coordsCache))*coordsCacheEntryMemory +
+		s._announcementMemory
+}
+
+// _cacheCoords remembers the coordinates of the given node, unless the
+// routing tables have used up their share of the memory budget.
+func (s *state) _cacheCoords(key types.PublicKey, coords types.Coordinates) {
+	if _, ok := s._coordsCache[key]; !ok {
+		if b := s.r.memory; b != nil && s._tableMemory()+coordsCacheEntryMemory > b.tableLimit() {
+			return
+		}
+	}
+	s._coordsCache[key] = coordsCacheEntry{
+		coordinates: coords,
+		lastSeen:    s.r.clock.Now(),
+	}
+}
+
+// MemoryStats returns how much of the memory budget given with
+// RouterOptionMemoryBudget is in use.
+func (r *Router) MemoryStats() MemoryStats {
+	var tables uint64
+	phony.Block(r.state, func() {
+		tables = r.state._tableMemory()
+	})
+	return r.memory.stats(tables)
+}
+
+func (b *memoryBudget) stats(tables uint64) MemoryStats {
+	stats := MemoryStats{Tables: tables}
+	if b != nil {
+		stats.Budget = b.limit
+		stats.Queued = b.used.Load()
+		stats.PeerQuota = b.quota()
+		stats.Peers = int(b.peers.Load())
+		stats.Dropped = b.dropped.Load()
+	}
+	return stats
+}
@@ -0,0 +1,114 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"testing"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestMemoryBudgetTrafficQueue(t *testing.T) {
+	size := frameMemory(getFrame())
+	// Room for eight frames in the queues, shared between two peerings.
+	b := newMemoryBudget(size * 8 * memoryBudgetTableShare / (memoryBudgetTableShare - 1))
+	p1, p2 := b.forPeer(), b.forPeer()
+	if quota := b.quota(); quota < size*4 || quota >= size*5 {
+		t.Fatalf("expected a quota of four frames, got %d bytes", quota)
+	}
+	q1 := newFairFIFOQueue(4, nil, nil).withBudget(p1)
+	q2 := newFairFIFOQueue(4, nil, nil).withBudget(p2)
+
+	// Going over the quota drops the oldest frames rather than refusing new
+	// ones.
+	for i := 0; i < 6; i++ {
+		f := getFrame()
+		f.Type = types.TypeTraffic
+		f.DestinationKey = types.PublicKey{byte(i % 2)}
+		if !q1.push(f) {
+			t.Fatalf("expected frame %d to be queued", i)
+		}
+	}
+	if count := q1.queuecount(); count != 4 {
+		t.Fatalf("expected four frames to be queued, got %d", count)
+	}
+	if used := b.used.Load(); used != size*4 {
+		t.Fatalf("expected four frames of the budget to be used, got %d bytes", used)
+	}
+	if dropped := b.stats(0).Dropped; dropped != 2 {
+		t.Fatalf("expected two frames to be dropped, got %d", dropped)
+	}
+
+	// The other peering still has its own share.
+	for i := 0; i < 4; i++ {
+		if !q2.push(getFrame()) {
+			t.Fatalf("expected frame %d to be queued on the other peering", i)
+		}
+	}
+
+	// Resetting the queues and closing a share gives the memory back.
+	q1.reset()
+	if used := b.used.Load(); used != size*4 {
+		t.Fatalf("expected the reset queue to give back its memory, got %d bytes used", used)
+	}
+	p2.close()
+	if used, peers := b.used.Load(), b.peers.Load(); used != 0 || peers != 1 {
+		t.Fatalf("expected the closed share to be given back, got %d bytes and %d peers", used, peers)
+	}
+	if q2.push(getFrame()) {
+		t.Fatalf("expected a closed share to refuse frames")
+	}
+}
+
+func TestMemoryBudgetProtocolQueue(t *testing.T) {
+	size := frameMemory(getFrame())
+	b := newMemoryBudget(size * 4 * memoryBudgetTableShare / (memoryBudgetTableShare - 1))
+	p1, _ := b.forPeer(), b.forPeer()
+	q := newFIFOQueue(fifoNoMax, nil, nil).withBudget(p1, true)
+
+	// Protocol frames can use more than the peering's share, but not more
+	// than the whole budget.
+	for i := 0; i < 4; i++ {
+		if !q.push(getFrame()) {
+			t.Fatalf("expected protocol frame %d to be queued", i)
+		}
+	}
+	if q.push(getFrame()) {
+		t.Fatalf("expected a protocol frame over the budget to be refused")
+	}
+	if stats := q.queueStats(); stats.Dropped != 1 {
+		t.Fatalf("expected the refused frame to be counted, got %+v", stats)
+	}
+	f := <-q.pop()
+	q.ack(f)
+	if !q.push(getFrame()) {
+		t.Fatalf("expected a sent frame to make room")
+	}
+}
+
+func TestMemoryBudgetCoordsCache(t *testing.T) {
+	s := newTestState(types.PublicKey{}, systemClock{})
+	s.r.memory = newMemoryBudget(coordsCacheEntryMemory * 2 * memoryBudgetTableShare)
+	for i := 0; i < 4; i++ {
+		s._cacheCoords(types.PublicKey{byte(i)}, types.Coordinates{1})
+	}
+	if len(s._coordsCache) != 2 {
+		t.Fatalf("expected the cache to stop growing, got %d entries", len(s._coordsCache))
+	}
+	s._cacheCoords(types.PublicKey{0}, types.Coordinates{2})
+	if coords := s._coordsCache[types.PublicKey{0}].coordinates; len(coords) != 1 || coords[0] != 2 {
+		t.Fatalf("expected existing entries to be updated, got %v", coords)
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+// In a closed network, both sides of a peering send their certificate chain
+// straight after the handshake, prefixed with its length. Peerings that are
+// set up with ConnectionPublicKey skip the handshake and so are trusted
+// without checking any certificates.
+
+// exchangeCertificates sends our certificate chain to the remote node and
+// checks that the chain that it sends back leads to our authority. The
+// exchange must complete before the given deadline.
+func (r *Router) exchangeCertificates(conn net.Conn, public types.PublicKey, deadline time.Time) error {
+	if err := conn.SetDeadline(deadline); err != nil {
+		return fmt.Errorf("conn.SetDeadline: %w", err)
+	}
+	ours := make([]byte, 2+r.certificates.Length())
+	n, err := r.certificates.MarshalBinary(ours[2:])
+	if err != nil {
+		return fmt.Errorf("r.certificates.MarshalBinary: %w", err)
+	}
+	binary.BigEndian.PutUint16(ours[:2], uint16(n))
+	if _, err := conn.Write(ours[:2+n]); err != nil {
+		return fmt.Errorf("conn.Write: %w", err)
+	}
+
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return fmt.Errorf("io.ReadFull: %w", err)
+	}
+	theirs := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, theirs); err != nil {
+		return fmt.Errorf("io.ReadFull: %w", err)
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return fmt.Errorf("conn.SetDeadline: %w", err)
+	}
+
+	var chain types.CertificateChain
+	if n, err := types.Decode(&chain, theirs); err != nil {
+		return fmt.Errorf("chain.UnmarshalBinary: %w", err)
+	} else if n != len(theirs) {
+		return fmt.Errorf("certificate chain has %d trailing bytes", len(theirs)-n)
+	}
+	r.energy.verifies.Add(uint64(len(chain)))
+	if err := chain.Verify(public, *r.authority, r.clock.Now()); err != nil {
+		return fmt.Errorf("chain.Verify: %w", err)
+	}
+	return nil
+}
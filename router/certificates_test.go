@@ -0,0 +1,93 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+// connectTestRouters peers the two routers over a loopback connection and
+// returns the errors from both sides of the handshake.
+func connectTestRouters(t *testing.T, a, b *Router) (error, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	accepted := make(chan error, 1)
+	go func() {
+		c, err := listener.Accept()
+		if err == nil {
+			_, err = a.Connect(c)
+		}
+		accepted <- err
+	}()
+	c, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, errB := b.Connect(c)
+	return <-accepted, errB
+}
+
+func TestPeeringCertificates(t *testing.T) {
+	var authority types.PrivateKey
+	_, ask, _ := ed25519.GenerateKey(nil)
+	copy(authority[:], ask)
+
+	newRouter := func(certified, closed bool, opts ...RouterOption) *Router {
+		_, sk, _ := ed25519.GenerateKey(nil)
+		if closed {
+			opts = append(opts, RouterOptionPeeringAuthority(authority.Public()))
+		}
+		if certified {
+			var public types.PublicKey
+			copy(public[:], sk.Public().(ed25519.PublicKey))
+			opts = append(opts, RouterOptionCertificateChain{
+				types.IssueCertificate(authority, public, time.Now().Add(time.Hour)),
+			})
+		}
+		r := NewRouter(nil, sk, opts...)
+		t.Cleanup(func() { _ = r.Close() })
+		return r
+	}
+
+	// Two certified nodes in the closed network can peer.
+	if errA, errB := connectTestRouters(t, newRouter(true, true), newRouter(true, true)); errA != nil || errB != nil {
+		t.Fatalf("certified nodes failed to peer: %v, %v", errA, errB)
+	}
+
+	// A node without a certificate is refused.
+	if errA, errB := connectTestRouters(t, newRouter(true, true), newRouter(false, true)); !errors.Is(errA, ErrNotAuthorized) {
+		t.Fatalf("uncertified node was accepted (errors: %v, %v)", errA, errB)
+	}
+
+	// Nodes in the open network can't peer with the closed network.
+	if errA, errB := connectTestRouters(t, newRouter(true, true), newRouter(false, false)); errA == nil || errB == nil {
+		t.Fatalf("open and closed nodes peered: %v, %v", errA, errB)
+	}
+
+	// Certificates expire by the clock of the router, not the system clock.
+	later := RouterOptionClock{Clock: NewManualClock(time.Now().Add(time.Hour * 2))}
+	if errA, errB := connectTestRouters(t, newRouter(true, true, later), newRouter(true, true)); !errors.Is(errA, ErrNotAuthorized) {
+		t.Fatalf("expired certificate was accepted (errors: %v, %v)", errA, errB)
+	}
+}
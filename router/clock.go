@@ -0,0 +1,240 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is the source of time for the routing state, i.e. timers and the
+// expiry of routes, announcements and caches, and for pacing, keepalives
+// and the timeouts on the peerings. The reads and writes themselves happen
+// in real time, since they depend on the real network.
+type Clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a timer created by a Clock, which behaves like a *time.Timer
+// created by time.AfterFunc.
+type Timer interface {
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// since returns the time elapsed since t according to the clock.
+func since(c Clock, t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+// systemClock is the default clock, which uses real time.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// ManualClock is a Clock that only moves when it is advanced, so that
+// tests can fast-forward through timers and expiry periods, and so that
+// simulations can run faster than real time. It is safe for concurrent use.
+type ManualClock struct {
+	mutex  sync.Mutex
+	now    time.Time
+	timers map[*manualTimer]struct{}
+}
+
+// NewManualClock returns a ManualClock that starts at the given time.
+func NewManualClock(now time.Time) *ManualClock {
+	return &ManualClock{
+		now:    now,
+		timers: map[*manualTimer]struct{}{},
+	}
+}
+
+// Now returns the current time of the clock.
+func (c *ManualClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+// AfterFunc calls f once the clock has been advanced by d.
+func (c *ManualClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	t := &manualTimer{clock: c, f: f, deadline: c.now.Add(d)}
+	c.timers[t] = struct{}{}
+	return t
+}
+
+// Advance moves the clock forward by d, calling the functions of any timers
+// that become due along the way in deadline order. Timers that are created
+// by those functions are also called if they become due before the end.
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	end := c.now.Add(d)
+	c.mutex.Unlock()
+	for {
+		c.mutex.Lock()
+		due := make([]*manualTimer, 0, len(c.timers))
+		for t := range c.timers {
+			if !t.deadline.After(end) {
+				due = append(due, t)
+			}
+		}
+		if len(due) == 0 {
+			c.now = end
+			c.mutex.Unlock()
+			return
+		}
+		sort.Slice(due, func(i, j int) bool {
+			return due[i].deadline.Before(due[j].deadline)
+		})
+		next := due[0]
+		delete(c.timers, next)
+		if next.deadline.After(c.now) {
+			c.now = next.deadline
+		}
+		c.mutex.Unlock()
+		next.f()
+	}
+}
+
+type manualTimer struct {
+	clock    *ManualClock
+	f        func()
+	deadline time.Time
+}
+
+func (t *manualTimer) Stop() bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	_, pending := t.clock.timers[t]
+	delete(t.clock.timers, t)
+	return pending
+}
+
+func (t *manualTimer) Reset(d time.Duration) bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	_, pending := t.clock.timers[t]
+	t.deadline = t.clock.now.Add(d)
+	t.clock.timers[t] = struct{}{}
+	return pending
+}
+
+// clockTimer is a timer on a Clock that delivers the time on a channel when
+// it fires, in the same way as a *time.Timer created by time.NewTimer.
+type clockTimer struct {
+	C     chan time.Time
+	timer Timer
+}
+
+func newClockTimer(c Clock, d time.Duration) *clockTimer {
+	t := &clockTimer{C: make(chan time.Time, 1)}
+	t.timer = c.AfterFunc(d, func() {
+		select {
+		case t.C <- c.Now():
+		default:
+		}
+	})
+	return t
+}
+
+// Stop stops the timer, returning false if it had already fired.
+func (t *clockTimer) Stop() bool {
+	return t.timer.Stop()
+}
+
+// Reset starts the timer again, throwing away the time from the last time
+// that it fired if nobody received it.
+func (t *clockTimer) Reset(d time.Duration) {
+	t.timer.Stop()
+	select {
+	case <-t.C:
+	default:
+	}
+	t.timer.Reset(d)
+}
+
+// aLongTimeAgo is a deadline in the past, which makes a read or a write on
+// a connection that is blocked return straight away.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// connDeadline times out the reads or the writes on a connection once some
+// time has passed on a Clock. The deadlines of a connection are always in
+// real time, so rather than setting one in advance, the deadline of the
+// connection is moved into the past when the timer fires.
+type connDeadline struct {
+	mutex   sync.Mutex
+	timer   Timer
+	set     func(time.Time) error
+	armed   bool // protected by mutex
+	expired bool // protected by mutex
+}
+
+// newConnDeadline returns a deadline that uses the given function, which is
+// the SetDeadline, SetReadDeadline or SetWriteDeadline of the connection.
+// Nothing times out until start is called.
+func newConnDeadline(c Clock, set func(time.Time) error) *connDeadline {
+	d := &connDeadline{set: set}
+	d.timer = c.AfterFunc(time.Hour, d.expire)
+	d.timer.Stop()
+	return d
+}
+
+func (d *connDeadline) expire() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.armed {
+		d.armed, d.expired = false, true
+		_ = d.set(aLongTimeAgo)
+	}
+}
+
+// start times out the connection once the given duration has passed,
+// unless stop or start are called again first.
+func (d *connDeadline) start(timeout time.Duration) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.expired {
+		d.expired = false
+		if err := d.set(time.Time{}); err != nil {
+			return err
+		}
+	}
+	d.armed = true
+	d.timer.Reset(timeout)
+	return nil
+}
+
+// stop stops the connection from timing out.
+func (d *connDeadline) stop() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.armed = false
+	d.timer.Stop()
+	if d.expired {
+		d.expired = false
+		return d.set(time.Time{})
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestManualClock(t *testing.T) {
+	start := time.Unix(1000, 0)
+	c := NewManualClock(start)
+	var fired []int
+	c.AfterFunc(time.Second*2, func() { fired = append(fired, 2) })
+	c.AfterFunc(time.Second, func() {
+		fired = append(fired, 1)
+		// Timers created by timers fire too if they're due.
+		c.AfterFunc(time.Second*2, func() { fired = append(fired, 3) })
+	})
+	stopped := c.AfterFunc(time.Second, func() { fired = append(fired, 0) })
+	if !stopped.Stop() {
+		t.Fatalf("expected timer to be pending")
+	}
+
+	c.Advance(time.Millisecond * 2500)
+	if len(fired) != 2 || fired[0] != 1 || fired[1] != 2 {
+		t.Fatalf("expected timers 1 and 2 to fire in order, got %v", fired)
+	}
+	if now := c.Now(); !now.Equal(start.Add(time.Millisecond * 2500)) {
+		t.Fatalf("clock is at %s", now)
+	}
+	c.Advance(time.Second)
+	if len(fired) != 3 || fired[2] != 3 {
+		t.Fatalf("expected timer 3 to fire, got %v", fired)
+	}
+
+	// Resetting a timer that has fired arms it again.
+	if stopped.Reset(time.Second) {
+		t.Fatalf("expected stopped timer not to be pending")
+	}
+	c.Advance(time.Second)
+	if len(fired) != 4 || fired[3] != 0 {
+		t.Fatalf("expected reset timer to fire, got %v", fired)
+	}
+}
+
+func TestSNEKEntryExpiryWithManualClock(t *testing.T) {
+	c := NewManualClock(time.Now())
+	_, sk, _ := ed25519.GenerateKey(nil)
+	r := NewRouter(nil, sk, RouterOptionClock{c})
+	t.Cleanup(func() { _ = r.Close() })
+
+	index := virtualSnakeIndex{PublicKey: types.PublicKey{1}}
+	phony.Block(r.state, func() {
+		r.state._table[index] = &virtualSnakeEntry{
+			virtualSnakeIndex: &index,
+			Source:            r.local,
+			LastSeen:          c.Now(),
+		}
+	})
+	exists := func() (ok bool) {
+		phony.Block(r.state, func() {
+			_, ok = r.state._table[index]
+		})
+		return
+	}
+
+	// Step through maintenance until just before the path expires.
+	for i := time.Duration(0); i < virtualSnakeNeighExpiryPeriod-virtualSnakeMaintainInterval; i += virtualSnakeMaintainInterval {
+		c.Advance(virtualSnakeMaintainInterval)
+		if !exists() {
+			t.Fatalf("path expired early")
+		}
+	}
+	for i := 0; i < 3; i++ {
+		c.Advance(virtualSnakeMaintainInterval)
+		_ = exists()
+	}
+	if exists() {
+		t.Fatalf("path should have expired")
+	}
+}
+
+func TestConnDeadline(t *testing.T) {
+	c := NewManualClock(time.Unix(1000, 0))
+	local, remote := net.Pipe()
+	defer local.Close()  // nolint:errcheck
+	defer remote.Close() // nolint:errcheck
+	deadline := newConnDeadline(c, local.SetReadDeadline)
+	read := func() <-chan error {
+		done := make(chan error, 1)
+		go func() {
+			_, err := local.Read(make([]byte, 1))
+			done <- err
+		}()
+		return done
+	}
+
+	// A read times out once the time has passed on the clock, however
+	// long that takes in real time.
+	if err := deadline.start(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	done := read()
+	select {
+	case err := <-done:
+		t.Fatalf("expected the read to wait for the clock, got %v", err)
+	case <-time.After(time.Millisecond * 50):
+	}
+	c.Advance(time.Second)
+	if err := <-done; !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected the read to time out, got %v", err)
+	}
+
+	// Starting again clears the deadline that expired, and stopping means
+	// that the read never times out.
+	if err := deadline.start(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := deadline.stop(); err != nil {
+		t.Fatal(err)
+	}
+	done = read()
+	c.Advance(time.Hour)
+	if _, err := remote.Write([]byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("expected the read to succeed, got %v", err)
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+// The third byte of the handshake, which was always zero before, holds
+// optional wire features that a node is willing to receive. A feature is
+// only used on a peering if both sides set its bit, so nodes that don't
+// know about a feature never see it. Unlike the capabilities, these don't
+// have to match for the peering to come up.
+
+// handshakeCompactFrames is set if the node accepts compact frames, which
+// encode lengths and coordinates more tightly than normal frames.
+const handshakeCompactFrames = 1 << 0
+
+// wireFeatures returns the value to advertise in the handshake.
+func (r *Router) wireFeatures() uint8 {
+	var features uint8
+	if r.wireProfile != nil {
+		// An older implementation wouldn't know about any of them.
+		return features
+	}
+	if r.compact {
+		features |= handshakeCompactFrames
+	}
+	if r.locality != "" {
+		features |= handshakeLocality
+	}
+	if r.networkName != "" {
+		features |= handshakeNetworkName
+	}
+	if r.linkEncrypt {
+		features |= handshakeLinkEncryption
+	}
+	features |= handshakeMetadata | handshakeSignedMetadata
+	features |= handshakeKeepalives
+	return features
+}
@@ -0,0 +1,73 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"testing"
+	"time"
+)
+
+func TestCompactFrames(t *testing.T) {
+	newRouter := func(compact bool) *Router {
+		_, sk, _ := ed25519.GenerateKey(nil)
+		r := NewRouter(nil, sk, RouterOptionCompactFrames(compact))
+		t.Cleanup(func() { _ = r.Close() })
+		return r
+	}
+
+	for _, tc := range []struct {
+		a, b     bool
+		expected bool
+	}{
+		{true, false, false},
+		{false, true, false},
+		{true, true, true},
+	} {
+		a, b := newRouter(tc.a), newRouter(tc.b)
+		if errA, errB := connectTestRouters(t, a, b); errA != nil || errB != nil {
+			t.Fatalf("failed to peer: %v, %v", errA, errB)
+		}
+		for _, peer := range a.Peers() {
+			if peer.Port != 0 && peer.CompactFrames != tc.expected {
+				t.Fatalf("%v and %v: expected compact frames %v", tc.a, tc.b, tc.expected)
+			}
+		}
+
+		deadline := time.Now().Add(time.Second * 10)
+		for len(a.Coords()) == 0 && len(b.Coords()) == 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("tree didn't converge")
+			}
+			time.Sleep(time.Millisecond * 100)
+		}
+
+		// Traffic must get through whichever encoding is used.
+		sent := []byte("HELLO!")
+		if _, err := a.WriteTo(sent, b.PublicKey()); err != nil {
+			t.Fatal(err)
+		}
+		_ = b.SetReadDeadline(time.Now().Add(time.Second * 5))
+		received := make([]byte, 64)
+		n, _, err := b.ReadFrom(received)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(received[:n], sent) {
+			t.Fatalf("payload doesn't match")
+		}
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnectWithContextCancelled(t *testing.T) {
+	_, sk, _ := ed25519.GenerateKey(nil)
+	r := NewRouter(nil, sk)
+	t.Cleanup(func() { _ = r.Close() })
+
+	// The remote side of the pipe never reads or writes, like a
+	// dead TCP endpoint, so the handshake can't complete.
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	peers := len(r.Peers())
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(time.Millisecond*100, cancel)
+	start := time.Now()
+	if _, err := r.ConnectWithContext(ctx, local); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > peerHandshakeTimeout/2 {
+		t.Fatalf("handshake took %s to give up after cancellation", elapsed)
+	}
+	if len(r.Peers()) != peers {
+		t.Fatalf("peer was added despite the failed handshake")
+	}
+}
+
+func TestConnectWithContextDeadline(t *testing.T) {
+	_, sk, _ := ed25519.GenerateKey(nil)
+	r := NewRouter(nil, sk)
+	t.Cleanup(func() { _ = r.Close() })
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	start := time.Now()
+	if _, err := r.ConnectWithContext(ctx, local); !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, ErrHandshakeTimeout) {
+		t.Fatalf("expected the handshake to time out, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > peerHandshakeTimeout/2 {
+		t.Fatalf("handshake took %s despite the context deadline", elapsed)
+	}
+}
+
+func TestConnectWithContextAlreadyDone(t *testing.T) {
+	_, sk, _ := ed25519.GenerateKey(nil)
+	r := NewRouter(nil, sk)
+	t.Cleanup(func() { _ = r.Close() })
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := r.ConnectWithContext(ctx, local); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
@@ -22,6 +22,16 @@ import (
 const portCount = math.MaxUint8 - 1
 const trafficBuffer = math.MaxUint8 - 1
 
+// peerHandshakeTimeout is the longest that we will wait
+// for a new peering to complete the handshake, unless the
+// caller gives us a context with a sooner deadline.
+const peerHandshakeTimeout = time.Second * 10
+
+// peerCertificateTimeout is the longest that we will wait
+// for a new peering in a closed network to complete the
+// certificate exchange after the handshake.
+const peerCertificateTimeout = time.Second * 10
+
 // peerKeepaliveInterval is the frequency at which this
 // node will send keepalive packets to other peers if no
 // other packets have been sent within the peerKeepaliveInterval.
@@ -32,6 +42,112 @@ const peerKeepaliveInterval = time.Second * 3
 // will assume that the peer is dead.
 const peerKeepaliveTimeout = time.Second * 5
 
+// peerKeepaliveMinInterval is the shortest keepalive
+// interval that can be configured for a peer type.
+const peerKeepaliveMinInterval = time.Millisecond * 100
+
+// peerKeepaliveMinMissTolerance is the fewest keepalive
+// intervals that can be configured to pass without
+// receiving anything before a peer is declared dead.
+const peerKeepaliveMinMissTolerance = 2
+
+// fastFailureDetectionInterval is the default interval at
+// which we will ask peers to send us frames when fast failure
+// detection is enabled on a peering.
+const fastFailureDetectionInterval = time.Millisecond * 250
+
+// fastFailureDetectionMultiplier is the default number of
+// negotiated intervals that can pass without receiving a frame
+// before fast failure detection declares the peering dead.
+const fastFailureDetectionMultiplier = 3
+
+// fastFailureDetectionMinInterval is the fastest interval that
+// we will agree to for fast failure detection.
+const fastFailureDetectionMinInterval = time.Millisecond * 50
+
+// peerMaxMalformedFrames is how many recent malformed frames
+// or payloads we will tolerate from a peer in strict decoding
+// mode before we assume that it is buggy or abusive and
+// disconnect it. The count is halved every peerQualityInterval.
+const peerMaxMalformedFrames = 16
+
+// peerQualityInterval is how often we will recalculate
+// the quality scores of our peerings.
+const peerQualityInterval = time.Second * 10
+
+// handshakeFailureDecayInterval is how often the counts of
+// handshake failures are halved, so that they stop counting
+// against the quality of peerings with the same key.
+const handshakeFailureDecayInterval = time.Minute
+
+// handshakeFailureMaxKeys is how many keys we will count
+// handshake failures for at once. Failures for new keys
+// aren't counted while there are this many.
+const handshakeFailureMaxKeys = 4096
+
+// peerQualityDemoteThreshold is the quality score below
+// which a peer will no longer be considered as a parent, if
+// pruning is enabled.
+const peerQualityDemoteThreshold = 50
+
+// peerQualityDisconnectThreshold is the quality score below
+// which a peering will be disconnected, if pruning is enabled.
+const peerQualityDisconnectThreshold = 20
+
+// echoTimeout is how long we will wait for an echo reply
+// before forgetting about the request.
+const echoTimeout = time.Second * 30
+
+// rttExpiry is how long we will keep a round trip time
+// estimate for a destination that we no longer measure.
+const rttExpiry = time.Minute * 5
+
+// parentRTTFactor and parentRTTMargin control how much lower
+// the round trip time to another peer must be before we will
+// prefer it as our parent over an otherwise equal candidate.
+const parentRTTFactor = 2
+const parentRTTMargin = time.Millisecond * 10
+
+// pacerMinBlockedWrite is how long a write must take before
+// we assume that it was held up by the link, and so can be
+// used to estimate the link rate for pacing.
+const pacerMinBlockedWrite = time.Millisecond
+
+// schedulerProtoBurst is how many protocol frames we will
+// send to a peer in a row while traffic frames are waiting,
+// before letting a traffic frame through.
+const schedulerProtoBurst = 8
+
+// queueAlarmMinCheckInterval is the most often that we will
+// sample queue depths when queue alarms are enabled.
+const queueAlarmMinCheckInterval = time.Millisecond * 100
+
+// queueDelaySampleInterval is how many frames pass through
+// a queue for every one that is timed for the queue delay
+// statistics.
+const queueDelaySampleInterval = 16
+
+// serviceAdvertisementInterval is how often we will repeat
+// the advertisements for the services that we offer.
+const serviceAdvertisementInterval = time.Minute
+
+// serviceExpiryPeriod is how long we will remember a service
+// advertisement from another node.
+const serviceExpiryPeriod = serviceAdvertisementInterval * 3
+
+// serviceMaxRecords is the most service advertisements from
+// other nodes that we will remember at once.
+const serviceMaxRecords = 1024
+
+// lowPowerPeerQualityInterval is how often we recalculate
+// peer quality scores in low power mode.
+const lowPowerPeerQualityInterval = time.Minute
+
+// lowPowerBatchDelay is how long we will hold on to tree
+// announcements in low power mode so that they can be sent
+// together.
+const lowPowerBatchDelay = time.Millisecond * 500
+
 // announcementInterval is the frequency at which this
 // node will send root announcements to other peers.
 const announcementInterval = time.Minute * 30
@@ -41,6 +157,28 @@ const announcementInterval = time.Minute * 30
 // will assume that the peer is dead.
 const announcementTimeout = time.Minute * 45
 
+// sendQueueTimeout is how long traffic that we send waits
+// for a next hop before it is dropped, unless another time
+// is given with RouterOptionSendQueueTimeout.
+const sendQueueTimeout = time.Second * 3
+
+// sendQueueFrames is the most frames that can wait for a
+// next hop to any one destination.
+const sendQueueFrames = 64
+
+// sendQueueDestinations is the most destinations that can
+// have traffic waiting for a next hop at once.
+const sendQueueDestinations = 256
+
+// sendQueueBytes is the most payload bytes that can wait
+// for a next hop across all destinations.
+const sendQueueBytes = 1024 * 1024
+
+// defaultAnnouncementLimit is the soft limit on the memory
+// held by stored tree announcements, unless another is
+// given with RouterOptionAnnouncementLimit.
+const defaultAnnouncementLimit = 4 * 1024 * 1024
+
 // virtualSnakeMaintainInterval is how often we check to
 // see if SNEK maintenance needs to be done.
 const virtualSnakeMaintainInterval = time.Second
@@ -53,6 +191,66 @@ const virtualSnakeBootstrapInterval = time.Second * 5
 // to expire a path that hasn't re-bootstrapped.
 const virtualSnakeNeighExpiryPeriod = virtualSnakeBootstrapInterval * 2
 
+// timingsMinSNEKMaintainInterval and timingsMaxSNEKMaintainInterval
+// are the bounds on the SNEK maintenance interval that can be
+// configured with RouterOptionTimings.
+const timingsMinSNEKMaintainInterval = time.Millisecond * 100
+const timingsMaxSNEKMaintainInterval = time.Second * 10
+
+// timingsMinBootstrapInterval and timingsMaxBootstrapInterval
+// are the bounds on the bootstrap interval that can be
+// configured with RouterOptionTimings.
+const timingsMinBootstrapInterval = time.Second
+const timingsMaxBootstrapInterval = time.Minute * 5
+
+// timingsMinAnnouncementInterval and timingsMaxAnnouncementInterval
+// are the bounds on the root announcement interval that can be
+// configured with RouterOptionTimings.
+const timingsMinAnnouncementInterval = time.Second * 10
+const timingsMaxAnnouncementInterval = time.Hour * 2
+
+// bootstrapRetransmitInterval is how long we will wait for
+// a peer to acknowledge a bootstrap before sending it again.
+const bootstrapRetransmitInterval = time.Millisecond * 500
+
+// bootstrapMaxRetransmits is how many times we will send a
+// bootstrap again before giving up on it. The next bootstrap
+// will be along soon enough anyway.
+const bootstrapMaxRetransmits = 3
+
+// bootstrapConfirmTimeout is how long we will wait for our
+// bootstrap to be confirmed before bootstrapping again.
+const bootstrapConfirmTimeout = time.Second * 2
+
+// bootstrapRetryInterval is how long we will wait before
+// bootstrapping again after a bootstrap fails. This doubles
+// for each failure in a row, up to the bootstrap interval.
+const bootstrapRetryInterval = time.Second
+
+// snekSummaryMaxKeys is the most keys that we will send
+// to or accept from a new peer in a SNEK summary.
+const snekSummaryMaxKeys = 512
+
+// reachabilityInterval is how often we will send each of
+// our peers a filter of the keys that it can reach through us.
+const reachabilityInterval = time.Second * 10
+
+// reachabilityExpiryPeriod is how long we will use a peer's
+// reachability filter for before it must be refreshed.
+const reachabilityExpiryPeriod = reachabilityInterval * 3
+
+// custodyMaxBundles is the default for the most bundles
+// that we will hold at once in delay-tolerant mode.
+const custodyMaxBundles = 256
+
+// custodyMaxTTL is the default for the longest that we will
+// hold a bundle in delay-tolerant mode.
+const custodyMaxTTL = time.Hour * 24
+
+// custodyRetryInterval is how often we will try to send the
+// bundles that we hold on towards their destinations.
+const custodyRetryInterval = time.Second * 10
+
 // coordsCacheLifetime is how long we'll keep entries in
 // the coords cache for switching to tree routing.
 const coordsCacheLifetime = time.Minute
@@ -74,3 +272,41 @@ const broadcastExpiryPeriod = wakeupBroadcastInterval * 3
 // This helps to prevent broadcasts from flooding the
 // network.
 const broadcastFilterTime = wakeupBroadcastInterval / 2
+
+// trafficPriorityWeight is how many traffic frames from the
+// preferred origin are sent in a row while traffic from the
+// other origin is waiting, unless a weight is given with
+// RouterOptionTrafficPriority.
+const trafficPriorityWeight = 4
+
+// amplificationDefaultFactor is how many bytes we will
+// send in reply to a source key that we can't verify for
+// each byte that we received from it, unless a factor is
+// given with RouterOptionAmplificationLimit.
+const amplificationDefaultFactor = 3
+
+// amplificationDefaultWindow is how long the bytes sent to
+// and received from each source key are counted for, unless
+// a window is given with RouterOptionAmplificationLimit.
+const amplificationDefaultWindow = time.Minute
+
+// amplificationMaxSources is how many source keys we will
+// count bytes for at once. Replies to new source keys are
+// dropped while there are this many.
+const amplificationMaxSources = 4096
+
+// timeSyncInterval is how often we ask each peer for its
+// time, unless an interval is given with RouterOptionTimeSync.
+const timeSyncInterval = time.Minute
+
+// timeSyncSamples is how many time sync samples we keep for
+// each peer. Samples are used for this many intervals.
+const timeSyncSamples = 8
+
+// timeSyncMinReplyInterval is the most often that we will
+// answer a time sync request on the same peering.
+const timeSyncMinReplyInterval = time.Second
+
+// drainPollInterval is how often Drain checks whether
+// the paths that pass through us have gone elsewhere.
+const drainPollInterval = time.Millisecond * 250
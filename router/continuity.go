@@ -0,0 +1,243 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/router/events"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+// A node that rotates its identity starts again with a new key, and then
+// publishes a continuity record, signed by both keys, which links the old
+// key to the new one. The record is sent towards the old key using SNEK
+// routing, so it is stored by the node that is now closest to the old key in
+// keyspace, as well as being cached by every node along the way. Lookups and
+// traffic for the old key will arrive at that same node, so it can answer
+// lookups with the record instead. The record can also be sent directly to
+// the nodes that we had sessions with. Records are repeated regularly and
+// are forgotten by other nodes if they stop arriving. Keys that are higher
+// than the root key have no closest node, so those records only help nodes
+// that they have been sent to directly, but the root is normally the highest
+// key in the network so this is rare.
+
+const continuityPublishInterval = time.Minute * 5
+const continuityExpiryPeriod = continuityPublishInterval * 3
+const continuityMaxRecords = 1024
+const continuityMaxChain = 8
+
+type continuityTable map[types.PublicKey]*continuityEntry
+
+type continuityEntry struct {
+	record   types.ContinuityRecord
+	lastSeen time.Time
+}
+
+// PublishContinuity starts publishing a record that links an old identity to
+// the identity of this node, so that nodes trying to reach the old key will
+// learn about the new one. The record can be created with
+// types.NewContinuityRecord using both private keys.
+func (r *Router) PublishContinuity(record types.ContinuityRecord) error {
+	if record.New != r.public {
+		return fmt.Errorf("continuity record is not for this node")
+	}
+	if err := record.Verify(); err != nil {
+		// Anyone can send us a forged record, so ignore it rather than
+		// blaming the peer that passed it on.
+		return nil
+	}
+	phony.Block(r.state, func() {
+		r.state._predecessors[record.Old] = &continuityEntry{
+			record:   record,
+			lastSeen: r.clock.Now(),
+		}
+		r.state._sendContinuity(record, record.Old, nil)
+	})
+	return nil
+}
+
+// NotifyContinuity sends the continuity records that we publish directly to
+// the given node, e.g. to a node that we had a session with using our old
+// identity, so that it doesn't have to find out by looking us up.
+func (r *Router) NotifyContinuity(public types.PublicKey) {
+	phony.Block(r.state, func() {
+		var coords types.Coordinates
+		if cached, ok := r.state._coordsCache[public]; ok && since(r.clock, cached.lastSeen) < coordsCacheLifetime {
+			coords = cached.coordinates
+		}
+		for _, entry := range r.state._predecessors {
+			r.state._sendContinuity(entry.record, public, coords)
+		}
+	})
+}
+
+// Successor returns the key that the given key has most recently been
+// replaced by, following any further rotations, if we know about one.
+func (r *Router) Successor(public types.PublicKey) (types.PublicKey, bool) {
+	var successor types.PublicKey
+	var ok bool
+	phony.Block(r.state, func() {
+		successor, ok = r.state._successor(public)
+	})
+	return successor, ok
+}
+
+// _successor returns the newest key that the given key has been replaced
+// by. The number of rotations followed is limited in case of a cycle.
+func (s *state) _successor(public types.PublicKey) (types.PublicKey, bool) {
+	found := false
+	for i := 0; i < continuityMaxChain; i++ {
+		entry, ok := s._continuity[public]
+		if !ok || since(s.r.clock, entry.lastSeen) >= continuityExpiryPeriod {
+			break
+		}
+		public, found = entry.record.New, true
+	}
+	return public, found
+}
+
+// _maintainContinuity expires old continuity records and repeats our own.
+func (s *state) _maintainContinuity() {
+	if s._suspended {
+		// Resume will restart maintenance.
+		return
+	}
+	select {
+	case <-s.r.context.Done():
+		return
+	default:
+		defer s._continuityTimer.Reset(continuityPublishInterval)
+	}
+
+	for k, v := range s._continuity {
+		if since(s.r.clock, v.lastSeen) >= continuityExpiryPeriod {
+			delete(s._continuity, k)
+		}
+	}
+	for _, entry := range s._predecessors {
+		s._sendContinuity(entry.record, entry.record.Old, nil)
+	}
+}
+
+// _sendContinuity sends a continuity record to the given key. If no
+// coordinates are given then the record will be routed using SNEK.
+func (s *state) _sendContinuity(record types.ContinuityRecord, to types.PublicKey, coords types.Coordinates) {
+	if f := s._continuityFrame(record, to, coords); f != nil {
+		_ = s._forward(s.r.local, f)
+	}
+}
+
+// _continuityFrame returns a frame carrying the continuity record to the
+// given node, or nil if the record couldn't be marshalled.
+func (s *state) _continuityFrame(record types.ContinuityRecord, to types.PublicKey, coords types.Coordinates) *types.Frame {
+	f := getFrame()
+	n, err := record.MarshalBinary(f.Payload[:cap(f.Payload)])
+	if err != nil {
+		framePool.Put(f)
+		s.r.log.Println("Failed creating continuity record:", err)
+		return nil
+	}
+	f.Type = types.TypeContinuity
+	f.HopLimit = types.MaxHopLimit
+	f.Destination = append(f.Destination[:0], coords...)
+	f.DestinationKey = to
+	f.Source = s._coords()
+	f.SourceKey = s.r.public
+	f.Watermark = types.VirtualSnakeWatermark{
+		PublicKey: types.FullMask,
+		Sequence:  0,
+	}
+	f.Payload = f.Payload[:n]
+	return f
+}
+
+// _handleContinuity stores a continuity record that is passing through us.
+// Any lookups that are waiting for the old key are sent on to the new key.
+func (s *state) _handleContinuity(f *types.Frame) error {
+	var record types.ContinuityRecord
+	if _, err := types.Decode(&record, f.Payload); err != nil {
+		return fmt.Errorf("record.UnmarshalBinary: %w", err)
+	}
+	s.r.energy.verifies.Add(2) // Signed by both the old and the new key
+	if err := record.Verify(); err != nil {
+		// Anyone can send us a forged record, so ignore it rather than
+		// blaming the peer that passed it on.
+		return nil
+	}
+	if record.Old == s.r.public {
+		return nil
+	}
+	existing, ok := s._continuity[record.Old]
+	switch {
+	case ok && record.Issued < existing.record.Issued:
+		// This record has been superseded by a later rotation.
+		return nil
+	case ok && record.Issued == existing.record.Issued:
+		existing.lastSeen = s.r.clock.Now()
+	case !ok && len(s._continuity) >= continuityMaxRecords:
+		return nil
+	default:
+		s._continuity[record.Old] = &continuityEntry{
+			record:   record,
+			lastSeen: s.r.clock.Now(),
+		}
+		if !ok || existing.record.New != record.New {
+			s.r.Act(nil, func() {
+				s.r._publish(events.IdentityMoved{
+					OldPeerID: record.Old.String(),
+					NewPeerID: record.New.String(),
+				})
+			})
+		}
+	}
+
+	for id, pending := range s._echoes {
+		if pending.public != record.Old {
+			continue
+		}
+		delete(s._echoes, id)
+		successor, _ := s._successor(record.Old)
+		if f, err := s._newEchoRequestWithID(id, successor, pending.notify); err == nil {
+			s._echoes[id].sent = pending.sent
+			s._echoes[id].successor = successor
+			_ = s._forward(s.r.local, f)
+		}
+	}
+	return nil
+}
+
+// _answerFromContinuity replies to an echo request for a key that we have a
+// continuity record for, by sending the record back to the requester. It
+// returns true if it did.
+func (s *state) _answerFromContinuity(f *types.Frame) bool {
+	entry, ok := s._continuity[f.DestinationKey]
+	if !ok || since(s.r.clock, entry.lastSeen) >= continuityExpiryPeriod {
+		return false
+	}
+	if reply := s._continuityFrame(entry.record, f.SourceKey, f.Source); reply != nil {
+		if s._replyAllowed(f, reply) {
+			_ = s._forward(s.r.local, reply)
+		} else {
+			framePool.Put(reply)
+		}
+	}
+	return true
+}
@@ -0,0 +1,96 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !minimal
+// +build !minimal
+
+package router
+
+import (
+	"context"
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+	"github.com/matrix-org/pinecone/util"
+)
+
+func TestContinuity(t *testing.T) {
+	low, high := newTestRouterPair(t)
+
+	deadline := time.Now().Add(time.Second * 10)
+	for len(low.Coords()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("tree didn't converge")
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+
+	// Keys above the root have no closest node to store the record at, so
+	// pick an old key that is below the root.
+	var old types.PrivateKey
+	for {
+		_, sk, _ := ed25519.GenerateKey(nil)
+		copy(old[:], sk)
+		if util.LessThan(old.Public(), high.PublicKey()) {
+			break
+		}
+	}
+	record := types.NewContinuityRecord(old, high.PrivateKey(), time.Now())
+	if err := low.PublishContinuity(record); err == nil {
+		t.Fatalf("expected record for another node to be rejected")
+	}
+	if err := high.PublishContinuity(record); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	result, err := low.Lookup(ctx, old.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Reachable || result.Successor != high.PublicKey() {
+		t.Fatalf("expected lookup to follow the rotation to %s, got %s", high.PublicKey(), result.Successor)
+	}
+	if successor, ok := low.Successor(old.Public()); !ok || successor != high.PublicKey() {
+		t.Fatalf("expected successor %s, got %s", high.PublicKey(), successor)
+	}
+}
+
+func TestContinuityForgedRecord(t *testing.T) {
+	s := newTestState(types.PublicKey{1}, NewManualClock(time.Unix(1000, 0)))
+	s._continuity = continuityTable{}
+	_, oldKey, _ := ed25519.GenerateKey(nil)
+	_, newKey, _ := ed25519.GenerateKey(nil)
+	var from, to types.PrivateKey
+	copy(from[:], oldKey)
+	copy(to[:], newKey)
+	record := types.NewContinuityRecord(from, to, time.Unix(1000, 0))
+	record.NewSignature[0] ^= 0xff
+
+	// A forged record is ignored without an error, since an error would
+	// stop the peering that passed the frame on to us.
+	f := s._continuityFrame(record, types.PublicKey{2}, nil)
+	if f == nil {
+		t.Fatalf("expected a frame for the record")
+	}
+	if err := s._handleContinuity(f); err != nil {
+		t.Fatalf("expected a forged record to be ignored, got %v", err)
+	}
+	if len(s._continuity) != 0 {
+		t.Fatalf("expected the forged record not to be stored")
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+// When our parent or root changes, our place in the SNEK has to be found
+// again, so we measure how long it takes until we have a stable pair of
+// ascending and descending nodes. The measurement starts at the change and
+// ends at the last change to either neighbour, once neither has changed
+// for a whole bootstrap interval and, unless we are the root, one of our
+// bootstraps has been confirmed since the change. Further changes while we
+// are converging are counted as part of the same measurement. The times
+// are kept in a histogram, which is the best single measure of how healthy
+// the network is from where we are.
+
+// convergenceBuckets are the upper bounds of the convergence histogram.
+var convergenceBuckets = [...]time.Duration{
+	time.Millisecond * 100,
+	time.Millisecond * 250,
+	time.Millisecond * 500,
+	time.Second,
+	time.Second * 2,
+	time.Second * 5,
+	time.Second * 10,
+	time.Second * 30,
+	time.Minute,
+	time.Minute * 5,
+}
+
+// HistogramBucket is one bucket of a histogram. Buckets are cumulative,
+// so each one counts all of the samples up to its upper bound. The last
+// bucket has no upper bound, which is shown as zero.
+type HistogramBucket struct {
+	UpperBound time.Duration `json:"upper_bound"`
+	Count      uint64        `json:"count"`
+}
+
+// ConvergenceStats describes how long it has taken for us to find a stable
+// pair of SNEK neighbours after our parent or root changed.
+type ConvergenceStats struct {
+	Converging bool              `json:"converging"` // Is a measurement in progress?
+	Count      uint64            `json:"count"`      // Measurements so far
+	Sum        time.Duration     `json:"sum"`        // Total of all measurements
+	Last       time.Duration     `json:"last"`       // The most recent measurement
+	Buckets    []HistogramBucket `json:"buckets"`
+}
+
+type convergenceTracker struct {
+	since      time.Time // When the current measurement started, zero if converged
+	lastChange time.Time // When either neighbour last changed
+	ascending  types.PublicKey
+	count      uint64
+	sum        time.Duration
+	last       time.Duration
+	buckets    [len(convergenceBuckets) + 1]uint64
+}
+
+func (t *convergenceTracker) observe(d time.Duration) {
+	t.count++
+	t.sum += d
+	t.last = d
+	for i, bound := range convergenceBuckets {
+		if d <= bound {
+			t.buckets[i]++
+			return
+		}
+	}
+	t.buckets[len(convergenceBuckets)]++
+}
+
+func (t *convergenceTracker) stats() ConvergenceStats {
+	stats := ConvergenceStats{
+		Converging: !t.since.IsZero(),
+		Count:      t.count,
+		Sum:        t.sum,
+		Last:       t.last,
+		Buckets:    make([]HistogramBucket, 0, len(t.buckets)),
+	}
+	var cumulative uint64
+	for i, count := range t.buckets {
+		cumulative += count
+		bucket := HistogramBucket{Count: cumulative}
+		if i < len(convergenceBuckets) {
+			bucket.UpperBound = convergenceBuckets[i]
+		}
+		stats.Buckets = append(stats.Buckets, bucket)
+	}
+	return stats
+}
+
+// _convergenceStarted is called when our parent or root changes.
+func (s *state) _convergenceStarted() {
+	t := &s._convergence
+	now := s.r.clock.Now()
+	if t.since.IsZero() {
+		t.since = now
+	}
+	t.lastChange = now
+}
+
+// _neighbourChanged is called when our ascending or descending node
+// changes.
+func (s *state) _neighbourChanged() {
+	if !s._convergence.since.IsZero() {
+		s._convergence.lastChange = s.r.clock.Now()
+	}
+}
+
+// _ascendingConfirmed is called when one of our bootstraps is confirmed by
+// the given node, which is our ascending node.
+func (s *state) _ascendingConfirmed(key types.PublicKey) {
+	if key != s._convergence.ascending {
+		s._convergence.ascending = key
+		s._observeAscendingChange()
+		s._neighbourChanged()
+	}
+}
+
+// _checkConvergence finishes the current measurement if our neighbours have
+// been stable for long enough. It is called during SNEK maintenance.
+func (s *state) _checkConvergence() {
+	t := &s._convergence
+	if t.since.IsZero() || since(s.r.clock, t.lastChange) < s.r.timings.BootstrapInterval {
+		return
+	}
+	end := t.lastChange
+	if s._parent != nil && s._bootstrapConfirm != nil {
+		// Older nodes don't confirm bootstraps, so we only wait for a
+		// confirmation if we've had one before.
+		if s._bootstrapConfirm.At.Before(t.since) {
+			return
+		}
+		if s._bootstrapConfirm.At.After(end) {
+			end = s._bootstrapConfirm.At
+		}
+	}
+	d := end.Sub(t.since)
+	t.observe(d)
+	t.since = time.Time{}
+	s._recordEvent(ProtocolConverged, types.PublicKey{}, nil, fmt.Sprintf("took %s", d))
+}
+
+// ConvergenceStats returns a histogram of how long it has taken for us to
+// find a stable pair of SNEK neighbours after our parent or root changed.
+func (r *Router) ConvergenceStats() ConvergenceStats {
+	var stats ConvergenceStats
+	phony.Block(r.state, func() {
+		stats = r.state._convergence.stats()
+	})
+	return stats
+}
@@ -0,0 +1,82 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"crypto/ed25519"
+	"testing"
+	"time"
+)
+
+func TestConvergenceHistogram(t *testing.T) {
+	var tracker convergenceTracker
+	for _, d := range []time.Duration{time.Millisecond * 50, time.Second, time.Second, time.Hour} {
+		tracker.observe(d)
+	}
+	stats := tracker.stats()
+	if stats.Count != 4 || stats.Last != time.Hour || stats.Sum != time.Hour+time.Second*2+time.Millisecond*50 {
+		t.Fatalf("unexpected totals: %+v", stats)
+	}
+	if len(stats.Buckets) != len(convergenceBuckets)+1 {
+		t.Fatalf("expected %d buckets, got %d", len(convergenceBuckets)+1, len(stats.Buckets))
+	}
+	for _, bucket := range stats.Buckets {
+		var expected uint64
+		switch {
+		case bucket.UpperBound == 0:
+			expected = 4
+		case bucket.UpperBound >= time.Second:
+			expected = 3
+		case bucket.UpperBound >= time.Millisecond*50:
+			expected = 1
+		}
+		if bucket.Count != expected {
+			t.Fatalf("expected %d samples up to %s, got %d", expected, bucket.UpperBound, bucket.Count)
+		}
+	}
+}
+
+func TestConvergenceMeasured(t *testing.T) {
+	timings := RouterOptionTimings{
+		SNEKMaintainInterval: time.Millisecond * 100,
+		BootstrapInterval:    time.Second,
+	}
+	var routers [2]*Router
+	for i := range routers {
+		_, sk, _ := ed25519.GenerateKey(nil)
+		routers[i] = NewRouter(nil, sk, timings)
+		r := routers[i]
+		t.Cleanup(func() { _ = r.Close() })
+	}
+	if errA, errB := connectTestRouters(t, routers[0], routers[1]); errA != nil || errB != nil {
+		t.Fatalf("failed to peer routers: %v, %v", errA, errB)
+	}
+
+	// One of the routers takes the other as its parent, so it should take
+	// a measurement once its neighbours are stable.
+	deadline := time.Now().Add(time.Second * 10)
+	for routers[0].ConvergenceStats().Count+routers[1].ConvergenceStats().Count == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected a convergence time to be measured")
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	for _, r := range routers {
+		stats := r.ConvergenceStats()
+		if stats.Count > 0 && (stats.Converging || stats.Last > time.Second*5) {
+			t.Fatalf("unexpected convergence stats: %+v", stats)
+		}
+	}
+}
@@ -0,0 +1,331 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+// In delay-tolerant mode, traffic can be sent as custody bundles, which
+// aren't dropped just because the destination can't be reached right now.
+// A bundle is routed with SNEK like any other traffic, but when it reaches
+// a node with nowhere better to send it, that node takes custody of it,
+// if it is also in delay-tolerant mode and has room, and sends a signed
+// receipt to the previous custodian so that it can stop holding it. The
+// source is the first custodian. Custodians retry their bundles whenever
+// the network changes so that the bundles might make progress, until they
+// are delivered, handed over or expire. The destination also sends a
+// receipt once the bundle has arrived, and drops any duplicates. This suits
+// sparse mobile meshes, where a path to the destination might never exist
+// end-to-end at one time.
+
+// custodyConfig holds the settings for delay-tolerant mode.
+type custodyConfig struct {
+	maxBundles int
+	maxTTL     time.Duration
+}
+
+type custodyKey struct {
+	source   types.PublicKey
+	sequence types.Varu64
+}
+
+// custodyBundle is a bundle that we are holding as its custodian.
+type custodyBundle struct {
+	destination types.PublicKey
+	expiry      time.Time
+	payload     []byte
+	tried       time.Time
+}
+
+type custodyStore struct {
+	held      map[custodyKey]*custodyBundle
+	delivered map[custodyKey]time.Time // Bundles delivered to us, until they expire
+	sequence  types.Varu64             // Used to identify our bundles
+	lastRetry time.Time
+	status    CustodyStatus
+}
+
+func newCustodyStore(now time.Time) *custodyStore {
+	return &custodyStore{
+		held:      map[custodyKey]*custodyBundle{},
+		delivered: map[custodyKey]time.Time{},
+		// Starting from the time means that we are unlikely to reuse a
+		// sequence number from before a restart.
+		sequence: types.Varu64(now.UnixNano()),
+	}
+}
+
+// CustodyStatus describes the bundles that the router has held.
+type CustodyStatus struct {
+	Held        int    // Bundles that we are holding now
+	Accepted    uint64 // Bundles that we took custody of from other nodes
+	Transferred uint64 // Bundles that other nodes took custody of from us
+	Delivered   uint64 // Bundles that reached their destination from us
+	Expired     uint64 // Bundles that expired while we were holding them
+	Refused     uint64 // Bundles that we couldn't take custody of
+}
+
+// WriteToWithCustody sends a packet to the node with the given public key
+// as a custody bundle, which is held by us and by custodians along the way
+// until it can be delivered, for up to the given time to live. The router
+// must be in delay-tolerant mode. The bundle is delivered at most once,
+// and arrives at the destination through ReadFrom like any other packet.
+func (r *Router) WriteToWithCustody(p []byte, key types.PublicKey, ttl time.Duration) (int, error) {
+	if r.custody == nil {
+		return 0, ErrCustodyUnavailable
+	}
+	if max := types.MaxPayloadSize - types.CustodyBundleOverhead; len(p) > max {
+		return 0, fmt.Errorf("payload length %d exceeds maximum %d", len(p), max)
+	}
+	var err error
+	phony.Block(r.state, func() {
+		err = r.state._newBundle(key, p, ttl)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Custody returns the status of the bundles that the router has held.
+func (r *Router) Custody() CustodyStatus {
+	var status CustodyStatus
+	phony.Block(r.state, func() {
+		status = r.state._custody.status
+		status.Held = len(r.state._custody.held)
+	})
+	return status
+}
+
+// _newBundle takes custody of a new bundle from us and sends it.
+func (s *state) _newBundle(destination types.PublicKey, payload []byte, ttl time.Duration) error {
+	store := s._custody
+	if len(store.held) >= s.r.custody.maxBundles {
+		return fmt.Errorf("%w: holding %d bundles", ErrCustodyUnavailable, len(store.held))
+	}
+	if ttl <= 0 || ttl > s.r.custody.maxTTL {
+		ttl = s.r.custody.maxTTL
+	}
+	store.sequence++
+	key := custodyKey{s.r.public, store.sequence}
+	store.held[key] = &custodyBundle{
+		destination: destination,
+		expiry:      s.r.clock.Now().Add(ttl),
+		payload:     append([]byte{}, payload...),
+	}
+	s._sendBundle(key, store.held[key])
+	return nil
+}
+
+// _sendBundle sends a copy of a bundle that we hold towards its destination.
+func (s *state) _sendBundle(key custodyKey, b *custodyBundle) {
+	bundle := types.CustodyBundle{
+		Sequence:  key.sequence,
+		Expiry:    types.Varu64(b.expiry.Unix()),
+		Custodian: s.r.public,
+		Payload:   b.payload,
+	}
+	frame := getFrame()
+	frame.Type = types.TypeCustody
+	frame.DestinationKey = b.destination
+	frame.SourceKey = key.source
+	frame.Watermark = types.VirtualSnakeWatermark{
+		PublicKey: types.FullMask,
+		Sequence:  0,
+	}
+	n, err := bundle.MarshalBinary(frame.Payload[:cap(frame.Payload)])
+	if err != nil {
+		framePool.Put(frame)
+		return
+	}
+	frame.Payload = frame.Payload[:n]
+	b.tried = s.r.clock.Now()
+	_ = s._forward(s.r.local, frame)
+}
+
+// _takeCustody is called when a bundle has nowhere better to go than us.
+func (s *state) _takeCustody(rx *types.Frame) error {
+	var bundle types.CustodyBundle
+	if _, err := types.Decode(&bundle, rx.Payload); err != nil {
+		return fmt.Errorf("bundle.UnmarshalBinary: %w", err)
+	}
+	if bundle.Custodian == s.r.public {
+		// We already hold this bundle.
+		return nil
+	}
+	store, now := s._custody, s.r.clock.Now()
+	expiry := time.Unix(int64(bundle.Expiry), 0)
+	key := custodyKey{rx.SourceKey, bundle.Sequence}
+	switch {
+	case !expiry.After(now):
+		return nil
+	case store.held[key] != nil:
+		// We already took custody, but the receipt might have been lost.
+	case s.r.custody == nil || len(store.held) >= s.r.custody.maxBundles:
+		store.status.Refused++
+		return nil
+	default:
+		if limit := now.Add(s.r.custody.maxTTL); expiry.After(limit) {
+			expiry = limit
+		}
+		store.held[key] = &custodyBundle{
+			destination: rx.DestinationKey,
+			expiry:      expiry,
+			payload:     append([]byte{}, bundle.Payload...),
+			tried:       now,
+		}
+		store.status.Accepted++
+	}
+	s._sendCustodyReceipt(bundle.Custodian, key, false)
+	return nil
+}
+
+// _handleBundle is called when a bundle addressed to us arrives.
+func (s *state) _handleBundle(rx *types.Frame) error {
+	var bundle types.CustodyBundle
+	if _, err := types.Decode(&bundle, rx.Payload); err != nil {
+		return fmt.Errorf("bundle.UnmarshalBinary: %w", err)
+	}
+	key := custodyKey{rx.SourceKey, bundle.Sequence}
+	s._sendCustodyReceipt(bundle.Custodian, key, true)
+	if _, ok := s._custody.delivered[key]; ok {
+		return nil
+	}
+	s._custody.delivered[key] = time.Unix(int64(bundle.Expiry), 0)
+	frame := getFrame()
+	frame.Type = types.TypeTraffic
+	frame.SetTrafficClass(types.TrafficClassBackground)
+	frame.DestinationKey = s.r.public
+	frame.SourceKey = rx.SourceKey
+	frame.Payload = append(frame.Payload[:0], bundle.Payload...)
+	if !s.r.local.send(frame) {
+		framePool.Put(frame)
+	}
+	return nil
+}
+
+// _sendCustodyReceipt tells the custodian of a bundle that we have taken
+// custody of it, or that it was delivered to us.
+func (s *state) _sendCustodyReceipt(custodian types.PublicKey, key custodyKey, delivered bool) {
+	if custodian == s.r.public {
+		s._custodyReleased(key, delivered)
+		return
+	}
+	receipt := types.CustodyReceipt{
+		Source:    key.source,
+		Sequence:  key.sequence,
+		Delivered: delivered,
+	}
+	if s.r.secure {
+		protected, err := receipt.ProtectedPayload(custodian)
+		if err != nil {
+			return
+		}
+		copy(receipt.Signature[:], s.r.sign(protected))
+	}
+	frame := getFrame()
+	frame.Type = types.TypeCustodyReceipt
+	frame.DestinationKey = custodian
+	frame.SourceKey = s.r.public
+	frame.Watermark = types.VirtualSnakeWatermark{
+		PublicKey: types.FullMask,
+		Sequence:  0,
+	}
+	n, err := receipt.MarshalBinary(frame.Payload[:cap(frame.Payload)])
+	if err != nil {
+		framePool.Put(frame)
+		return
+	}
+	frame.Payload = frame.Payload[:n]
+	_ = s._forward(s.r.local, frame)
+}
+
+// _handleCustodyReceipt is called when a receipt for one of the bundles
+// that we hold arrives.
+func (s *state) _handleCustodyReceipt(rx *types.Frame) error {
+	var receipt types.CustodyReceipt
+	if _, err := types.Decode(&receipt, rx.Payload); err != nil {
+		return fmt.Errorf("receipt.UnmarshalBinary: %w", err)
+	}
+	if s.r.secure {
+		protected, err := receipt.ProtectedPayload(s.r.public)
+		if err != nil {
+			return fmt.Errorf("receipt.ProtectedPayload: %w", err)
+		}
+		if !s.r.verify(rx.SourceKey[:], protected, receipt.Signature[:]) {
+			return nil
+		}
+	}
+	s._custodyReleased(custodyKey{receipt.Source, receipt.Sequence}, receipt.Delivered)
+	return nil
+}
+
+// _custodyReleased stops holding a bundle once another node has taken
+// custody of it or it has been delivered.
+func (s *state) _custodyReleased(key custodyKey, delivered bool) {
+	store := s._custody
+	if _, ok := store.held[key]; !ok {
+		return
+	}
+	delete(store.held, key)
+	if delivered {
+		store.status.Delivered++
+	} else {
+		store.status.Transferred++
+	}
+}
+
+// _maintainCustody expires old bundles and retries the bundles that we
+// hold, if it is time to do so.
+func (s *state) _maintainCustody() {
+	store, now := s._custody, s.r.clock.Now()
+	if len(store.held) == 0 && len(store.delivered) == 0 {
+		return
+	}
+	if now.Sub(store.lastRetry) < custodyRetryInterval {
+		return
+	}
+	store.lastRetry = now
+	for key, expiry := range store.delivered {
+		if !expiry.After(now) {
+			delete(store.delivered, key)
+		}
+	}
+	watermark := types.VirtualSnakeWatermark{PublicKey: types.FullMask}
+	for key, b := range store.held {
+		if !b.expiry.After(now) {
+			delete(store.held, key)
+			store.status.Expired++
+			continue
+		}
+		if nexthop, _ := s._nextHopsSNEK(b.destination, types.TypeCustody, watermark); nexthop != nil && nexthop != s.r.local {
+			s._sendBundle(key, b)
+		}
+	}
+}
+
+// _retryCustodySoon makes us retry the bundles that we hold at the next
+// maintenance interval, e.g. because a new peering came up.
+func (s *state) _retryCustodySoon() {
+	s._custody.lastRetry = time.Time{}
+}
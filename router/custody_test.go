@@ -0,0 +1,83 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCustodyUnavailable(t *testing.T) {
+	_, sk, _ := ed25519.GenerateKey(nil)
+	r := NewRouter(nil, sk)
+	defer r.Close()
+	if _, err := r.WriteToWithCustody([]byte("HELLO!"), r.PublicKey(), time.Minute); !errors.Is(err, ErrCustodyUnavailable) {
+		t.Fatalf("expected ErrCustodyUnavailable, got %v", err)
+	}
+}
+
+func TestCustodyDelivery(t *testing.T) {
+	newRouter := func() *Router {
+		_, sk, _ := ed25519.GenerateKey(nil)
+		r := NewRouter(nil, sk, RouterOptionDelayTolerant{})
+		t.Cleanup(func() { _ = r.Close() })
+		return r
+	}
+	a, b, c := newRouter(), newRouter(), newRouter()
+	if errA, errB := connectTestRouters(t, a, b); errA != nil || errB != nil {
+		t.Fatalf("failed to peer: %v, %v", errA, errB)
+	}
+	held := func() int {
+		return a.Custody().Held + b.Custody().Held
+	}
+	waitFor := func(what string, cond func() bool) {
+		deadline := time.Now().Add(time.Second * 20)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+			time.Sleep(time.Millisecond * 100)
+		}
+	}
+
+	// The destination isn't reachable yet, so either a or b must hold on
+	// to the bundle rather than dropping it.
+	sent := []byte("HELLO!")
+	if _, err := a.WriteToWithCustody(sent, c.PublicKey(), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("a custodian", func() bool { return held() == 1 })
+
+	// Once the destination turns up, the bundle should be delivered and
+	// released by its custodian.
+	if errB, errC := connectTestRouters(t, b, c); errB != nil || errC != nil {
+		t.Fatalf("failed to peer: %v, %v", errB, errC)
+	}
+	_ = c.SetReadDeadline(time.Now().Add(time.Second * 30))
+	received := make([]byte, 64)
+	n, addr, err := c.ReadFrom(received)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr != a.PublicKey() || !bytes.Equal(received[:n], sent) {
+		t.Fatalf("unexpected bundle from %v: %q", addr, received[:n])
+	}
+	waitFor("the bundle to be released", func() bool {
+		return held() == 0 && a.Custody().Delivered+b.Custody().Delivered == 1
+	})
+}
@@ -0,0 +1,95 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"fmt"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+// When the root flaps, or the tree is otherwise unstable, a peer can send
+// us a burst of tree announcements, each of which we would check, store
+// and probably pass on to all of our own peers, only for the next one to
+// replace it a moment later. With RouterOptionAnnouncementDamping, we
+// handle at most one announcement from each peer per damping interval. An
+// announcement that arrives after a quiet interval is handled straight away,
+// but one that arrives sooner is held until the interval is up, and if more
+// arrive in the meantime then only the latest is kept. The ones that are
+// replaced are counted as suppressed. Since an announcement replaces the
+// last one from the same peer anyway, handling only the latest one leaves
+// us in the same place, just with less work on the way.
+
+// _dampAnnouncement returns true if the tree announcement from the peer
+// should be held back rather than handled now, in which case the frame now
+// belongs to the damping and must not be reused by the caller.
+func (s *state) _dampAnnouncement(p *peer, f *types.Frame) bool {
+	damping := s.r.annDamping
+	if damping <= 0 || p == s.r.local {
+		return false
+	}
+	if p._annPending != nil {
+		// There is already an announcement waiting, so this one replaces
+		// it and will be handled when the interval is up instead.
+		framePool.Put(p._annPending)
+		p._annPending = f
+		p._annSuppressed++
+		s._observeSuppressedAnnouncement()
+		return true
+	}
+	now := s.r.clock.Now()
+	since := now.Sub(p._annHandled)
+	if since >= damping {
+		p._annHandled = now
+		return false
+	}
+	p._annPending = f
+	s.r.clock.AfterFunc(damping-since, func() {
+		s.Act(nil, func() {
+			s._flushAnnouncement(p)
+		})
+	})
+	return true
+}
+
+// _flushAnnouncement handles the announcement that was held back for the
+// peer, if there is one.
+func (s *state) _flushAnnouncement(p *peer) {
+	f := p._annPending
+	if f == nil {
+		return
+	}
+	defer framePool.Put(f)
+	p._annPending = nil
+	p._annHandled = s.r.clock.Now()
+	if !p.started.Load() || s._peers[p.port] != p {
+		return
+	}
+	if err := s._handleTreeAnnouncement(p, f); err != nil {
+		p.stop(fmt.Errorf("s._handleTreeAnnouncement (port %d): %w", p.port, err))
+	}
+}
+
+// _dropPendingAnnouncement forgets the announcement that was held back for
+// the peer, if there is one.
+func (s *state) _dropPendingAnnouncement(p *peer) {
+	if p._annPending != nil {
+		framePool.Put(p._annPending)
+		p._annPending = nil
+	}
+}
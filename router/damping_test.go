@@ -0,0 +1,133 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+	"github.com/matrix-org/pinecone/util"
+)
+
+func TestAnnouncementDamping(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	s := newTestState(types.PublicKey{}, clock)
+	s.r.annDamping = time.Second
+	p := addTestPeer(s, types.PublicKey{1})
+
+	announcement := func() *types.Frame {
+		f := getFrame()
+		f.Type = types.TypeTreeAnnouncement
+		return f
+	}
+	if s._dampAnnouncement(p, announcement()) {
+		t.Fatalf("expected the first announcement to be handled straight away")
+	}
+	first, last := announcement(), announcement()
+	if !s._dampAnnouncement(p, first) || !s._dampAnnouncement(p, announcement()) || !s._dampAnnouncement(p, last) {
+		t.Fatalf("expected the burst to be held back")
+	}
+	if p._annPending != last || p._annSuppressed != 2 {
+		t.Fatalf("expected only the latest announcement to be kept, suppressed %d", p._annSuppressed)
+	}
+	if stats := s._treeStats.stats(clock.Now(), 0); stats.Suppressed != 2 {
+		t.Fatalf("expected two suppressed announcements, got %+v", stats)
+	}
+
+	// The peer has gone by the time the interval is up, so the announcement
+	// is dropped rather than handled.
+	s._peers[1] = nil
+	clock.Advance(time.Second)
+	phony.Block(s, func() {})
+	if p._annPending != nil || !p._annHandled.Equal(clock.Now()) {
+		t.Fatalf("expected the held announcement to have been flushed")
+	}
+	if !s._dampAnnouncement(p, announcement()) {
+		t.Fatalf("expected an announcement straight after the flush to be held back")
+	}
+	s._dropPendingAnnouncement(p)
+	clock.Advance(time.Second)
+	if s._dampAnnouncement(p, announcement()) {
+		t.Fatalf("expected an announcement after a quiet interval to be handled straight away")
+	}
+}
+
+func TestAnnouncementDampingKeepsLatest(t *testing.T) {
+	_, sk1, _ := ed25519.GenerateKey(nil)
+	_, sk2, _ := ed25519.GenerateKey(nil)
+	damping := RouterOptionAnnouncementDamping(time.Millisecond * 500)
+	a, b := NewRouter(nil, sk1, damping), NewRouter(nil, sk2, damping)
+	t.Cleanup(func() {
+		_ = a.Close()
+		_ = b.Close()
+	})
+	low, high := a, b
+	if util.LessThan(high.PublicKey(), low.PublicKey()) {
+		low, high = high, low
+	}
+	if errA, errB := connectTestRouters(t, a, b); errA != nil || errB != nil {
+		t.Fatalf("failed to peer: %v, %v", errA, errB)
+	}
+
+	rootSequence := func() (seq types.Varu64, root types.PublicKey) {
+		phony.Block(low.state, func() {
+			ann := low.state._rootAnnouncement()
+			seq, root = ann.RootSequence, ann.RootPublicKey
+		})
+		return
+	}
+	deadline := time.Now().Add(time.Second * 10)
+	for {
+		if _, root := rootSequence(); root == high.PublicKey() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("tree didn't converge")
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+
+	// Send a burst of announcements from the root.
+	var latest types.Varu64
+	phony.Block(high.state, func() {
+		for i := 0; i < 10; i++ {
+			high.state._sequence++
+			high.state._sendTreeAnnouncementsNow()
+		}
+		latest = types.Varu64(high.state._sequence)
+	})
+	for {
+		if seq, _ := rootSequence(); seq >= latest {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the latest announcement wasn't handled")
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	if stats := low.TreeStats(); stats.Suppressed == 0 {
+		t.Fatalf("expected announcements to have been suppressed, got %+v", stats)
+	}
+	var suppressed uint64
+	for _, p := range low.Peers() {
+		suppressed += p.SuppressedAnnouncements
+	}
+	if suppressed == 0 {
+		t.Fatalf("expected the peer to have suppressed announcements")
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+// Datagrams are small unreliable payloads for real-time traffic such as
+// voice and video, where waiting for a session to be set up or for a lost
+// packet to be sent again is worse than losing it. Each datagram is sent
+// in a single traffic frame straight to the destination key, marked so
+// that the destination hands it to ReadDatagram instead of ReadFrom, and
+// nodes along the path forward it like any other traffic. Nothing is
+// encrypted or acknowledged, so applications must protect the payload
+// themselves if they need to. If the application doesn't read datagrams
+// quickly enough, the oldest ones are dropped to make room for new ones,
+// since stale media is no use.
+
+// datagramQueueSize is how many datagrams that have arrived for us are
+// held until the application reads them.
+const datagramQueueSize = 64
+
+// WriteDatagram sends a datagram to the node with the given public key,
+// using SNEK routing and the interactive traffic class. The payload must
+// fit in a single frame.
+func (r *Router) WriteDatagram(p []byte, key types.PublicKey) error {
+	if len(p) > types.MaxPayloadSize {
+		return fmt.Errorf("datagram length %d exceeds maximum %d", len(p), types.MaxPayloadSize)
+	}
+	frame := getFrame()
+	frame.HopLimit = types.MaxHopLimit
+	frame.Type = types.TypeTraffic
+	frame.SetTrafficClass(types.TrafficClassInteractive)
+	frame.SetDatagram()
+	frame.Source = r.state.coords()
+	frame.SourceKey = r.public
+	frame.Payload = append(frame.Payload[:0], p...)
+	frame.Watermark = types.VirtualSnakeWatermark{
+		PublicKey: types.FullMask,
+		Sequence:  0,
+	}
+	r.state.Act(nil, func() {
+		if successor, ok := r.state._successor(key); ok {
+			key = successor
+		}
+		frame.DestinationKey = key
+		_ = r.state._sendLocal(frame)
+	})
+	return nil
+}
+
+// ReadDatagram blocks until a datagram arrives for us, and copies its
+// payload into p. Any of the payload that doesn't fit is lost.
+func (r *Router) ReadDatagram(ctx context.Context, p []byte) (int, types.PublicKey, error) {
+	select {
+	case <-ctx.Done():
+		return 0, types.PublicKey{}, ctx.Err()
+	case <-r.context.Done():
+		return 0, types.PublicKey{}, fmt.Errorf("router closed")
+	case frame := <-r.datagrams:
+		defer framePool.Put(frame)
+		return copy(p, frame.Payload), frame.SourceKey, nil
+	}
+}
+
+// _deliverDatagram hands a datagram that arrived for us to the application,
+// dropping the oldest one waiting if there isn't room.
+func (s *state) _deliverDatagram(f *types.Frame) {
+	if s.r.local.traffic == nil {
+		// We aren't accepting traffic.
+		framePool.Put(f)
+		return
+	}
+	for {
+		select {
+		case s.r.datagrams <- f:
+			return
+		default:
+		}
+		select {
+		case old := <-s.r.datagrams:
+			framePool.Put(old)
+		default:
+		}
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"context"
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestDatagrams(t *testing.T) {
+	var routers [2]*Router
+	for i := range routers {
+		_, sk, _ := ed25519.GenerateKey(nil)
+		routers[i] = NewRouter(nil, sk)
+		r := routers[i]
+		t.Cleanup(func() { _ = r.Close() })
+	}
+	a, b := routers[0], routers[1]
+	if errA, errB := connectTestRouters(t, a, b); errA != nil || errB != nil {
+		t.Fatalf("failed to peer: %v, %v", errA, errB)
+	}
+
+	if err := a.WriteDatagram(make([]byte, types.MaxPayloadSize+1), b.PublicKey()); err == nil {
+		t.Fatalf("expected an oversized datagram to be refused")
+	}
+
+	// Datagrams go to ReadDatagram and not to ReadFrom.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	buf := make([]byte, types.MaxPayloadSize)
+	for {
+		if err := a.WriteDatagram([]byte("media"), b.PublicKey()); err != nil {
+			t.Fatal(err)
+		}
+		attempt, cancelAttempt := context.WithTimeout(ctx, time.Millisecond*100)
+		n, from, err := b.ReadDatagram(attempt, buf)
+		cancelAttempt()
+		if err == nil {
+			if from != a.PublicKey() || string(buf[:n]) != "media" {
+				t.Fatalf("got datagram %q from %s", buf[:n], from)
+			}
+			break
+		}
+		if ctx.Err() != nil {
+			t.Fatalf("datagram didn't arrive")
+		}
+	}
+	_ = b.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+	if n, _, _ := b.ReadFrom(buf); n != 0 {
+		t.Fatalf("expected no datagrams to be read with ReadFrom")
+	}
+}
+
+func TestDatagramQueueDropsOldest(t *testing.T) {
+	s := newTestState(types.PublicKey{}, systemClock{})
+	s.r.local.traffic = newFairFIFOQueue(1, nil, nil)
+	s.r.datagrams = make(chan *types.Frame, datagramQueueSize)
+	for i := 0; i < datagramQueueSize+2; i++ {
+		f := getFrame()
+		f.Payload = append(f.Payload[:0], byte(i))
+		s._deliverDatagram(f)
+	}
+	if first := <-s.r.datagrams; first.Payload[0] != 2 {
+		t.Fatalf("expected the two oldest datagrams to be dropped, got %d first", first.Payload[0])
+	}
+}
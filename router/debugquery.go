@@ -0,0 +1,342 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+// Debug queries let an operator see the routing state of a remote node, i.e.
+// its root, coordinates, parent, SNEK neighbours, the size of its routing
+// table and its peerings, without needing a shell on the device. They work
+// in the same way as node info queries, but a node only answers them if the
+// key that signed the request is in the list given to it with
+// RouterOptionDebugQueries, and nodes without that option never answer. The
+// answer is signed but not encrypted, so nodes along the way can read it.
+//
+// Each key is answered at most once every debugQueryMinInterval, since the
+// answer can be much bigger than the request. Requests carry the time that
+// they were made, which must be within debugQueryMaxAge of our own clock
+// and later than the last request that we answered from the same key, so
+// that a request can't be replayed. The answer is routed using SNEK to the
+// key that signed the request, and not to the coordinates in the frame,
+// which aren't signed and could point anywhere.
+
+// debugQueryMinInterval is how often we will answer debug queries from any
+// one key.
+const debugQueryMinInterval = time.Second
+
+// debugQueryMaxAge is how far the time in a debug request can be from our
+// own clock before we ignore the request.
+const debugQueryMaxAge = time.Minute
+
+// RemotePeer describes one of the peerings of a remote node.
+type RemotePeer struct {
+	PublicKey types.PublicKey
+	Port      types.SwitchPortID
+	PeerType  int
+}
+
+// RemoteDebugInfo is the routing state that a remote node gave us in
+// answer to a debug query. Keys are zero if the node doesn't have one.
+type RemoteDebugInfo struct {
+	Root       types.Root        // The root of the tree that the node is in
+	Coords     types.Coordinates // The coordinates of the node
+	Parent     types.PublicKey   // The parent of the node in the tree
+	Ascending  types.PublicKey   // The next node up the keyspace
+	Descending types.PublicKey   // The next node down the keyspace
+	Paths      int               // Entries in the routing table of the node
+	Peers      []RemotePeer      // The peerings of the node
+	RTT        time.Duration     // Time between sending the query and the answer
+}
+
+type pendingDebugQuery struct {
+	public types.PublicKey
+	sent   time.Time
+	notify func(RemoteDebugInfo)
+}
+
+type answeredDebugQuery struct {
+	at        time.Time    // When we answered the request
+	timestamp types.Varu64 // The time in the request
+}
+
+// debugQueryState holds the debug queries that we are waiting on and the
+// last that we answered from each key.
+type debugQueryState struct {
+	sequence uint64
+	pending  map[uint64]*pendingDebugQuery
+	answered map[types.PublicKey]answeredDebugQuery
+}
+
+// QueryDebug asks the node with the given public key for a summary of its
+// routing state. It blocks until the remote node answers or until the
+// context expires, in which case the context error is returned. The remote
+// node only answers if our key is on its list of debug keys.
+func (r *Router) QueryDebug(ctx context.Context, public types.PublicKey) (RemoteDebugInfo, error) {
+	if public == r.public {
+		var info RemoteDebugInfo
+		phony.Block(r.state, func() {
+			info = r.state._localDebugInfo()
+		})
+		return info, nil
+	}
+	result := make(chan RemoteDebugInfo, 1)
+	var id uint64
+	var err error
+	phony.Block(r.state, func() {
+		var f *types.Frame
+		id, f, err = r.state._newDebugRequest(public, func(info RemoteDebugInfo) {
+			result <- info
+		})
+		if err != nil {
+			err = fmt.Errorf("r.state._newDebugRequest: %w", err)
+			return
+		}
+		if err = r.state._forward(r.local, f); err != nil {
+			err = fmt.Errorf("r.state._forward: %w", err)
+		}
+	})
+	defer phony.Block(r.state, func() {
+		delete(r.state._debugQueries.pending, id)
+	})
+	if err != nil {
+		return RemoteDebugInfo{}, err
+	}
+	select {
+	case info := <-result:
+		return info, nil
+	case <-ctx.Done():
+		return RemoteDebugInfo{}, ctx.Err()
+	case <-r.context.Done():
+		return RemoteDebugInfo{}, ErrRouterClosed
+	}
+}
+
+// _localDebugInfo returns what we would tell an operator about our own
+// routing state.
+func (s *state) _localDebugInfo() RemoteDebugInfo {
+	info := RemoteDebugInfo{
+		Root:   s._rootAnnouncement().Root,
+		Coords: s._coords(),
+	}
+	if s._parent != nil && s._parent != s.r.local {
+		info.Parent = s._parent.public
+	}
+	if s._parent != nil {
+		p, w := s._nextHopsSNEK(s.r.public, types.TypeBootstrap, types.VirtualSnakeWatermark{
+			PublicKey: types.FullMask,
+		})
+		if p != nil && w.PublicKey != s.r.public {
+			info.Ascending = w.PublicKey
+		}
+		if c := s._bootstrapConfirm; c != nil && c.Sequence == s._bootstrapSequence {
+			info.Ascending = c.PublicKey
+		}
+	}
+	if desc := s._descending; desc != nil && desc.valid(s.r.clock.Now(), s.r.timings.PathExpiry) {
+		info.Descending = desc.PublicKey
+	}
+	for _, entry := range s._table {
+		if entry.valid(s.r.clock.Now(), s.r.timings.PathExpiry) {
+			info.Paths++
+		}
+	}
+	for _, p := range s._peers {
+		if p == nil || p == s.r.local || !p.started.Load() {
+			continue
+		}
+		info.Peers = append(info.Peers, RemotePeer{
+			PublicKey: p.public,
+			Port:      p.port,
+			PeerType:  int(p.peertype),
+		})
+	}
+	return info
+}
+
+// _newDebugRequest builds a signed debug request for the node with the
+// given public key, which will be routed using SNEK. The notify function
+// will be called from the state actor if an answer arrives.
+func (s *state) _newDebugRequest(public types.PublicKey, notify func(RemoteDebugInfo)) (uint64, *types.Frame, error) {
+	if s._debugQueries.pending == nil {
+		s._debugQueries.pending = map[uint64]*pendingDebugQuery{}
+	}
+	s._debugQueries.sequence++
+	id := s._debugQueries.sequence
+	request := types.DebugRequest{
+		ID:        types.Varu64(id),
+		Timestamp: types.Varu64(s.r.clock.Now().UnixMilli()),
+	}
+	protected, err := request.ProtectedPayload(public)
+	if err != nil {
+		return 0, nil, fmt.Errorf("request.ProtectedPayload: %w", err)
+	}
+	copy(request.Signature[:], s.r.sign(protected))
+
+	f := getFrame()
+	f.Type = types.TypeDebugRequest
+	f.HopLimit = types.MaxHopLimit
+	f.DestinationKey = public
+	f.Source = s._coords()
+	f.SourceKey = s.r.public
+	f.Watermark = types.VirtualSnakeWatermark{
+		PublicKey: types.FullMask,
+		Sequence:  0,
+	}
+	if err := f.AppendPayload(&request); err != nil {
+		framePool.Put(f)
+		return 0, nil, fmt.Errorf("f.AppendPayload: %w", err)
+	}
+	s._debugQueries.pending[id] = &pendingDebugQuery{
+		public: public,
+		sent:   s.r.clock.Now(),
+		notify: notify,
+	}
+	return id, f, nil
+}
+
+// _allowDebugQuery returns true if a debug query from the node with the
+// given key was made recently, is newer than the last one that we answered
+// from that node and doesn't come too soon after it, and if so, records
+// that we are answering this one.
+func (s *state) _allowDebugQuery(from types.PublicKey, timestamp types.Varu64) bool {
+	now := s.r.clock.Now()
+	made := time.UnixMilli(int64(timestamp))
+	if made.Before(now.Add(-debugQueryMaxAge)) || made.After(now.Add(debugQueryMaxAge)) {
+		return false
+	}
+	last, ok := s._debugQueries.answered[from]
+	if ok && (timestamp <= last.timestamp || now.Sub(last.at) < debugQueryMinInterval) {
+		return false
+	}
+	if s._debugQueries.answered == nil {
+		s._debugQueries.answered = map[types.PublicKey]answeredDebugQuery{}
+	}
+	s._debugQueries.answered[from] = answeredDebugQuery{at: now, timestamp: timestamp}
+	return true
+}
+
+// _handleDebugQuery is called when a debug frame addressed to us arrives.
+// Requests from allowed keys are answered and answers are matched up with
+// the queries that are waiting for them.
+func (s *state) _handleDebugQuery(f *types.Frame) error {
+	switch f.Type {
+	case types.TypeDebugRequest:
+		var request types.DebugRequest
+		if _, err := types.Decode(&request, f.Payload); err != nil {
+			return fmt.Errorf("request.UnmarshalBinary: %w", err)
+		}
+		if _, ok := s.r.debugKeys[f.SourceKey]; !ok {
+			// Don't give away that we understood the request.
+			return nil
+		}
+		protected, err := request.ProtectedPayload(s.r.public)
+		if err != nil {
+			return fmt.Errorf("request.ProtectedPayload: %w", err)
+		}
+		if !s.r.verify(f.SourceKey[:], protected, request.Signature[:]) {
+			// Anyone can send us a forged request, so drop it rather than
+			// blaming the peer that passed it on.
+			return nil
+		}
+		if !s._allowDebugQuery(f.SourceKey, request.Timestamp) {
+			return nil
+		}
+		s.r.log.Println("Answering debug query from", f.SourceKey.String())
+		local := s._localDebugInfo()
+		response := types.DebugResponse{
+			ID:         request.ID,
+			Root:       local.Root,
+			Coords:     local.Coords,
+			Parent:     local.Parent,
+			Ascending:  local.Ascending,
+			Descending: local.Descending,
+			Paths:      types.Varu64(local.Paths),
+			Peers:      make([]types.DebugPeer, 0, len(local.Peers)),
+		}
+		for _, p := range local.Peers {
+			response.Peers = append(response.Peers, types.DebugPeer{
+				PublicKey: p.PublicKey,
+				Port:      p.Port,
+				PeerType:  uint8(p.PeerType),
+			})
+		}
+		if protected, err = response.ProtectedPayload(f.SourceKey); err != nil {
+			return fmt.Errorf("response.ProtectedPayload: %w", err)
+		}
+		copy(response.Signature[:], s.r.sign(protected))
+
+		reply := getFrame()
+		reply.Type = types.TypeDebugResponse
+		reply.HopLimit = types.MaxHopLimit
+		reply.DestinationKey = f.SourceKey
+		reply.Source = s._coords()
+		reply.SourceKey = s.r.public
+		reply.Watermark = types.VirtualSnakeWatermark{
+			PublicKey: types.FullMask,
+			Sequence:  0,
+		}
+		if err := reply.AppendPayload(&response); err != nil {
+			framePool.Put(reply)
+			return fmt.Errorf("reply.AppendPayload: %w", err)
+		}
+		return s._forward(s.r.local, reply)
+
+	case types.TypeDebugResponse:
+		var response types.DebugResponse
+		if _, err := types.Decode(&response, f.Payload); err != nil {
+			return fmt.Errorf("response.UnmarshalBinary: %w", err)
+		}
+		pending, ok := s._debugQueries.pending[uint64(response.ID)]
+		if !ok || pending.public != f.SourceKey {
+			return nil
+		}
+		protected, err := response.ProtectedPayload(s.r.public)
+		if err != nil {
+			return fmt.Errorf("response.ProtectedPayload: %w", err)
+		}
+		if !s.r.verify(f.SourceKey[:], protected, response.Signature[:]) {
+			return nil
+		}
+		delete(s._debugQueries.pending, uint64(response.ID))
+		info := RemoteDebugInfo{
+			Root:       response.Root,
+			Coords:     response.Coords,
+			Parent:     response.Parent,
+			Ascending:  response.Ascending,
+			Descending: response.Descending,
+			Paths:      int(response.Paths),
+			RTT:        since(s.r.clock, pending.sent),
+		}
+		for _, p := range response.Peers {
+			info.Peers = append(info.Peers, RemotePeer{
+				PublicKey: p.PublicKey,
+				Port:      p.Port,
+				PeerType:  int(p.PeerType),
+			})
+		}
+		pending.notify(info)
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestQueryDebug(t *testing.T) {
+	_, ska, _ := ed25519.GenerateKey(nil)
+	_, skb, _ := ed25519.GenerateKey(nil)
+	_, skc, _ := ed25519.GenerateKey(nil)
+	operator := NewRouter(nil, ska)
+	outsider := NewRouter(nil, skb)
+	target := NewRouter(nil, skc, RouterOptionDebugQueries{operator.PublicKey()})
+	t.Cleanup(func() {
+		_ = operator.Close()
+		_ = outsider.Close()
+		_ = target.Close()
+	})
+	for _, r := range []*Router{operator, outsider} {
+		if errA, errB := connectTestRouters(t, target, r); errA != nil || errB != nil {
+			t.Fatalf("failed to connect: %v, %v", errA, errB)
+		}
+	}
+
+	var info RemoteDebugInfo
+	deadline := time.Now().Add(time.Second * 10)
+	for {
+		// Queries are only answered once a second, so wait that long
+		// between attempts while the network converges.
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		var err error
+		info, err = operator.QueryDebug(ctx, target.PublicKey())
+		cancel()
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("debug query didn't succeed: %v", err)
+		}
+	}
+	if len(info.Peers) != 2 {
+		t.Fatalf("expected two peers, got %+v", info.Peers)
+	}
+	seen := map[types.PublicKey]bool{}
+	for _, p := range info.Peers {
+		seen[p.PublicKey] = true
+	}
+	if !seen[operator.PublicKey()] || !seen[outsider.PublicKey()] {
+		t.Fatalf("expected both peers to be listed, got %+v", info.Peers)
+	}
+	if info.Root.RootPublicKey == (types.PublicKey{}) {
+		t.Fatalf("expected a root, got %+v", info)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+	if _, err := outsider.QueryDebug(ctx, target.PublicKey()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected a key that isn't allowed not to be answered, got %v", err)
+	}
+}
+
+func TestDebugQueryReplay(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	s := newTestState(types.PublicKey{}, clock)
+	operator, other := types.PublicKey{1}, types.PublicKey{2}
+	stamp := func() types.Varu64 {
+		return types.Varu64(clock.Now().UnixMilli())
+	}
+
+	first := stamp()
+	if !s._allowDebugQuery(operator, first) {
+		t.Fatalf("expected a fresh request to be answered")
+	}
+	clock.Advance(debugQueryMinInterval * 2)
+	if s._allowDebugQuery(operator, first) {
+		t.Fatalf("expected a replayed request not to be answered")
+	}
+	if !s._allowDebugQuery(operator, stamp()) {
+		t.Fatalf("expected a newer request to be answered")
+	}
+
+	// Requests made too long before or after our own time are ignored,
+	// even from keys that we haven't answered before.
+	if s._allowDebugQuery(other, stamp()-types.Varu64(2*debugQueryMaxAge/time.Millisecond)) {
+		t.Fatalf("expected an old request not to be answered")
+	}
+	if s._allowDebugQuery(other, stamp()+types.Varu64(2*debugQueryMaxAge/time.Millisecond)) {
+		t.Fatalf("expected a request from the future not to be answered")
+	}
+}
+
+func TestDebugQueryForgedSignature(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	s := newTestState(types.PublicKey{1}, clock)
+	operator := types.PublicKey{2}
+	s.r.debugKeys = map[types.PublicKey]struct{}{operator: {}}
+	answered := false
+	s._debugQueries.pending = map[uint64]*pendingDebugQuery{
+		1: {public: operator, notify: func(RemoteDebugInfo) { answered = true }},
+	}
+
+	// Frames with bad signatures are dropped without an error, since an
+	// error would stop the peering that passed the frame on to us.
+	request := getFrame()
+	request.Type = types.TypeDebugRequest
+	request.SourceKey = operator
+	if err := request.AppendPayload(&types.DebugRequest{ID: 1, Timestamp: types.Varu64(clock.Now().UnixMilli())}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s._handleDebugQuery(request); err != nil {
+		t.Fatalf("expected a forged request to be dropped, got %v", err)
+	}
+	response := getFrame()
+	response.Type = types.TypeDebugResponse
+	response.SourceKey = operator
+	if err := response.AppendPayload(&types.DebugResponse{ID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s._handleDebugQuery(response); err != nil {
+		t.Fatalf("expected a forged response to be dropped, got %v", err)
+	}
+	if answered || len(s._debugQueries.pending) != 1 {
+		t.Fatalf("expected the query to still be waiting for an answer")
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"context"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+// Closing a well-connected node breaks every SNEK path that passes through
+// it, and the nodes that were using them can't send anything until they
+// notice and set up new paths. Draining the node first avoids that. While
+// draining, we refuse new peerings, don't let new paths through us and stop
+// refreshing the ones that already do, and tell our peers that we're about
+// to leave. Our peers then stop choosing us as their parent if they have
+// another choice and stop sending bootstraps through us, so the nodes whose
+// paths went through us set up new paths around us when their refreshes go
+// unconfirmed. Once the paths through us have expired, nothing depends on us
+// and we can close without anyone noticing.
+
+// Drain prepares the router to leave the network and then closes it. It
+// waits until no SNEK paths pass through us, or until the context is done,
+// whichever comes first. It returns nil if every path went elsewhere, or the
+// error from the context if the router was closed before they did.
+func (r *Router) Drain(ctx context.Context) error {
+	phony.Block(r.state, r.state._drain)
+	for {
+		if r.state.transitPaths() == 0 {
+			return r.Close()
+		}
+		poll := make(chan struct{})
+		timer := r.clock.AfterFunc(drainPollInterval, func() {
+			close(poll)
+		})
+		select {
+		case <-poll:
+		case <-ctx.Done():
+			timer.Stop()
+			_ = r.Close()
+			return ctx.Err()
+		case <-r.context.Done():
+			timer.Stop()
+			return ErrRouterClosed
+		}
+	}
+}
+
+// Draining returns true if Drain has been called.
+func (r *Router) Draining() bool {
+	var draining bool
+	phony.Block(r.state, func() {
+		draining = r.state._draining
+	})
+	return draining
+}
+
+// _drain starts draining and tells our peers that we are about to leave.
+func (s *state) _drain() {
+	if s._draining {
+		return
+	}
+	s._draining = true
+	s.r.log.Println("Draining before leaving the network")
+	s._recordEvent(ProtocolDraining, types.PublicKey{}, nil, "")
+	for _, p := range s._peers {
+		if p == nil || p == s.r.local || !p.started.Load() {
+			continue
+		}
+		s._sendDeparting(p)
+	}
+}
+
+// _sendDeparting tells a peer that we are about to leave.
+func (s *state) _sendDeparting(p *peer) {
+	send := getFrame()
+	send.Type = types.TypeDeparting
+	if !p.send(send) {
+		framePool.Put(send)
+	}
+}
+
+// _handleDeparting is called when a peer tells us that it is about to
+// leave. If it is our parent, we find another if we can, and if our own
+// path goes through it, we set up a new one.
+func (s *state) _handleDeparting(from *peer) {
+	if from._departing {
+		return
+	}
+	from._departing = true
+	s._recordEvent(ProtocolPeerDeparting, from.public, from, "")
+	bootstrap := s._refresh != nil && s._refresh.via == from
+	if from == s._parent && s._selectNewParent() {
+		bootstrap = true
+	}
+	if bootstrap {
+		s._bootstrapSoon()
+	}
+}
+
+// transitPaths returns the number of valid SNEK paths that pass through us
+// on their way to somewhere else.
+func (s *state) transitPaths() int {
+	var count int
+	phony.Block(s, func() {
+		count = s._transitPaths()
+	})
+	return count
+}
+
+func (s *state) _transitPaths() int {
+	count := 0
+	for _, entry := range s._table {
+		if entry.valid(s.r.clock.Now(), s.r.timings.PathExpiry) && entry.Destination != nil && entry.Destination != s.r.local {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,130 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestDrain(t *testing.T) {
+	var routers [3]*Router
+	for i := range routers {
+		_, sk, _ := ed25519.GenerateKey(nil)
+		routers[i] = NewRouter(nil, sk)
+		r := routers[i]
+		t.Cleanup(func() { _ = r.Close() })
+	}
+	drained, neighbour, late := routers[0], routers[1], routers[2]
+	if errA, errB := connectTestRouters(t, drained, neighbour); errA != nil || errB != nil {
+		t.Fatalf("failed to peer: %v, %v", errA, errB)
+	}
+
+	phony.Block(drained.state, drained.state._drain)
+	if !drained.Draining() {
+		t.Fatalf("expected the router to be draining")
+	}
+	if errA, _ := connectTestRouters(t, drained, late); !errors.Is(errA, ErrDraining) {
+		t.Fatalf("expected the peering to be refused, got %v", errA)
+	}
+
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		var departing bool
+		phony.Block(neighbour.state, func() {
+			for _, p := range neighbour.state._peers {
+				if p != nil && p.public == drained.PublicKey() {
+					departing = p._departing
+				}
+			}
+		})
+		if departing {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the neighbour to be told that we are leaving")
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+
+	// Nothing passes through us, so there is nothing to wait for.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if err := drained.Drain(ctx); err != nil {
+		t.Fatalf("expected the router to drain, got %v", err)
+	}
+	select {
+	case <-drained.context.Done():
+	default:
+		t.Fatalf("expected the router to be closed")
+	}
+}
+
+func TestDrainRejectsTransitPaths(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	root := types.Root{RootPublicKey: types.PublicKey{9}, RootSequence: 1}
+	s := newTestState(types.PublicKey{}, clock)
+	from := addTestPeer(s, types.PublicKey{1})
+	next := addTestPeer(s, types.PublicKey{2})
+	s._parent = from
+	s._announcements = announcementTable{
+		from: &rootAnnouncementWithTime{
+			SwitchAnnouncement: types.SwitchAnnouncement{Root: root},
+			receiveTime:        clock.Now(),
+		},
+	}
+	origin := types.PublicKey{4}
+	index := virtualSnakeIndex{PublicKey: origin}
+	s._table[index] = &virtualSnakeEntry{
+		virtualSnakeIndex: &index,
+		Source:            from,
+		Destination:       next,
+		LastSeen:          clock.Now(),
+		Root:              root,
+		Watermark:         types.VirtualSnakeWatermark{PublicKey: origin, Sequence: 100},
+	}
+	s._draining = true
+
+	// The refresh isn't passed on, so the path expires.
+	clock.Advance(time.Second)
+	f := &types.Frame{Type: types.TypeSNEKRefresh}
+	if err := f.AppendPayload(&types.VirtualSnakeRefresh{PublicKey: origin, Sequence: 100, Root: root}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s._handleSNEKRefresh(from, f); err != nil {
+		t.Fatal(err)
+	}
+	if e := s._table[index]; !e.LastSeen.Equal(clock.Now().Add(-time.Second)) {
+		t.Fatalf("expected the path not to be refreshed while draining")
+	}
+
+	// A new path through us isn't installed.
+	f = &types.Frame{Type: types.TypeBootstrap, DestinationKey: origin}
+	if err := f.AppendPayload(&types.VirtualSnakeBootstrap{Sequence: 101, Root: root}); err != nil {
+		t.Fatal(err)
+	}
+	if s._handleBootstrap(from, next, f) {
+		t.Fatalf("expected the bootstrap to be rejected while draining")
+	}
+	if e := s._table[index]; e.Watermark.Sequence != 100 {
+		t.Fatalf("expected the old path to be kept, got sequence %d", e.Watermark.Sequence)
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+// When a peering stops, the frames that are still queued for it have
+// nowhere to go and are dropped, unless there is another link to the same
+// neighbour to move them onto. Protocol frames are sent again by the
+// protocol itself, but the traffic that we sent ourselves would otherwise
+// be lost without the sender ever knowing. If a handler has been set with
+// NotifyDroppedTraffic then it is given a copy of each of our own traffic
+// frames that was dropped, so that the sender can decide whether to send
+// it again straight away rather than waiting for a timeout. Traffic that
+// we were forwarding for other nodes is dropped silently as before, since
+// the sender is somewhere else in the network.
+
+// DroppedTraffic is one of our own traffic frames that was still queued for
+// a peering when it stopped.
+type DroppedTraffic struct {
+	Destination types.PublicKey
+	Port        types.SwitchPortID // The port of the peering that stopped
+	Payload     []byte             // A copy of the payload, which the handler owns
+}
+
+// DroppedTrafficFn is called with the traffic that was dropped from the
+// queues of a peering when it stopped. It is called from the router's
+// actor, so it must not block.
+type DroppedTrafficFn func(dropped []DroppedTraffic)
+
+// NotifyDroppedTraffic sets a function that is told about the traffic that
+// we sent which was dropped because the peering it was queued for stopped.
+// Passing nil removes the function.
+func (r *Router) NotifyDroppedTraffic(fn DroppedTrafficFn) {
+	phony.Block(r.state, func() {
+		r.state._droppedTraffic = fn
+	})
+}
+
+// _resetQueues drops everything in the queues of a peering that stopped,
+// telling the handler about any of our own traffic.
+func (s *state) _resetQueues(p *peer) {
+	if p.control != nil {
+		p.control.reset()
+	}
+	if p.proto != nil {
+		p.proto.reset()
+	}
+	if p.traffic == nil {
+		return
+	}
+	if fn := s._droppedTraffic; fn != nil {
+		var dropped []DroppedTraffic
+		for p.traffic.queuecount() > 0 {
+			var f *types.Frame
+			select {
+			case f = <-p.traffic.pop():
+			default:
+			}
+			if f == nil {
+				// Anything left has already been taken by the writer.
+				break
+			}
+			p.traffic.ack(f)
+			if f.Type == types.TypeTraffic && f.SourceKey == s.r.public {
+				dropped = append(dropped, DroppedTraffic{
+					Destination: f.DestinationKey,
+					Port:        p.port,
+					Payload:     append([]byte(nil), f.Payload...),
+				})
+			}
+			framePool.Put(f)
+		}
+		if len(dropped) > 0 {
+			s.r.Act(nil, func() {
+				fn(dropped)
+			})
+		}
+	}
+	p.traffic.reset()
+}
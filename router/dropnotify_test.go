@@ -0,0 +1,73 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestNotifyDroppedTraffic(t *testing.T) {
+	_, sk, _ := ed25519.GenerateKey(nil)
+	r := NewRouter(nil, sk)
+	t.Cleanup(func() { _ = r.Close() })
+
+	notified := make(chan []DroppedTraffic, 1)
+	r.NotifyDroppedTraffic(func(dropped []DroppedTraffic) {
+		notified <- dropped
+	})
+
+	var remote, other types.PublicKey
+	remote[0], other[0] = 1, 2
+	p := &peer{
+		router:  r,
+		port:    3,
+		control: newFIFOQueue(fifoNoMax, nil, nil),
+		traffic: newFairFIFOQueue(4, nil, nil),
+	}
+	ours := getFrame()
+	ours.Type = types.TypeTraffic
+	ours.SourceKey, ours.DestinationKey = r.PublicKey(), remote
+	ours.Payload = append(ours.Payload[:0], "hello"...)
+	forwarded := getFrame()
+	forwarded.Type = types.TypeTraffic
+	forwarded.SourceKey, forwarded.DestinationKey = other, remote
+	forwarded.Payload = append(forwarded.Payload[:0], "world"...)
+	p.traffic.push(ours)
+	p.traffic.push(forwarded)
+
+	phony.Block(r.state, func() {
+		r.state._resetQueues(p)
+	})
+	select {
+	case dropped := <-notified:
+		if len(dropped) != 1 {
+			t.Fatalf("expected only our own frame to be reported, got %d", len(dropped))
+		}
+		if d := dropped[0]; d.Destination != remote || d.Port != 3 || !bytes.Equal(d.Payload, []byte("hello")) {
+			t.Fatalf("unexpected dropped frame %+v", d)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected to be told about the dropped frame")
+	}
+	if p.traffic.queuecount() != 0 {
+		t.Fatalf("expected the queue to be empty, got %d", p.traffic.queuecount())
+	}
+}
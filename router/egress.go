@@ -0,0 +1,108 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+// An egress limiter caps the rate at which traffic frames are written to a
+// peering, with separate token buckets for traffic that we sent ourselves
+// and for traffic that we are relaying for other nodes. A frame that goes
+// over the cap is held back by the writer until the bucket has refilled,
+// while protocol frames carry on being sent in the meantime. Since the
+// traffic queue isn't drained while a frame is held, it fills up and the
+// fair queue starts dropping frames from the busiest flows.
+type egressLimiter struct {
+	local   egressBucket
+	transit egressBucket
+	held    *types.Frame // A traffic frame waiting for the bucket to refill
+	until   time.Time    // When the held frame can be written
+}
+
+// egressBucket is a token bucket that holds up to a second's worth of
+// tokens, or a single maximum-sized frame if that is larger. A rate of zero
+// means that the traffic isn't limited.
+type egressBucket struct {
+	rate   float64 // bytes per second
+	tokens float64 // bytes that can be written without waiting
+	last   time.Time
+}
+
+func newEgressLimiter(local, transit uint64, now time.Time) *egressLimiter {
+	return &egressLimiter{
+		local:   newEgressBucket(local, now),
+		transit: newEgressBucket(transit, now),
+	}
+}
+
+func newEgressBucket(rate uint64, now time.Time) egressBucket {
+	b := egressBucket{
+		rate: float64(rate),
+		last: now,
+	}
+	b.tokens = b.burst()
+	return b
+}
+
+func (b *egressBucket) burst() float64 {
+	if b.rate < types.MaxFrameSize {
+		return types.MaxFrameSize
+	}
+	return b.rate
+}
+
+// delay takes tokens for a frame of the given size and returns how long
+// we must wait before writing it.
+func (b *egressBucket) delay(size int, now time.Time) time.Duration {
+	if b.rate <= 0 {
+		return 0
+	}
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	b.last = now
+	if burst := b.burst(); b.tokens > burst {
+		b.tokens = burst
+	}
+	b.tokens -= float64(size)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// hold returns true if the traffic frame, which was sent by the given node,
+// has to wait before it can be written. The frame is then kept until it is
+// taken with release.
+func (l *egressLimiter) hold(local types.PublicKey, frame *types.Frame, size int, now time.Time) bool {
+	bucket := &l.transit
+	if frame.SourceKey == local {
+		bucket = &l.local
+	}
+	delay := bucket.delay(size, now)
+	if delay <= 0 {
+		return false
+	}
+	l.held, l.until = frame, now.Add(delay)
+	return true
+}
+
+// release returns the held frame and forgets about it.
+func (l *egressLimiter) release() *types.Frame {
+	frame := l.held
+	l.held = nil
+	return frame
+}
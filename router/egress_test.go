@@ -0,0 +1,53 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestEgressLimiter(t *testing.T) {
+	var us, them types.PublicKey
+	us[0], them[0] = 1, 2
+	l := newEgressLimiter(0, 250000, time.Now()) // transit capped at 2Mbit/s
+	now := l.transit.last
+	local := &types.Frame{Type: types.TypeTraffic, SourceKey: us}
+	transit := &types.Frame{Type: types.TypeTraffic, SourceKey: them}
+
+	// Local traffic isn't limited at all.
+	for i := 0; i < 10; i++ {
+		if l.hold(us, local, types.MaxFrameSize, now) {
+			t.Fatalf("local traffic shouldn't be limited")
+		}
+	}
+
+	// Transit traffic can burst up to the bucket size and is then held
+	// until the bucket has refilled.
+	if l.hold(us, transit, 250000, now) {
+		t.Fatalf("transit frame within the burst shouldn't be held")
+	}
+	if !l.hold(us, transit, 25000, now) {
+		t.Fatalf("transit frame over the limit should be held")
+	}
+	if l.until.Sub(now) != time.Millisecond*100 {
+		t.Fatalf("expected frame to be held for 100ms, got %s", l.until.Sub(now))
+	}
+	if frame := l.release(); frame != transit || l.held != nil {
+		t.Fatalf("expected the held frame to be released")
+	}
+}
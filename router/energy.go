@@ -0,0 +1,89 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"crypto/ed25519"
+	"time"
+
+	"go.uber.org/atomic"
+)
+
+// On a phone most of the battery that the router uses goes on keeping the
+// radio awake to send and receive frames, on signing and checking
+// signatures, and on waking the CPU up to run timers. The router counts
+// each of these from the moment it starts, so that the cost of a change to
+// the protocol can be compared before it ships, i.e. by running the same
+// scenario in the simulator before and after the change. The counters are
+// only ever added to, so they are cheap enough to always keep.
+
+// EnergyStats counts the work that the router has done since it started.
+type EnergyStats struct {
+	FramesSent     uint64 // Frames written to our peerings
+	FramesReceived uint64 // Frames read from our peerings
+	BytesSent      uint64
+	BytesReceived  uint64
+	Signatures     uint64 // ed25519 signatures made by us
+	Verifications  uint64 // ed25519 signatures checked by us
+	Wakeups        uint64 // Router timers that have fired
+}
+
+type energyCounters struct {
+	framesTx atomic.Uint64
+	framesRx atomic.Uint64
+	bytesTx  atomic.Uint64
+	bytesRx  atomic.Uint64
+	signs    atomic.Uint64
+	verifies atomic.Uint64
+	wakeups  atomic.Uint64
+}
+
+// EnergyStats returns the work that the router has done since it started.
+func (r *Router) EnergyStats() EnergyStats {
+	return EnergyStats{
+		FramesSent:     r.energy.framesTx.Load(),
+		FramesReceived: r.energy.framesRx.Load(),
+		BytesSent:      r.energy.bytesTx.Load(),
+		BytesReceived:  r.energy.bytesRx.Load(),
+		Signatures:     r.energy.signs.Load(),
+		Verifications:  r.energy.verifies.Load(),
+		Wakeups:        r.energy.wakeups.Load(),
+	}
+}
+
+// sign signs the message with our private key.
+func (r *Router) sign(message []byte) []byte {
+	r.energy.signs.Inc()
+	return ed25519.Sign(r.private[:], message)
+}
+
+// verify checks the signature of the message against the public key.
+func (r *Router) verify(public, message, signature []byte) bool {
+	r.energy.verifies.Inc()
+	return ed25519.Verify(public, message, signature)
+}
+
+// wakeupClock counts the timers of the wrapped clock as they fire.
+type wakeupClock struct {
+	Clock
+	wakeups *atomic.Uint64
+}
+
+func (c wakeupClock) AfterFunc(d time.Duration, f func()) Timer {
+	return c.Clock.AfterFunc(d, func() {
+		c.wakeups.Inc()
+		f()
+	})
+}
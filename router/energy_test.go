@@ -0,0 +1,68 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+)
+
+func TestEnergyStats(t *testing.T) {
+	var routers [2]*Router
+	for i := range routers {
+		_, sk, _ := ed25519.GenerateKey(nil)
+		routers[i] = NewRouter(nil, sk)
+		r := routers[i]
+		t.Cleanup(func() { _ = r.Close() })
+	}
+	a, b := routers[0], routers[1]
+	if errA, errB := connectTestRouters(t, a, b); errA != nil || errB != nil {
+		t.Fatalf("failed to peer: %v, %v", errA, errB)
+	}
+
+	deadline := time.Now().Add(time.Second * 10)
+	for {
+		sa, sb := a.EnergyStats(), b.EnergyStats()
+		if sa.FramesSent > 0 && sa.FramesReceived > 0 &&
+			sa.Signatures > 0 && sa.Verifications > 0 &&
+			sb.FramesReceived > 0 && sb.BytesReceived > 0 {
+			if sa.BytesSent < sa.FramesSent || sa.BytesReceived < sa.FramesReceived {
+				t.Fatalf("counted fewer bytes than frames: %+v", sa)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("counters didn't move: %+v, %+v", sa, sb)
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+}
+
+func TestEnergyStatsWakeups(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	_, sk, _ := ed25519.GenerateKey(nil)
+	r := NewRouter(nil, sk, RouterOptionClock{clock})
+	t.Cleanup(func() { _ = r.Close() })
+	phony.Block(r.state, func() {}) // Wait for the maintenance timers to start
+
+	before := r.EnergyStats().Wakeups
+	clock.Advance(time.Minute)
+	if after := r.EnergyStats().Wakeups; after <= before {
+		t.Fatalf("expected timers to be counted, got %d then %d", before, after)
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"errors"
+)
+
+// The errors returned from the public API wrap one of the following errors
+// where the cause of the failure is known, so that callers can check for
+// them using errors.Is instead of matching on the error text.
+
+// ErrHandshakeTimeout is returned by Connect when the remote node doesn't
+// complete the handshake in time.
+var ErrHandshakeTimeout = errors.New("handshake timed out")
+
+// ErrTooManyHandshakes is returned by Connect when the limits set with
+// RouterOptionHandshakeLimits don't allow another handshake to start.
+var ErrTooManyHandshakes = errors.New("too many handshakes in progress")
+
+// ErrTooManyConnections is returned by Connect when an inbound connection
+// is refused by the limits set with RouterOptionAcceptLimits.
+var ErrTooManyConnections = errors.New("too many connections")
+
+// ErrInvalidHandshake is returned by Connect when the remote node sends a
+// handshake that wasn't signed by the key that it claims to have.
+var ErrInvalidHandshake = errors.New("peer sent invalid handshake")
+
+// ErrIncompatiblePeer is returned by Connect when the remote node runs a
+// different protocol version or has different capabilities to us.
+var ErrIncompatiblePeer = errors.New("peer is incompatible")
+
+// ErrNotAuthorized is returned by Connect when the remote node isn't
+// allowed to peer with us, either because its key has been revoked or
+// because it couldn't prove its membership of a closed network.
+var ErrNotAuthorized = errors.New("peer is not authorized")
+
+// ErrPeerLimitReached is returned by Connect when there is no room for
+// another peering and no existing peering could be evicted to make room.
+var ErrPeerLimitReached = errors.New("peer limit reached")
+
+// ErrOverloaded is returned by Connect when new peerings are being refused
+// to shed load, see RouterOptionLoadShedding.
+var ErrOverloaded = errors.New("router overloaded")
+
+// ErrDraining is returned by Connect when new peerings are being refused
+// because the router is being drained, see Router.Drain.
+var ErrDraining = errors.New("router draining")
+
+// ErrTrafficPolicy is returned when traffic that we are sending is dropped
+// by the traffic policy, see RouterOptionTrafficPolicy.
+var ErrTrafficPolicy = errors.New("traffic refused by policy")
+
+// ErrNoNextHop is returned by Lookup when there is nowhere to send the
+// request because we have no peerings.
+var ErrNoNextHop = errors.New("no next-hop")
+
+// ErrCustodyUnavailable is returned by WriteToWithCustody when the router
+// isn't in delay-tolerant mode or can't hold any more bundles.
+var ErrCustodyUnavailable = errors.New("custody unavailable")
+
+// ErrRouterClosed is returned when the router is closed while waiting for
+// an operation to complete.
+var ErrRouterClosed = errors.New("router closed")
+
+// ErrNoLiveCandidate is returned by NearestLiveKey when none of the
+// candidates answered.
+var ErrNoLiveCandidate = errors.New("no live candidate")
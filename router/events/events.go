@@ -15,6 +15,8 @@
 package events
 
 import (
+	"time"
+
 	"github.com/matrix-org/pinecone/types"
 )
 
@@ -85,6 +87,52 @@ type BroadcastReceived struct {
 // Tag BroadcastReceived as an Event
 func (e BroadcastReceived) isEvent() {}
 
+// QueueCongested is sent when an outbound queue of a peering has stayed
+// above the configured threshold for the configured duration.
+type QueueCongested struct {
+	Port   types.SwitchPortID
+	PeerID string
+	Queue  string // "proto" or "traffic"
+	Depth  int
+	Since  time.Time
+}
+
+// Tag QueueCongested as an Event
+func (e QueueCongested) isEvent() {}
+
+// QueueRecovered is sent when a congested queue drops back down to the
+// configured threshold.
+type QueueRecovered struct {
+	Port   types.SwitchPortID
+	PeerID string
+	Queue  string // "proto" or "traffic"
+}
+
+// Tag QueueRecovered as an Event
+func (e QueueRecovered) isEvent() {}
+
+// PeerStalled is sent when the watchdog resets a peering because its
+// reader or writer appears to be stuck.
+type PeerStalled struct {
+	Port   types.SwitchPortID
+	PeerID string
+	Reason string
+}
+
+// Tag PeerStalled as an Event
+func (e PeerStalled) isEvent() {}
+
+// ServiceDiscovered is sent when another node advertises a service that
+// we didn't know about, or changes the capacity that it advertises.
+type ServiceDiscovered struct {
+	PeerID   string
+	Service  string
+	Capacity uint64
+}
+
+// Tag ServiceDiscovered as an Event
+func (e ServiceDiscovered) isEvent() {}
+
 type PeerBandwidthUsage struct {
 	Protocol struct {
 		Rx uint64
@@ -103,3 +151,146 @@ type BandwidthReport struct {
 
 // Tag BandwidthReport as an Event
 func (e BandwidthReport) isEvent() {}
+
+// IdentityMoved is sent when we learn that a node has retired its old
+// public key in favour of a new one.
+type IdentityMoved struct {
+	OldPeerID string
+	NewPeerID string
+}
+
+// Tag IdentityMoved as an Event
+func (e IdentityMoved) isEvent() {}
+
+// RootMisbehaving is sent when the root of our tree, or a root that one of
+// our peers is announcing, does something that a well-behaved root never
+// would. The anomaly is a short name for what it did and the reason gives
+// the details.
+type RootMisbehaving struct {
+	RootID  string
+	Anomaly string
+	Reason  string
+}
+
+// Tag RootMisbehaving as an Event
+func (e RootMisbehaving) isEvent() {}
+
+// AdjacencyInconsistent is sent when a node's signed statement about its
+// neighbours in the keyspace disagrees with what we know, which may mean
+// that it is lying about its position to attract traffic.
+type AdjacencyInconsistent struct {
+	PeerID string
+	Reason string
+}
+
+// Tag AdjacencyInconsistent as an Event
+func (e AdjacencyInconsistent) isEvent() {}
+
+// LoadLevelChanged is sent when the load monitor starts or stops shedding
+// load. The pressure is how close the load is to the configured limits.
+type LoadLevelChanged struct {
+	Level    string
+	Pressure float64
+}
+
+// Tag LoadLevelChanged as an Event
+func (e LoadLevelChanged) isEvent() {}
+
+// RouteChange describes how an entry in a routing table changed.
+type RouteChange int
+
+const (
+	RouteAdded RouteChange = iota
+	RouteUpdated
+	RouteRemoved
+)
+
+// SnakeRoute is an entry in the SNEK routing table.
+type SnakeRoute struct {
+	PublicKey   types.PublicKey    // The node that bootstrapped the path
+	Sequence    uint64             // The sequence of the bootstrap
+	Root        types.Root         // The root that the path was set up under
+	Source      types.SwitchPortID // The port towards the node that bootstrapped
+	Destination types.SwitchPortID // The port that the bootstrap went out of, 0 if it ended here
+	LastSeen    time.Time
+}
+
+// TreeAnnouncement is the last tree announcement received from a peer.
+type TreeAnnouncement struct {
+	Port   types.SwitchPortID
+	PeerID string
+	Root   types.Root
+	Coords types.Coordinates
+}
+
+// RoutingSnapshot is sent to a routing table subscriber when it subscribes,
+// and again whenever the routing tables are reset. It replaces anything
+// that the subscriber knew about the routing tables before.
+type RoutingSnapshot struct {
+	SnakeRoutes       []SnakeRoute
+	TreeAnnouncements []TreeAnnouncement
+}
+
+// Tag RoutingSnapshot as an Event
+func (e RoutingSnapshot) isEvent() {}
+
+// SnakeRouteChanged is sent to routing table subscribers when an entry in
+// the SNEK routing table is added, updated or removed. Only the key is set
+// on removed routes.
+type SnakeRouteChanged struct {
+	Change RouteChange
+	Route  SnakeRoute
+}
+
+// Tag SnakeRouteChanged as an Event
+func (e SnakeRouteChanged) isEvent() {}
+
+// TreeAnnouncementChanged is sent to routing table subscribers when a peer
+// sends us a tree announcement, or when the peer's announcement is removed
+// because the peer disconnected. Only the port and peer ID are set on
+// removed announcements.
+type TreeAnnouncementChanged struct {
+	Change       RouteChange
+	Announcement TreeAnnouncement
+}
+
+// Tag TreeAnnouncementChanged as an Event
+func (e TreeAnnouncementChanged) isEvent() {}
+
+// InvariantViolated is sent when the invariant checker finds something in
+// the routing state that should have been cleaned up already. Healed is
+// true if the checker repaired it.
+type InvariantViolated struct {
+	Invariant string
+	Detail    string
+	Healed    bool
+}
+
+// Tag InvariantViolated as an Event
+func (e InvariantViolated) isEvent() {}
+
+// StaticPeerGaveUp is sent by the connection manager when it stops trying
+// to connect to a static peer because its reconnect policy allows no more
+// attempts.
+type StaticPeerGaveUp struct {
+	URI      string
+	Attempts int
+	Error    string // Why the last attempt failed
+}
+
+// Tag StaticPeerGaveUp as an Event
+func (e StaticPeerGaveUp) isEvent() {}
+
+// SessionMigrated is sent to session subscribers when the traffic for an
+// open session starts taking a different path, because the next hop
+// towards the remote node changed. The session carries on, but the round
+// trip time may have changed.
+type SessionMigrated struct {
+	PeerID      string // The remote node
+	Protocol    string
+	PreviousHop string // The public key of the old next hop
+	NextHop     string // The public key of the new next hop
+}
+
+// Tag SessionMigrated as an Event
+func (e SessionMigrated) isEvent() {}
@@ -0,0 +1,198 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/matrix-org/pinecone/types"
+	"github.com/matrix-org/pinecone/util"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+// ReservedPeer describes peerings that always have a slot available and
+// are never evicted when the maximum peer count is reached. A peering is
+// reserved if it matches the public key, or if the URI of the peering
+// matches the URI pattern using the syntax of path.Match. Either field can
+// be left empty.
+type ReservedPeer struct {
+	PublicKey  types.PublicKey
+	URIPattern string
+}
+
+func (res ReservedPeer) matches(public types.PublicKey, uri ConnectionURI) bool {
+	if !res.PublicKey.IsEmpty() && res.PublicKey == public {
+		return true
+	}
+	if res.URIPattern == "" || uri == "" {
+		return false
+	}
+	if res.URIPattern == string(uri) {
+		// Literal URIs may contain characters that path.Match would
+		// otherwise treat as part of a pattern, e.g. IPv6 addresses.
+		return true
+	}
+	ok, _ := path.Match(res.URIPattern, string(uri))
+	return ok
+}
+
+// _isReserved returns true if a peering with the given key and URI
+// should be given a reserved slot.
+func (s *state) _isReserved(public types.PublicKey, uri ConnectionURI) bool {
+	for _, res := range s._reserved {
+		if res.matches(public, uri) {
+			return true
+		}
+	}
+	return false
+}
+
+// _peerCount returns the number of running peerings that count towards
+// the maximum peer count, which excludes the local router and reserved
+// peerings.
+func (s *state) _peerCount() int {
+	count := 0
+	for _, p := range s._peers {
+		if p != nil && p != s.r.local && p.started.Load() && !s._isReserved(p.public, p.uri) {
+			count++
+		}
+	}
+	return count
+}
+
+// _hasPeerings returns true if we have at least one running peering.
+func (s *state) _hasPeerings() bool {
+	for _, p := range s._peers {
+		if p != nil && p != s.r.local && p.started.Load() {
+			return true
+		}
+	}
+	return false
+}
+
+// _protectedPeers returns the set of peerings that must never be evicted
+// to make room for another, because losing them would disrupt the tree or
+// the snake: our parent, the source of our descending path and the source
+// of any path that treats us as its descending node. Reserved peerings are
+// also protected.
+func (s *state) _protectedPeers() map[*peer]struct{} {
+	protected := map[*peer]struct{}{}
+	for _, p := range s._peers {
+		if p != nil && s._isReserved(p.public, p.uri) {
+			protected[p] = struct{}{}
+		}
+	}
+	if s._parent != nil {
+		protected[s._parent] = struct{}{}
+	}
+	if desc := s._descending; desc != nil && desc.Source != nil {
+		protected[desc.Source] = struct{}{}
+	}
+	for _, entry := range s._table {
+		if entry.Destination == s.r.local && entry.Source != nil {
+			protected[entry.Source] = struct{}{}
+		}
+	}
+	return protected
+}
+
+// _makeRoomForPeer is called before accepting a new peering when the
+// maximum peer count has been reached. It picks the peering that adds the
+// least to our coverage of the keyspace, i.e. the one whose key is closest
+// to another peered key, and stops it. If the new peering would be the most
+// redundant itself then an error is returned and nothing is evicted.
+func (s *state) _makeRoomForPeer(public types.PublicKey, uri ConnectionURI) error {
+	if s.r.maxPeers <= 0 || s._isReserved(public, uri) || s._peerCount() < s.r.maxPeers {
+		return nil
+	}
+	protected := s._protectedPeers()
+	running := make([]*peer, 0, len(s._peers))
+	for _, p := range s._peers {
+		if p != nil && p != s.r.local && p.started.Load() {
+			running = append(running, p)
+		}
+	}
+
+	victim := chooseEvictionVictim(public, running, protected, func(p *peer) int {
+		return p.quality(s._handshakeFailures[p.public])
+	})
+	if victim == nil {
+		return fmt.Errorf("%w: maximum peer count of %d reached", ErrPeerLimitReached, s.r.maxPeers)
+	}
+	s.r.log.Println("Evicting peer", victim.public.String(), "on port", victim.port, "to make room for", public.String())
+	victim.stop(fmt.Errorf("evicted to make room for another peering"))
+	return nil
+}
+
+// chooseEvictionVictim returns the running peering which is most redundant
+// with another, not counting the protected peerings, or nil if the incoming
+// key would be more redundant than any of them.
+func chooseEvictionVictim(public types.PublicKey, running []*peer, protected map[*peer]struct{}, quality func(*peer) int) *peer {
+	// nearest returns the distance from the key to the closest other
+	// peered key, treating the new peering as peered.
+	nearest := func(key types.PublicKey, self *peer) types.PublicKey {
+		var closest types.PublicKey
+		found := false
+		consider := func(other types.PublicKey) {
+			dist := util.AbsoluteKeyspaceDistance(key, other)
+			if !found || util.LessThan(dist, closest) {
+				closest, found = dist, true
+			}
+		}
+		for _, p := range running {
+			if p != self {
+				consider(p.public)
+			}
+		}
+		if self != nil {
+			consider(public)
+		}
+		if !found {
+			// There's nothing else for the key to be redundant with, so
+			// it is as far away as it could possibly be.
+			for i := range closest {
+				closest[i] = 0xff
+			}
+		}
+		return closest
+	}
+
+	var victim *peer
+	victimDist := nearest(public, nil)
+	victimQuality := MaxPeerQuality + 1
+	for _, p := range running {
+		if _, ok := protected[p]; ok {
+			continue
+		}
+		dist := nearest(p.public, p)
+		switch {
+		case util.LessThan(dist, victimDist):
+		case dist == victimDist && victim != nil:
+			// Equally redundant, so evict whichever of the two has the
+			// worse quality score.
+			if quality(p) >= victimQuality {
+				continue
+			}
+		default:
+			continue
+		}
+		victim, victimDist = p, dist
+		victimQuality = quality(p)
+	}
+	return victim
+}
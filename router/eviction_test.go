@@ -0,0 +1,74 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"testing"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestChooseEvictionVictim(t *testing.T) {
+	a := &peer{public: types.PublicKey{0x10}}
+	b := &peer{public: types.PublicKey{0x11}}
+	c := &peer{public: types.PublicKey{0x80}}
+	running := []*peer{a, b, c}
+	quality := func(p *peer) int {
+		if p == b {
+			return 10
+		}
+		return MaxPeerQuality
+	}
+
+	// a and b are the closest pair, but b has the worse quality.
+	if victim := chooseEvictionVictim(types.PublicKey{0xc0}, running, nil, quality); victim != b {
+		t.Fatalf("expected b to be evicted, got %v", victim)
+	}
+
+	// If b is protected then a is still redundant with it.
+	protected := map[*peer]struct{}{b: {}}
+	if victim := chooseEvictionVictim(types.PublicKey{0xc0}, running, protected, quality); victim != a {
+		t.Fatalf("expected a to be evicted, got %v", victim)
+	}
+
+	// A new key almost identical to c is more redundant than anything
+	// else, so nothing should be evicted.
+	protected = map[*peer]struct{}{a: {}, b: {}}
+	if victim := chooseEvictionVictim(types.PublicKey{0x80, 0x01}, running, protected, quality); victim != nil {
+		t.Fatalf("expected no eviction, got %v", victim)
+	}
+}
+
+func TestReservedPeerMatches(t *testing.T) {
+	key := types.PublicKey{1, 2, 3}
+	tests := []struct {
+		res    ReservedPeer
+		public types.PublicKey
+		uri    ConnectionURI
+		match  bool
+	}{
+		{ReservedPeer{PublicKey: key}, key, "", true},
+		{ReservedPeer{PublicKey: key}, types.PublicKey{4}, "", false},
+		{ReservedPeer{URIPattern: "home.example.com:*"}, types.PublicKey{}, "home.example.com:5000", true},
+		{ReservedPeer{URIPattern: "home.example.com:*"}, types.PublicKey{}, "work.example.com:5000", false},
+		{ReservedPeer{URIPattern: "[::1]:5000"}, types.PublicKey{}, "[::1]:5000", true},
+		{ReservedPeer{}, types.PublicKey{}, "anything", false},
+	}
+	for i, test := range tests {
+		if match := test.res.matches(test.public, test.uri); match != test.match {
+			t.Fatalf("test %d: expected match %v, got %v", i, test.match, match)
+		}
+	}
+}
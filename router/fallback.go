@@ -0,0 +1,140 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+// Traffic that carries the tree coordinates of its destination can be
+// routed either way. By default the tree is tried first and SNEK is only
+// used if the tree has nowhere to send the frame, at which point the
+// coordinates are dropped from the frame so that the rest of the path uses
+// SNEK too. The sender can choose otherwise with a routing preference in
+// the frame header: SNEK first with the tree as the fallback, which is
+// useful while paths are being set up again after the tree has changed and
+// SNEK has nowhere to go, or either one on its own with no fallback. SNEK
+// has nowhere to go if it has no candidate at all, or if the best candidate
+// is us but the frame isn't for us, which happens when the path towards the
+// destination has been torn down. With RouterOptionLoopDemotion, traffic
+// is also routed the other way if the preferred next-hop keeps looping
+// traffic for the destination. Each fallback is counted, so that it is
+// possible to see how much traffic relies on them.
+
+// RoutingFallbacks counts the traffic frames that were routed the other way
+// because their preferred way had nowhere to send them, or was demoted.
+type RoutingFallbacks struct {
+	TreeToSNEK uint64 `json:"tree_to_snek"` // Frames that preferred the tree but were sent using SNEK
+	SNEKToTree uint64 `json:"snek_to_tree"` // Frames that preferred SNEK but were sent using the tree
+	Failed     uint64 `json:"failed"`       // Frames that had nowhere to go either way
+	Demoted    uint64 `json:"demoted"`      // Frames that were routed the other way because their next-hop keeps looping
+}
+
+// RoutingFallbacks returns how many traffic frames we have routed the
+// other way because their preferred way had nowhere to send them.
+func (r *Router) RoutingFallbacks() RoutingFallbacks {
+	var fallbacks RoutingFallbacks
+	phony.Block(r.state, func() {
+		fallbacks = r.state._fallbacks
+	})
+	return fallbacks
+}
+
+// _nextHopsTraffic returns the next-hop for a frame that can be routed using
+// either the tree or SNEK, following the routing preference of the frame.
+func (s *state) _nextHopsTraffic(from *peer, f *types.Frame) (*peer, types.VirtualSnakeWatermark) {
+	tree := func() *peer {
+		if len(f.Destination) == 0 {
+			return nil
+		}
+		nexthop, _ := s._nextHopsFor(from, f.Type, f.Destination, f.Watermark)
+		return nexthop
+	}
+	snek := func() (*peer, types.VirtualSnakeWatermark) {
+		nexthop, watermark := s._nextHopsFor(from, f.Type, f.DestinationKey, f.Watermark)
+		if nexthop == s.r.local && f.DestinationKey != s.r.public {
+			return nil, watermark
+		}
+		return nexthop, watermark
+	}
+
+	demoted := func(nexthop *peer) bool {
+		return f.Type.IsTraffic() && s._loopDemoted(f.DestinationKey, nexthop)
+	}
+
+	switch f.RoutingPreference() {
+	case types.RoutingPreferSNEK:
+		first, watermark := snek()
+		if first != nil && !demoted(first) {
+			return first, watermark
+		}
+		if nexthop := tree(); nexthop != nil && nexthop != first {
+			if first == nil {
+				s._fallbacks.SNEKToTree++
+			} else {
+				s._fallbacks.Demoted++
+			}
+			return nexthop, f.Watermark
+		}
+		if first != nil {
+			return first, watermark
+		}
+
+	case types.RoutingTreeOnly:
+		if nexthop := tree(); nexthop != nil {
+			return nexthop, f.Watermark
+		}
+
+	case types.RoutingSNEKOnly:
+		return s._nextHopsFor(from, f.Type, f.DestinationKey, f.Watermark)
+
+	default:
+		first := tree()
+		if first != nil && !demoted(first) {
+			return first, f.Watermark
+		}
+		if first != nil {
+			// The tree has somewhere to go but it keeps looping traffic
+			// for this destination, so only use SNEK if it goes somewhere
+			// else.
+			if nexthop, watermark := snek(); nexthop != nil && nexthop != first {
+				s._fallbacks.Demoted++
+				f.Destination = f.Destination[:0]
+				return nexthop, watermark
+			}
+			return first, f.Watermark
+		}
+		// Once we've fallen back to SNEK, the rest of the path should use
+		// SNEK too, so the coordinates are no use any more.
+		fellBack := len(f.Destination) > 0
+		f.Destination = f.Destination[:0]
+		nexthop, watermark := s._nextHopsFor(from, f.Type, f.DestinationKey, f.Watermark)
+		switch {
+		case nexthop == nil && f.Type.IsTraffic():
+			s._fallbacks.Failed++
+		case nexthop != nil && fellBack:
+			s._fallbacks.TreeToSNEK++
+		}
+		return nexthop, watermark
+	}
+	if f.Type.IsTraffic() {
+		s._fallbacks.Failed++
+	}
+	return nil, f.Watermark
+}
@@ -0,0 +1,84 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestRoutingPreferenceFallbacks(t *testing.T) {
+	// We are the root and have a single peer below us at coordinates [1].
+	// We have no SNEK paths at all and the peer's key is below the
+	// destination, so SNEK has nowhere to send the traffic but the tree
+	// does.
+	s := newTestState(types.PublicKey{5}, NewManualClock(time.Unix(1000, 0)))
+	s.r.timings = Timings{PathExpiry: time.Minute}
+	child := addTestPeer(s, types.PublicKey{3})
+	announceTestChild(s, child)
+
+	frame := func(preference types.RoutingPreference, coords types.Coordinates) *types.Frame {
+		f := &types.Frame{
+			Type:           types.TypeTraffic,
+			Destination:    coords,
+			DestinationKey: types.PublicKey{4},
+			Watermark:      types.VirtualSnakeWatermark{PublicKey: types.FullMask},
+		}
+		f.SetTrafficClass(types.TrafficClassBulk)
+		f.SetRoutingPreference(preference)
+		return f
+	}
+	for _, tc := range []struct {
+		preference types.RoutingPreference
+		coords     types.Coordinates
+		expected   *peer
+		fallbacks  RoutingFallbacks
+	}{
+		{types.RoutingPreferTree, types.Coordinates{1}, child, RoutingFallbacks{}},
+		{types.RoutingPreferSNEK, types.Coordinates{1}, child, RoutingFallbacks{SNEKToTree: 1}},
+		{types.RoutingPreferSNEK, nil, nil, RoutingFallbacks{SNEKToTree: 1, Failed: 1}},
+		{types.RoutingTreeOnly, nil, nil, RoutingFallbacks{SNEKToTree: 1, Failed: 2}},
+		{types.RoutingSNEKOnly, types.Coordinates{1}, s.r.local, RoutingFallbacks{SNEKToTree: 1, Failed: 2}},
+	} {
+		f := frame(tc.preference, tc.coords)
+		if f.RoutingPreference() != tc.preference || f.TrafficClass() != types.TrafficClassBulk {
+			t.Fatalf("expected the preference and class to be kept apart, got %s and %s", f.RoutingPreference(), f.TrafficClass())
+		}
+		if nexthop, _ := s._nextHopsTraffic(s.r.local, f); nexthop != tc.expected {
+			t.Fatalf("%s with coordinates %v: expected next-hop %v, got %v", tc.preference, tc.coords, tc.expected, nexthop)
+		}
+		if s._fallbacks != tc.fallbacks {
+			t.Fatalf("%s with coordinates %v: expected %+v, got %+v", tc.preference, tc.coords, tc.fallbacks, s._fallbacks)
+		}
+	}
+
+	// Preferring the tree with coordinates that the tree can't reach falls
+	// back to SNEK and drops the coordinates for the rest of the path.
+	s._announcements = announcementTable{}
+	s._table[virtualSnakeIndex{PublicKey: types.PublicKey{4}}] = &virtualSnakeEntry{
+		virtualSnakeIndex: &virtualSnakeIndex{PublicKey: types.PublicKey{4}},
+		Source:            child,
+		LastSeen:          s.r.clock.Now(),
+	}
+	f := frame(types.RoutingPreferTree, types.Coordinates{1})
+	if nexthop, _ := s._nextHopsTraffic(s.r.local, f); nexthop != child || len(f.Destination) != 0 {
+		t.Fatalf("expected to fall back to SNEK, got %v with coordinates %v", nexthop, f.Destination)
+	}
+	if s._fallbacks.TreeToSNEK != 1 {
+		t.Fatalf("expected the fallback to be counted, got %+v", s._fallbacks)
+	}
+}
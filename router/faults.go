@@ -0,0 +1,153 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+	"go.uber.org/atomic"
+)
+
+// Fault injection lets tests see how the network copes with poor links
+// without having to shape real network traffic. Frames on peerings with
+// remote nodes can be dropped, delayed, duplicated or have their payloads
+// corrupted at a few points on their way through the router, each with a
+// configured probability. It is configured with RouterOptionFaultInjection
+// and costs nothing more than a nil check when it isn't.
+
+// FaultPoint is a point in the router at which faults can be injected.
+type FaultPoint int
+
+const (
+	// FaultPreQueue is where a frame is about to be queued for a peer.
+	// Delayed frames are queued later, so they can overtake each other.
+	FaultPreQueue FaultPoint = iota
+	// FaultPreWrite is where a frame has been taken from the queues and is
+	// about to be written to a peer. Delayed frames hold up the peering, as
+	// on a slow link.
+	FaultPreWrite
+	// FaultPostRead is where a frame has been read from a peer and is about
+	// to be handled. Delayed frames are handled later, so they can overtake
+	// each other.
+	FaultPostRead
+	faultPointCount
+)
+
+// FaultStats counts the faults that have been injected by a router.
+type FaultStats struct {
+	Dropped    uint64
+	Delayed    uint64
+	Duplicated uint64
+	Corrupted  uint64
+}
+
+// fault is what should happen to a frame at a fault point.
+type fault struct {
+	drop      bool
+	delay     time.Duration
+	duplicate bool
+	corrupt   int // The index of the payload byte to corrupt, or -1
+}
+
+// faultInjector decides which faults to inject. It is safe to use from any
+// actor or goroutine.
+type faultInjector struct {
+	points     [faultPointCount]*RouterOptionFaultInjection
+	mutex      sync.Mutex
+	random     *rand.Rand // protected by mutex
+	dropped    atomic.Uint64
+	delayed    atomic.Uint64
+	duplicated atomic.Uint64
+	corrupted  atomic.Uint64
+}
+
+func newFaultInjector() *faultInjector {
+	return &faultInjector{
+		random: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// configure sets up the faults for the point in the given option, replacing
+// any that were configured for it before.
+func (i *faultInjector) configure(o RouterOptionFaultInjection) {
+	if o.Point < 0 || o.Point >= faultPointCount {
+		return
+	}
+	i.points[o.Point] = &o
+}
+
+// decide returns what should happen to the given frame at the given point.
+// A dropped frame has no other faults.
+func (i *faultInjector) decide(point FaultPoint, f *types.Frame) fault {
+	result := fault{corrupt: -1}
+	o := i.points[point]
+	if o == nil {
+		return result
+	}
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	if i.random.Float64() < o.Drop {
+		i.dropped.Inc()
+		result.drop = true
+		return result
+	}
+	if o.MaxDelay > 0 && i.random.Float64() < o.Delay {
+		i.delayed.Inc()
+		result.delay = time.Duration(i.random.Int63n(int64(o.MaxDelay))) + 1
+	}
+	if i.random.Float64() < o.Duplicate {
+		i.duplicated.Inc()
+		result.duplicate = true
+	}
+	if len(f.Payload) > 0 && i.random.Float64() < o.Corrupt {
+		i.corrupted.Inc()
+		result.corrupt = i.random.Intn(len(f.Payload))
+	}
+	return result
+}
+
+// apply corrupts the payload of the frame if the fault says to. This has to
+// happen before the frame is duplicated, so that both copies are the same.
+func (f fault) apply(frame *types.Frame) {
+	if f.corrupt >= 0 && f.corrupt < len(frame.Payload) {
+		frame.Payload[f.corrupt] ^= 0xff
+	}
+}
+
+// copyFrame returns a copy of the frame from the frame pool.
+func copyFrame(f *types.Frame) *types.Frame {
+	c := getFrame()
+	f.CopyInto(c)
+	c.Destination = append(c.Destination[:0], f.Destination...)
+	c.Source = append(c.Source[:0], f.Source...)
+	return c
+}
+
+// FaultStats returns the number of faults that have been injected so far.
+// It is always zero unless RouterOptionFaultInjection was given.
+func (r *Router) FaultStats() FaultStats {
+	if r.faults == nil {
+		return FaultStats{}
+	}
+	return FaultStats{
+		Dropped:    r.faults.dropped.Load(),
+		Delayed:    r.faults.delayed.Load(),
+		Duplicated: r.faults.duplicated.Load(),
+		Corrupted:  r.faults.corrupted.Load(),
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !minimal
+// +build !minimal
+
+package router
+
+import (
+	"context"
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func newTestFaultRouters(t *testing.T, opts ...RouterOption) (*Router, *Router) {
+	var routers [2]*Router
+	for i := range routers {
+		_, sk, _ := ed25519.GenerateKey(nil)
+		routers[i] = NewRouter(nil, sk, opts...)
+		r := routers[i]
+		t.Cleanup(func() { _ = r.Close() })
+	}
+	if errA, errB := connectTestRouters(t, routers[0], routers[1]); errA != nil || errB != nil {
+		t.Fatalf("failed to peer routers: %v, %v", errA, errB)
+	}
+	return routers[0], routers[1]
+}
+
+func TestFaultInjectorDecide(t *testing.T) {
+	i := newFaultInjector()
+	i.configure(RouterOptionFaultInjection{Point: FaultPreWrite, Drop: 1})
+	i.configure(RouterOptionFaultInjection{
+		Point:     FaultPostRead,
+		Delay:     1,
+		MaxDelay:  time.Millisecond * 10,
+		Duplicate: 1,
+		Corrupt:   1,
+	})
+	f := &types.Frame{Payload: []byte{1, 2, 3, 4}}
+
+	if fault := i.decide(FaultPreQueue, f); fault.drop || fault.delay != 0 || fault.duplicate || fault.corrupt != -1 {
+		t.Fatalf("expected no faults at an unconfigured point, got %+v", fault)
+	}
+	if fault := i.decide(FaultPreWrite, f); !fault.drop || fault.delay != 0 || fault.duplicate || fault.corrupt != -1 {
+		t.Fatalf("expected only a drop, got %+v", fault)
+	}
+	fault := i.decide(FaultPostRead, f)
+	if fault.drop || fault.delay <= 0 || fault.delay > time.Millisecond*10 || !fault.duplicate {
+		t.Fatalf("expected a delayed duplicate, got %+v", fault)
+	}
+	if fault.corrupt < 0 || fault.corrupt >= len(f.Payload) {
+		t.Fatalf("expected a corrupted payload byte, got %d", fault.corrupt)
+	}
+	before := append([]byte{}, f.Payload...)
+	fault.apply(f)
+	if before[fault.corrupt] == f.Payload[fault.corrupt] {
+		t.Fatalf("expected the payload to be corrupted")
+	}
+	if fault := i.decide(FaultPostRead, &types.Frame{}); fault.corrupt != -1 {
+		t.Fatalf("expected an empty payload not to be corrupted")
+	}
+
+	r := &Router{faults: i}
+	expected := FaultStats{Dropped: 1, Delayed: 2, Duplicated: 2, Corrupted: 1}
+	if stats := r.FaultStats(); stats != expected {
+		t.Fatalf("expected %+v, got %+v", expected, stats)
+	}
+}
+
+func TestFaultInjectionDropsFrames(t *testing.T) {
+	a, b := newTestFaultRouters(t, RouterOptionFaultInjection{Point: FaultPreWrite, Drop: 1})
+
+	// Nothing gets through, so neither node should learn about the other
+	// one's tree.
+	time.Sleep(time.Second * 2)
+	if len(a.Coords()) != 0 || len(b.Coords()) != 0 {
+		t.Fatalf("expected each node to be its own root")
+	}
+	if a.FaultStats().Dropped == 0 || b.FaultStats().Dropped == 0 {
+		t.Fatalf("expected frames to be dropped")
+	}
+}
+
+func TestFaultInjectionDuplicatesAndDelaysFrames(t *testing.T) {
+	var opts []RouterOption
+	for _, point := range []FaultPoint{FaultPreQueue, FaultPreWrite, FaultPostRead} {
+		opts = append(opts, RouterOptionFaultInjection{
+			Point:     point,
+			Delay:     0.5,
+			MaxDelay:  time.Millisecond * 20,
+			Duplicate: 0.5,
+		})
+	}
+	a, b := newTestFaultRouters(t, opts...)
+
+	// The network should still work, just more slowly.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*20)
+	defer cancel()
+	for {
+		attempt, cancelAttempt := context.WithTimeout(ctx, time.Second)
+		result, err := a.Lookup(attempt, b.PublicKey())
+		cancelAttempt()
+		if err == nil && result.Reachable {
+			break
+		}
+		if ctx.Err() != nil {
+			t.Fatalf("expected the remote node to be reachable despite faults")
+		}
+	}
+	if stats := a.FaultStats(); stats.Delayed == 0 || stats.Duplicated == 0 {
+		t.Fatalf("expected frames to be delayed and duplicated, got %+v", stats)
+	}
+}
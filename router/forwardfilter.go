@@ -0,0 +1,144 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+// ForwardInfo describes a frame that is passing through this node on its way
+// between two other nodes.
+type ForwardInfo struct {
+	SourceKey      types.PublicKey
+	DestinationKey types.PublicKey
+	Type           types.FrameType
+	Size           int // Size of the frame payload in bytes
+}
+
+// ForwardAction is the decision that a forward filter makes about a frame.
+type ForwardAction int
+
+const (
+	ForwardAllow     ForwardAction = iota // Forward the frame as normal
+	ForwardDrop                           // Drop the frame
+	ForwardRateLimit                      // Forward the frame unless the source is over its rate
+)
+
+// ForwardDecision is returned by a forward filter. The rate is only used by
+// ForwardRateLimit, and is the number of payload bytes per second that will
+// be forwarded for the source key of the frame. Frames over the rate are
+// dropped rather than delayed.
+type ForwardDecision struct {
+	Action ForwardAction
+	Rate   uint64
+}
+
+// ForwardFilterFn is called for every frame that we forward on behalf of
+// other nodes, but not for frames that we send or receive ourselves. Relay
+// operators can use it to enforce local policy, e.g. refusing to relay bulk
+// traffic. It is called from the router's state actor, so it must not block.
+type ForwardFilterFn func(info ForwardInfo) ForwardDecision
+
+const forwardLimiterMax = 1024
+const forwardLimiterIdle = time.Minute
+
+type forwardLimits map[types.PublicKey]*forwardLimiter
+
+// forwardLimiter is a token bucket that holds up to a second's worth of
+// tokens, or a single maximum-sized payload if that is larger.
+type forwardLimiter struct {
+	tokens float64
+	last   time.Time
+}
+
+func forwardLimiterBurst(rate uint64) float64 {
+	if rate < types.MaxPayloadSize {
+		return types.MaxPayloadSize
+	}
+	return float64(rate)
+}
+
+func (l *forwardLimiter) allow(rate uint64, size int, now time.Time) bool {
+	burst := forwardLimiterBurst(rate)
+	l.tokens += now.Sub(l.last).Seconds() * float64(rate)
+	l.last = now
+	if l.tokens > burst {
+		l.tokens = burst
+	}
+	if l.tokens < float64(size) {
+		return false
+	}
+	l.tokens -= float64(size)
+	return true
+}
+
+// InjectForwardFilter sets a function that decides whether frames that we
+// are forwarding for other nodes should be forwarded, dropped or rate
+// limited. Passing nil removes the filter.
+func (r *Router) InjectForwardFilter(fn ForwardFilterFn) {
+	phony.Block(r.state, func() {
+		r.state._forwardFilter = fn
+		r.state._forwardLimits = forwardLimits{}
+	})
+}
+
+// _forwardFiltered returns true if the forward filter wants the frame to be
+// dropped. Frames that we are sending or that are for us are never filtered.
+func (s *state) _forwardFiltered(from, nexthop *peer, f *types.Frame) bool {
+	if s._forwardFilter == nil || from == s.r.local || nexthop == nil || nexthop == s.r.local {
+		return false
+	}
+	decision := s._forwardFilter(ForwardInfo{
+		SourceKey:      f.SourceKey,
+		DestinationKey: f.DestinationKey,
+		Type:           f.Type,
+		Size:           len(f.Payload),
+	})
+	switch decision.Action {
+	case ForwardDrop:
+		return true
+	case ForwardRateLimit:
+		now := s.r.clock.Now()
+		limiter, ok := s._forwardLimits[f.SourceKey]
+		if !ok {
+			if len(s._forwardLimits) >= forwardLimiterMax {
+				for k, v := range s._forwardLimits {
+					if now.Sub(v.last) >= forwardLimiterIdle {
+						delete(s._forwardLimits, k)
+					}
+				}
+			}
+			if len(s._forwardLimits) >= forwardLimiterMax {
+				// We can't keep track of any more sources, so be strict
+				// rather than letting new sources through unlimited.
+				return true
+			}
+			limiter = &forwardLimiter{
+				tokens: forwardLimiterBurst(decision.Rate),
+				last:   now,
+			}
+			s._forwardLimits[f.SourceKey] = limiter
+		}
+		return !limiter.allow(decision.Rate, len(f.Payload), now)
+	default:
+		return false
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"testing"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestForwardFilter(t *testing.T) {
+	s := newTestState(types.PublicKey{}, systemClock{})
+	local, from, to := s.r.local, &peer{port: 1}, &peer{port: 2}
+	var bulk, banned types.PublicKey
+	bulk[0], banned[0] = 1, 2
+	var seen []ForwardInfo
+	s._forwardFilter = func(info ForwardInfo) ForwardDecision {
+		seen = append(seen, info)
+		switch info.SourceKey {
+		case banned:
+			return ForwardDecision{Action: ForwardDrop}
+		case bulk:
+			return ForwardDecision{Action: ForwardRateLimit, Rate: 1000}
+		default:
+			return ForwardDecision{Action: ForwardAllow}
+		}
+	}
+	s._forwardLimits = forwardLimits{}
+	frame := func(source types.PublicKey, size int) *types.Frame {
+		return &types.Frame{
+			Type:      types.TypeTraffic,
+			SourceKey: source,
+			Payload:   make([]byte, size),
+		}
+	}
+
+	// Frames that we send or receive ourselves are never filtered.
+	if s._forwardFiltered(local, to, frame(banned, 10)) || s._forwardFiltered(from, local, frame(banned, 10)) {
+		t.Fatalf("local frames shouldn't be filtered")
+	}
+	if len(seen) != 0 {
+		t.Fatalf("filter shouldn't be called for local frames")
+	}
+
+	if s._forwardFiltered(from, to, frame(types.PublicKey{}, 10)) {
+		t.Fatalf("allowed frame was dropped")
+	}
+	if !s._forwardFiltered(from, to, frame(banned, 10)) {
+		t.Fatalf("frame from a banned source was forwarded")
+	}
+	if info := seen[len(seen)-1]; info.Size != 10 || info.Type != types.TypeTraffic {
+		t.Fatalf("wrong frame info given to the filter: %+v", info)
+	}
+
+	// The rate limited source can burst up to a maximum sized payload, but
+	// anything more than that is dropped.
+	if s._forwardFiltered(from, to, frame(bulk, types.MaxPayloadSize)) {
+		t.Fatalf("frame within the burst was dropped")
+	}
+	if !s._forwardFiltered(from, to, frame(bulk, 1000)) {
+		t.Fatalf("frame over the rate limit was forwarded")
+	}
+}
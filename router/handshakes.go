@@ -0,0 +1,115 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Each stage of the handshake has to finish within its own timeout, which
+// starts when the stage does, so a remote node can't hold a handshake open
+// by trickling bytes to us. On top of that, the number of handshakes that
+// are in progress at the same time can be limited, both overall and for
+// each remote host, so that many slow connections can't tie up goroutines
+// and file descriptors. Connections whose remote address has no host, such
+// as pipes and unix sockets, only count towards the overall limit.
+
+type handshakeLimiter struct {
+	clock        Clock
+	timeout      time.Duration // How long the key exchange can take
+	certTimeout  time.Duration // How long the certificate exchange can take
+	maxPending   int           // Zero means no limit
+	maxPerSource int           // Zero means no limit
+	mutex        sync.Mutex
+	pending      int
+	sources      map[string]int
+}
+
+func newHandshakeLimiter(o RouterOptionHandshakeLimits, clock Clock) *handshakeLimiter {
+	l := &handshakeLimiter{
+		clock:        clock,
+		timeout:      peerHandshakeTimeout,
+		certTimeout:  peerCertificateTimeout,
+		maxPending:   o.MaxPending,
+		maxPerSource: o.MaxPendingPerSource,
+		sources:      map[string]int{},
+	}
+	if o.Timeout > 0 {
+		l.timeout = o.Timeout
+	}
+	if o.CertificateTimeout > 0 {
+		l.certTimeout = o.CertificateTimeout
+	}
+	return l
+}
+
+// deadline returns the time by which a stage of the handshake that starts
+// now must finish, taking the deadline of the context into account.
+func (l *handshakeLimiter) deadline(ctx context.Context, timeout time.Duration) time.Time {
+	deadline := l.clock.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	return deadline
+}
+
+// acquire reserves a handshake slot for the given connection, returning a
+// function that must be called to release it once the handshake is over.
+func (l *handshakeLimiter) acquire(conn net.Conn) (func(), error) {
+	source := handshakeSource(conn.RemoteAddr())
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.maxPending > 0 && l.pending >= l.maxPending {
+		return nil, fmt.Errorf("%w: %d handshakes in progress", ErrTooManyHandshakes, l.pending)
+	}
+	if source != "" && l.maxPerSource > 0 && l.sources[source] >= l.maxPerSource {
+		return nil, fmt.Errorf("%w: %d handshakes in progress from %s", ErrTooManyHandshakes, l.sources[source], source)
+	}
+	l.pending++
+	if source != "" {
+		l.sources[source]++
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mutex.Lock()
+			defer l.mutex.Unlock()
+			l.pending--
+			if source == "" {
+				return
+			}
+			if l.sources[source]--; l.sources[source] <= 0 {
+				delete(l.sources, source)
+			}
+		})
+	}, nil
+}
+
+// handshakeSource returns the host that a connection came from, or an
+// empty string if the address doesn't have one.
+func handshakeSource(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return ""
+	}
+	return host
+}
@@ -0,0 +1,139 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// addrConn is a connection that claims to come from the given address.
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func TestHandshakeLimiterPerSource(t *testing.T) {
+	l := newHandshakeLimiter(RouterOptionHandshakeLimits{
+		MaxPending:          3,
+		MaxPendingPerSource: 1,
+	}, systemClock{})
+	from := func(addr string) net.Conn {
+		tcp, err := net.ResolveTCPAddr("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return addrConn{remote: tcp}
+	}
+
+	release, err := l.acquire(from("192.0.2.1:1000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = l.acquire(from("192.0.2.1:1001")); !errors.Is(err, ErrTooManyHandshakes) {
+		t.Fatalf("expected second handshake from the same host to be refused, got %v", err)
+	}
+	if _, err = l.acquire(from("192.0.2.2:1000")); err != nil {
+		t.Fatalf("handshake from another host was refused: %v", err)
+	}
+
+	// Connections without a host only count towards the overall limit.
+	pipe, _ := net.Pipe()
+	if _, err = l.acquire(pipe); err != nil {
+		t.Fatalf("handshake over a pipe was refused: %v", err)
+	}
+	if _, err = l.acquire(from("192.0.2.3:1000")); !errors.Is(err, ErrTooManyHandshakes) {
+		t.Fatalf("expected the overall limit to be enforced, got %v", err)
+	}
+
+	// Releasing twice must only free one slot.
+	release()
+	release()
+	if _, err = l.acquire(from("192.0.2.1:1002")); err != nil {
+		t.Fatalf("handshake was refused after the slot was released: %v", err)
+	}
+	if _, err = l.acquire(from("192.0.2.4:1000")); !errors.Is(err, ErrTooManyHandshakes) {
+		t.Fatalf("released slot was counted twice")
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	_, sk, _ := ed25519.GenerateKey(nil)
+	r := NewRouter(nil, sk, RouterOptionHandshakeLimits{
+		Timeout: time.Millisecond * 100,
+	})
+	t.Cleanup(func() { _ = r.Close() })
+
+	// The remote side sends nothing back, like a slowloris.
+	local, remote := net.Pipe()
+	defer remote.Close()
+	go func() {
+		buf := make([]byte, 1)
+		for {
+			if _, err := remote.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	start := time.Now()
+	if _, err := r.Connect(local); !errors.Is(err, ErrHandshakeTimeout) {
+		t.Fatalf("expected ErrHandshakeTimeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > peerHandshakeTimeout/2 {
+		t.Fatalf("handshake took %s despite the configured timeout", elapsed)
+	}
+}
+
+func TestMaxPendingHandshakes(t *testing.T) {
+	_, sk, _ := ed25519.GenerateKey(nil)
+	r := NewRouter(nil, sk, RouterOptionHandshakeLimits{
+		MaxPending: 1,
+	})
+	t.Cleanup(func() { _ = r.Close() })
+
+	// Hold one handshake open until the end of the test.
+	first, remote := net.Pipe()
+	defer remote.Close()
+	go func() {
+		_, _ = r.Connect(first)
+	}()
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		r.handshakes.mutex.Lock()
+		pending := r.handshakes.pending
+		r.handshakes.mutex.Unlock()
+		if pending == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("first handshake didn't start")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	second, other := net.Pipe()
+	defer other.Close()
+	if _, err := r.Connect(second); !errors.Is(err, ErrTooManyHandshakes) {
+		t.Fatalf("expected ErrTooManyHandshakes, got %v", err)
+	}
+}
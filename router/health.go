@@ -0,0 +1,255 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/router/events"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+// When a peering stops, everything that used it is meant to be cleaned up
+// straight away: the paths through it are removed, the descending node is
+// cleared if it came through it and a new parent is chosen if it was our
+// parent. The routing code still skips anything through a stopped peering,
+// so if the cleanup is ever missed, nothing is routed wrongly, but the bug
+// would otherwise go unnoticed. Every time the SNEK is maintained, the
+// invariant checker looks for anything that should have been cleaned up.
+// A peering stops and is cleaned up in the same action, so anything that
+// is still there on two checks in a row is a real violation. Violations
+// are logged, kept for the Health API and sent to subscribers. With
+// RouterOptionSelfHeal, the checker also repairs what it found, by doing
+// the cleanup that was missed.
+//
+// The Health API also sums up whether the node is usable: whether it is
+// in a tree with a root that is still announcing, whether it has found its
+// neighbours in the keyspace and whether any of its peerings are backed up.
+// Ready is true only if all of those are fine, so that it can be used as a
+// readiness probe, e.g. through HealthHandler, and Problems says why not.
+
+// healthMaxViolations is how many violations are kept for the Health API.
+const healthMaxViolations = 32
+
+// The invariants that are checked.
+const (
+	invariantPathSource        = "path_source_stopped"
+	invariantPathDestination   = "path_destination_stopped"
+	invariantDescendingSource  = "descending_source_stopped"
+	invariantParentStopped     = "parent_stopped"
+	invariantStaleAnnouncement = "announcement_from_stopped_peer"
+)
+
+// InvariantViolation describes something in the routing state that should
+// never have happened.
+type InvariantViolation struct {
+	Invariant string    `json:"invariant"`
+	Detail    string    `json:"detail"`
+	At        time.Time `json:"at"`
+	Healed    bool      `json:"healed"` // The checker repaired it
+}
+
+// HealthReport sums up the state of the router, along with what the
+// invariant checker has found.
+type HealthReport struct {
+	Ready      bool                 `json:"ready"`              // Nothing below is wrong
+	Problems   []string             `json:"problems,omitempty"` // Why we aren't ready
+	Peers      int                  `json:"peers"`
+	HasParent  bool                 `json:"has_parent"`
+	IsRoot     bool                 `json:"is_root"`
+	Root       types.PublicKey      `json:"root"`
+	RootFresh  bool                 `json:"root_fresh"` // The root is still announcing, or we are the root
+	RootAge    time.Duration        `json:"root_age"`   // Since the parent's last announcement
+	Ascending  bool                 `json:"ascending"`  // Our bootstrap has been confirmed
+	Descending bool                 `json:"descending"` // We have a path from the next lowest key
+	Saturated  []types.SwitchPortID `json:"saturated,omitempty"`
+	Healthy    bool                 `json:"healthy"` // The last invariant check found nothing wrong
+	Checked    time.Time            `json:"checked"`
+	Violations []InvariantViolation `json:"violations,omitempty"` // Oldest first
+	Total      uint64               `json:"total"`                // Violations found since we started
+	Healed     uint64               `json:"healed"`               // Violations repaired since we started
+}
+
+type healthTracker struct {
+	checked    time.Time
+	healthy    bool
+	suspects   map[string]struct{} // Violations seen on the last check
+	violations []InvariantViolation
+	total      uint64
+	healed     uint64
+}
+
+// _checkInvariants looks for anything in the routing state that should
+// have been cleaned up already. It is called during SNEK maintenance.
+func (s *state) _checkInvariants() {
+	h := &s._health
+	suspects := map[string]struct{}{}
+	found := false
+	check := func(invariant, detail string, heal func()) {
+		id := invariant + " " + detail
+		suspects[id] = struct{}{}
+		if _, ok := h.suspects[id]; ok {
+			found = true
+			s._invariantViolated(invariant, detail, heal)
+		}
+	}
+
+	for k, v := range s._table {
+		k := k
+		heal := func() { s._removeRouteEntry(k, "invariant checker") }
+		if v.Source != nil && v.Source != s.r.local && !v.Source.started.Load() {
+			check(invariantPathSource, fmt.Sprintf("path %s from port %d", k.PublicKey, v.Source.port), heal)
+		}
+		if v.Destination != nil && v.Destination != s.r.local && !v.Destination.started.Load() {
+			check(invariantPathDestination, fmt.Sprintf("path %s to port %d", k.PublicKey, v.Destination.port), heal)
+		}
+	}
+	if desc := s._descending; desc != nil && desc.Source != nil && desc.Source != s.r.local && !desc.Source.started.Load() {
+		check(invariantDescendingSource, fmt.Sprintf("descending node %s via port %d", desc.PublicKey, desc.Source.port), func() {
+			s._setDescendingNode(nil)
+		})
+	}
+	if p := s._parent; p != nil && !p.started.Load() {
+		check(invariantParentStopped, fmt.Sprintf("parent on port %d", p.port), func() {
+			if s._selectNewParent() {
+				s._bootstrapSoon()
+			}
+		})
+	}
+	for p := range s._announcements {
+		if p == nil || p.started.Load() {
+			continue
+		}
+		p := p
+		check(invariantStaleAnnouncement, fmt.Sprintf("announcement from port %d", p.port), func() {
+			s._forgetAnnouncement(p)
+		})
+	}
+
+	h.suspects = suspects
+	h.checked = s.r.clock.Now()
+	h.healthy = !found
+}
+
+// _invariantViolated records a violation and, with RouterOptionSelfHeal,
+// repairs it.
+func (s *state) _invariantViolated(invariant, detail string, heal func()) {
+	h := &s._health
+	violation := InvariantViolation{
+		Invariant: invariant,
+		Detail:    detail,
+		At:        s.r.clock.Now(),
+	}
+	if s.r.selfHeal && heal != nil {
+		heal()
+		violation.Healed = true
+		h.healed++
+	}
+	h.total++
+	if len(h.violations) >= healthMaxViolations {
+		h.violations = append(h.violations[:0], h.violations[1:]...)
+	}
+	h.violations = append(h.violations, violation)
+	s.r.log.Printf("Routing invariant %q violated: %s (healed: %v)", invariant, detail, violation.Healed)
+	s._recordEvent(ProtocolInvariantViolated, types.PublicKey{}, nil, invariant+": "+detail)
+	s.r.Act(nil, func() {
+		s.r._publish(events.InvariantViolated{
+			Invariant: violation.Invariant,
+			Detail:    violation.Detail,
+			Healed:    violation.Healed,
+		})
+	})
+}
+
+// Health returns a summary of the state of the router and what the
+// invariant checker has found in the routing state.
+func (r *Router) Health() HealthReport {
+	var report HealthReport
+	phony.Block(r.state, func() {
+		report = r.state._healthReport()
+	})
+	return report
+}
+
+// HealthHandler serves the health report as JSON, with status 200 if the
+// router is ready and 503 if not, for use as a readiness probe.
+func (r *Router) HealthHandler(w http.ResponseWriter, req *http.Request) {
+	report := r.Health()
+	w.Header().Set("Content-Type", "application/json")
+	if !report.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	_ = encoder.Encode(report)
+}
+
+func (s *state) _healthReport() HealthReport {
+	h := &s._health
+	report := HealthReport{
+		Healthy:    h.healthy || h.checked.IsZero(),
+		Checked:    h.checked,
+		Violations: append([]InvariantViolation(nil), h.violations...),
+		Total:      h.total,
+		Healed:     h.healed,
+	}
+	for _, p := range s._peers {
+		if p == nil || p == s.r.local || !p.started.Load() {
+			continue
+		}
+		report.Peers++
+		alarmed := p._queueAlarms[0].raised || p._queueAlarms[1].raised
+		if alarmed || p.congested.Load() || saturated(p.proto) || saturated(p.traffic) {
+			report.Saturated = append(report.Saturated, p.port)
+		}
+	}
+	ann := s._rootAnnouncement()
+	report.Root = ann.RootPublicKey
+	report.HasParent = s._parent != nil
+	report.IsRoot = report.Root == s.r.public
+	if report.IsRoot {
+		report.RootFresh = true
+	} else {
+		report.RootAge = since(s.r.clock, ann.receiveTime)
+		report.RootFresh = report.RootAge < s.r.timings.AnnouncementTimeout
+	}
+	report.Ascending = !s._ascendingKey().IsEmpty()
+	report.Descending = s._descending != nil && s._descending.valid(s.r.clock.Now(), s.r.timings.PathExpiry)
+
+	problem := func(failed bool, reason string) {
+		if failed {
+			report.Problems = append(report.Problems, reason)
+		}
+	}
+	problem(report.Peers == 0, "no peers")
+	problem(!report.RootFresh, "root announcements have stopped")
+	problem(report.Peers > 0 && !report.IsRoot && !report.Ascending, "no confirmed ascending path")
+	problem(len(report.Saturated) > 0, "peerings are saturated")
+	problem(!report.Healthy, "routing invariants violated")
+	report.Ready = len(report.Problems) == 0
+	return report
+}
+
+// saturated returns true if the queue is full.
+func saturated(q queue) bool {
+	return q != nil && q.queuesize() > 0 && q.queuecount() >= q.queuesize()
+}
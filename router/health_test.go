@@ -0,0 +1,120 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func testHealthState(selfHeal bool) (*state, *peer) {
+	s := newTestState(types.PublicKey{}, NewManualClock(time.Unix(1000, 0)))
+	s.r.selfHeal = selfHeal
+	running := addTestPeer(s, types.PublicKey{1})
+	stopped := addTestPeer(s, types.PublicKey{2})
+	stopped.started.Store(false)
+	entry := &virtualSnakeEntry{
+		virtualSnakeIndex: &virtualSnakeIndex{PublicKey: types.PublicKey{9}},
+		Source:            stopped,
+		Destination:       running,
+	}
+	s._table[*entry.virtualSnakeIndex] = entry
+	s._descending = entry
+	return s, stopped
+}
+
+func TestInvariantChecker(t *testing.T) {
+	s, _ := testHealthState(false)
+
+	// The first sighting might be a peering that is stopping right now.
+	s._checkInvariants()
+	if report := s._healthReport(); !report.Healthy || report.Total != 0 {
+		t.Fatalf("expected nothing to be reported yet, got %+v", report)
+	}
+
+	s._checkInvariants()
+	report := s._healthReport()
+	if report.Healthy || report.Total != 2 || report.Healed != 0 {
+		t.Fatalf("expected two violations to be reported, got %+v", report)
+	}
+	if report.Violations[0].Invariant != invariantPathSource || report.Violations[1].Invariant != invariantDescendingSource {
+		t.Fatalf("unexpected violations %+v", report.Violations)
+	}
+	if len(s._table) != 1 || s._descending == nil {
+		t.Fatalf("expected the routing state to be left alone")
+	}
+	if events := s._history.query(ProtocolHistoryQuery{Kind: ProtocolInvariantViolated}); len(events) != 2 {
+		t.Fatalf("expected two violations in the history, got %d", len(events))
+	}
+}
+
+func TestInvariantCheckerSelfHeal(t *testing.T) {
+	s, _ := testHealthState(true)
+	s._checkInvariants()
+	s._checkInvariants()
+	report := s._healthReport()
+	if report.Total != 2 || report.Healed != 2 {
+		t.Fatalf("expected two violations to be healed, got %+v", report)
+	}
+	if len(s._table) != 0 || s._descending != nil {
+		t.Fatalf("expected the stale path and descending node to be removed")
+	}
+
+	// Once healed, the next check finds nothing.
+	s._checkInvariants()
+	if report := s._healthReport(); !report.Healthy || report.Total != 2 {
+		t.Fatalf("expected the routing state to be healthy again, got %+v", report)
+	}
+}
+
+func TestHealthReadiness(t *testing.T) {
+	s, stopped := testHealthState(false)
+	s.r.timings = Timings{AnnouncementTimeout: time.Minute, PathExpiry: time.Minute}
+	s.r.public = types.PublicKey{5}
+	delete(s._table, *s._descending.virtualSnakeIndex)
+	s._descending = nil
+	running := s._peers[1]
+
+	// We are the root, but haven't got any peers yet.
+	stopped.started.Store(true)
+	stopped.congested.Store(true)
+	report := s._healthReport()
+	if report.Ready || !report.IsRoot || !report.RootFresh || len(report.Saturated) != 1 || report.Saturated[0] != stopped.port {
+		t.Fatalf("expected the congested peering to stop us being ready, got %+v", report)
+	}
+
+	// Under a parent whose root has gone quiet, with no ascending path.
+	stopped.congested.Store(false)
+	s._parent = running
+	s._announcements = announcementTable{
+		running: &rootAnnouncementWithTime{
+			SwitchAnnouncement: types.SwitchAnnouncement{Root: types.Root{RootPublicKey: types.PublicKey{9}}},
+			receiveTime:        s.r.clock.Now().Add(-time.Hour),
+		},
+	}
+	report = s._healthReport()
+	if report.Ready || report.IsRoot || report.RootFresh || report.Ascending || len(report.Problems) != 2 {
+		t.Fatalf("expected a stale root and no ascending path, got %+v", report)
+	}
+
+	// Once the root is fresh and our bootstrap is confirmed, we're ready.
+	s._announcements[running].receiveTime = s.r.clock.Now()
+	s._bootstrapConfirm = &bootstrapConfirmation{PublicKey: types.PublicKey{9}, At: s.r.clock.Now()}
+	if report = s._healthReport(); !report.Ready {
+		t.Fatalf("expected to be ready, got %+v", report)
+	}
+}
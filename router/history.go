@@ -0,0 +1,332 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+// The protocol history remembers the last few significant things that the
+// routing state did, such as installing or removing a path and why, so that
+// questions like "why did my path go away at 14:32?" can be answered after
+// the fact. It is a fixed-size ring buffer owned by the state actor, so the
+// oldest events are forgotten first, and it survives the state being reset.
+//
+// Each bootstrap, along with the acknowledgements, confirmation and path
+// entries that it leads to, is identified by a PathID, which is the key of
+// the node that sent it and its sequence number. Every node that sees the
+// bootstrap tags its events with the same PathID, so the history of one
+// path can be followed from node to node, including which node rejected it
+// and why.
+
+// protocolHistoryDefault is how many events are kept, unless a different
+// number is given with RouterOptionProtocolHistory.
+const protocolHistoryDefault = 512
+
+// ProtocolEventKind describes what happened in a ProtocolEvent.
+type ProtocolEventKind string
+
+const (
+	// ProtocolBootstrapSent is one of our bootstraps being sent.
+	ProtocolBootstrapSent ProtocolEventKind = "bootstrap_sent"
+	// ProtocolBootstrapReceived is a bootstrap ending with us.
+	ProtocolBootstrapReceived ProtocolEventKind = "bootstrap_received"
+	// ProtocolBootstrapAcknowledged is a peer acknowledging a bootstrap
+	// that we sent or forwarded to it.
+	ProtocolBootstrapAcknowledged ProtocolEventKind = "bootstrap_acknowledged"
+	// ProtocolBootstrapRetransmitted is a bootstrap being sent to a peer
+	// again because it wasn't acknowledged.
+	ProtocolBootstrapRetransmitted ProtocolEventKind = "bootstrap_retransmitted"
+	// ProtocolBootstrapLost is us giving up on a peer acknowledging a
+	// bootstrap.
+	ProtocolBootstrapLost ProtocolEventKind = "bootstrap_lost"
+	// ProtocolBootstrapConfirmed is one of our bootstraps being confirmed
+	// by the node that took us as its descending node.
+	ProtocolBootstrapConfirmed ProtocolEventKind = "bootstrap_confirmed"
+	// ProtocolBootstrapFailed is one of our bootstraps failing. The reason
+	// says why.
+	ProtocolBootstrapFailed ProtocolEventKind = "bootstrap_failed"
+	// ProtocolRefreshSent is us refreshing our path instead of sending a
+	// new bootstrap.
+	ProtocolRefreshSent ProtocolEventKind = "refresh_sent"
+	// ProtocolConfirmSent is us confirming a bootstrap that ended with us.
+	ProtocolConfirmSent ProtocolEventKind = "confirm_sent"
+	// ProtocolConfirmIgnored is a confirmation of one of our bootstraps
+	// being ignored. The reason says why.
+	ProtocolConfirmIgnored ProtocolEventKind = "confirm_ignored"
+	// ProtocolDescendingChanged is the node that sent a bootstrap becoming
+	// our descending node, or staying as it. The reason says which rule
+	// applied.
+	ProtocolDescendingChanged ProtocolEventKind = "descending_changed"
+	// ProtocolDescendingRefused is a bootstrap that ended with us not
+	// making its sender our descending node. The reason says which rule
+	// applied.
+	ProtocolDescendingRefused ProtocolEventKind = "descending_refused"
+	// ProtocolPathInstalled is a path being added to our routing table or
+	// refreshed.
+	ProtocolPathInstalled ProtocolEventKind = "path_installed"
+	// ProtocolPathRefreshed is a path in our routing table being kept alive
+	// by a refresh from the node that bootstrapped it.
+	ProtocolPathRefreshed ProtocolEventKind = "path_refreshed"
+	// ProtocolPathRejected is a bootstrap or refresh that didn't install
+	// or refresh a path. The reason says why.
+	ProtocolPathRejected ProtocolEventKind = "path_rejected"
+	// ProtocolPathRemoved is a path being removed from our routing table.
+	// The reason says why.
+	ProtocolPathRemoved ProtocolEventKind = "path_removed"
+	// ProtocolConverged is us finding a stable pair of SNEK neighbours after
+	// our parent or root changed. The reason says how long it took.
+	ProtocolConverged ProtocolEventKind = "converged"
+	// ProtocolParentChanged is our parent in the tree changing. The key is
+	// the new parent, or empty if we are now the root.
+	ProtocolParentChanged ProtocolEventKind = "parent_changed"
+	// ProtocolRootMisbehaving is a root doing something that a well-behaved
+	// root never would. The key is the root and the reason says what it did.
+	ProtocolRootMisbehaving ProtocolEventKind = "root_misbehaving"
+	// ProtocolAdjacencyInconsistent is a node's signed statement about its
+	// keyspace neighbours disagreeing with what we know. The key is the
+	// node and the reason says how it disagreed.
+	ProtocolAdjacencyInconsistent ProtocolEventKind = "adjacency_inconsistent"
+	// ProtocolLoadLevelChanged is us starting or stopping shedding load.
+	// The reason gives the new level and the load that caused it.
+	ProtocolLoadLevelChanged ProtocolEventKind = "load_level_changed"
+	// ProtocolInvariantViolated is the invariant checker finding something
+	// in the routing state that should have been cleaned up already. The
+	// reason says what it found.
+	ProtocolInvariantViolated ProtocolEventKind = "invariant_violated"
+	// ProtocolDraining is us starting to drain before leaving the network.
+	ProtocolDraining ProtocolEventKind = "draining"
+	// ProtocolPeerDeparting is a peer telling us that it is about to leave
+	// the network. The key is the peer.
+	ProtocolPeerDeparting ProtocolEventKind = "peer_departing"
+)
+
+// PathID identifies a bootstrap and everything that follows from it.
+type PathID struct {
+	PublicKey types.PublicKey `json:"public_key"` // The node that sent the bootstrap
+	Sequence  types.Varu64    `json:"sequence"`
+}
+
+func (p PathID) String() string {
+	return fmt.Sprintf("%s/%d", p.PublicKey, p.Sequence)
+}
+
+// ParsePathID parses a PathID in the form returned by PathID.String.
+func ParsePathID(s string) (PathID, error) {
+	var id PathID
+	key, sequence, ok := strings.Cut(s, "/")
+	if !ok {
+		return id, fmt.Errorf("path ID %q has no sequence number", s)
+	}
+	decoded, err := hex.DecodeString(key)
+	if err != nil || len(decoded) != len(id.PublicKey) {
+		return id, fmt.Errorf("path ID %q has an invalid key", s)
+	}
+	copy(id.PublicKey[:], decoded)
+	parsed, err := strconv.ParseUint(sequence, 10, 64)
+	if err != nil {
+		return id, fmt.Errorf("path ID %q has an invalid sequence number", s)
+	}
+	id.Sequence = types.Varu64(parsed)
+	return id, nil
+}
+
+// ProtocolEvent is something significant that the routing state did. The
+// key is the node that the event is about, which for events to do with a
+// path is the node that sent the bootstrap, and for parent changes is the
+// new parent.
+type ProtocolEvent struct {
+	Time   time.Time          `json:"time"`
+	Kind   ProtocolEventKind  `json:"kind"`
+	Key    types.PublicKey    `json:"key"`
+	Path   *PathID            `json:"path,omitempty"` // The path that the event belongs to, if any
+	Port   types.SwitchPortID `json:"port,omitempty"` // The peer that was involved, if any
+	Reason string             `json:"reason,omitempty"`
+}
+
+// ProtocolHistoryQuery selects events from the protocol history. Zero
+// fields match every event.
+type ProtocolHistoryQuery struct {
+	Since time.Time         // Only events at or after this time
+	Until time.Time         // Only events before this time
+	Kind  ProtocolEventKind // Only events of this kind
+	Key   types.PublicKey   // Only events about this node
+	Path  *PathID           // Only events belonging to this path
+}
+
+func (q *ProtocolHistoryQuery) matches(e *ProtocolEvent) bool {
+	switch {
+	case !q.Since.IsZero() && e.Time.Before(q.Since):
+		return false
+	case !q.Until.IsZero() && !e.Time.Before(q.Until):
+		return false
+	case q.Kind != "" && e.Kind != q.Kind:
+		return false
+	case !q.Key.IsEmpty() && e.Key != q.Key:
+		return false
+	case q.Path != nil && (e.Path == nil || *e.Path != *q.Path):
+		return false
+	}
+	return true
+}
+
+type protocolHistory struct {
+	events []ProtocolEvent
+	next   int  // Where the next event will be written
+	full   bool // Has the buffer wrapped around?
+}
+
+func newProtocolHistory(size int) *protocolHistory {
+	if size <= 0 {
+		return nil
+	}
+	return &protocolHistory{
+		events: make([]ProtocolEvent, size),
+	}
+}
+
+func (h *protocolHistory) add(e ProtocolEvent) {
+	h.events[h.next] = e
+	h.next++
+	if h.next == len(h.events) {
+		h.next, h.full = 0, true
+	}
+}
+
+// query returns the matching events, oldest first.
+func (h *protocolHistory) query(q ProtocolHistoryQuery) []ProtocolEvent {
+	var result []ProtocolEvent
+	start, count := 0, h.next
+	if h.full {
+		start, count = h.next, len(h.events)
+	}
+	for i := 0; i < count; i++ {
+		e := &h.events[(start+i)%len(h.events)]
+		if q.matches(e) {
+			result = append(result, *e)
+		}
+	}
+	return result
+}
+
+// _recordEvent adds an event to the protocol history, if it is enabled.
+func (s *state) _recordEvent(kind ProtocolEventKind, key types.PublicKey, p *peer, reason string) {
+	s._record(ProtocolEvent{Kind: kind, Key: key, Reason: reason}, p)
+}
+
+// _recordPathEvent adds an event belonging to the given path to the
+// protocol history, if it is enabled.
+func (s *state) _recordPathEvent(kind ProtocolEventKind, path PathID, p *peer, reason string) {
+	s._record(ProtocolEvent{Kind: kind, Key: path.PublicKey, Path: &path, Reason: reason}, p)
+}
+
+func (s *state) _record(e ProtocolEvent, p *peer) {
+	if s._history == nil && s._stateLog == nil {
+		return
+	}
+	e.Time = s.r.clock.Now()
+	if p != nil {
+		e.Port = p.port
+	}
+	if s._history != nil {
+		s._history.add(e)
+	}
+	if s._stateLog != nil {
+		s._stateLog.log(s.r.log, &e)
+	}
+}
+
+// ProtocolHistory returns the events in the protocol history that match the
+// query, oldest first.
+func (r *Router) ProtocolHistory(q ProtocolHistoryQuery) []ProtocolEvent {
+	var result []ProtocolEvent
+	phony.Block(r.state, func() {
+		if r.state._history != nil {
+			result = r.state._history.query(q)
+		}
+	})
+	return result
+}
+
+// PathTimeline returns the events in the protocol history that belong to
+// the given path, oldest first. Other nodes that the bootstrap passed
+// through have their own timelines for the same path.
+func (r *Router) PathTimeline(path PathID) []ProtocolEvent {
+	return r.ProtocolHistory(ProtocolHistoryQuery{Path: &path})
+}
+
+// ProtocolHistoryHandler serves the protocol history as JSON. The events
+// can be filtered with the "since" and "until" parameters, which are
+// RFC 3339 times, the "kind" parameter, the "key" parameter, which is a
+// hex-encoded public key, and the "path" parameter, which is a PathID.
+func (r *Router) ProtocolHistoryHandler(w http.ResponseWriter, req *http.Request) {
+	q, err := parseProtocolHistoryQuery(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	events := r.ProtocolHistory(q)
+	if events == nil {
+		events = []ProtocolEvent{}
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(events); err != nil {
+		w.WriteHeader(500)
+		return
+	}
+}
+
+func parseProtocolHistoryQuery(req *http.Request) (ProtocolHistoryQuery, error) {
+	var q ProtocolHistoryQuery
+	values := req.URL.Query()
+	for name, t := range map[string]*time.Time{"since": &q.Since, "until": &q.Until} {
+		if v := values.Get(name); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return q, fmt.Errorf("invalid %q time: %w", name, err)
+			}
+			*t = parsed
+		}
+	}
+	q.Kind = ProtocolEventKind(values.Get("kind"))
+	if v := values.Get("key"); v != "" {
+		key, err := hex.DecodeString(v)
+		if err != nil || len(key) != len(q.Key) {
+			return q, fmt.Errorf("invalid key %q", v)
+		}
+		copy(q.Key[:], key)
+	}
+	if v := values.Get("path"); v != "" {
+		path, err := ParsePathID(v)
+		if err != nil {
+			return q, err
+		}
+		q.Path = &path
+	}
+	return q, nil
+}
@@ -0,0 +1,152 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !minimal
+// +build !minimal
+
+package router
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestProtocolHistoryRing(t *testing.T) {
+	h := newProtocolHistory(3)
+	start := time.Now()
+	var key types.PublicKey
+	key[0] = 1
+	for i := 0; i < 5; i++ {
+		kind := ProtocolPathInstalled
+		if i%2 == 1 {
+			kind = ProtocolPathRemoved
+		}
+		h.add(ProtocolEvent{Time: start.Add(time.Duration(i) * time.Second), Kind: kind, Port: types.SwitchPortID(i)})
+	}
+	h.events[2].Key = key
+
+	all := h.query(ProtocolHistoryQuery{})
+	if len(all) != 3 {
+		t.Fatalf("expected 3 events, got %d", len(all))
+	}
+	for i, e := range all {
+		if e.Port != types.SwitchPortID(i+2) {
+			t.Fatalf("expected the oldest events to be forgotten first, got %v", all)
+		}
+	}
+	if removed := h.query(ProtocolHistoryQuery{Kind: ProtocolPathRemoved}); len(removed) != 1 || removed[0].Port != 3 {
+		t.Fatalf("expected to find one removal, got %v", removed)
+	}
+	if since := h.query(ProtocolHistoryQuery{Since: start.Add(time.Second * 3)}); len(since) != 2 {
+		t.Fatalf("expected 2 events since the given time, got %v", since)
+	}
+	if until := h.query(ProtocolHistoryQuery{Until: start.Add(time.Second * 3)}); len(until) != 1 {
+		t.Fatalf("expected 1 event until the given time, got %v", until)
+	}
+	if keyed := h.query(ProtocolHistoryQuery{Key: key}); len(keyed) != 1 || keyed[0].Port != 2 {
+		t.Fatalf("expected to find one event about the key, got %v", keyed)
+	}
+	if newProtocolHistory(-1) != nil {
+		t.Fatalf("expected a negative size to disable the history")
+	}
+}
+
+func TestProtocolHistoryRecordsEvents(t *testing.T) {
+	low, high := newTestRouterPair(t)
+
+	// The lower key should take the higher key as its parent and then
+	// bootstrap towards it, which installs a path at the higher key.
+	deadline := time.Now().Add(time.Second * 10)
+	for len(high.ProtocolHistory(ProtocolHistoryQuery{Kind: ProtocolPathInstalled, Key: low.PublicKey()})) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected a path to be installed")
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	parents := low.ProtocolHistory(ProtocolHistoryQuery{Kind: ProtocolParentChanged, Key: high.PublicKey()})
+	if len(parents) == 0 || parents[0].Port == 0 || parents[0].Reason == "" {
+		t.Fatalf("expected a parent change with a port and reason, got %v", parents)
+	}
+	if sent := low.ProtocolHistory(ProtocolHistoryQuery{Kind: ProtocolBootstrapSent}); len(sent) == 0 {
+		t.Fatalf("expected a bootstrap to be sent")
+	}
+
+	w := httptest.NewRecorder()
+	high.ProtocolHistoryHandler(w, httptest.NewRequest("GET", "/?kind=path_installed&key="+low.PublicKey().String(), nil))
+	var served []ProtocolEvent
+	if err := json.NewDecoder(w.Body).Decode(&served); err != nil {
+		t.Fatal(err)
+	}
+	if len(served) == 0 || served[0].Kind != ProtocolPathInstalled || served[0].Key != low.PublicKey() {
+		t.Fatalf("expected the handler to serve the installed path, got %v", served)
+	}
+	w = httptest.NewRecorder()
+	high.ProtocolHistoryHandler(w, httptest.NewRequest("GET", "/?since=yesterday", nil))
+	if w.Code != 400 {
+		t.Fatalf("expected a bad query to be refused, got %d", w.Code)
+	}
+}
+
+func TestPathIDString(t *testing.T) {
+	var id PathID
+	id.PublicKey[0], id.PublicKey[31] = 0xab, 0xcd
+	id.Sequence = 1234567
+	parsed, err := ParsePathID(id.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed != id {
+		t.Fatalf("expected %s, got %s", id, parsed)
+	}
+	for _, invalid := range []string{"", "abcd/1", id.PublicKey.String(), id.PublicKey.String() + "/x"} {
+		if _, err := ParsePathID(invalid); err == nil {
+			t.Fatalf("expected %q to be refused", invalid)
+		}
+	}
+}
+
+func TestPathTimelineRecordsDecisions(t *testing.T) {
+	low, high := newTestRouterPair(t)
+
+	// The higher key is the root, so the lower key bootstraps to it and it
+	// should take the lower key as its descending node and confirm.
+	deadline := time.Now().Add(time.Second * 10)
+	for {
+		confirmed := low.ProtocolHistory(ProtocolHistoryQuery{Kind: ProtocolBootstrapConfirmed})
+		if len(confirmed) > 0 {
+			path := *confirmed[0].Path
+			kinds := map[ProtocolEventKind]string{}
+			for _, e := range high.PathTimeline(path) {
+				kinds[e.Kind] = e.Reason
+			}
+			for _, kind := range []ProtocolEventKind{ProtocolBootstrapReceived, ProtocolPathInstalled, ProtocolDescendingChanged, ProtocolConfirmSent} {
+				if _, ok := kinds[kind]; !ok {
+					t.Fatalf("expected %s in the timeline of path %s, got %v", kind, path, kinds)
+				}
+			}
+			if kinds[ProtocolDescendingChanged] == "" {
+				t.Fatalf("expected the descending node rule to be recorded")
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected a bootstrap to be confirmed")
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+}
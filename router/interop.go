@@ -0,0 +1,62 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"github.com/matrix-org/pinecone/types"
+)
+
+// Frame types are only ever added to the end of the list, so an older
+// implementation knows every frame type up to some point and none after it.
+// New frame types can only be sent to older nodes if they are safe for them
+// to drop, and the handshake has to keep working with nodes that don't know
+// about the newer capabilities or wire features. RouterOptionWireProfile
+// pins a router to what an older implementation knew, so that the rest of
+// the network can be tested against it before a wire format change ships.
+
+// wireProfile is what an older implementation knew about the wire format.
+type wireProfile struct {
+	lastType     types.FrameType
+	pinned       bool     // Are the capabilities pinned?
+	capabilities uint32   // The capabilities to advertise if pinned
+	unknown      []string // Capability names that we didn't recognise
+}
+
+func newWireProfile(o RouterOptionWireProfile) *wireProfile {
+	profile := &wireProfile{
+		lastType: o.LastFrameType,
+		pinned:   o.Capabilities != nil,
+	}
+	for _, name := range o.Capabilities {
+		found := false
+		for _, c := range capabilityNames {
+			if c.name == name {
+				profile.capabilities |= c.flag
+				found = true
+				break
+			}
+		}
+		if !found {
+			profile.unknown = append(profile.unknown, name)
+		}
+	}
+	return profile
+}
+
+// understands returns true if the frame type is one that we know about,
+// which is all of them unless the router is pinned to a wire profile.
+func (r *Router) understands(t types.FrameType) bool {
+	return r.wireProfile == nil || t <= r.wireProfile.lastType
+}
@@ -0,0 +1,120 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestWireProfileInterop(t *testing.T) {
+	newRouter := func(options ...RouterOption) *Router {
+		_, sk, _ := ed25519.GenerateKey(nil)
+		r := NewRouter(nil, sk, options...)
+		t.Cleanup(func() { _ = r.Close() })
+		return r
+	}
+	older := newRouter(
+		RouterOptionStrictDecoding(true),
+		RouterOptionWireProfile{LastFrameType: types.TypeWakeupBroadcast},
+	)
+	newer := newRouter(RouterOptionJumboFrames(65535), RouterOptionCompactFrames(true))
+	if errA, errB := connectTestRouters(t, older, newer); errA != nil || errB != nil {
+		t.Fatalf("failed to peer: %v, %v", errA, errB)
+	}
+
+	peered := func(r, with *Router) (PeerInfo, bool) {
+		for _, info := range r.Peers() {
+			if info.PublicKey == with.PublicKey().String() {
+				return info, true
+			}
+		}
+		return PeerInfo{}, false
+	}
+	info, ok := peered(newer, older)
+	if !ok {
+		t.Fatalf("expected the nodes to be peered")
+	}
+	if info.JumboFrames != 0 || info.CompactFrames || len(info.WireFeatures) != 0 {
+		t.Fatalf("expected no wire features to be negotiated, got %+v", info)
+	}
+
+	// Both nodes must agree on the root, which is only possible if the tree
+	// announcements are getting through in both directions.
+	rootOf := func(r *Router) (key types.PublicKey) {
+		phony.Block(r.state, func() {
+			key = r.state._rootAnnouncement().RootPublicKey
+		})
+		return
+	}
+	root := older.PublicKey()
+	if newer.PublicKey().CompareTo(root) > 0 {
+		root = newer.PublicKey()
+	}
+	deadline := time.Now().Add(time.Second * 10)
+	for rootOf(older) != root || rootOf(newer) != root {
+		if time.Now().After(deadline) {
+			t.Fatalf("didn't converge on root %s", root)
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	if _, ok := peered(older, newer); !ok {
+		t.Fatalf("expected the older node to still be peered")
+	}
+}
+
+func TestWireProfileCapabilities(t *testing.T) {
+	_, skA, _ := ed25519.GenerateKey(nil)
+	_, skB, _ := ed25519.GenerateKey(nil)
+	older := NewRouter(nil, skA, RouterOptionWireProfile{
+		LastFrameType: types.TypeWakeupBroadcast,
+		Capabilities:  []string{"lengthened_root_interval", "cryptographic_setups"},
+	})
+	newer := NewRouter(nil, skB)
+	t.Cleanup(func() { _ = older.Close(); _ = newer.Close() })
+
+	errA, errB := connectTestRouters(t, older, newer)
+	if !errors.Is(errA, ErrIncompatiblePeer) || !errors.Is(errB, ErrIncompatiblePeer) {
+		t.Fatalf("expected mismatched capabilities to be refused, got %v, %v", errA, errB)
+	}
+}
+
+func TestWireProfileFrames(t *testing.T) {
+	_, sk, _ := ed25519.GenerateKey(nil)
+	r := NewRouter(nil, sk, RouterOptionWireProfile{LastFrameType: types.TypeWakeupBroadcast})
+	t.Cleanup(func() { _ = r.Close() })
+
+	for _, ft := range []types.FrameType{types.TypeKeepalive, types.TypeTraffic, types.TypeWakeupBroadcast} {
+		if !r.understands(ft) {
+			t.Fatalf("expected %s to be understood", ft)
+		}
+	}
+	for _, ft := range []types.FrameType{types.TypeLinkProbe, types.TypeBootstrapACK, types.TypeSNEKRefresh} {
+		if r.understands(ft) {
+			t.Fatalf("expected %s not to be understood", ft)
+		}
+	}
+	if r.wireFeatures() != 0 {
+		t.Fatalf("expected no wire features, got %d", r.wireFeatures())
+	}
+	if r.capabilities() != ourCapabilities {
+		t.Fatalf("expected our capabilities when they aren't pinned")
+	}
+}
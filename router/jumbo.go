@@ -0,0 +1,64 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"math/bits"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+// Traffic payloads that are too big for a normal frame can be sent as jumbo
+// frames, but only to peers that have agreed to accept them. In the
+// handshake, each node puts the base 2 logarithm of the largest payload
+// that it will accept into the second byte, which was always zero before.
+// A peering carries jumbo frames up to the smaller of the two sizes, as
+// long as both are bigger than a normal frame. Jumbo frames that would
+// have to be forwarded to a peer that doesn't accept them, or that are too
+// big for it, are dropped.
+
+// jumboExponent returns the value to advertise in the handshake for the
+// given maximum payload size, or zero if jumbo frames are disabled.
+func jumboExponent(size int) uint8 {
+	if size > types.MaxJumboPayloadSize {
+		size = types.MaxJumboPayloadSize
+	}
+	if size <= types.MaxPayloadSize {
+		return 0
+	}
+	return uint8(bits.Len(uint(size)) - 1)
+}
+
+// negotiateJumbo returns the largest jumbo frame payload that can be sent
+// on a peering, given the exponents advertised by both sides, or zero if
+// jumbo frames can't be used.
+func negotiateJumbo(ours, theirs uint8) int {
+	if theirs < ours {
+		ours = theirs
+	}
+	size := 1 << ours
+	if size <= types.MaxPayloadSize || size > types.MaxJumboPayloadSize {
+		return 0
+	}
+	return size
+}
+
+// jumboBufferPool holds buffers for reading and writing jumbo frames, which
+// are too big for the buffers in frameBufferPool. They are only allocated
+// if a peering actually carries a jumbo frame.
+var jumboBufferPool = newTrackedPool("jumbo buffers", func() interface{} {
+	b := make([]byte, types.MaxJumboFrameSize)
+	return &b
+})
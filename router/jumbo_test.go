@@ -0,0 +1,101 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestNegotiateJumbo(t *testing.T) {
+	for _, tc := range []struct {
+		ours, theirs int
+		expected     int
+	}{
+		{0, 0, 0},
+		{types.MaxJumboPayloadSize, 0, 0},
+		{0, types.MaxJumboPayloadSize, 0},
+		{types.MaxPayloadSize, types.MaxJumboPayloadSize, 0},
+		{types.MaxJumboPayloadSize, types.MaxJumboPayloadSize, types.MaxJumboPayloadSize},
+		{types.MaxJumboPayloadSize * 4, types.MaxJumboPayloadSize, types.MaxJumboPayloadSize},
+		{300 * 1024, types.MaxJumboPayloadSize, 256 * 1024},
+	} {
+		if got := negotiateJumbo(jumboExponent(tc.ours), jumboExponent(tc.theirs)); got != tc.expected {
+			t.Errorf("%d and %d: expected %d, got %d", tc.ours, tc.theirs, tc.expected, got)
+		}
+	}
+}
+
+func TestJumboFrames(t *testing.T) {
+	newRouter := func(jumbo int) *Router {
+		_, sk, _ := ed25519.GenerateKey(nil)
+		r := NewRouter(nil, sk, RouterOptionJumboFrames(jumbo))
+		t.Cleanup(func() { _ = r.Close() })
+		return r
+	}
+
+	// A peering where only one side allows jumbo frames doesn't carry them.
+	a, b := newRouter(types.MaxJumboPayloadSize), newRouter(0)
+	if errA, errB := connectTestRouters(t, a, b); errA != nil || errB != nil {
+		t.Fatalf("failed to peer: %v, %v", errA, errB)
+	}
+	for _, peer := range a.Peers() {
+		if peer.JumboFrames != 0 {
+			t.Fatalf("peering shouldn't carry jumbo frames")
+		}
+	}
+
+	a, b = newRouter(types.MaxJumboPayloadSize), newRouter(types.MaxJumboPayloadSize)
+	if errA, errB := connectTestRouters(t, a, b); errA != nil || errB != nil {
+		t.Fatalf("failed to peer: %v, %v", errA, errB)
+	}
+	for _, peer := range a.Peers() {
+		if peer.Port != 0 && peer.JumboFrames != types.MaxJumboPayloadSize {
+			t.Fatalf("peering should carry jumbo frames, got %d", peer.JumboFrames)
+		}
+	}
+
+	deadline := time.Now().Add(time.Second * 10)
+	for len(a.Coords()) == 0 && len(b.Coords()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("tree didn't converge")
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+
+	sent := make([]byte, types.MaxPayloadSize*4)
+	for i := range sent {
+		sent[i] = byte(i)
+	}
+	if _, err := a.WriteTo(sent, b.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+	_ = b.SetReadDeadline(time.Now().Add(time.Second * 5))
+	received := make([]byte, types.MaxJumboPayloadSize)
+	n, addr, err := b.ReadFrom(received)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr != a.PublicKey() {
+		t.Fatalf("jumbo frame came from %v, expected %v", addr, a.PublicKey())
+	}
+	if !bytes.Equal(received[:n], sent) {
+		t.Fatalf("jumbo frame payload of %d bytes doesn't match", n)
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// Keepalive timings are agreed with the remote side straight after the
+// handshake, since a node can't tell that a peering is dead from the lack
+// of keepalives unless it knows how often they are meant to arrive. Each
+// side sends the interval that it would like to use and both then go with
+// the slower of the two, as with link probes, stretching their timeouts to
+// match. A node that doesn't take part is assumed to use the default.
+
+// handshakeKeepalives is set if the node wants to agree keepalive timings
+// after the handshake. Nodes always set it.
+const handshakeKeepalives = 1 << 6
+
+// keepaliveConfig holds the keepalive timings for a class of peerings.
+type keepaliveConfig struct {
+	interval time.Duration // how long to wait before sending a keepalive
+	timeout  time.Duration // how long to wait for a frame before giving up
+}
+
+// defaultKeepaliveConfig is used for any peer type that hasn't been
+// configured with RouterOptionPeerKeepalives.
+var defaultKeepaliveConfig = keepaliveConfig{
+	interval: peerKeepaliveInterval,
+	timeout:  peerKeepaliveTimeout,
+}
+
+// newKeepaliveConfig builds a keepalive config from an interval and the
+// number of intervals that can be missed before the peer is declared dead,
+// clamping both to sensible values. At least two intervals can always be
+// missed, so that a keepalive that is a little late doesn't kill the peering.
+func newKeepaliveConfig(interval time.Duration, missTolerance int) keepaliveConfig {
+	if interval < peerKeepaliveMinInterval {
+		interval = peerKeepaliveMinInterval
+	}
+	if missTolerance < peerKeepaliveMinMissTolerance {
+		missTolerance = peerKeepaliveMinMissTolerance
+	}
+	return keepaliveConfig{
+		interval: interval,
+		timeout:  interval * time.Duration(missTolerance),
+	}
+}
+
+// keepaliveConfigFor returns the keepalive timings to use for a new peering
+// of the given peer type.
+func (r *Router) keepaliveConfigFor(peertype ConnectionPeerType) keepaliveConfig {
+	if c, ok := r.keepalives[peertype]; ok {
+		return c
+	}
+	return defaultKeepaliveConfig
+}
+
+// negotiate returns the timings to use on a peering with a node that wants
+// to send keepalives at the given interval, or zero if it didn't say. If the
+// remote side is slower then its interval is used and the timeout grows by
+// the same proportion, so that an idle peering isn't given up on before the
+// remote side was ever going to send anything.
+func (c keepaliveConfig) negotiate(remote time.Duration) keepaliveConfig {
+	if remote == 0 {
+		remote = peerKeepaliveInterval
+	}
+	if remote <= c.interval {
+		return c
+	}
+	return keepaliveConfig{
+		interval: remote,
+		timeout:  time.Duration(float64(c.timeout) * float64(remote) / float64(c.interval)),
+	}
+}
+
+// exchangeKeepalives sends our keepalive interval for the peering to the
+// remote node and returns theirs. This must only be called if both nodes
+// have set the keepalives bit in the handshake.
+func (r *Router) exchangeKeepalives(conn net.Conn, interval time.Duration, deadline time.Time) (time.Duration, error) {
+	if err := conn.SetDeadline(deadline); err != nil {
+		return 0, fmt.Errorf("conn.SetDeadline: %w", err)
+	}
+	var ours, theirs [4]byte
+	binary.BigEndian.PutUint32(ours[:], uint32(interval.Milliseconds()))
+	if _, err := conn.Write(ours[:]); err != nil {
+		return 0, fmt.Errorf("conn.Write: %w", err)
+	}
+	if _, err := io.ReadFull(conn, theirs[:]); err != nil {
+		return 0, fmt.Errorf("io.ReadFull: %w", err)
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return 0, fmt.Errorf("conn.SetDeadline: %w", err)
+	}
+	return time.Duration(binary.BigEndian.Uint32(theirs[:])) * time.Millisecond, nil
+}
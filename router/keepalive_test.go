@@ -0,0 +1,123 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+)
+
+func TestKeepaliveConfig(t *testing.T) {
+	if c := newKeepaliveConfig(time.Millisecond, 1); c.interval != peerKeepaliveMinInterval || c.timeout != 2*peerKeepaliveMinInterval {
+		t.Fatalf("expected the interval and miss tolerance to be clamped, got %+v", c)
+	}
+	if c := newKeepaliveConfig(time.Second, 3); c.interval != time.Second || c.timeout != 3*time.Second {
+		t.Fatalf("expected a 1s interval with a 3s timeout, got %+v", c)
+	}
+
+	_, sk, _ := ed25519.GenerateKey(nil)
+	r := NewRouter(nil, sk,
+		RouterOptionPeerKeepalives{PeerType: PeerTypeMulticast, Interval: time.Minute, MissTolerance: 2},
+		RouterOptionPeerKeepalives{PeerType: PeerTypeMulticast, Interval: time.Second, MissTolerance: 4},
+	)
+	defer r.Close()
+	if c := r.keepaliveConfigFor(ConnectionPeerType(PeerTypeMulticast)); c.interval != time.Second || c.timeout != 4*time.Second {
+		t.Fatalf("expected the later option to win, got %+v", c)
+	}
+	if c := r.keepaliveConfigFor(ConnectionPeerType(PeerTypeRemote)); c != defaultKeepaliveConfig {
+		t.Fatalf("expected the default for unconfigured peer types, got %+v", c)
+	}
+}
+
+func TestKeepaliveNegotiation(t *testing.T) {
+	c := newKeepaliveConfig(time.Second, 3)
+	if n := c.negotiate(500 * time.Millisecond); n != c {
+		t.Fatalf("expected a faster remote interval to be ignored, got %+v", n)
+	}
+	if n := c.negotiate(0); n.interval != peerKeepaliveInterval || n.timeout != 3*peerKeepaliveInterval {
+		t.Fatalf("expected the default to be assumed for the remote side, got %+v", n)
+	}
+	if n := defaultKeepaliveConfig.negotiate(time.Minute); n.interval != time.Minute || n.timeout != 100*time.Second {
+		t.Fatalf("expected the timeout to stretch with the interval, got %+v", n)
+	}
+
+	// Both sides end up with the slower of the two intervals.
+	newRouter := func(interval time.Duration) *Router {
+		_, sk, _ := ed25519.GenerateKey(nil)
+		r := NewRouter(nil, sk, RouterOptionPeerKeepalives{PeerType: PeerTypePipe, Interval: interval, MissTolerance: 2})
+		t.Cleanup(func() { _ = r.Close() })
+		return r
+	}
+	a, b := newRouter(time.Second), newRouter(4*time.Second)
+	if errA, errB := connectTestRouters(t, a, b); errA != nil || errB != nil {
+		t.Fatalf("failed to peer: %v, %v", errA, errB)
+	}
+	for _, r := range []*Router{a, b} {
+		phony.Block(r.state, func() {
+			for _, p := range r.state._peers {
+				if p == nil || p == r.local {
+					continue
+				}
+				if p.keepalive.interval != 4*time.Second || p.keepalive.timeout != 8*time.Second {
+					t.Fatalf("expected the slower interval to be agreed, got %+v", p.keepalive)
+				}
+			}
+		})
+	}
+}
+
+func TestKeepaliveScheduling(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	p := &peer{
+		router:     &Router{clock: clock},
+		keepalives: true,
+		keepalive:  newKeepaliveConfig(time.Second, 3),
+	}
+	if p.idleInterval() != time.Second || p.readTimeout() != 3*time.Second {
+		t.Fatalf("expected the keepalive timings, got %s and %s", p.idleInterval(), p.readTimeout())
+	}
+
+	// A negotiated probe interval that is shorter than the keepalive
+	// interval takes over, but a longer one never slows keepalives down.
+	p.probeInterval.Store(200 * time.Millisecond)
+	p.probeTimeout.Store(600 * time.Millisecond)
+	if p.idleInterval() != 200*time.Millisecond || p.readTimeout() != 600*time.Millisecond {
+		t.Fatalf("expected the probe timings, got %s and %s", p.idleInterval(), p.readTimeout())
+	}
+	p.probeInterval.Store(time.Minute)
+	p.probeTimeout.Store(3 * time.Minute)
+	if p.idleInterval() != time.Second || p.readTimeout() != 3*time.Second {
+		t.Fatalf("expected the keepalive timings, got %s and %s", p.idleInterval(), p.readTimeout())
+	}
+
+	// The idle timer runs on the router clock, is reused, and can be reset
+	// after it has fired.
+	fired := p._resetIdleTimer(time.Second)
+	clock.Advance(time.Second)
+	<-fired
+	if again := p._resetIdleTimer(time.Hour); again != fired {
+		t.Fatalf("expected the idle timer to be reused")
+	}
+	select {
+	case <-fired:
+		t.Fatalf("expected the idle timer to wait for the new interval")
+	default:
+	}
+	clock.Advance(time.Hour)
+	<-fired
+}
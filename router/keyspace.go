@@ -0,0 +1,139 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"crypto/ed25519"
+	"math/big"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+// Keys are spread evenly around the keyspace, so the gaps between a node
+// and its ascending and descending neighbours say how many nodes the SNEK
+// covers around it. A gap that is much wider than it should be for the size
+// of the network means that nodes in that part of the keyspace can't find
+// each other, and neighbours that keep changing mean that paths through
+// that part of the keyspace keep being torn down. The distances are given
+// as a fraction of the whole keyspace, going around it from our key, and
+// changes of either neighbour are kept for the same window as the tree
+// statistics so that they can be reported as rates.
+
+// KeyspaceStats describes where we are in the keyspace relative to our
+// SNEK neighbours and how often they have changed recently.
+type KeyspaceStats struct {
+	Ascending          *types.PublicKey `json:"ascending,omitempty"`    // The node that last confirmed our bootstrap
+	Descending         *types.PublicKey `json:"descending,omitempty"`   // The node whose bootstraps reached us
+	AscendingDistance  float64          `json:"ascending_distance"`     // Fraction of the keyspace up to the ascending node
+	DescendingDistance float64          `json:"descending_distance"`    // Fraction of the keyspace down to the descending node
+	EstimatedNodes     float64          `json:"estimated_nodes"`        // Network size implied by the distances, zero if unknown
+	AscendingChanges   int              `json:"ascending_changes"`      // Times that the ascending node changed
+	DescendingChanges  int              `json:"descending_changes"`     // Times that the descending node changed
+	AscendingRate      float64          `json:"ascending_change_rate"`  // Ascending changes per minute
+	DescendingRate     float64          `json:"descending_change_rate"` // Descending changes per minute
+	Window             time.Duration    `json:"window"`                 // How far back the changes look
+}
+
+type keyspaceTracker struct {
+	started           time.Time
+	ascendingChanges  []time.Time // Oldest first
+	descendingChanges []time.Time // Oldest first
+}
+
+// keyspaceSize is the number of keys in the keyspace.
+var keyspaceSize = new(big.Int).Lsh(big.NewInt(1), ed25519.PublicKeySize*8)
+
+// keyspaceDistance returns how far it is from one key up to another, going
+// around the keyspace if need be, as a fraction of the whole keyspace.
+func keyspaceDistance(from, to types.PublicKey) float64 {
+	d := new(big.Int).Sub(new(big.Int).SetBytes(to[:]), new(big.Int).SetBytes(from[:]))
+	if d.Sign() < 0 {
+		d.Add(d, keyspaceSize)
+	}
+	f, _ := new(big.Float).Quo(new(big.Float).SetInt(d), new(big.Float).SetInt(keyspaceSize)).Float64()
+	return f
+}
+
+func (t *keyspaceTracker) stats(now time.Time, local types.PublicKey, ascending, descending *types.PublicKey) KeyspaceStats {
+	cutoff := now.Add(-treeStatsWindow)
+	t.ascendingChanges = pruneTimes(t.ascendingChanges, cutoff)
+	t.descendingChanges = pruneTimes(t.descendingChanges, cutoff)
+	stats := KeyspaceStats{
+		Ascending:         ascending,
+		Descending:        descending,
+		AscendingChanges:  len(t.ascendingChanges),
+		DescendingChanges: len(t.descendingChanges),
+		Window:            treeStatsWindow,
+	}
+	if ascending != nil {
+		stats.AscendingDistance = keyspaceDistance(local, *ascending)
+	}
+	if descending != nil {
+		stats.DescendingDistance = keyspaceDistance(*descending, local)
+	}
+	if ascending != nil && descending != nil {
+		// The two gaps together are about twice the average gap between
+		// neighbouring keys.
+		if gaps := stats.AscendingDistance + stats.DescendingDistance; gaps > 0 {
+			stats.EstimatedNodes = 2 / gaps
+		}
+	}
+	minutes := treeStatsWindow.Minutes()
+	if running := now.Sub(t.started); running < treeStatsWindow {
+		minutes = running.Minutes()
+	}
+	if minutes > 0 {
+		stats.AscendingRate = float64(stats.AscendingChanges) / minutes
+		stats.DescendingRate = float64(stats.DescendingChanges) / minutes
+	}
+	return stats
+}
+
+// _observeAscendingChange records that our ascending node changed.
+func (s *state) _observeAscendingChange() {
+	s._keyspace.ascendingChanges = appendTime(s._keyspace.ascendingChanges, s.r.clock.Now())
+}
+
+// _observeDescendingChange records that our descending node changed.
+func (s *state) _observeDescendingChange() {
+	s._keyspace.descendingChanges = appendTime(s._keyspace.descendingChanges, s.r.clock.Now())
+}
+
+func (s *state) _keyspaceStats() KeyspaceStats {
+	var ascending, descending *types.PublicKey
+	if key := s._convergence.ascending; key != (types.PublicKey{}) {
+		ascending = &key
+	}
+	if s._descending != nil {
+		key := s._descending.PublicKey
+		descending = &key
+	}
+	return s._keyspace.stats(s.r.clock.Now(), s.r.public, ascending, descending)
+}
+
+// KeyspaceStats returns the distances between our key and those of our SNEK
+// neighbours, and how often the neighbours have changed recently.
+func (r *Router) KeyspaceStats() KeyspaceStats {
+	var stats KeyspaceStats
+	phony.Block(r.state, func() {
+		stats = r.state._keyspaceStats()
+	})
+	return stats
+}
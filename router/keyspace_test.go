@@ -0,0 +1,84 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestKeyspaceDistance(t *testing.T) {
+	var quarter, half, threeQuarters types.PublicKey
+	quarter[0], half[0], threeQuarters[0] = 0x40, 0x80, 0xc0
+	for _, tc := range []struct {
+		from, to types.PublicKey
+		expected float64
+	}{
+		{quarter, half, 0.25},
+		{quarter, threeQuarters, 0.5},
+		{threeQuarters, quarter, 0.5}, // Around the end of the keyspace
+		{half, quarter, 0.75},
+		{half, half, 0},
+	} {
+		if d := keyspaceDistance(tc.from, tc.to); math.Abs(d-tc.expected) > 1e-9 {
+			t.Fatalf("expected a distance of %f from %x to %x, got %f", tc.expected, tc.from[0], tc.to[0], d)
+		}
+	}
+}
+
+func TestKeyspaceStats(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	s := newTestState(types.PublicKey{0x80}, clock)
+	if stats := s._keyspaceStats(); stats.Ascending != nil || stats.Descending != nil || stats.EstimatedNodes != 0 {
+		t.Fatalf("expected no neighbours, got %+v", stats)
+	}
+
+	var ascending, other types.PublicKey
+	ascending[0], other[0] = 0x90, 0xa0
+	s._ascendingConfirmed(ascending)
+	s._ascendingConfirmed(ascending)
+	clock.Advance(time.Minute)
+	s._ascendingConfirmed(other)
+	s._ascendingConfirmed(ascending)
+	s._descending = &virtualSnakeEntry{virtualSnakeIndex: &virtualSnakeIndex{}}
+	s._descending.PublicKey[0] = 0x70
+	s._observeDescendingChange()
+	clock.Advance(time.Minute)
+
+	stats := s._keyspaceStats()
+	if stats.Ascending == nil || *stats.Ascending != ascending || stats.Descending == nil {
+		t.Fatalf("expected both neighbours, got %+v", stats)
+	}
+	if stats.AscendingChanges != 3 || stats.DescendingChanges != 1 {
+		t.Fatalf("expected three ascending and one descending change, got %+v", stats)
+	}
+	if stats.AscendingRate != 1.5 || stats.DescendingRate != 0.5 {
+		t.Fatalf("expected rates over the two minutes running, got %+v", stats)
+	}
+	// Both neighbours are 1/16 of the keyspace away, so the network looks
+	// like it has about 16 nodes.
+	if math.Abs(stats.AscendingDistance-1.0/16) > 1e-9 || math.Abs(stats.EstimatedNodes-16) > 1e-6 {
+		t.Fatalf("unexpected distances: %+v", stats)
+	}
+
+	// Changes fall out of the window.
+	clock.Advance(treeStatsWindow)
+	if stats := s._keyspaceStats(); stats.AscendingChanges != 0 || stats.DescendingChanges != 0 {
+		t.Fatalf("expected the changes to have expired, got %+v", stats)
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"sort"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+// With RouterOptionForwardingLatency, we measure how long each frame that
+// we forward spends with us, from when it has been read from one peering to
+// when it has been queued to be sent on another, and keep histograms of the
+// times for each frame type. The time is split into the time that the frame
+// spent waiting for the router to get to it, which grows when the router is
+// busy, and the time that it took to handle the frame and choose where to
+// send it, which grows when routing is slow. Frames that are for us, or that
+// we sent ourselves, aren't measured. This uses the real time rather than
+// the router's clock, since it measures the router itself.
+
+// latencyBuckets are the upper bounds of the forwarding latency histograms.
+var latencyBuckets = [...]time.Duration{
+	time.Microsecond,
+	time.Microsecond * 5,
+	time.Microsecond * 10,
+	time.Microsecond * 25,
+	time.Microsecond * 50,
+	time.Microsecond * 100,
+	time.Microsecond * 250,
+	time.Microsecond * 500,
+	time.Millisecond,
+	time.Millisecond * 5,
+	time.Millisecond * 10,
+	time.Millisecond * 50,
+	time.Millisecond * 100,
+}
+
+// LatencyHistogram counts how long something took.
+type LatencyHistogram struct {
+	Count   uint64            `json:"count"`
+	Sum     time.Duration     `json:"sum"`
+	Buckets []HistogramBucket `json:"buckets"`
+}
+
+// FrameLatencyStats describes how long the frames of one type took to be
+// forwarded.
+type FrameLatencyStats struct {
+	Type     string           `json:"type"`
+	Queueing LatencyHistogram `json:"queueing"` // Waiting for the router
+	NextHop  LatencyHistogram `json:"next_hop"` // Handling and routing
+	Total    LatencyHistogram `json:"total"`    // From being read to being queued
+}
+
+type latencyHistogram struct {
+	count   uint64
+	sum     time.Duration
+	buckets [len(latencyBuckets) + 1]uint64
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	h.count++
+	h.sum += d
+	for i, bound := range latencyBuckets {
+		if d <= bound {
+			h.buckets[i]++
+			return
+		}
+	}
+	h.buckets[len(latencyBuckets)]++
+}
+
+func (h *latencyHistogram) stats() LatencyHistogram {
+	stats := LatencyHistogram{
+		Count:   h.count,
+		Sum:     h.sum,
+		Buckets: make([]HistogramBucket, 0, len(h.buckets)),
+	}
+	var cumulative uint64
+	for i, count := range h.buckets {
+		cumulative += count
+		bucket := HistogramBucket{Count: cumulative}
+		if i < len(latencyBuckets) {
+			bucket.UpperBound = latencyBuckets[i]
+		}
+		stats.Buckets = append(stats.Buckets, bucket)
+	}
+	return stats
+}
+
+type frameLatency struct {
+	queueing latencyHistogram
+	nexthop  latencyHistogram
+	total    latencyHistogram
+}
+
+// forwardLatency measures one frame at a time, since the state actor only
+// handles one frame at a time. Frames that we send while handling it, i.e.
+// replies, aren't the frame being measured and so are ignored.
+type forwardLatency struct {
+	clock     Clock
+	frame     *types.Frame    // The frame being measured, if any
+	frameType types.FrameType // The type of the frame being measured
+	received  time.Time       // When the frame was read from the peering
+	started   time.Time       // When we started handling the frame
+	routed    time.Time       // When the next-hop was chosen
+	types     map[types.FrameType]*frameLatency
+}
+
+func newForwardLatency(clock Clock) *forwardLatency {
+	return &forwardLatency{
+		clock: clock,
+		types: map[types.FrameType]*frameLatency{},
+	}
+}
+
+// begin starts measuring a frame that was read at the given time.
+func (l *forwardLatency) begin(f *types.Frame, received time.Time) {
+	l.frame, l.received, l.started, l.routed = f, received, l.clock.Now(), time.Time{}
+}
+
+// route records that the next-hop for the frame has been chosen.
+func (l *forwardLatency) route(f *types.Frame) {
+	if l.frame == f {
+		l.frameType, l.routed = f.Type, l.clock.Now()
+	}
+}
+
+// queued records that the frame has been queued for another peering. The
+// frame may already have been sent and reused by then, so it is only
+// compared with the frame being measured and not looked at.
+func (l *forwardLatency) queued(f *types.Frame) {
+	if l.frame != f || l.routed.IsZero() {
+		return
+	}
+	t, ok := l.types[l.frameType]
+	if !ok {
+		t = &frameLatency{}
+		l.types[l.frameType] = t
+	}
+	now := l.clock.Now()
+	t.queueing.observe(l.started.Sub(l.received))
+	t.nexthop.observe(l.routed.Sub(l.started))
+	t.total.observe(now.Sub(l.received))
+}
+
+// end stops measuring the frame, whether or not it was forwarded.
+func (l *forwardLatency) end() {
+	l.frame = nil
+}
+
+func (l *forwardLatency) stats() []FrameLatencyStats {
+	stats := make([]FrameLatencyStats, 0, len(l.types))
+	for frameType, t := range l.types {
+		stats = append(stats, FrameLatencyStats{
+			Type:     frameType.String(),
+			Queueing: t.queueing.stats(),
+			NextHop:  t.nexthop.stats(),
+			Total:    t.total.stats(),
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Type < stats[j].Type
+	})
+	return stats
+}
+
+// ForwardingLatency returns histograms of how long the frames that we
+// forwarded took to get through us, by frame type, or false if this wasn't
+// enabled with RouterOptionForwardingLatency.
+func (r *Router) ForwardingLatency() ([]FrameLatencyStats, bool) {
+	var stats []FrameLatencyStats
+	var ok bool
+	phony.Block(r.state, func() {
+		if r.state._latency != nil {
+			stats, ok = r.state._latency.stats(), true
+		}
+	})
+	return stats, ok
+}
@@ -0,0 +1,93 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestForwardLatency(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	l := newForwardLatency(clock)
+	forwarded := &types.Frame{Type: types.TypeTraffic}
+	reply := &types.Frame{Type: types.TypeKeepalive}
+
+	l.begin(forwarded, clock.Now().Add(-time.Millisecond*20))
+	l.queued(reply) // Frames that we send while handling aren't measured
+	clock.Advance(time.Millisecond * 5)
+	l.route(forwarded)
+	forwarded.Type = types.TypeSNEKRefresh // The frame can be reused once sent
+	clock.Advance(time.Millisecond * 5)
+	l.queued(forwarded)
+	l.end()
+
+	// Frames that are handled without being forwarded aren't measured.
+	l.begin(reply, clock.Now())
+	l.end()
+	l.queued(forwarded)
+
+	stats := l.stats()
+	if len(stats) != 1 {
+		t.Fatalf("expected one frame type, got %+v", stats)
+	}
+	traffic := stats[0]
+	if traffic.Type != types.TypeTraffic.String() {
+		t.Fatalf("expected %s, got %s", types.TypeTraffic, traffic.Type)
+	}
+	for name, h := range map[string]LatencyHistogram{
+		"queueing": traffic.Queueing,
+		"next-hop": traffic.NextHop,
+		"total":    traffic.Total,
+	} {
+		if h.Count != 1 || len(h.Buckets) != len(latencyBuckets)+1 {
+			t.Fatalf("unexpected %s histogram %+v", name, h)
+		}
+		if last := h.Buckets[len(h.Buckets)-1]; last.Count != 1 {
+			t.Fatalf("expected %s buckets to be cumulative, got %+v", name, h.Buckets)
+		}
+	}
+	if traffic.Queueing.Sum != time.Millisecond*20 || traffic.NextHop.Sum != time.Millisecond*5 || traffic.Total.Sum != time.Millisecond*30 {
+		t.Fatalf("unexpected times %+v", traffic)
+	}
+	for _, b := range traffic.Queueing.Buckets {
+		if b.UpperBound != 0 && b.UpperBound < time.Millisecond*20 && b.Count != 0 {
+			t.Fatalf("expected the frame to be in the 50ms bucket, got %+v", traffic.Queueing.Buckets)
+		}
+	}
+}
+
+func TestForwardingLatencyDisabled(t *testing.T) {
+	_, sk, _ := ed25519.GenerateKey(nil)
+	r := NewRouter(nil, sk)
+	t.Cleanup(func() {
+		_ = r.Close()
+	})
+	if _, ok := r.ForwardingLatency(); ok {
+		t.Fatalf("expected forwarding latency to be disabled by default")
+	}
+
+	_, sk, _ = ed25519.GenerateKey(nil)
+	r = NewRouter(nil, sk, RouterOptionForwardingLatency(true))
+	t.Cleanup(func() {
+		_ = r.Close()
+	})
+	if stats, ok := r.ForwardingLatency(); !ok || len(stats) != 0 {
+		t.Fatalf("expected empty forwarding latency, got %+v, %v", stats, ok)
+	}
+}
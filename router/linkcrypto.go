@@ -0,0 +1,214 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Traffic is encrypted end-to-end by the sessions, but the frames on a
+// peering are otherwise in the clear, so anyone watching a link that isn't
+// encrypted by the transport can see the headers of every frame and the
+// whole of every protocol frame. With RouterOptionLinkEncryption, two nodes
+// that both want it encrypt the peering once the handshake has checked
+// their keys. Each sends a new X25519 key, signed with its node key, and
+// the shared secret is run through HKDF, with both node keys, to give a
+// ChaCha20-Poly1305 key for each direction. Everything after that point,
+// including the rest of the handshake, is sent in records of up to 64KB,
+// each of which is a two byte length and the sealed bytes, with a counter
+// for the nonce. Since the X25519 keys are thrown away afterwards, a node
+// key that leaks later doesn't reveal what was sent.
+
+// handshakeLinkEncryption is set if the node wants to encrypt the peering
+// after the handshake.
+const handshakeLinkEncryption = 1 << 5
+
+// linkKeyContext is signed along with the X25519 key, so that the signature
+// can't be used for anything else.
+const linkKeyContext = "pinecone link key"
+
+// linkMaxRecord is the largest sealed record, which has to fit the length.
+const linkMaxRecord = 1<<16 - 1
+
+// linkMaxPlaintext is the most that can be sent in one record.
+const linkMaxPlaintext = linkMaxRecord - chacha20poly1305.Overhead
+
+// linkEncrypted returns true if a peering with a node that sent the given
+// wire features is encrypted.
+func (r *Router) linkEncrypted(features uint8) bool {
+	return r.wireFeatures()&features&handshakeLinkEncryption != 0
+}
+
+// exchangeLinkKeys agrees keys with the remote node and returns the
+// connection wrapped so that everything sent on it is encrypted. This must
+// only be called if both nodes have set the link encryption bit in the
+// handshake.
+func (r *Router) exchangeLinkKeys(conn net.Conn, public types.PublicKey, deadline time.Time) (net.Conn, error) {
+	var private [curve25519.ScalarSize]byte
+	if _, err := rand.Read(private[:]); err != nil {
+		return nil, fmt.Errorf("rand.Read: %w", err)
+	}
+	ours, err := curve25519.X25519(private[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, fmt.Errorf("curve25519.X25519: %w", err)
+	}
+	if err = conn.SetDeadline(deadline); err != nil {
+		return nil, fmt.Errorf("conn.SetDeadline: %w", err)
+	}
+	message := append(ours, r.sign(append([]byte(linkKeyContext), ours...))...)
+	if _, err = conn.Write(message); err != nil {
+		return nil, fmt.Errorf("conn.Write: %w", err)
+	}
+	theirMessage := make([]byte, curve25519.PointSize+ed25519.SignatureSize)
+	if _, err = io.ReadFull(conn, theirMessage); err != nil {
+		return nil, fmt.Errorf("io.ReadFull: %w", err)
+	}
+	if err = conn.SetDeadline(time.Time{}); err != nil {
+		return nil, fmt.Errorf("conn.SetDeadline: %w", err)
+	}
+	theirs, signature := theirMessage[:curve25519.PointSize], theirMessage[curve25519.PointSize:]
+	if !r.verify(public[:], append([]byte(linkKeyContext), theirs...), signature) {
+		return nil, fmt.Errorf("%w: invalid link key signature", ErrInvalidHandshake)
+	}
+	shared, err := curve25519.X25519(private[:], theirs)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidHandshake, err)
+	}
+
+	// Both nodes have to put the keys in the same order, so the node with
+	// the lower key goes first and gets the first key for sending.
+	lower, higher := r.public, public
+	lowerKey, higherKey := ours, theirs
+	if public.CompareTo(r.public) < 0 {
+		lower, higher = higher, lower
+		lowerKey, higherKey = higherKey, lowerKey
+	}
+	info := append([]byte(linkKeyContext), lower[:]...)
+	info = append(info, higher[:]...)
+	info = append(info, lowerKey...)
+	info = append(info, higherKey...)
+	keys := make([]byte, chacha20poly1305.KeySize*2)
+	if _, err = io.ReadFull(hkdf.New(sha256.New, shared, nil, info), keys); err != nil {
+		return nil, fmt.Errorf("hkdf: %w", err)
+	}
+	sendKey, recvKey := keys[:chacha20poly1305.KeySize], keys[chacha20poly1305.KeySize:]
+	if lower != r.public {
+		sendKey, recvKey = recvKey, sendKey
+	}
+	return newCipherConn(conn, sendKey, recvKey)
+}
+
+// cipherConn encrypts everything written to the connection and decrypts
+// everything read from it.
+type cipherConn struct {
+	net.Conn
+	readMutex  sync.Mutex
+	recv       cipher.AEAD
+	recvNonce  uint64
+	record     []byte // The last record that was read
+	plaintext  []byte // What is left of the last record to read
+	writeMutex sync.Mutex
+	send       cipher.AEAD
+	sendNonce  uint64
+	sealed     []byte // Reused for writing records
+}
+
+func newCipherConn(conn net.Conn, sendKey, recvKey []byte) (*cipherConn, error) {
+	send, err := chacha20poly1305.New(sendKey)
+	if err != nil {
+		return nil, fmt.Errorf("chacha20poly1305.New: %w", err)
+	}
+	recv, err := chacha20poly1305.New(recvKey)
+	if err != nil {
+		return nil, fmt.Errorf("chacha20poly1305.New: %w", err)
+	}
+	return &cipherConn{
+		Conn:   conn,
+		send:   send,
+		recv:   recv,
+		record: make([]byte, linkMaxRecord),
+		sealed: make([]byte, 0, 2+linkMaxRecord),
+	}, nil
+}
+
+func linkNonce(counter uint64) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(nonce[chacha20poly1305.NonceSize-8:], counter)
+	return nonce
+}
+
+func (c *cipherConn) Read(b []byte) (int, error) {
+	c.readMutex.Lock()
+	defer c.readMutex.Unlock()
+	if len(c.plaintext) == 0 {
+		var length [2]byte
+		if _, err := io.ReadFull(c.Conn, length[:]); err != nil {
+			return 0, err
+		}
+		record := c.record[:binary.BigEndian.Uint16(length[:])]
+		if _, err := io.ReadFull(c.Conn, record); err != nil {
+			return 0, err
+		}
+		plaintext, err := c.recv.Open(record[:0], linkNonce(c.recvNonce), record, nil)
+		if err != nil {
+			return 0, fmt.Errorf("invalid link record: %w", err)
+		}
+		c.recvNonce++
+		c.plaintext = plaintext
+	}
+	n := copy(b, c.plaintext)
+	c.plaintext = c.plaintext[n:]
+	return n, nil
+}
+
+func (c *cipherConn) Write(b []byte) (int, error) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	written := 0
+	for written < len(b) {
+		chunk := b[written:]
+		if len(chunk) > linkMaxPlaintext {
+			chunk = chunk[:linkMaxPlaintext]
+		}
+		record := c.send.Seal(c.sealed[:2], linkNonce(c.sendNonce), chunk, nil)
+		binary.BigEndian.PutUint16(record[:2], uint16(len(record)-2))
+		c.sendNonce++
+		if _, err := c.Conn.Write(record); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+	}
+	return written, nil
+}
+
+// NetConn returns the underlying connection, so that socket options can be
+// applied to it.
+func (c *cipherConn) NetConn() net.Conn {
+	return c.Conn
+}
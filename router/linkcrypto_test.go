@@ -0,0 +1,125 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// recordingConn keeps a copy of everything written to the connection.
+type recordingConn struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	c.written.Write(b)
+	return c.Conn.Write(b)
+}
+
+func TestCipherConn(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close() // nolint:errcheck
+	defer b.Close() // nolint:errcheck
+	key1, key2 := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)
+	recorder := &recordingConn{Conn: a}
+	sender, err := newCipherConn(recorder, key1, key2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, err := newCipherConn(b, key2, key1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Big enough to need more than one record.
+	message := bytes.Repeat([]byte("a secret frame "), linkMaxPlaintext/10)
+	go func() {
+		_, _ = sender.Write(message)
+		_, _ = sender.Write(message[:100])
+	}()
+	received := make([]byte, len(message)+100)
+	if _, err = io.ReadFull(receiver, received); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received[:len(message)], message) || !bytes.Equal(received[len(message):], message[:100]) {
+		t.Fatalf("received something other than what was sent")
+	}
+	if bytes.Contains(recorder.written.Bytes(), []byte("a secret frame")) {
+		t.Fatalf("the plaintext was visible on the link")
+	}
+
+	// A record that is sent again is refused.
+	go func() {
+		record := append([]byte(nil), recorder.written.Bytes()[:2+linkMaxRecord]...)
+		_, _ = a.Write(record)
+	}()
+	if _, err = receiver.Read(received); err == nil {
+		t.Fatalf("expected a replayed record to be refused")
+	}
+}
+
+func TestLinkEncryption(t *testing.T) {
+	router := func(opts ...RouterOption) *Router {
+		_, sk, _ := ed25519.GenerateKey(nil)
+		r := NewRouter(nil, sk, opts...)
+		t.Cleanup(func() { _ = r.Close() })
+		return r
+	}
+	encrypted := func(r *Router) bool {
+		for _, p := range r.Peers() {
+			if p.Port != 0 {
+				return p.Encrypted
+			}
+		}
+		return false
+	}
+
+	a, b := router(RouterOptionLinkEncryption{}), router(RouterOptionLinkEncryption{})
+	if errA, errB := connectTestRouters(t, a, b); errA != nil || errB != nil {
+		t.Fatalf("failed to peer: %v, %v", errA, errB)
+	}
+	if !encrypted(a) || !encrypted(b) {
+		t.Fatalf("expected the peering to be encrypted")
+	}
+	deadline := time.Now().Add(time.Second * 10)
+	for len(a.Coords()) == 0 && len(b.Coords()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("tree didn't converge over the encrypted peering")
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+
+	// Encryption is only used if both nodes want it.
+	a, b = router(RouterOptionLinkEncryption{}), router()
+	if errA, errB := connectTestRouters(t, a, b); errA != nil || errB != nil {
+		t.Fatalf("failed to peer: %v, %v", errA, errB)
+	}
+	if encrypted(a) || encrypted(b) {
+		t.Fatalf("expected the peering not to be encrypted")
+	}
+
+	// Unless one of them requires it.
+	a, b = router(RouterOptionLinkEncryption{Required: true}), router()
+	if errA, errB := connectTestRouters(t, a, b); !errors.Is(errA, ErrIncompatiblePeer) || errB == nil {
+		t.Fatalf("expected the peering to be refused: %v, %v", errA, errB)
+	}
+}
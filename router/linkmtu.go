@@ -0,0 +1,70 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"bufio"
+	"net"
+)
+
+// Some transports, like Bluetooth LE, can only carry small packets and
+// would otherwise have to pretend to be a stream that can take whole frames.
+// If a link MTU is known then every write to the connection is split into
+// chunks no bigger than the MTU, and reads are buffered so that each read
+// from the connection has room for a whole chunk. Since frames are already
+// length-prefixed, the reader puts them back together without any changes
+// to the wire format, so only the side that knows about the MTU needs to.
+
+// LinkMTU can be implemented by connections to report the largest write
+// that the underlying link can carry in one go. It is used if the peering
+// wasn't given a ConnectionMTU.
+type LinkMTU interface {
+	LinkMTU() int
+}
+
+// linkConn splits writes and buffers reads to fit the link MTU.
+type linkConn struct {
+	net.Conn
+	mtu    int
+	reader *bufio.Reader
+}
+
+func newLinkConn(conn net.Conn, mtu int) *linkConn {
+	return &linkConn{
+		Conn:   conn,
+		mtu:    mtu,
+		reader: bufio.NewReaderSize(conn, mtu),
+	}
+}
+
+func (c *linkConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *linkConn) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		chunk := b[written:]
+		if len(chunk) > c.mtu {
+			chunk = chunk[:c.mtu]
+		}
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,138 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// packetConn behaves like a link that carries packets of limited size.
+// Writes bigger than the MTU fail and reads into a buffer that is smaller
+// than the packet lose the rest of the packet.
+type packetConn struct {
+	mtu    int
+	in     <-chan []byte
+	out    chan<- []byte
+	closed chan struct{}
+	once   *sync.Once
+}
+
+func newPacketConnPair(mtu int) (*packetConn, *packetConn) {
+	ab, ba := make(chan []byte, 64), make(chan []byte, 64)
+	closed, once := make(chan struct{}), &sync.Once{}
+	return &packetConn{mtu, ba, ab, closed, once}, &packetConn{mtu, ab, ba, closed, once}
+}
+
+func (c *packetConn) Read(b []byte) (int, error) {
+	select {
+	case packet := <-c.in:
+		return copy(b, packet), nil
+	case <-c.closed:
+		return 0, io.EOF
+	}
+}
+
+func (c *packetConn) Write(b []byte) (int, error) {
+	if len(b) > c.mtu {
+		return 0, fmt.Errorf("packet of %d bytes exceeds MTU", len(b))
+	}
+	select {
+	case c.out <- append([]byte(nil), b...):
+		return len(b), nil
+	case <-c.closed:
+		return 0, io.ErrClosedPipe
+	}
+}
+
+func (c *packetConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *packetConn) LinkMTU() int                     { return c.mtu }
+func (c *packetConn) LocalAddr() net.Addr              { return &net.UnixAddr{} }
+func (c *packetConn) RemoteAddr() net.Addr             { return &net.UnixAddr{} }
+func (c *packetConn) SetDeadline(time.Time) error      { return nil }
+func (c *packetConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *packetConn) SetWriteDeadline(time.Time) error { return nil }
+
+func TestLinkConnSplitsWrites(t *testing.T) {
+	a, b := newPacketConnPair(16)
+	defer a.Close()
+	la, lb := newLinkConn(a, 16), newLinkConn(b, 16)
+
+	sent := make([]byte, 100)
+	for i := range sent {
+		sent[i] = byte(i)
+	}
+	if n, err := la.Write(sent); err != nil || n != len(sent) {
+		t.Fatalf("write failed after %d bytes: %v", n, err)
+	}
+	received := make([]byte, len(sent))
+	if _, err := io.ReadFull(lb, received); err != nil {
+		t.Fatal(err)
+	}
+	for i := range sent {
+		if sent[i] != received[i] {
+			t.Fatalf("byte %d was %d, expected %d", i, received[i], sent[i])
+		}
+	}
+}
+
+func TestPeeringOverSmallMTU(t *testing.T) {
+	_, sk1, _ := ed25519.GenerateKey(nil)
+	_, sk2, _ := ed25519.GenerateKey(nil)
+	r1, r2 := NewRouter(nil, sk1), NewRouter(nil, sk2)
+	t.Cleanup(func() {
+		_ = r1.Close()
+		_ = r2.Close()
+	})
+
+	// The first side learns the MTU from the connection and the second
+	// side is told it explicitly.
+	a, b := newPacketConnPair(64)
+	errs := make(chan error, 1)
+	go func() {
+		_, err := r1.Connect(a)
+		errs <- err
+	}()
+	if _, err := r2.Connect(b, ConnectionMTU(64)); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second * 10)
+	for len(r1.Coords()) == 0 && len(r2.Coords()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("tree didn't converge")
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if result, err := r1.Lookup(ctx, r2.PublicKey()); err != nil || !result.Reachable {
+		t.Fatalf("lookup over small MTU link failed: %v", err)
+	}
+}
@@ -0,0 +1,232 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+	"go.uber.org/atomic"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+// A node can be peered with the same neighbour more than once over
+// different transports, e.g. over the LAN by multicast and over the WAN by
+// TCP at the same time. Each peering is a separate port, but they all lead
+// to the same node, so we treat them as links to one neighbour. Frames for
+// the neighbour always go over the best of the links that are up, which is
+// the one with the fastest peer type. When a link goes down, the paths,
+// parent and descending node that used it are moved to the best remaining
+// link rather than being torn down, and traffic that was still queued for
+// it is sent over that link instead, so nothing needs to be set up again.
+//
+// With RouterOptionLinkAggregation, traffic is striped across all of the
+// links that are up instead, for more bandwidth than any one of them has.
+// Each flow, i.e. the traffic between two keys in one traffic class, sticks
+// to one link so that its frames aren't reordered, and flows are spread
+// over the links in proportion to how fast each link drains. Protocol
+// frames still always take the best link. The links are chosen by weighted
+// rendezvous hashing, so a link coming or going only moves the flows that
+// have to move, and the weights are rounded so that small changes in the
+// measured throughput don't move flows back and forth.
+
+// betterLink returns true if the first link to a neighbour should be used
+// instead of the second. Lower peer types are usually faster connections.
+// Ties go to the lower port so that the choice is stable.
+func betterLink(a, b *peer) bool {
+	if a.peertype != b.peertype {
+		return a.peertype < b.peertype
+	}
+	return a.port < b.port
+}
+
+// _bestLink returns the best running link to the same neighbour as the
+// given peering, which may be the peering itself.
+func (s *state) _bestLink(p *peer) *peer {
+	if p == nil || p == s.r.local || s._links[p.public] < 2 {
+		return p
+	}
+	if other := s._otherLink(p); other != nil && (!p.started.Load() || betterLink(other, p)) {
+		return other
+	}
+	return p
+}
+
+// _otherLink returns the best running link to the same neighbour as the
+// given peering, other than the peering itself, or nil if there isn't one.
+func (s *state) _otherLink(p *peer) *peer {
+	var best *peer
+	for _, q := range s._peers {
+		if q == nil || q == p || q.public != p.public || !q.started.Load() {
+			continue
+		}
+		if best == nil || betterLink(q, best) {
+			best = q
+		}
+	}
+	return best
+}
+
+// _linkUp is called when a new peering starts.
+func (s *state) _linkUp(p *peer) {
+	if s._links == nil {
+		s._links = map[types.PublicKey]int{}
+	}
+	s._links[p.public]++
+}
+
+// _linkDown is called when a peering stops. It returns the link that takes
+// over from it, if there is one.
+func (s *state) _linkDown(p *peer) *peer {
+	if _, ok := s._links[p.public]; !ok {
+		// The local peering, or a peering that never started.
+		return nil
+	}
+	if s._links[p.public]--; s._links[p.public] <= 0 {
+		delete(s._links, p.public)
+		return nil
+	}
+	return s._otherLink(p)
+}
+
+// _failOverQueued moves the traffic that is still queued for a peering
+// which has stopped onto another link to the same neighbour.
+func (s *state) _failOverQueued(from, to *peer) {
+	if from.traffic == nil || to.traffic == nil {
+		return
+	}
+	for from.traffic.queuecount() > 0 {
+		select {
+		case f := <-from.traffic.pop():
+			from.traffic.ack(f)
+			if !to.send(f) {
+				framePool.Put(f)
+			}
+		default:
+			// Anything left has already been taken by the writer.
+			return
+		}
+	}
+}
+
+// _failOverRoutes moves everything that used a peering which has stopped
+// onto another link to the same neighbour.
+func (s *state) _failOverRoutes(from, to *peer) {
+	for _, entry := range s._table {
+		if entry.Source == from {
+			entry.Source = to
+		}
+		if entry.Destination == from {
+			entry.Destination = to
+		}
+	}
+	if desc := s._descending; desc != nil && desc.Source == from {
+		desc.Source = to
+	}
+	if s._parent == from && s._announcements[to] != nil && !to.noParent {
+		s._setParent(to, fmt.Sprintf("link on port %d went down, failed over to port %d", from.port, to.port))
+	}
+	s.r.log.Println("Failed over from port", from.port, "to port", to.port, "for peer", from.public.String())
+}
+
+// linkThroughput estimates how quickly a link drains, in bytes per second,
+// from writes that had to block, in the same way as the pacer does. It is
+// updated by the writer and read by the state actor.
+type linkThroughput struct {
+	rate atomic.Float64 // Zero if not known yet
+}
+
+func (t *linkThroughput) observe(size int, writeTime time.Duration) {
+	if writeTime < pacerMinBlockedWrite {
+		return
+	}
+	sample := float64(size) / writeTime.Seconds()
+	if rate := t.rate.Load(); rate > 0 {
+		sample = rate + (sample-rate)/8
+	}
+	t.rate.Store(sample)
+}
+
+// linkWeight rounds the measured throughput of a link to the nearest half
+// power of two, so that flows only move when it changes by a good deal.
+func linkWeight(rate float64) float64 {
+	return math.Exp2(math.Round(math.Log2(rate)*2) / 2)
+}
+
+// flowHash identifies the flow that a traffic frame belongs to.
+func flowHash(f *types.Frame) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write(f.SourceKey[:])
+	_, _ = h.Write(f.DestinationKey[:])
+	_, _ = h.Write([]byte{byte(f.TrafficClass())})
+	return h.Sum64()
+}
+
+// mix64 scrambles the bits of the value, as in the SplitMix64 finalizer.
+func mix64(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+// _stripeLink returns the link to the same neighbour as the given peering
+// that the flow of the traffic frame should use, if link aggregation is
+// enabled, or otherwise the best link.
+func (s *state) _stripeLink(p *peer, f *types.Frame) *peer {
+	if !s.r.stripeLinks || p == nil || p == s.r.local || s._links[p.public] < 2 || !f.Type.IsTraffic() {
+		return s._bestLink(p)
+	}
+	links := make([]*peer, 0, s._links[p.public])
+	var known, total float64
+	for _, q := range s._peers {
+		if q == nil || q.public != p.public || !q.started.Load() {
+			continue
+		}
+		links = append(links, q)
+		if rate := q.throughput.rate.Load(); rate > 0 {
+			known, total = known+1, total+linkWeight(rate)
+		}
+	}
+	// Links that haven't been measured yet get the average weight.
+	unknown := 1.0
+	if known > 0 {
+		unknown = total / known
+	}
+	flow := flowHash(f)
+	var best *peer
+	var bestScore float64
+	for _, q := range links {
+		weight := unknown
+		if rate := q.throughput.rate.Load(); rate > 0 {
+			weight = linkWeight(rate)
+		}
+		// Map the hash into (0, 1) and score it so that each link wins
+		// a share of the flows in proportion to its weight.
+		u := (float64(mix64(flow^uint64(q.port))>>11) + 0.5) / (1 << 53)
+		if score := -weight / math.Log(u); best == nil || score > bestScore {
+			best, bestScore = q, score
+		}
+	}
+	if best == nil {
+		return p
+	}
+	return best
+}
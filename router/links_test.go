@@ -0,0 +1,169 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestBestLink(t *testing.T) {
+	s := newTestState(types.PublicKey{}, systemClock{})
+	if other := s._linkDown(s.r.local); other != nil {
+		t.Fatalf("expected no link to take over from the local peering")
+	}
+	neighbour := types.PublicKey{1}
+	remote, lan := addTestPeer(s, neighbour), addTestPeer(s, neighbour)
+	remote.peertype, lan.peertype = ConnectionPeerType(PeerTypeRemote), ConnectionPeerType(PeerTypeMulticast)
+	other := addTestPeer(s, types.PublicKey{2})
+	for _, p := range s._peers[1:] {
+		s._linkUp(p)
+	}
+
+	if best := s._bestLink(remote); best != lan {
+		t.Fatalf("expected the multicast link to be preferred, got port %d", best.port)
+	}
+	if best := s._bestLink(other); best != other {
+		t.Fatalf("expected a single link to be used as it is")
+	}
+
+	// When the preferred link goes down, its paths move to the other.
+	entry := &virtualSnakeEntry{
+		virtualSnakeIndex: &virtualSnakeIndex{PublicKey: types.PublicKey{9}},
+		Source:            lan,
+		Destination:       other,
+	}
+	s._table[*entry.virtualSnakeIndex] = entry
+	lan.started.Store(false)
+	taken := s._linkDown(lan)
+	if taken != remote {
+		t.Fatalf("expected the remote link to take over")
+	}
+	s._failOverRoutes(lan, taken)
+	if entry.Source != remote || entry.Destination != other {
+		t.Fatalf("expected the path to move to the remote link")
+	}
+	if best := s._bestLink(remote); best != remote {
+		t.Fatalf("expected the remote link to be used now")
+	}
+
+	// Once the last link goes down there's nothing to fail over to.
+	remote.started.Store(false)
+	if taken := s._linkDown(remote); taken != nil {
+		t.Fatalf("expected no link to take over")
+	}
+}
+
+func TestLinkFailover(t *testing.T) {
+	var routers [2]*Router
+	for i := range routers {
+		_, sk, _ := ed25519.GenerateKey(nil)
+		routers[i] = NewRouter(nil, sk)
+		r := routers[i]
+		t.Cleanup(func() { _ = r.Close() })
+	}
+	for i := 0; i < 2; i++ {
+		if errA, errB := connectTestRouters(t, routers[0], routers[1]); errA != nil || errB != nil {
+			t.Fatalf("failed to peer routers: %v, %v", errA, errB)
+		}
+	}
+	child := routers[0]
+	if routers[0].PublicKey().CompareTo(routers[1].PublicKey()) > 0 {
+		child = routers[1]
+	}
+
+	// Wait for the child to hear the root on both links.
+	var parent *peer
+	deadline := time.Now().Add(time.Second * 10)
+	for {
+		var announcements int
+		phony.Block(child.state, func() {
+			parent = child.state._parent
+			announcements = len(child.state._announcements)
+		})
+		if parent != nil && announcements == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the child to choose a parent")
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+
+	// Taking down the parent link moves the parent to the other link
+	// straight away.
+	child.Disconnect(parent.port, nil)
+	phony.Block(child.state, func() {
+		if p := child.state._parent; p == nil || p == parent || p.public != parent.public {
+			t.Fatalf("expected the parent to fail over to the other link")
+		}
+	})
+}
+
+func TestStripeLink(t *testing.T) {
+	s := newTestState(types.PublicKey{}, systemClock{})
+	s.r.stripeLinks = true
+	neighbour := types.PublicKey{1}
+	fast, slow := addTestPeer(s, neighbour), addTestPeer(s, neighbour)
+	fast.throughput.rate.Store(4000000)
+	slow.throughput.rate.Store(1000000)
+	for _, p := range s._peers[1:] {
+		s._linkUp(p)
+	}
+
+	counts := map[*peer]int{}
+	for i := 0; i < 1000; i++ {
+		f := &types.Frame{Type: types.TypeTraffic, DestinationKey: types.PublicKey{byte(i), byte(i >> 8)}}
+		link := s._stripeLink(slow, f)
+		if again := s._stripeLink(fast, f); again != link {
+			t.Fatalf("expected flow %d to stick to one link", i)
+		}
+		counts[link]++
+	}
+	// The fast link should carry about four fifths of the flows.
+	if counts[fast] < 700 || counts[fast] > 900 {
+		t.Fatalf("expected flows in proportion to throughput, got %d and %d", counts[fast], counts[slow])
+	}
+
+	// Small changes in throughput don't move flows.
+	if linkWeight(4000000) != linkWeight(4200000) {
+		t.Fatalf("expected small changes in throughput to be rounded away")
+	}
+
+	// Protocol frames take the best link.
+	if link := s._stripeLink(slow, &types.Frame{Type: types.TypeBootstrap}); link != fast {
+		t.Fatalf("expected protocol frames to take the best link")
+	}
+}
+
+func TestLinkThroughput(t *testing.T) {
+	var tp linkThroughput
+	tp.observe(1000, time.Microsecond)
+	if rate := tp.rate.Load(); rate != 0 {
+		t.Fatalf("expected a write that didn't block to be ignored, got %f", rate)
+	}
+	tp.observe(10000, time.Millisecond*10)
+	if rate := tp.rate.Load(); rate != 1000000 {
+		t.Fatalf("expected the first sample to be taken as it is, got %f", rate)
+	}
+	tp.observe(20000, time.Millisecond*10)
+	if rate := tp.rate.Load(); rate != 1125000 {
+		t.Fatalf("expected the rate to be smoothed, got %f", rate)
+	}
+}
@@ -0,0 +1,258 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"fmt"
+	"runtime"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/router/events"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+// With RouterOptionLoadShedding, the memory in use, the number of
+// goroutines and the bytes held in all of the peer queues are sampled
+// regularly, and the pressure is how close the closest of them is to its
+// limit. As the pressure rises we shed load in steps, giving up the things
+// that matter least first: transit traffic in the background class, then
+// bulk transit traffic along with the gossip that can wait, such as wakeup
+// broadcasts, service advertisements and reachability filters, and finally
+// new peerings. Our own traffic, traffic for us, tree and SNEK maintenance
+// and revocations are never shed. Each step only ends once the pressure has
+// dropped a little below where it started, so that we don't flap between
+// them.
+
+// loadShedDefaultInterval is how often the load is sampled if the option
+// doesn't say.
+const loadShedDefaultInterval = time.Second
+
+// loadShedHysteresis is how far below a threshold the pressure has to drop
+// before we leave the level that it starts.
+const loadShedHysteresis = 0.05
+
+// loadShedThresholds are the pressures at which each level above
+// LoadNormal starts.
+var loadShedThresholds = [...]float64{
+	LoadShedTransit - 1:    0.7,
+	LoadDeferGossip - 1:    0.85,
+	LoadRefusePeerings - 1: 0.95,
+}
+
+// LoadLevel describes how much load we are shedding.
+type LoadLevel int
+
+const (
+	LoadNormal         LoadLevel = iota // Nothing is shed
+	LoadShedTransit                     // Background transit traffic is dropped
+	LoadDeferGossip                     // Bulk transit traffic is dropped and gossip is deferred too
+	LoadRefusePeerings                  // New peerings are refused too
+)
+
+func (l LoadLevel) String() string {
+	switch l {
+	case LoadNormal:
+		return "normal"
+	case LoadShedTransit:
+		return "shed_transit"
+	case LoadDeferGossip:
+		return "defer_gossip"
+	case LoadRefusePeerings:
+		return "refuse_peerings"
+	default:
+		return "unknown"
+	}
+}
+
+func (l LoadLevel) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+// LoadStatus describes the last sample taken by the load monitor and how
+// much load has been shed.
+type LoadStatus struct {
+	Level      LoadLevel `json:"level"`
+	Pressure   float64   `json:"pressure"`   // The highest of the ratios of each sample to its limit
+	Memory     uint64    `json:"memory"`     // Bytes of heap in use
+	Goroutines int       `json:"goroutines"` // Goroutines running in the process
+	Queued     uint64    `json:"queued"`     // Bytes held in all of the peer queues
+	Shed       uint64    `json:"shed"`       // Transit frames dropped
+	Deferred   uint64    `json:"deferred"`   // Gossip frames not sent or forwarded
+	Refused    uint64    `json:"refused"`    // Peerings refused
+}
+
+// loadShedConfig holds the settings from RouterOptionLoadShedding.
+type loadShedConfig struct {
+	memoryLimit    uint64
+	goroutineLimit int
+	queueLimit     uint64
+	interval       time.Duration
+	sample         func() (memory uint64, goroutines int) // Replaced in tests
+}
+
+func newLoadShedConfig(o RouterOptionLoadShedding) *loadShedConfig {
+	if o.MemoryLimit == 0 && o.GoroutineLimit <= 0 && o.QueueLimit == 0 {
+		return nil
+	}
+	c := &loadShedConfig{
+		memoryLimit:    o.MemoryLimit,
+		goroutineLimit: o.GoroutineLimit,
+		queueLimit:     o.QueueLimit,
+		interval:       o.Interval,
+		sample:         sampleRuntime,
+	}
+	if c.interval <= 0 {
+		c.interval = loadShedDefaultInterval
+	}
+	return c
+}
+
+func sampleRuntime() (uint64, int) {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapAlloc, runtime.NumGoroutine()
+}
+
+// pressure returns the highest of the ratios of the samples to the limits
+// that were given.
+func (c *loadShedConfig) pressure(memory uint64, goroutines int, queued uint64) float64 {
+	var pressure float64
+	ratio := func(sample, limit float64) {
+		if limit > 0 && sample/limit > pressure {
+			pressure = sample / limit
+		}
+	}
+	ratio(float64(memory), float64(c.memoryLimit))
+	ratio(float64(goroutines), float64(c.goroutineLimit))
+	ratio(float64(queued), float64(c.queueLimit))
+	return pressure
+}
+
+// loadLevelFor returns the level for the given pressure, given the level
+// that we are at now.
+func loadLevelFor(pressure float64, current LoadLevel) LoadLevel {
+	level := LoadNormal
+	for i, threshold := range loadShedThresholds {
+		l := LoadLevel(i + 1)
+		if l <= current {
+			threshold -= loadShedHysteresis
+		}
+		if pressure >= threshold {
+			level = l
+		}
+	}
+	return level
+}
+
+// _maintainLoadShedding samples the load and moves between levels.
+func (s *state) _maintainLoadShedding() {
+	if s._suspended {
+		// Resume will restart maintenance.
+		return
+	}
+	select {
+	case <-s.r.context.Done():
+		return
+	default:
+		defer s._loadShedTimer.Reset(s.r.loadShedding.interval)
+	}
+
+	load := &s._load
+	load.Memory, load.Goroutines = s.r.loadShedding.sample()
+	load.Queued = 0
+	for _, p := range s._peers {
+		if p == nil || p.proto == nil || p.traffic == nil {
+			continue
+		}
+		load.Queued += p.proto.queueStats().Bytes + p.traffic.queueStats().Bytes
+		if p.control != nil {
+			load.Queued += p.control.queueStats().Bytes
+		}
+	}
+	load.Pressure = s.r.loadShedding.pressure(load.Memory, load.Goroutines, load.Queued)
+	level := loadLevelFor(load.Pressure, load.Level)
+	if level == load.Level {
+		return
+	}
+	reason := fmt.Sprintf("pressure %.2f (memory %d bytes, %d goroutines, %d bytes queued)", load.Pressure, load.Memory, load.Goroutines, load.Queued)
+	s.r.log.Printf("Load level changed from %s to %s: %s", load.Level, level, reason)
+	s._recordEvent(ProtocolLoadLevelChanged, types.PublicKey{}, nil, fmt.Sprintf("%s: %s", level, reason))
+	load.Level = level
+	pressure := load.Pressure
+	s.r.Act(nil, func() {
+		s.r._publish(events.LoadLevelChanged{
+			Level:    level.String(),
+			Pressure: pressure,
+		})
+	})
+}
+
+// _shedTransit returns true if a frame that we are forwarding from one peer
+// to another should be dropped to shed load.
+func (s *state) _shedTransit(from, nexthop *peer, f *types.Frame) bool {
+	if s._load.Level < LoadShedTransit || from == s.r.local || nexthop == nil || nexthop == s.r.local {
+		return false
+	}
+	if f.Type != types.TypeTraffic && f.Type != types.TypeCustody {
+		return false
+	}
+	shed := types.TrafficClassBackground
+	if s._load.Level >= LoadDeferGossip {
+		shed = types.TrafficClassBulk
+	}
+	if f.TrafficClass() < shed {
+		return false
+	}
+	s._load.Shed++
+	return true
+}
+
+// _deferGossip returns true if gossip of the given type should not be sent
+// or forwarded for now.
+func (s *state) _deferGossip(t types.FrameType) bool {
+	if s._load.Level < LoadDeferGossip {
+		return false
+	}
+	switch t {
+	case types.TypeWakeupBroadcast, types.TypeServiceAdvert, types.TypeReachability:
+		s._load.Deferred++
+		return true
+	}
+	return false
+}
+
+// _refusePeering returns an error if new peerings should be refused to
+// shed load.
+func (s *state) _refusePeering() error {
+	if s._load.Level < LoadRefusePeerings {
+		return nil
+	}
+	s._load.Refused++
+	return fmt.Errorf("%w: refusing new peerings at pressure %.2f", ErrOverloaded, s._load.Pressure)
+}
+
+// LoadStatus returns the last sample taken by the load monitor enabled with
+// RouterOptionLoadShedding, and how much load has been shed.
+func (r *Router) LoadStatus() LoadStatus {
+	var status LoadStatus
+	phony.Block(r.state, func() {
+		status = r.state._load
+	})
+	return status
+}
@@ -0,0 +1,135 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestLoadLevelHysteresis(t *testing.T) {
+	cases := []struct {
+		pressure float64
+		current  LoadLevel
+		expected LoadLevel
+	}{
+		{0.5, LoadNormal, LoadNormal},
+		{0.7, LoadNormal, LoadShedTransit},
+		{0.9, LoadNormal, LoadDeferGossip},
+		{1.2, LoadNormal, LoadRefusePeerings},
+		{0.67, LoadShedTransit, LoadShedTransit},
+		{0.64, LoadShedTransit, LoadNormal},
+		{0.82, LoadRefusePeerings, LoadDeferGossip},
+		{0.82, LoadShedTransit, LoadShedTransit},
+	}
+	for _, tc := range cases {
+		if level := loadLevelFor(tc.pressure, tc.current); level != tc.expected {
+			t.Errorf("pressure %.2f at %s: expected %s, got %s", tc.pressure, tc.current, tc.expected, level)
+		}
+	}
+}
+
+func TestLoadShedding(t *testing.T) {
+	var memory uint64
+	clock := NewManualClock(time.Unix(1000, 0))
+	s := newTestState(types.PublicKey{}, clock)
+	s.r.loadShedding = &loadShedConfig{
+		memoryLimit: 1000,
+		interval:    time.Second,
+		sample:      func() (uint64, int) { return memory, 1 },
+	}
+	s._loadShedTimer = clock.AfterFunc(time.Hour, func() {})
+	from, to := &peer{}, &peer{}
+	frame := func(class types.TrafficClass) *types.Frame {
+		f := &types.Frame{Type: types.TypeTraffic}
+		f.SetTrafficClass(class)
+		return f
+	}
+	sample := func(m uint64, expected LoadLevel) {
+		t.Helper()
+		memory = m
+		s._maintainLoadShedding()
+		if s._load.Level != expected {
+			t.Fatalf("expected %s at %d bytes, got %s", expected, m, s._load.Level)
+		}
+	}
+
+	sample(500, LoadNormal)
+	if s._shedTransit(from, to, frame(types.TrafficClassBackground)) {
+		t.Fatalf("expected nothing to be shed")
+	}
+
+	sample(750, LoadShedTransit)
+	if !s._shedTransit(from, to, frame(types.TrafficClassBackground)) {
+		t.Fatalf("expected background transit traffic to be shed")
+	}
+	if s._shedTransit(from, to, frame(types.TrafficClassBulk)) {
+		t.Fatalf("expected bulk transit traffic not to be shed yet")
+	}
+	if s._shedTransit(s.r.local, to, frame(types.TrafficClassBackground)) || s._shedTransit(from, s.r.local, frame(types.TrafficClassBackground)) {
+		t.Fatalf("expected our own traffic not to be shed")
+	}
+	if s._deferGossip(types.TypeServiceAdvert) {
+		t.Fatalf("expected gossip not to be deferred yet")
+	}
+
+	sample(900, LoadDeferGossip)
+	if !s._shedTransit(from, to, frame(types.TrafficClassBulk)) || s._shedTransit(from, to, frame(types.TrafficClassInteractive)) {
+		t.Fatalf("expected only bulk and background transit traffic to be shed")
+	}
+	if !s._deferGossip(types.TypeWakeupBroadcast) || s._deferGossip(types.TypeRevocation) {
+		t.Fatalf("expected only deferrable gossip to be deferred")
+	}
+	if err := s._refusePeering(); err != nil {
+		t.Fatalf("expected peerings not to be refused yet")
+	}
+
+	sample(960, LoadRefusePeerings)
+	if err := s._refusePeering(); !errors.Is(err, ErrOverloaded) {
+		t.Fatalf("expected peerings to be refused, got %v", err)
+	}
+
+	sample(100, LoadNormal)
+	if status := s._load; status.Shed != 2 || status.Deferred != 1 || status.Refused != 1 {
+		t.Fatalf("expected shed load to be counted, got %+v", status)
+	}
+	if events := s._history.query(ProtocolHistoryQuery{Kind: ProtocolLoadLevelChanged}); len(events) != 4 {
+		t.Fatalf("expected four level changes in the history, got %d", len(events))
+	}
+}
+
+func TestLoadSheddingRefusesPeerings(t *testing.T) {
+	var routers [2]*Router
+	for i := range routers {
+		_, sk, _ := ed25519.GenerateKey(nil)
+		routers[i] = NewRouter(nil, sk, RouterOptionLoadShedding{GoroutineLimit: 1 << 30})
+		r := routers[i]
+		t.Cleanup(func() { _ = r.Close() })
+	}
+	phony.Block(routers[0].state, func() {
+		routers[0].state._load.Level = LoadRefusePeerings
+	})
+	if errA, _ := connectTestRouters(t, routers[0], routers[1]); !errors.Is(errA, ErrOverloaded) {
+		t.Fatalf("expected the peering to be refused, got %v", errA)
+	}
+	if status := routers[0].LoadStatus(); status.Refused != 1 {
+		t.Fatalf("expected the refused peering to be counted, got %+v", status)
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+// A node can be given a coarse locality hint, such as a region tag like
+// "eu-west", which means nothing to the router except that two nodes with
+// the same hint are probably close to each other. Peers that both have a
+// hint exchange them straight after the handshake, and nodes include their
+// hint in their service advertisements. When choosing a parent, a nearby
+// peer is preferred over one that is otherwise equal, and nearby services
+// are listed before ones that are otherwise equal. This avoids sending
+// traffic to the other side of the world and back when there is no need.
+// Hints are only ever used to break ties, so a wrong hint can't do more
+// harm than a less efficient tree.
+
+// handshakeLocality is set if the node has a locality hint and wants to
+// exchange it after the handshake.
+const handshakeLocality = 1 << 1
+
+// validLocality returns true if the locality hint can be sent to other
+// nodes.
+func validLocality(locality string) bool {
+	return len(locality) > 0 && len(locality) <= types.MaxLocalityLength
+}
+
+// Locality returns our locality hint, or an empty string if we don't have
+// one.
+func (r *Router) Locality() string {
+	return r.locality
+}
+
+// nearby returns true if a node with the given locality hint is probably
+// close to us.
+func (r *Router) nearby(locality string) bool {
+	return r.locality != "" && locality == r.locality
+}
+
+// exchangeLocality sends our locality hint to the remote node and returns
+// theirs. This must only be called if both nodes have set the locality bit
+// in the handshake.
+func (r *Router) exchangeLocality(conn net.Conn, deadline time.Time) (string, error) {
+	if err := conn.SetDeadline(deadline); err != nil {
+		return "", fmt.Errorf("conn.SetDeadline: %w", err)
+	}
+	ours := append([]byte{byte(len(r.locality))}, r.locality...)
+	if _, err := conn.Write(ours); err != nil {
+		return "", fmt.Errorf("conn.Write: %w", err)
+	}
+	var length [1]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return "", fmt.Errorf("io.ReadFull: %w", err)
+	}
+	theirs := make([]byte, length[0])
+	if _, err := io.ReadFull(conn, theirs); err != nil {
+		return "", fmt.Errorf("io.ReadFull: %w", err)
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return "", fmt.Errorf("conn.SetDeadline: %w", err)
+	}
+	if !validLocality(string(theirs)) {
+		return "", fmt.Errorf("invalid locality of length %d", len(theirs))
+	}
+	return string(theirs), nil
+}
+
+// _nearbyParent returns a peer that is nearby and offers the same root as
+// the chosen parent, if the chosen parent isn't nearby, or otherwise the
+// chosen parent. Our current parent is kept if it qualifies, so that we
+// don't switch between nearby parents.
+func (s *state) _nearbyParent(chosen *peer) *peer {
+	chosenAnn := s._announcements[chosen]
+	if chosenAnn == nil || s.r.locality == "" || s.r.nearby(chosen.locality) {
+		return chosen
+	}
+	var best *peer
+	var bestOrder uint64
+	for p, ann := range s._announcements {
+		switch {
+		case ann == nil || p == chosen || !s.r.nearby(p.locality):
+			continue
+		case !p.started.Load() || p._demoted || p._departing || p.noParent:
+			continue
+		case ann.Root != chosenAnn.Root || since(s.r.clock, ann.receiveTime) >= s.r.timings.AnnouncementTimeout:
+			continue
+		case ann.IsLoopOrChildOf(s.r.public):
+			continue
+		case p == s._parent:
+			return p
+		}
+		if best == nil || ann.receiveOrder < bestOrder {
+			best, bestOrder = p, ann.receiveOrder
+		}
+	}
+	if best == nil {
+		return chosen
+	}
+	return best
+}
@@ -0,0 +1,152 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+	"go.uber.org/atomic"
+)
+
+func TestLocalityExchange(t *testing.T) {
+	newRouter := func(locality string) *Router {
+		_, sk, _ := ed25519.GenerateKey(nil)
+		r := NewRouter(nil, sk, RouterOptionLocality(locality))
+		t.Cleanup(func() { _ = r.Close() })
+		return r
+	}
+
+	for _, tc := range []struct {
+		a, b     string
+		expected string
+	}{
+		{"eu-west", "", ""},
+		{"", "us-east", ""},
+		{"eu-west", "us-east", "us-east"},
+	} {
+		a, b := newRouter(tc.a), newRouter(tc.b)
+		if errA, errB := connectTestRouters(t, a, b); errA != nil || errB != nil {
+			t.Fatalf("failed to peer: %v, %v", errA, errB)
+		}
+		for _, peer := range a.Peers() {
+			if peer.Port != 0 && peer.Locality != tc.expected {
+				t.Fatalf("%q and %q: expected peer locality %q, got %q", tc.a, tc.b, tc.expected, peer.Locality)
+			}
+		}
+	}
+}
+
+func TestLocalityTooLong(t *testing.T) {
+	_, sk, _ := ed25519.GenerateKey(nil)
+	r := NewRouter(nil, sk, RouterOptionLocality("this-locality-is-much-too-long-to-be-sent"))
+	defer r.Close() // nolint:errcheck
+	if r.Locality() != "" {
+		t.Fatalf("expected locality that is too long to be ignored")
+	}
+}
+
+func TestLocalityServiceAdvertisements(t *testing.T) {
+	_, skA, _ := ed25519.GenerateKey(nil)
+	_, skB, _ := ed25519.GenerateKey(nil)
+	a := NewRouter(nil, skA, RouterOptionLocality("eu-west"))
+	b := NewRouter(nil, skB, RouterOptionLocality("eu-west"))
+	t.Cleanup(func() {
+		_ = a.Close()
+		_ = b.Close()
+	})
+	if errA, errB := connectTestRouters(t, a, b); errA != nil || errB != nil {
+		t.Fatalf("failed to peer: %v, %v", errA, errB)
+	}
+	if err := b.AdvertiseService("relay", 1); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second * 10)
+	for {
+		if records := a.Services("relay"); len(records) == 1 {
+			if records[0].Locality != "eu-west" {
+				t.Fatalf("expected locality in service record, got %q", records[0].Locality)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("service advertisement wasn't received")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	// Nearby services come before ones with the same capacity elsewhere.
+	far := types.PublicKey{1}
+	phony.Block(a.state, func() {
+		a.state._seenServices[serviceKey{far, "relay"}] = &serviceEntry{
+			capacity: 1,
+			locality: "us-east",
+			lastSeen: a.clock.Now(),
+		}
+	})
+	if records := a.Services("relay"); len(records) != 2 || records[0].PublicKey != b.PublicKey() {
+		t.Fatalf("expected nearby service to be listed first")
+	}
+}
+
+func TestNearbyParent(t *testing.T) {
+	root := types.Root{RootPublicKey: types.PublicKey{9}, RootSequence: 1}
+	s := newTestState(types.PublicKey{2}, systemClock{})
+	s.r.locality = "eu-west"
+	far := &peer{started: *atomic.NewBool(true), public: types.PublicKey{8}, port: 1, locality: "us-east"}
+	near1 := &peer{started: *atomic.NewBool(true), public: types.PublicKey{7}, port: 2, locality: "eu-west"}
+	near2 := &peer{started: *atomic.NewBool(true), public: types.PublicKey{6}, port: 3, locality: "eu-west"}
+	announcement := func(order uint64) *rootAnnouncementWithTime {
+		return &rootAnnouncementWithTime{
+			SwitchAnnouncement: types.SwitchAnnouncement{Root: root},
+			receiveTime:        time.Now(),
+			receiveOrder:       order,
+		}
+	}
+	s._announcements = announcementTable{
+		far:   announcement(1),
+		near1: announcement(3),
+		near2: announcement(2),
+	}
+
+	// The nearby peer that sent the announcement first is preferred.
+	if p := s._nearbyParent(far); p != near2 {
+		t.Fatalf("expected the first nearby peer to be chosen")
+	}
+
+	// Our current parent is kept if it is nearby.
+	s._parent = near1
+	if p := s._nearbyParent(far); p != near1 {
+		t.Fatalf("expected the current nearby parent to be kept")
+	}
+
+	// Nearby peers with a different root aren't equal candidates.
+	s._parent = nil
+	s._announcements[near1].Root.RootSequence = 2
+	s._announcements[near2].Root.RootSequence = 2
+	if p := s._nearbyParent(far); p != far {
+		t.Fatalf("expected the chosen parent to be kept")
+	}
+
+	// Nothing changes if we don't have a locality.
+	s._announcements[near2].Root.RootSequence = 1
+	s.r.locality = ""
+	if p := s._nearbyParent(far); p != far {
+		t.Fatalf("expected the chosen parent to be kept without a locality")
+	}
+}
@@ -0,0 +1,208 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+// Lookups work by sending an echo request towards the public key using SNEK
+// routing. The node with that key answers with an echo reply, which is sent
+// back to our coordinates using tree routing where possible and which carries
+// the current coordinates of the remote node. Each node that forwards either
+// frame, including the node that sent it, increments the hop count in the
+// frame header, so we learn the length of the path in both directions. Nodes
+// that don't understand echo frames will just drop them, in which case the
+// lookup will time out. If the node has rotated its identity then we may be
+// sent a continuity record instead, in which case the lookup carries on with
+// the new key.
+
+// LookupResult contains the outcome of a successful lookup.
+type LookupResult struct {
+	Reachable  bool              // Did the remote node answer?
+	Coords     types.Coordinates // The current coordinates of the remote node
+	Hops       int               // Number of hops taken by the request
+	ReturnHops int               // Number of hops taken by the reply
+	RTT        time.Duration     // Time between sending the request and the reply
+	Successor  types.PublicKey   // The new key of the remote node, if it has moved
+}
+
+type pendingEcho struct {
+	public    types.PublicKey
+	successor types.PublicKey
+	sent      time.Time
+	notify    func(LookupResult)
+}
+
+// Lookup actively probes the network to see whether the node with the given
+// public key is reachable. It blocks until the remote node answers or until
+// the context expires, in which case the context error is returned. A
+// successful lookup also refreshes the coordinates that will be used for
+// sending traffic to the node.
+func (r *Router) Lookup(ctx context.Context, public types.PublicKey) (LookupResult, error) {
+	if public == r.public {
+		return LookupResult{
+			Reachable: true,
+			Coords:    r.state.coords(),
+		}, nil
+	}
+	result := make(chan LookupResult, 1)
+	var id uint64
+	var err error
+	phony.Block(r.state, func() {
+		var f *types.Frame
+		successor, moved := r.state._successor(public)
+		if moved {
+			public = successor
+		}
+		id, f, err = r.state._newEchoRequest(public, func(res LookupResult) {
+			result <- res
+		})
+		if err != nil {
+			err = fmt.Errorf("r.state._newEchoRequest: %w", err)
+			return
+		}
+		if moved {
+			r.state._echoes[id].successor = successor
+		}
+		if err = r.state._forward(r.local, f); err != nil {
+			err = fmt.Errorf("r.state._forward: %w", err)
+		}
+	})
+	defer phony.Block(r.state, func() {
+		delete(r.state._echoes, id)
+	})
+	if err != nil {
+		return LookupResult{}, err
+	}
+	select {
+	case res := <-result:
+		return res, nil
+	case <-ctx.Done():
+		return LookupResult{}, ctx.Err()
+	case <-r.context.Done():
+		return LookupResult{}, ErrRouterClosed
+	}
+}
+
+// _newEchoRequest builds an echo request for the node with the given public
+// key, which will be routed using SNEK. The notify function will be called
+// from the state actor if a reply arrives.
+func (s *state) _newEchoRequest(public types.PublicKey, notify func(LookupResult)) (uint64, *types.Frame, error) {
+	s._echoSequence++
+	id := s._echoSequence
+	f, err := s._newEchoRequestWithID(id, public, notify)
+	return id, f, err
+}
+
+// _newEchoRequestWithID builds an echo request using an existing ID, so
+// that a lookup can be carried on towards a different key.
+func (s *state) _newEchoRequestWithID(id uint64, public types.PublicKey, notify func(LookupResult)) (*types.Frame, error) {
+	f := getFrame()
+	f.Type = types.TypeEchoRequest
+	f.HopLimit = types.MaxHopLimit
+	f.DestinationKey = public
+	f.Source = s._coords()
+	f.SourceKey = s.r.public
+	f.Watermark = types.VirtualSnakeWatermark{
+		PublicKey: types.FullMask,
+		Sequence:  0,
+	}
+	echo := types.Echo{
+		ID: types.Varu64(id),
+	}
+	n, err := echo.MarshalBinary(f.Payload[:cap(f.Payload)])
+	if err != nil {
+		framePool.Put(f)
+		return nil, fmt.Errorf("echo.MarshalBinary: %w", err)
+	}
+	f.Payload = f.Payload[:n]
+	s._echoes[id] = &pendingEcho{
+		public: public,
+		sent:   s.r.clock.Now(),
+		notify: notify,
+	}
+	return f, nil
+}
+
+// _handleEcho is called when an echo frame addressed to us arrives. Echo
+// requests are answered with an echo reply and echo replies are matched up
+// with the lookups that are waiting for them.
+func (s *state) _handleEcho(f *types.Frame) error {
+	var echo types.Echo
+	if _, err := types.Decode(&echo, f.Payload); err != nil {
+		return fmt.Errorf("echo.UnmarshalBinary: %w", err)
+	}
+	if len(f.Source) > 0 {
+		s._cacheCoords(f.SourceKey, append(types.Coordinates{}, f.Source...))
+	}
+
+	switch f.Type {
+	case types.TypeEchoRequest:
+		reply := getFrame()
+		reply.Type = types.TypeEchoReply
+		reply.HopLimit = types.MaxHopLimit
+		reply.Destination = append(reply.Destination[:0], f.Source...)
+		reply.DestinationKey = f.SourceKey
+		reply.Source = s._coords()
+		reply.SourceKey = s.r.public
+		reply.Watermark = types.VirtualSnakeWatermark{
+			PublicKey: types.FullMask,
+			Sequence:  0,
+		}
+		response := types.Echo{
+			ID:   echo.ID,
+			Hops: types.Varu64(f.Extra),
+		}
+		n, err := response.MarshalBinary(reply.Payload[:cap(reply.Payload)])
+		if err != nil {
+			framePool.Put(reply)
+			return fmt.Errorf("response.MarshalBinary: %w", err)
+		}
+		reply.Payload = reply.Payload[:n]
+		if !s._replyAllowed(f, reply) {
+			framePool.Put(reply)
+			return nil
+		}
+		return s._forward(s.r.local, reply)
+
+	case types.TypeEchoReply:
+		pending, ok := s._echoes[uint64(echo.ID)]
+		if !ok || pending.public != f.SourceKey {
+			return nil
+		}
+		delete(s._echoes, uint64(echo.ID))
+		result := LookupResult{
+			Reachable:  true,
+			Coords:     append(types.Coordinates{}, f.Source...),
+			Hops:       int(echo.Hops),
+			ReturnHops: int(f.Extra),
+			RTT:        since(s.r.clock, pending.sent),
+			Successor:  pending.successor,
+		}
+		s._recordDestinationRTT(f.SourceKey, result.RTT)
+		s._recordPathLength(f.SourceKey, f.Source, result.Hops)
+		pending.notify(result)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !minimal
+// +build !minimal
+
+package router
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestLookup(t *testing.T) {
+	low, high := newTestRouterPair(t)
+
+	deadline := time.Now().Add(time.Second * 10)
+	for len(low.Coords()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("tree didn't converge")
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	result, err := low.Lookup(ctx, high.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Reachable {
+		t.Fatalf("expected remote node to be reachable")
+	}
+	if !result.Coords.EqualTo(high.Coords()) {
+		t.Fatalf("expected coordinates %v, got %v", high.Coords(), result.Coords)
+	}
+	if result.Hops != 1 || result.ReturnHops != 1 {
+		t.Fatalf("expected direct path, got %d hops there and %d hops back", result.Hops, result.ReturnHops)
+	}
+
+	if rtt, ok := low.DestinationRTT(high.PublicKey()); !ok || rtt.Samples != 1 {
+		t.Fatalf("expected lookup to record a round trip time sample")
+	}
+
+	var unknown types.PublicKey
+	pk, _, _ := ed25519.GenerateKey(nil)
+	copy(unknown[:], pk)
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancel()
+	if result, err := low.Lookup(ctx, unknown); !errors.Is(err, context.DeadlineExceeded) || result.Reachable {
+		t.Fatalf("expected unknown node lookup to time out, got %v (reachable %v)", err, result.Reachable)
+	}
+}
+
+func TestLookupWithoutPeerings(t *testing.T) {
+	_, sk, _ := ed25519.GenerateKey(nil)
+	r := NewRouter(nil, sk)
+	t.Cleanup(func() { _ = r.Close() })
+
+	var unknown types.PublicKey
+	pk, _, _ := ed25519.GenerateKey(nil)
+	copy(unknown[:], pk)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if _, err := r.Lookup(ctx, unknown); !errors.Is(err, ErrNoNextHop) {
+		t.Fatalf("expected ErrNoNextHop, got %v", err)
+	}
+}
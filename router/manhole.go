@@ -33,8 +33,31 @@ type manholeResponse struct {
 	SNEK   struct {
 		Descending *virtualSnakeEntry   `json:"descending"`
 		Paths      []*virtualSnakeEntry `json:"paths"`
+		Bootstraps struct {
+			Outstanding   []*bootstrapAttempt `json:"outstanding"`
+			Failures      int                 `json:"failures"`
+			LastFailure   string              `json:"last_failure,omitempty"`
+			LastFailureAt time.Time           `json:"last_failure_at,omitempty"`
+			Backoff       time.Duration       `json:"backoff"`
+		} `json:"bootstraps"`
 	} `json:"snek"`
-	CoordCache map[string]types.Coordinates `json:"coords_cache"`
+	CoordCache  map[string]types.Coordinates `json:"coords_cache"`
+	Convergence ConvergenceStats             `json:"convergence"`
+	Tree        TreeStats                    `json:"tree"`
+	Keyspace    KeyspaceStats                `json:"keyspace"`
+	Roots       []MisbehavingRoot            `json:"misbehaving_roots,omitempty"`
+	Adjacency   []AdjacencyInconsistency     `json:"adjacency_inconsistencies,omitempty"`
+	Memory      MemoryStats                  `json:"memory"`
+	Announce    AnnouncementStats            `json:"announcements"`
+	SendQueue   SendQueueStats               `json:"send_queue"`
+	Pools       []PoolStats                  `json:"pools"`
+	Load        LoadStatus                   `json:"load"`
+	Fallbacks   RoutingFallbacks             `json:"fallbacks"`
+	PathStats   map[string]PathStats         `json:"path_stats,omitempty"`
+	Health      HealthReport                 `json:"health"`
+	Rollups     []StatsRollup                `json:"rollups"`
+	Frames      *FrameAnalysis               `json:"frames,omitempty"`
+	Latency     []FrameLatencyStats          `json:"forwarding_latency,omitempty"`
 }
 
 type manholePeer struct {
@@ -48,6 +71,13 @@ type manholePeer struct {
 	TXProto      uint64             `json:"tx_proto_bytes"`
 	RXTraffic    uint64             `json:"rx_traffic_bytes"`
 	TXTraffic    uint64             `json:"tx_traffic_bytes"`
+	Malformed    uint64             `json:"malformed_frames,omitempty"`
+	Quality      int                `json:"quality"`
+	Demoted      bool               `json:"demoted,omitempty"`
+	Tags         []string           `json:"tags,omitempty"`
+	RTT          time.Duration      `json:"rtt,omitempty"`
+	RTTVariance  time.Duration      `json:"rtt_variance,omitempty"`
+	ControlQueue queue              `json:"control_queue"`
 	ProtoQueue   queue              `json:"proto_queue"`
 	TrafficQueue queue              `json:"traffic_queue"`
 }
@@ -66,7 +96,7 @@ func (r *Router) ManholeHandler(w http.ResponseWriter, req *http.Request) {
 		}
 		response.CoordCache = map[string]types.Coordinates{}
 		for k, v := range r.state._coordsCache {
-			if time.Since(v.lastSeen) > coordsCacheLifetime {
+			if since(r.clock, v.lastSeen) > coordsCacheLifetime {
 				continue
 			}
 			response.CoordCache[k.String()] = v.coordinates
@@ -80,13 +110,18 @@ func (r *Router) ManholeHandler(w http.ResponseWriter, req *http.Request) {
 				PeerType:     p.peertype,
 				PeerZone:     p.zone,
 				PeerURI:      p.uri,
+				ControlQueue: p.control,
 				ProtoQueue:   p.proto,
 				TrafficQueue: p.traffic,
+				Quality:      p.quality(r.state._handshakeFailures[p.public]),
+				Demoted:      p._demoted,
+				Tags:         p.tags.List(),
+				RTT:          p._rtt.Smoothed,
+				RTTVariance:  p._rtt.Variance,
 			}
-			phony.Block(&p.statistics, func() {
-				info.RXProto, info.RXTraffic = p.statistics._bytesRxProto, p.statistics._bytesRxTraffic
-				info.TXProto, info.TXTraffic = p.statistics._bytesTxProto, p.statistics._bytesTxTraffic
-			})
+			info.RXProto, info.RXTraffic = p.statistics.bytesRxProto.Load(), p.statistics.bytesRxTraffic.Load()
+			info.TXProto, info.TXTraffic = p.statistics.bytesTxProto.Load(), p.statistics.bytesTxTraffic.Load()
+			info.Malformed = p.statistics.malformed.Load()
 			if ann := r.state._announcements[p]; ann != nil {
 				info.Coords = ann.Coords()
 				info.Order = ann.receiveOrder
@@ -98,6 +133,40 @@ func (r *Router) ManholeHandler(w http.ResponseWriter, req *http.Request) {
 		for _, p := range r.state._table {
 			response.SNEK.Paths = append(response.SNEK.Paths, p)
 		}
+		bootstraps := &response.SNEK.Bootstraps
+		for _, a := range r.state._bootstrapAttempts.outstanding {
+			bootstraps.Outstanding = append(bootstraps.Outstanding, a)
+		}
+		bootstraps.Failures = r.state._bootstrapAttempts.failures
+		bootstraps.LastFailure = r.state._bootstrapAttempts.lastFailure
+		bootstraps.LastFailureAt = r.state._bootstrapAttempts.lastFailureAt
+		bootstraps.Backoff = r.state._bootstrapAttempts.backoff(r.timings.BootstrapInterval)
+		response.Convergence = r.state._convergence.stats()
+		response.Tree = r.state._treeStats.stats(r.clock.Now(), len(response.Coords))
+		response.Keyspace = r.state._keyspaceStats()
+		response.Roots = r.state._rootWatch.misbehaving(r.clock.Now())
+		response.Adjacency = append(response.Adjacency, r.state._adjacency.inconsistencies...)
+		response.Memory = r.memory.stats(r.state._tableMemory())
+		response.Announce = r.state._announcementStatistics()
+		response.SendQueue = r.state._sendQueueStatistics()
+		response.Pools = r.PoolStats()
+		response.Load = r.state._load
+		response.Fallbacks = r.state._fallbacks
+		for public, e := range r.state._pathStats {
+			if response.PathStats == nil {
+				response.PathStats = map[string]PathStats{}
+			}
+			response.PathStats[public.String()] = e.PathStats
+		}
+		response.Health = r.state._healthReport()
+		response.Rollups = r.state._rollups.rollups(r.clock.Now())
+		if r.state._analyzer != nil {
+			analysis := r.state._analyzer.analysis(r.clock.Now())
+			response.Frames = &analysis
+		}
+		if r.state._latency != nil {
+			response.Latency = r.state._latency.stats()
+		}
 	})
 	for _, p := range response.Peers {
 		sort.Slice(p, func(i, j int) bool {
@@ -0,0 +1,212 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"io"
+	"net"
+	"time"
+	"unicode/utf8"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+// What a peer told us about itself in the handshake is kept with the
+// peering and returned from the Peers API, so that applications can make
+// their own decisions about peers and show something more useful than a
+// public key. As well as the protocol version, capabilities and wire
+// features, nodes exchange a name and a software version straight after the
+// handshake. Both are free text that the remote node chooses, so they must
+// not be trusted for anything that matters, only displayed.
+//
+// Newer nodes also exchange a contact for whoever runs the node and sign
+// what they send with their node key. The signature doesn't make the
+// metadata any more true, but it does mean that it can be shown to others
+// as what the node said about itself, e.g. when asking the operator of a
+// misbehaving node to fix it, and that nothing on the way changed it.
+
+// handshakeMetadata is set if the node wants to exchange metadata after the
+// handshake. Nodes always set it, even if they have no metadata to give.
+const handshakeMetadata = 1 << 2
+
+// handshakeSignedMetadata is set if the node wants to exchange signed
+// metadata, including the contact, rather than just the name and software
+// version. Nodes always set it along with handshakeMetadata.
+const handshakeSignedMetadata = 1 << 3
+
+// metadataSigningContext is signed along with the metadata, so that the
+// signature can't be mistaken for one over anything else.
+const metadataSigningContext = "pinecone node metadata"
+
+// maxMetadataLength is the longest that each metadata field can be.
+const maxMetadataLength = 64
+
+// PeerMetadata is what a node tells its peers about itself.
+type PeerMetadata struct {
+	Name     string // A name for the node, chosen by whoever runs it
+	Software string // The name and version of the software running the node
+	Contact  string // How to reach whoever runs the node, e.g. a Matrix ID
+}
+
+// valid returns true if the metadata can be sent to other nodes.
+func (m PeerMetadata) valid() bool {
+	return validMetadata(m.Name) && validMetadata(m.Software) && validMetadata(m.Contact)
+}
+
+// signedPayload returns what is signed by the node that sent the metadata.
+func (m PeerMetadata) signedPayload() []byte {
+	payload := append([]byte(metadataSigningContext), byte(len(m.Name)))
+	payload = append(payload, m.Name...)
+	payload = append(payload, byte(len(m.Software)))
+	payload = append(payload, m.Software...)
+	payload = append(payload, byte(len(m.Contact)))
+	return append(payload, m.Contact...)
+}
+
+// Verify returns true if the signature over the metadata was made by the
+// node with the given key, as when a peer sent it to us in the handshake.
+func (m PeerMetadata) Verify(key types.PublicKey, sig types.Signature) bool {
+	return ed25519.Verify(key[:], m.signedPayload(), sig[:])
+}
+
+// negotiated holds what the peer sent us in the handshake. It is empty for
+// peerings set up with a known public key, since they skip the handshake.
+type negotiated struct {
+	version      uint8
+	capabilities uint32
+	features     uint8
+	metadata     PeerMetadata
+	signature    types.Signature // Over the metadata, zero if it wasn't signed
+	keepalive    time.Duration   // The remote keepalive interval, zero if it wasn't sent
+}
+
+var capabilityNames = []struct {
+	flag uint32
+	name string
+}{
+	{capabilityLengthenedRootInterval, "lengthened_root_interval"},
+	{capabilityCryptographicSetups, "cryptographic_setups"},
+	{capabilitySetupACKs, "setup_acks"},
+	{capabilityDedupedCoordinateInfo, "deduped_coordinate_info"},
+	{capabilitySoftState, "soft_state"},
+	{capabilityHybridRouting, "hybrid_routing"},
+	{capabilityPeeringCertificates, "peering_certificates"},
+	{capabilityAggregateSignatures, "aggregate_signatures"},
+}
+
+var wireFeatureNames = []struct {
+	flag uint8
+	name string
+}{
+	{handshakeCompactFrames, "compact_frames"},
+	{handshakeLocality, "locality"},
+	{handshakeMetadata, "metadata"},
+	{handshakeSignedMetadata, "signed_metadata"},
+	{handshakeNetworkName, "network_name"},
+	{handshakeLinkEncryption, "link_encryption"},
+	{handshakeKeepalives, "keepalives"},
+}
+
+// capabilityList returns the names of the capability flags that are set.
+func capabilityList(capabilities uint32) []string {
+	var names []string
+	for _, c := range capabilityNames {
+		if capabilities&c.flag != 0 {
+			names = append(names, c.name)
+		}
+	}
+	return names
+}
+
+// wireFeatureList returns the names of the wire features that are set.
+func wireFeatureList(features uint8) []string {
+	var names []string
+	for _, f := range wireFeatureNames {
+		if features&f.flag != 0 {
+			names = append(names, f.name)
+		}
+	}
+	return names
+}
+
+// validMetadata returns true if the metadata field can be sent to other
+// nodes.
+func validMetadata(field string) bool {
+	return len(field) <= maxMetadataLength && utf8.ValidString(field)
+}
+
+// Metadata returns what we tell our peers about ourselves.
+func (r *Router) Metadata() PeerMetadata {
+	return r.metadata
+}
+
+// exchangeMetadata sends our metadata to the remote node and returns
+// theirs. This must only be called if both nodes have set the metadata bit
+// in the handshake. If both have also set the signed metadata bit, the
+// contact is exchanged too and the metadata is signed, and the remote
+// node's signature is checked and returned.
+func (r *Router) exchangeMetadata(conn net.Conn, remote types.PublicKey, signed bool, deadline time.Time) (PeerMetadata, types.Signature, error) {
+	var theirs PeerMetadata
+	var signature types.Signature
+	if err := conn.SetDeadline(deadline); err != nil {
+		return theirs, signature, fmt.Errorf("conn.SetDeadline: %w", err)
+	}
+	fields := []*string{&theirs.Name, &theirs.Software}
+	var ours []byte
+	if signed {
+		fields = append(fields, &theirs.Contact)
+		ours = r.metadata.signedPayload()[len(metadataSigningContext):]
+		ours = append(ours, r.sign(r.metadata.signedPayload())...)
+	} else {
+		ours = append([]byte{byte(len(r.metadata.Name))}, r.metadata.Name...)
+		ours = append(ours, byte(len(r.metadata.Software)))
+		ours = append(ours, r.metadata.Software...)
+	}
+	if _, err := conn.Write(ours); err != nil {
+		return theirs, signature, fmt.Errorf("conn.Write: %w", err)
+	}
+	for _, field := range fields {
+		var length [1]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return theirs, signature, fmt.Errorf("io.ReadFull: %w", err)
+		}
+		if length[0] > maxMetadataLength {
+			return theirs, signature, fmt.Errorf("metadata field of length %d is too long", length[0])
+		}
+		value := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, value); err != nil {
+			return theirs, signature, fmt.Errorf("io.ReadFull: %w", err)
+		}
+		if !utf8.Valid(value) {
+			return theirs, signature, fmt.Errorf("metadata field isn't valid UTF-8")
+		}
+		*field = string(value)
+	}
+	if signed {
+		if _, err := io.ReadFull(conn, signature[:]); err != nil {
+			return theirs, signature, fmt.Errorf("io.ReadFull: %w", err)
+		}
+		r.energy.verifies.Inc()
+		if !theirs.Verify(remote, signature) {
+			return theirs, signature, fmt.Errorf("metadata signature is invalid")
+		}
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return theirs, signature, fmt.Errorf("conn.SetDeadline: %w", err)
+	}
+	return theirs, signature, nil
+}
@@ -0,0 +1,93 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestPeerMetadataExchange(t *testing.T) {
+	newRouter := func(metadata PeerMetadata) *Router {
+		_, sk, _ := ed25519.GenerateKey(nil)
+		r := NewRouter(nil, sk, RouterOptionNodeMetadata(metadata))
+		t.Cleanup(func() { _ = r.Close() })
+		return r
+	}
+	a := newRouter(PeerMetadata{})
+	b := newRouter(PeerMetadata{Name: "relay-1", Software: "pinecone-test/1.0", Contact: "@ops:example.org"})
+	if errA, errB := connectTestRouters(t, a, b); errA != nil || errB != nil {
+		t.Fatalf("failed to peer: %v, %v", errA, errB)
+	}
+
+	check := func(r *Router, expected PeerMetadata) {
+		t.Helper()
+		for _, peer := range r.Peers() {
+			if peer.Port == 0 {
+				continue
+			}
+			if peer.NodeName != expected.Name || peer.SoftwareVersion != expected.Software || peer.Contact != expected.Contact {
+				t.Fatalf("expected metadata %+v, got %q, %q and %q", expected, peer.NodeName, peer.SoftwareVersion, peer.Contact)
+			}
+			var key types.PublicKey
+			var sig types.Signature
+			_, _ = hex.Decode(key[:], []byte(peer.PublicKey))
+			_, _ = hex.Decode(sig[:], []byte(peer.MetadataSignature))
+			if !expected.Verify(key, sig) {
+				t.Fatalf("expected the peer's metadata to be signed")
+			}
+			if peer.ProtocolVersion != int(ourVersion) {
+				t.Fatalf("expected protocol version %d, got %d", ourVersion, peer.ProtocolVersion)
+			}
+			if len(peer.Capabilities) != len(capabilityList(r.capabilities())) {
+				t.Fatalf("expected the peer's capabilities, got %v", peer.Capabilities)
+			}
+			if strings.Join(peer.WireFeatures, ",") != "compact_frames,metadata,signed_metadata,keepalives" {
+				t.Fatalf("expected the peer's wire features, got %v", peer.WireFeatures)
+			}
+		}
+	}
+	check(a, b.Metadata())
+	check(b, PeerMetadata{})
+}
+
+func TestPeerMetadataSignature(t *testing.T) {
+	pk, sk, _ := ed25519.GenerateKey(nil)
+	var key types.PublicKey
+	var sig types.Signature
+	copy(key[:], pk)
+	metadata := PeerMetadata{Name: "relay-1", Contact: "@ops:example.org"}
+	copy(sig[:], ed25519.Sign(sk, metadata.signedPayload()))
+	if !metadata.Verify(key, sig) {
+		t.Fatalf("expected the signature to verify")
+	}
+	metadata.Contact = "@someone-else:example.org"
+	if metadata.Verify(key, sig) {
+		t.Fatalf("expected the signature not to verify for changed metadata")
+	}
+}
+
+func TestPeerMetadataTooLong(t *testing.T) {
+	_, sk, _ := ed25519.GenerateKey(nil)
+	r := NewRouter(nil, sk, RouterOptionNodeMetadata{Name: strings.Repeat("a", maxMetadataLength+1)})
+	defer r.Close() // nolint:errcheck
+	if r.Metadata() != (PeerMetadata{}) {
+		t.Fatalf("expected metadata that is too long to be ignored")
+	}
+}
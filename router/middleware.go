@@ -0,0 +1,206 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+	"go.uber.org/atomic"
+)
+
+// Middleware lets an embedder inspect, modify or drop the frames on our
+// peerings with remote nodes, i.e. to compress them, filter them, account
+// for them or trace them, without changes to the router itself. Egress
+// middleware runs when a frame has been taken from the queues and is about
+// to be written, and ingress middleware runs when a frame has been read and
+// is about to be handled. Middlewares run in ascending order on egress and
+// in descending order on ingress, so that a middleware which changes the
+// frame on the way out always sees it changed back on the way in, i.e.
+// compression that runs after encryption on egress runs before decryption
+// on ingress. The chain is replaced as a whole whenever it changes, so that
+// the peerings never have to take a lock to run it.
+
+// MiddlewareAction is what a middleware wants to happen to a frame.
+type MiddlewareAction int
+
+const (
+	MiddlewarePass MiddlewareAction = iota // Pass the frame on to the next middleware
+	MiddlewareDrop                         // Drop the frame
+)
+
+// MiddlewareInfo describes the peering that a frame is on.
+type MiddlewareInfo struct {
+	PublicKey types.PublicKey
+	Port      types.SwitchPortID
+	Zone      string
+}
+
+// MiddlewareFn is called for each frame that passes the middleware. It may
+// modify the frame in place but must not hold onto it after returning. It
+// is called from the actors of the peering, so it must not block.
+type MiddlewareFn func(info MiddlewareInfo, f *types.Frame) MiddlewareAction
+
+// Middleware is a named step in the middleware chain. Either function can
+// be nil if the middleware only cares about one direction.
+type Middleware struct {
+	Name    string
+	Order   int // Lower orders run first on egress and last on ingress
+	Egress  MiddlewareFn
+	Ingress MiddlewareFn
+}
+
+// MiddlewareStats counts the frames that a middleware has seen.
+type MiddlewareStats struct {
+	Name           string
+	Order          int
+	EgressFrames   uint64
+	EgressDropped  uint64
+	IngressFrames  uint64
+	IngressDropped uint64
+	Time           time.Duration // Time spent in the middleware functions
+}
+
+type middleware struct {
+	Middleware
+	egressFrames   atomic.Uint64
+	egressDropped  atomic.Uint64
+	ingressFrames  atomic.Uint64
+	ingressDropped atomic.Uint64
+	time           atomic.Duration
+}
+
+// middlewareChain is sorted by order and is never modified once it has
+// been stored, so it's safe to run from any actor.
+type middlewareChain []*middleware
+
+type middlewares struct {
+	mutex sync.Mutex   // Serialises changes to the chain
+	chain atomic.Value // middlewareChain
+}
+
+func (m *middlewares) load() middlewareChain {
+	chain, _ := m.chain.Load().(middlewareChain)
+	return chain
+}
+
+// AddMiddleware adds a middleware to the chain, replacing any middleware
+// with the same name. Middlewares with the same order run in the order
+// that they were added.
+func (r *Router) AddMiddleware(m Middleware) {
+	r.middleware.mutex.Lock()
+	defer r.middleware.mutex.Unlock()
+	previous := r.middleware.load()
+	chain := make(middlewareChain, 0, len(previous)+1)
+	for _, existing := range previous {
+		if existing.Name != m.Name {
+			chain = append(chain, existing)
+		}
+	}
+	chain = append(chain, &middleware{Middleware: m})
+	sort.SliceStable(chain, func(i, j int) bool {
+		return chain[i].Order < chain[j].Order
+	})
+	r.middleware.chain.Store(chain)
+}
+
+// RemoveMiddleware removes the named middleware from the chain, returning
+// false if there was no such middleware.
+func (r *Router) RemoveMiddleware(name string) bool {
+	r.middleware.mutex.Lock()
+	defer r.middleware.mutex.Unlock()
+	previous := r.middleware.load()
+	chain := make(middlewareChain, 0, len(previous))
+	for _, existing := range previous {
+		if existing.Name != name {
+			chain = append(chain, existing)
+		}
+	}
+	if len(chain) == len(previous) {
+		return false
+	}
+	r.middleware.chain.Store(chain)
+	return true
+}
+
+// MiddlewareStats returns the counters of the middlewares in the chain, in
+// egress order. The counters of a removed middleware are lost.
+func (r *Router) MiddlewareStats() []MiddlewareStats {
+	chain := r.middleware.load()
+	stats := make([]MiddlewareStats, 0, len(chain))
+	for _, m := range chain {
+		stats = append(stats, MiddlewareStats{
+			Name:           m.Name,
+			Order:          m.Order,
+			EgressFrames:   m.egressFrames.Load(),
+			EgressDropped:  m.egressDropped.Load(),
+			IngressFrames:  m.ingressFrames.Load(),
+			IngressDropped: m.ingressDropped.Load(),
+			Time:           m.time.Load(),
+		})
+	}
+	return stats
+}
+
+// egress runs the chain over a frame that is about to be written to the
+// peer, returning false if the frame should be dropped.
+func (c middlewareChain) egress(p *peer, f *types.Frame) bool {
+	info := p.middlewareInfo()
+	for _, m := range c {
+		if m.Egress == nil {
+			continue
+		}
+		m.egressFrames.Inc()
+		start := p.router.clock.Now()
+		action := m.Egress(info, f)
+		m.time.Add(since(p.router.clock, start))
+		if action == MiddlewareDrop {
+			m.egressDropped.Inc()
+			return false
+		}
+	}
+	return true
+}
+
+// ingress runs the chain in reverse over a frame that was read from the
+// peer, returning false if the frame should be dropped.
+func (c middlewareChain) ingress(p *peer, f *types.Frame) bool {
+	info := p.middlewareInfo()
+	for i := len(c) - 1; i >= 0; i-- {
+		m := c[i]
+		if m.Ingress == nil {
+			continue
+		}
+		m.ingressFrames.Inc()
+		start := p.router.clock.Now()
+		action := m.Ingress(info, f)
+		m.time.Add(since(p.router.clock, start))
+		if action == MiddlewareDrop {
+			m.ingressDropped.Inc()
+			return false
+		}
+	}
+	return true
+}
+
+func (p *peer) middlewareInfo() MiddlewareInfo {
+	return MiddlewareInfo{
+		PublicKey: p.public,
+		Port:      p.port,
+		Zone:      string(p.zone),
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"crypto/ed25519"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestMiddlewareOrder(t *testing.T) {
+	_, sk, _ := ed25519.GenerateKey(nil)
+	r := NewRouter(nil, sk)
+	t.Cleanup(func() { _ = r.Close() })
+
+	var ran []string
+	record := func(name string) MiddlewareFn {
+		return func(_ MiddlewareInfo, _ *types.Frame) MiddlewareAction {
+			ran = append(ran, name)
+			return MiddlewarePass
+		}
+	}
+	for _, m := range []struct {
+		name  string
+		order int
+	}{{"c", 3}, {"a", 1}, {"b", 2}, {"b2", 2}} {
+		r.AddMiddleware(Middleware{
+			Name:    m.name,
+			Order:   m.order,
+			Egress:  record(m.name),
+			Ingress: record(m.name),
+		})
+	}
+	r.AddMiddleware(Middleware{Name: "ingress-only", Order: 0, Ingress: record("ingress-only")})
+
+	p := &peer{router: r, port: 1}
+	chain := r.middleware.load()
+	if !chain.egress(p, &types.Frame{}) {
+		t.Fatalf("expected the frame to be passed on egress")
+	}
+	if expected := []string{"a", "b", "b2", "c"}; !reflect.DeepEqual(ran, expected) {
+		t.Fatalf("expected egress order %v, got %v", expected, ran)
+	}
+	ran = nil
+	if !chain.ingress(p, &types.Frame{}) {
+		t.Fatalf("expected the frame to be passed on ingress")
+	}
+	if expected := []string{"c", "b2", "b", "a", "ingress-only"}; !reflect.DeepEqual(ran, expected) {
+		t.Fatalf("expected ingress order %v, got %v", expected, ran)
+	}
+
+	if !r.RemoveMiddleware("b") || r.RemoveMiddleware("b") {
+		t.Fatalf("expected the middleware to be removed once")
+	}
+	if stats := r.MiddlewareStats(); len(stats) != 4 || stats[0].Name != "ingress-only" {
+		t.Fatalf("unexpected stats after removal: %+v", stats)
+	}
+}
+
+func TestMiddlewareDrop(t *testing.T) {
+	var routers [2]*Router
+	for i := range routers {
+		_, sk, _ := ed25519.GenerateKey(nil)
+		routers[i] = NewRouter(nil, sk)
+		r := routers[i]
+		t.Cleanup(func() { _ = r.Close() })
+	}
+	a, b := routers[0], routers[1]
+
+	// Drop everything that A sends apart from keepalives, which would
+	// otherwise stop the peering from coming up.
+	a.AddMiddleware(Middleware{
+		Name: "filter",
+		Egress: func(_ MiddlewareInfo, f *types.Frame) MiddlewareAction {
+			if f.Type == types.TypeKeepalive {
+				return MiddlewarePass
+			}
+			return MiddlewareDrop
+		},
+	})
+	b.AddMiddleware(Middleware{
+		Name: "count",
+		Ingress: func(info MiddlewareInfo, f *types.Frame) MiddlewareAction {
+			if info.PublicKey != a.PublicKey() {
+				t.Errorf("expected frames from %s, got %s", a.PublicKey(), info.PublicKey)
+			}
+			return MiddlewarePass
+		},
+	})
+	if errA, errB := connectTestRouters(t, a, b); errA != nil || errB != nil {
+		t.Fatalf("failed to peer: %v, %v", errA, errB)
+	}
+
+	deadline := time.Now().Add(time.Second * 10)
+	for {
+		stats := a.MiddlewareStats()
+		if len(stats) == 1 && stats[0].EgressDropped > 0 {
+			if stats[0].IngressFrames != 0 {
+				t.Fatalf("expected no ingress frames, got %d", stats[0].IngressFrames)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected frames to be dropped, got %+v", stats)
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+}
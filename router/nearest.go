@@ -0,0 +1,154 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+	"github.com/matrix-org/pinecone/util"
+)
+
+// Anything that keeps copies of something at several keys, such as the
+// replicas of a service or the nodes holding a mailbox, needs to pick the
+// copy to use for a given key. NearestLiveKey orders the candidates by how
+// close they are to the target in the keyspace and probes them with lookups,
+// a few at a time and nearest first, until some of them answer. Of those
+// that answered in the same round, the one nearest to the target is chosen,
+// or the one with the lowest round trip time if PreferLowRTT is set, so that
+// a replica that is slightly further away in the keyspace but much closer on
+// the network can be used instead. Candidates further away than the first
+// round that had an answer are never probed.
+
+// nearestDefaultProbes is how many candidates are probed at once if the
+// options don't say.
+const nearestDefaultProbes = 3
+
+// nearestDefaultTimeout is how long each probe waits for an answer if the
+// options don't say.
+const nearestDefaultTimeout = time.Second * 5
+
+// NearestKeyOptions controls how NearestLiveKey probes the candidates. All
+// of the fields are optional.
+type NearestKeyOptions struct {
+	Probes       int           // How many candidates to probe at once
+	Timeout      time.Duration // How long to wait for each candidate to answer
+	PreferLowRTT bool          // Choose by round trip time rather than keyspace distance
+}
+
+// KeyProbe is the outcome of probing one of the candidates.
+type KeyProbe struct {
+	PublicKey types.PublicKey
+	Live      bool          // Did the candidate answer?
+	RTT       time.Duration // Zero if the candidate didn't answer
+	Err       error         // Why the candidate didn't answer
+}
+
+// NearestKeyResult is the candidate that NearestLiveKey chose.
+type NearestKeyResult struct {
+	PublicKey types.PublicKey // The chosen candidate
+	RTT       time.Duration   // The round trip time to the chosen candidate
+	Probes    []KeyProbe      // Every candidate that was probed, nearest first
+}
+
+// NearestLiveKey returns the candidate that is nearest to the target key and
+// that answers a lookup. If none of the candidates answer then the error is
+// ErrNoLiveCandidate, and the probes are still returned in the result. It
+// gives up early if the context expires, in which case the context error is
+// returned.
+func (r *Router) NearestLiveKey(ctx context.Context, target types.PublicKey, candidates []types.PublicKey, options NearestKeyOptions) (NearestKeyResult, error) {
+	if options.Probes <= 0 {
+		options.Probes = nearestDefaultProbes
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = nearestDefaultTimeout
+	}
+	ordered := make([]types.PublicKey, 0, len(candidates))
+	seen := make(map[types.PublicKey]struct{}, len(candidates))
+	for _, k := range candidates {
+		if _, ok := seen[k]; !ok {
+			seen[k] = struct{}{}
+			ordered = append(ordered, k)
+		}
+	}
+	sort.SliceStable(ordered, func(i, j int) bool {
+		di := util.AbsoluteKeyspaceDistance(target, ordered[i])
+		dj := util.AbsoluteKeyspaceDistance(target, ordered[j])
+		if di != dj {
+			return util.LessThan(di, dj)
+		}
+		// Ties go to the key above the target, as with util.NearestKey.
+		return util.KeyspaceDistance(target, ordered[i]) == di
+	})
+
+	var result NearestKeyResult
+	for start := 0; start < len(ordered); start += options.Probes {
+		end := start + options.Probes
+		if end > len(ordered) {
+			end = len(ordered)
+		}
+		round := r.probeKeys(ctx, ordered[start:end], options.Timeout)
+		result.Probes = append(result.Probes, round...)
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		var best *KeyProbe
+		for i := range round {
+			p := &round[i]
+			if !p.Live {
+				continue
+			}
+			if best == nil || (options.PreferLowRTT && p.RTT < best.RTT) {
+				best = p
+			}
+		}
+		if best != nil {
+			result.PublicKey, result.RTT = best.PublicKey, best.RTT
+			return result, nil
+		}
+	}
+	return result, ErrNoLiveCandidate
+}
+
+// probeKeys looks up all of the keys at once and returns the outcomes in
+// the same order.
+func (r *Router) probeKeys(ctx context.Context, keys []types.PublicKey, timeout time.Duration) []KeyProbe {
+	probes := make([]KeyProbe, len(keys))
+	var wg sync.WaitGroup
+	for i, k := range keys {
+		wg.Add(1)
+		go func(p *KeyProbe, k types.PublicKey) {
+			defer wg.Done()
+			probeCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			p.PublicKey = k
+			res, err := r.Lookup(probeCtx, k)
+			switch {
+			case err != nil:
+				p.Err = err
+			case !res.Reachable:
+				p.Err = errors.New("not reachable")
+			default:
+				p.Live, p.RTT = true, res.RTT
+			}
+		}(&probes[i], k)
+	}
+	wg.Wait()
+	return probes
+}
@@ -0,0 +1,75 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !minimal
+// +build !minimal
+
+package router
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestNearestLiveKey(t *testing.T) {
+	low, high := newTestRouterPair(t)
+
+	deadline := time.Now().Add(time.Second * 10)
+	for len(low.Coords()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("tree didn't converge")
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+
+	var unknown types.PublicKey
+	pk, _, _ := ed25519.GenerateKey(nil)
+	copy(unknown[:], pk)
+
+	// The unknown key is nearest to itself but never answers, so the next
+	// round of probes should find the other node.
+	options := NearestKeyOptions{Probes: 1, Timeout: time.Millisecond * 300}
+	result, err := low.NearestLiveKey(context.Background(), unknown, []types.PublicKey{high.PublicKey(), unknown}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.PublicKey != high.PublicKey() {
+		t.Fatalf("expected %s, got %s", high.PublicKey(), result.PublicKey)
+	}
+	if len(result.Probes) != 2 || result.Probes[0].PublicKey != unknown || result.Probes[0].Live {
+		t.Fatalf("expected the unknown key to be probed first and not answer, got %+v", result.Probes)
+	}
+
+	// Probed together, the nearest key wins unless we prefer the lowest
+	// round trip time, which is our own key.
+	candidates := []types.PublicKey{low.PublicKey(), high.PublicKey()}
+	options = NearestKeyOptions{Probes: 2}
+	if result, err = low.NearestLiveKey(context.Background(), high.PublicKey(), candidates, options); err != nil || result.PublicKey != high.PublicKey() {
+		t.Fatalf("expected the nearest key to be chosen, got %s (%v)", result.PublicKey, err)
+	}
+	options.PreferLowRTT = true
+	if result, err = low.NearestLiveKey(context.Background(), high.PublicKey(), candidates, options); err != nil || result.PublicKey != low.PublicKey() {
+		t.Fatalf("expected the key with the lowest RTT to be chosen, got %s (%v)", result.PublicKey, err)
+	}
+
+	options = NearestKeyOptions{Timeout: time.Millisecond * 200}
+	if _, err = low.NearestLiveKey(context.Background(), unknown, []types.PublicKey{unknown}, options); !errors.Is(err, ErrNoLiveCandidate) {
+		t.Fatalf("expected no live candidate, got %v", err)
+	}
+}
@@ -0,0 +1,246 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Each router belongs to a network, which is identified by the fourth byte
+// of the handshake. This was always zero before, so network zero is the
+// default network that older nodes belong to. Routers only peer with nodes
+// in the same network, which keeps networks isolated from each other even
+// if they share infrastructure. Since the network ID comes before anything
+// else that the remote node sends, a SharedListener can read it to decide
+// which of several routers in the same process a peering is meant for.
+//
+// There are only 256 network IDs though, so unrelated networks, like a test
+// network and a community's own network, can easily end up with the same
+// one. A router can therefore also be given a network name. Nodes with a
+// name set a bit in the handshake and then exchange a hash of the name,
+// which must match. Since the bit is covered by the handshake signature, a
+// node with a name never peers with one without a name or with an older
+// node. Routers with a name also add the hash to their multicast beacons,
+// so that they don't even try to peer with nodes in other networks that
+// share the same multicast domain.
+
+// handshakeNetworkOffset is the position of the network ID in the
+// handshake.
+const handshakeNetworkOffset = 3
+
+// handshakeNetworkName is set if the node has a network name, the hash of
+// which is exchanged after the handshake.
+const handshakeNetworkName = 1 << 4
+
+// networkTagLength is how many bytes of the hash of the network name are
+// exchanged.
+const networkTagLength = 16
+
+// ErrUnknownNetwork is returned by SharedListener when a peering is for a
+// network that no router has been registered for.
+var ErrUnknownNetwork = errors.New("no router for network")
+
+// NetworkID returns the ID of the network that the router belongs to.
+func (r *Router) NetworkID() uint8 {
+	return r.networkID
+}
+
+// NetworkName returns the name of the network that the router belongs to,
+// or an empty string if it wasn't given one.
+func (r *Router) NetworkName() string {
+	return r.networkName
+}
+
+// NetworkTag returns the hash of the network name, which is what is sent to
+// other nodes, or nil if the router wasn't given a network name.
+func (r *Router) NetworkTag() []byte {
+	if r.networkName == "" {
+		return nil
+	}
+	return append([]byte(nil), r.networkTag[:]...)
+}
+
+// networkTagFor returns the hash of the given network name.
+func networkTagFor(name string) (tag [networkTagLength]byte) {
+	sum := sha256.Sum256([]byte("pinecone network " + name))
+	copy(tag[:], sum[:])
+	return
+}
+
+// exchangeNetworkTag sends the hash of our network name to the remote node
+// and checks that theirs is the same. This must only be called if both
+// nodes have set the network name bit in the handshake.
+func (r *Router) exchangeNetworkTag(conn net.Conn, deadline time.Time) error {
+	if err := conn.SetDeadline(deadline); err != nil {
+		return fmt.Errorf("conn.SetDeadline: %w", err)
+	}
+	if _, err := conn.Write(r.networkTag[:]); err != nil {
+		return fmt.Errorf("conn.Write: %w", err)
+	}
+	var theirs [networkTagLength]byte
+	if _, err := io.ReadFull(conn, theirs[:]); err != nil {
+		return fmt.Errorf("io.ReadFull: %w", err)
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return fmt.Errorf("conn.SetDeadline: %w", err)
+	}
+	if !bytes.Equal(theirs[:], r.networkTag[:]) {
+		return fmt.Errorf("%w: mismatched network name", ErrIncompatiblePeer)
+	}
+	return nil
+}
+
+// SharedListener accepts peerings on a single listener on behalf of several
+// routers in the same process, and hands each one to the router for the
+// network ID in its handshake. This is useful for bridges and test rigs.
+// The start of the handshake is read before we know which router it is
+// for, so it is timed on the clock of the first router to be registered.
+type SharedListener struct {
+	listener net.Listener
+	options  []ConnectionOption
+	mutex    sync.RWMutex
+	routers  map[uint8]*Router // protected by mutex
+	clock    Clock             // protected by mutex
+}
+
+// NewSharedListener returns a SharedListener that accepts peerings on the
+// given listener. The connection options are given to the router along
+// with each peering.
+func NewSharedListener(listener net.Listener, options ...ConnectionOption) *SharedListener {
+	return &SharedListener{
+		listener: listener,
+		options:  options,
+		routers:  map[uint8]*Router{},
+		clock:    systemClock{},
+	}
+}
+
+// Register starts handing peerings for the network of the given router to
+// it. Only one router can be registered for each network.
+func (s *SharedListener) Register(r *Router) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.routers[r.networkID]; ok {
+		return fmt.Errorf("a router is already registered for network %d", r.networkID)
+	}
+	if len(s.routers) == 0 {
+		s.clock = r.clock
+	}
+	s.routers[r.networkID] = r
+	return nil
+}
+
+// Unregister stops handing peerings to the given router.
+func (s *SharedListener) Unregister(r *Router) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.routers[r.networkID] == r {
+		delete(s.routers, r.networkID)
+	}
+}
+
+// Addr returns the address of the listener.
+func (s *SharedListener) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Close closes the listener, which makes Serve return. Peerings that have
+// already been handed to routers are not affected.
+func (s *SharedListener) Close() error {
+	return s.listener.Close()
+}
+
+// Serve accepts peerings until the listener is closed, handing each one to
+// the right router in the background. Errors from individual peerings are
+// passed to the given function, if it isn't nil.
+func (s *SharedListener) Serve(onError func(net.Conn, error)) error {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return fmt.Errorf("s.listener.Accept: %w", err)
+		}
+		go func() {
+			if err := s.handle(conn); err != nil {
+				_ = conn.Close()
+				if onError != nil {
+					onError(conn, err)
+				}
+			}
+		}()
+	}
+}
+
+// handle reads the network ID from the start of the handshake and passes
+// the connection, with the bytes that were read, to the right router.
+func (s *SharedListener) handle(conn net.Conn) error {
+	prefix := make([]byte, handshakeNetworkOffset+1)
+	s.mutex.RLock()
+	deadline := newConnDeadline(s.clock, conn.SetReadDeadline)
+	s.mutex.RUnlock()
+	if err := deadline.start(peerHandshakeTimeout); err != nil {
+		return fmt.Errorf("deadline.start: %w", err)
+	}
+	if _, err := io.ReadFull(conn, prefix); err != nil {
+		return fmt.Errorf("io.ReadFull: %w", err)
+	}
+	if err := deadline.stop(); err != nil {
+		return fmt.Errorf("deadline.stop: %w", err)
+	}
+	network := prefix[handshakeNetworkOffset]
+	s.mutex.RLock()
+	r := s.routers[network]
+	s.mutex.RUnlock()
+	if r == nil {
+		return fmt.Errorf("%w %d", ErrUnknownNetwork, network)
+	}
+	options := append([]ConnectionOption{
+		ConnectionURI(conn.RemoteAddr().String()),
+		ConnectionPeerType(PeerTypeRemote),
+		ConnectionInbound(true),
+	}, s.options...)
+	if _, err := r.Connect(&prefixConn{Conn: conn, prefix: prefix}, options...); err != nil {
+		return fmt.Errorf("r.Connect: %w", err)
+	}
+	return nil
+}
+
+// prefixConn is a connection that returns the given bytes before anything
+// else is read from it.
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(b, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+// NetConn returns the underlying connection, so that socket options can be
+// applied to it.
+func (c *prefixConn) NetConn() net.Conn {
+	return c.Conn
+}
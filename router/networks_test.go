@@ -0,0 +1,137 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestNetworkRouter(t *testing.T, network uint8) *Router {
+	_, sk, _ := ed25519.GenerateKey(nil)
+	r := NewRouter(nil, sk, RouterOptionNetworkID(network))
+	t.Cleanup(func() { _ = r.Close() })
+	return r
+}
+
+func TestNetworkIsolation(t *testing.T) {
+	a, b := newTestNetworkRouter(t, 1), newTestNetworkRouter(t, 2)
+	if errA, errB := connectTestRouters(t, a, b); !errors.Is(errA, ErrIncompatiblePeer) || !errors.Is(errB, ErrIncompatiblePeer) {
+		t.Fatalf("expected routers in different networks to refuse to peer: %v, %v", errA, errB)
+	}
+	a, b = newTestNetworkRouter(t, 1), newTestNetworkRouter(t, 1)
+	if errA, errB := connectTestRouters(t, a, b); errA != nil || errB != nil {
+		t.Fatalf("expected routers in the same network to peer: %v, %v", errA, errB)
+	}
+}
+
+func TestNetworkNames(t *testing.T) {
+	named := func(name string) *Router {
+		_, sk, _ := ed25519.GenerateKey(nil)
+		r := NewRouter(nil, sk, RouterOptionNetworkName(name))
+		t.Cleanup(func() { _ = r.Close() })
+		return r
+	}
+	for _, tc := range []struct {
+		name string
+		a, b *Router
+	}{
+		{"different names", named("test"), named("production")},
+		{"only one name", named("test"), newTestNetworkRouter(t, 0)},
+		{"only the other name", newTestNetworkRouter(t, 0), named("test")},
+	} {
+		if errA, errB := connectTestRouters(t, tc.a, tc.b); !errors.Is(errA, ErrIncompatiblePeer) || !errors.Is(errB, ErrIncompatiblePeer) {
+			t.Fatalf("expected routers with %s to refuse to peer: %v, %v", tc.name, errA, errB)
+		}
+	}
+	a, b := named("test"), named("test")
+	if errA, errB := connectTestRouters(t, a, b); errA != nil || errB != nil {
+		t.Fatalf("expected routers with the same name to peer: %v, %v", errA, errB)
+	}
+	if !bytes.Equal(a.NetworkTag(), b.NetworkTag()) || bytes.Equal(a.NetworkTag(), named("production").NetworkTag()) {
+		t.Fatalf("expected network tags to follow the name")
+	}
+	if tag := newTestNetworkRouter(t, 0).NetworkTag(); tag != nil {
+		t.Fatalf("expected no network tag without a name, got %x", tag)
+	}
+}
+
+func TestSharedListener(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared := NewSharedListener(listener)
+	defer shared.Close() // nolint:errcheck
+
+	one, two := newTestNetworkRouter(t, 1), newTestNetworkRouter(t, 2)
+	if err := shared.Register(one); err != nil {
+		t.Fatal(err)
+	}
+	if err := shared.Register(two); err != nil {
+		t.Fatal(err)
+	}
+	if err := shared.Register(newTestNetworkRouter(t, 1)); err == nil {
+		t.Fatalf("expected a second router for the same network to be refused")
+	}
+	failures := make(chan error, 1)
+	go shared.Serve(func(_ net.Conn, err error) { // nolint:errcheck
+		failures <- err
+	})
+
+	dial := func(r *Router) error {
+		c, err := net.Dial("tcp", shared.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = r.Connect(c)
+		return err
+	}
+	for _, tc := range []struct {
+		dialer   *Router
+		listener *Router
+	}{
+		{newTestNetworkRouter(t, 1), one},
+		{newTestNetworkRouter(t, 2), two},
+	} {
+		if err := dial(tc.dialer); err != nil {
+			t.Fatal(err)
+		}
+		deadline := time.Now().Add(time.Second * 5)
+		for !tc.listener.IsConnected(tc.dialer.PublicKey(), "") {
+			if time.Now().After(deadline) {
+				t.Fatalf("peering wasn't handed to the router for network %d", tc.dialer.NetworkID())
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+
+	// A peering for a network without a router is refused.
+	if err := dial(newTestNetworkRouter(t, 3)); err == nil {
+		t.Fatalf("expected peering for an unknown network to fail")
+	}
+	select {
+	case err := <-failures:
+		if !errors.Is(err, ErrUnknownNetwork) {
+			t.Fatalf("expected ErrUnknownNetwork, got %v", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatalf("expected the listener to report the failure")
+	}
+}
@@ -0,0 +1,302 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+// Node info queries ask a remote node, by key, what it will say about itself
+// to anyone: the metadata that it gives its peers in the handshake, its
+// protocol version and capabilities, how many peers it has and how long it
+// has been running. They let health tooling build a picture of the network
+// without having to peer with every node. The request is sent towards the
+// key using SNEK routing, like a lookup, and the answer comes back using
+// tree routing where possible. Both are signed, the request over the key of
+// the node being asked and the response over the key of the node asking, so
+// neither can be forged or sent on to someone else.
+//
+// Answering is cheap but not free, so each node is only answered once every
+// nodeInfoMinInterval and we answer at most nodeInfoMaxPerSecond queries in
+// total each second. Nodes that would rather not say anything at all can set
+// RouterOptionHideNodeInfo, in which case queries to them will time out.
+
+// nodeInfoMinInterval is how often we will answer node info queries from
+// any one node.
+const nodeInfoMinInterval = time.Second
+
+// nodeInfoMaxPerSecond is how many node info queries we will answer in
+// total each second.
+const nodeInfoMaxPerSecond = 16
+
+// RemoteNodeInfo is what a remote node told us about itself in answer to a
+// node info query.
+type RemoteNodeInfo struct {
+	ProtocolVersion uint8         // The protocol version that the node speaks
+	Capabilities    []string      // The capabilities that the node advertises
+	Metadata        PeerMetadata  // What the node tells its peers about itself
+	Peers           int           // How many peerings the node has
+	Uptime          time.Duration // How long the node has been running
+	RTT             time.Duration // Time between sending the query and the answer
+}
+
+type pendingNodeInfo struct {
+	public types.PublicKey
+	sent   time.Time
+	notify func(RemoteNodeInfo)
+}
+
+// nodeInfoState holds the queries that we are waiting on and the rate
+// limits on the ones that we answer.
+type nodeInfoState struct {
+	sequence uint64
+	pending  map[uint64]*pendingNodeInfo
+	answered map[types.PublicKey]time.Time // When we last answered each node
+	second   time.Time                     // The start of the current second
+	count    int                           // Queries answered this second
+}
+
+// QueryNodeInfo asks the node with the given public key about itself. It
+// blocks until the remote node answers or until the context expires, in
+// which case the context error is returned. Nodes that hide their node info,
+// or that are answering too many queries, won't answer at all.
+func (r *Router) QueryNodeInfo(ctx context.Context, public types.PublicKey) (RemoteNodeInfo, error) {
+	if public == r.public {
+		var info RemoteNodeInfo
+		phony.Block(r.state, func() {
+			info = r.state._localNodeInfo()
+		})
+		return info, nil
+	}
+	result := make(chan RemoteNodeInfo, 1)
+	var id uint64
+	var err error
+	phony.Block(r.state, func() {
+		var f *types.Frame
+		id, f, err = r.state._newNodeInfoRequest(public, func(info RemoteNodeInfo) {
+			result <- info
+		})
+		if err != nil {
+			err = fmt.Errorf("r.state._newNodeInfoRequest: %w", err)
+			return
+		}
+		if err = r.state._forward(r.local, f); err != nil {
+			err = fmt.Errorf("r.state._forward: %w", err)
+		}
+	})
+	defer phony.Block(r.state, func() {
+		delete(r.state._nodeInfo.pending, id)
+	})
+	if err != nil {
+		return RemoteNodeInfo{}, err
+	}
+	select {
+	case info := <-result:
+		return info, nil
+	case <-ctx.Done():
+		return RemoteNodeInfo{}, ctx.Err()
+	case <-r.context.Done():
+		return RemoteNodeInfo{}, ErrRouterClosed
+	}
+}
+
+// _localNodeInfo returns what we would tell other nodes about ourselves.
+func (s *state) _localNodeInfo() RemoteNodeInfo {
+	return RemoteNodeInfo{
+		ProtocolVersion: ourVersion,
+		Capabilities:    capabilityList(s.r.capabilities()),
+		Metadata:        s.r.metadata,
+		Peers:           s._nodeInfoPeerCount(),
+		Uptime:          since(s.r.clock, s._treeStats.started),
+	}
+}
+
+// _nodeInfoPeerCount returns how many peerings are running.
+func (s *state) _nodeInfoPeerCount() int {
+	count := 0
+	for _, p := range s._peers {
+		if p != nil && p != s.r.local && p.started.Load() {
+			count++
+		}
+	}
+	return count
+}
+
+// _newNodeInfoRequest builds a signed node info request for the node with
+// the given public key, which will be routed using SNEK. The notify function
+// will be called from the state actor if an answer arrives.
+func (s *state) _newNodeInfoRequest(public types.PublicKey, notify func(RemoteNodeInfo)) (uint64, *types.Frame, error) {
+	if s._nodeInfo.pending == nil {
+		s._nodeInfo.pending = map[uint64]*pendingNodeInfo{}
+	}
+	s._nodeInfo.sequence++
+	id := s._nodeInfo.sequence
+	request := types.NodeInfoRequest{
+		ID: types.Varu64(id),
+	}
+	protected, err := request.ProtectedPayload(public)
+	if err != nil {
+		return 0, nil, fmt.Errorf("request.ProtectedPayload: %w", err)
+	}
+	copy(request.Signature[:], s.r.sign(protected))
+
+	f := getFrame()
+	f.Type = types.TypeNodeInfoRequest
+	f.HopLimit = types.MaxHopLimit
+	f.DestinationKey = public
+	f.Source = s._coords()
+	f.SourceKey = s.r.public
+	f.Watermark = types.VirtualSnakeWatermark{
+		PublicKey: types.FullMask,
+		Sequence:  0,
+	}
+	if err := f.AppendPayload(&request); err != nil {
+		framePool.Put(f)
+		return 0, nil, fmt.Errorf("f.AppendPayload: %w", err)
+	}
+	s._nodeInfo.pending[id] = &pendingNodeInfo{
+		public: public,
+		sent:   s.r.clock.Now(),
+		notify: notify,
+	}
+	return id, f, nil
+}
+
+// _allowNodeInfo returns true if we should answer a node info query from
+// the node with the given key, and if so, counts it against the limits.
+func (s *state) _allowNodeInfo(from types.PublicKey) bool {
+	if s.r.hideNodeInfo {
+		return false
+	}
+	now := s.r.clock.Now()
+	if now.Sub(s._nodeInfo.second) >= time.Second {
+		s._nodeInfo.second, s._nodeInfo.count = now, 0
+		// Forget nodes that we haven't answered recently, so that the
+		// map doesn't grow without bound.
+		for k, t := range s._nodeInfo.answered {
+			if now.Sub(t) >= nodeInfoMinInterval {
+				delete(s._nodeInfo.answered, k)
+			}
+		}
+	}
+	if s._nodeInfo.count >= nodeInfoMaxPerSecond {
+		return false
+	}
+	if last, ok := s._nodeInfo.answered[from]; ok && now.Sub(last) < nodeInfoMinInterval {
+		return false
+	}
+	if s._nodeInfo.answered == nil {
+		s._nodeInfo.answered = map[types.PublicKey]time.Time{}
+	}
+	s._nodeInfo.answered[from] = now
+	s._nodeInfo.count++
+	return true
+}
+
+// _handleNodeInfo is called when a node info frame addressed to us arrives.
+// Requests are answered, if the limits allow, and answers are matched up
+// with the queries that are waiting for them.
+func (s *state) _handleNodeInfo(f *types.Frame) error {
+	switch f.Type {
+	case types.TypeNodeInfoRequest:
+		var request types.NodeInfoRequest
+		if _, err := types.Decode(&request, f.Payload); err != nil {
+			return fmt.Errorf("request.UnmarshalBinary: %w", err)
+		}
+		protected, err := request.ProtectedPayload(s.r.public)
+		if err != nil {
+			return fmt.Errorf("request.ProtectedPayload: %w", err)
+		}
+		if !s.r.verify(f.SourceKey[:], protected, request.Signature[:]) {
+			// Anyone can send us a forged request, so drop it rather than
+			// blaming the peer that passed it on.
+			return nil
+		}
+		if !s._allowNodeInfo(f.SourceKey) {
+			return nil
+		}
+		local := s._localNodeInfo()
+		response := types.NodeInfo{
+			ID:           request.ID,
+			Version:      local.ProtocolVersion,
+			Capabilities: s.r.capabilities(),
+			Peers:        types.Varu64(local.Peers),
+			Uptime:       types.Varu64(local.Uptime / time.Second),
+			Name:         local.Metadata.Name,
+			Software:     local.Metadata.Software,
+			Contact:      local.Metadata.Contact,
+		}
+		if protected, err = response.ProtectedPayload(f.SourceKey); err != nil {
+			return fmt.Errorf("response.ProtectedPayload: %w", err)
+		}
+		copy(response.Signature[:], s.r.sign(protected))
+
+		reply := getFrame()
+		reply.Type = types.TypeNodeInfoResponse
+		reply.HopLimit = types.MaxHopLimit
+		reply.Destination = append(reply.Destination[:0], f.Source...)
+		reply.DestinationKey = f.SourceKey
+		reply.Source = s._coords()
+		reply.SourceKey = s.r.public
+		reply.Watermark = types.VirtualSnakeWatermark{
+			PublicKey: types.FullMask,
+			Sequence:  0,
+		}
+		if err := reply.AppendPayload(&response); err != nil {
+			framePool.Put(reply)
+			return fmt.Errorf("reply.AppendPayload: %w", err)
+		}
+		return s._forward(s.r.local, reply)
+
+	case types.TypeNodeInfoResponse:
+		var response types.NodeInfo
+		if _, err := types.Decode(&response, f.Payload); err != nil {
+			return fmt.Errorf("response.UnmarshalBinary: %w", err)
+		}
+		pending, ok := s._nodeInfo.pending[uint64(response.ID)]
+		if !ok || pending.public != f.SourceKey {
+			return nil
+		}
+		protected, err := response.ProtectedPayload(s.r.public)
+		if err != nil {
+			return fmt.Errorf("response.ProtectedPayload: %w", err)
+		}
+		if !s.r.verify(f.SourceKey[:], protected, response.Signature[:]) {
+			return nil
+		}
+		delete(s._nodeInfo.pending, uint64(response.ID))
+		pending.notify(RemoteNodeInfo{
+			ProtocolVersion: response.Version,
+			Capabilities:    capabilityList(response.Capabilities),
+			Metadata: PeerMetadata{
+				Name:     response.Name,
+				Software: response.Software,
+				Contact:  response.Contact,
+			},
+			Peers:  int(response.Peers),
+			Uptime: time.Duration(response.Uptime) * time.Second,
+			RTT:    since(s.r.clock, pending.sent),
+		})
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestQueryNodeInfo(t *testing.T) {
+	metadata := PeerMetadata{Name: "relay", Software: "pinecone/test", Contact: "@ops:example.org"}
+	_, ska, _ := ed25519.GenerateKey(nil)
+	_, skb, _ := ed25519.GenerateKey(nil)
+	_, skc, _ := ed25519.GenerateKey(nil)
+	a := NewRouter(nil, ska)
+	b := NewRouter(nil, skb, RouterOptionNodeMetadata(metadata))
+	c := NewRouter(nil, skc, RouterOptionHideNodeInfo(true))
+	t.Cleanup(func() {
+		_ = a.Close()
+		_ = b.Close()
+		_ = c.Close()
+	})
+	for _, r := range []*Router{b, c} {
+		if errA, errB := connectTestRouters(t, a, r); errA != nil || errB != nil {
+			t.Fatalf("failed to connect: %v, %v", errA, errB)
+		}
+	}
+
+	var info RemoteNodeInfo
+	deadline := time.Now().Add(time.Second * 10)
+	for {
+		// Queries are only answered once a second, so wait that long
+		// between attempts while the network converges.
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		var err error
+		info, err = a.QueryNodeInfo(ctx, b.PublicKey())
+		cancel()
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("node info query didn't succeed: %v", err)
+		}
+	}
+	if info.Metadata != metadata {
+		t.Fatalf("expected metadata %+v, got %+v", metadata, info.Metadata)
+	}
+	if info.ProtocolVersion != ourVersion || info.Peers != 1 || len(info.Capabilities) == 0 {
+		t.Fatalf("unexpected node info %+v", info)
+	}
+
+	// A second query straight away is rate limited.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancel()
+	if _, err := a.QueryNodeInfo(ctx, b.PublicKey()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the second query to be rate limited, got %v", err)
+	}
+
+	// The node that hides its node info never answers.
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+	if _, err := a.QueryNodeInfo(ctx, c.PublicKey()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the hidden node not to answer, got %v", err)
+	}
+
+	if self, err := a.QueryNodeInfo(context.Background(), a.PublicKey()); err != nil || self.Peers != 2 {
+		t.Fatalf("expected our own node info to count two peers, got %+v (%v)", self, err)
+	}
+}
+
+func TestNodeInfoForgedSignature(t *testing.T) {
+	s := newTestState(types.PublicKey{1}, NewManualClock(time.Unix(1000, 0)))
+	sender := types.PublicKey{2}
+	answered := false
+	s._nodeInfo.pending = map[uint64]*pendingNodeInfo{
+		1: {public: sender, notify: func(RemoteNodeInfo) { answered = true }},
+	}
+
+	// Frames with bad signatures are dropped without an error, since an
+	// error would stop the peering that passed the frame on to us.
+	request := getFrame()
+	request.Type = types.TypeNodeInfoRequest
+	request.SourceKey = sender
+	if err := request.AppendPayload(&types.NodeInfoRequest{ID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s._handleNodeInfo(request); err != nil {
+		t.Fatalf("expected a forged request to be dropped, got %v", err)
+	}
+	response := getFrame()
+	response.Type = types.TypeNodeInfoResponse
+	response.SourceKey = sender
+	if err := response.AppendPayload(&types.NodeInfo{ID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s._handleNodeInfo(response); err != nil {
+		t.Fatalf("expected a forged response to be dropped, got %v", err)
+	}
+	if answered || len(s._nodeInfo.pending) != 1 {
+		t.Fatalf("expected the query to still be waiting for an answer")
+	}
+}
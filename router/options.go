@@ -14,15 +14,481 @@
 
 package router
 
-import "github.com/matrix-org/pinecone/types"
+import (
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
 
 type RouterOptionBlackhole bool
+type RouterOptionStrictDecoding bool
+
+// RouterOptionPeerQualityPruning enables demoting peers with poor quality
+// scores, so that they won't be chosen as our tree parent, and eventually
+// disconnecting them if their scores keep falling.
+type RouterOptionPeerQualityPruning bool
+
+// RouterOptionMaxPeers limits the number of simultaneous peerings. When the
+// limit is reached, new peerings will evict the existing peering that adds
+// least to our keyspace coverage, although our parent and the peerings that
+// carry our snake paths are never evicted. Zero means no limit.
+type RouterOptionMaxPeers int
+
+// RouterOptionAnnouncementLimit sets the soft limit, in bytes, on the
+// memory held by the tree announcements of our peers. When it is reached,
+// announcements from new peerings are refused until there is room. The
+// default is 4MB, which is enough for thousands of peerings. Zero means
+// the default.
+type RouterOptionAnnouncementLimit uint64
+
+// RouterOptionSendQueueTimeout sets how long traffic that we send waits for
+// a next hop to its destination before it is dropped. The default is three
+// seconds. A negative timeout drops the traffic straight away.
+type RouterOptionSendQueueTimeout time.Duration
+
+// RouterOptionReservedPeer reserves a peering slot for peerings matching
+// the given key or URI pattern. It can be supplied more than once.
+type RouterOptionReservedPeer ReservedPeer
+
+// RouterOptionPeerKeepalives configures link-level keepalives for all
+// peerings of the given peer type. A keepalive is sent if nothing else has
+// been sent within the interval, and the peer is assumed to be dead if
+// nothing has been received for the given number of intervals, which is
+// at least two. The interval is agreed with the remote side when peering,
+// and the slower of the two is used, so a short interval only takes effect
+// if the remote side is configured with one too. Supplying this option more
+// than once for the same peer type replaces the earlier setting.
+type RouterOptionPeerKeepalives struct {
+	PeerType      int
+	Interval      time.Duration
+	MissTolerance int
+}
+
+// RouterOptionFastFailureDetection enables fast failure detection on the
+// link to our tree parent, so that re-parenting starts shortly after the
+// parent link dies rather than at the next keepalive timeout. A zero
+// Interval or Multiplier selects the default.
+type RouterOptionFastFailureDetection struct {
+	Interval   time.Duration
+	Multiplier int
+}
+
+// RouterOptionQueueAlarm enables events.QueueCongested events, which are
+// sent when one of the outbound queues of a peering has held more than
+// Threshold frames for at least Duration, and events.QueueRecovered events
+// when it drains again. Queue depths are sampled, so very brief dips below
+// the threshold might not be noticed.
+type RouterOptionQueueAlarm struct {
+	Threshold int
+	Duration  time.Duration
+}
+
+// RouterOptionWatchdog enables a watchdog which resets peerings whose
+// writer hasn't drained its queues, or whose reader hasn't received
+// anything, for the given duration. An events.PeerStalled event is sent
+// when this happens. It should be longer than the keepalive timeout.
+type RouterOptionWatchdog time.Duration
+
+// RouterOptionSlowPeerPolicy applies the given action to peerings whose
+// traffic queue has held more than Threshold frames for at least Duration,
+// since a saturated peering degrades all of the traffic that hashes onto it.
+type RouterOptionSlowPeerPolicy struct {
+	Threshold int
+	Duration  time.Duration
+	Action    SlowPeerAction
+}
+
+// RouterOptionPeeringAuthority makes the node part of a closed network, in
+// which peerings are only accepted from nodes that present a certificate
+// chain issued by the given authority key. The node must also be given its
+// own chain with RouterOptionCertificateChain. Nodes in a closed network
+// won't peer with nodes in the open network at all.
+type RouterOptionPeeringAuthority types.PublicKey
+
+// RouterOptionCertificateChain is the certificate chain that the node will
+// present to its peers in a closed network.
+type RouterOptionCertificateChain types.CertificateChain
+
+// RouterOptionRevocationAuthority is the key that signs the revocation list
+// for the deployment. Peerings and bootstraps from keys in the list will be
+// refused. Without it, revocation lists are ignored.
+type RouterOptionRevocationAuthority types.PublicKey
+
+// RouterOptionClock replaces the source of time for the routing state,
+// i.e. maintenance timers and the expiry of routes and announcements. This
+// is mostly useful for tests and simulations, which can use a ManualClock
+// to fast-forward time.
+type RouterOptionClock struct {
+	Clock Clock
+}
+
+// RouterOptionHandshakeLimits protects the handshake from slow or abusive
+// remote nodes. Timeout bounds the exchange of keys and CertificateTimeout
+// bounds the exchange of certificates in a closed network, each starting
+// from the beginning of that stage. MaxPending limits the number of
+// handshakes in progress at once and MaxPendingPerSource limits them for
+// each remote host. Zero timeouts select the defaults and zero limits mean
+// no limit.
+type RouterOptionHandshakeLimits struct {
+	Timeout             time.Duration
+	CertificateTimeout  time.Duration
+	MaxPending          int
+	MaxPendingPerSource int
+}
+
+// RouterOptionAcceptLimits protects the router from storms of inbound
+// connections, i.e. when a large deployment restarts and all of its nodes
+// dial in at once. Only connections marked with ConnectionInbound are
+// limited. Rate is how many can be accepted per second on average and
+// Burst is how many can be accepted at once, which defaults to a second's
+// worth. MaxPeersPerSource limits the peerings with each remote host.
+// Zero limits mean no limit.
+type RouterOptionAcceptLimits struct {
+	Rate              float64
+	Burst             int
+	MaxPeersPerSource int
+}
+
+// RouterOptionJumboFrames allows traffic payloads up to the given size in
+// bytes to be sent over peerings with nodes that allow them too. Payloads
+// that are bigger than types.MaxPayloadSize are carried in jumbo frames and
+// are dropped if they can't be. The size is rounded down to a power of two
+// and can't be bigger than types.MaxJumboPayloadSize. This is useful for
+// high-throughput relays between servers.
+type RouterOptionJumboFrames int
+
+// RouterOptionCompactFrames controls whether frames that carry coordinates
+// are sent in the compact encoding to peers that accept it, and whether we
+// tell peers that we accept it. This is enabled by default. Disabling it
+// means that only the original frame encoding is used in both directions.
+type RouterOptionCompactFrames bool
+
+// RouterOptionAggregateSignatures authenticates root announcements with a
+// single aggregate MAC, keyed by the given network secret, instead of an
+// ed25519 signature from every hop. This keeps announcements from growing
+// by a signature per hop in deep trees. It is only suitable for closed
+// deployments where every node that knows the secret is trusted, since any
+// of them could forge announcements. All nodes in the network must use the
+// same secret, and nodes with this option can only peer with each other.
+type RouterOptionAggregateSignatures []byte
+
+// RouterOptionTimings changes how often the tree and SNEK are maintained
+// and how long their state lasts. See Timings for the safe ranges.
+type RouterOptionTimings Timings
+
+// RouterOptionDelayTolerant enables delay-tolerant mode, in which traffic
+// sent with WriteToWithCustody is held by us, and by other nodes in
+// delay-tolerant mode, until it can be delivered. Zero values use the
+// defaults of 256 bundles held for up to 24 hours.
+type RouterOptionDelayTolerant struct {
+	MaxBundles int           // The most bundles that we will hold at once
+	MaxTTL     time.Duration // The longest that we will hold a bundle
+}
+
+// RouterOptionLocality gives the node a coarse locality hint, such as a
+// region tag like "eu-west", which is shared with peers and in service
+// advertisements. Nearby parents and services are preferred over ones that
+// are otherwise equal. Hints can be up to types.MaxLocalityLength bytes.
+type RouterOptionLocality string
+
+// RouterOptionLinkAggregation stripes traffic across all of the links to a
+// neighbour when we are peered with it more than once, in proportion to the
+// measured throughput of each link, rather than only using the best link.
+// The frames of each flow always take the same link, so they aren't
+// reordered.
+type RouterOptionLinkAggregation bool
+
+// RouterOptionNodeMetadata gives the node a name and a software version,
+// which are sent to peers after the handshake and shown in their Peers API.
+// Each can be up to 64 bytes of UTF-8.
+type RouterOptionNodeMetadata PeerMetadata
+
+// RouterOptionNetworkID puts the router in the given network. Routers only
+// peer with nodes in the same network. Network zero is the default, which
+// older nodes belong to. See SharedListener for running routers in several
+// networks from one listener.
+type RouterOptionNetworkID uint8
+
+// RouterOptionNetworkName puts the router in the network with the given
+// name, as well as the network ID. Routers with a network name only peer
+// with nodes that have the same name, and never with nodes that don't have
+// a name, so that separate networks stay apart even if they share the same
+// transports, multicast domains and network ID.
+type RouterOptionNetworkName string
+
+// RouterOptionLinkEncryption encrypts peerings with nodes that also have
+// this option, with keys that are agreed after the handshake, so that the
+// frames can't be read by anyone watching the link. This is only needed for
+// transports that aren't encrypted already, like plain TCP, unix sockets
+// or Bluetooth LE. If Required is set then peerings with nodes that don't
+// encrypt, or that are set up with a known public key and so skip the
+// handshake, are refused.
+type RouterOptionLinkEncryption struct {
+	Required bool
+}
+
+// RouterOptionFaultInjection deliberately drops, delays, duplicates or
+// corrupts frames on peerings with remote nodes at the given point, each
+// with the given probability between 0 and 1. Delays are random, up to
+// MaxDelay. Give the option once for each point. This is only for testing
+// how the network copes with poor links and must never be used otherwise.
+type RouterOptionFaultInjection struct {
+	Point     FaultPoint
+	Drop      float64
+	Delay     float64
+	MaxDelay  time.Duration
+	Duplicate float64
+	Corrupt   float64
+}
+
+// RouterOptionProtocolHistory sets how many of the most recent protocol
+// events, such as paths being installed or removed, are kept for the
+// ProtocolHistory API. Zero keeps the default of 512 and a negative number
+// turns the history off.
+type RouterOptionProtocolHistory int
+
+// RouterOptionStateLogging writes the protocol events whose names start with
+// the prefix to the log as they happen, i.e. "tree" for changes to the tree
+// or "snek.table" for paths being installed and removed, or turns them off
+// again if Off is set. The names are listed in statelog.go and an empty
+// prefix matches them all. Only the first in every SampleEvery events of
+// each kind is logged, or all of them if zero. The option can be given more
+// than once and the longest matching prefix applies.
+type RouterOptionStateLogging struct {
+	Prefix      string
+	SampleEvery uint64
+	Off         bool
+}
+
+// RouterOptionDistrustMisbehavingRoots makes us treat a root that misbehaves,
+// for example by sending sequence numbers that go backwards, as weaker than
+// every other root for the given time, so that we build the tree under the
+// next best root instead. Misbehaving roots are always reported, but are
+// only distrusted if this option is given.
+type RouterOptionDistrustMisbehavingRoots time.Duration
+
+// RouterOptionRootPolicy replaces the policy that decides which root the
+// tree is built under. The default is StrongestKeyRootPolicy. Every node in
+// the network must use the same policy, or the tree will never settle.
+type RouterOptionRootPolicy struct {
+	Policy RootPolicy
+}
+
+// RouterOptionAdjacencyProofs makes us send our ascending and descending
+// nodes signed statements of who our neighbours in the keyspace are, and
+// check the statements that they send us, so that nodes lying about their
+// position in the keyspace can be detected. Nodes without the option drop
+// the statements, and older nodes can't forward them, so it is best given
+// to every node in a deployment.
+type RouterOptionAdjacencyProofs bool
+
+// RouterOptionMemoryBudget limits the memory used by all of the queues and
+// routing tables to about the given number of bytes, shared out between the
+// peerings, so that memory use doesn't grow with the number of peers. Frames
+// are dropped to stay within it. Without it, queues are only limited by
+// their length in frames.
+type RouterOptionMemoryBudget uint64
+
+// RouterOptionLoadShedding samples the heap in use, the number of goroutines
+// and the bytes held in the peer queues every Interval, and sheds load in
+// steps as the closest of them gets to its limit, rather than letting the
+// process run out of memory: first background and then bulk transit
+// traffic is dropped, then gossip is deferred, and then new peerings are
+// refused with ErrOverloaded. A zero limit isn't checked, and a zero
+// Interval selects the default.
+type RouterOptionLoadShedding struct {
+	MemoryLimit    uint64
+	GoroutineLimit int
+	QueueLimit     uint64
+	Interval       time.Duration
+}
+
+// RouterOptionRouteTracing traces the routing of one in every SampleEvery
+// frames that we route, recording each candidate that the routing rules
+// picked and the next-hop that was chosen, and keeps the last Limit traces
+// for each destination key, which can be read with RouteTraces. Tracing
+// every frame is slow, so it is meant for debugging and tests. A zero
+// Limit selects the default.
+type RouterOptionRouteTracing struct {
+	SampleEvery int
+	Limit       int
+}
+
+// RouterOptionSelfHeal makes the invariant checker repair the routing state
+// when it finds something that should have been cleaned up already, such
+// as a path through a peering that has stopped, rather than only reporting
+// it in the Health API.
+type RouterOptionSelfHeal bool
+
+// RouterOptionStatsRetention sets how long the counts behind StatsRollups
+// are kept for, up to a day. The default is an hour.
+type RouterOptionStatsRetention time.Duration
+
+// RouterOptionHideNodeInfo stops us from answering node info queries from
+// other nodes, for nodes that would rather not say what they are running.
+type RouterOptionHideNodeInfo bool
+
+// RouterOptionDebugQueries allows the nodes with the given keys to ask us
+// for a summary of our routing state and peerings with QueryDebug. Nobody
+// can ask unless this option is given.
+type RouterOptionDebugQueries []types.PublicKey
+
+// RouterOptionLoopDemotion demotes a next-hop for a destination when
+// traffic for that destination keeps running out of hops on its way there,
+// which usually means that it is going round in a loop, so that the traffic
+// is routed the other way instead. Only has an effect when hop limiting is
+// enabled.
+type RouterOptionLoopDemotion bool
+
+// RouterOptionTrafficScheduler replaces the queue that decides which of the
+// traffic frames waiting for each peering is sent next. The default is a
+// fair queue that shares each peering out between flows and traffic classes.
+type RouterOptionTrafficScheduler struct {
+	Scheduler TrafficScheduler
+}
+
+// RouterOptionForwardingLatency measures how long each frame that we
+// forward takes to get through us, split into the time waiting for the
+// router and the time spent choosing the next-hop, so that
+// ForwardingLatency can show histograms of the times for each frame type.
+type RouterOptionForwardingLatency bool
+
+// RouterOptionAnnouncementDamping handles at most one tree announcement
+// from each peer per interval. Announcements that arrive sooner are held
+// until the interval is up and only the latest one is handled, so that a
+// burst of announcements while the tree is unstable doesn't have to be
+// checked and passed on one by one. The suppressed announcements are
+// counted in TreeStats and PeerInfo. The default is no damping.
+type RouterOptionAnnouncementDamping time.Duration
+
+// RouterOptionFrameAnalyzer counts every frame that we handle by type,
+// payload size and the first PrefixBytes bytes of the source and
+// destination keys, which can be 1 or 2, over the last Window, so that
+// FrameAnalysis can show what the traffic through the node is made of. A
+// zero Window or PrefixBytes selects the default.
+type RouterOptionFrameAnalyzer struct {
+	Window      time.Duration
+	PrefixBytes int
+}
+
+// RouterOptionWireProfile makes the router behave on the wire like an older
+// implementation which only knew the frame types up to and including
+// LastFrameType, so that mixed-version networks can be tested without
+// building an older release. Frames of newer types are dropped instead of
+// being sent, and frames of newer types that arrive are treated as unknown,
+// i.e. counted as malformed with RouterOptionStrictDecoding and otherwise
+// ignored. Jumbo frames and the optional wire features aren't offered in
+// the handshake. If Capabilities isn't nil then the named capabilities are
+// advertised instead of ours. Only the frame types and the handshake are
+// pinned, so changes to the payloads of older frame types or to how they
+// are handled aren't emulated. This is only meant for testing.
+type RouterOptionWireProfile struct {
+	LastFrameType types.FrameType
+	Capabilities  []string
+}
+
+// RouterOptionTagPolicy restricts the peerings that have the given tag. If
+// NeverParent is set then they are never chosen as our parent in the tree,
+// even if that means that we become the root, i.e. so that a node doesn't
+// route the tree over cellular peerings. If MaxPeers is more than zero then
+// no more than that many peerings with the tag are allowed at once. It can
+// be given once for each tag.
+type RouterOptionTagPolicy struct {
+	Tag         string
+	NeverParent bool
+	MaxPeers    int
+}
+
+// RouterOptionTrafficPriority gives the traffic from one origin more of
+// each peering than the other while both have frames waiting, within each
+// traffic class. Prefer TrafficOriginLocal so that our own traffic isn't
+// held up by the traffic that we relay for the mesh, or TrafficOriginTransit
+// for a node that is there to relay. Weight is how many frames from the
+// preferred origin are sent for each frame from the other, which defaults
+// to 4. It has no effect with RouterOptionTrafficScheduler.
+type RouterOptionTrafficPriority struct {
+	Prefer TrafficOrigin
+	Weight int
+}
+
+// RouterOptionAmplificationLimit limits the replies that we send to source
+// keys that we can't verify, i.e. echo replies and search answers, to Factor
+// times the bytes that we received from each source key within Window, so
+// that spoofed requests can't be used to send more traffic to a victim
+// than the attacker sent to us. Replies over the limit are dropped. A zero
+// Factor or Window selects the default of 3 and a minute.
+type RouterOptionAmplificationLimit struct {
+	Factor int
+	Window time.Duration
+}
+
+// RouterOptionTimeSync asks each of our peers for its time at the given
+// interval, so that ClockOffset and NetworkTime can make up for our clock
+// being wrong. An interval of zero asks once a minute.
+type RouterOptionTimeSync time.Duration
+
+// RouterOptionTrafficPolicy applies the given rules to the traffic that we
+// send and forward, see TrafficRule. The rules can be read from a file with
+// ParseTrafficPolicy and replaced later with SetTrafficPolicy.
+type RouterOptionTrafficPolicy []TrafficRule
 
 type RouterOption interface {
 	isRouterOption()
 }
 
-func (o RouterOptionBlackhole) isRouterOption() {}
+func (o RouterOptionBlackhole) isRouterOption()                {}
+func (o RouterOptionStrictDecoding) isRouterOption()           {}
+func (o RouterOptionPeerKeepalives) isRouterOption()           {}
+func (o RouterOptionFastFailureDetection) isRouterOption()     {}
+func (o RouterOptionPeerQualityPruning) isRouterOption()       {}
+func (o RouterOptionMaxPeers) isRouterOption()                 {}
+func (o RouterOptionReservedPeer) isRouterOption()             {}
+func (o RouterOptionQueueAlarm) isRouterOption()               {}
+func (o RouterOptionWatchdog) isRouterOption()                 {}
+func (o RouterOptionSlowPeerPolicy) isRouterOption()           {}
+func (o RouterOptionPeeringAuthority) isRouterOption()         {}
+func (o RouterOptionCertificateChain) isRouterOption()         {}
+func (o RouterOptionRevocationAuthority) isRouterOption()      {}
+func (o RouterOptionClock) isRouterOption()                    {}
+func (o RouterOptionHandshakeLimits) isRouterOption()          {}
+func (o RouterOptionAcceptLimits) isRouterOption()             {}
+func (o RouterOptionJumboFrames) isRouterOption()              {}
+func (o RouterOptionCompactFrames) isRouterOption()            {}
+func (o RouterOptionAggregateSignatures) isRouterOption()      {}
+func (o RouterOptionTimings) isRouterOption()                  {}
+func (o RouterOptionDelayTolerant) isRouterOption()            {}
+func (o RouterOptionLocality) isRouterOption()                 {}
+func (o RouterOptionNodeMetadata) isRouterOption()             {}
+func (o RouterOptionLinkAggregation) isRouterOption()          {}
+func (o RouterOptionNetworkID) isRouterOption()                {}
+func (o RouterOptionNetworkName) isRouterOption()              {}
+func (o RouterOptionLinkEncryption) isRouterOption()           {}
+func (o RouterOptionFaultInjection) isRouterOption()           {}
+func (o RouterOptionProtocolHistory) isRouterOption()          {}
+func (o RouterOptionStateLogging) isRouterOption()             {}
+func (o RouterOptionDistrustMisbehavingRoots) isRouterOption() {}
+func (o RouterOptionRootPolicy) isRouterOption()               {}
+func (o RouterOptionAdjacencyProofs) isRouterOption()          {}
+func (o RouterOptionMemoryBudget) isRouterOption()             {}
+func (o RouterOptionLoadShedding) isRouterOption()             {}
+func (o RouterOptionRouteTracing) isRouterOption()             {}
+func (o RouterOptionFrameAnalyzer) isRouterOption()            {}
+func (o RouterOptionSelfHeal) isRouterOption()                 {}
+func (o RouterOptionStatsRetention) isRouterOption()           {}
+func (o RouterOptionAnnouncementDamping) isRouterOption()      {}
+func (o RouterOptionHideNodeInfo) isRouterOption()             {}
+func (o RouterOptionDebugQueries) isRouterOption()             {}
+func (o RouterOptionLoopDemotion) isRouterOption()             {}
+func (o RouterOptionTrafficScheduler) isRouterOption()         {}
+func (o RouterOptionForwardingLatency) isRouterOption()        {}
+func (o RouterOptionWireProfile) isRouterOption()              {}
+func (o RouterOptionTagPolicy) isRouterOption()                {}
+func (o RouterOptionTrafficPriority) isRouterOption()          {}
+func (o RouterOptionAmplificationLimit) isRouterOption()       {}
+func (o RouterOptionTrafficPolicy) isRouterOption()            {}
+func (o RouterOptionTimeSync) isRouterOption()                 {}
+func (o RouterOptionAnnouncementLimit) isRouterOption()        {}
+func (o RouterOptionSendQueueTimeout) isRouterOption()         {}
 
 type ConnectionOption interface {
 	isConnectionOption()
@@ -33,9 +499,72 @@ type ConnectionURI string
 type ConnectionZone string
 type ConnectionPeerType int
 type ConnectionKeepalives bool
+type ConnectionFastFailureDetection bool
+
+// ConnectionTag attaches a tag to the peering, which is passed to the route
+// filter and reported in the peer information. It can be supplied more than
+// once to attach multiple tags.
+type ConnectionTag string
+
+// ConnectionPacingRate enables pacing of the frames that are written to
+// the peering, spacing them out at the given rate in bytes per second
+// rather than bursting whole queues onto the link. A rate of zero will
+// estimate the link rate instead. This helps on constrained links, such
+// as Bluetooth or cellular, which would otherwise drop frames.
+type ConnectionPacingRate uint64
+
+// ConnectionEgressLimit caps the rate at which traffic is written to the
+// peering, in payload bytes per second, with separate caps for traffic that
+// we send ourselves and traffic that we relay for other nodes. A cap of zero
+// means that the traffic isn't limited. This is useful for limiting relayed
+// traffic over a metered uplink.
+type ConnectionEgressLimit struct {
+	Local   uint64
+	Transit uint64
+}
+
+// ConnectionSocketOptions tunes the underlying socket of the peering, where
+// the connection supports it. ReadBuffer and WriteBuffer set the size of
+// the operating system's socket buffers in bytes, which can be raised for
+// high-throughput relays or lowered for memory-constrained devices. Nagle
+// turns Nagle's algorithm back on for TCP, trading latency for fewer small
+// packets. KeepAlive sets the TCP keepalive period, or disables TCP
+// keepalives if negative. Zero values leave the defaults alone.
+type ConnectionSocketOptions struct {
+	ReadBuffer  int
+	WriteBuffer int
+	Nagle       bool
+	KeepAlive   time.Duration
+}
+
+// ConnectionWriteCoalescing buffers up to the given number of bytes of
+// frames and writes them to the peering together, rather than making a
+// write for every frame. The buffer is written out as soon as there are no
+// more frames waiting to be sent, so this doesn't add latency, but it does
+// save system calls and packets when the peering is busy.
+type ConnectionWriteCoalescing int
+
+// ConnectionMTU is the largest write that the link underneath the peering
+// can carry in one go. Frames that are larger than this are split across
+// several writes and put back together by the remote side. It overrides
+// the MTU reported by a connection that implements LinkMTU.
+type ConnectionMTU int
+
+// ConnectionInbound marks a connection that the remote node made to us,
+// i.e. one that was accepted from a listener, so that the limits set with
+// RouterOptionAcceptLimits apply to it.
+type ConnectionInbound bool
 
-func (w ConnectionPublicKey) isConnectionOption()  {}
-func (w ConnectionURI) isConnectionOption()        {}
-func (w ConnectionZone) isConnectionOption()       {}
-func (w ConnectionPeerType) isConnectionOption()   {}
-func (w ConnectionKeepalives) isConnectionOption() {}
+func (w ConnectionPublicKey) isConnectionOption()            {}
+func (w ConnectionURI) isConnectionOption()                  {}
+func (w ConnectionZone) isConnectionOption()                 {}
+func (w ConnectionPeerType) isConnectionOption()             {}
+func (w ConnectionKeepalives) isConnectionOption()           {}
+func (w ConnectionFastFailureDetection) isConnectionOption() {}
+func (w ConnectionTag) isConnectionOption()                  {}
+func (w ConnectionPacingRate) isConnectionOption()           {}
+func (w ConnectionEgressLimit) isConnectionOption()          {}
+func (w ConnectionSocketOptions) isConnectionOption()        {}
+func (w ConnectionWriteCoalescing) isConnectionOption()      {}
+func (w ConnectionMTU) isConnectionOption()                  {}
+func (w ConnectionInbound) isConnectionOption()              {}
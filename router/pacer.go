@@ -0,0 +1,84 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+// A pacer spaces out the frames that we write to a peering so that they
+// leave at the link rate, rather than writing out a whole queue in one
+// burst and relying on the link to buffer it. It is a token bucket that
+// holds enough tokens for a single maximum-sized frame, so that we never
+// get ahead of the link by more than one frame.
+//
+// If the rate isn't configured then it is estimated from writes that had
+// to block, since those tell us how quickly the link is really draining.
+// Writes that return straight away have only been buffered locally, so they
+// say nothing about the link rate. Until the first estimate is available,
+// frames are not paced at all.
+type pacer struct {
+	rate       float64   // bytes per second, or zero if not known yet
+	estimating bool      // is the rate estimated from writes?
+	tokens     float64   // bytes that can be written without waiting
+	last       time.Time // when the tokens were last refilled
+}
+
+const pacerBurst = float64(types.MaxFrameSize)
+
+// newPacer returns a pacer for the given rate in bytes per second, or one
+// that estimates the rate if the given rate is zero, starting at the given
+// time.
+func newPacer(rate uint64, now time.Time) *pacer {
+	return &pacer{
+		rate:       float64(rate),
+		estimating: rate == 0,
+		tokens:     pacerBurst,
+		last:       now,
+	}
+}
+
+// delay takes tokens for a frame of the given size and returns how long
+// we must wait before writing it.
+func (p *pacer) delay(size int, now time.Time) time.Duration {
+	if p.rate <= 0 {
+		return 0
+	}
+	p.tokens += now.Sub(p.last).Seconds() * p.rate
+	p.last = now
+	if p.tokens > pacerBurst {
+		p.tokens = pacerBurst
+	}
+	p.tokens -= float64(size)
+	if p.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-p.tokens / p.rate * float64(time.Second))
+}
+
+// observe updates the estimated rate from a completed write.
+func (p *pacer) observe(size int, writeTime time.Duration) {
+	if !p.estimating || writeTime < pacerMinBlockedWrite {
+		return
+	}
+	sample := float64(size) / writeTime.Seconds()
+	if p.rate == 0 {
+		p.rate = sample
+		return
+	}
+	p.rate += (sample - p.rate) / 8
+}
@@ -0,0 +1,71 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestPacerFixedRate(t *testing.T) {
+	p := newPacer(100000, time.Unix(1000, 0)) // 100KB/s
+	now := p.last
+
+	// The first full-sized frame fits in the burst, so goes straight away.
+	if d := p.delay(types.MaxFrameSize, now); d != 0 {
+		t.Fatalf("expected first frame to be sent immediately, got delay %s", d)
+	}
+	// The next 1000 bytes need 10ms of tokens.
+	if d := p.delay(1000, now); d != time.Millisecond*10 {
+		t.Fatalf("expected delay of 10ms, got %s", d)
+	}
+	// After waiting for that long, the next 1000 bytes need another 10ms.
+	now = now.Add(time.Millisecond * 10)
+	if d := p.delay(1000, now); d != time.Millisecond*10 {
+		t.Fatalf("expected delay of 10ms, got %s", d)
+	}
+	// After a long idle period, the tokens are capped at the burst size.
+	now = now.Add(time.Hour)
+	if d := p.delay(types.MaxFrameSize, now); d != 0 {
+		t.Fatalf("expected frame after idle period to be sent immediately, got delay %s", d)
+	}
+	if d := p.delay(1000, now); d != time.Millisecond*10 {
+		t.Fatalf("expected burst to be capped, got delay %s", d)
+	}
+}
+
+func TestPacerEstimatedRate(t *testing.T) {
+	p := newPacer(0, time.Unix(1000, 0))
+	if d := p.delay(types.MaxFrameSize*10, p.last); d != 0 {
+		t.Fatalf("expected no pacing without an estimate, got delay %s", d)
+	}
+	// Writes that didn't block don't tell us anything about the link.
+	p.observe(1000, time.Microsecond)
+	if p.rate != 0 {
+		t.Fatalf("expected no estimate from unblocked write, got %f", p.rate)
+	}
+	p.observe(1000, time.Millisecond*10)
+	if p.rate != 100000 {
+		t.Fatalf("expected estimate of 100000 bytes/sec, got %f", p.rate)
+	}
+	// A configured rate is never replaced by an estimate.
+	fixed := newPacer(5000, time.Unix(1000, 0))
+	fixed.observe(1000, time.Millisecond*10)
+	if fixed.rate != 5000 {
+		t.Fatalf("expected configured rate to be kept, got %f", fixed.rate)
+	}
+}
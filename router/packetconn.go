@@ -15,6 +15,8 @@
 package router
 
 import (
+	"errors"
+	"fmt"
 	"net"
 	"time"
 
@@ -38,7 +40,8 @@ func (r *Router) newLocalPeer(blackhole bool) *peer {
 		started:  *atomic.NewBool(true),
 	}
 	if !blackhole {
-		peer.traffic = newFairFIFOQueue(trafficBuffer, r.log)
+		peer.budget = r.memory.forPeer()
+		peer.traffic = newFairFIFOQueue(trafficBuffer, r.log, r.clock).withBudget(peer.budget)
 	}
 	return peer
 }
@@ -47,7 +50,8 @@ func (r *Router) newLocalPeer(blackhole bool) *peer {
 // Pinecone network. Only traffic frames will be returned here (not protocol
 // frames). The returned address will either be a `types.PublicKey` (if the
 // frame was delivered using SNEK routing) or `types.Coordinates` (if the frame
-// was delivered using tree routing).
+// was delivered using tree routing). Once HandleTraffic has been called,
+// frames are passed to the handler instead.
 func (r *Router) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
 	if r.local.traffic == nil {
 		<-r.local.context.Done()
@@ -64,7 +68,7 @@ func (r *Router) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
 		return
 	case frame = <-r.local.traffic.pop():
 		// A protocol packet is ready to send.
-		r.local.traffic.ack()
+		r.local.traffic.ack(frame)
 	}
 
 	addr = frame.SourceKey
@@ -79,6 +83,19 @@ func (r *Router) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
 // or `types.Coordinates` for tree routing. Supplying an unsupported address type
 // will result in a `*net.AddrError` being returned.
 func (r *Router) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	return r.WriteToWithClass(p, addr, types.TrafficClassInteractive)
+}
+
+// WriteToWithClass works like WriteTo but sends the packet with the given
+// traffic class, which every node along the path will use to schedule it.
+func (r *Router) WriteToWithClass(p []byte, addr net.Addr, class types.TrafficClass) (n int, err error) {
+	return r.WriteToWithPreference(p, addr, class, types.RoutingPreferTree)
+}
+
+// WriteToWithPreference works like WriteToWithClass but also sends the
+// packet with the given routing preference, which every node along the path
+// will use to choose between the tree and SNEK.
+func (r *Router) WriteToWithPreference(p []byte, addr net.Addr, class types.TrafficClass, preference types.RoutingPreference) (n int, err error) {
 	timer := time.NewTimer(time.Second * 5)
 	defer func() {
 		if !timer.Stop() {
@@ -88,12 +105,22 @@ func (r *Router) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 
 	switch ga := addr.(type) {
 	case types.PublicKey:
+		if len(p) > types.MaxJumboPayloadSize {
+			return 0, fmt.Errorf("payload length %d exceeds maximum %d", len(p), types.MaxJumboPayloadSize)
+		}
 		frame := getFrame()
 		frame.HopLimit = types.MaxHopLimit
 		frame.Type = types.TypeTraffic
-		frame.DestinationKey = ga
+		frame.SetTrafficClass(class)
+		frame.SetRoutingPreference(preference)
 		phony.Block(r.state, func() {
-			if cached, ok := r.state._coordsCache[ga]; ok && time.Since(cached.lastSeen) < coordsCacheLifetime {
+			// If the node has moved to a new identity then send the traffic
+			// to the new key instead, so that it still reaches them.
+			if successor, ok := r.state._successor(ga); ok {
+				ga = successor
+			}
+			frame.DestinationKey = ga
+			if cached, ok := r.state._coordsCache[ga]; ok && since(r.clock, cached.lastSeen) < coordsCacheLifetime {
 				frame.Destination = cached.coordinates
 			}
 		})
@@ -105,8 +132,13 @@ func (r *Router) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 			Sequence:  0,
 		}
 		phony.Block(r.state, func() {
-			_ = r.state._forward(r.local, frame)
+			if errors.Is(r.state._sendLocal(frame), ErrTrafficPolicy) {
+				err = ErrTrafficPolicy
+			}
 		})
+		if err != nil {
+			return 0, err
+		}
 		return len(p), nil
 
 	default:
@@ -118,6 +150,15 @@ func (r *Router) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 	}
 }
 
+// ForgetCoordinates forgets the tree coordinates that we have cached for
+// the given node, so that traffic to it is routed using SNEK until it
+// sends us traffic with its coordinates again.
+func (r *Router) ForgetCoordinates(public types.PublicKey) {
+	phony.Block(r.state, func() {
+		delete(r.state._coordsCache, public)
+	})
+}
+
 // LocalAddr returns a net.Addr containing the public key of the node for
 // SNEK routing.
 func (r *Router) LocalAddr() net.Addr {
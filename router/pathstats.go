@@ -0,0 +1,168 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+// We keep some statistics about the paths to each destination that we
+// send to. Every echo reply from a lookup tells us how many hops the echo
+// request took to get there, which we compare with the distance across the
+// tree between our coordinates and theirs to get the stretch of the path.
+// A stretch above one means that the path is longer than the tree path,
+// and below one means that SNEK found a shortcut.
+//
+// When hop limiting is enabled, traffic that runs out of hops with us is
+// almost certainly going round in a loop, which happens while the network
+// is converging after a change. Each of these is counted against the
+// destination, along with the next-hop that we would have sent it to. With
+// RouterOptionLoopDemotion, a next-hop that keeps looping traffic for a
+// destination is demoted for that destination for a while, so that traffic
+// is routed the other way instead if the other way has somewhere to go.
+
+// loopDemotionThreshold is how many frames for the same destination must
+// run out of hops in a row, all on their way to the same next-hop, before
+// that next-hop is demoted for the destination.
+const loopDemotionThreshold = 3
+
+// loopDemotionWindow is how long the loops must all happen within, and how
+// long the next-hop stays demoted after the last of them.
+const loopDemotionWindow = time.Second * 10
+
+// pathStatsExpiry is how long we will keep the statistics about the path
+// to a destination that we no longer send to.
+const pathStatsExpiry = time.Minute * 5
+
+// PathStats contains what we know about the path to a destination.
+type PathStats struct {
+	Hops         int       `json:"hops"`                // Hops taken by the last echo request to get there
+	TreeDistance int       `json:"tree_distance"`       // Distance across the tree at the time
+	Stretch      float64   `json:"stretch"`             // Smoothed ratio of the hops taken to the tree distance
+	Samples      uint64    `json:"samples"`             // Number of echo replies measured
+	Loops        uint64    `json:"loops"`               // Frames for the destination that ran out of hops here
+	LastLoop     time.Time `json:"last_loop,omitempty"` // When a frame last ran out of hops here
+}
+
+type pathStatsTable map[types.PublicKey]*pathStatsEntry
+
+type pathStatsEntry struct {
+	PathStats
+	loopVia   *peer     // The next-hop that the recent loops were heading to
+	loopCount int       // How many loops in a row were heading to loopVia
+	loopStart time.Time // When the first of those loops happened
+	updated   time.Time
+}
+
+// PathStats returns the statistics about the path to the node with the
+// given public key, or false if we haven't sent anything there recently.
+func (r *Router) PathStats(public types.PublicKey) (PathStats, bool) {
+	var stats PathStats
+	var ok bool
+	phony.Block(r.state, func() {
+		var e *pathStatsEntry
+		if e, ok = r.state._pathStats[public]; ok {
+			stats = e.PathStats
+		}
+	})
+	return stats, ok
+}
+
+// HopLimitExpiries returns how many frames have run out of hops with us
+// since the router started, for any destination. This only goes up while
+// hop limiting is enabled, and shouldn't go up at all once the network has
+// converged, since it means that traffic is going round in a loop.
+func (r *Router) HopLimitExpiries() uint64 {
+	return r.hopExpiries.Load()
+}
+
+// _pathStatsFor returns the entry for the destination, creating it if
+// needed.
+func (s *state) _pathStatsFor(public types.PublicKey) *pathStatsEntry {
+	e, ok := s._pathStats[public]
+	if !ok {
+		e = &pathStatsEntry{}
+		s._pathStats[public] = e
+	}
+	e.updated = s.r.clock.Now()
+	return e
+}
+
+// _recordPathLength adds the path length measured by an echo request to
+// the statistics about the path to the destination.
+func (s *state) _recordPathLength(public types.PublicKey, coords types.Coordinates, hops int) {
+	distance := int(s._coords().DistanceTo(coords))
+	e := s._pathStatsFor(public)
+	e.Hops, e.TreeDistance = hops, distance
+	e.Samples++
+	if distance == 0 {
+		return
+	}
+	sample := float64(hops) / float64(distance)
+	if e.Stretch == 0 {
+		e.Stretch = sample
+		return
+	}
+	e.Stretch += (sample - e.Stretch) / 8
+}
+
+// _recordLoop is called when a frame for the destination runs out of hops
+// with us, along with the next-hop that we would have sent it to.
+func (s *state) _recordLoop(public types.PublicKey, via *peer) {
+	s.r.hopExpiries.Inc()
+	now := s.r.clock.Now()
+	e := s._pathStatsFor(public)
+	e.Loops++
+	e.LastLoop = now
+	if e.loopVia != via || now.Sub(e.loopStart) > loopDemotionWindow {
+		e.loopVia, e.loopCount, e.loopStart = via, 0, now
+	}
+	e.loopCount++
+	if e.loopCount == loopDemotionThreshold && s.r.loopDemotion && via != nil {
+		s.r.log.Printf("Demoting port %d for %s after repeated loops", via.port, public.String()[:8])
+	}
+}
+
+// _loopDemoted returns true if the next-hop should be demoted for the
+// destination because it keeps looping traffic for it.
+func (s *state) _loopDemoted(public types.PublicKey, via *peer) bool {
+	if !s.r.loopDemotion || via == nil || via == s.r.local {
+		return false
+	}
+	e, ok := s._pathStats[public]
+	switch {
+	case !ok || e.loopVia != via || e.loopCount < loopDemotionThreshold:
+		return false
+	case since(s.r.clock, e.LastLoop) > loopDemotionWindow:
+		return false
+	}
+	return true
+}
+
+// _expirePathStats cleans up the statistics about paths to destinations
+// that we no longer send to.
+func (s *state) _expirePathStats() {
+	for public, e := range s._pathStats {
+		if since(s.r.clock, e.updated) > pathStatsExpiry {
+			delete(s._pathStats, public)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestPathStretch(t *testing.T) {
+	s := newTestState(types.PublicKey{}, NewManualClock(time.Unix(1000, 0)))
+	dest := types.PublicKey{4}
+
+	// We are the root, so the tree distance to [1 2] is two hops.
+	s._recordPathLength(dest, types.Coordinates{1, 2}, 4)
+	if e := s._pathStats[dest]; e.Stretch != 2 || e.TreeDistance != 2 || e.Samples != 1 {
+		t.Fatalf("expected a stretch of 2 over a distance of 2, got %+v", e.PathStats)
+	}
+	s._recordPathLength(dest, types.Coordinates{1, 2}, 2)
+	if e := s._pathStats[dest]; e.Stretch != 1.875 || e.Hops != 2 || e.Samples != 2 {
+		t.Fatalf("expected the stretch to be smoothed, got %+v", e.PathStats)
+	}
+}
+
+func TestLoopDemotion(t *testing.T) {
+	// We are the root. The tree sends traffic for {4} at [1] to the child
+	// on port 1, and SNEK sends it to the peer on port 2.
+	dest := types.PublicKey{4}
+	clock := NewManualClock(time.Unix(1000, 0))
+	s := newTestState(types.PublicKey{5}, clock)
+	s.r.timings = Timings{PathExpiry: time.Minute}
+	s.r.loopDemotion = true
+	child := addTestPeer(s, types.PublicKey{3})
+	other := addTestPeer(s, types.PublicKey{6})
+	announceTestChild(s, child)
+	s._table[virtualSnakeIndex{PublicKey: dest}] = &virtualSnakeEntry{
+		virtualSnakeIndex: &virtualSnakeIndex{PublicKey: dest},
+		Source:            other,
+		LastSeen:          clock.Now(),
+	}
+
+	nexthop := func() (*peer, *types.Frame) {
+		f := &types.Frame{
+			Type:           types.TypeTraffic,
+			Destination:    types.Coordinates{1},
+			DestinationKey: dest,
+			Watermark:      types.VirtualSnakeWatermark{PublicKey: types.FullMask},
+		}
+		p, _ := s._nextHopsTraffic(s.r.local, f)
+		return p, f
+	}
+
+	for i := 0; i < loopDemotionThreshold; i++ {
+		if p, _ := nexthop(); p != child {
+			t.Fatalf("expected the tree to be used after %d loops, got %v", i, p)
+		}
+		s._recordLoop(dest, child)
+	}
+	if p, f := nexthop(); p != other || len(f.Destination) != 0 {
+		t.Fatalf("expected the looping next-hop to be demoted, got %v with coordinates %v", p, f.Destination)
+	}
+	if s._fallbacks.Demoted != 1 {
+		t.Fatalf("expected the demotion to be counted, got %+v", s._fallbacks)
+	}
+	if stats := s._pathStats[dest]; stats.Loops != loopDemotionThreshold {
+		t.Fatalf("expected %d loops, got %+v", loopDemotionThreshold, stats.PathStats)
+	}
+	if expiries := s.r.HopLimitExpiries(); expiries != loopDemotionThreshold {
+		t.Fatalf("expected %d hop limit expiries, got %d", loopDemotionThreshold, expiries)
+	}
+
+	// The demotion lapses once the loops stop.
+	clock.Advance(loopDemotionWindow + time.Second)
+	if p, _ := nexthop(); p != child {
+		t.Fatalf("expected the demotion to lapse, got %v", p)
+	}
+
+	// Without the option, loops are only counted.
+	s.r.loopDemotion = false
+	for i := 0; i < loopDemotionThreshold; i++ {
+		s._recordLoop(dest, child)
+	}
+	if p, _ := nexthop(); p != child {
+		t.Fatalf("expected nothing to be demoted without the option, got %v", p)
+	}
+}
@@ -15,11 +15,13 @@
 package router
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -60,16 +62,70 @@ type peer struct {
 	peertype   ConnectionPeerType // Not mutated after peer setup.
 	public     types.PublicKey    // Not mutated after peer setup.
 	keepalives bool               // Not mutated after peer setup.
+	keepalive  keepaliveConfig    // Not mutated after peer setup.
+	readTimer  *connDeadline      // Times out reads on the router clock, nil without keepalives.
+	writeTimer *connDeadline      // Times out writes on the router clock, nil without keepalives.
+	tags       PeerTags           // Not mutated after peer setup.
+	noParent   bool               // Not mutated after peer setup.
+	pacer      *pacer             // Owned by the writer actor, nil if not pacing.
+	coalesce   *bufio.Writer      // Owned by the writer actor, nil if not coalescing.
+	jumbo      int                // Largest jumbo payload, not mutated after peer setup.
+	compact    bool               // Accepts compact frames, not mutated after peer setup.
+	locality   string             // Locality hint, not mutated after peer setup.
+	handshook  negotiated         // What the peer sent in the handshake, not mutated after peer setup.
+	throughput linkThroughput     // Estimated from blocked writes, updated by the writer actor.
+	faults     *faultInjector     // Nil unless injecting faults, not mutated after peer setup.
 	started    atomic.Bool        // Thread-safe toggle for marking a peer as down.
+	budget     *peerBudget        // Share of the memory budget for the queues, nil if there isn't one.
+	control    queue              // Thread-safe queue for outbound control messages.
 	proto      queue              // Thread-safe queue for outbound protocol messages.
 	traffic    queue              // Thread-safe queue for outbound traffic messages.
-	statistics struct {
-		phony.Inbox
-		_bytesRxProto   uint64
-		_bytesRxTraffic uint64
-		_bytesTxProto   uint64
-		_bytesTxTraffic uint64
-	}
+	scheduler  *scheduler         // Chooses between the queues, owned by the writer actor.
+
+	fastDetection   bool            // Not mutated after peer setup.
+	probeInterval   atomic.Duration // Negotiated fast failure detection interval, if any.
+	probeTimeout    atomic.Duration // Negotiated fast failure detection timeout, if any.
+	_probeLocal     time.Duration   // The interval we asked for, owned by the state actor.
+	_probeRemote    time.Duration   // The interval they asked for, owned by the state actor.
+	_probeSupported bool            // Has the peer sent us a link probe, owned by the state actor.
+	_demoted        bool            // Is the peer excluded from parent selection, owned by the state actor.
+	_departing      bool            // Has the peer said that it is about to leave, owned by the state actor.
+	_clock          peerClock       // How far the peer's clock is from ours, owned by the state actor.
+	_rtt            rttEstimate     // Round trip time to the peer, owned by the state actor.
+	_queueAlarms    [2]queueAlarm   // Proto and traffic queue alarms, owned by the state actor.
+	lastRead        atomic.Time     // When the reader last received a frame.
+	lastWrite       atomic.Time     // When the writer last wrote a frame.
+	congested       atomic.Bool     // Is the peering being avoided by the slow peer policy?
+	_slowState      bool            // Was the traffic queue above the slow peer threshold, owned by the state actor.
+	_slowSince      time.Time       // When the traffic queue crossed the threshold, owned by the state actor.
+	egress          *egressLimiter  // Caps the rate of traffic frames, owned by the writer actor.
+	_bootstrapACKs  bool            // Has the peer acknowledged a bootstrap, owned by the state actor.
+	_bootstrapRetx  uint64          // Bootstraps sent again for lack of acknowledgement, owned by the state actor.
+	_bootstrapLost  uint64          // Bootstraps that were never acknowledged, owned by the state actor.
+	_summary        *snekSummary    // Keys reachable through the peer, owned by the state actor.
+	_reachability   *reachability   // Filter of keys reachable through the peer, owned by the state actor.
+	_annPending     *types.Frame    // Tree announcement held back by damping, owned by the state actor.
+	_annHandled     time.Time       // When we last handled a tree announcement, owned by the state actor.
+	_annSuppressed  uint64          // Tree announcements replaced by later ones, owned by the state actor.
+	_writeTime      time.Duration   // Smoothed time taken to write a frame, owned by the writer actor.
+	_idleTimer      *clockTimer     // Reused to wait for the keepalive interval, owned by the writer actor.
+	statistics      peerStatistics  // Counters that are safe to update from any actor.
+}
+
+// peerStatistics are updated for every frame that is read from, queued for
+// or written to the peering. They are atomics, rather than being owned by an
+// actor, since sending an actor a message costs an allocation and, if it has
+// to be waited for, a context switch, which is too much for every frame.
+type peerStatistics struct {
+	bytesRxProto    atomic.Uint64
+	bytesRxTraffic  atomic.Uint64
+	bytesTxProto    atomic.Uint64
+	bytesTxTraffic  atomic.Uint64
+	malformed       atomic.Uint64
+	recentMalformed atomic.Uint64 // Halved every peerQualityInterval
+	queued          atomic.Uint64
+	dropped         atomic.Uint64
+	writeJitter     atomic.Duration // Smoothed by the writer actor
 }
 
 func (p *peer) MarshalJSON() ([]byte, error) {
@@ -93,30 +149,71 @@ func (p *peer) String() string { // to make sim less ugly
 }
 
 func (p *peer) ClearBandwidthCounters() {
-	phony.Block(&p.statistics, func() {
-		p.statistics._bytesRxProto = 0
-		p.statistics._bytesRxTraffic = 0
-		p.statistics._bytesTxProto = 0
-		p.statistics._bytesTxTraffic = 0
-	})
+	p.statistics.bytesRxProto.Store(0)
+	p.statistics.bytesRxTraffic.Store(0)
+	p.statistics.bytesTxProto.Store(0)
+	p.statistics.bytesTxTraffic.Store(0)
+}
+
+// queueFor returns the queue that frames of the given type are sent on.
+// Control frames are sent on the protocol queue if there isn't a control
+// queue.
+func (p *peer) queueFor(t types.FrameType) queue {
+	switch {
+	case t.IsTraffic() || t == types.TypeCustody:
+		return p.traffic
+	case isControlFrame(t) && p.control != nil:
+		return p.control
+	default:
+		return p.proto
+	}
 }
 
 // send queues a frame to be sent to this peer. It is safe to be called from
 // other actors. The frame will be allocated to the correct queue automatically
-// depending on whether it is a protocol frame or a traffic frame. This function
+// depending on whether it is a control, protocol or traffic frame. This function
 // will return true if the message was correctly queued or false if it was dropped,
 // i.e. due to the queue overflowing.
 func (p *peer) send(f *types.Frame) bool {
-	var q queue
-	if f.Type.IsTraffic() {
-		q = p.traffic
-	} else {
-		q = p.proto
+	if p.router != nil && !p.router.understands(f.Type) {
+		// An older implementation wouldn't have sent the frame at all.
+		framePool.Put(f)
+		return true
 	}
+	q := p.queueFor(f.Type)
 	if q == nil {
 		return false
 	}
-	return q.push(f)
+	if p.faults != nil {
+		injected := p.faults.decide(FaultPreQueue, f)
+		injected.apply(f)
+		switch {
+		case injected.drop:
+			// Pretend that the frame was queued, since it would have been
+			// lost somewhere on the link as far as the sender knows.
+			framePool.Put(f)
+			return true
+		case injected.duplicate:
+			dup := copyFrame(f)
+			if !q.push(dup) {
+				framePool.Put(dup)
+			}
+		}
+		if injected.delay > 0 {
+			p.router.clock.AfterFunc(injected.delay, func() {
+				if !q.push(f) {
+					framePool.Put(f)
+				}
+			})
+			return true
+		}
+	}
+	ok := q.push(f)
+	p.statistics.queued.Inc()
+	if !ok {
+		p.statistics.dropped.Inc()
+	}
+	return ok
 }
 
 // stop will immediately mark a port as offline, before dispatching a task to
@@ -155,14 +252,18 @@ func (p *peer) stop(err error) {
 			_ = p.conn.Close()
 		}
 
+		// If there's another link to the same neighbour then everything that
+		// used this one, including the traffic that is still queued for it,
+		// moves over to that link instead.
+		if other := p.router.state._linkDown(p); other != nil {
+			p.router.state._failOverQueued(p, other)
+			p.router.state._failOverRoutes(p, other)
+		}
+
 		// Drop all of the frames that are sitting in this peer's queues, since there
 		// is no way to send them at this point.
-		if p.proto != nil {
-			p.proto.reset()
-		}
-		if p.traffic != nil {
-			p.traffic.reset()
-		}
+		p.router.state._resetQueues(p)
+		p.budget.close()
 
 		// Notify the tree and SNEK that the port was disconnected.: This triggers
 		// tearing down of paths and possible tree re-parenting.
@@ -196,35 +297,58 @@ func (p *peer) _write() {
 	var frame *types.Frame
 
 	// The keepalive function will return a channel that either matches the
-	// keepalive interval (if enabled) or blocks forever (if disabled).
+	// keepalive interval (if enabled) or blocks forever (if disabled). The
+	// timer is reused, since we might wait for it for every frame.
 	keepalive := func() <-chan time.Time {
 		if !p.keepalives {
-			return make(chan time.Time)
+			return nil
 		}
-		return time.After(peerKeepaliveInterval)
+		return p._resetIdleTimer(p.idleInterval())
 	}
 
-	// Wait for some work to do.
-	select {
-	case <-p.context.Done():
-		// The peer context has been cancelled, which implies that the port
-		// has just been stopped.
-		return
-	case frame = <-p.proto.pop():
-		// A protocol packet is ready to send.
-		p.proto.ack()
-	default:
+	// If a traffic frame is being held back by the egress limit then we
+	// won't take any more traffic frames until it has been written, but
+	// protocol frames can still be sent in the meantime.
+	traffic, held := p.traffic.pop(), (<-chan time.Time)(nil)
+	if p.egress != nil && p.egress.held != nil {
+		ready := make(chan time.Time, 1)
+		timer := p.router.clock.AfterFunc(-since(p.router.clock, p.egress.until), func() {
+			ready <- time.Time{}
+		})
+		defer timer.Stop()
+		traffic, held = nil, ready
+	}
+
+	// If the scheduler has a frame ready to go then take it straight away,
+	// otherwise wait for some work to do.
+	frame, from := p.scheduler._next(traffic != nil)
+	if from == nil {
+		// Don't leave coalesced frames sitting in the buffer while we
+		// wait, i.e. if traffic is being held back by the egress limit.
+		if p.coalesce != nil && p.coalesce.Buffered() > 0 {
+			if err := p.coalesce.Flush(); err != nil {
+				p.stop(fmt.Errorf("p.coalesce.Flush: %w", err))
+				return
+			}
+		}
 		select {
 		case <-p.context.Done():
 			// The peer context has been cancelled, which implies that the port
 			// has just been stopped.
 			return
+		case frame = <-p.control.pop():
+			// A control packet is ready to send.
+			from = p.control
 		case frame = <-p.proto.pop():
 			// A protocol packet is ready to send.
-			p.proto.ack()
-		case frame = <-p.traffic.pop():
-			// A protocol packet is ready to send.
-			p.traffic.ack()
+			from = p.proto
+		case frame = <-traffic:
+			// A traffic packet is ready to send.
+			from = p.traffic
+		case <-held:
+			// The held traffic packet can now be sent.
+			frame = p.egress.release()
+			p.scheduler._trafficSent()
 		case <-keepalive():
 			// Nothing else happened but we reached the keepalive interval, so
 			// we will generate a keepalive frame to send instead.
@@ -232,6 +356,15 @@ func (p *peer) _write() {
 			frame.Type = types.TypeKeepalive
 		}
 	}
+	if from != nil {
+		p.scheduler._sent(from, frame)
+	}
+	if from == p.traffic && frame != nil && p.egress != nil && p.egress.hold(p.router.public, frame, len(frame.Payload), p.router.clock.Now()) {
+		// The peering is over its egress limit, so the frame will have to
+		// wait its turn.
+		p.writer.Act(nil, p._write)
+		return
+	}
 
 	// If the frame is `nil` at this point, it's probably because the queues
 	// were reset. This *shouldn't* happen at this stage but the guard doesn't
@@ -249,37 +382,108 @@ func (p *peer) _write() {
 		return
 	}
 
-	// Marshal the frame.
-	buf := frameBufferPool.Get().(*[types.MaxFrameSize]byte)
-	defer frameBufferPool.Put(buf)
-	n, err := frame.MarshalBinary(buf[:])
+	// Middleware might modify or drop the frame before it goes out. This
+	// happens before any faults are injected, since those stand in for the
+	// link itself.
+	if chain := p.router.middleware.load(); len(chain) > 0 && !chain.egress(p, frame) {
+		p.writer.Act(nil, p._write)
+		return
+	}
+
+	// If faults are being injected then the frame might be dropped here,
+	// or held back or written twice below.
+	var injected fault
+	if p.faults != nil {
+		injected = p.faults.decide(FaultPreWrite, frame)
+		injected.apply(frame)
+		if injected.drop {
+			p.writer.Act(nil, p._write)
+			return
+		}
+	}
+
+	// Marshal the frame. Frames whose payloads are too big for a normal
+	// frame have to be sent as jumbo frames, if the peering accepts them,
+	// otherwise they are dropped. Frames that carry coordinates are sent
+	// as compact frames if the peering accepts them.
+	out := frameBufferPool.Get().(*[types.MaxFrameSize]byte)
+	defer frameBufferPool.Put(out)
+	buf := out[:]
+	frame.Version = types.Version0
+	if p.compact && frame.Type.HasCompactEncoding() {
+		frame.Version = types.Version2
+	}
+	if len(frame.Payload) > types.MaxPayloadSize {
+		if frame.Type != types.TypeTraffic || len(frame.Payload) > p.jumbo {
+			p.writer.Act(nil, p._write)
+			return
+		}
+		frame.Version = types.Version1
+		jumbo := jumboBufferPool.Get().(*[]byte)
+		defer jumboBufferPool.Put(jumbo)
+		buf = *jumbo
+	}
+	n, err := frame.MarshalBinary(buf)
+	if err != nil && frame.Version == types.Version2 {
+		// The frame is too big for the compact encoding, so fall back to
+		// the normal one.
+		frame.Version = types.Version0
+		n, err = frame.MarshalBinary(buf)
+	}
 	if err != nil {
 		p.stop(fmt.Errorf("frame.MarshalBinary: %w", err))
 		return
 	}
 
+	// If the peering is paced then we might need to wait a little while
+	// before writing, so that we don't get ahead of the link.
+	if p.pacer != nil {
+		if delay := p.pacer.delay(n, p.router.clock.Now()); delay > 0 {
+			timer := newClockTimer(p.router.clock, delay)
+			select {
+			case <-p.context.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+		}
+	}
+	if injected.delay > 0 {
+		timer := newClockTimer(p.router.clock, injected.delay)
+		select {
+		case <-p.context.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+
 	// If keepalives are enabled then we should set a write deadline to ensure
-	// that the write doesn't block for too long. We don't do this when keepalives
-	// are disabled, which allows writes to take longer.
+	// that the write doesn't block for longer than the remote side would wait
+	// for a frame. We don't do this when keepalives are disabled, which allows
+	// writes to take longer.
 	if p.keepalives {
-		if err := p.conn.SetWriteDeadline(time.Now().Add(peerKeepaliveInterval)); err != nil {
-			p.stop(fmt.Errorf("p.conn.SetWriteDeadline: %w", err))
+		if err := p.writeTimer.start(p.keepalive.timeout); err != nil {
+			p.stop(fmt.Errorf("p.writeTimer.start: %w", err))
 			return
 		}
 	}
 
 	// Write the frame to the peering.
 	if frame.Type.IsTraffic() {
-		phony.Block(&p.statistics, func() {
-			p.statistics._bytesTxTraffic += uint64(n)
-		})
+		p.statistics.bytesTxTraffic.Add(uint64(n))
 	} else {
-		phony.Block(&p.statistics, func() {
-			p.statistics._bytesTxProto += uint64(n)
-		})
+		p.statistics.bytesTxProto.Add(uint64(n))
 	}
 
-	wn, err := p.conn.Write(buf[:n])
+	writeStart := p.router.clock.Now()
+	wn, err := p._writeFrame(buf[:n])
+	writeTime := since(p.router.clock, writeStart)
+	p._recordWriteTime(writeTime)
+	if p.pacer != nil {
+		p.pacer.observe(wn, writeTime)
+	}
+	p.throughput.observe(wn, writeTime)
 	if err != nil {
 		p.stop(fmt.Errorf("p.conn.Write: %w", err))
 		return
@@ -292,11 +496,18 @@ func (p *peer) _write() {
 		p.stop(fmt.Errorf("p.conn.Write length %d != %d", wn, n))
 		return
 	}
+	if injected.duplicate {
+		if _, err := p._writeFrame(buf[:n]); err != nil {
+			p.stop(fmt.Errorf("p.conn.Write: %w", err))
+			return
+		}
+	}
+	p.lastWrite.Store(p.router.clock.Now())
 
 	// If keepalives are enabled then we should reset the write deadline.
 	if p.keepalives {
-		if err := p.conn.SetWriteDeadline(time.Time{}); err != nil {
-			p.stop(fmt.Errorf("p.conn.SetWriteDeadline: %w", err))
+		if err := p.writeTimer.stop(); err != nil {
+			p.stop(fmt.Errorf("p.writeTimer.stop: %w", err))
 			return
 		}
 	}
@@ -306,6 +517,26 @@ func (p *peer) _write() {
 	p.writer.Act(nil, p._write)
 }
 
+// _writeFrame writes a marshalled frame to the peering. If writes are being
+// coalesced then the frame is buffered instead, and the buffer is only
+// written out once there are no more frames waiting to be sent or once it
+// is full. This function must be called from the peer's writer actor only.
+func (p *peer) _writeFrame(b []byte) (int, error) {
+	p.router.energy.framesTx.Inc()
+	p.router.energy.bytesTx.Add(uint64(len(b)))
+	if p.coalesce == nil {
+		return p.conn.Write(b)
+	}
+	n, err := p.coalesce.Write(b)
+	if err != nil {
+		return n, err
+	}
+	if p.control.queuecount() == 0 && p.proto.queuecount() == 0 && p.traffic.queuecount() == 0 {
+		err = p.coalesce.Flush()
+	}
+	return n, err
+}
+
 // _read waits for packets to arrive from the peering and then handles
 // them appropriate. This function must be called from the peer's reader
 // actor only.
@@ -322,8 +553,8 @@ func (p *peer) _read() {
 	// then we assume the remote peer is dead, as they should have sent us a keepalive
 	// packet by then.
 	if p.keepalives {
-		if err := p.conn.SetReadDeadline(time.Now().Add(peerKeepaliveTimeout)); err != nil {
-			p.stop(fmt.Errorf("p.conn.SetReadDeadline: %w", err))
+		if err := p.readTimer.start(p.readTimeout()); err != nil {
+			p.stop(fmt.Errorf("p.readTimer.start: %w", err))
 			return
 		}
 	}
@@ -341,13 +572,9 @@ func (p *peer) _read() {
 		isProtoTraffic = !types.FrameType(b[5]).IsTraffic()
 
 		if isProtoTraffic {
-			phony.Block(&p.statistics, func() {
-				p.statistics._bytesRxProto += uint64(n)
-			})
+			p.statistics.bytesRxProto.Add(uint64(n))
 		} else {
-			phony.Block(&p.statistics, func() {
-				p.statistics._bytesRxTraffic += uint64(n)
-			})
+			p.statistics.bytesRxTraffic.Add(uint64(n))
 		}
 	}
 
@@ -359,30 +586,56 @@ func (p *peer) _read() {
 		return
 	}
 
+	// Jumbo frames have a longer header and need a bigger buffer, so they
+	// are only accepted from peers that agreed to send them.
+	data, header := b[:], types.FrameHeaderLength
+	expecting := int(binary.BigEndian.Uint16(b[types.FrameHeaderLength-2 : types.FrameHeaderLength]))
+	if types.IsJumboFrame(b[:]) {
+		if p.jumbo == 0 {
+			p.stop(fmt.Errorf("unexpected jumbo frame"))
+			return
+		}
+		if _, err := io.ReadFull(p.conn, b[types.FrameHeaderLength:types.JumboFrameHeaderLength]); err != nil {
+			p.stop(fmt.Errorf("io.ReadFull Jumbo: %w", err))
+			return
+		}
+		header, expecting = types.JumboFrameHeaderLength, types.JumboFrameLength(b[:])
+		if expecting > p.jumbo+types.MaxFrameSize {
+			p.stop(fmt.Errorf("jumbo frame of %d bytes is too big", expecting))
+			return
+		}
+		jumbo := jumboBufferPool.Get().(*[]byte)
+		defer jumboBufferPool.Put(jumbo)
+		data = *jumbo
+		copy(data, b[:header])
+	}
+	if expecting < header {
+		p.stop(fmt.Errorf("frame length %d is shorter than the header", expecting))
+		return
+	}
+
 	// Now read the rest of the packet. If something goes wrong with this then we will
 	// assume that either the length given to us earlier was incorrect, or something else
 	// is wrong with the peering, so we will stop the peering in either case.
-	expecting := int(binary.BigEndian.Uint16(b[types.FrameHeaderLength-2 : types.FrameHeaderLength]))
-	n, err := io.ReadFull(p.conn, b[types.FrameHeaderLength:expecting])
+	n, err := io.ReadFull(p.conn, data[header:expecting])
 	if err != nil {
 		p.stop(fmt.Errorf("io.ReadFull Remaining: %w", err))
 		return
 	}
+	p.lastRead.Store(p.router.clock.Now())
+	p.router.energy.framesRx.Inc()
+	p.router.energy.bytesRx.Add(uint64(expecting))
 
 	if isProtoTraffic {
-		phony.Block(&p.statistics, func() {
-			p.statistics._bytesRxProto += uint64(n)
-		})
+		p.statistics.bytesRxProto.Add(uint64(n))
 	} else {
-		phony.Block(&p.statistics, func() {
-			p.statistics._bytesRxTraffic += uint64(n)
-		})
+		p.statistics.bytesRxTraffic.Add(uint64(n))
 	}
 
 	// If keepalives are disabled then we can reset the read deadline again.
 	if p.keepalives {
-		if err := p.conn.SetReadDeadline(time.Time{}); err != nil {
-			p.stop(fmt.Errorf("conn.SetReadDeadline: %w", err))
+		if err := p.readTimer.stop(); err != nil {
+			p.stop(fmt.Errorf("p.readTimer.stop: %w", err))
 			return
 		}
 	}
@@ -397,31 +650,151 @@ func (p *peer) _read() {
 	// Check that we read the number of bytes that we were expecting to read.
 	// If we didn't then that implies that something went wrong, so shut down the
 	// peering.
-	if n < expecting-types.FrameHeaderLength {
+	if n < expecting-header {
 		p.stop(fmt.Errorf("expecting %d bytes but got %d bytes", expecting, n))
 		return
 	}
 
-	// Unmarshal the frame.
+	// Unmarshal the frame. In strict mode, a malformed frame doesn't cost us
+	// our place in the stream since we already read the whole thing, so we
+	// can count it against the peer and carry on up to a limit. Otherwise
+	// a malformed frame stops the peering.
 	f := getFrame()
-	if _, err := f.UnmarshalBinary(b[:n+types.FrameHeaderLength]); err != nil {
-		p.stop(fmt.Errorf("f.UnmarshalBinary: %w", err))
+	if t := types.FrameType(data[5]); !p.router.understands(t) {
+		// An older implementation wouldn't know how to decode the frame,
+		// so it would be malformed in strict mode and ignored otherwise.
+		framePool.Put(f)
+		if p.router.strict && p.countMalformed(&types.UnknownFrameTypeError{Type: t}) {
+			return
+		}
+		p.reader.Act(nil, p._read)
+		return
+	}
+	if !p.router.strict {
+		_, err = types.Decode(f, data[:n+header])
+	} else {
+		_, err = f.UnmarshalBinaryStrict(data[:n+header])
+	}
+	if err != nil {
+		framePool.Put(f)
+		if p.countMalformed(err) {
+			return
+		}
+		p.reader.Act(nil, p._read)
 		return
 	}
 
-	// Send the frame across to the state actor to be handled/forwarded.
-	p.router.state.Act(&p.reader, func() {
-		if err := p.router.state._forward(p, f); err != nil {
-			p.stop(fmt.Errorf("p.router.state._forward: %w", err))
+	// If faults are being injected then the frame might be dropped, handled
+	// later or handled twice.
+	if p.faults != nil {
+		injected := p.faults.decide(FaultPostRead, f)
+		injected.apply(f)
+		switch {
+		case injected.drop:
+			framePool.Put(f)
+			p.reader.Act(nil, p._read)
 			return
+		case injected.duplicate:
+			p._handle(copyFrame(f))
 		}
-	})
+		if injected.delay > 0 {
+			p.router.clock.AfterFunc(injected.delay, func() {
+				p.reader.Act(nil, func() {
+					p._handle(f)
+				})
+			})
+			p.reader.Act(nil, p._read)
+			return
+		}
+	}
+
+	// Send the frame across to the state actor to be handled/forwarded.
+	p._handle(f)
 
 	// This is effectively a recursive call to queue up the next read into
 	// the actor inbox.
 	p.reader.Act(nil, p._read)
 }
 
+// countMalformed counts a malformed frame, or a malformed payload that the
+// peer is itself responsible for, against the peer and returns true if the
+// peering was stopped because of it. Without strict decoding the first one
+// stops the peering, otherwise the peering is only stopped once there have
+// been too many of them recently. It is safe to call from any actor.
+func (p *peer) countMalformed(err error) bool {
+	p.statistics.malformed.Inc()
+	recent := p.statistics.recentMalformed.Inc()
+	if !p.router.strict {
+		p.stop(fmt.Errorf("malformed frame: %w", err))
+		return true
+	}
+	p.router.log.Println("Malformed frame from peer", p.public.String(), "on port", p.port, "due to error:", err)
+	if recent >= peerMaxMalformedFrames {
+		p.stop(fmt.Errorf("too many malformed frames: %w", err))
+		return true
+	}
+	return false
+}
+
+// decayMalformed halves the count of recent malformed frames, so that rare
+// corruption on a long-lived peering never adds up to a disconnection. It
+// is safe to call from any actor.
+func (p *peer) decayMalformed() {
+	for {
+		recent := p.statistics.recentMalformed.Load()
+		if recent == 0 || p.statistics.recentMalformed.CAS(recent, recent/2) {
+			return
+		}
+	}
+}
+
+// peerLocalFrame returns true if frames of the given type are only ever sent
+// directly between peers, so that a malformed payload can only be the fault
+// of the peer that sent it and not of a node further away.
+func peerLocalFrame(t types.FrameType) bool {
+	switch t {
+	case types.TypeKeepalive, types.TypeTreeAnnouncement, types.TypeLinkProbe,
+		types.TypeBootstrapACK, types.TypeSNEKSummary, types.TypeReachability,
+		types.TypeSNEKRefresh, types.TypeDeparting, types.TypeTimeSync:
+		return true
+	default:
+		return false
+	}
+}
+
+// _handle sends a frame that was read from the peering across to the state
+// actor to be handled/forwarded.
+func (p *peer) _handle(f *types.Frame) {
+	if chain := p.router.middleware.load(); len(chain) > 0 && !chain.ingress(p, f) {
+		framePool.Put(f)
+		return
+	}
+	var received time.Time
+	if p.router.latency {
+		received = p.router.clock.Now()
+	}
+	p.router.state.Act(&p.reader, func() {
+		if l := p.router.state._latency; l != nil {
+			l.begin(f, received)
+			defer l.end()
+		}
+		frameType := f.Type
+		switch err := p.router.state._forward(p, f); {
+		case err == nil:
+		case errors.Is(err, types.ErrMalformed):
+			// The frame was dropped. Only a payload that the peer wrote
+			// itself counts against it, since anything else might have
+			// been relayed on behalf of a node further away that would
+			// otherwise be able to get our peerings torn down.
+			if peerLocalFrame(frameType) {
+				p.countMalformed(err)
+			}
+		default:
+			p.stop(fmt.Errorf("p.router.state._forward: %w", err))
+		}
+	})
+}
+
 func (p *peer) _coords() (types.Coordinates, error) {
 	var err error
 	var coords types.Coordinates
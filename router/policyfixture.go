@@ -0,0 +1,201 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !minimal
+// +build !minimal
+
+package router
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+	"go.uber.org/atomic"
+)
+
+// PolicyFixture holds synthetic routing state, i.e. peers, the tree
+// announcements that they sent and SNEK paths, so that tests can ask the
+// next-hop rules where frames would go without setting up any routers or
+// connections. The rules are the same ones that the router uses. The
+// router/policytest package has helpers for table-driven tests on top of
+// it.
+type PolicyFixture struct {
+	public        types.PublicKey
+	self          *peer
+	parent        *peer
+	peers         map[types.SwitchPortID]*peer
+	announcements announcementTable
+	table         virtualSnakeTable
+	ordering      uint64
+	now           time.Time
+	pathExpiry    time.Duration
+}
+
+// NewPolicyFixture returns a fixture for a node with the given key, which
+// has no peers and is its own root.
+func NewPolicyFixture(public types.PublicKey) *PolicyFixture {
+	return &PolicyFixture{
+		public: public,
+		self: &peer{
+			public:  public,
+			started: *atomic.NewBool(true),
+		},
+		peers:         map[types.SwitchPortID]*peer{},
+		announcements: announcementTable{},
+		table:         virtualSnakeTable{},
+		now:           time.Now(),
+		pathExpiry:    virtualSnakeNeighExpiryPeriod,
+	}
+}
+
+// AddPeer adds a running peering on the given port, which must not be
+// zero, to the node with the given key. The peer type is one of the
+// PeerType constants.
+func (f *PolicyFixture) AddPeer(port types.SwitchPortID, public types.PublicKey, peertype int) {
+	if port == 0 {
+		panic("port 0 is the local port")
+	}
+	f.peers[port] = &peer{
+		port:     port,
+		public:   public,
+		peertype: ConnectionPeerType(peertype),
+		started:  *atomic.NewBool(true),
+	}
+}
+
+// StopPeer marks the peering on the given port as stopped.
+func (f *PolicyFixture) StopPeer(port types.SwitchPortID) {
+	f.peer(port).started.Store(false)
+}
+
+// SetCongested marks the peering on the given port as being avoided by
+// the slow peer policy, or not.
+func (f *PolicyFixture) SetCongested(port types.SwitchPortID, congested bool) {
+	f.peer(port).congested.Store(congested)
+}
+
+// Announce records the tree announcement that the peer on the given port
+// sent us. The signatures run from the root to the peer, and the last one
+// is the peer's signature for the port that leads to us. Announcements are
+// ordered by when they were recorded.
+func (f *PolicyFixture) Announce(port types.SwitchPortID, announcement types.SwitchAnnouncement) {
+	f.ordering++
+	f.announcements[f.peer(port)] = &rootAnnouncementWithTime{
+		SwitchAnnouncement: announcement,
+		receiveTime:        f.now,
+		receiveOrder:       f.ordering,
+	}
+}
+
+// SetParent makes the peer on the given port our parent, so that our
+// coordinates and root come from its announcement, which must have been
+// recorded already. Port zero makes us our own root again.
+func (f *PolicyFixture) SetParent(port types.SwitchPortID) {
+	if port == 0 {
+		f.parent = nil
+		return
+	}
+	p := f.peer(port)
+	if f.announcements[p] == nil {
+		panic(fmt.Sprintf("no announcement from port %d", port))
+	}
+	f.parent = p
+}
+
+// AddPath adds a SNEK path to the node with the given key, which was set up
+// through the peer on the given source port, or by us if the port is zero.
+// The path was last seen at the fixture's current time.
+func (f *PolicyFixture) AddPath(public types.PublicKey, source types.SwitchPortID, watermark types.VirtualSnakeWatermark) {
+	index := virtualSnakeIndex{PublicKey: public}
+	f.table[index] = &virtualSnakeEntry{
+		virtualSnakeIndex: &index,
+		Source:            f.peer(source),
+		Destination:       f.self,
+		Watermark:         watermark,
+		LastSeen:          f.now,
+		Root:              f.rootAnnouncement().Root,
+	}
+}
+
+// SetTime sets the time that the next-hop rules think it is, which is used
+// to expire paths. Announcements and paths recorded after this use it too.
+func (f *PolicyFixture) SetTime(now time.Time) {
+	f.now = now
+}
+
+// Coords returns our coordinates in the tree.
+func (f *PolicyFixture) Coords() types.Coordinates {
+	return f.rootAnnouncement().Coords()
+}
+
+// NextHopSNEK works out where a frame for the given key would be sent
+// using SNEK routing, and why.
+func (f *PolicyFixture) NextHopSNEK(dest types.PublicKey, bootstrap bool) NextHopExplanation {
+	return explainSNEK(virtualSnakeNextHopParams{
+		bootstrap,
+		dest,
+		f.public,
+		types.VirtualSnakeWatermark{PublicKey: types.FullMask},
+		f.parent,
+		f.self,
+		f.rootAnnouncement(),
+		f.announcements,
+		f.table,
+		f.now,
+		f.pathExpiry,
+	})
+}
+
+// NextHopTree works out where a frame for the given coordinates that came
+// from the peer on the given port, or from us if the port is zero, would be
+// sent using tree routing, and why.
+func (f *PolicyFixture) NextHopTree(dest types.Coordinates, from types.SwitchPortID) NextHopExplanation {
+	return explainTree(treeNextHopParams{
+		dest,
+		f.Coords(),
+		f.peer(from),
+		f.self,
+		f.rootAnnouncement(),
+		&f.announcements,
+	})
+}
+
+func (f *PolicyFixture) peer(port types.SwitchPortID) *peer {
+	if port == 0 {
+		return f.self
+	}
+	p, ok := f.peers[port]
+	if !ok {
+		panic(fmt.Sprintf("no peer on port %d", port))
+	}
+	return p
+}
+
+// rootAnnouncement returns our parent's announcement, or one for us as the
+// root if we don't have a parent, in the same way as the router does.
+func (f *PolicyFixture) rootAnnouncement() *rootAnnouncementWithTime {
+	if f.parent != nil {
+		if ann := f.announcements[f.parent]; ann != nil {
+			return ann
+		}
+	}
+	return &rootAnnouncementWithTime{
+		SwitchAnnouncement: types.SwitchAnnouncement{
+			Root: types.Root{
+				RootPublicKey: f.public,
+			},
+		},
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !minimal
+// +build !minimal
+
+// Package policytest has helpers for table-driven tests of the routing
+// rules. Each test sets up a router.PolicyFixture with the peers, tree
+// announcements and SNEK paths that it needs, and then checks where frames
+// for a list of destinations would be sent, without setting up any
+// routers or connections.
+package policytest
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/matrix-org/pinecone/router"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// Case is a destination and where frames for it are expected to go.
+type Case struct {
+	Name        string
+	Key         types.PublicKey    // The destination for SNEK routing, if Coords is nil
+	Coords      types.Coordinates  // The destination for tree routing
+	From        types.SwitchPortID // The port that the frame came from, for tree routing
+	Bootstrap   bool               // Is the frame a bootstrap? For SNEK routing
+	Expected    types.SwitchPortID // The port that the frame should be sent to, zero for us
+	NotFound    bool               // Set if no next-hop should be found at all
+	ExpectedVia string             // The rule that should pick the next-hop, if not empty
+}
+
+// Run checks each of the cases against the fixture as a subtest.
+func Run(t *testing.T, f *router.PolicyFixture, cases []Case) {
+	t.Helper()
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			Check(t, f, tc)
+		})
+	}
+}
+
+// Check checks a single case against the fixture.
+func Check(t *testing.T, f *router.PolicyFixture, tc Case) {
+	t.Helper()
+	var explanation router.NextHopExplanation
+	if tc.Coords != nil {
+		explanation = f.NextHopTree(tc.Coords, tc.From)
+	} else {
+		explanation = f.NextHopSNEK(tc.Key, tc.Bootstrap)
+	}
+	switch {
+	case tc.NotFound && explanation.Found:
+		t.Fatalf("expected no next-hop, got port %d (%s)", explanation.Port, Describe(explanation))
+	case tc.NotFound:
+		return
+	case !explanation.Found:
+		t.Fatalf("expected port %d, got no next-hop (%s)", tc.Expected, Describe(explanation))
+	case explanation.Port != tc.Expected:
+		t.Fatalf("expected port %d, got port %d (%s)", tc.Expected, explanation.Port, Describe(explanation))
+	}
+	if tc.ExpectedVia != "" {
+		if n := len(explanation.Candidates); n == 0 || explanation.Candidates[n-1].Rule != tc.ExpectedVia {
+			t.Fatalf("expected the next-hop to be picked because %q (%s)", tc.ExpectedVia, Describe(explanation))
+		}
+	}
+}
+
+// Describe returns the candidates in the explanation and the rules that
+// picked them, for failure messages.
+func Describe(explanation router.NextHopExplanation) string {
+	if len(explanation.Candidates) == 0 {
+		return "no candidates"
+	}
+	description := ""
+	for i, c := range explanation.Candidates {
+		if i > 0 {
+			description += ", then "
+		}
+		description += fmt.Sprintf("port %d because %s", c.Port, c.Rule)
+	}
+	return description
+}
+
+// Announcement returns a tree announcement for the given root, with one
+// signature for each of the hops from the root down to the peer that sent
+// it. The last hop is the peer's port towards us.
+func Announcement(root types.PublicKey, hops ...types.SignatureWithHop) types.SwitchAnnouncement {
+	return types.SwitchAnnouncement{
+		Root:       types.Root{RootPublicKey: root},
+		Signatures: append([]types.SignatureWithHop{}, hops...),
+	}
+}
+
+// Hop returns a signature for an announcement, from the node with the given
+// key for the given port.
+func Hop(public types.PublicKey, port types.SwitchPortID) types.SignatureWithHop {
+	return types.SignatureWithHop{
+		Hop:       types.Varu64(port),
+		PublicKey: public,
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !minimal
+// +build !minimal
+
+package policytest
+
+import (
+	"testing"
+
+	"github.com/matrix-org/pinecone/router"
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestPolicyFixture(t *testing.T) {
+	self := types.PublicKey{5}
+	root := types.PublicKey{9}
+	lower := types.PublicKey{3}
+	stopped := types.PublicKey{7}
+	relay := types.PublicKey{1}
+	remote := types.PublicKey{4}
+
+	f := router.NewPolicyFixture(self)
+	f.AddPeer(1, root, router.PeerTypeRemote)
+	f.AddPeer(2, lower, router.PeerTypeRemote)
+	f.AddPeer(3, stopped, router.PeerTypeRemote)
+	f.AddPeer(4, relay, router.PeerTypeRemote)
+	f.Announce(1, Announcement(root, Hop(root, 1)))
+	f.Announce(2, Announcement(root, Hop(root, 2), Hop(lower, 1)))
+	f.Announce(3, Announcement(root, Hop(root, 3), Hop(stopped, 1)))
+	f.Announce(4, Announcement(root, Hop(root, 4), Hop(relay, 1)))
+	f.SetParent(1)
+	f.StopPeer(3)
+	f.AddPath(remote, 4, types.VirtualSnakeWatermark{PublicKey: types.FullMask})
+
+	if coords := f.Coords(); !coords.EqualTo(types.Coordinates{1}) {
+		t.Fatalf("expected coordinates [1], got %v", coords)
+	}
+
+	Run(t, f, []Case{
+		{Name: "OwnKey", Key: self, Expected: 0, ExpectedVia: "destination is our own key"},
+		{Name: "Root", Key: root, Expected: 1},
+		{Name: "DirectPeer", Key: lower, Expected: 2, ExpectedVia: "directly peered with the best key"},
+		{Name: "StoppedPeer", Key: stopped, Expected: 1},
+		{Name: "SNEKPath", Key: remote, Expected: 4, ExpectedVia: "SNEK path is the destination"},
+		{Name: "OwnCoords", Coords: types.Coordinates{1}, Expected: 0},
+		{Name: "TreePeer", Coords: types.Coordinates{2}, Expected: 2, ExpectedVia: "closer to the destination"},
+		{Name: "TreeNotBack", Coords: types.Coordinates{2}, From: 2, Expected: 1},
+		{Name: "TreeStopped", Coords: types.Coordinates{3}, Expected: 1},
+	})
+
+	f.SetCongested(2, true)
+	Check(t, f, Case{Name: "TreeCongested", Coords: types.Coordinates{2}, Expected: 1})
+}
@@ -15,29 +15,190 @@
 package router
 
 import (
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/matrix-org/pinecone/types"
+	"go.uber.org/atomic"
 )
 
-var frameBufferPool = &sync.Pool{
-	New: func() interface{} {
-		b := [types.MaxFrameSize]byte{}
-		return &b
-	},
-}
+// Frames and buffers are reused through pools rather than being left for
+// the garbage collector, so a frame that is put back into the pool while
+// something is still using it turns up later as a corrupted payload, and
+// one that is never put back is a slow leak. Each pool counts how many
+// items have been taken out and put back, which PoolStats reports. With
+// SetFrameTracking, the stack of every Get is also recorded until the item
+// is put back, so that UnreleasedFrames can show where the items that are
+// still out came from. The pools are shared by every router in the
+// process, and so is the tracking.
 
-var framePool = &sync.Pool{
-	New: func() interface{} {
-		f := &types.Frame{
-			Payload: make([]byte, 0, types.MaxPayloadSize),
-		}
-		return f
-	},
-}
+var frameBufferPool = newTrackedPool("frame buffers", func() interface{} {
+	b := [types.MaxFrameSize]byte{}
+	return &b
+})
+
+var framePool = newTrackedPool("frames", func() interface{} {
+	f := &types.Frame{
+		Payload: make([]byte, 0, types.MaxPayloadSize),
+	}
+	return f
+})
 
 func getFrame() *types.Frame {
 	f := framePool.Get().(*types.Frame)
 	f.Reset()
 	return f
 }
+
+// poolTracking is set by SetFrameTracking.
+var poolTracking atomic.Bool
+
+// poolOutstanding holds a poolGet for every item that was taken out of a
+// pool while tracking was enabled and hasn't been put back yet.
+var poolOutstanding sync.Map // interface{} -> *poolGet
+
+// poolStackDepth is how many frames of the stack are recorded for each
+// Get while tracking is enabled.
+const poolStackDepth = 16
+
+type poolGet struct {
+	pool    string
+	at      time.Time
+	callers []uintptr
+}
+
+// SetFrameTracking turns on or off recording where every frame and buffer
+// was taken out of its pool until it is put back, so that UnreleasedFrames
+// can show where leaked frames came from. Recording the stacks is slow, so
+// this is only meant for debugging. The pools are shared by every router in
+// the process, so this applies to all of them. Frames that are already out
+// of their pools when tracking is turned on aren't known about, and turning
+// it off forgets the ones that were.
+func SetFrameTracking(enabled bool) {
+	poolTracking.Store(enabled)
+	if !enabled {
+		poolOutstanding.Range(func(k, _ interface{}) bool {
+			poolOutstanding.Delete(k)
+			return true
+		})
+	}
+}
+
+// PoolStats contains the counters for one of the frame or buffer pools.
+type PoolStats struct {
+	Name        string `json:"name"`
+	Allocated   uint64 `json:"allocated"`   // Items created because the pool was empty
+	Gets        uint64 `json:"gets"`        // Items taken out of the pool
+	Puts        uint64 `json:"puts"`        // Items put back into the pool
+	Outstanding int64  `json:"outstanding"` // Items taken out and not put back yet
+}
+
+// UnreleasedFrame is an item that was taken out of a pool while tracking
+// was enabled and hasn't been put back.
+type UnreleasedFrame struct {
+	Pool  string
+	Age   time.Duration
+	Stack string // Where the item was taken out of the pool
+}
+
+// trackedPool is a sync.Pool that counts what goes in and out of it.
+type trackedPool struct {
+	name      string
+	pool      sync.Pool
+	allocated atomic.Uint64
+	gets      atomic.Uint64
+	puts      atomic.Uint64
+}
+
+func newTrackedPool(name string, fn func() interface{}) *trackedPool {
+	p := &trackedPool{name: name}
+	p.pool.New = func() interface{} {
+		p.allocated.Inc()
+		return fn()
+	}
+	return p
+}
+
+func (p *trackedPool) Get() interface{} {
+	x := p.pool.Get()
+	p.gets.Inc()
+	if poolTracking.Load() {
+		callers := make([]uintptr, poolStackDepth)
+		callers = callers[:runtime.Callers(2, callers)]
+		poolOutstanding.Store(x, &poolGet{p.name, time.Now(), callers})
+	}
+	return x
+}
+
+func (p *trackedPool) Put(x interface{}) {
+	if x == nil {
+		return
+	}
+	p.puts.Inc()
+	if poolTracking.Load() {
+		poolOutstanding.Delete(x)
+	}
+	p.pool.Put(x)
+}
+
+func (p *trackedPool) stats() PoolStats {
+	gets, puts := p.gets.Load(), p.puts.Load()
+	return PoolStats{
+		Name:        p.name,
+		Allocated:   p.allocated.Load(),
+		Gets:        gets,
+		Puts:        puts,
+		Outstanding: int64(gets - puts),
+	}
+}
+
+// PoolStats returns the counters for each of the frame and buffer pools.
+// The pools are shared by every router in the process.
+func (r *Router) PoolStats() []PoolStats {
+	return []PoolStats{
+		framePool.stats(),
+		frameBufferPool.stats(),
+		jumboBufferPool.stats(),
+	}
+}
+
+// UnreleasedFrames returns the frames and buffers that have been out of
+// their pools for at least the given age, oldest first, along with where
+// they were taken out. It only knows about the ones that were taken out
+// while frame tracking was turned on with SetFrameTracking.
+func (r *Router) UnreleasedFrames(age time.Duration) []UnreleasedFrame {
+	now := time.Now()
+	var unreleased []UnreleasedFrame
+	poolOutstanding.Range(func(_, v interface{}) bool {
+		get := v.(*poolGet)
+		if since := now.Sub(get.at); since >= age {
+			unreleased = append(unreleased, UnreleasedFrame{
+				Pool:  get.pool,
+				Age:   since,
+				Stack: formatCallers(get.callers),
+			})
+		}
+		return true
+	})
+	sort.Slice(unreleased, func(i, j int) bool {
+		return unreleased[i].Age > unreleased[j].Age
+	})
+	return unreleased
+}
+
+func formatCallers(callers []uintptr) string {
+	var b strings.Builder
+	frames := runtime.CallersFrames(callers)
+	for {
+		frame, more := frames.Next()
+		fmt.Fprintf(&b, "%s\n\t%s:%d\n", frame.Function, frame.File, frame.Line)
+		if !more {
+			break
+		}
+	}
+	return b.String()
+}
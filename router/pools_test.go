@@ -0,0 +1,67 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"crypto/ed25519"
+	"strings"
+	"testing"
+)
+
+func TestPoolTracking(t *testing.T) {
+	SetFrameTracking(true)
+	t.Cleanup(func() { SetFrameTracking(false) })
+	_, sk, _ := ed25519.GenerateKey(nil)
+	r := NewRouter(nil, sk)
+	t.Cleanup(func() { _ = r.Close() })
+
+	p := newTrackedPool("test", func() interface{} { return new(int) })
+	leaked, released := p.Get(), p.Get()
+	p.Put(released)
+	if s := p.stats(); s.Allocated != 2 || s.Gets != 2 || s.Puts != 1 || s.Outstanding != 1 {
+		t.Fatalf("unexpected pool counters: %+v", s)
+	}
+
+	unreleased := func() (found []UnreleasedFrame) {
+		for _, u := range r.UnreleasedFrames(0) {
+			if u.Pool == "test" {
+				found = append(found, u)
+			}
+		}
+		return
+	}
+	found := unreleased()
+	if len(found) != 1 {
+		t.Fatalf("expected one unreleased item, got %d", len(found))
+	}
+	if !strings.Contains(found[0].Stack, "TestPoolTracking") {
+		t.Fatalf("expected the stack to show where the item was taken, got:\n%s", found[0].Stack)
+	}
+	p.Put(leaked)
+	if found := unreleased(); len(found) != 0 {
+		t.Fatalf("expected nothing to be unreleased, got %d", len(found))
+	}
+	if s := p.stats(); s.Outstanding != 0 {
+		t.Fatalf("expected nothing to be outstanding, got %d", s.Outstanding)
+	}
+
+	// Turning tracking off forgets what is still out, since it won't be
+	// noticed when it's put back.
+	p.Get()
+	SetFrameTracking(false)
+	if found := unreleased(); len(found) != 0 {
+		t.Fatalf("expected nothing to be tracked once tracking was off, got %d", len(found))
+	}
+}
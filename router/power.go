@@ -0,0 +1,124 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"time"
+
+	"github.com/Arceliar/phony"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+// PowerMode controls how aggressively the router performs background
+// maintenance. Embedders should switch to PowerModeLowPower when the host
+// reports that the battery is low or that the application has been moved
+// into the background, and back to PowerModeNormal when foregrounded.
+type PowerMode int
+
+const (
+	// PowerModeNormal performs maintenance at the usual cadence.
+	PowerModeNormal PowerMode = iota
+	// PowerModeLowPower lengthens maintenance intervals, batches tree
+	// announcements and suppresses wakeup broadcasts. Keepalives and
+	// bootstraps are not affected, since our peers would otherwise
+	// time us out.
+	PowerModeLowPower
+)
+
+func (m PowerMode) String() string {
+	switch m {
+	case PowerModeNormal:
+		return "normal"
+	case PowerModeLowPower:
+		return "low-power"
+	default:
+		return "unknown"
+	}
+}
+
+// SetPowerMode changes the power mode of the router. Switching back to
+// PowerModeNormal immediately runs any maintenance that was deferred.
+func (r *Router) SetPowerMode(mode PowerMode) {
+	phony.Block(r.state, func() {
+		if r.state._powerMode == mode {
+			return
+		}
+		r.log.Println("Switching to", mode.String(), "power mode")
+		r.state._powerMode = mode
+		if mode == PowerModeNormal {
+			r.state._maintainSnakeIn(0)
+			if r.state._announcePending {
+				r.state._flushTreeAnnouncements()
+			}
+		}
+	})
+}
+
+// PowerMode returns the current power mode of the router.
+func (r *Router) PowerMode() PowerMode {
+	var mode PowerMode
+	phony.Block(r.state, func() {
+		mode = r.state._powerMode
+	})
+	return mode
+}
+
+// _snakeMaintainInterval returns how long to wait between runs of
+// SNEK maintenance in the current power mode. In low power mode it must
+// still be short enough that we bootstrap before our paths expire.
+func (s *state) _snakeMaintainInterval() time.Duration {
+	if s._powerMode == PowerModeLowPower {
+		return s.r.timings.BootstrapInterval / 2
+	}
+	return s.r.timings.SNEKMaintainInterval
+}
+
+// _peerQualityInterval returns how long to wait between recalculating
+// peer quality scores in the current power mode.
+func (s *state) _peerQualityInterval() time.Duration {
+	if s._powerMode == PowerModeLowPower {
+		return lowPowerPeerQualityInterval
+	}
+	return peerQualityInterval
+}
+
+// _batchTreeAnnouncements returns true if the tree announcements should
+// be deferred, in which case a flush will have been scheduled.
+func (s *state) _batchTreeAnnouncements() bool {
+	if s._powerMode != PowerModeLowPower {
+		return false
+	}
+	if !s._announcePending {
+		s._announcePending = true
+		s.r.clock.AfterFunc(lowPowerBatchDelay, func() {
+			s.Act(nil, func() {
+				if s._announcePending {
+					s._flushTreeAnnouncements()
+				}
+			})
+		})
+	}
+	return true
+}
+
+// _flushTreeAnnouncements sends the batched tree announcements. Since the
+// announcements are generated at this point, only the latest state of the
+// tree is sent, no matter how many times it changed in the meantime.
+func (s *state) _flushTreeAnnouncements() {
+	s._announcePending = false
+	s._sendTreeAnnouncementsNow()
+}
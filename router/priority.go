@@ -0,0 +1,83 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import "github.com/matrix-org/pinecone/types"
+
+// By default the fair queue for each peering shares the link out between
+// flows without caring where they came from, so a personal device that
+// relays a lot of traffic for the mesh can find its own traffic waiting
+// behind it. With RouterOptionTrafficPriority, the traffic that we sent
+// ourselves and the traffic that we are forwarding for other nodes are
+// kept in separate fair queues within each traffic class, and one of them
+// gets more turns than the other while both have frames waiting. A node
+// that is only there to relay can prefer transit traffic instead. The
+// other side still gets a turn every so often, so that it isn't starved.
+
+// TrafficOrigin is where a traffic frame came from.
+type TrafficOrigin int
+
+const (
+	// TrafficOriginAny gives no preference to either origin.
+	TrafficOriginAny TrafficOrigin = iota
+	// TrafficOriginLocal is the traffic that we sent ourselves.
+	TrafficOriginLocal
+	// TrafficOriginTransit is the traffic that we are forwarding for other
+	// nodes.
+	TrafficOriginTransit
+)
+
+func (o TrafficOrigin) String() string {
+	switch o {
+	case TrafficOriginAny:
+		return "any"
+	case TrafficOriginLocal:
+		return "local"
+	case TrafficOriginTransit:
+		return "transit"
+	default:
+		return "unknown"
+	}
+}
+
+// trafficPriority is the preference given by RouterOptionTrafficPriority.
+// It is shared by the traffic queues of all peerings and not mutated after
+// the router is created.
+type trafficPriority struct {
+	local  types.PublicKey
+	prefer TrafficOrigin
+	weight int
+}
+
+func newTrafficPriority(local types.PublicKey, o RouterOptionTrafficPriority) *trafficPriority {
+	if o.Prefer != TrafficOriginLocal && o.Prefer != TrafficOriginTransit {
+		return nil
+	}
+	weight := o.Weight
+	if weight <= 0 {
+		weight = trafficPriorityWeight
+	}
+	return &trafficPriority{
+		local:  local,
+		prefer: o.Prefer,
+		weight: weight,
+	}
+}
+
+// preferred returns true if the frame came from the preferred origin.
+func (t *trafficPriority) preferred(frame *types.Frame) bool {
+	local := frame.SourceKey == t.local
+	return local == (t.prefer == TrafficOriginLocal)
+}
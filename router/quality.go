@@ -0,0 +1,180 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+// MaxPeerQuality is the best possible quality score for a peering. Scores
+// fall towards zero as the peering shows signs of being lossy, jittery or
+// misbehaving.
+const MaxPeerQuality = 100
+
+// peerQualityInputs are the raw measurements that feed into a quality score.
+type peerQualityInputs struct {
+	queued            uint64        // frames queued to the peer
+	dropped           uint64        // frames dropped on the way to the peer
+	writeJitter       time.Duration // mean deviation in the time taken to write
+	handshakeFailures uint64        // attributable handshake failures for the key
+	malformed         uint64        // recent malformed frames received from the peer
+}
+
+// score turns the measurements into a quality score between zero and
+// MaxPeerQuality. Each factor can only take away a limited amount, so that
+// a single bad measurement isn't enough to condemn a peering on its own.
+func (i peerQualityInputs) score() int {
+	score := MaxPeerQuality
+	if i.queued > 0 {
+		score -= int(40 * i.dropped / i.queued)
+	}
+	if jitter := int(i.writeJitter / (time.Millisecond * 10)); jitter < 20 {
+		score -= jitter
+	} else {
+		score -= 20
+	}
+	if penalty := int(i.handshakeFailures) * 10; penalty < 20 {
+		score -= penalty
+	} else {
+		score -= 20
+	}
+	if penalty := int(i.malformed) * 5; penalty < 40 {
+		score -= penalty
+	} else {
+		score -= 40
+	}
+	if score < 0 {
+		score = 0
+	}
+	return score
+}
+
+// _recordWriteTime updates the running write time estimates for the peer,
+// using the same smoothing as TCP uses for RTT estimates. This function
+// must be called from the peer's writer actor only.
+func (p *peer) _recordWriteTime(d time.Duration) {
+	if p._writeTime == 0 {
+		p._writeTime = d
+		p.statistics.writeJitter.Store(d / 2)
+		return
+	}
+	delta := d - p._writeTime
+	if delta < 0 {
+		delta = -delta
+	}
+	jitter := p.statistics.writeJitter.Load()
+	p.statistics.writeJitter.Store(jitter + (delta-jitter)/4)
+	p._writeTime += (d - p._writeTime) / 8
+}
+
+// quality returns the current quality score for the peer. It is safe to
+// call from other actors but must be given the handshake failure count,
+// which is owned by the state actor.
+func (p *peer) quality(handshakeFailures uint64) int {
+	inputs := peerQualityInputs{
+		handshakeFailures: handshakeFailures,
+		queued:            p.statistics.queued.Load(),
+		dropped:           p.statistics.dropped.Load(),
+		writeJitter:       p.statistics.writeJitter.Load(),
+		malformed:         p.statistics.recentMalformed.Load(),
+	}
+	if q, ok := p.traffic.(*fairFIFOQueue); ok {
+		// The fair queue doesn't refuse frames but drops from the head
+		// when full, so those drops have to be counted separately.
+		total, dropped := q.stats()
+		inputs.queued += total
+		inputs.dropped += dropped
+	}
+	return inputs.score()
+}
+
+// _recordHandshakeFailure notes that a node with a verified key failed to
+// complete the peering handshake with us. Failures for new keys aren't
+// counted while we are already counting failures for too many keys.
+func (s *state) _recordHandshakeFailure(public types.PublicKey) {
+	if _, ok := s._handshakeFailures[public]; !ok && len(s._handshakeFailures) >= handshakeFailureMaxKeys {
+		return
+	}
+	s._handshakeFailures[public]++
+}
+
+// _decayHandshakeFailures halves the handshake failure counts once every
+// handshakeFailureDecayInterval, so that old failures stop counting against
+// a peer and keys that stop failing are eventually forgotten.
+func (s *state) _decayHandshakeFailures() {
+	if since(s.r.clock, s._handshakeDecay) < handshakeFailureDecayInterval {
+		return
+	}
+	s._handshakeDecay = s.r.clock.Now()
+	for public, count := range s._handshakeFailures {
+		if count /= 2; count == 0 {
+			delete(s._handshakeFailures, public)
+		} else {
+			s._handshakeFailures[public] = count
+		}
+	}
+}
+
+// _maintainPeerQuality recalculates the quality scores of all peerings and,
+// if pruning is enabled, demotes or disconnects the chronically bad ones.
+func (s *state) _maintainPeerQuality() {
+	if s._suspended {
+		// Resume will restart maintenance.
+		return
+	}
+	select {
+	case <-s.r.context.Done():
+		return
+	default:
+		defer s._qualityTimer.Reset(s._peerQualityInterval())
+	}
+
+	s._expireRTTs()
+	s._expirePathStats()
+	s._decayHandshakeFailures()
+	reparent := false
+	for _, p := range s._peers {
+		if p == nil || p == s.r.local || !p.started.Load() {
+			continue
+		}
+		s._probePeerRTT(p)
+		score := p.quality(s._handshakeFailures[p.public])
+		p.decayMalformed()
+		if !s.r.pruning {
+			continue
+		}
+		switch {
+		case score < peerQualityDisconnectThreshold:
+			p.stop(fmt.Errorf("peer quality score %d too low", score))
+		case score < peerQualityDemoteThreshold:
+			if !p._demoted {
+				s.r.log.Println("Demoting peer", p.public.String(), "on port", p.port, "with quality score", score)
+			}
+			p._demoted = true
+			reparent = reparent || p == s._parent
+		default:
+			p._demoted = false
+		}
+	}
+	if reparent && s._selectNewParent() {
+		s._bootstrapSoon()
+	}
+}
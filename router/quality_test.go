@@ -0,0 +1,86 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestPeerQualityScore(t *testing.T) {
+	tests := []struct {
+		name   string
+		inputs peerQualityInputs
+		score  int
+	}{
+		{"perfect", peerQualityInputs{queued: 100}, MaxPeerQuality},
+		{"half loss", peerQualityInputs{queued: 100, dropped: 50}, 80},
+		{"jitter", peerQualityInputs{writeJitter: 50 * time.Millisecond}, 95},
+		{"jitter capped", peerQualityInputs{writeJitter: time.Minute}, 80},
+		{"handshakes", peerQualityInputs{handshakeFailures: 5}, 80},
+		{"malformed", peerQualityInputs{malformed: 3}, 85},
+		{"everything", peerQualityInputs{
+			queued: 10, dropped: 10, writeJitter: time.Minute,
+			handshakeFailures: 10, malformed: 100,
+		}, 0},
+	}
+	for _, test := range tests {
+		if score := test.inputs.score(); score != test.score {
+			t.Fatalf("%s: expected score %d, got %d", test.name, test.score, score)
+		}
+	}
+}
+
+func TestHandshakeFailureDecay(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	s := newTestState(types.PublicKey{}, clock)
+	s._handshakeDecay = clock.Now()
+	s._recordHandshakeFailure(types.PublicKey{1})
+	s._recordHandshakeFailure(types.PublicKey{1})
+	s._recordHandshakeFailure(types.PublicKey{1})
+	s._recordHandshakeFailure(types.PublicKey{2})
+
+	// Nothing decays until the interval has passed.
+	s._decayHandshakeFailures()
+	if len(s._handshakeFailures) != 2 {
+		t.Fatalf("expected no decay yet, got %v", s._handshakeFailures)
+	}
+	clock.Advance(handshakeFailureDecayInterval)
+	s._decayHandshakeFailures()
+	if n, ok := s._handshakeFailures[types.PublicKey{1}]; !ok || n != 1 || len(s._handshakeFailures) != 1 {
+		t.Fatalf("expected the counts to be halved, got %v", s._handshakeFailures)
+	}
+	clock.Advance(handshakeFailureDecayInterval)
+	s._decayHandshakeFailures()
+	if len(s._handshakeFailures) != 0 {
+		t.Fatalf("expected the failures to be forgotten, got %v", s._handshakeFailures)
+	}
+
+	// Failures for new keys aren't counted once the table is full, but
+	// failures for keys that are already there still are.
+	for i := 0; i < handshakeFailureMaxKeys; i++ {
+		var public types.PublicKey
+		binary.BigEndian.PutUint32(public[:], uint32(i))
+		s._recordHandshakeFailure(public)
+	}
+	s._recordHandshakeFailure(types.PublicKey{0xff})
+	s._recordHandshakeFailure(types.PublicKey{})
+	if len(s._handshakeFailures) != handshakeFailureMaxKeys || s._handshakeFailures[types.PublicKey{}] != 2 {
+		t.Fatalf("expected the table to be capped")
+	}
+}
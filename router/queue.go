@@ -21,6 +21,7 @@ type queue interface {
 	queuesize() int
 	push(frame *types.Frame) bool
 	pop() <-chan *types.Frame
-	ack()
+	ack(frame *types.Frame)
 	reset()
+	queueStats() QueueStats
 }
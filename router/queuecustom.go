@@ -0,0 +1,291 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+// The traffic queue of each peering decides which of the traffic frames
+// that are waiting for the peering is sent next, and which are dropped when
+// there are too many. By default this is a fair queue, which shares the
+// peering out between flows and traffic classes, but embedders can supply
+// their own with RouterOptionTrafficScheduler, i.e. to try out different
+// queueing strategies without having to change the router. Only traffic is
+// affected. Control and protocol frames still have their own queues and are
+// always sent ahead of traffic in the same way, so that a queue can't stop
+// the network from working, and the memory budget, queue statistics and
+// egress limits still apply to traffic as normal.
+//
+// Queues are given each frame along with the details that they are most
+// likely to want to order frames by. The router takes frames from the queue
+// one at a time as it is ready to write them to the peering, although it
+// may take the next frame a little before the previous one has been
+// written.
+
+// QueuedFrame is a traffic frame in a Queue.
+type QueuedFrame struct {
+	Frame       *types.Frame       // The frame itself, which must not be changed
+	Source      types.PublicKey    // The node that sent the frame
+	Destination types.PublicKey    // The node that the frame is for
+	Class       types.TrafficClass // The traffic class of the frame
+	Size        int                // Size of the payload in bytes
+	Queued      time.Time          // When the frame was pushed
+}
+
+// Queue holds the traffic frames that are waiting to be sent on a peering.
+// All of the methods must be safe to call from different goroutines.
+type Queue interface {
+	// Push adds a frame to the queue. It returns any frames that were
+	// dropped instead of being queued, which can include the pushed frame
+	// itself, i.e. if the queue is full.
+	Push(frame QueuedFrame) (dropped []QueuedFrame)
+	// Pop removes the frame that should be sent next and returns it, or
+	// returns false if there isn't one ready to send.
+	Pop() (QueuedFrame, bool)
+	// Wait returns a channel that receives a value when a frame may have
+	// become ready to send, i.e. when a frame is pushed. The channel should
+	// be buffered so that pushes don't block, and must not be closed.
+	Wait() <-chan struct{}
+	// Reset drops all of the frames in the queue.
+	Reset()
+	// Len returns the number of frames in the queue.
+	Len() int
+}
+
+// QueuePeer describes the peering that a Queue is for.
+type QueuePeer struct {
+	Port      types.SwitchPortID
+	PublicKey types.PublicKey
+	PeerType  ConnectionPeerType
+	Zone      ConnectionZone
+}
+
+// TrafficScheduler creates the traffic queue for each new peering.
+type TrafficScheduler interface {
+	NewQueue(peer QueuePeer) Queue
+}
+
+// FIFOTrafficScheduler creates queues that send traffic frames in the order
+// that they were pushed, dropping new frames once Size frames are queued.
+// It is mostly useful as a starting point for other queues.
+type FIFOTrafficScheduler struct {
+	Size int
+}
+
+func (s FIFOTrafficScheduler) NewQueue(_ QueuePeer) Queue {
+	return &fifoTrafficQueue{
+		size:   s.Size,
+		notify: make(chan struct{}, 1),
+	}
+}
+
+type fifoTrafficQueue struct {
+	mutex  sync.Mutex
+	size   int
+	frames []QueuedFrame
+	notify chan struct{}
+}
+
+func (q *fifoTrafficQueue) Push(frame QueuedFrame) []QueuedFrame {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if len(q.frames) >= q.size {
+		return []QueuedFrame{frame}
+	}
+	q.frames = append(q.frames, frame)
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (q *fifoTrafficQueue) Pop() (QueuedFrame, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if len(q.frames) == 0 {
+		return QueuedFrame{}, false
+	}
+	frame := q.frames[0]
+	q.frames[0] = QueuedFrame{}
+	q.frames = q.frames[1:]
+	return frame, true
+}
+
+func (q *fifoTrafficQueue) Wait() <-chan struct{} {
+	return q.notify
+}
+
+func (q *fifoTrafficQueue) Reset() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.frames = nil
+}
+
+func (q *fifoTrafficQueue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.frames)
+}
+
+// customQueue lets a Queue supplied by the embedder be used as the traffic
+// queue of a peering. The frame that will be sent next is taken from the
+// Queue as soon as there is room for it in the channel returned by pop, and
+// goes back to the frame pool if the queue is reset before it is sent.
+type customQueue struct {
+	queue   Queue
+	next    chan *types.Frame
+	mutex   sync.Mutex
+	monitor queueMonitor
+}
+
+// newCustomQueue wraps the queue, taking frames from it whenever it says
+// that they are ready until the context ends.
+func newCustomQueue(ctx context.Context, queue Queue, clock Clock) *customQueue {
+	q := &customQueue{
+		queue:   queue,
+		next:    make(chan *types.Frame, 1),
+		monitor: queueMonitor{clock: clock},
+	}
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-queue.Wait():
+				q.mutex.Lock()
+				q._fill()
+				q.mutex.Unlock()
+			}
+		}
+	}()
+	return q
+}
+
+// withBudget keeps the queue within the given share of the memory budget.
+// The share can be nil.
+func (q *customQueue) withBudget(budget *peerBudget) *customQueue {
+	q.monitor.budget = budget
+	return q
+}
+
+// _fill takes the next frame from the queue if there isn't one waiting to
+// be sent already. The queue mutex must be held.
+func (q *customQueue) _fill() {
+	if len(q.next) > 0 {
+		return
+	}
+	if frame, ok := q.queue.Pop(); ok {
+		q.next <- frame.Frame
+	}
+}
+
+func (q *customQueue) queuecount() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.queue.Len() + len(q.next)
+}
+
+func (q *customQueue) queuesize() int {
+	// The size of the queue is up to the embedder.
+	return 0
+}
+
+func (q *customQueue) push(frame *types.Frame) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if !q.monitor._reserve(frame) {
+		q.monitor._refused()
+		q.monitor._overBudget()
+		return false
+	}
+	q.monitor._pushed(frame)
+	queued := true
+	dropped := q.queue.Push(QueuedFrame{
+		Frame:       frame,
+		Source:      frame.SourceKey,
+		Destination: frame.DestinationKey,
+		Class:       frame.TrafficClass(),
+		Size:        len(frame.Payload),
+		Queued:      q.monitor.now(),
+	})
+	for _, d := range dropped {
+		q.monitor._removed(d.Frame, true)
+		if d.Frame == frame {
+			// The caller puts the frame back in the pool.
+			queued = false
+		} else {
+			framePool.Put(d.Frame)
+		}
+	}
+	q._fill()
+	return queued
+}
+
+func (q *customQueue) pop() <-chan *types.Frame {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q._fill()
+	return q.next
+}
+
+func (q *customQueue) ack(frame *types.Frame) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.monitor._removed(frame, false)
+	q._fill()
+}
+
+func (q *customQueue) reset() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.queue.Reset()
+	select {
+	case frame := <-q.next:
+		framePool.Put(frame)
+	default:
+	}
+	q.monitor._reset()
+}
+
+func (q *customQueue) queueStats() QueueStats {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.monitor._stats
+}
+
+func (q *customQueue) MarshalJSON() ([]byte, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return json.Marshal(struct {
+		Count         int    `json:"count"`
+		Bytes         uint64 `json:"bytes"`
+		HighWatermark int    `json:"high_watermark"`
+		Dropped       uint64 `json:"packets_dropped"`
+		LongestDelay  string `json:"longest_delay"`
+	}{
+		Count:         q.queue.Len() + len(q.next),
+		Bytes:         q.monitor._stats.Bytes,
+		HighWatermark: q.monitor._stats.HighWatermark,
+		Dropped:       q.monitor._stats.Dropped,
+		LongestDelay:  q.monitor._stats.LongestDelay.String(),
+	})
+}
@@ -0,0 +1,144 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestCustomQueue(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	q := newCustomQueue(ctx, FIFOTrafficScheduler{Size: 2}.NewQueue(QueuePeer{}), nil)
+
+	frames := make([]*types.Frame, 4)
+	for i := range frames {
+		frames[i] = &types.Frame{Type: types.TypeTraffic, DestinationKey: types.PublicKey{byte(i)}}
+	}
+	// One frame is taken from the queue straight away, ready to be sent,
+	// so there is room for two more behind it.
+	for i, f := range frames[:3] {
+		if !q.push(f) {
+			t.Fatalf("frame %d should have been queued", i)
+		}
+	}
+	if q.push(frames[3]) {
+		t.Fatalf("frame should have been dropped from the full queue")
+	}
+	if stats := q.queueStats(); stats.Depth != 3 || stats.Dropped != 1 || q.queuecount() != 3 {
+		t.Fatalf("expected 3 frames queued and 1 dropped, got %+v", stats)
+	}
+	for i, expected := range frames[:3] {
+		select {
+		case f := <-q.pop():
+			if f != expected {
+				t.Fatalf("frame %d was sent out of order", i)
+			}
+			q.ack(f)
+		default:
+			t.Fatalf("frame %d wasn't ready to send", i)
+		}
+	}
+	if stats := q.queueStats(); stats.Depth != 0 || q.queuecount() != 0 {
+		t.Fatalf("expected the queue to be empty, got %+v", stats)
+	}
+
+	q.push(getFrame())
+	q.push(getFrame())
+	q.reset()
+	if q.queuecount() != 0 || q.queueStats().Depth != 0 {
+		t.Fatalf("expected the queue to be empty after a reset")
+	}
+}
+
+type recordingScheduler struct {
+	mutex  sync.Mutex
+	peers  []QueuePeer
+	pushed []QueuedFrame
+}
+
+func (s *recordingScheduler) NewQueue(peer QueuePeer) Queue {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.peers = append(s.peers, peer)
+	return &recordingQueue{FIFOTrafficScheduler{Size: 16}.NewQueue(peer), s}
+}
+
+type recordingQueue struct {
+	Queue
+	scheduler *recordingScheduler
+}
+
+func (q *recordingQueue) Push(frame QueuedFrame) []QueuedFrame {
+	q.scheduler.mutex.Lock()
+	q.scheduler.pushed = append(q.scheduler.pushed, frame)
+	q.scheduler.mutex.Unlock()
+	return q.Queue.Push(frame)
+}
+
+func TestTrafficScheduler(t *testing.T) {
+	scheduler := &recordingScheduler{}
+	_, sk1, _ := ed25519.GenerateKey(nil)
+	_, sk2, _ := ed25519.GenerateKey(nil)
+	a := NewRouter(nil, sk1, RouterOptionTrafficScheduler{Scheduler: scheduler})
+	b := NewRouter(nil, sk2)
+	t.Cleanup(func() {
+		_ = a.Close()
+		_ = b.Close()
+	})
+	if errA, errB := connectTestRouters(t, a, b); errA != nil || errB != nil {
+		t.Fatalf("failed to peer: %v, %v", errA, errB)
+	}
+	deadline := time.Now().Add(time.Second * 10)
+	for len(a.Coords()) == 0 && len(b.Coords()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("tree didn't converge")
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+
+	sent := []byte("HELLO!")
+	if _, err := a.WriteToWithClass(sent, b.PublicKey(), types.TrafficClassInteractive); err != nil {
+		t.Fatal(err)
+	}
+	_ = b.SetReadDeadline(time.Now().Add(time.Second * 5))
+	received := make([]byte, 64)
+	n, _, err := b.ReadFrom(received)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received[:n], sent) {
+		t.Fatalf("payload doesn't match")
+	}
+
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	if len(scheduler.peers) != 1 || scheduler.peers[0].PublicKey != b.PublicKey() {
+		t.Fatalf("expected a queue for the peering with %s, got %+v", b.PublicKey(), scheduler.peers)
+	}
+	if len(scheduler.pushed) != 1 {
+		t.Fatalf("expected one frame to be pushed, got %d", len(scheduler.pushed))
+	}
+	if f := scheduler.pushed[0]; f.Source != a.PublicKey() || f.Destination != b.PublicKey() || f.Class != types.TrafficClassInteractive || f.Size != len(sent) {
+		t.Fatalf("frame was pushed with the wrong details: %+v", f)
+	}
+}
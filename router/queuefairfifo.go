@@ -24,28 +24,79 @@ import (
 
 const fairFIFOQueueSize = 16
 
+// Each traffic class has its own set of fair queues. Classes are served by
+// weighted round robin in priority order, so that more urgent classes get a
+// bigger share of the link without starving the others completely.
+var trafficClassPriority = []types.TrafficClass{
+	types.TrafficClassControl,
+	types.TrafficClassInteractive,
+	types.TrafficClassBulk,
+	types.TrafficClassBackground,
+}
+
+var trafficClassWeights = [types.TrafficClasses]int{
+	types.TrafficClassControl:     8,
+	types.TrafficClassInteractive: 4,
+	types.TrafficClassBulk:        2,
+	types.TrafficClassBackground:  1,
+}
+
+// TrafficClassStats contains the counters for a single traffic class.
+type TrafficClassStats struct {
+	Class   types.TrafficClass
+	Queued  int
+	Sent    uint64
+	Dropped uint64
+}
+
 type fairFIFOQueue struct {
 	log     types.Logger
-	queues  map[uint16]chan *types.Frame // queue ID -> frame, map for randomness
-	num     uint16                       // how many queues should we have?
-	count   int                          // how many queued items in total?
-	n       uint16                       // which queue did we last iterate on?
-	offset  uint64                       // adds an element of randomness to queue assignment
-	total   uint64                       // how many packets handled?
-	dropped uint64                       // how many packets dropped?
+	queues  map[uint32]chan *types.Frame            // queue ID -> frame, map for randomness
+	num     uint16                                  // how many queues should we have per class?
+	count   int                                     // how many queued items in total?
+	n       [types.TrafficClasses]uint16            // which queue did we last iterate on per class?
+	offset  uint64                                  // adds an element of randomness to queue assignment
+	total   uint64                                  // how many packets handled?
+	dropped uint64                                  // how many packets dropped?
+	classes [types.TrafficClasses]TrafficClassStats // counters for each traffic class
+	credits [types.TrafficClasses]int               // how many frames can each class still send this round?
+	prefer  *trafficPriority                        // which origin gets more turns, if set
+	turns   int                                     // how many more frames can the preferred origin send in a row?
 	mutex   sync.Mutex
+	monitor queueMonitor
 }
 
-func newFairFIFOQueue(num uint16, log types.Logger) *fairFIFOQueue {
+func newFairFIFOQueue(num uint16, log types.Logger, clock Clock) *fairFIFOQueue {
 	q := &fairFIFOQueue{
-		log:    log,
-		offset: rand.Uint64(),
-		num:    num,
+		log:     log,
+		offset:  rand.Uint64(),
+		num:     num,
+		monitor: queueMonitor{clock: clock},
+	}
+	for class := range q.classes {
+		q.classes[class].Class = types.TrafficClass(class)
 	}
 	q.reset()
 	return q
 }
 
+// withBudget keeps the queue within the given share of the memory budget.
+// The share can be nil.
+func (q *fairFIFOQueue) withBudget(budget *peerBudget) *fairFIFOQueue {
+	q.monitor.budget = budget
+	return q
+}
+
+// withPriority gives more turns to the traffic from one origin. The
+// priority can be nil.
+func (q *fairFIFOQueue) withPriority(prefer *trafficPriority) *fairFIFOQueue {
+	q.prefer = prefer
+	if prefer != nil {
+		q.turns = prefer.weight
+	}
+	return q
+}
+
 func (q *fairFIFOQueue) queuecount() int { // nolint:unused
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
@@ -73,37 +124,107 @@ func (q *fairFIFOQueue) hash(frame *types.Frame) uint16 {
 	return uint16(h % uint64(q.num))
 }
 
+// id returns the queue ID for the given hash within a traffic class. The
+// frames that aren't from the preferred origin have a set of queues of their
+// own after those of all of the classes. Queue ID 0 is reserved for the
+// first frame that arrives when the queue is empty.
+func (q *fairFIFOQueue) id(class types.TrafficClass, other bool, h uint16) uint32 {
+	id := uint32(class)*uint32(q.num) + uint32(h) + 1
+	if other {
+		id += uint32(types.TrafficClasses) * uint32(q.num)
+	}
+	return id
+}
+
+// other returns true if the frame isn't from the preferred origin. It is
+// always false if no origin is preferred.
+func (q *fairFIFOQueue) other(frame *types.Frame) bool {
+	return q.prefer != nil && !q.prefer.preferred(frame)
+}
+
+// queue returns the queue with the given ID, creating it if needed, so that
+// we only allocate the queues that are actually used.
+func (q *fairFIFOQueue) queue(id uint32) chan *types.Frame {
+	queue, ok := q.queues[id]
+	if !ok {
+		queue = make(chan *types.Frame, fairFIFOQueueSize)
+		q.queues[id] = queue
+	}
+	return queue
+}
+
 func (q *fairFIFOQueue) push(frame *types.Frame) bool {
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
-	var h uint16
+	class := frame.TrafficClass()
+	reserved := q.monitor._reserve(frame)
+	for !reserved && q.dropLongest() {
+		reserved = q.monitor._reserve(frame)
+	}
+	if !reserved {
+		q.monitor._refused()
+		q.monitor._overBudget()
+		q.classes[class].Dropped++
+		q.dropped++
+		return false
+	}
+	var id uint32
 	if q.count > 0 {
-		h = q.hash(frame) + 1
+		id = q.id(class, q.other(frame), q.hash(frame))
 	}
 	select {
-	case q.queues[h] <- frame:
+	case q.queue(id) <- frame:
 		// There is space in the queue
 		q.count++
 	default:
 		// The queue is full - perform a head drop
-		<-q.queues[h]
+		head := <-q.queues[id]
+		q.monitor._removed(head, true)
+		q.classes[head.TrafficClass()].Queued--
+		q.classes[head.TrafficClass()].Dropped++
 		q.dropped++
 		if q.count-1 == 0 {
-			h = 0
+			id = 0
 		}
-		q.queues[h] <- frame
+		q.queue(id) <- frame
 	}
+	q.classes[class].Queued++
+	q.monitor._pushed(frame)
 	q.total++
 	return true
 }
 
+// dropLongest drops the frame at the head of the longest queue, which is
+// the oldest frame of the busiest flow, to make room within the memory
+// budget. It returns false if there was nothing to drop. The queue mutex
+// must be held.
+func (q *fairFIFOQueue) dropLongest() bool {
+	var longest uint32
+	max := 0
+	for id, queue := range q.queues {
+		if len(queue) > max {
+			longest, max = id, len(queue)
+		}
+	}
+	if max == 0 {
+		return false
+	}
+	head := <-q.queues[longest]
+	q.monitor._removed(head, true)
+	q.monitor._overBudget()
+	q.classes[head.TrafficClass()].Queued--
+	q.classes[head.TrafficClass()].Dropped++
+	q.dropped++
+	q.count--
+	return true
+}
+
 func (q *fairFIFOQueue) reset() {
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
-	q.queues = make(map[uint16]chan *types.Frame, q.num+1)
-	for i := uint16(0); i <= q.num; i++ {
-		q.queues[i] = make(chan *types.Frame, fairFIFOQueueSize)
-	}
+	q.queues = make(map[uint32]chan *types.Frame, int(q.num)+1)
+	q.queue(0)
+	q.monitor._reset()
 }
 
 func (q *fairFIFOQueue) pop() <-chan *types.Frame {
@@ -119,41 +240,109 @@ func (q *fairFIFOQueue) pop() <-chan *types.Frame {
 		// There's something in queue 0 waiting to be sent.
 		return q.queues[0]
 	default:
-		// Select the next queue that has something waiting.
-		for i := uint16(0); i <= q.num; i++ {
-			if q.n = (q.n + 1) % (q.num + 1); q.n == 0 {
-				continue
+		// Select the next queue that has something waiting in the
+		// class that is due to send next, from the preferred origin
+		// first unless it has used up its turns.
+		class := q.nextClass()
+		origins := [...]bool{false, true}
+		if q.prefer != nil && q.turns == 0 {
+			origins[0], origins[1] = origins[1], origins[0]
+		}
+		for _, other := range origins {
+			for i := uint16(0); i < q.num; i++ {
+				q.n[class] = (q.n[class] + 1) % q.num
+				if queue := q.queues[q.id(class, other, q.n[class])]; len(queue) > 0 {
+					return queue
+				}
 			}
-			if queue := q.queues[q.n]; len(queue) > 0 {
-				return queue
+		}
+	}
+	// We shouldn't ever arrive here.
+	panic("invalid queue state")
+}
+
+// nextClass returns the most urgent traffic class that has frames waiting
+// and that hasn't used up its share of the current round.
+func (q *fairFIFOQueue) nextClass() types.TrafficClass {
+	for round := 0; round < 2; round++ {
+		for _, class := range trafficClassPriority {
+			if q.classes[class].Queued > 0 && q.credits[class] > 0 {
+				return class
 			}
 		}
+		// All of the classes that have frames waiting have used up their
+		// share, so start a new round.
+		q.credits = trafficClassWeights
 	}
 	// We shouldn't ever arrive here.
 	panic("invalid queue state")
 }
 
-func (q *fairFIFOQueue) ack() {
+// stats returns how many frames have been pushed into the queue and how
+// many of those were dropped.
+func (q *fairFIFOQueue) stats() (total, dropped uint64) {
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
+	return q.total, q.dropped
+}
+
+func (q *fairFIFOQueue) ack(frame *types.Frame) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.monitor._removed(frame, false)
 	q.count--
+	class := frame.TrafficClass()
+	q.classes[class].Queued--
+	q.classes[class].Sent++
+	if q.credits[class] > 0 {
+		q.credits[class]--
+	}
+	if q.other(frame) {
+		q.turns = q.prefer.weight
+	} else if q.turns > 0 {
+		q.turns--
+	}
+}
+
+// classStats returns the counters for each traffic class.
+func (q *fairFIFOQueue) classStats() []TrafficClassStats {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return append([]TrafficClassStats{}, q.classes[:]...)
+}
+
+func (q *fairFIFOQueue) queueStats() QueueStats {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.monitor._stats
 }
 
 func (q *fairFIFOQueue) MarshalJSON() ([]byte, error) {
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
 	res := struct {
-		Count   int            `json:"count"`
-		Size    int            `json:"size"`
-		Queues  map[uint16]int `json:"queues"`
-		Total   uint64         `json:"packets_total"`
-		Dropped uint64         `json:"packets_dropped"`
+		Count         int            `json:"count"`
+		Size          int            `json:"size"`
+		Queues        map[uint32]int `json:"queues"`
+		Total         uint64         `json:"packets_total"`
+		Dropped       uint64         `json:"packets_dropped"`
+		Bytes         uint64         `json:"bytes"`
+		HighWatermark int            `json:"high_watermark"`
+		LongestDelay  string         `json:"longest_delay"`
+		Classes       map[string]int `json:"classes"`
 	}{
-		Count:   q.count,
-		Size:    int(q.num) * fairFIFOQueueSize,
-		Queues:  map[uint16]int{},
-		Total:   q.total,
-		Dropped: q.dropped,
+		Count:         q.count,
+		Size:          int(q.num) * fairFIFOQueueSize,
+		Queues:        map[uint32]int{},
+		Total:         q.total,
+		Dropped:       q.dropped,
+		Bytes:         q.monitor._stats.Bytes,
+		HighWatermark: q.monitor._stats.HighWatermark,
+		LongestDelay:  q.monitor._stats.LongestDelay.String(),
+		Classes:       map[string]int{},
+	}
+	for _, class := range q.classes {
+		res.Classes[class.Class.String()] = class.Queued
 	}
 	for h, queue := range q.queues {
 		if c := len(queue); c > 0 {
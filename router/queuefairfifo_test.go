@@ -0,0 +1,110 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"testing"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestFairFIFOQueueTrafficClasses(t *testing.T) {
+	q := newFairFIFOQueue(4, nil, nil)
+	push := func(class types.TrafficClass, count int) {
+		for i := 0; i < count; i++ {
+			f := &types.Frame{Type: types.TypeTraffic}
+			f.SetTrafficClass(class)
+			q.push(f)
+		}
+	}
+	pop := func() types.TrafficClass {
+		f := <-q.pop()
+		q.ack(f)
+		return f.TrafficClass()
+	}
+
+	// The first frame goes into queue 0 and is sent first, whatever its
+	// class is.
+	push(types.TrafficClassBulk, 11)
+	push(types.TrafficClassInteractive, 10)
+	push(types.TrafficClassBackground, 5)
+	if class := pop(); class != types.TrafficClassBulk {
+		t.Fatalf("expected the first frame to be sent first, got %s", class)
+	}
+
+	// After that, each round sends frames in proportion to the weights of
+	// the classes, so that background traffic isn't starved.
+	sent := map[types.TrafficClass]int{}
+	for i := 0; i < 14; i++ {
+		sent[pop()]++
+	}
+	if sent[types.TrafficClassInteractive] != 8 || sent[types.TrafficClassBulk] != 4 || sent[types.TrafficClassBackground] != 2 {
+		t.Fatalf("unexpected share of frames sent: %v", sent)
+	}
+
+	stats := q.classStats()
+	if s := stats[types.TrafficClassBulk]; s.Sent != 5 || s.Queued != 6 {
+		t.Fatalf("unexpected bulk class counters: %+v", s)
+	}
+	if s := stats[types.TrafficClassInteractive]; s.Sent != 8 || s.Queued != 2 {
+		t.Fatalf("unexpected interactive class counters: %+v", s)
+	}
+}
+
+func TestFairFIFOQueueTrafficPriority(t *testing.T) {
+	var local, remote types.PublicKey
+	local[0], remote[0] = 1, 2
+	for _, prefer := range []TrafficOrigin{TrafficOriginLocal, TrafficOriginTransit} {
+		q := newFairFIFOQueue(4, nil, nil).withPriority(newTrafficPriority(local, RouterOptionTrafficPriority{
+			Prefer: prefer,
+			Weight: 3,
+		}))
+		push := func(source types.PublicKey, count int) {
+			for i := 0; i < count; i++ {
+				q.push(&types.Frame{Type: types.TypeTraffic, SourceKey: source})
+			}
+		}
+		pop := func() TrafficOrigin {
+			f := <-q.pop()
+			q.ack(f)
+			if f.SourceKey == local {
+				return TrafficOriginLocal
+			}
+			return TrafficOriginTransit
+		}
+
+		// The first frame goes into queue 0 and is sent first, wherever
+		// it came from.
+		other := TrafficOriginTransit
+		if prefer == TrafficOriginTransit {
+			other = TrafficOriginLocal
+		}
+		push(remote, 10)
+		push(local, 10)
+		if origin := pop(); origin != TrafficOriginTransit {
+			t.Fatalf("expected the first frame to be sent first, got %s", origin)
+		}
+
+		// After that, the preferred origin gets three turns for each
+		// turn of the other while both have frames waiting.
+		sent := map[TrafficOrigin]int{}
+		for i := 0; i < 8; i++ {
+			sent[pop()]++
+		}
+		if sent[prefer] != 6 || sent[other] != 2 {
+			t.Fatalf("preferring %s, unexpected share of frames sent: %v", prefer, sent)
+		}
+	}
+}
@@ -26,19 +26,28 @@ type fifoQueue struct {
 	max     int
 	entries []chan *types.Frame
 	mutex   sync.Mutex
+	monitor queueMonitor
 }
 
 const fifoNoMax = 0
 
-func newFIFOQueue(max int, log types.Logger) *fifoQueue {
+func newFIFOQueue(max int, log types.Logger, clock Clock) *fifoQueue {
 	q := &fifoQueue{
-		log: log,
-		max: max,
+		log:     log,
+		max:     max,
+		monitor: queueMonitor{clock: clock},
 	}
 	q.reset()
 	return q
 }
 
+// withBudget keeps the queue within the given share of the memory budget,
+// which it can go over if it is a protocol queue. The share can be nil.
+func (q *fifoQueue) withBudget(budget *peerBudget, protocol bool) *fifoQueue {
+	q.monitor.budget, q.monitor.protocol = budget, protocol
+	return q
+}
+
 func (q *fifoQueue) _initialise() {
 	for i := range q.entries {
 		q.entries[i] = nil
@@ -73,12 +82,19 @@ func (q *fifoQueue) push(frame *types.Frame) bool {
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
 	if q.max != 0 && len(q.entries)-1 >= q.max {
+		q.monitor._refused()
+		return false
+	}
+	if !q.monitor._reserve(frame) {
+		q.monitor._refused()
+		q.monitor._overBudget()
 		return false
 	}
 	ch := q.entries[len(q.entries)-1]
 	ch <- frame
 	close(ch)
 	q.entries = append(q.entries, make(chan *types.Frame, 1))
+	q.monitor._pushed(frame)
 	return true
 }
 
@@ -95,6 +111,7 @@ func (q *fifoQueue) reset() {
 		}
 	}
 	q._initialise()
+	q.monitor._reset()
 }
 
 func (q *fifoQueue) pop() <-chan *types.Frame {
@@ -103,23 +120,38 @@ func (q *fifoQueue) pop() <-chan *types.Frame {
 	return q.entries[0]
 }
 
-func (q *fifoQueue) ack() {
+func (q *fifoQueue) ack(frame *types.Frame) {
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
+	q.monitor._removed(frame, false)
 	q.entries = q.entries[1:]
 	if q.max == 0 && len(q.entries) == 0 {
 		q._initialise()
 	}
 }
 
+func (q *fifoQueue) queueStats() QueueStats {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.monitor._stats
+}
+
 func (q *fifoQueue) MarshalJSON() ([]byte, error) {
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
 	return json.Marshal(struct {
-		Count int `json:"count"`
-		Size  int `json:"size"`
+		Count         int    `json:"count"`
+		Size          int    `json:"size"`
+		Bytes         uint64 `json:"bytes"`
+		HighWatermark int    `json:"high_watermark"`
+		Dropped       uint64 `json:"packets_dropped"`
+		LongestDelay  string `json:"longest_delay"`
 	}{
-		Count: len(q.entries) - 1,
-		Size:  cap(q.entries),
+		Count:         len(q.entries) - 1,
+		Size:          cap(q.entries),
+		Bytes:         q.monitor._stats.Bytes,
+		HighWatermark: q.monitor._stats.HighWatermark,
+		Dropped:       q.monitor._stats.Dropped,
+		LongestDelay:  q.monitor._stats.LongestDelay.String(),
 	})
 }
@@ -2,12 +2,13 @@ package router
 
 import (
 	"testing"
+	"time"
 
 	"github.com/matrix-org/pinecone/types"
 )
 
 func TestLimitedFIFO(t *testing.T) {
-	q := newFIFOQueue(5, nil)
+	q := newFIFOQueue(5, nil, nil)
 
 	// the actual allocated queue size will be 1 more than the
 	// supplied, so that when we push an entry and assign the
@@ -33,3 +34,44 @@ func TestLimitedFIFO(t *testing.T) {
 		t.Fatalf("expected final queue size to be 6 but it was %d", s)
 	}
 }
+
+func TestFIFOQueueStats(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	q := newFIFOQueue(3, nil, clock)
+	for i := 0; i < 4; i++ {
+		q.push(&types.Frame{Payload: make([]byte, 100)})
+	}
+	stats := q.queueStats()
+	if stats.Depth != 3 || stats.Bytes != 300 {
+		t.Fatalf("expected 3 frames and 300 bytes queued, got %d frames and %d bytes", stats.Depth, stats.Bytes)
+	}
+	if stats.Dropped != 1 {
+		t.Fatalf("expected 1 frame to be dropped, got %d", stats.Dropped)
+	}
+
+	clock.Advance(time.Millisecond * 10)
+	for i := 0; i < 3; i++ {
+		q.ack(<-q.pop())
+	}
+	stats = q.queueStats()
+	if stats.Depth != 0 || stats.Bytes != 0 {
+		t.Fatalf("expected empty queue, got %d frames and %d bytes", stats.Depth, stats.Bytes)
+	}
+	if stats.HighWatermark != 3 || stats.HighWatermarkBytes != 300 {
+		t.Fatalf("expected high watermark of 3 frames and 300 bytes, got %d frames and %d bytes", stats.HighWatermark, stats.HighWatermarkBytes)
+	}
+	if stats.LongestDelay != time.Millisecond*10 {
+		t.Fatalf("expected longest delay of 10ms, got %s", stats.LongestDelay)
+	}
+
+	// Only some of the frames are timed, but a frame that waits for longer
+	// than the others will be noticed eventually.
+	for i := 0; i < queueDelaySampleInterval*2; i++ {
+		q.push(&types.Frame{Payload: make([]byte, 100)})
+		clock.Advance(time.Millisecond * 20)
+		q.ack(<-q.pop())
+	}
+	if stats = q.queueStats(); stats.LongestDelay != time.Millisecond*20 || stats.Depth != 0 || stats.Bytes != 0 {
+		t.Fatalf("expected longest delay of 20ms, got %+v", stats)
+	}
+}
@@ -79,7 +79,7 @@ func (q *lifoQueue) pop() (*types.Frame, bool) { // nolint:unused
 	return frame, true
 }
 
-func (q *lifoQueue) ack() { // nolint:unused
+func (q *lifoQueue) ack(frame *types.Frame) { // nolint:unused
 	// no-op on this queue type
 }
 
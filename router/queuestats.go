@@ -0,0 +1,216 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"time"
+
+	"github.com/matrix-org/pinecone/router/events"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races. The queue
+// monitor functions must be called with the queue mutex held instead.
+
+// QueueStats contains statistics about one of the outbound queues of a
+// peering. Byte counts only include frame payloads.
+type QueueStats struct {
+	Depth              int           // Frames currently queued
+	Bytes              uint64        // Bytes currently queued
+	HighWatermark      int           // Most frames that have been queued at once
+	HighWatermarkBytes uint64        // Most bytes that have been queued at once
+	Dropped            uint64        // Frames dropped because the queue was full
+	LongestDelay       time.Duration // Longest time that a sampled frame has spent queued
+}
+
+// queueMonitor keeps the statistics for a queue, and keeps the queue within
+// its share of the memory budget if there is one. The monitor is called for
+// every frame that passes through the queue, so it only does arithmetic for
+// most of them. Reading the clock is comparatively expensive, so only one
+// frame in every queueDelaySampleInterval is timed, and only one at a time.
+type queueMonitor struct {
+	clock     Clock       // Used to time how long frames are queued, nil for real time
+	budget    *peerBudget // The share of the memory budget, nil if there isn't one
+	protocol  bool        // Can the queue go over its share of the budget?
+	_memory   uint64      // Taken from the memory budget by the queued frames
+	_pushes   uint64      // Frames queued so far, used to pick frames to time
+	_sampled  *types.Frame
+	_sampleAt time.Time // When _sampled was queued
+	_stats    QueueStats
+}
+
+func (m *queueMonitor) now() time.Time {
+	if m.clock == nil {
+		return time.Now()
+	}
+	return m.clock.Now()
+}
+
+// _reserve takes the memory for the frame from the budget, returning false
+// if it doesn't fit. It must be followed by _pushed if it succeeds.
+func (m *queueMonitor) _reserve(frame *types.Frame) bool {
+	return m.budget == nil || m.budget.reserve(frameMemory(frame), m.protocol)
+}
+
+// _overBudget records that a frame was dropped or refused to keep within
+// the memory budget.
+func (m *queueMonitor) _overBudget() {
+	m.budget.budget.dropped.Inc()
+}
+
+// _pushed records that a frame has been queued.
+func (m *queueMonitor) _pushed(frame *types.Frame) {
+	if m._sampled == nil && m._pushes%queueDelaySampleInterval == 0 {
+		m._sampled, m._sampleAt = frame, m.now()
+	}
+	m._pushes++
+	size := uint64(len(frame.Payload))
+	if m.budget != nil {
+		m._memory += frameMemory(frame)
+	}
+	m._stats.Depth++
+	m._stats.Bytes += size
+	if m._stats.Depth > m._stats.HighWatermark {
+		m._stats.HighWatermark = m._stats.Depth
+	}
+	if m._stats.Bytes > m._stats.HighWatermarkBytes {
+		m._stats.HighWatermarkBytes = m._stats.Bytes
+	}
+}
+
+// _removed records that a frame has left the queue, either because it
+// was sent or because it was dropped. The queues don't change the frames
+// that they hold, so the frame is still the size that it was when it was
+// queued.
+func (m *queueMonitor) _removed(frame *types.Frame, dropped bool) {
+	if m._stats.Depth == 0 {
+		return
+	}
+	if m.budget != nil {
+		memory := frameMemory(frame)
+		if memory > m._memory {
+			memory = m._memory
+		}
+		m._memory -= memory
+		m.budget.give(memory)
+	}
+	m._stats.Depth--
+	if size := uint64(len(frame.Payload)); size < m._stats.Bytes {
+		m._stats.Bytes -= size
+	} else {
+		m._stats.Bytes = 0
+	}
+	if dropped {
+		m._stats.Dropped++
+	}
+	if frame != m._sampled {
+		return
+	}
+	m._sampled = nil
+	if delay := m.now().Sub(m._sampleAt); !dropped && delay > m._stats.LongestDelay {
+		m._stats.LongestDelay = delay
+	}
+}
+
+// _refused records that a frame couldn't be queued.
+func (m *queueMonitor) _refused() {
+	m._stats.Dropped++
+}
+
+// _reset forgets about all queued frames but keeps the running totals.
+func (m *queueMonitor) _reset() {
+	if m._memory > 0 {
+		m.budget.give(m._memory)
+	}
+	m._memory, m._sampled = 0, nil
+	m._stats.Depth, m._stats.Bytes = 0, 0
+}
+
+// queueAlarmConfig holds the settings from RouterOptionQueueAlarm.
+type queueAlarmConfig struct {
+	threshold int
+	duration  time.Duration
+}
+
+func (c queueAlarmConfig) enabled() bool {
+	return c.duration > 0
+}
+
+// checkInterval returns how often the queues should be sampled, which is
+// often enough to notice congestion reasonably close to the duration.
+func (c queueAlarmConfig) checkInterval() time.Duration {
+	if interval := c.duration / 4; interval > queueAlarmMinCheckInterval {
+		return interval
+	}
+	return queueAlarmMinCheckInterval
+}
+
+// queueAlarm tracks how long a queue has been above the alarm threshold.
+type queueAlarm struct {
+	above  time.Time // when the queue was first seen above the threshold
+	raised bool      // has the congestion event been sent?
+}
+
+// _maintainQueueAlarms samples the depth of every queue, sending an event
+// when a queue has stayed above the configured threshold for the configured
+// duration, and another when it drops back down again.
+func (s *state) _maintainQueueAlarms() {
+	if s._suspended {
+		// Resume will restart maintenance.
+		return
+	}
+	select {
+	case <-s.r.context.Done():
+		return
+	default:
+		defer s._queueAlarmTimer.Reset(s.r.queueAlarm.checkInterval())
+	}
+
+	for _, p := range s._peers {
+		if p == nil || p == s.r.local || !p.started.Load() {
+			continue
+		}
+		for i, q := range []struct {
+			name  string
+			queue queue
+		}{{"proto", p.proto}, {"traffic", p.traffic}} {
+			depth := q.queue.queueStats().Depth
+			alarm := &p._queueAlarms[i]
+			switch {
+			case depth <= s.r.queueAlarm.threshold:
+				if alarm.raised {
+					s.r._publish(events.QueueRecovered{
+						Port:   p.port,
+						PeerID: p.public.String(),
+						Queue:  q.name,
+					})
+				}
+				*alarm = queueAlarm{}
+			case alarm.above.IsZero():
+				alarm.above = s.r.clock.Now()
+			case !alarm.raised && since(s.r.clock, alarm.above) >= s.r.queueAlarm.duration:
+				alarm.raised = true
+				s.r._publish(events.QueueCongested{
+					Port:   p.port,
+					PeerID: p.public.String(),
+					Queue:  q.name,
+					Depth:  depth,
+					Since:  alarm.above,
+				})
+			}
+		}
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+// Every so often we send each of our peers a bloom filter of the keys that
+// it can reach through us without going far out of its way: our own key,
+// our other direct peers, our ancestors in the tree and the nodes whose
+// SNEK paths pass through us. If SNEK routing can't find a candidate that
+// is the destination itself, then a peer whose filter contains the
+// destination is used instead of heading blindly in the right direction
+// through keyspace. Peers whose filters don't contain the destination are
+// never chosen this way. Bloom filters can give false positives, but the
+// frame still makes progress from there using the normal rules.
+
+type reachability struct {
+	root     types.Root
+	filter   types.ReachabilityFilter
+	received time.Time
+}
+
+// valid returns true if the filter hasn't expired and was sent under the
+// given root.
+func (r *reachability) valid(root *types.Root, now time.Time) bool {
+	return now.Sub(r.received) < reachabilityExpiryPeriod && r.root.EqualTo(root)
+}
+
+// _reachabilityFrame returns a frame containing a filter of the keys that
+// the given peer can reach through us.
+func (s *state) _reachabilityFrame(p *peer) *types.Frame {
+	ann := s._rootAnnouncement()
+	update := types.Reachability{
+		Root: ann.Root,
+	}
+	update.Filter.Add(s.r.public)
+	for _, q := range s._peers {
+		if q != nil && q != p && q.started.Load() {
+			update.Filter.Add(q.public)
+		}
+	}
+	if s._parent != p {
+		for _, ancestor := range ann.Signatures {
+			update.Filter.Add(ancestor.PublicKey)
+		}
+	}
+	for _, entry := range s._table {
+		if entry.valid(s.r.clock.Now(), s.r.timings.PathExpiry) && entry.Source != p && entry.underRoot(&ann.Root) {
+			update.Filter.Add(entry.PublicKey)
+		}
+	}
+	frame := getFrame()
+	frame.Type = types.TypeReachability
+	n, err := update.MarshalBinary(frame.Payload[:cap(frame.Payload)])
+	if err != nil {
+		framePool.Put(frame)
+		return nil
+	}
+	frame.Payload = frame.Payload[:n]
+	return frame
+}
+
+// _sendReachability sends our reachability filters to all of our peers, if
+// it is time to do so.
+func (s *state) _sendReachability() {
+	if since(s.r.clock, s._lastReachability) < reachabilityInterval {
+		return
+	}
+	for _, p := range s._peers {
+		if p == nil || p == s.r.local || !p.started.Load() || p.proto == nil {
+			continue
+		}
+		if s._deferGossip(types.TypeReachability) {
+			continue
+		}
+		if f := s._reachabilityFrame(p); f != nil {
+			p.proto.push(f)
+		}
+	}
+	s._lastReachability = s.r.clock.Now()
+}
+
+// _handleReachability is called when a peer sends us a filter of the keys
+// that can be reached through it.
+func (s *state) _handleReachability(p *peer, rx *types.Frame) error {
+	var update types.Reachability
+	if _, err := types.Decode(&update, rx.Payload); err != nil {
+		return fmt.Errorf("update.UnmarshalBinary: %w", err)
+	}
+	p._reachability = &reachability{
+		root:     update.Root,
+		filter:   update.Filter,
+		received: s.r.clock.Now(),
+	}
+	return nil
+}
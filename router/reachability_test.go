@@ -0,0 +1,82 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+	"go.uber.org/atomic"
+)
+
+func TestReachabilityNextHop(t *testing.T) {
+	selfKey := types.PublicKey{2}
+	destKey := types.PublicKey{4}
+	root := types.Root{RootPublicKey: types.PublicKey{9}, RootSequence: 1}
+
+	self := &peer{started: *atomic.NewBool(true), public: selfKey}
+	parent := &peer{started: *atomic.NewBool(true), public: types.PublicKey{8}, port: 1}
+	first := &peer{started: *atomic.NewBool(true), public: types.PublicKey{7}, port: 2}
+	second := &peer{started: *atomic.NewBool(true), public: types.PublicKey{6}, port: 3}
+
+	ann := &rootAnnouncementWithTime{
+		SwitchAnnouncement: types.SwitchAnnouncement{Root: root},
+	}
+	params := virtualSnakeNextHopParams{
+		false,
+		destKey,
+		selfKey,
+		types.VirtualSnakeWatermark{PublicKey: types.FullMask},
+		parent,
+		self,
+		ann,
+		announcementTable{
+			parent: ann,
+			first:  ann,
+			second: ann,
+		},
+		virtualSnakeTable{},
+		time.Now(),
+		virtualSnakeNeighExpiryPeriod,
+	}
+
+	// A peer whose filter doesn't contain the destination isn't chosen.
+	first._reachability = &reachability{root: root, received: time.Now()}
+	first._reachability.filter.Add(types.PublicKey{5})
+	if p, _ := getNextHopSNEK(params); p != parent {
+		t.Fatalf("expected traffic to go to the parent")
+	}
+
+	// One whose filter does is.
+	second._reachability = &reachability{root: root, received: time.Now()}
+	second._reachability.filter.Add(destKey)
+	if p, w := getNextHopSNEK(params); p != second || w.PublicKey != destKey {
+		t.Fatalf("expected traffic to go to the peer that can reach the destination")
+	}
+
+	// Unless the filter has expired.
+	second._reachability.received = params.now.Add(-reachabilityExpiryPeriod)
+	if p, _ := getNextHopSNEK(params); p != parent {
+		t.Fatalf("expected expired filter to be ignored")
+	}
+
+	// Bootstraps never use the filters.
+	second._reachability.received = time.Now()
+	params.isBootstrap, params.destinationKey = true, selfKey
+	if p, _ := getNextHopSNEK(params); p != parent {
+		t.Fatalf("expected bootstrap to ignore reachability filters")
+	}
+}
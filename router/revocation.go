@@ -0,0 +1,157 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"fmt"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+// A deployment can nominate a revocation authority, whose key is given to
+// every node with RouterOptionRevocationAuthority. The authority signs lists
+// of banned keys, which can be published from any node. A new list is flooded
+// to the whole network, since nodes only forward lists that are newer than the
+// one they already have, and the current list is also sent to every new peer
+// so that nodes that join later will learn about it. Nodes refuse to peer with
+// banned keys and drop their bootstraps, so they can't join the DHT. Nodes
+// without a revocation authority ignore revocation lists.
+
+type revokedKeys map[types.PublicKey]struct{}
+
+// PublishRevocationList replaces the current revocation list with the given
+// list, which must be signed by the revocation authority and must have a
+// higher sequence than the current list, and sends it to the network.
+func (r *Router) PublishRevocationList(list types.RevocationList) error {
+	if r.banAuthority == nil {
+		return fmt.Errorf("no revocation authority configured")
+	}
+	if err := list.Verify(*r.banAuthority); err != nil {
+		return fmt.Errorf("list.Verify: %w", err)
+	}
+	var err error
+	phony.Block(r.state, func() {
+		if !r.state._applyRevocationList(list) {
+			err = fmt.Errorf("revocation list is not newer than the current list")
+			return
+		}
+		if f, ferr := r.state._revocationFrame(); ferr == nil {
+			r.state._flood(r.local, f, ClassicFlood)
+			framePool.Put(f)
+		}
+	})
+	return err
+}
+
+// RevocationList returns the current revocation list, if we have one.
+func (r *Router) RevocationList() (types.RevocationList, bool) {
+	var list types.RevocationList
+	var ok bool
+	phony.Block(r.state, func() {
+		if r.state._revocations != nil {
+			list, ok = *r.state._revocations, true
+		}
+	})
+	return list, ok
+}
+
+// IsRevoked returns true if the given key is in the current revocation list.
+func (r *Router) IsRevoked(public types.PublicKey) bool {
+	var revoked bool
+	phony.Block(r.state, func() {
+		revoked = r.state._isRevoked(public)
+	})
+	return revoked
+}
+
+func (s *state) _isRevoked(public types.PublicKey) bool {
+	_, ok := s._revoked[public]
+	return ok
+}
+
+// _applyRevocationList replaces the current revocation list if the given
+// list is newer, disconnecting any peers and forgetting any routes that
+// belong to keys that are now revoked. The list must already be verified.
+func (s *state) _applyRevocationList(list types.RevocationList) bool {
+	if s._revocations != nil && list.Sequence <= s._revocations.Sequence {
+		return false
+	}
+	s._revocations = &list
+	s._revoked = make(revokedKeys, len(list.Keys))
+	for _, key := range list.Keys {
+		s._revoked[key] = struct{}{}
+	}
+	if s._isRevoked(s.r.public) {
+		s.r.log.Println("WARNING: Our key has been revoked, so other nodes will refuse to peer with us")
+	}
+	for _, p := range s._peers {
+		if p == nil || p == s.r.local || !s._isRevoked(p.public) {
+			continue
+		}
+		s.r.log.Println("Disconnecting revoked peer", p.public.String(), "on port", p.port)
+		p.stop(fmt.Errorf("peer key has been revoked"))
+	}
+	for k := range s._table {
+		if s._isRevoked(k.PublicKey) {
+			s._removeRouteEntry(k, "key revoked")
+		}
+	}
+	return true
+}
+
+// _revocationFrame builds a frame containing the current revocation list.
+func (s *state) _revocationFrame() (*types.Frame, error) {
+	if s._revocations == nil {
+		return nil, fmt.Errorf("no revocation list")
+	}
+	f := getFrame()
+	n, err := s._revocations.MarshalBinary(f.Payload[:cap(f.Payload)])
+	if err != nil {
+		framePool.Put(f)
+		return nil, fmt.Errorf("s._revocations.MarshalBinary: %w", err)
+	}
+	f.Type = types.TypeRevocation
+	f.SourceKey = *s.r.banAuthority
+	f.HopLimit = types.MaxHopLimit
+	f.Payload = f.Payload[:n]
+	return f, nil
+}
+
+// _handleRevocation checks a revocation list from a peer and, if it is newer
+// than the one that we have, applies it and floods it to our other peers.
+func (s *state) _handleRevocation(p *peer, f *types.Frame) error {
+	if s.r.banAuthority == nil || f.SourceKey != *s.r.banAuthority {
+		return nil
+	}
+	var list types.RevocationList
+	if _, err := types.Decode(&list, f.Payload); err != nil {
+		return fmt.Errorf("list.UnmarshalBinary: %w", err)
+	}
+	if s._revocations != nil && list.Sequence <= s._revocations.Sequence {
+		return nil
+	}
+	s.r.energy.verifies.Inc()
+	if err := list.Verify(*s.r.banAuthority); err != nil {
+		return fmt.Errorf("list.Verify: %w", err)
+	}
+	if s._applyRevocationList(list) {
+		s._flood(p, f, ClassicFlood)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestRevocationList(t *testing.T) {
+	var authority types.PrivateKey
+	_, ask, _ := ed25519.GenerateKey(nil)
+	copy(authority[:], ask)
+
+	newRouter := func() *Router {
+		_, sk, _ := ed25519.GenerateKey(nil)
+		r := NewRouter(nil, sk, RouterOptionRevocationAuthority(authority.Public()))
+		t.Cleanup(func() { _ = r.Close() })
+		return r
+	}
+	a, b, banned, existing := newRouter(), newRouter(), newRouter(), newRouter()
+
+	if errA, errB := connectTestRouters(t, a, existing); errA != nil || errB != nil {
+		t.Fatalf("nodes failed to peer: %v, %v", errA, errB)
+	}
+	list, err := types.NewRevocationList(authority, 1, []types.PublicKey{
+		banned.PublicKey(), existing.PublicKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.PublishRevocationList(list); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.PublishRevocationList(list); err == nil {
+		t.Fatalf("expected list with the same sequence to be refused")
+	}
+	forged := list
+	forged.Sequence++
+	if err := a.PublishRevocationList(forged); err == nil {
+		t.Fatalf("expected list with a bad signature to be refused")
+	}
+
+	// The peer that was revoked is disconnected.
+	connected := func(r, to *Router) bool {
+		for _, info := range r.Peers() {
+			if info.PublicKey == to.PublicKey().String() {
+				return true
+			}
+		}
+		return false
+	}
+	deadline := time.Now().Add(time.Second * 5)
+	for connected(a, existing) {
+		if time.Now().After(deadline) {
+			t.Fatalf("revoked peer wasn't disconnected")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	// New peers are sent the list when they connect.
+	if errA, errB := connectTestRouters(t, a, b); errA != nil || errB != nil {
+		t.Fatalf("nodes failed to peer: %v, %v", errA, errB)
+	}
+	deadline = time.Now().Add(time.Second * 5)
+	for !b.IsRevoked(banned.PublicKey()) {
+		if time.Now().After(deadline) {
+			t.Fatalf("revocation list wasn't sent to the new peer")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if received, ok := b.RevocationList(); !ok || received.Sequence != list.Sequence {
+		t.Fatalf("wrong revocation list received")
+	}
+
+	// Revoked keys can't peer.
+	if errA, errB := connectTestRouters(t, b, banned); errA == nil {
+		t.Fatalf("revoked node was accepted (other side: %v)", errB)
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"time"
+
+	"github.com/Arceliar/phony"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+// Not every embedder has a metrics stack to scrape counters into, so the
+// router keeps a short history of its most important counters itself. The
+// counts are kept in buckets of rollupResolution for as long as the
+// retention, which is an hour unless RouterOptionStatsRetention says
+// otherwise, and are added up into the last minute, five minutes and hour
+// when asked for. If the retention is longer than an hour, the whole of it
+// is given too.
+
+// rollupResolution is how much time each bucket of counts covers.
+const rollupResolution = time.Second * 10
+
+// rollupDefaultRetention is how long the counts are kept for if the option
+// doesn't say.
+const rollupDefaultRetention = time.Hour
+
+// rollupMaxRetention is the longest that the counts can be kept for.
+const rollupMaxRetention = time.Hour * 24
+
+// rollupWindows are the windows that the counts are added up over.
+var rollupWindows = []time.Duration{time.Minute, time.Minute * 5, time.Hour}
+
+// The counters that are kept.
+const (
+	rollupForwarded = iota
+	rollupDropped
+	rollupBootstraps
+	rollupParentChanges
+	rollupCounters
+)
+
+// StatsRollup adds up the counters over a window of time.
+type StatsRollup struct {
+	Window        time.Duration `json:"window"`
+	Forwarded     uint64        `json:"frames_forwarded"` // Frames sent on to a peer
+	Dropped       uint64        `json:"frames_dropped"`   // Frames that we couldn't or wouldn't send on
+	Bootstraps    uint64        `json:"bootstraps"`       // Bootstraps that we sent
+	ParentChanges uint64        `json:"parent_changes"`
+}
+
+type rollupBucket struct {
+	start  time.Time
+	counts [rollupCounters]uint64
+}
+
+type statsRollups struct {
+	retention time.Duration
+	buckets   []rollupBucket
+}
+
+func newStatsRollups(retention time.Duration) *statsRollups {
+	switch {
+	case retention <= 0:
+		retention = rollupDefaultRetention
+	case retention > rollupMaxRetention:
+		retention = rollupMaxRetention
+	case retention < rollupResolution:
+		retention = rollupResolution
+	}
+	return &statsRollups{
+		retention: retention,
+		buckets:   make([]rollupBucket, retention/rollupResolution),
+	}
+}
+
+// add counts one of the counter at the given time.
+func (r *statsRollups) add(now time.Time, counter int) {
+	start := now.Truncate(rollupResolution)
+	b := &r.buckets[(start.UnixNano()/int64(rollupResolution))%int64(len(r.buckets))]
+	if !b.start.Equal(start) {
+		*b = rollupBucket{start: start}
+	}
+	b.counts[counter]++
+}
+
+// rollup adds up the counters over the window.
+func (r *statsRollups) rollup(now time.Time, window time.Duration) StatsRollup {
+	rollup := StatsRollup{Window: window}
+	oldest := now.Add(-window)
+	for i := range r.buckets {
+		b := &r.buckets[i]
+		if b.start.IsZero() || !b.start.After(oldest) || b.start.After(now) {
+			continue
+		}
+		rollup.Forwarded += b.counts[rollupForwarded]
+		rollup.Dropped += b.counts[rollupDropped]
+		rollup.Bootstraps += b.counts[rollupBootstraps]
+		rollup.ParentChanges += b.counts[rollupParentChanges]
+	}
+	return rollup
+}
+
+// rollups adds up the counters over each of the windows that fit within the
+// retention, shortest first.
+func (r *statsRollups) rollups(now time.Time) []StatsRollup {
+	rollups := make([]StatsRollup, 0, len(rollupWindows)+1)
+	for _, window := range rollupWindows {
+		if window <= r.retention {
+			rollups = append(rollups, r.rollup(now, window))
+		}
+	}
+	if last := rollupWindows[len(rollupWindows)-1]; r.retention > last {
+		rollups = append(rollups, r.rollup(now, r.retention))
+	}
+	return rollups
+}
+
+// _count counts one of the counter now.
+func (s *state) _count(counter int) {
+	if s._rollups != nil {
+		s._rollups.add(s.r.clock.Now(), counter)
+	}
+}
+
+// StatsRollups returns the counts of frames forwarded and dropped,
+// bootstraps sent and parent changes over the last minute, five minutes
+// and hour, as far back as the retention allows.
+func (r *Router) StatsRollups() []StatsRollup {
+	var rollups []StatsRollup
+	phony.Block(r.state, func() {
+		if r.state._rollups != nil {
+			rollups = r.state._rollups.rollups(r.clock.Now())
+		}
+	})
+	return rollups
+}
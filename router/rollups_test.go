@@ -0,0 +1,67 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStatsRollups(t *testing.T) {
+	r := newStatsRollups(0)
+	now := time.Unix(100000, 0)
+	r.add(now.Add(-time.Minute*30), rollupParentChanges)
+	r.add(now.Add(-time.Minute*3), rollupDropped)
+	for i := 0; i < 5; i++ {
+		r.add(now.Add(-time.Second*5), rollupForwarded)
+	}
+	r.add(now, rollupBootstraps)
+
+	rollups := r.rollups(now)
+	if len(rollups) != 3 {
+		t.Fatalf("expected three windows, got %d", len(rollups))
+	}
+	expected := []StatsRollup{
+		{Window: time.Minute, Forwarded: 5, Bootstraps: 1},
+		{Window: time.Minute * 5, Forwarded: 5, Dropped: 1, Bootstraps: 1},
+		{Window: time.Hour, Forwarded: 5, Dropped: 1, Bootstraps: 1, ParentChanges: 1},
+	}
+	for i := range expected {
+		if rollups[i] != expected[i] {
+			t.Fatalf("window %s: expected %+v, got %+v", expected[i].Window, expected[i], rollups[i])
+		}
+	}
+
+	// An hour later, everything has fallen out of the retention.
+	for _, rollup := range r.rollups(now.Add(time.Hour * 2)) {
+		if rollup != (StatsRollup{Window: rollup.Window}) {
+			t.Fatalf("expected nothing to be left, got %+v", rollup)
+		}
+	}
+}
+
+func TestStatsRollupsRetention(t *testing.T) {
+	now := time.Unix(100000, 0)
+	short := newStatsRollups(time.Minute * 2)
+	if rollups := short.rollups(now); len(rollups) != 1 || rollups[0].Window != time.Minute {
+		t.Fatalf("expected only the one minute window, got %+v", rollups)
+	}
+	long := newStatsRollups(time.Hour * 6)
+	long.add(now.Add(-time.Hour*5), rollupDropped)
+	rollups := long.rollups(now)
+	if len(rollups) != 4 || rollups[3].Window != time.Hour*6 || rollups[3].Dropped != 1 || rollups[2].Dropped != 0 {
+		t.Fatalf("expected the whole retention as a fourth window, got %+v", rollups)
+	}
+}
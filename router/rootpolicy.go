@@ -0,0 +1,70 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"github.com/matrix-org/pinecone/types"
+)
+
+// RootPolicy decides which of two roots is the better root for the tree.
+// Every node builds the tree under the best root that it hears about, so
+// all of the nodes in a network must use the same policy, and the policy
+// must give the same answer on every node and put roots in a consistent
+// order. If it doesn't, nodes will disagree about the root and the tree
+// will never settle. Sequence numbers go up over time, so policies that
+// look at them need to take care that the order doesn't change as they do.
+type RootPolicy interface {
+	// CompareRoots returns a positive number if a is a better root than b,
+	// a negative number if it is worse, or zero if they are as good as each
+	// other. It is never asked to compare two announcements from the same
+	// root.
+	CompareRoots(a, b types.Root) int
+}
+
+// StrongestKeyRootPolicy prefers the root with the highest public key. It is
+// the default, and the only policy that older nodes understand.
+type StrongestKeyRootPolicy struct{}
+
+func (StrongestKeyRootPolicy) CompareRoots(a, b types.Root) int {
+	return a.RootPublicKey.CompareTo(b.RootPublicKey)
+}
+
+// PreferredRootPolicy prefers roots for which Preferred returns true, such
+// as nodes known to hold a deployment certificate, over all other roots.
+// Between two roots that are both preferred, or both not, the one with the
+// highest public key is better.
+type PreferredRootPolicy struct {
+	Preferred func(key types.PublicKey) bool
+}
+
+func (p PreferredRootPolicy) CompareRoots(a, b types.Root) int {
+	pa, pb := p.Preferred(a.RootPublicKey), p.Preferred(b.RootPublicKey)
+	switch {
+	case pa && !pb:
+		return 1
+	case !pa && pb:
+		return -1
+	}
+	return a.RootPublicKey.CompareTo(b.RootPublicKey)
+}
+
+// compareRoots asks the policy which root is better, unless both are the
+// same root, in which case neither is.
+func compareRoots(policy RootPolicy, a, b types.Root) int {
+	if a.RootPublicKey == b.RootPublicKey {
+		return 0
+	}
+	return policy.CompareRoots(a, b)
+}
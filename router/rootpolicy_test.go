@@ -0,0 +1,99 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestPreferredRootPolicy(t *testing.T) {
+	low, high := types.Root{RootPublicKey: types.PublicKey{1}}, types.Root{RootPublicKey: types.PublicKey{2}}
+	policy := PreferredRootPolicy{
+		Preferred: func(key types.PublicKey) bool { return key == low.RootPublicKey },
+	}
+	if compareRoots(StrongestKeyRootPolicy{}, high, low) <= 0 {
+		t.Fatalf("expected the default policy to prefer the higher key")
+	}
+	if compareRoots(policy, low, high) <= 0 || compareRoots(policy, high, low) >= 0 {
+		t.Fatalf("expected the preferred root to be better")
+	}
+	if compareRoots(policy, low, types.Root{RootPublicKey: low.RootPublicKey, RootSequence: 5}) != 0 {
+		t.Fatalf("expected announcements from the same root to compare equal")
+	}
+
+	// Parent selection follows the policy too.
+	ann := rootAnnouncementWithTime{
+		SwitchAnnouncement: types.SwitchAnnouncement{Root: low},
+		receiveTime:        time.Now(),
+	}
+	if !isBetterParentCandidate(ann, high, 0, false, time.Now(), time.Minute, policy) {
+		t.Fatalf("expected a peer with the preferred root to be a better parent")
+	}
+	if isBetterParentCandidate(ann, high, 0, false, time.Now(), time.Minute, StrongestKeyRootPolicy{}) {
+		t.Fatalf("expected a peer with a weaker root not to be a better parent")
+	}
+}
+
+func TestRootPolicyElectsPreferredRoot(t *testing.T) {
+	var sks [2]ed25519.PrivateKey
+	for i := range sks {
+		_, sks[i], _ = ed25519.GenerateKey(nil)
+	}
+	var keys [2]types.PublicKey
+	for i, sk := range sks {
+		copy(keys[i][:], sk.Public().(ed25519.PublicKey))
+	}
+	weakest := keys[0]
+	if keys[1].CompareTo(weakest) < 0 {
+		weakest = keys[1]
+	}
+	policy := RouterOptionRootPolicy{PreferredRootPolicy{
+		Preferred: func(key types.PublicKey) bool { return key == weakest },
+	}}
+	var routers [2]*Router
+	for i, sk := range sks {
+		routers[i] = NewRouter(nil, sk, policy)
+		r := routers[i]
+		t.Cleanup(func() { _ = r.Close() })
+	}
+	if errA, errB := connectTestRouters(t, routers[0], routers[1]); errA != nil || errB != nil {
+		t.Fatalf("failed to peer routers: %v, %v", errA, errB)
+	}
+
+	// Both nodes should build the tree under the weaker key, since it is
+	// the one that the policy prefers.
+	root := func(r *Router) (key types.PublicKey) {
+		phony.Block(r.state, func() {
+			key = r.state._rootAnnouncement().RootPublicKey
+		})
+		return
+	}
+	deadline := time.Now().Add(time.Second * 10)
+	for {
+		root0, root1 := root(routers[0]), root(routers[1])
+		if root0 == weakest && root1 == weakest {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %s to be the root, got %s and %s", weakest, root0, root1)
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+}
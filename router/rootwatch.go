@@ -0,0 +1,263 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/router/events"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+// The node with the highest key becomes the root of the tree, so a single
+// buggy or malicious node with a high key can disrupt the whole network.
+// We watch the roots that are announced to us for things that a
+// well-behaved root never does:
+//
+//   - Its sequence number going backwards, other than the announcement
+//     from one peer lagging behind another.
+//   - Its sequence number going up faster than one step per announcement
+//     interval, which means that it isn't waiting between announcements.
+//   - Becoming our root over and over again in a short time, which means
+//     that it is coming and going.
+//
+// Anomalies are logged, recorded in the protocol history and sent as
+// events. If RouterOptionDistrustMisbehavingRoots is given, the root is
+// also treated as weaker than every other root for a while, so that we
+// build the tree under the next best root instead. A legitimate root that
+// restarts will start its sequence numbers again, so distrusting roots is
+// off by default.
+
+// rootWatchWindow is how long we remember a root that we have stopped
+// hearing about, how far back we look for flapping, and how often the same
+// anomaly from the same root is reported.
+const rootWatchWindow = time.Minute * 10
+
+// rootFlapThreshold is how many times a root can become our root within
+// rootWatchWindow before it is flagged as flapping.
+const rootFlapThreshold = 3
+
+// rootSequenceTolerance is how far behind the highest sequence number that
+// we have seen from a root an announcement can be, since announcements
+// reach us over paths of different lengths.
+const rootSequenceTolerance = 1
+
+// rootSequenceSlack is how many more sequence numbers than the elapsed
+// time allows a root can use, since a node increments its sequence number
+// each time it becomes a root as well as on each announcement interval.
+const rootSequenceSlack = 16
+
+// RootAnomaly describes what a misbehaving root did.
+type RootAnomaly string
+
+const (
+	// RootSequenceRegression is a root's sequence number going backwards.
+	RootSequenceRegression RootAnomaly = "sequence_regression"
+	// RootSequenceJump is a root's sequence number going up faster than
+	// its announcement interval allows.
+	RootSequenceJump RootAnomaly = "sequence_jump"
+	// RootFlapping is a root becoming our root too many times.
+	RootFlapping RootAnomaly = "flapping"
+)
+
+// MisbehavingRoot describes the last anomaly seen from a root.
+type MisbehavingRoot struct {
+	PublicKey       types.PublicKey `json:"public_key"`
+	Anomaly         RootAnomaly     `json:"anomaly"`
+	Reason          string          `json:"reason"`
+	At              time.Time       `json:"at"`
+	DistrustedUntil time.Time       `json:"distrusted_until,omitempty"` // Zero unless distrusted
+}
+
+type rootRecord struct {
+	firstSeen     time.Time
+	firstSequence types.Varu64
+	lastSeen      time.Time
+	highest       types.Varu64
+	adopted       []time.Time // When it became our root, oldest first
+	reported      map[RootAnomaly]time.Time
+	last          *MisbehavingRoot
+}
+
+type rootWatch struct {
+	roots      map[types.PublicKey]*rootRecord
+	distrusted map[types.PublicKey]time.Time // Until when
+	lastPrune  time.Time
+}
+
+// _rootRecord returns the record for the given root, creating it if needed.
+func (s *state) _rootRecord(root types.PublicKey, sequence types.Varu64) *rootRecord {
+	w := &s._rootWatch
+	now := s.r.clock.Now()
+	if w.roots == nil {
+		w.roots = map[types.PublicKey]*rootRecord{}
+	}
+	if now.Sub(w.lastPrune) >= rootWatchWindow {
+		w.lastPrune = now
+		for key, rec := range w.roots {
+			if now.Sub(rec.lastSeen) >= rootWatchWindow {
+				delete(w.roots, key)
+			}
+		}
+		for key, until := range w.distrusted {
+			if !now.Before(until) {
+				delete(w.distrusted, key)
+			}
+		}
+	}
+	rec := w.roots[root]
+	if rec == nil {
+		rec = &rootRecord{
+			firstSeen:     now,
+			firstSequence: sequence,
+			highest:       sequence,
+			reported:      map[RootAnomaly]time.Time{},
+		}
+		w.roots[root] = rec
+	}
+	rec.lastSeen = now
+	return rec
+}
+
+// _watchRootAnnouncement checks the root in a tree announcement from one
+// of our peers for sequence number anomalies.
+func (s *state) _watchRootAnnouncement(p *peer, ann *types.SwitchAnnouncement) {
+	if ann.RootPublicKey == s.r.public {
+		return
+	}
+	rec := s._rootRecord(ann.RootPublicKey, ann.RootSequence)
+	switch {
+	case ann.RootSequence+rootSequenceTolerance < rec.highest:
+		s._rootMisbehaving(ann.RootPublicKey, RootSequenceRegression, p,
+			fmt.Sprintf("sequence number went back from %d to %d", rec.highest, ann.RootSequence))
+	case ann.RootSequence > rec.highest:
+		elapsed := ann.RootSequence - rec.firstSequence
+		allowed := types.Varu64(since(s.r.clock, rec.firstSeen)/s.r.timings.AnnouncementInterval) + rootSequenceSlack
+		if elapsed > allowed {
+			s._rootMisbehaving(ann.RootPublicKey, RootSequenceJump, p,
+				fmt.Sprintf("sequence number went up by %d in %s", elapsed, since(s.r.clock, rec.firstSeen).Round(time.Second)))
+			// Start counting again from here so that we don't keep
+			// reporting the same jump.
+			rec.firstSeen, rec.firstSequence = s.r.clock.Now(), ann.RootSequence
+		}
+		rec.highest = ann.RootSequence
+	}
+}
+
+// _watchRootAdopted is called when our root changes, to check for roots
+// that keep coming and going.
+func (s *state) _watchRootAdopted(root types.Root) {
+	if root.RootPublicKey == s.r.public {
+		return
+	}
+	rec := s._rootRecord(root.RootPublicKey, root.RootSequence)
+	now := s.r.clock.Now()
+	rec.adopted = append(pruneTimes(rec.adopted, now.Add(-rootWatchWindow)), now)
+	if len(rec.adopted) >= rootFlapThreshold {
+		s._rootMisbehaving(root.RootPublicKey, RootFlapping, s._parent,
+			fmt.Sprintf("became our root %d times in %s", len(rec.adopted), rootWatchWindow))
+	}
+}
+
+// _rootMisbehaving reports an anomaly from the given root, unless the same
+// anomaly was reported recently, and distrusts the root if we have been
+// asked to.
+func (s *state) _rootMisbehaving(root types.PublicKey, anomaly RootAnomaly, p *peer, reason string) {
+	w := &s._rootWatch
+	rec := w.roots[root]
+	now := s.r.clock.Now()
+	if at, ok := rec.reported[anomaly]; ok && now.Sub(at) < rootWatchWindow {
+		return
+	}
+	rec.reported[anomaly] = now
+	rec.last = &MisbehavingRoot{
+		PublicKey: root,
+		Anomaly:   anomaly,
+		Reason:    reason,
+		At:        now,
+	}
+	if d := s.r.distrustRoots; d > 0 {
+		if w.distrusted == nil {
+			w.distrusted = map[types.PublicKey]time.Time{}
+		}
+		w.distrusted[root] = now.Add(d)
+		rec.last.DistrustedUntil = now.Add(d)
+		// Parent selection can't safely run from here, since we may be
+		// part way through handling an announcement or changing parent.
+		s.Act(nil, func() {
+			if s._selectNewParent() {
+				s._bootstrapSoon()
+			}
+		})
+	}
+	s.r.log.Printf("Root %s is misbehaving (%s): %s", root, anomaly, reason)
+	s._recordEvent(ProtocolRootMisbehaving, root, p, fmt.Sprintf("%s: %s", anomaly, reason))
+	s.r.Act(nil, func() {
+		s.r._publish(events.RootMisbehaving{
+			RootID:  root.String(),
+			Anomaly: string(anomaly),
+			Reason:  reason,
+		})
+	})
+}
+
+// _rootDistrusted returns true if the given root misbehaved recently and we
+// have been asked to avoid roots that misbehave.
+func (s *state) _rootDistrusted(root types.PublicKey) bool {
+	until, ok := s._rootWatch.distrusted[root]
+	return ok && s.r.clock.Now().Before(until)
+}
+
+// _compareRoots compares roots using our root policy, except that
+// distrusted roots are weaker than all other roots.
+func (s *state) _compareRoots(a, b types.Root) int {
+	da, db := s._rootDistrusted(a.RootPublicKey), s._rootDistrusted(b.RootPublicKey)
+	switch {
+	case da && !db:
+		return -1
+	case !da && db:
+		return 1
+	}
+	return compareRoots(s.r.rootPolicy, a, b)
+}
+
+// MisbehavingRoots returns the roots that have misbehaved recently, along
+// with the last thing that each of them did, most recent first.
+func (r *Router) MisbehavingRoots() []MisbehavingRoot {
+	var result []MisbehavingRoot
+	phony.Block(r.state, func() {
+		result = r.state._rootWatch.misbehaving(r.clock.Now())
+	})
+	return result
+}
+
+func (w *rootWatch) misbehaving(now time.Time) []MisbehavingRoot {
+	var result []MisbehavingRoot
+	for _, rec := range w.roots {
+		if rec.last != nil && now.Sub(rec.last.At) < rootWatchWindow {
+			result = append(result, *rec.last)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].At.After(result[j].At)
+	})
+	return result
+}
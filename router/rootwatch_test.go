@@ -0,0 +1,131 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+func newTestRootWatchState(distrust time.Duration) (*state, *ManualClock) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	s := newTestState(types.PublicKey{1}, clock)
+	s.r.distrustRoots = distrust
+	s.r.rootPolicy = StrongestKeyRootPolicy{}
+	return s, clock
+}
+
+func TestRootWatchSequenceAnomalies(t *testing.T) {
+	s, clock := newTestRootWatchState(0)
+	root := types.PublicKey{9}
+	announce := func(sequence types.Varu64) {
+		s._watchRootAnnouncement(nil, &types.SwitchAnnouncement{
+			Root: types.Root{RootPublicKey: root, RootSequence: sequence},
+		})
+	}
+
+	// An announcement lagging one behind is expected, as is one new
+	// sequence number per announcement interval.
+	announce(10)
+	clock.Advance(s.r.timings.AnnouncementInterval)
+	announce(11)
+	announce(10)
+	if roots := s._rootWatch.misbehaving(clock.Now()); len(roots) != 0 {
+		t.Fatalf("expected no anomalies, got %v", roots)
+	}
+
+	announce(5)
+	roots := s._rootWatch.misbehaving(clock.Now())
+	if len(roots) != 1 || roots[0].PublicKey != root || roots[0].Anomaly != RootSequenceRegression {
+		t.Fatalf("expected a sequence regression, got %v", roots)
+	}
+
+	clock.Advance(time.Second)
+	announce(11 + rootSequenceSlack + 2)
+	roots = s._rootWatch.misbehaving(clock.Now())
+	if len(roots) != 1 || roots[0].Anomaly != RootSequenceJump {
+		t.Fatalf("expected a sequence jump, got %v", roots)
+	}
+	if events := s._history.query(ProtocolHistoryQuery{Kind: ProtocolRootMisbehaving, Key: root}); len(events) != 2 {
+		t.Fatalf("expected two anomalies in the history, got %v", events)
+	}
+
+	// The same anomaly isn't reported again straight away.
+	announce(1)
+	if events := s._history.query(ProtocolHistoryQuery{Kind: ProtocolRootMisbehaving}); len(events) != 2 {
+		t.Fatalf("expected repeated anomalies not to be reported, got %v", events)
+	}
+
+	// Our own key is never flagged.
+	s._watchRootAnnouncement(nil, &types.SwitchAnnouncement{
+		Root: types.Root{RootPublicKey: s.r.public, RootSequence: 1000},
+	})
+	if _, ok := s._rootWatch.roots[s.r.public]; ok {
+		t.Fatalf("expected our own key not to be watched")
+	}
+}
+
+func TestRootWatchFlapping(t *testing.T) {
+	s, clock := newTestRootWatchState(0)
+	root := types.Root{RootPublicKey: types.PublicKey{9}}
+	for i := 0; i < rootFlapThreshold-1; i++ {
+		s._watchRootAdopted(root)
+		clock.Advance(rootWatchWindow / 2)
+	}
+	if roots := s._rootWatch.misbehaving(clock.Now()); len(roots) != 0 {
+		t.Fatalf("expected no anomalies, got %v", roots)
+	}
+	for i := 0; i < rootFlapThreshold; i++ {
+		s._watchRootAdopted(root)
+		clock.Advance(time.Second)
+	}
+	roots := s._rootWatch.misbehaving(clock.Now())
+	if len(roots) != 1 || roots[0].Anomaly != RootFlapping {
+		t.Fatalf("expected the root to be flapping, got %v", roots)
+	}
+	if !roots[0].DistrustedUntil.IsZero() || s._rootDistrusted(root.RootPublicKey) {
+		t.Fatalf("expected the root not to be distrusted by default")
+	}
+}
+
+func TestRootWatchDistrust(t *testing.T) {
+	s, clock := newTestRootWatchState(time.Minute)
+	bad, good := types.Root{RootPublicKey: types.PublicKey{9}}, types.Root{RootPublicKey: types.PublicKey{8}}
+	if s._compareRoots(bad, good) <= 0 {
+		t.Fatalf("expected the higher key to be stronger")
+	}
+
+	s._watchRootAnnouncement(nil, &types.SwitchAnnouncement{
+		Root: types.Root{RootPublicKey: bad.RootPublicKey, RootSequence: 10},
+	})
+	s._watchRootAnnouncement(nil, &types.SwitchAnnouncement{
+		Root: types.Root{RootPublicKey: bad.RootPublicKey, RootSequence: 1},
+	})
+	phony.Block(s, func() {})
+	if !s._rootDistrusted(bad.RootPublicKey) || s._compareRoots(bad, good) >= 0 || s._compareRoots(good, bad) <= 0 {
+		t.Fatalf("expected the misbehaving root to be weaker than any other")
+	}
+	if roots := s._rootWatch.misbehaving(clock.Now()); len(roots) != 1 || roots[0].DistrustedUntil.IsZero() {
+		t.Fatalf("expected the root to be reported as distrusted, got %v", roots)
+	}
+
+	clock.Advance(time.Minute)
+	if s._rootDistrusted(bad.RootPublicKey) || s._compareRoots(bad, good) <= 0 {
+		t.Fatalf("expected the root to be trusted again")
+	}
+}
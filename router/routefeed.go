@@ -0,0 +1,101 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/router/events"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+// Routing table subscribers are owned by the state actor rather than the
+// router actor, so that the snapshot that a subscriber starts with and the
+// changes that follow it are all sent from the same place, in order.
+
+type routeFeedTable map[chan<- events.Event]*phony.Inbox
+
+// SubscribeRoutingTable registers a subscriber to changes in the routing
+// tables. The subscriber is sent a RoutingSnapshot of the current tables
+// first, followed by SnakeRouteChanged and TreeAnnouncementChanged events
+// as the tables change.
+func (r *Router) SubscribeRoutingTable(ch chan<- events.Event) {
+	phony.Block(r.state, func() {
+		inbox := &phony.Inbox{}
+		r.state._routeFeeds[ch] = inbox
+		snapshot := r.state._routingSnapshot()
+		inbox.Act(nil, func() {
+			ch <- snapshot
+		})
+	})
+}
+
+// UnsubscribeRoutingTable stops sending routing table changes to the given
+// subscriber.
+func (r *Router) UnsubscribeRoutingTable(ch chan<- events.Event) {
+	phony.Block(r.state, func() {
+		delete(r.state._routeFeeds, ch)
+	})
+}
+
+// _publishRoute sends a routing table event to each routing table subscriber.
+func (s *state) _publishRoute(event events.Event) {
+	for ch, inbox := range s._routeFeeds {
+		ch := ch
+		inbox.Act(nil, func() {
+			ch <- event
+		})
+	}
+}
+
+// _routingSnapshot returns the current contents of the routing tables.
+func (s *state) _routingSnapshot() events.RoutingSnapshot {
+	var snapshot events.RoutingSnapshot
+	for _, entry := range s._table {
+		snapshot.SnakeRoutes = append(snapshot.SnakeRoutes, snakeRoute(entry))
+	}
+	for p, ann := range s._announcements {
+		if ann != nil {
+			snapshot.TreeAnnouncements = append(snapshot.TreeAnnouncements, treeAnnouncement(p, ann))
+		}
+	}
+	return snapshot
+}
+
+func snakeRoute(entry *virtualSnakeEntry) events.SnakeRoute {
+	route := events.SnakeRoute{
+		PublicKey: entry.PublicKey,
+		Sequence:  uint64(entry.Watermark.Sequence),
+		Root:      entry.Root,
+		LastSeen:  entry.LastSeen,
+	}
+	if entry.Source != nil {
+		route.Source = entry.Source.port
+	}
+	if entry.Destination != nil {
+		route.Destination = entry.Destination.port
+	}
+	return route
+}
+
+func treeAnnouncement(p *peer, ann *rootAnnouncementWithTime) events.TreeAnnouncement {
+	return events.TreeAnnouncement{
+		Port:   p.port,
+		PeerID: p.public.String(),
+		Root:   ann.Root,
+		Coords: ann.Coords(),
+	}
+}
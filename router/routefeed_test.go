@@ -0,0 +1,81 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/router/events"
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestRoutingTableFeed(t *testing.T) {
+	r := newTestState(types.PublicKey{}, systemClock{}).r
+	source := &peer{port: 3}
+	existing := virtualSnakeIndex{PublicKey: types.PublicKey{1}}
+	r.state._table[existing] = &virtualSnakeEntry{
+		virtualSnakeIndex: &existing,
+		Source:            source,
+		LastSeen:          time.Now(),
+	}
+
+	ch := make(chan events.Event, 8)
+	r.SubscribeRoutingTable(ch)
+	next := func() events.Event {
+		select {
+		case e := <-ch:
+			return e
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for event")
+			return nil
+		}
+	}
+
+	// The subscriber starts with a snapshot of the current tables.
+	snapshot, ok := next().(events.RoutingSnapshot)
+	if !ok || len(snapshot.SnakeRoutes) != 1 || snapshot.SnakeRoutes[0].Source != 3 {
+		t.Fatalf("expected snapshot with one route, got %+v", snapshot)
+	}
+
+	// Then gets each change in order.
+	added := virtualSnakeIndex{PublicKey: types.PublicKey{2}}
+	phony.Block(r.state, func() {
+		r.state._addRouteEntry(added, &virtualSnakeEntry{virtualSnakeIndex: &added, Source: source})
+		r.state._addRouteEntry(existing, &virtualSnakeEntry{virtualSnakeIndex: &existing, Source: source})
+		r.state._removeRouteEntry(added, "test")
+	})
+	for _, expected := range []events.SnakeRouteChanged{
+		{Change: events.RouteAdded, Route: events.SnakeRoute{PublicKey: added.PublicKey, Source: 3}},
+		{Change: events.RouteUpdated, Route: events.SnakeRoute{PublicKey: existing.PublicKey, Source: 3}},
+		{Change: events.RouteRemoved, Route: events.SnakeRoute{PublicKey: added.PublicKey}},
+	} {
+		if e := next(); e != expected {
+			t.Fatalf("expected %+v, got %+v", expected, e)
+		}
+	}
+
+	// Nothing is sent once the subscriber unsubscribes.
+	r.UnsubscribeRoutingTable(ch)
+	phony.Block(r.state, func() {
+		r.state._removeRouteEntry(existing, "test")
+	})
+	select {
+	case e := <-ch:
+		t.Fatalf("unexpected event after unsubscribing: %+v", e)
+	case <-time.After(time.Millisecond * 100):
+	}
+}
@@ -19,6 +19,7 @@ import (
 	"crypto/ed25519"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -45,9 +46,63 @@ type Router struct {
 	local         *peer
 	state         *state
 	secure        bool
+	strict        bool
+	pruning       bool
+	maxPeers      int
+	sendTimeout   time.Duration
+	keepalives    map[ConnectionPeerType]keepaliveConfig
+	fastDetection fastFailureDetectionConfig
+	queueAlarm    queueAlarmConfig
+	watchdog      time.Duration
+	slowPeers     slowPeerPolicy
+	handshakes    *handshakeLimiter
+	accept        *acceptLimiter
+	jumbo         uint8
+	compact       bool
+	aggregate     types.AggregateKey
+	timings       Timings
+	custody       *custodyConfig
+	locality      string
+	metadata      PeerMetadata
+	networkID     uint8
+	networkName   string
+	networkTag    [networkTagLength]byte
+	linkEncrypt   bool
+	linkRequired  bool
+	faults        *faultInjector
+	distrustRoots time.Duration
+	rootPolicy    RootPolicy
+	adjacency     bool
+	memory        *memoryBudget
+	loadShedding  *loadShedConfig
+	stripeLinks   bool
+	datagrams     chan *types.Frame
+	rawHandler    atomic.Bool
+	routeTracing  *routeTraceConfig
+	timeSync      time.Duration
+	selfHeal      bool
+	hideNodeInfo  bool
+	debugKeys     map[types.PublicKey]struct{}
+	loopDemotion  bool
+	scheduler     TrafficScheduler
+	latency       bool
+	annDamping    time.Duration
+	authority     *types.PublicKey
+	certificates  types.CertificateChain
+	banAuthority  *types.PublicKey
 	_hopLimiting  *atomic.Bool
 	_readDeadline *atomic.Time
 	_subscribers  map[chan<- events.Event]*phony.Inbox
+	clock         Clock
+	energy        energyCounters
+	hopExpiries   atomic.Uint64
+	wireProfile   *wireProfile
+	middleware    middlewares
+	tagPolicies   tagPolicies
+	priority      *trafficPriority
+	amplification *amplificationConfig
+
+	announcementLimit uint64 // Soft limit on the memory held by stored announcements
 }
 
 func NewRouter(logger types.Logger, sk ed25519.PrivateKey, opts ...RouterOption) *Router {
@@ -55,12 +110,232 @@ func NewRouter(logger types.Logger, sk ed25519.PrivateKey, opts ...RouterOption)
 		logger = log.New(ioutil.Discard, "", 0)
 	}
 	blackhole := false
+	strict := false
+	pruning := false
+	maxPeers := 0
+	announcementLimit := uint64(defaultAnnouncementLimit)
+	sendTimeout := sendQueueTimeout
+	var reserved []ReservedPeer
+	var queueAlarm queueAlarmConfig
+	var watchdog time.Duration
+	var slowPeers slowPeerPolicy
+	var handshakes RouterOptionHandshakeLimits
+	var accept RouterOptionAcceptLimits
+	var jumbo uint8
+	compact := true
+	var aggregate types.AggregateKey
+	var timings Timings
+	var custody *custodyConfig
+	var locality string
+	var metadata PeerMetadata
+	var networkID uint8
+	var networkName string
+	var linkEncryption *RouterOptionLinkEncryption
+	var faults *faultInjector
+	history := protocolHistoryDefault
+	var stateLogging []RouterOptionStateLogging
+	policies := tagPolicies{}
+	var distrustRoots time.Duration
+	var rootPolicy RootPolicy = StrongestKeyRootPolicy{}
+	adjacency := false
+	var memory uint64
+	var loadShedding *loadShedConfig
+	stripeLinks := false
+	var routeTracing *routeTraceConfig
+	var analyzer *frameAnalyzer
+	selfHeal := false
+	hideNodeInfo := false
+	var debugKeys map[types.PublicKey]struct{}
+	loopDemotion := false
+	var scheduler TrafficScheduler
+	var priority RouterOptionTrafficPriority
+	var amplification *amplificationConfig
+	var policy []TrafficRule
+	var timeSync time.Duration
+	latency := false
+	var annDamping time.Duration
+	var retention time.Duration
+	var authority *types.PublicKey
+	var certificates types.CertificateChain
+	var banAuthority *types.PublicKey
+	var clock Clock = systemClock{}
+	var profile *wireProfile
+	keepalives := map[ConnectionPeerType]keepaliveConfig{}
+	fastDetection := fastFailureDetectionConfig{
+		multiplier: fastFailureDetectionMultiplier,
+	}
 	for _, opt := range opts {
 		switch v := opt.(type) {
 		case RouterOptionBlackhole:
 			blackhole = bool(v)
+		case RouterOptionStrictDecoding:
+			strict = bool(v)
+		case RouterOptionPeerQualityPruning:
+			pruning = bool(v)
+		case RouterOptionMaxPeers:
+			maxPeers = int(v)
+		case RouterOptionSendQueueTimeout:
+			if v != 0 {
+				sendTimeout = time.Duration(v)
+			}
+		case RouterOptionAnnouncementLimit:
+			if v > 0 {
+				announcementLimit = uint64(v)
+			}
+		case RouterOptionReservedPeer:
+			reserved = append(reserved, ReservedPeer(v))
+		case RouterOptionSlowPeerPolicy:
+			slowPeers = slowPeerPolicy{
+				threshold: v.Threshold,
+				duration:  v.Duration,
+				action:    v.Action,
+			}
+		case RouterOptionHandshakeLimits:
+			handshakes = v
+		case RouterOptionAcceptLimits:
+			accept = v
+		case RouterOptionJumboFrames:
+			jumbo = jumboExponent(int(v))
+		case RouterOptionCompactFrames:
+			compact = bool(v)
+		case RouterOptionDelayTolerant:
+			custody = &custodyConfig{
+				maxBundles: custodyMaxBundles,
+				maxTTL:     custodyMaxTTL,
+			}
+			if v.MaxBundles > 0 {
+				custody.maxBundles = v.MaxBundles
+			}
+			if v.MaxTTL > 0 {
+				custody.maxTTL = v.MaxTTL
+			}
+		case RouterOptionNetworkID:
+			networkID = uint8(v)
+		case RouterOptionNetworkName:
+			networkName = string(v)
+		case RouterOptionLinkEncryption:
+			linkEncryption = &v
+		case RouterOptionLocality:
+			locality = string(v)
+		case RouterOptionNodeMetadata:
+			metadata = PeerMetadata(v)
+		case RouterOptionProtocolHistory:
+			if v != 0 {
+				history = int(v)
+			}
+		case RouterOptionStateLogging:
+			stateLogging = append(stateLogging, v)
+		case RouterOptionTagPolicy:
+			policies[v.Tag] = v
+		case RouterOptionDistrustMisbehavingRoots:
+			distrustRoots = time.Duration(v)
+		case RouterOptionRootPolicy:
+			if v.Policy != nil {
+				rootPolicy = v.Policy
+			}
+		case RouterOptionAdjacencyProofs:
+			adjacency = bool(v)
+		case RouterOptionMemoryBudget:
+			memory = uint64(v)
+		case RouterOptionLoadShedding:
+			loadShedding = newLoadShedConfig(v)
+		case RouterOptionLinkAggregation:
+			stripeLinks = bool(v)
+		case RouterOptionRouteTracing:
+			routeTracing = newRouteTraceConfig(v)
+		case RouterOptionFrameAnalyzer:
+			analyzer = newFrameAnalyzer(v)
+		case RouterOptionSelfHeal:
+			selfHeal = bool(v)
+		case RouterOptionHideNodeInfo:
+			hideNodeInfo = bool(v)
+		case RouterOptionDebugQueries:
+			if debugKeys == nil {
+				debugKeys = map[types.PublicKey]struct{}{}
+			}
+			for _, k := range v {
+				debugKeys[k] = struct{}{}
+			}
+		case RouterOptionLoopDemotion:
+			loopDemotion = bool(v)
+		case RouterOptionTrafficScheduler:
+			scheduler = v.Scheduler
+		case RouterOptionTrafficPriority:
+			priority = v
+		case RouterOptionAmplificationLimit:
+			amplification = newAmplificationConfig(v)
+		case RouterOptionTrafficPolicy:
+			policy = v
+		case RouterOptionTimeSync:
+			timeSync = time.Duration(v)
+			if timeSync <= 0 {
+				timeSync = timeSyncInterval
+			}
+		case RouterOptionForwardingLatency:
+			latency = bool(v)
+		case RouterOptionWireProfile:
+			profile = newWireProfile(v)
+		case RouterOptionAnnouncementDamping:
+			annDamping = time.Duration(v)
+		case RouterOptionStatsRetention:
+			retention = time.Duration(v)
+		case RouterOptionFaultInjection:
+			if faults == nil {
+				faults = newFaultInjector()
+			}
+			faults.configure(v)
+		case RouterOptionTimings:
+			timings = Timings(v)
+		case RouterOptionAggregateSignatures:
+			if len(v) > 0 {
+				aggregate = append(types.AggregateKey{}, v...)
+			}
+		case RouterOptionPeeringAuthority:
+			key := types.PublicKey(v)
+			authority = &key
+		case RouterOptionCertificateChain:
+			certificates = types.CertificateChain(v)
+		case RouterOptionRevocationAuthority:
+			key := types.PublicKey(v)
+			banAuthority = &key
+		case RouterOptionClock:
+			if v.Clock != nil {
+				clock = v.Clock
+			}
+		case RouterOptionWatchdog:
+			watchdog = time.Duration(v)
+		case RouterOptionQueueAlarm:
+			queueAlarm = queueAlarmConfig{
+				threshold: v.Threshold,
+				duration:  v.Duration,
+			}
+		case RouterOptionPeerKeepalives:
+			keepalives[ConnectionPeerType(v.PeerType)] = newKeepaliveConfig(v.Interval, v.MissTolerance)
+		case RouterOptionFastFailureDetection:
+			fastDetection.interval = fastFailureDetectionInterval
+			if v.Interval > 0 {
+				fastDetection.interval = v.Interval
+			}
+			if v.Multiplier > 0 {
+				fastDetection.multiplier = v.Multiplier
+			}
 		}
 	}
+	timings, clamped := timings.withDefaults()
+	if profile != nil {
+		jumbo = 0
+		for _, name := range profile.unknown {
+			logger.Println("WARNING: Ignoring unknown capability", name, "in the wire profile")
+		}
+	}
+	if locality != "" && !validLocality(locality) {
+		logger.Println("WARNING: Ignoring locality hint longer than", types.MaxLocalityLength, "bytes")
+		locality = ""
+	}
+	if !metadata.valid() {
+		logger.Println("WARNING: Ignoring node metadata longer than", maxMetadataLength, "bytes or not valid UTF-8")
+		metadata = PeerMetadata{}
+	}
 	ctx, cancel := context.WithCancel(context.Background())
 	_, insecure := os.LookupEnv("PINECONE_DISABLE_SIGNATURES")
 	r := &Router{
@@ -68,19 +343,95 @@ func NewRouter(logger types.Logger, sk ed25519.PrivateKey, opts ...RouterOption)
 		context:       ctx,
 		cancel:        cancel,
 		secure:        !insecure,
+		strict:        strict,
+		pruning:       pruning,
+		maxPeers:      maxPeers,
+		sendTimeout:   sendTimeout,
+		keepalives:    keepalives,
+		fastDetection: fastDetection,
+		queueAlarm:    queueAlarm,
+		watchdog:      watchdog,
+		slowPeers:     slowPeers,
+		handshakes:    newHandshakeLimiter(handshakes, clock),
+		accept:        newAcceptLimiter(accept, clock),
+		jumbo:         jumbo,
+		compact:       compact,
+		aggregate:     aggregate,
+		timings:       timings,
+		custody:       custody,
+		locality:      locality,
+		metadata:      metadata,
+		networkID:     networkID,
+		networkName:   networkName,
+		networkTag:    networkTagFor(networkName),
+		linkEncrypt:   linkEncryption != nil,
+		linkRequired:  linkEncryption != nil && linkEncryption.Required,
+		faults:        faults,
+		distrustRoots: distrustRoots,
+		rootPolicy:    rootPolicy,
+		adjacency:     adjacency,
+		memory:        newMemoryBudget(memory),
+		loadShedding:  loadShedding,
+		stripeLinks:   stripeLinks,
+		datagrams:     make(chan *types.Frame, datagramQueueSize),
+		routeTracing:  routeTracing,
+		timeSync:      timeSync,
+		selfHeal:      selfHeal,
+		hideNodeInfo:  hideNodeInfo,
+		debugKeys:     debugKeys,
+		loopDemotion:  loopDemotion,
+		scheduler:     scheduler,
+		latency:       latency,
+		wireProfile:   profile,
+		tagPolicies:   policies,
+		amplification: amplification,
+		annDamping:    annDamping,
+		authority:     authority,
+		certificates:  certificates,
+		banAuthority:  banAuthority,
 		_hopLimiting:  atomic.NewBool(false),
 		_readDeadline: atomic.NewTime(time.Now().Add(time.Hour * 24 * 365 * 100)), // ~100 years
 		_subscribers:  make(map[chan<- events.Event]*phony.Inbox),
+
+		announcementLimit: announcementLimit,
 	}
+	r.clock = wakeupClock{Clock: clock, wakeups: &r.energy.wakeups}
 	// Populate the node keys from the supplied private key.
 	copy(r.private[:], sk)
 	r.public = r.private.Public()
+	r.priority = newTrafficPriority(r.public, priority)
+	if r.authority != nil && len(r.certificates) == 0 {
+		r.log.Println("WARNING: A peering authority is configured but no certificate chain was given, so other nodes will refuse to peer with us")
+	}
+	for _, c := range clamped {
+		r.log.Println("WARNING: Configured", c, "to stay within the safe range")
+	}
+	if r.faults != nil {
+		r.log.Println("WARNING: Fault injection is enabled, so frames will be dropped, delayed, duplicated or corrupted")
+	}
 	// Create a state actor.
 	r.state = &state{
-		r:             r,
-		_table:        make(virtualSnakeTable),
-		_peers:        make([]*peer, portCount),
-		_filterPacket: nil,
+		r:                  r,
+		_table:             make(virtualSnakeTable),
+		_peers:             make([]*peer, portCount),
+		_filterPacket:      nil,
+		_handshakeFailures: make(map[types.PublicKey]uint64),
+		_reserved:          reserved,
+		_analyzer:          analyzer,
+		_rollups:           newStatsRollups(retention),
+		_history:           newProtocolHistory(history),
+		_stateLog:          newStateLogger(stateLogging),
+		_trafficPolicy:     newTrafficPolicy(policy),
+		_treeStats: treeStatsTracker{
+			started: clock.Now(),
+			root:    r.public,
+		},
+		_keyspace: keyspaceTracker{
+			started: clock.Now(),
+		},
+	}
+	if latency {
+		r.state._latency = newForwardLatency(clock)
 	}
 	// Create a new local peer and wire it into port 0.
 	r.local = r.newLocalPeer(blackhole)
@@ -92,12 +443,39 @@ func NewRouter(logger types.Logger, sk ed25519.PrivateKey, opts ...RouterOption)
 	return r
 }
 
+// ReservePeer reserves a peering slot for peerings matching the given
+// key or URI pattern, in the same way as RouterOptionReservedPeer.
+func (r *Router) ReservePeer(res ReservedPeer) {
+	phony.Block(r.state, func() {
+		r.state._reserved = append(r.state._reserved, res)
+	})
+}
+
+// IsReservedPeer returns true if a peering with the given key and URI
+// would be given a reserved slot.
+func (r *Router) IsReservedPeer(public types.PublicKey, uri string) bool {
+	var reserved bool
+	phony.Block(r.state, func() {
+		reserved = r.state._isReserved(public, ConnectionURI(uri))
+	})
+	return reserved
+}
+
 func (r *Router) InjectPacketFilter(fn FilterFn) {
 	phony.Block(r.state, func() {
 		r.state._filterPacket = fn
 	})
 }
 
+// InjectRouteFilter sets a function that is called with the next-hop
+// peering for each frame before it is forwarded, which can drop the frame
+// based on the tags attached to the peering.
+func (r *Router) InjectRouteFilter(fn RouteFilterFn) {
+	phony.Block(r.state, func() {
+		r.state._filterRoute = fn
+	})
+}
+
 func (r *Router) EnableWakeupBroadcasts() {
 	r.state.Act(r.state, func() {
 		r.state._sendBroadcastIn(0)
@@ -106,9 +484,7 @@ func (r *Router) EnableWakeupBroadcasts() {
 
 func (r *Router) DisableWakeupBroadcasts() {
 	r.state.Act(r.state, func() {
-		if !r.state._broadcastTimer.Stop() {
-			<-r.state._broadcastTimer.C
-		}
+		r.state._broadcastTimer.Stop()
 	})
 }
 
@@ -165,10 +541,33 @@ func (r *Router) Addr() net.Addr {
 // ConnectionPublicKey is specified, the connection will autonegotiate with the
 // remote peer to exchange public keys and version/capability information.
 func (r *Router) Connect(conn net.Conn, options ...ConnectionOption) (types.SwitchPortID, error) {
+	return r.ConnectWithContext(context.Background(), conn, options...)
+}
+
+// ConnectWithContext is like Connect, but the handshake is bounded by the
+// given context. If the context has a deadline that is sooner than the usual
+// handshake timeout then the handshake must complete by then, and if the
+// context is cancelled during the handshake then the connection is closed
+// and the handshake fails straight away. In a closed network this covers
+// the certificate exchange too. The context has no effect once the peering
+// is up.
+func (r *Router) ConnectWithContext(ctx context.Context, conn net.Conn, options ...ConnectionOption) (types.SwitchPortID, error) {
 	var public types.PublicKey
 	var uri ConnectionURI
 	var zone ConnectionZone
 	var peertype ConnectionPeerType
+	var fastDetection ConnectionFastFailureDetection
+	var tags PeerTags
+	var pacing *pacer
+	var egress *egressLimiter
+	var sockets ConnectionSocketOptions
+	var coalesce int
+	var mtu int
+	var jumbo int
+	var compact bool
+	var locality string
+	var handshook negotiated
+	var inbound bool
 	keepalives := true
 	for _, option := range options {
 		switch v := option.(type) {
@@ -182,60 +581,218 @@ func (r *Router) Connect(conn net.Conn, options ...ConnectionOption) (types.Swit
 			peertype = v
 		case ConnectionKeepalives:
 			keepalives = bool(v)
+		case ConnectionFastFailureDetection:
+			fastDetection = v
+		case ConnectionTag:
+			if tags == nil {
+				tags = PeerTags{}
+			}
+			tags[string(v)] = struct{}{}
+		case ConnectionPacingRate:
+			pacing = newPacer(uint64(v), r.clock.Now())
+		case ConnectionEgressLimit:
+			if v.Local > 0 || v.Transit > 0 {
+				egress = newEgressLimiter(v.Local, v.Transit, r.clock.Now())
+			}
+		case ConnectionSocketOptions:
+			sockets = v
+		case ConnectionWriteCoalescing:
+			coalesce = int(v)
+		case ConnectionMTU:
+			mtu = int(v)
+		case ConnectionInbound:
+			inbound = bool(v)
 		}
 	}
+	if inbound {
+		if err := r.accept.allow(); err != nil {
+			conn.Close()
+			return 0, err
+		}
+	}
+	if err := applySocketOptions(conn, sockets); err != nil {
+		conn.Close()
+		return 0, fmt.Errorf("applySocketOptions: %w", err)
+	}
+	if l, ok := conn.(LinkMTU); ok && mtu <= 0 {
+		mtu = l.LinkMTU()
+	}
+	if mtu > 0 {
+		// The handshake goes over the link too, so it must also fit.
+		conn = newLinkConn(conn, mtu)
+	}
 
 	var empty types.PublicKey
 	if public == empty {
+		if err := ctx.Err(); err != nil {
+			conn.Close()
+			return 0, fmt.Errorf("ctx.Err: %w", err)
+		}
+		release, err := r.handshakes.acquire(conn)
+		if err != nil {
+			conn.Close()
+			return 0, err
+		}
+		defer release()
+		// If the context is cancelled, closing the connection will
+		// unblock any reads or writes that are still in progress.
+		done, stopped := make(chan struct{}), make(chan struct{})
+		var once sync.Once
+		stopWatching := func() {
+			once.Do(func() {
+				close(done)
+				<-stopped
+			})
+		}
+		defer stopWatching()
+		go func(conn net.Conn) {
+			defer close(stopped)
+			select {
+			case <-ctx.Done():
+				conn.Close()
+			case <-done:
+			}
+		}(conn)
 		handshake := []byte{
 			ourVersion,
-			0, // unused
-			0, // unused
-			0, // unused
-			0, // capabilities
-			0, // capabilities
-			0, // capabilities
-			0, // capabilities
+			r.jumbo,          // largest jumbo payload, as a power of two
+			r.wireFeatures(), // optional wire features
+			r.networkID,      // network ID
+			0,                // capabilities
+			0,                // capabilities
+			0,                // capabilities
+			0,                // capabilities
 		}
-		binary.BigEndian.PutUint32(handshake[4:8], ourCapabilities)
+		binary.BigEndian.PutUint32(handshake[4:8], r.capabilities())
 		handshake = append(handshake, r.public[:ed25519.PublicKeySize]...)
-		handshake = append(handshake, ed25519.Sign(r.private[:], handshake)...)
-		if err := conn.SetDeadline(time.Now().Add(time.Second * 10)); err != nil {
+		handshake = append(handshake, r.sign(handshake)...)
+		if err := conn.SetDeadline(r.handshakes.deadline(ctx, r.handshakes.timeout)); err != nil {
 			return 0, fmt.Errorf("conn.SetDeadline: %w", err)
 		}
 		if _, err := conn.Write(handshake); err != nil {
 			conn.Close()
-			return 0, fmt.Errorf("conn.Write: %w", err)
+			return 0, fmt.Errorf("conn.Write: %w", handshakeError(ctx, err))
 		}
 		if _, err := io.ReadFull(conn, handshake); err != nil {
 			conn.Close()
-			return 0, fmt.Errorf("io.ReadFull: %w", err)
+			return 0, fmt.Errorf("io.ReadFull: %w", handshakeError(ctx, err))
 		}
 		if err := conn.SetDeadline(time.Time{}); err != nil {
 			return 0, fmt.Errorf("conn.SetDeadline: %w", err)
 		}
+		// Check the signature first, since we can only hold the remote
+		// node responsible for the rest of the handshake if we know that
+		// it really came from them.
+		var signature types.Signature
+		offset := 8
+		offset += copy(public[:], handshake[offset:offset+ed25519.PublicKeySize])
+		copy(signature[:], handshake[offset:offset+ed25519.SignatureSize])
+		if !r.verify(public[:], handshake[:offset], signature[:]) {
+			conn.Close()
+			return 0, ErrInvalidHandshake
+		}
 		if theirVersion := handshake[0]; theirVersion != ourVersion {
 			conn.Close()
-			return 0, fmt.Errorf("mismatched node version")
+			r.state.Act(nil, func() { r.state._recordHandshakeFailure(public) })
+			return 0, fmt.Errorf("%w: mismatched node version", ErrIncompatiblePeer)
 		}
-		if theirCapabilities := binary.BigEndian.Uint32(handshake[4:8]); theirCapabilities != ourCapabilities {
+		if theirNetwork := handshake[handshakeNetworkOffset]; theirNetwork != r.networkID {
 			conn.Close()
-			return 0, fmt.Errorf("mismatched node capabilities")
+			return 0, fmt.Errorf("%w: mismatched network %d", ErrIncompatiblePeer, theirNetwork)
 		}
-		var signature types.Signature
-		offset := 8
-		offset += copy(public[:], handshake[offset:offset+ed25519.PublicKeySize])
-		copy(signature[:], handshake[offset:offset+ed25519.SignatureSize])
-		if !ed25519.Verify(public[:], handshake[:offset], signature[:]) {
+		if theirCapabilities := binary.BigEndian.Uint32(handshake[4:8]); theirCapabilities != r.capabilities() {
+			conn.Close()
+			r.state.Act(nil, func() { r.state._recordHandshakeFailure(public) })
+			return 0, fmt.Errorf("%w: mismatched node capabilities", ErrIncompatiblePeer)
+		}
+		if (r.wireFeatures()^handshake[2])&handshakeNetworkName != 0 {
 			conn.Close()
-			return 0, fmt.Errorf("peer sent invalid signature")
+			return 0, fmt.Errorf("%w: only one node has a network name", ErrIncompatiblePeer)
 		}
+		if r.wireFeatures()&handshake[2]&handshakeNetworkName != 0 {
+			deadline := r.handshakes.deadline(ctx, r.handshakes.timeout)
+			if err := r.exchangeNetworkTag(conn, deadline); err != nil {
+				conn.Close()
+				return 0, fmt.Errorf("r.exchangeNetworkTag: %w", handshakeError(ctx, err))
+			}
+		}
+		if r.linkRequired && !r.linkEncrypted(handshake[2]) {
+			conn.Close()
+			return 0, fmt.Errorf("%w: peer doesn't encrypt the link", ErrIncompatiblePeer)
+		}
+		if r.linkEncrypted(handshake[2]) {
+			deadline := r.handshakes.deadline(ctx, r.handshakes.timeout)
+			encrypted, err := r.exchangeLinkKeys(conn, public, deadline)
+			if err != nil {
+				conn.Close()
+				return 0, fmt.Errorf("r.exchangeLinkKeys: %w", handshakeError(ctx, err))
+			}
+			conn = encrypted
+		}
+		handshook.version = handshake[0]
+		handshook.capabilities = binary.BigEndian.Uint32(handshake[4:8])
+		handshook.features = handshake[2]
+		jumbo = negotiateJumbo(r.jumbo, handshake[1])
+		compact = r.wireFeatures()&handshake[2]&handshakeCompactFrames != 0
+		if r.wireFeatures()&handshake[2]&handshakeLocality != 0 {
+			deadline := r.handshakes.deadline(ctx, r.handshakes.timeout)
+			var err error
+			if locality, err = r.exchangeLocality(conn, deadline); err != nil {
+				conn.Close()
+				return 0, fmt.Errorf("r.exchangeLocality: %w", handshakeError(ctx, err))
+			}
+		}
+		if r.wireFeatures()&handshake[2]&handshakeMetadata != 0 {
+			deadline := r.handshakes.deadline(ctx, r.handshakes.timeout)
+			var err error
+			signed := r.wireFeatures()&handshake[2]&handshakeSignedMetadata != 0
+			if handshook.metadata, handshook.signature, err = r.exchangeMetadata(conn, public, signed, deadline); err != nil {
+				conn.Close()
+				return 0, fmt.Errorf("r.exchangeMetadata: %w", handshakeError(ctx, err))
+			}
+		}
+		if r.wireFeatures()&handshake[2]&handshakeKeepalives != 0 {
+			deadline := r.handshakes.deadline(ctx, r.handshakes.timeout)
+			var err error
+			interval := r.keepaliveConfigFor(peertype).interval
+			if handshook.keepalive, err = r.exchangeKeepalives(conn, interval, deadline); err != nil {
+				conn.Close()
+				return 0, fmt.Errorf("r.exchangeKeepalives: %w", handshakeError(ctx, err))
+			}
+		}
+		if r.authority != nil {
+			deadline := r.handshakes.deadline(ctx, r.handshakes.certTimeout)
+			if err := r.exchangeCertificates(conn, public, deadline); err != nil {
+				conn.Close()
+				if herr := handshakeError(ctx, err); herr != err {
+					return 0, fmt.Errorf("r.exchangeCertificates: %w", herr)
+				}
+				r.state.Act(nil, func() { r.state._recordHandshakeFailure(public) })
+				return 0, fmt.Errorf("%w: %s", ErrNotAuthorized, err)
+			}
+		}
+		// Once the watcher has stopped, the context can no longer
+		// close the connection from under the peering.
+		stopWatching()
+		if err := ctx.Err(); err != nil {
+			conn.Close()
+			return 0, fmt.Errorf("ctx.Err: %w", err)
+		}
+	} else if r.linkRequired {
+		// Without the handshake, there's nothing to agree keys with.
+		conn.Close()
+		return 0, fmt.Errorf("%w: link encryption needs the handshake", ErrIncompatiblePeer)
 	}
 
 	port := types.SwitchPortID(0)
 	var err error
 	phony.Block(r.state, func() {
-		port, err = r.state._addPeer(conn, public, uri, zone, peertype, keepalives)
+		if inbound {
+			if err = r.state._checkSourceLimit(conn); err != nil {
+				return
+			}
+		}
+		port, err = r.state._addPeer(conn, public, uri, zone, peertype, keepalives, fastDetection, tags, pacing, egress, coalesce, jumbo, compact, locality, handshook)
 	})
 	if err != nil {
 		return types.SwitchPortID(0), fmt.Errorf("_addPeer: %w", err)
@@ -243,6 +800,20 @@ func (r *Router) Connect(conn net.Conn, options ...ConnectionOption) (types.Swit
 	return port, nil
 }
 
+// handshakeError returns the context's error in place of the given error if
+// the context was cancelled or expired, since that is the real reason why
+// the handshake failed, or ErrHandshakeTimeout if the connection deadline
+// passed.
+func handshakeError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return ErrHandshakeTimeout
+	}
+	return err
+}
+
 // Disconnect will disconnect whatever is connected to the
 // given port number on the Pinecone node. The peering will
 // no longer be used and the underlying connection will be
@@ -258,6 +829,24 @@ func (r *Router) Disconnect(i types.SwitchPortID, err error) {
 	})
 }
 
+// IsPeered returns true if we have a running peering of the given
+// peer type with the node, in any zone, or of any type if the peer
+// type is negative.
+func (r *Router) IsPeered(key types.PublicKey, peertype int) (peered bool) {
+	phony.Block(r.state, func() {
+		for _, p := range r.state._peers {
+			if p == nil || p.port == 0 || p.public != key || !p.started.Load() {
+				continue
+			}
+			if int(p.peertype) == peertype || peertype < 0 {
+				peered = true
+				return
+			}
+		}
+	})
+	return
+}
+
 // PeerCount returns the number of nodes that are directly
 // connected to this Pinecone node.
 func (r *Router) PeerCount(peertype int) (count int) {
@@ -0,0 +1,182 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routertest
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Pipe returns the two ends of an in-memory connection. Unlike net.Pipe,
+// writes are buffered and never block, so both routers can send their
+// handshakes at the same time, as they would over a real network. Read
+// deadlines are supported. Closing either end closes the connection.
+func Pipe() (net.Conn, net.Conn) {
+	ab, ba := newPipeBuffer(), newPipeBuffer()
+	a := &pipeConn{rx: ba, tx: ab, local: pipeAddr("a"), remote: pipeAddr("b")}
+	b := &pipeConn{rx: ab, tx: ba, local: pipeAddr("b"), remote: pipeAddr("a")}
+	a.deadlineChanged = make(chan struct{})
+	b.deadlineChanged = make(chan struct{})
+	return a, b
+}
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "pipe" }
+func (a pipeAddr) String() string  { return string(a) }
+
+// pipeBuffer holds the data travelling in one direction.
+type pipeBuffer struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer  // protected by mutex
+	closed bool          // protected by mutex
+	notify chan struct{} // closed when data arrives or the pipe closes
+}
+
+func newPipeBuffer() *pipeBuffer {
+	return &pipeBuffer{
+		notify: make(chan struct{}),
+	}
+}
+
+// wake tells any waiting readers that something has changed. The mutex
+// must be held.
+func (p *pipeBuffer) wake() {
+	close(p.notify)
+	p.notify = make(chan struct{})
+}
+
+func (p *pipeBuffer) close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if !p.closed {
+		p.closed = true
+		p.wake()
+	}
+}
+
+type pipeConn struct {
+	rx, tx          *pipeBuffer
+	local, remote   pipeAddr
+	mutex           sync.Mutex
+	readDeadline    time.Time     // protected by mutex
+	writeDeadline   time.Time     // protected by mutex
+	deadlineChanged chan struct{} // protected by mutex
+}
+
+func (c *pipeConn) Read(b []byte) (int, error) {
+	for {
+		c.rx.mutex.Lock()
+		if c.rx.buffer.Len() > 0 {
+			n, _ := c.rx.buffer.Read(b)
+			c.rx.mutex.Unlock()
+			return n, nil
+		}
+		if c.rx.closed {
+			c.rx.mutex.Unlock()
+			return 0, io.EOF
+		}
+		notify := c.rx.notify
+		c.rx.mutex.Unlock()
+
+		c.mutex.Lock()
+		deadline, changed := c.readDeadline, c.deadlineChanged
+		c.mutex.Unlock()
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		if !c.wait(notify, changed, deadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+// wait blocks until there is something new to read, the deadlines change
+// or the read deadline passes, returning false in the last case.
+func (c *pipeConn) wait(notify, changed <-chan struct{}, deadline time.Time) bool {
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case <-notify:
+	case <-changed:
+	case <-expired:
+		return false
+	}
+	return true
+}
+
+func (c *pipeConn) Write(b []byte) (int, error) {
+	c.mutex.Lock()
+	deadline := c.writeDeadline
+	c.mutex.Unlock()
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	c.tx.mutex.Lock()
+	defer c.tx.mutex.Unlock()
+	if c.tx.closed {
+		return 0, io.ErrClosedPipe
+	}
+	c.tx.buffer.Write(b)
+	c.tx.wake()
+	return len(b), nil
+}
+
+func (c *pipeConn) Close() error {
+	c.tx.close()
+	c.rx.close()
+	return nil
+}
+
+func (c *pipeConn) LocalAddr() net.Addr  { return c.local }
+func (c *pipeConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *pipeConn) SetDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.readDeadline, c.writeDeadline = t, t
+	c.deadlineUpdated()
+	return nil
+}
+
+func (c *pipeConn) SetReadDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.readDeadline = t
+	c.deadlineUpdated()
+	return nil
+}
+
+func (c *pipeConn) SetWriteDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.writeDeadline = t
+	return nil
+}
+
+// deadlineUpdated wakes up any blocked reads so that they pick up the new
+// read deadline. The mutex must be held.
+func (c *pipeConn) deadlineUpdated() {
+	close(c.deadlineChanged)
+	c.deadlineChanged = make(chan struct{})
+}
@@ -0,0 +1,333 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package routertest provides helpers for integration tests that run a
+// small Pinecone network inside the test process. The routers are peered
+// with in-memory connections, which carry the full handshake, so they
+// behave in the same way as routers peered over a real network.
+package routertest
+
+import (
+	"context"
+	"crypto/ed25519"
+	crand "crypto/rand"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/router"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// DefaultTimeout is how long the helpers wait for the network to converge
+// or for a node to become reachable, if no other timeout is given.
+const DefaultTimeout = time.Second * 30
+
+// pollInterval is how often the helpers check whether the network has
+// reached the expected state.
+const pollInterval = time.Millisecond * 50
+
+// Network is a set of routers running in the test process. The routers are
+// closed when the test finishes.
+type Network struct {
+	t       testing.TB
+	Routers []*router.Router
+	mutex   sync.Mutex
+	links   map[[2]int]types.SwitchPortID // protected by mutex
+}
+
+// NewNetwork starts the given number of routers with the given options,
+// each with a new identity. The routers aren't peered with each other.
+func NewNetwork(t testing.TB, count int, opts ...router.RouterOption) *Network {
+	t.Helper()
+	return newNetwork(t, count, crand.Reader, opts...)
+}
+
+// NewSeededNetwork is like NewNetwork, but the identities of the routers
+// are derived from the seed, so that the same seed always gives the same
+// keys and therefore the same tree root and keyspace order.
+func NewSeededNetwork(t testing.TB, count int, seed int64, opts ...router.RouterOption) *Network {
+	t.Helper()
+	return newNetwork(t, count, rand.New(rand.NewSource(seed)), opts...)
+}
+
+func newNetwork(t testing.TB, count int, keys io.Reader, opts ...router.RouterOption) *Network {
+	t.Helper()
+	n := &Network{
+		t:       t,
+		Routers: make([]*router.Router, 0, count),
+		links:   map[[2]int]types.SwitchPortID{},
+	}
+	for i := 0; i < count; i++ {
+		_, sk, err := ed25519.GenerateKey(keys)
+		if err != nil {
+			t.Fatalf("ed25519.GenerateKey: %s", err)
+		}
+		r := router.NewRouter(nil, sk, opts...)
+		t.Cleanup(func() { _ = r.Close() })
+		n.Routers = append(n.Routers, r)
+	}
+	return n
+}
+
+// NewLine starts the given number of routers and peers each one with the
+// next, so that they form a line.
+func NewLine(t testing.TB, count int, opts ...router.RouterOption) *Network {
+	t.Helper()
+	n := NewNetwork(t, count, opts...)
+	for i := 1; i < count; i++ {
+		n.Connect(i-1, i)
+	}
+	return n
+}
+
+// NewMesh starts the given number of routers and peers every router with
+// every other router.
+func NewMesh(t testing.TB, count int, opts ...router.RouterOption) *Network {
+	t.Helper()
+	n := NewNetwork(t, count, opts...)
+	for i := 0; i < count; i++ {
+		for j := i + 1; j < count; j++ {
+			n.Connect(i, j)
+		}
+	}
+	return n
+}
+
+// Connect peers the routers with the given indices over an in-memory
+// connection, failing the test if the peering can't be set up.
+func (n *Network) Connect(a, b int, options ...router.ConnectionOption) {
+	n.t.Helper()
+	if err := n.TryConnect(a, b, options...); err != nil {
+		n.t.Fatal(err)
+	}
+}
+
+// TryConnect peers the routers with the given indices over an in-memory
+// connection, returning an error if the peering can't be set up.
+func (n *Network) TryConnect(a, b int, options ...router.ConnectionOption) error {
+	ca, cb := Pipe()
+	var wg sync.WaitGroup
+	var portA, portB types.SwitchPortID
+	var errA, errB error
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		portA, errA = n.Routers[a].Connect(ca, options...)
+	}()
+	go func() {
+		defer wg.Done()
+		portB, errB = n.Routers[b].Connect(cb, options...)
+	}()
+	wg.Wait()
+	if errA != nil || errB != nil {
+		_ = ca.Close()
+		return fmt.Errorf("failed to peer router %d with router %d: %v, %v", a, b, errA, errB)
+	}
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.links[[2]int{a, b}] = portA
+	n.links[[2]int{b, a}] = portB
+	return nil
+}
+
+// Disconnect tears down the peering between the routers with the given
+// indices, if there is one.
+func (n *Network) Disconnect(a, b int) {
+	n.mutex.Lock()
+	portA, ok := n.links[[2]int{a, b}]
+	delete(n.links, [2]int{a, b})
+	delete(n.links, [2]int{b, a})
+	n.mutex.Unlock()
+	if ok {
+		n.Routers[a].Disconnect(portA, fmt.Errorf("disconnected by test"))
+	}
+}
+
+// Converged returns true if the routers agree on their neighbours in the
+// SNEK, which means that every router can reach every other router. It
+// expects all of the routers to be peered into a single network.
+func (n *Network) Converged() bool {
+	sorted := make([]*router.Router, len(n.Routers))
+	copy(sorted, n.Routers)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].PublicKey().CompareTo(sorted[j].PublicKey()) < 0
+	})
+	for i, r := range sorted {
+		asc, ascOK := r.Ascending()
+		desc, descOK := r.Descending()
+		switch {
+		case i < len(sorted)-1 && (!ascOK || asc.PublicKey != sorted[i+1].PublicKey()):
+			return false
+		case i == len(sorted)-1 && ascOK:
+			return false
+		case i > 0 && (!descOK || desc.PublicKey != sorted[i-1].PublicKey()):
+			return false
+		case i == 0 && descOK:
+			return false
+		}
+	}
+	return true
+}
+
+// WaitForConvergence waits until the network has converged, failing the
+// test if it doesn't do so within the timeout. A zero timeout means
+// DefaultTimeout.
+func (n *Network) WaitForConvergence(timeout time.Duration) {
+	n.t.Helper()
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	for !n.Converged() {
+		if time.Now().After(deadline) {
+			n.t.Fatalf("network of %d routers didn't converge within %s", len(n.Routers), timeout)
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// Reachable returns true if the router with the index a can look up the
+// router with the index b within the timeout.
+func (n *Network) Reachable(a, b int, timeout time.Duration) bool {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for {
+		attempt, cancelAttempt := context.WithTimeout(ctx, time.Second)
+		result, err := n.Routers[a].Lookup(attempt, n.Routers[b].PublicKey())
+		cancelAttempt()
+		if err == nil && result.Reachable {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// AssertReachable fails the test if the router with the index a can't look
+// up the router with the index b within the timeout. A zero timeout means
+// DefaultTimeout.
+func (n *Network) AssertReachable(a, b int, timeout time.Duration) {
+	n.t.Helper()
+	if !n.Reachable(a, b, timeout) {
+		n.t.Fatalf("router %d can't reach router %d", a, b)
+	}
+}
+
+// AssertUnreachable fails the test if the router with the index a can look
+// up the router with the index b within the timeout. A zero timeout means
+// DefaultTimeout, so it is worth giving a shorter one.
+func (n *Network) AssertUnreachable(a, b int, timeout time.Duration) {
+	n.t.Helper()
+	if n.Reachable(a, b, timeout) {
+		n.t.Fatalf("router %d can unexpectedly reach router %d", a, b)
+	}
+}
+
+// AssertAllReachable fails the test unless every router can reach every
+// other router.
+func (n *Network) AssertAllReachable(timeout time.Duration) {
+	n.t.Helper()
+	for a := range n.Routers {
+		for b := range n.Routers {
+			if a != b {
+				n.AssertReachable(a, b, timeout)
+			}
+		}
+	}
+}
+
+// TimelineEvent is an event from the protocol history of one of the routers.
+type TimelineEvent struct {
+	Router int // The index of the router that recorded the event
+	router.ProtocolEvent
+}
+
+// PathTimeline collects the events that belong to the given path from the
+// protocol history of every router, in time order, so that a bootstrap can
+// be followed through the network to see where it went and which router
+// rejected it, if any.
+func (n *Network) PathTimeline(path router.PathID) []TimelineEvent {
+	var timeline []TimelineEvent
+	for i, r := range n.Routers {
+		for _, e := range r.PathTimeline(path) {
+			timeline = append(timeline, TimelineEvent{Router: i, ProtocolEvent: e})
+		}
+	}
+	sort.SliceStable(timeline, func(i, j int) bool {
+		return timeline[i].Time.Before(timeline[j].Time)
+	})
+	return timeline
+}
+
+// VerifySNEK checks the SNEK state of all of the routers against each
+// other, as router.VerifySNEK does.
+func (n *Network) VerifySNEK() []router.SNEKViolation {
+	nodes := make([]router.SNEKVerifiable, len(n.Routers))
+	for i, r := range n.Routers {
+		nodes[i] = r
+	}
+	return router.VerifySNEK(nodes)
+}
+
+// AssertSNEKInvariants waits for VerifySNEK to find nothing wrong with the
+// network, failing the test with the violations that it last found and
+// the history that led to them if it doesn't within the timeout. A zero
+// timeout means DefaultTimeout. Paths that were left behind by earlier
+// bootstraps only go away when they expire, so the timeout should be
+// longer than the path expiry.
+func (n *Network) AssertSNEKInvariants(timeout time.Duration) {
+	n.t.Helper()
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	if err := (SNEKInvariants{timeout}).Check(n); err != nil {
+		n.t.Fatalf("SNEK %s", err)
+	}
+}
+
+// describeViolations formats violations and their history using the
+// indices of the routers rather than their keys.
+func (n *Network) describeViolations(violations []router.SNEKViolation) string {
+	index := make(map[types.PublicKey]int, len(n.Routers))
+	for i, r := range n.Routers {
+		index[r.PublicKey()] = i
+	}
+	var b strings.Builder
+	for _, v := range violations {
+		fmt.Fprintf(&b, "router %d: %s\n", index[v.Node], v)
+		for _, e := range v.History {
+			fmt.Fprintf(&b, "    %s router %d: %s", e.Time.Format("15:04:05.000"), index[e.Node], e.Kind)
+			if e.Path != nil {
+				fmt.Fprintf(&b, " %s", e.Path)
+			}
+			if e.Reason != "" {
+				fmt.Fprintf(&b, " (%s)", e.Reason)
+			}
+			b.WriteString("\n")
+		}
+	}
+	return b.String()
+}
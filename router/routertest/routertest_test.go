@@ -0,0 +1,151 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routertest
+
+import (
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/router"
+)
+
+func TestPipe(t *testing.T) {
+	a, b := Pipe()
+
+	// Writes don't wait for the other end to read.
+	if _, err := a.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Write([]byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	if n, err := b.Read(buf); err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("expected hello, got %q (%v)", buf[:n], err)
+	}
+	if n, err := a.Read(buf); err != nil || string(buf[:n]) != "world" {
+		t.Fatalf("expected world, got %q (%v)", buf[:n], err)
+	}
+
+	// Reads time out at the deadline.
+	_ = a.SetReadDeadline(time.Now().Add(time.Millisecond * 50))
+	if _, err := a.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected deadline to be exceeded, got %v", err)
+	}
+
+	// Clearing the deadline wakes up a blocked read so that it waits
+	// for data instead.
+	_ = a.SetReadDeadline(time.Now().Add(time.Hour))
+	done := make(chan error, 1)
+	go func() {
+		_, err := a.Read(buf)
+		done <- err
+	}()
+	_ = a.SetReadDeadline(time.Now().Add(time.Millisecond * 50))
+	select {
+	case err := <-done:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("expected deadline to be exceeded, got %v", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatalf("read didn't pick up the new deadline")
+	}
+
+	// Closing one end closes both.
+	_ = a.SetReadDeadline(time.Time{})
+	_ = b.Close()
+	if _, err := a.Read(buf); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+	if _, err := a.Write([]byte("again")); err == nil {
+		t.Fatalf("expected write to a closed pipe to fail")
+	}
+}
+
+func TestLine(t *testing.T) {
+	n := NewLine(t, 4)
+	n.WaitForConvergence(0)
+	n.AssertAllReachable(0)
+
+	// Cutting the line in the middle splits the network.
+	n.Disconnect(1, 2)
+	n.AssertUnreachable(0, 3, time.Second*3)
+	n.Connect(1, 2)
+	n.AssertReachable(0, 3, 0)
+}
+
+func TestSNEKInvariants(t *testing.T) {
+	n := NewMesh(t, 5, router.RouterOptionTimings{
+		SNEKMaintainInterval: time.Millisecond * 200,
+		BootstrapInterval:    time.Second,
+		PathExpiry:           time.Second * 2,
+	})
+	n.WaitForConvergence(0)
+	n.AssertSNEKInvariants(0)
+}
+
+func TestConformance(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping conformance scenarios in short mode")
+	}
+	for _, s := range Conformance {
+		Run(t, s)
+	}
+}
+
+func TestPathTimeline(t *testing.T) {
+	n := NewLine(t, 3)
+	n.WaitForConvergence(0)
+
+	// Follow the most recent bootstrap from the lowest key to the node that
+	// took it as its descending node.
+	lowest := 0
+	for i, r := range n.Routers {
+		if r.PublicKey().CompareTo(n.Routers[lowest].PublicKey()) < 0 {
+			lowest = i
+		}
+	}
+	sent := n.Routers[lowest].ProtocolHistory(router.ProtocolHistoryQuery{Kind: router.ProtocolBootstrapSent})
+	if len(sent) == 0 || sent[len(sent)-1].Path == nil {
+		t.Fatalf("expected the lowest key to have sent a bootstrap")
+	}
+	path := *sent[len(sent)-1].Path
+	deadline := time.Now().Add(time.Second * 10)
+	for {
+		timeline := n.PathTimeline(path)
+		var confirmed bool
+		for _, e := range timeline {
+			if e.Path == nil || *e.Path != path {
+				t.Fatalf("expected only events for path %s, got %+v", path, e)
+			}
+			if e.Kind == router.ProtocolBootstrapConfirmed && e.Router == lowest {
+				confirmed = true
+			}
+		}
+		if confirmed {
+			if timeline[0].Kind != router.ProtocolBootstrapSent || timeline[0].Router != lowest {
+				t.Fatalf("expected the timeline to start with the bootstrap being sent, got %+v", timeline[0])
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the bootstrap to be confirmed, got %+v", timeline)
+		}
+		time.Sleep(pollInterval)
+	}
+}
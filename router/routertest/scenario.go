@@ -0,0 +1,276 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routertest
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/router"
+)
+
+// A scenario builds a topology and then runs through a list of steps, each
+// of which applies some events to the network, such as links going up or
+// down, and then checks that the network has the expected properties. The
+// identities of the routers come from the seed of the scenario, so the
+// tree root and keyspace order are the same on every run, and events are
+// always applied in the same order. Scenarios can be used to check that a
+// change to the protocol doesn't break its basic guarantees, and the ones
+// in Conformance are run by this repository's tests.
+
+// Scenario describes a network and what should happen to it.
+type Scenario struct {
+	Name    string
+	Nodes   int
+	Links   [][2]int // Links between nodes, by index, at the start
+	Seed    int64    // Seed for the identities of the nodes
+	Options []router.RouterOption
+	Steps   []Step
+}
+
+// Step applies some events to the network and then checks properties.
+type Step struct {
+	Name   string
+	Events []Event
+	Expect []Property
+}
+
+// Event is something that happens to the network.
+type Event interface {
+	Apply(n *Network) error
+	String() string
+}
+
+// Property is something that should be true of the network. Properties
+// are allowed some time to become true, since the network needs time to
+// react to events.
+type Property interface {
+	Check(n *Network) error
+	String() string
+}
+
+// Run runs the scenario as a subtest of the given test.
+func Run(t *testing.T, s Scenario) {
+	t.Run(s.Name, func(t *testing.T) {
+		n := NewSeededNetwork(t, s.Nodes, s.Seed, s.Options...)
+		for _, link := range s.Links {
+			n.Connect(link[0], link[1])
+		}
+		for i, step := range s.Steps {
+			name := step.Name
+			if name == "" {
+				name = fmt.Sprintf("step %d", i)
+			}
+			for _, event := range step.Events {
+				if err := event.Apply(n); err != nil {
+					t.Fatalf("%s: %s: %s", name, event, err)
+				}
+			}
+			for _, property := range step.Expect {
+				if err := property.Check(n); err != nil {
+					t.Fatalf("%s: %s: %s", name, property, err)
+				}
+			}
+		}
+	})
+}
+
+// AddLink peers two nodes.
+type AddLink struct{ A, B int }
+
+func (e AddLink) Apply(n *Network) error { return n.TryConnect(e.A, e.B) }
+func (e AddLink) String() string         { return fmt.Sprintf("AddLink{%d, %d}", e.A, e.B) }
+
+// RemoveLink tears down the peering between two nodes.
+type RemoveLink struct{ A, B int }
+
+func (e RemoveLink) Apply(n *Network) error {
+	n.Disconnect(e.A, e.B)
+	return nil
+}
+func (e RemoveLink) String() string { return fmt.Sprintf("RemoveLink{%d, %d}", e.A, e.B) }
+
+// Wait lets time pass before the next event.
+type Wait struct{ Duration time.Duration }
+
+func (e Wait) Apply(n *Network) error {
+	time.Sleep(e.Duration)
+	return nil
+}
+func (e Wait) String() string { return fmt.Sprintf("Wait{%s}", e.Duration) }
+
+// Converged expects the SNEK to converge within the given time, which
+// means that every node has found its neighbours in keyspace. It only
+// makes sense if all of the nodes are peered into one network.
+type Converged struct{ Within time.Duration }
+
+func (p Converged) Check(n *Network) error {
+	deadline := time.Now().Add(p.Within)
+	for !n.Converged() {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("didn't converge")
+		}
+		time.Sleep(pollInterval)
+	}
+	return nil
+}
+func (p Converged) String() string { return fmt.Sprintf("Converged{%s}", p.Within) }
+
+// SNEKInvariants expects router.VerifySNEK to find nothing wrong with the
+// network within the given time. Unlike Converged, it works when the nodes
+// are split into more than one network.
+type SNEKInvariants struct{ Within time.Duration }
+
+func (p SNEKInvariants) Check(n *Network) error {
+	deadline := time.Now().Add(p.Within)
+	for {
+		violations := n.VerifySNEK()
+		if len(violations) == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("invariants violated:\n%s", n.describeViolations(violations))
+		}
+		time.Sleep(pollInterval)
+	}
+}
+func (p SNEKInvariants) String() string { return fmt.Sprintf("SNEKInvariants{%s}", p.Within) }
+
+// AllReachable expects every node to be able to reach every other node,
+// with all of the lookups finishing within the given time.
+type AllReachable struct{ Within time.Duration }
+
+func (p AllReachable) Check(n *Network) error {
+	deadline := time.Now().Add(p.Within)
+	for a := range n.Routers {
+		for b := range n.Routers {
+			if a == b {
+				continue
+			}
+			if !n.Reachable(a, b, time.Until(deadline)) {
+				return fmt.Errorf("node %d can't reach node %d", a, b)
+			}
+		}
+	}
+	return nil
+}
+func (p AllReachable) String() string { return fmt.Sprintf("AllReachable{%s}", p.Within) }
+
+// Reachable expects one node to be able to reach another within the given
+// time.
+type Reachable struct {
+	From, To int
+	Within   time.Duration
+}
+
+func (p Reachable) Check(n *Network) error {
+	if !n.Reachable(p.From, p.To, p.Within) {
+		return fmt.Errorf("node %d can't reach node %d", p.From, p.To)
+	}
+	return nil
+}
+func (p Reachable) String() string {
+	return fmt.Sprintf("Reachable{%d, %d, %s}", p.From, p.To, p.Within)
+}
+
+// Unreachable expects one node not to be able to reach another for the
+// given time, e.g. because they are in different partitions.
+type Unreachable struct {
+	From, To int
+	For      time.Duration
+}
+
+func (p Unreachable) Check(n *Network) error {
+	if n.Reachable(p.From, p.To, p.For) {
+		return fmt.Errorf("node %d can reach node %d", p.From, p.To)
+	}
+	return nil
+}
+func (p Unreachable) String() string {
+	return fmt.Sprintf("Unreachable{%d, %d, %s}", p.From, p.To, p.For)
+}
+
+// Conformance is a set of scenarios that every version of the protocol
+// should pass.
+var Conformance = []Scenario{
+	{
+		Name:  "Line",
+		Nodes: 5,
+		Links: [][2]int{{0, 1}, {1, 2}, {2, 3}, {3, 4}},
+		Seed:  1,
+		Steps: []Step{
+			{
+				Name:   "converge",
+				Expect: []Property{Converged{time.Second * 30}, AllReachable{time.Second * 30}},
+			},
+		},
+	},
+	{
+		Name:  "RingHealsAfterCut",
+		Nodes: 6,
+		Links: [][2]int{{0, 1}, {1, 2}, {2, 3}, {3, 4}, {4, 5}, {5, 0}},
+		Seed:  2,
+		Steps: []Step{
+			{
+				Name:   "converge",
+				Expect: []Property{Converged{time.Second * 30}, AllReachable{time.Second * 30}},
+			},
+			{
+				Name:   "cut",
+				Events: []Event{RemoveLink{0, 1}},
+				Expect: []Property{AllReachable{time.Second * 30}},
+			},
+		},
+	},
+	{
+		Name:  "PartitionAndMerge",
+		Nodes: 6,
+		Links: [][2]int{{0, 1}, {1, 2}, {2, 3}, {3, 4}, {4, 5}},
+		Seed:  3,
+		Steps: []Step{
+			{
+				Name:   "converge",
+				Expect: []Property{Converged{time.Second * 30}},
+			},
+			{
+				Name:   "partition",
+				Events: []Event{RemoveLink{2, 3}},
+				Expect: []Property{
+					Reachable{0, 2, time.Second * 30},
+					Reachable{5, 3, time.Second * 30},
+					Unreachable{0, 5, time.Second * 3},
+				},
+			},
+			{
+				Name:   "merge",
+				Events: []Event{AddLink{0, 5}},
+				Expect: []Property{Converged{time.Second * 30}, AllReachable{time.Second * 30}},
+			},
+		},
+	},
+	{
+		Name:  "Star",
+		Nodes: 6,
+		Links: [][2]int{{0, 1}, {0, 2}, {0, 3}, {0, 4}, {0, 5}},
+		Seed:  4,
+		Steps: []Step{
+			{
+				Name:   "converge",
+				Expect: []Property{Converged{time.Second * 30}, AllReachable{time.Second * 30}},
+			},
+		},
+	},
+}
@@ -0,0 +1,206 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+// With RouterOptionRouteTracing, a sample of the frames that we route are
+// traced: the tree and SNEK next-hop rules are run again with the
+// explanation enabled, in the same way as NextHop does, and each candidate
+// that a rule picked is recorded along with the next-hop that was chosen
+// in the end. Traces are kept for each destination key, so that developers
+// can see why frames for a node went where they did, and compare the
+// decisions before and after a change to the routing rules. Only the most
+// recent traces for the most recently traced destinations are kept.
+
+// routeTraceDefaultLimit is how many traces are kept for each destination
+// if the option doesn't say.
+const routeTraceDefaultLimit = 16
+
+// routeTraceMaxDestinations is how many destinations we keep traces for.
+const routeTraceMaxDestinations = 256
+
+// RouteTraceStep is a candidate that one of the routing rules picked while
+// a frame was being routed.
+type RouteTraceStep struct {
+	Tree      bool               // Picked by the tree rules, otherwise by the SNEK rules
+	Port      types.SwitchPortID // The port of the peering
+	PublicKey types.PublicKey    // The key of the peer
+	Towards   types.PublicKey    // The key that the peering leads to, for SNEK routing
+	Distance  int64              // The tree distance to the destination, for tree routing
+	Rule      string             // Why the candidate was picked
+}
+
+// RouteTrace records how a frame was routed.
+type RouteTrace struct {
+	Time        time.Time
+	Type        types.FrameType
+	From        types.SwitchPortID // The port that the frame came from, zero if it was ours
+	Destination types.PublicKey
+	Coordinates types.Coordinates  // The destination coordinates, if any
+	Steps       []RouteTraceStep   // The candidates picked, in order
+	Found       bool               // Was a next-hop found at all?
+	Port        types.SwitchPortID // The port of the chosen next-hop
+	PublicKey   types.PublicKey    // The key of the chosen next-hop
+}
+
+// routeTraceConfig holds the settings from RouterOptionRouteTracing.
+type routeTraceConfig struct {
+	sampleEvery uint64
+	limit       int
+}
+
+func newRouteTraceConfig(o RouterOptionRouteTracing) *routeTraceConfig {
+	if o.SampleEvery <= 0 {
+		return nil
+	}
+	c := &routeTraceConfig{
+		sampleEvery: uint64(o.SampleEvery),
+		limit:       o.Limit,
+	}
+	if c.limit <= 0 {
+		c.limit = routeTraceDefaultLimit
+	}
+	return c
+}
+
+// routeTracer holds the traces taken so far.
+type routeTracer struct {
+	count  uint64
+	traces map[types.PublicKey][]RouteTrace
+}
+
+// _traceRoute traces the routing of the frame if it is sampled. It must be
+// called before the frame is routed, since the destination coordinates are
+// cleared when tree routing fails.
+func (s *state) _traceRoute(from *peer, f *types.Frame) {
+	config := s.r.routeTracing
+	if config == nil {
+		return
+	}
+	switch f.Type {
+	case types.TypeTraffic, types.TypeEchoRequest, types.TypeEchoReply, types.TypeContinuity, types.TypeBootstrapConfirm, types.TypeCustody, types.TypeCustodyReceipt, types.TypeSNEKAdjacency, types.TypeNodeInfoRequest, types.TypeNodeInfoResponse, types.TypeDebugRequest, types.TypeDebugResponse, types.TypeSearchRequest, types.TypeSearchResponse, types.TypeBootstrap:
+	default:
+		return
+	}
+	if s._routeTracer == nil {
+		s._routeTracer = &routeTracer{
+			traces: map[types.PublicKey][]RouteTrace{},
+		}
+	}
+	tracer := s._routeTracer
+	tracer.count++
+	if tracer.count%config.sampleEvery != 0 {
+		return
+	}
+
+	trace := RouteTrace{
+		Time:        s.r.clock.Now(),
+		Type:        f.Type,
+		Destination: f.DestinationKey,
+	}
+	if from != nil && from != s.r.local {
+		trace.From = from.port
+	}
+	var nexthop *peer
+	if len(f.Destination) > 0 && f.Type != types.TypeBootstrap {
+		trace.Coordinates = append(types.Coordinates{}, f.Destination...)
+		nexthop = explainNextHopTree(treeNextHopParams{
+			f.Destination,
+			s._coords(),
+			from,
+			s.r.local,
+			s._rootAnnouncement(),
+			&s._announcements,
+		}, func(p *peer, distance int64, rule string) {
+			trace.Steps = append(trace.Steps, RouteTraceStep{
+				Tree:      true,
+				Port:      p.port,
+				PublicKey: p.public,
+				Distance:  distance,
+				Rule:      rule,
+			})
+		})
+	}
+	if nexthop == nil {
+		nexthop, _ = explainNextHopSNEK(virtualSnakeNextHopParams{
+			f.Type == types.TypeBootstrap,
+			f.DestinationKey,
+			s.r.public,
+			f.Watermark,
+			s._parent,
+			s.r.local,
+			s._rootAnnouncement(),
+			s._announcements,
+			s._table,
+			s.r.clock.Now(),
+			s.r.timings.PathExpiry,
+		}, func(key types.PublicKey, p *peer, rule string) {
+			trace.Steps = append(trace.Steps, RouteTraceStep{
+				Port:      p.port,
+				PublicKey: p.public,
+				Towards:   key,
+				Rule:      rule,
+			})
+		})
+	}
+	if nexthop = s._bestLink(nexthop); nexthop != nil {
+		trace.Found = true
+		trace.Port = nexthop.port
+		trace.PublicKey = nexthop.public
+	}
+
+	traces := append(tracer.traces[f.DestinationKey], trace)
+	if len(traces) > config.limit {
+		traces = traces[len(traces)-config.limit:]
+	}
+	tracer.traces[f.DestinationKey] = traces
+	if len(tracer.traces) > routeTraceMaxDestinations {
+		tracer._evictOldest()
+	}
+}
+
+// _evictOldest forgets the traces for the destination that was traced
+// least recently.
+func (t *routeTracer) _evictOldest() {
+	var oldest types.PublicKey
+	var oldestTime time.Time
+	for key, traces := range t.traces {
+		if last := traces[len(traces)-1].Time; oldestTime.IsZero() || last.Before(oldestTime) {
+			oldest, oldestTime = key, last
+		}
+	}
+	delete(t.traces, oldest)
+}
+
+// RouteTraces returns the traces kept for frames to the given destination
+// key, oldest first. Tracing must be enabled with RouterOptionRouteTracing.
+func (r *Router) RouteTraces(dest types.PublicKey) []RouteTrace {
+	var traces []RouteTrace
+	phony.Block(r.state, func() {
+		if r.state._routeTracer != nil {
+			traces = append(traces, r.state._routeTracer.traces[dest]...)
+		}
+	})
+	return traces
+}
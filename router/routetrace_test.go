@@ -0,0 +1,82 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestRouteTracing(t *testing.T) {
+	var routers [2]*Router
+	for i := range routers {
+		_, sk, _ := ed25519.GenerateKey(nil)
+		routers[i] = NewRouter(nil, sk, RouterOptionRouteTracing{SampleEvery: 1, Limit: 2})
+		r := routers[i]
+		t.Cleanup(func() { _ = r.Close() })
+	}
+	a, b := routers[0], routers[1]
+	if errA, errB := connectTestRouters(t, a, b); errA != nil || errB != nil {
+		t.Fatalf("failed to peer: %v, %v", errA, errB)
+	}
+
+	deadline := time.Now().Add(time.Second * 10)
+	for {
+		if _, err := a.WriteTo([]byte("traced"), b.PublicKey()); err != nil {
+			t.Fatal(err)
+		}
+		traces := a.RouteTraces(b.PublicKey())
+		if n := len(traces); n > 2 {
+			t.Fatalf("expected at most two traces to be kept, got %d", n)
+		}
+		if n := len(traces); n > 0 && traces[n-1].Found && traces[n-1].PublicKey == b.PublicKey() {
+			trace := traces[n-1]
+			if trace.Type != types.TypeTraffic || trace.From != 0 || trace.Destination != b.PublicKey() {
+				t.Fatalf("unexpected trace %+v", trace)
+			}
+			if len(trace.Steps) == 0 || trace.Steps[len(trace.Steps)-1].PublicKey != b.PublicKey() {
+				t.Fatalf("expected the last step to pick the chosen next-hop, got %+v", trace.Steps)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no trace chose the peer, got %+v", traces)
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+
+	if traces := a.RouteTraces(types.PublicKey{1}); len(traces) != 0 {
+		t.Fatalf("expected no traces for another destination, got %d", len(traces))
+	}
+}
+
+func TestRouteTracingSamples(t *testing.T) {
+	s := newTestState(types.PublicKey{}, systemClock{})
+	s.r.routeTracing = newRouteTraceConfig(RouterOptionRouteTracing{SampleEvery: 3})
+	for i := 0; i < 9; i++ {
+		s._traceRoute(s.r.local, &types.Frame{Type: types.TypeTraffic, DestinationKey: types.PublicKey{byte(i % 2)}})
+	}
+	s._traceRoute(s.r.local, &types.Frame{Type: types.TypeKeepalive})
+	total := 0
+	for _, traces := range s._routeTracer.traces {
+		total += len(traces)
+	}
+	if total != 3 {
+		t.Fatalf("expected one in three frames to be traced, got %d", total)
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+// Round trip times are measured using echo frames. Direct peers are sent an
+// echo request on the peering each time that we recalculate peer quality,
+// and every successful lookup of a remote node also counts as a sample for
+// that destination. Keepalive frames can't carry timestamps without breaking
+// compatibility with older nodes, so they aren't used for this.
+
+// RTTStats contains a smoothed round trip time estimate, calculated in the
+// same way as TCP does.
+type RTTStats struct {
+	Smoothed time.Duration // Smoothed round trip time
+	Variance time.Duration // Mean deviation of the round trip time
+	Samples  uint64        // Number of samples taken
+}
+
+type rttTable map[types.PublicKey]*rttEstimate
+
+type rttEstimate struct {
+	RTTStats
+	updated time.Time
+}
+
+// update adds a new sample to the estimate.
+func (e *rttEstimate) update(sample time.Duration, now time.Time) {
+	e.updated = now
+	e.Samples++
+	if e.Samples == 1 {
+		e.Smoothed, e.Variance = sample, sample/2
+		return
+	}
+	delta := sample - e.Smoothed
+	if delta < 0 {
+		delta = -delta
+	}
+	e.Variance += (delta - e.Variance) / 4
+	e.Smoothed += (sample - e.Smoothed) / 8
+}
+
+// DestinationRTT returns the round trip time estimate for the node with
+// the given public key, as measured by lookups, or false if we haven't
+// measured it recently.
+func (r *Router) DestinationRTT(public types.PublicKey) (RTTStats, bool) {
+	var stats RTTStats
+	var ok bool
+	phony.Block(r.state, func() {
+		var e *rttEstimate
+		if e, ok = r.state._rtts[public]; ok {
+			stats = e.RTTStats
+		}
+	})
+	return stats, ok
+}
+
+// _recordDestinationRTT adds a new round trip time sample for the node
+// with the given public key.
+func (s *state) _recordDestinationRTT(public types.PublicKey, sample time.Duration) {
+	e, ok := s._rtts[public]
+	if !ok {
+		e = &rttEstimate{}
+		s._rtts[public] = e
+	}
+	e.update(sample, s.r.clock.Now())
+}
+
+// _probePeerRTT sends an echo request directly to the peer, updating the
+// round trip time estimate for the peering when the reply arrives.
+func (s *state) _probePeerRTT(p *peer) {
+	_, f, err := s._newEchoRequest(p.public, func(result LookupResult) {
+		p._rtt.update(result.RTT, s.r.clock.Now())
+	})
+	if err != nil {
+		return
+	}
+	if !p.send(f) {
+		framePool.Put(f)
+	}
+}
+
+// _expireRTTs cleans up lookups that were never answered and round trip
+// time estimates for destinations that we haven't measured in a while.
+func (s *state) _expireRTTs() {
+	for id, pending := range s._echoes {
+		if since(s.r.clock, pending.sent) > echoTimeout {
+			delete(s._echoes, id)
+		}
+	}
+	for public, e := range s._rtts {
+		if since(s.r.clock, e.updated) > rttExpiry {
+			delete(s._rtts, public)
+		}
+	}
+}
+
+// _lowerRTTParent returns a peer with the same root as the chosen parent
+// but a much lower round trip time, if there is one, or otherwise the
+// chosen parent. The margin stops us from flapping between parents that
+// have similar round trip times.
+func (s *state) _lowerRTTParent(chosen *peer) *peer {
+	chosenAnn := s._announcements[chosen]
+	if chosenAnn == nil || chosen._rtt.Samples == 0 {
+		return chosen
+	}
+	best := chosen
+	for p, ann := range s._announcements {
+		switch {
+		case ann == nil || p == chosen || p._rtt.Samples == 0:
+			continue
+		case !p.started.Load() || p._demoted || p._departing || p.congested.Load() || p.noParent:
+			continue
+		case ann.Root != chosenAnn.Root || since(s.r.clock, ann.receiveTime) >= s.r.timings.AnnouncementTimeout:
+			continue
+		case ann.IsLoopOrChildOf(s.r.public):
+			continue
+		}
+		rtt := p._rtt.Smoothed
+		if rtt*parentRTTFactor > chosen._rtt.Smoothed || chosen._rtt.Smoothed-rtt < parentRTTMargin {
+			continue
+		}
+		if rtt < best._rtt.Smoothed {
+			best = p
+		}
+	}
+	return best
+}
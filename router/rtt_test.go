@@ -0,0 +1,44 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRTTEstimate(t *testing.T) {
+	var e rttEstimate
+	e.update(time.Millisecond*100, time.Now())
+	if e.Smoothed != time.Millisecond*100 || e.Variance != time.Millisecond*50 {
+		t.Fatalf("unexpected first estimate %s ± %s", e.Smoothed, e.Variance)
+	}
+	e.update(time.Millisecond*180, time.Now())
+	if e.Smoothed != time.Millisecond*110 {
+		t.Fatalf("expected smoothed RTT of 110ms, got %s", e.Smoothed)
+	}
+	if e.Variance != time.Millisecond*57+time.Microsecond*500 {
+		t.Fatalf("expected variance of 57.5ms, got %s", e.Variance)
+	}
+	for i := 0; i < 100; i++ {
+		e.update(time.Millisecond*20, time.Now())
+	}
+	if e.Smoothed > time.Millisecond*21 || e.Variance > time.Millisecond {
+		t.Fatalf("estimate didn't converge, got %s ± %s", e.Smoothed, e.Variance)
+	}
+	if e.Samples != 102 {
+		t.Fatalf("expected 102 samples, got %d", e.Samples)
+	}
+}
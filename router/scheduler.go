@@ -0,0 +1,108 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import "github.com/matrix-org/pinecone/types"
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races. The scheduler
+// is owned by the peer's writer actor.
+
+// scheduler decides which of the outbound queues of a peering is served
+// next. Control frames, which are the ones that keep the tree and SNEK
+// working, i.e. tree announcements, bootstraps with their acknowledgements
+// and confirmations, keepalives and link probes, have a queue of their own
+// that is always served first. They are small and sent no more often than
+// the protocol timers allow, so they can't take much of the link, but that
+// share of it is theirs however busy the link is with anything else.
+//
+// Other protocol frames take strict priority over traffic frames, since
+// they must get through for the network to work even when the link is
+// saturated with traffic. However, the protocol queue can only send a
+// limited number of frames in a row while traffic frames are waiting,
+// after which a traffic frame is sent, so that a flood of protocol frames
+// can't stop traffic from flowing altogether.
+type scheduler struct {
+	control queue
+	proto   queue
+	traffic queue
+	limit   int // How many protocol frames can be sent in a row while traffic waits
+	_burst  int // How many protocol frames have been sent in a row while traffic waited
+}
+
+func newScheduler(control, proto, traffic queue, limit int) *scheduler {
+	return &scheduler{
+		control: control,
+		proto:   proto,
+		traffic: traffic,
+		limit:   limit,
+	}
+}
+
+// isControlFrame returns true if the frame type is sent on the control
+// queue.
+func isControlFrame(t types.FrameType) bool {
+	switch t {
+	case types.TypeKeepalive, types.TypeLinkProbe, types.TypeTreeAnnouncement, types.TypeBootstrap, types.TypeBootstrapACK, types.TypeBootstrapConfirm, types.TypeSNEKRefresh, types.TypeDeparting, types.TypeTimeSync:
+		return true
+	default:
+		return false
+	}
+}
+
+// _next returns the next frame that is ready to be sent, along with the
+// queue that it was taken from, without waiting. If traffic is false then
+// the traffic queue won't be served, i.e. because the egress limit has been
+// reached. A nil queue is returned if nothing is ready to be sent. The frame
+// must be passed to _sent once it has been taken.
+func (s *scheduler) _next(traffic bool) (*types.Frame, queue) {
+	order := [...]queue{s.control, s.proto, s.traffic}
+	if s._burst >= s.limit {
+		// The protocol queue has had its share, so a waiting traffic
+		// frame gets to go first, but still behind control frames.
+		order[1], order[2] = order[2], order[1]
+	}
+	for _, q := range order {
+		if q == nil || (q == s.traffic && !traffic) {
+			continue
+		}
+		select {
+		case frame := <-q.pop():
+			return frame, q
+		default:
+		}
+	}
+	return nil, nil
+}
+
+// _sent acknowledges a frame that was taken from the given queue and
+// updates the share of the link used by the protocol queue. Control frames
+// don't count towards it.
+func (s *scheduler) _sent(q queue, frame *types.Frame) {
+	q.ack(frame)
+	switch {
+	case q == s.control:
+	case q == s.proto && s.traffic != nil && s.traffic.queuecount() > 0:
+		s._burst++
+	default:
+		s._burst = 0
+	}
+}
+
+// _trafficSent records that a traffic frame was sent that had already
+// been acknowledged, i.e. one that was held back by the egress limit.
+func (s *scheduler) _trafficSent() {
+	s._burst = 0
+}
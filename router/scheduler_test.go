@@ -0,0 +1,159 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"testing"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func newTestScheduler() *scheduler {
+	return newScheduler(newFIFOQueue(fifoNoMax, nil, nil), newFIFOQueue(fifoNoMax, nil, nil), newFairFIFOQueue(4, nil, nil), 4)
+}
+
+func pushFrames(q queue, t types.FrameType, count int) {
+	for i := 0; i < count; i++ {
+		q.push(&types.Frame{Type: t})
+	}
+}
+
+// sendFrames takes up to count frames from the scheduler and returns how
+// many came from the protocol and traffic queues, counting control frames
+// as protocol frames.
+func sendFrames(s *scheduler, count int) (proto, traffic int) {
+	for i := 0; i < count; i++ {
+		frame, q := s._next(true)
+		if q == nil {
+			break
+		}
+		s._sent(q, frame)
+		if q == s.proto {
+			proto++
+		} else {
+			traffic++
+		}
+	}
+	return
+}
+
+func TestSchedulerProtocolFlowsWhenTrafficSaturated(t *testing.T) {
+	s := newTestScheduler()
+	pushFrames(s.traffic, types.TypeTraffic, 60)
+
+	// A teardown arriving behind a full traffic queue goes next.
+	pushFrames(s.proto, types.TypeBootstrap, 1)
+	if frame, q := s._next(true); q != s.proto || frame.Type != types.TypeBootstrap {
+		t.Fatalf("expected protocol frame to be sent first")
+	} else {
+		s._sent(q, frame)
+	}
+
+	// Protocol frames get the bulk of the link while both are busy.
+	pushFrames(s.proto, types.TypeTreeAnnouncement, 20)
+	proto, traffic := sendFrames(s, 25)
+	if proto != 20 || traffic != 5 {
+		t.Fatalf("expected 20 protocol and 5 traffic frames, got %d and %d", proto, traffic)
+	}
+}
+
+func TestSchedulerTrafficFlowsWhenProtocolSaturated(t *testing.T) {
+	s := newTestScheduler()
+	pushFrames(s.proto, types.TypeTreeAnnouncement, 100)
+	pushFrames(s.traffic, types.TypeTraffic, 10)
+
+	// The protocol queue can only send its burst before traffic gets a turn.
+	proto, traffic := sendFrames(s, 50)
+	if proto != 40 || traffic != 10 {
+		t.Fatalf("expected 40 protocol and 10 traffic frames, got %d and %d", proto, traffic)
+	}
+
+	// Once the traffic has drained, the protocol queue has the link to
+	// itself again.
+	proto, traffic = sendFrames(s, 20)
+	if proto != 20 || traffic != 0 {
+		t.Fatalf("expected 20 protocol frames, got %d and %d", proto, traffic)
+	}
+}
+
+func TestSchedulerTrafficHeld(t *testing.T) {
+	s := newTestScheduler()
+	pushFrames(s.traffic, types.TypeTraffic, 1)
+	if _, q := s._next(false); q != nil {
+		t.Fatalf("traffic frame shouldn't be sent while traffic is held")
+	}
+	if _, q := s._next(true); q != s.traffic {
+		t.Fatalf("traffic frame should be sent once traffic is released")
+	}
+}
+
+func TestSchedulerControlAheadOfEverything(t *testing.T) {
+	s := newTestScheduler()
+	pushFrames(s.traffic, types.TypeTraffic, 60)
+	pushFrames(s.proto, types.TypeEchoRequest, 60)
+
+	// Use up the protocol burst so that traffic is due to go next.
+	if proto, traffic := sendFrames(s, 4); proto != 4 || traffic != 0 {
+		t.Fatalf("expected 4 protocol frames, got %d and %d", proto, traffic)
+	}
+
+	// Control frames still go first, and don't use up the turn that
+	// traffic was due.
+	pushFrames(s.control, types.TypeBootstrap, 2)
+	pushFrames(s.control, types.TypeTreeAnnouncement, 1)
+	for _, expected := range []types.FrameType{types.TypeBootstrap, types.TypeBootstrap, types.TypeTreeAnnouncement, types.TypeTraffic} {
+		frame, q := s._next(true)
+		if frame == nil || frame.Type != expected {
+			t.Fatalf("expected %s to be sent next, got %v", expected, frame)
+		}
+		s._sent(q, frame)
+	}
+
+	// Control frames go first even when traffic is held.
+	pushFrames(s.control, types.TypeKeepalive, 1)
+	if frame, q := s._next(false); q != s.control || frame.Type != types.TypeKeepalive {
+		t.Fatalf("expected the keepalive to be sent next")
+	}
+}
+
+func TestPeerControlQueue(t *testing.T) {
+	p := &peer{
+		proto:   newFIFOQueue(fifoNoMax, nil, nil),
+		traffic: newFairFIFOQueue(1, nil, nil),
+	}
+	if p.queueFor(types.TypeBootstrap) != p.proto {
+		t.Fatalf("expected control frames to use the protocol queue without a control queue")
+	}
+	p.control = newFIFOQueue(fifoNoMax, nil, nil)
+	for _, tc := range []struct {
+		frameType types.FrameType
+		expected  queue
+	}{
+		{types.TypeKeepalive, p.control},
+		{types.TypeLinkProbe, p.control},
+		{types.TypeTreeAnnouncement, p.control},
+		{types.TypeBootstrap, p.control},
+		{types.TypeBootstrapACK, p.control},
+		{types.TypeBootstrapConfirm, p.control},
+		{types.TypeEchoRequest, p.proto},
+		{types.TypeServiceAdvert, p.proto},
+		{types.TypeTraffic, p.traffic},
+		{types.TypeCustody, p.traffic},
+	} {
+		if p.queueFor(tc.frameType) != tc.expected {
+			t.Fatalf("%s was sent on the wrong queue", tc.frameType)
+		}
+	}
+}
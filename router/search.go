@@ -0,0 +1,201 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+// A search finds the live node that is responsible for a point in the
+// keyspace, which is what a DHT needs in order to decide where to store a
+// value. The search request is sent towards the point using SNEK routing,
+// exactly as traffic for a node with that key would be, so it stops at the
+// node whose descending span covers the point, i.e. the node that traffic
+// for the point would reach. That node answers with a signed search
+// response, so we know that it is really there, and the response is sent
+// back to our coordinates using tree routing where possible. If the node
+// that the request stops at doesn't understand search frames then it will
+// just drop them, in which case the search will time out.
+
+// SearchResult is the outcome of a successful search.
+type SearchResult struct {
+	PublicKey types.PublicKey   // The node that is responsible for the target
+	Coords    types.Coordinates // The coordinates of that node
+	RTT       time.Duration     // Time between sending the request and the response
+}
+
+type pendingSearch struct {
+	target types.PublicKey
+	sent   time.Time
+	notify func(SearchResult)
+}
+
+// searchState holds the searches that we are waiting on.
+type searchState struct {
+	sequence uint64
+	pending  map[uint64]*pendingSearch
+}
+
+// Search finds the live node that is closest to the target in the keyspace,
+// in the sense that SNEK routing towards the target ends at it. The target
+// doesn't need to be the key of a real node. It blocks until an answer
+// arrives or until the context expires, in which case the context error is
+// returned. If we have no peerings then we are the closest node.
+func (r *Router) Search(ctx context.Context, target types.PublicKey) (SearchResult, error) {
+	result := make(chan SearchResult, 1)
+	var id uint64
+	var err error
+	phony.Block(r.state, func() {
+		var f *types.Frame
+		id, f, err = r.state._newSearchRequest(target, func(res SearchResult) {
+			result <- res
+		})
+		if err != nil {
+			err = fmt.Errorf("r.state._newSearchRequest: %w", err)
+			return
+		}
+		if err = r.state._forward(r.local, f); err != nil {
+			err = fmt.Errorf("r.state._forward: %w", err)
+		}
+	})
+	defer phony.Block(r.state, func() {
+		delete(r.state._searches.pending, id)
+	})
+	if err != nil {
+		return SearchResult{}, err
+	}
+	select {
+	case res := <-result:
+		return res, nil
+	case <-ctx.Done():
+		return SearchResult{}, ctx.Err()
+	case <-r.context.Done():
+		return SearchResult{}, ErrRouterClosed
+	}
+}
+
+// _newSearchRequest builds a search request for the target, which will be
+// routed using SNEK. The notify function will be called from the state actor
+// if a response arrives.
+func (s *state) _newSearchRequest(target types.PublicKey, notify func(SearchResult)) (uint64, *types.Frame, error) {
+	if s._searches.pending == nil {
+		s._searches.pending = map[uint64]*pendingSearch{}
+	}
+	s._searches.sequence++
+	id := s._searches.sequence
+	request := types.SearchRequest{
+		ID: types.Varu64(id),
+	}
+	f := getFrame()
+	f.Type = types.TypeSearchRequest
+	f.HopLimit = types.MaxHopLimit
+	f.DestinationKey = target
+	f.Source = s._coords()
+	f.SourceKey = s.r.public
+	f.Watermark = types.VirtualSnakeWatermark{
+		PublicKey: types.FullMask,
+		Sequence:  0,
+	}
+	if err := f.AppendPayload(&request); err != nil {
+		framePool.Put(f)
+		return 0, nil, fmt.Errorf("f.AppendPayload: %w", err)
+	}
+	s._searches.pending[id] = &pendingSearch{
+		target: target,
+		sent:   s.r.clock.Now(),
+		notify: notify,
+	}
+	return id, f, nil
+}
+
+// _answerSearch is called when a search request can't go any further,
+// which means that we are the closest node to the target that it could
+// reach, and answers it.
+func (s *state) _answerSearch(f *types.Frame) error {
+	var request types.SearchRequest
+	if _, err := types.Decode(&request, f.Payload); err != nil {
+		return fmt.Errorf("request.UnmarshalBinary: %w", err)
+	}
+	response := types.SearchResponse{
+		ID:     request.ID,
+		Target: f.DestinationKey,
+	}
+	protected, err := response.ProtectedPayload(f.SourceKey)
+	if err != nil {
+		return fmt.Errorf("response.ProtectedPayload: %w", err)
+	}
+	copy(response.Signature[:], s.r.sign(protected))
+
+	reply := getFrame()
+	reply.Type = types.TypeSearchResponse
+	reply.HopLimit = types.MaxHopLimit
+	reply.Destination = append(reply.Destination[:0], f.Source...)
+	reply.DestinationKey = f.SourceKey
+	reply.Source = s._coords()
+	reply.SourceKey = s.r.public
+	reply.Watermark = types.VirtualSnakeWatermark{
+		PublicKey: types.FullMask,
+		Sequence:  0,
+	}
+	if err := reply.AppendPayload(&response); err != nil {
+		framePool.Put(reply)
+		return fmt.Errorf("reply.AppendPayload: %w", err)
+	}
+	if !s._replyAllowed(f, reply) {
+		framePool.Put(reply)
+		return nil
+	}
+	return s._forward(s.r.local, reply)
+}
+
+// _handleSearchResponse is called when a search response addressed to us
+// arrives, and matches it up with the search that is waiting for it.
+func (s *state) _handleSearchResponse(f *types.Frame) error {
+	var response types.SearchResponse
+	if _, err := types.Decode(&response, f.Payload); err != nil {
+		return fmt.Errorf("response.UnmarshalBinary: %w", err)
+	}
+	pending, ok := s._searches.pending[uint64(response.ID)]
+	if !ok || pending.target != response.Target {
+		return nil
+	}
+	protected, err := response.ProtectedPayload(s.r.public)
+	if err != nil {
+		return fmt.Errorf("response.ProtectedPayload: %w", err)
+	}
+	if !s.r.verify(f.SourceKey[:], protected, response.Signature[:]) {
+		// Anyone can send us a forged response, so drop it rather than
+		// blaming the peer that passed it on.
+		return nil
+	}
+	delete(s._searches.pending, uint64(response.ID))
+	if len(f.Source) > 0 && f.SourceKey != s.r.public {
+		s._cacheCoords(f.SourceKey, append(types.Coordinates{}, f.Source...))
+	}
+	pending.notify(SearchResult{
+		PublicKey: f.SourceKey,
+		Coords:    append(types.Coordinates{}, f.Source...),
+		RTT:       since(s.r.clock, pending.sent),
+	})
+	return nil
+}
@@ -0,0 +1,110 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !minimal
+// +build !minimal
+
+package router
+
+import (
+	"context"
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestSearch(t *testing.T) {
+	low, high := newTestRouterPair(t)
+
+	deadline := time.Now().Add(time.Second * 10)
+	for len(low.Coords()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("tree didn't converge")
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+
+	// A point just above the lower key is between the two nodes, so the
+	// search should carry on up to the higher node.
+	between := low.PublicKey()
+	for i := len(between) - 1; i >= 0; i-- {
+		if between[i]++; between[i] != 0 {
+			break
+		}
+	}
+
+	for _, tc := range []struct {
+		target   types.PublicKey
+		expected types.PublicKey
+	}{
+		{low.PublicKey(), low.PublicKey()},
+		{high.PublicKey(), high.PublicKey()},
+		{between, high.PublicKey()},
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		result, err := low.Search(ctx, tc.target)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.PublicKey != tc.expected {
+			t.Fatalf("searching for %s: expected %s, got %s", tc.target, tc.expected, result.PublicKey)
+		}
+	}
+}
+
+func TestSearchWithoutPeerings(t *testing.T) {
+	_, sk, _ := ed25519.GenerateKey(nil)
+	r := NewRouter(nil, sk)
+	t.Cleanup(func() { _ = r.Close() })
+
+	var target types.PublicKey
+	pk, _, _ := ed25519.GenerateKey(nil)
+	copy(target[:], pk)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	result, err := r.Search(ctx, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.PublicKey != r.PublicKey() {
+		t.Fatalf("expected to be the closest node to everything, got %s", result.PublicKey)
+	}
+}
+
+func TestSearchForgedSignature(t *testing.T) {
+	s := newTestState(types.PublicKey{1}, NewManualClock(time.Unix(1000, 0)))
+	target := types.PublicKey{3}
+	answered := false
+	s._searches.pending = map[uint64]*pendingSearch{
+		1: {target: target, notify: func(SearchResult) { answered = true }},
+	}
+
+	// A response with a bad signature is dropped without an error, since
+	// an error would stop the peering that passed the frame on to us.
+	response := getFrame()
+	response.Type = types.TypeSearchResponse
+	response.SourceKey = types.PublicKey{2}
+	if err := response.AppendPayload(&types.SearchResponse{ID: 1, Target: target}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s._handleSearchResponse(response); err != nil {
+		t.Fatalf("expected a forged response to be dropped, got %v", err)
+	}
+	if answered || len(s._searches.pending) != 1 {
+		t.Fatalf("expected the search to still be waiting for an answer")
+	}
+}
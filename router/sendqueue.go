@@ -0,0 +1,168 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+// Traffic that we send ourselves normally goes straight into the traffic
+// queue of the next hop. While we are joining the network, or while the tree
+// or SNEK are settling after a change, there might not be a next hop for
+// some destinations yet, and that traffic would be dropped, which costs the
+// application a retransmission timeout even if the path appears a moment
+// later. Instead, it waits in a queue of its own for each destination until
+// there is a next hop or until it has waited for too long. While a
+// destination has traffic waiting, anything else that we send to it joins
+// the back of its queue, so that the traffic stays in order, but traffic to
+// other destinations, even those that will go through the same peer, is
+// sent as normal and isn't held up behind it. The queues are retried
+// whenever SNEK maintenance runs and whenever a new peering comes up.
+//
+// The queues are small, since they only need to cover the time that it
+// takes for a path to appear. When they are full, new traffic is dropped
+// rather than old, which would otherwise reorder the traffic.
+
+// SendQueueStats describes the traffic that has waited for a next hop.
+type SendQueueStats struct {
+	Destinations int    `json:"destinations"` // Destinations with traffic waiting now
+	Frames       int    `json:"frames"`       // Frames waiting now
+	Bytes        uint64 `json:"bytes"`        // Payload bytes waiting now
+	Held         uint64 `json:"held"`         // Frames that have had to wait
+	Released     uint64 `json:"released"`     // Frames sent after waiting
+	Expired      uint64 `json:"expired"`      // Frames dropped after waiting too long
+	Overflowed   uint64 `json:"overflowed"`   // Frames dropped because the queues were full
+}
+
+// sendQueue holds the traffic waiting for a next hop to one destination.
+type sendQueue struct {
+	frames []*types.Frame
+	held   []time.Time // When each frame started waiting
+	bytes  uint64
+}
+
+type sendQueueTable map[types.PublicKey]*sendQueue
+
+// SendQueueStats returns how much of our traffic is waiting for a next hop,
+// and how much has waited since the router started.
+func (r *Router) SendQueueStats() SendQueueStats {
+	var stats SendQueueStats
+	phony.Block(r.state, func() {
+		stats = r.state._sendQueueStatistics()
+	})
+	return stats
+}
+
+func (s *state) _sendQueueStatistics() SendQueueStats {
+	stats := s._sendStats
+	for _, q := range s._sendQueues {
+		stats.Destinations++
+		stats.Frames += len(q.frames)
+		stats.Bytes += q.bytes
+	}
+	return stats
+}
+
+// _sendLocal sends traffic that we originated, unless traffic to the same
+// destination is already waiting, in which case it joins the queue.
+func (s *state) _sendLocal(f *types.Frame) error {
+	if q, ok := s._sendQueues[f.DestinationKey]; ok && len(q.frames) > 0 {
+		s._holdForSend(f)
+		return nil
+	}
+	return s._forward(s.r.local, f)
+}
+
+// _holdForSend queues traffic that we originated until there is a next hop
+// for its destination. It returns false if traffic isn't held, in which
+// case the caller should drop the frame.
+func (s *state) _holdForSend(f *types.Frame) bool {
+	if s.r.sendTimeout <= 0 {
+		return false
+	}
+	size := uint64(len(f.Payload))
+	q, ok := s._sendQueues[f.DestinationKey]
+	if (ok && len(q.frames) >= sendQueueFrames) ||
+		(!ok && len(s._sendQueues) >= sendQueueDestinations) ||
+		s._sendHeld+size > sendQueueBytes {
+		s._sendStats.Overflowed++
+		s._count(rollupDropped)
+		framePool.Put(f)
+		return true
+	}
+	if !ok {
+		if s._sendQueues == nil {
+			s._sendQueues = sendQueueTable{}
+		}
+		q = &sendQueue{}
+		s._sendQueues[f.DestinationKey] = q
+	}
+	q.frames = append(q.frames, f)
+	q.held = append(q.held, s.r.clock.Now())
+	q.bytes += size
+	s._sendHeld += size
+	s._sendStats.Held++
+	return true
+}
+
+// _flushSendQueues drops the traffic that has waited for too long and sends
+// the traffic to destinations that now have a next hop.
+func (s *state) _flushSendQueues() {
+	now := s.r.clock.Now()
+	for key, q := range s._sendQueues {
+		expired := 0
+		for expired < len(q.frames) && now.Sub(q.held[expired]) >= s.r.sendTimeout {
+			s._releaseSend(q, q.frames[expired])
+			framePool.Put(q.frames[expired])
+			s._sendStats.Expired++
+			s._count(rollupDropped)
+			expired++
+		}
+		q.frames, q.held = q.frames[expired:], q.held[expired:]
+		if len(q.frames) == 0 {
+			delete(s._sendQueues, key)
+			continue
+		}
+		if nexthop, _ := s._nextHopsTraffic(s.r.local, q.frames[0]); nexthop == nil || nexthop == s.r.local {
+			continue
+		}
+		// Take the queue out of the table before sending, so that the
+		// frames aren't just queued again. If the next hop disappears
+		// part of the way through, the rest will start a new queue.
+		delete(s._sendQueues, key)
+		for _, f := range q.frames {
+			s._releaseSend(q, f)
+			s._sendStats.Released++
+			_ = s._sendLocal(f)
+		}
+	}
+}
+
+// _releaseSend stops counting a frame that is leaving the queue.
+func (s *state) _releaseSend(q *sendQueue, f *types.Frame) {
+	size := uint64(len(f.Payload))
+	q.bytes -= size
+	if size < s._sendHeld {
+		s._sendHeld -= size
+	} else {
+		s._sendHeld = 0
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestSendQueue(t *testing.T) {
+	s, from, to := newTransitState()
+	s.r.sendTimeout = time.Second
+	from.traffic = newFairFIFOQueue(trafficBuffer, s.r.log, s.r.clock)
+	send := func(destination types.PublicKey, payload byte) {
+		f := getFrame()
+		f.Type = types.TypeTraffic
+		f.HopLimit = types.MaxHopLimit
+		f.SourceKey = s.r.public
+		f.DestinationKey = destination
+		f.Watermark = types.VirtualSnakeWatermark{PublicKey: types.FullMask}
+		f.SetRoutingPreference(types.RoutingPreferSNEK)
+		f.Payload = append(f.Payload[:0], payload)
+		if err := s._sendLocal(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	received := func(p *peer) []byte {
+		var payloads []byte
+		for {
+			select {
+			case f := <-p.traffic.pop():
+				p.traffic.ack(f)
+				payloads = append(payloads, f.Payload[0])
+			default:
+				return payloads
+			}
+		}
+	}
+
+	// With the peering to the destination down, there is no next hop, so
+	// the traffic waits.
+	to.started.Store(false)
+	send(to.public, 1)
+	if stats := s._sendQueueStatistics(); stats.Frames != 1 || stats.Held != 1 {
+		t.Fatalf("expected the frame to be held, got %+v", stats)
+	}
+
+	// Traffic to other destinations isn't held up, and later traffic to the
+	// waiting destination joins the queue even if there is now a next hop.
+	send(from.public, 10)
+	if got := received(from); len(got) != 1 || got[0] != 10 {
+		t.Fatalf("expected traffic to another destination to be sent, got %v", got)
+	}
+	to.started.Store(true)
+	send(to.public, 2)
+	if got := received(to); len(got) != 0 {
+		t.Fatalf("expected traffic to wait behind the held frame, got %v", got)
+	}
+
+	// Once there is a next hop, the traffic is sent in order.
+	s._flushSendQueues()
+	if got := received(to); len(got) != 2 || got[0] != 1 || got[1] != 2 {
+		t.Fatalf("expected the held frames in order, got %v", got)
+	}
+	if stats := s._sendQueueStatistics(); stats.Frames != 0 || stats.Bytes != 0 || stats.Released != 2 {
+		t.Fatalf("expected the queue to be empty, got %+v", stats)
+	}
+
+	// Traffic that waits for too long is dropped.
+	to.started.Store(false)
+	send(to.public, 3)
+	s.r.clock.(*ManualClock).Advance(time.Second)
+	s._flushSendQueues()
+	to.started.Store(true)
+	s._flushSendQueues()
+	if got := received(to); len(got) != 0 {
+		t.Fatalf("expected the expired frame to be dropped, got %v", got)
+	}
+	if stats := s._sendQueueStatistics(); stats.Destinations != 0 || stats.Expired != 1 {
+		t.Fatalf("expected the frame to have expired, got %+v", stats)
+	}
+
+	// With the queue turned off, traffic without a next hop is dropped.
+	s.r.sendTimeout = -1
+	to.started.Store(false)
+	send(to.public, 4)
+	if stats := s._sendQueueStatistics(); stats.Frames != 0 || stats.Held != 3 {
+		t.Fatalf("expected the frame to be dropped, got %+v", stats)
+	}
+}
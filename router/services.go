@@ -0,0 +1,256 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/router/events"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+// Service advertisements let nodes find infrastructure, such as relays or
+// mailboxes, without any configuration. Each service that we offer is sent
+// as a signed advertisement, which is flooded in the same way as a wakeup
+// broadcast and so reaches the nodes within the network horizon. The
+// advertisements are repeated regularly and are forgotten by other nodes if
+// they stop arriving, so withdrawing a service just means that we stop
+// sending them. Advertisements carry our locality hint, if we have one,
+// so that nodes can prefer services that are nearby.
+
+// ServiceRecord describes a service that another node has advertised.
+type ServiceRecord struct {
+	PublicKey types.PublicKey
+	Service   string
+	Capacity  uint64
+	Locality  string // The locality hint of the node, if it gave one
+	LastSeen  time.Time
+}
+
+type serviceKey struct {
+	public  types.PublicKey
+	service string
+}
+
+type serviceTable map[serviceKey]*serviceEntry
+
+type serviceEntry struct {
+	sequence types.Varu64
+	capacity uint64
+	locality string
+	lastSeen time.Time
+}
+
+// AdvertiseService starts advertising that we offer the given service with
+// the given capacity, or updates the capacity if we already advertise it.
+func (r *Router) AdvertiseService(service string, capacity uint64) error {
+	if service == "" || len(service) > types.MaxServiceNameLength {
+		return fmt.Errorf("invalid service name")
+	}
+	phony.Block(r.state, func() {
+		r.state._services[service] = capacity
+		r.state._sendServiceAdvertisement(service, capacity)
+	})
+	return nil
+}
+
+// WithdrawService stops advertising the given service. Other nodes will
+// forget about it once their records expire.
+func (r *Router) WithdrawService(service string) {
+	phony.Block(r.state, func() {
+		delete(r.state._services, service)
+	})
+}
+
+// Services returns the records for the given service that we have heard
+// about from other nodes, or all records if the service is empty. Records
+// are sorted with the highest capacity first, and then with the nodes that
+// are nearby first.
+func (r *Router) Services(service string) []ServiceRecord {
+	var records []ServiceRecord
+	phony.Block(r.state, func() {
+		for k, v := range r.state._seenServices {
+			if service != "" && k.service != service {
+				continue
+			}
+			if since(r.clock, v.lastSeen) >= serviceExpiryPeriod {
+				continue
+			}
+			records = append(records, ServiceRecord{
+				PublicKey: k.public,
+				Service:   k.service,
+				Capacity:  v.capacity,
+				Locality:  v.locality,
+				LastSeen:  v.lastSeen,
+			})
+		}
+	})
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Capacity != records[j].Capacity {
+			return records[i].Capacity > records[j].Capacity
+		}
+		if ni, nj := r.nearby(records[i].Locality), r.nearby(records[j].Locality); ni != nj {
+			return ni
+		}
+		return records[i].PublicKey.CompareTo(records[j].PublicKey) < 0
+	})
+	return records
+}
+
+// _maintainServices expires old service records and repeats the
+// advertisements for our own services.
+func (s *state) _maintainServices() {
+	if s._suspended {
+		// Resume will restart maintenance.
+		return
+	}
+	select {
+	case <-s.r.context.Done():
+		return
+	default:
+		defer s._serviceTimer.Reset(serviceAdvertisementInterval)
+	}
+
+	for k, v := range s._seenServices {
+		if since(s.r.clock, v.lastSeen) >= serviceExpiryPeriod {
+			delete(s._seenServices, k)
+		}
+	}
+	for service, capacity := range s._services {
+		s._sendServiceAdvertisement(service, capacity)
+	}
+}
+
+// _sendServiceAdvertisement floods an advertisement for one of our services.
+func (s *state) _sendServiceAdvertisement(service string, capacity uint64) {
+	// The sequence needs to increase even if the advertisement is sent more
+	// than once within the same millisecond, e.g. when updating the capacity.
+	seq := types.Varu64(s.r.clock.Now().UnixMilli())
+	if seq <= s._serviceSequence {
+		seq = s._serviceSequence + 1
+	}
+	s._serviceSequence = seq
+	advertisement := types.ServiceAdvertisement{
+		Sequence: seq,
+		Service:  service,
+		Capacity: types.Varu64(capacity),
+		Locality: s.r.locality,
+	}
+	if s.r.secure {
+		protected, err := advertisement.ProtectedPayload()
+		if err != nil {
+			s.r.log.Println("Failed creating service advertisement:", err)
+			return
+		}
+		copy(advertisement.Signature[:], s.r.sign(protected))
+		if advertisement.Locality != "" {
+			protected, err = advertisement.LocalityPayload()
+			if err != nil {
+				s.r.log.Println("Failed creating service advertisement:", err)
+				return
+			}
+			copy(advertisement.LocalitySignature[:], s.r.sign(protected))
+		}
+	}
+	f := getFrame()
+	n, err := advertisement.MarshalBinary(f.Payload[:cap(f.Payload)])
+	if err != nil {
+		framePool.Put(f)
+		s.r.log.Println("Failed creating service advertisement:", err)
+		return
+	}
+	f.Type = types.TypeServiceAdvert
+	f.SourceKey = s.r.public
+	f.HopLimit = types.NetworkHorizonDistance
+	f.Payload = f.Payload[:n]
+	s._flood(s.r.local, f, ClassicFlood)
+	framePool.Put(f)
+}
+
+// _handleServiceAdvertisement records a service advertisement from another
+// node and forwards it on, if we haven't seen it already.
+func (s *state) _handleServiceAdvertisement(p *peer, f *types.Frame) error {
+	if f.SourceKey == s.r.public {
+		return nil
+	}
+	var advertisement types.ServiceAdvertisement
+	if _, err := types.Decode(&advertisement, f.Payload); err != nil {
+		return fmt.Errorf("advertisement.UnmarshalBinary: %w", err)
+	}
+	if s.r.secure {
+		protected, err := advertisement.ProtectedPayload()
+		if err != nil {
+			return fmt.Errorf("advertisement.ProtectedPayload: %w", err)
+		}
+		if !s.r.verify(f.SourceKey[:], protected, advertisement.Signature[:]) {
+			return fmt.Errorf("service advertisement signature invalid")
+		}
+		if advertisement.Locality != "" {
+			protected, err = advertisement.LocalityPayload()
+			if err != nil {
+				return fmt.Errorf("advertisement.LocalityPayload: %w", err)
+			}
+			if !s.r.verify(f.SourceKey[:], protected, advertisement.LocalitySignature[:]) {
+				return fmt.Errorf("service advertisement locality signature invalid")
+			}
+		}
+	}
+
+	key := serviceKey{f.SourceKey, advertisement.Service}
+	existing, ok := s._seenServices[key]
+	switch {
+	case ok && advertisement.Sequence <= existing.sequence:
+		// We've already seen this advertisement, so don't forward it again.
+		return nil
+	case !ok && len(s._seenServices) >= serviceMaxRecords:
+		// We don't have room to remember any more services, so drop it
+		// rather than forwarding something that we can't deduplicate.
+		return nil
+	}
+	capacity := uint64(advertisement.Capacity)
+	s._seenServices[key] = &serviceEntry{
+		sequence: advertisement.Sequence,
+		capacity: capacity,
+		locality: advertisement.Locality,
+		lastSeen: s.r.clock.Now(),
+	}
+	if !ok || existing.capacity != capacity {
+		s.r.Act(nil, func() {
+			s.r._publish(events.ServiceDiscovered{
+				PeerID:   key.public.String(),
+				Service:  key.service,
+				Capacity: capacity,
+			})
+		})
+	}
+
+	if f.HopLimit > 1 {
+		f.HopLimit -= 1
+	} else {
+		return nil
+	}
+	if f.HopLimit >= types.NetworkHorizonDistance-1 {
+		s._flood(p, f, ClassicFlood)
+	} else {
+		s._flood(p, f, TreeFlood)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !minimal
+// +build !minimal
+
+package router
+
+import (
+	"testing"
+	"time"
+)
+
+func TestServiceAdvertisements(t *testing.T) {
+	low, high := newTestRouterPair(t)
+
+	// Wait for the peering to come up before advertising, otherwise the
+	// advertisement will have nowhere to go.
+	deadline := time.Now().Add(time.Second * 10)
+	for low.TotalPeerCount() == 0 || high.TotalPeerCount() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("peering didn't come up")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	if err := high.AdvertiseService("relay", 50); err != nil {
+		t.Fatal(err)
+	}
+	if err := high.AdvertiseService("", 1); err == nil {
+		t.Fatalf("expected empty service name to be rejected")
+	}
+
+	for {
+		records := low.Services("relay")
+		if len(records) == 1 {
+			if records[0].PublicKey != high.PublicKey() || records[0].Capacity != 50 {
+				t.Fatalf("unexpected service record %+v", records[0])
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("service advertisement wasn't received")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if records := low.Services("mailbox"); len(records) != 0 {
+		t.Fatalf("expected no mailbox services, got %d", len(records))
+	}
+	if records := high.Services(""); len(records) != 0 {
+		t.Fatalf("expected our own advertisement to be ignored, got %d records", len(records))
+	}
+
+	// Updating the capacity should replace the record.
+	if err := high.AdvertiseService("relay", 10); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if records := low.Services("relay"); len(records) == 1 && records[0].Capacity == 10 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("updated service advertisement wasn't received")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"fmt"
+	"time"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+// SlowPeerAction is what happens to a peering that can't keep its traffic
+// queue drained, as configured by RouterOptionSlowPeerPolicy.
+type SlowPeerAction int
+
+const (
+	// SlowPeerDisconnect disconnects the peering.
+	SlowPeerDisconnect SlowPeerAction = iota
+	// SlowPeerAvoid keeps the peering up but stops choosing it as our
+	// parent or as a tree next-hop for traffic, until its queue has stayed
+	// below the threshold for the same duration again. Traffic that has to
+	// be routed using SNEK may still use the peering.
+	SlowPeerAvoid
+)
+
+func (a SlowPeerAction) String() string {
+	switch a {
+	case SlowPeerDisconnect:
+		return "disconnect"
+	case SlowPeerAvoid:
+		return "avoid"
+	default:
+		return "unknown"
+	}
+}
+
+// slowPeerPolicy holds the settings from RouterOptionSlowPeerPolicy.
+type slowPeerPolicy struct {
+	threshold int
+	duration  time.Duration
+	action    SlowPeerAction
+}
+
+func (c slowPeerPolicy) enabled() bool {
+	return c.duration > 0
+}
+
+// checkInterval returns how often the traffic queues should be sampled.
+func (c slowPeerPolicy) checkInterval() time.Duration {
+	if interval := c.duration / 4; interval > queueAlarmMinCheckInterval {
+		return interval
+	}
+	return queueAlarmMinCheckInterval
+}
+
+// _maintainSlowPeers samples the traffic queue of each peering and applies
+// the slow peer policy to any that have stayed above the threshold.
+func (s *state) _maintainSlowPeers() {
+	if s._suspended {
+		// Resume will restart maintenance.
+		return
+	}
+	select {
+	case <-s.r.context.Done():
+		return
+	default:
+		defer s._slowPeerTimer.Reset(s.r.slowPeers.checkInterval())
+	}
+
+	policy := s.r.slowPeers
+	reparent := false
+	for _, p := range s._peers {
+		if p == nil || p == s.r.local || !p.started.Load() {
+			continue
+		}
+		slow := p.traffic.queueStats().Depth > policy.threshold
+		if slow != p._slowState {
+			// The peering has crossed the threshold in one direction or
+			// the other, so start timing it again.
+			p._slowState, p._slowSince = slow, s.r.clock.Now()
+			continue
+		}
+		if since(s.r.clock, p._slowSince) < policy.duration {
+			continue
+		}
+		switch {
+		case slow && policy.action == SlowPeerDisconnect:
+			p.stop(fmt.Errorf("traffic queue above %d frames for %s", policy.threshold, policy.duration))
+		case slow && !p.congested.Load():
+			s.r.log.Println("Avoiding slow peer", p.public.String(), "on port", p.port)
+			p.congested.Store(true)
+			reparent = reparent || p == s._parent
+		case !slow && p.congested.Load():
+			s.r.log.Println("No longer avoiding peer", p.public.String(), "on port", p.port)
+			p.congested.Store(false)
+		}
+	}
+	if reparent && s._selectNewParent() {
+		s._bootstrapSoon()
+	}
+}
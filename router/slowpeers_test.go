@@ -0,0 +1,65 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestSlowPeerAvoid(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	s := newTestState(types.PublicKey{}, systemClock{})
+	s.r.context = ctx
+	s.r.slowPeers = slowPeerPolicy{
+		threshold: 1,
+		duration:  time.Millisecond * 10,
+		action:    SlowPeerAvoid,
+	}
+	p := addTestPeer(s, types.PublicKey{1})
+	s._slowPeerTimer = s.r.clock.AfterFunc(time.Hour, func() {})
+
+	step := func() {
+		phony.Block(s, s._maintainSlowPeers)
+	}
+
+	p.traffic.push(getFrame())
+	p.traffic.push(getFrame())
+	step()
+	if p.congested.Load() {
+		t.Fatalf("peer shouldn't be avoided before the duration has passed")
+	}
+	time.Sleep(time.Millisecond * 20)
+	step()
+	if !p.congested.Load() {
+		t.Fatalf("peer should be avoided after staying above the threshold")
+	}
+
+	p.traffic.reset()
+	step()
+	if !p.congested.Load() {
+		t.Fatalf("peer should still be avoided until it has drained for the duration")
+	}
+	time.Sleep(time.Millisecond * 20)
+	step()
+	if p.congested.Load() {
+		t.Fatalf("peer should no longer be avoided after draining")
+	}
+}
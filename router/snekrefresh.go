@@ -0,0 +1,197 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"fmt"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+// SNEK paths are soft state, so they have to be refreshed or they expire.
+// Sending a new bootstrap every interval does that, but every bootstrap
+// sets up a whole new path with a new sequence number, replacing the old
+// path at every hop, and any hop that sees things differently for a moment
+// can send the new bootstrap somewhere else. Once one of our bootstraps has
+// been confirmed, we instead send a refresh along the path that it set up.
+// Each node on the path checks that the refresh came from the peer that the
+// path came from, with the sequence number of the path, updates when the
+// path was last seen and passes the refresh on to the next hop. The node at
+// the end of the path confirms the refresh in the same way as a bootstrap,
+// as long as we are still its descending node. Healthy paths therefore last
+// for as long as they are refreshed, and only dead ones expire.
+//
+// Paths belong to the root key that they were set up under, but not to its
+// sequence number, so they also survive the root sending a new announcement.
+// Refreshes carry the root that we are using, and nodes on the path that
+// have moved to a different root drop them.
+//
+// If the next-hop or the node that our bootstrap is heading for changes, or
+// our root changes, or a refresh isn't confirmed in time, then we go back
+// to sending a full bootstrap, which sets up a new path.
+
+// snekRefreshPath is our confirmed path, which is refreshed rather than
+// being set up again.
+type snekRefreshPath struct {
+	via      *peer           // The peer that the bootstrap was sent to
+	target   types.PublicKey // The node that the bootstrap was heading for
+	root     types.PublicKey // The root that the path was set up under
+	sequence types.Varu64    // The sequence of the bootstrap
+}
+
+// _pathConfirmed is called when one of our bootstraps or refreshes is
+// confirmed, so that the path can be refreshed from now on.
+func (s *state) _pathConfirmed(sequence types.Varu64) {
+	attempt, ok := s._bootstrapAttempts.outstanding[sequence]
+	if !ok {
+		return
+	}
+	via := s._peers[attempt.Port]
+	if via == nil {
+		return
+	}
+	s._refresh = &snekRefreshPath{
+		via:      via,
+		target:   attempt.Target,
+		root:     s._rootAnnouncement().RootPublicKey,
+		sequence: sequence,
+	}
+}
+
+// _refreshPath sends a refresh along our confirmed path. It returns false if
+// the path can't be refreshed and a new bootstrap should be sent instead.
+func (s *state) _refreshPath() bool {
+	path := s._refresh
+	if path == nil || path.sequence != s._bootstrapSequence || !path.via.started.Load() {
+		return false
+	}
+	if _, ok := s._bootstrapAttempts.outstanding[path.sequence]; ok {
+		// The last refresh hasn't been confirmed yet. Wait for it to be
+		// confirmed or to time out before doing anything else.
+		return true
+	}
+	ann := s._rootAnnouncement()
+	if ann.RootPublicKey != path.root {
+		return false
+	}
+	if p, w := s._nextHopsSNEK(s.r.public, types.TypeBootstrap, types.VirtualSnakeWatermark{PublicKey: types.FullMask}); p != path.via || w.PublicKey != path.target {
+		// There's a better path, or a node that is closer to us than the
+		// one that our path leads to, so set up a new path.
+		return false
+	}
+	refresh := types.VirtualSnakeRefresh{
+		PublicKey: s.r.public,
+		Sequence:  path.sequence,
+		Root:      ann.Root,
+	}
+	if s.r.secure {
+		protected, err := refresh.ProtectedPayload()
+		if err != nil {
+			return false
+		}
+		copy(refresh.Signature[:], s.r.sign(protected))
+	}
+	send := getFrame()
+	send.Type = types.TypeSNEKRefresh
+	if err := send.AppendPayload(&refresh); err != nil {
+		framePool.Put(send)
+		return false
+	}
+	if !path.via.send(send) {
+		framePool.Put(send)
+		return false
+	}
+	s._lastbootstrap = s.r.clock.Now()
+	s._bootstrapSent(path.sequence, path.target, path.via)
+	s._recordPathEvent(ProtocolRefreshSent, PathID{s.r.public, path.sequence}, path.via, "")
+	s._awaitBootstrapConfirm(path.sequence)
+	return true
+}
+
+// _handleSNEKRefresh is called when a peer sends us a refresh for a path.
+// If the path goes through us, it is refreshed and the refresh is passed on
+// to the next hop, or confirmed if the path ends with us.
+func (s *state) _handleSNEKRefresh(from *peer, rx *types.Frame) error {
+	var refresh types.VirtualSnakeRefresh
+	if _, err := types.Decode(&refresh, rx.Payload); err != nil {
+		return fmt.Errorf("refresh.UnmarshalBinary: %w", err)
+	}
+	path := PathID{refresh.PublicKey, refresh.Sequence}
+	if s._isRevoked(refresh.PublicKey) {
+		s._recordPathEvent(ProtocolPathRejected, path, from, "key revoked")
+		return nil
+	}
+	if s.r.secure {
+		protected, err := refresh.ProtectedPayload()
+		if err != nil {
+			return fmt.Errorf("refresh.ProtectedPayload: %w", err)
+		}
+		if !s.r.verify(refresh.PublicKey[:], protected, refresh.Signature[:]) {
+			s._recordPathEvent(ProtocolPathRejected, path, from, "invalid signature")
+			return nil
+		}
+	}
+	root := s._rootAnnouncement()
+	entry, ok := s._table[virtualSnakeIndex{PublicKey: refresh.PublicKey}]
+	switch {
+	case root.RootPublicKey != refresh.RootPublicKey:
+		s._recordPathEvent(ProtocolPathRejected, path, from, "different root")
+		return nil
+	case !ok:
+		s._recordPathEvent(ProtocolPathRejected, path, from, "no path to refresh")
+		return nil
+	case entry.Watermark.Sequence != refresh.Sequence:
+		s._recordPathEvent(ProtocolPathRejected, path, from, "different sequence number")
+		return nil
+	case entry.Source != from:
+		s._recordPathEvent(ProtocolPathRejected, path, from, "path came from another peer")
+		return nil
+	}
+	if to := entry.Destination; s._draining && to != nil && to != s.r.local {
+		// We're about to leave, so let the path expire. The node that sent
+		// the refresh will set up a new path that doesn't go through us
+		// when the refresh isn't confirmed.
+		s._recordPathEvent(ProtocolPathRejected, path, from, "draining")
+		return nil
+	}
+	entry.LastSeen = s.r.clock.Now()
+	entry.Root = root.Root
+	s._recordPathEvent(ProtocolPathRefreshed, path, from, "")
+
+	if to := entry.Destination; to != nil && to != s.r.local {
+		if !to.started.Load() {
+			return nil
+		}
+		send := getFrame()
+		send.Type = types.TypeSNEKRefresh
+		send.Payload = append(send.Payload[:0], rx.Payload...)
+		if !to.send(send) {
+			framePool.Put(send)
+		}
+		return nil
+	}
+	if s._descending != entry {
+		// The path ends with us, but we've found a closer descending node
+		// since it was set up, so let the node that sent it find its own
+		// closer node by not confirming.
+		s._recordPathEvent(ProtocolDescendingRefused, path, from, "no longer descending node")
+		return nil
+	}
+	s._sendBootstrapConfirm(refresh.PublicKey, nil, refresh.Sequence)
+	return nil
+}
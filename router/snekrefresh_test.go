@@ -0,0 +1,149 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !minimal
+// +build !minimal
+
+package router
+
+import (
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+	"github.com/matrix-org/pinecone/util"
+)
+
+func TestSNEKRefreshKeepsPath(t *testing.T) {
+	timings := RouterOptionTimings{
+		SNEKMaintainInterval: time.Millisecond * 200,
+		BootstrapInterval:    time.Second,
+		PathExpiry:           time.Second * 2,
+	}
+	_, sk1, _ := ed25519.GenerateKey(nil)
+	_, sk2, _ := ed25519.GenerateKey(nil)
+	low, high := NewRouter(nil, sk1, timings), NewRouter(nil, sk2, timings)
+	t.Cleanup(func() {
+		_ = low.Close()
+		_ = high.Close()
+	})
+	if util.LessThan(high.PublicKey(), low.PublicKey()) {
+		low, high = high, low
+	}
+	if errA, errB := connectTestRouters(t, low, high); errA != nil || errB != nil {
+		t.Fatalf("failed to peer: %v, %v", errA, errB)
+	}
+
+	var path uint64
+	deadline := time.Now().Add(time.Second * 10)
+	for {
+		if asc, ok := low.Ascending(); ok && asc.Confirmed {
+			path = asc.Sequence
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("bootstrap wasn't confirmed")
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+
+	// The path is refreshed rather than set up again, so it keeps its
+	// sequence number for longer than it would last without refreshes.
+	time.Sleep(timings.PathExpiry * 2)
+	asc, ascOK := low.Ascending()
+	desc, descOK := high.Descending()
+	switch {
+	case !ascOK || !asc.Confirmed || asc.Sequence != path:
+		t.Fatalf("expected path %d to still be confirmed, got %+v", path, asc)
+	case !descOK || desc.PublicKey != low.PublicKey() || desc.Sequence != path:
+		t.Fatalf("expected path %d to still be our descending path, got %+v", path, desc)
+	case desc.Age >= timings.PathExpiry:
+		t.Fatalf("expected the path to have been refreshed, got %+v", desc)
+	}
+	id := PathID{low.PublicKey(), types.Varu64(path)}
+	if events := low.ProtocolHistory(ProtocolHistoryQuery{Kind: ProtocolRefreshSent, Path: &id}); len(events) == 0 {
+		t.Fatalf("expected refreshes to have been sent")
+	}
+	if events := high.ProtocolHistory(ProtocolHistoryQuery{Kind: ProtocolPathRefreshed, Path: &id}); len(events) == 0 {
+		t.Fatalf("expected the path to have been refreshed")
+	}
+}
+
+func TestSNEKRefreshChecksPath(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	root := types.Root{RootPublicKey: types.PublicKey{9}, RootSequence: 2}
+	s := newTestState(types.PublicKey{}, clock)
+	from := addTestPeer(s, types.PublicKey{1})
+	other := addTestPeer(s, types.PublicKey{2})
+	next := addTestPeer(s, types.PublicKey{3})
+	next.started.Store(false)
+	s._parent = from
+	s._announcements = announcementTable{
+		from: &rootAnnouncementWithTime{
+			SwitchAnnouncement: types.SwitchAnnouncement{Root: root},
+			receiveTime:        clock.Now(),
+		},
+	}
+	origin := types.PublicKey{4}
+	index := virtualSnakeIndex{PublicKey: origin}
+	s._table[index] = &virtualSnakeEntry{
+		virtualSnakeIndex: &index,
+		Source:            from,
+		Destination:       next,
+		LastSeen:          clock.Now(),
+		Root:              types.Root{RootPublicKey: root.RootPublicKey, RootSequence: 1},
+		Watermark:         types.VirtualSnakeWatermark{PublicKey: origin, Sequence: 100},
+	}
+
+	refresh := func(p *peer, sequence types.Varu64, rootKey types.PublicKey) {
+		t.Helper()
+		f := &types.Frame{Type: types.TypeSNEKRefresh}
+		r := types.VirtualSnakeRefresh{
+			PublicKey: origin,
+			Sequence:  sequence,
+			Root:      types.Root{RootPublicKey: rootKey, RootSequence: 1},
+		}
+		if err := f.AppendPayload(&r); err != nil {
+			t.Fatal(err)
+		}
+		if err := s._handleSNEKRefresh(p, f); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	clock.Advance(time.Second)
+	for _, tc := range []struct {
+		name     string
+		from     *peer
+		sequence types.Varu64
+		root     types.PublicKey
+	}{
+		{"wrong sequence", from, 101, root.RootPublicKey},
+		{"wrong peer", other, 100, root.RootPublicKey},
+		{"wrong root", from, 100, types.PublicKey{8}},
+	} {
+		refresh(tc.from, tc.sequence, tc.root)
+		if e := s._table[index]; !e.LastSeen.Equal(clock.Now().Add(-time.Second)) {
+			t.Fatalf("path was refreshed despite the %s", tc.name)
+		}
+	}
+
+	// The path survives the root sequence number changing, and takes on
+	// the new one.
+	refresh(from, 100, root.RootPublicKey)
+	if e := s._table[index]; !e.LastSeen.Equal(clock.Now()) || e.Root != root {
+		t.Fatalf("expected the path to be refreshed under the new root sequence, got %+v", e)
+	}
+}
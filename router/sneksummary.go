@@ -0,0 +1,105 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+// A new peer doesn't know about any SNEK paths until bootstraps start to
+// pass through it, which in a large network can take a few bootstrap
+// intervals. To speed this up, when a peering comes up we send the peer a
+// summary of the keys that can be reached through us. The peer treats these
+// as next-hop candidates until the summary expires, by which time organic
+// bootstrap traffic should have taken over. If the summary changes where
+// the peer's own bootstraps would go then it bootstraps again right away.
+
+type snekSummary struct {
+	root     types.Root
+	keys     []types.PublicKey
+	received time.Time
+}
+
+// valid returns true if the summary hasn't expired and was sent under the
+// given root. Summaries last as long as the paths that they stand in for.
+func (s *snekSummary) valid(root *types.Root, now time.Time, expiry time.Duration) bool {
+	return now.Sub(s.received) < expiry && s.root.EqualTo(root)
+}
+
+// _snekSummaryFrame returns a frame summarising the keys that the given
+// peer can reach through us, or nil if there is nothing to summarise.
+func (s *state) _snekSummaryFrame(p *peer) *types.Frame {
+	root := s._rootAnnouncement().Root
+	summary := types.VirtualSnakeSummary{
+		Root: root,
+		Keys: []types.PublicKey{s.r.public},
+	}
+	for _, entry := range s._table {
+		if len(summary.Keys) >= snekSummaryMaxKeys {
+			break
+		}
+		switch {
+		case !entry.valid(s.r.clock.Now(), s.r.timings.PathExpiry) || !entry.underRoot(&root):
+		case entry.Source == p || entry.PublicKey == p.public:
+			// The peer would just route back to itself.
+		default:
+			summary.Keys = append(summary.Keys, entry.PublicKey)
+		}
+	}
+	frame := getFrame()
+	frame.Type = types.TypeSNEKSummary
+	n, err := summary.MarshalBinary(frame.Payload[:cap(frame.Payload)])
+	if err != nil {
+		framePool.Put(frame)
+		return nil
+	}
+	frame.Payload = frame.Payload[:n]
+	return frame
+}
+
+// _handleSNEKSummary is called when a peer sends us a summary of the keys
+// that can be reached through it.
+func (s *state) _handleSNEKSummary(p *peer, rx *types.Frame) error {
+	var summary types.VirtualSnakeSummary
+	if _, err := types.Decode(&summary, rx.Payload); err != nil {
+		return fmt.Errorf("summary.UnmarshalBinary: %w", err)
+	}
+	keys := make([]types.PublicKey, 0, len(summary.Keys))
+	for _, key := range summary.Keys {
+		if len(keys) >= snekSummaryMaxKeys {
+			break
+		}
+		if key != s.r.public && !s._isRevoked(key) {
+			keys = append(keys, key)
+		}
+	}
+	watermark := types.VirtualSnakeWatermark{PublicKey: types.FullMask}
+	_, before := s._nextHopsSNEK(s.r.public, types.TypeBootstrap, watermark)
+	p._summary = &snekSummary{
+		root:     summary.Root,
+		keys:     keys,
+		received: s.r.clock.Now(),
+	}
+	if _, after := s._nextHopsSNEK(s.r.public, types.TypeBootstrap, watermark); after.PublicKey != before.PublicKey {
+		s._bootstrapSoon()
+	}
+	return nil
+}
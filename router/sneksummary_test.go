@@ -0,0 +1,119 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+	"go.uber.org/atomic"
+)
+
+func TestSNEKSummaryNextHop(t *testing.T) {
+	selfKey := types.PublicKey{2}
+	destKey := types.PublicKey{4}
+	root := types.Root{RootPublicKey: types.PublicKey{9}, RootSequence: 1}
+
+	self := &peer{started: *atomic.NewBool(true), public: selfKey}
+	parent := &peer{started: *atomic.NewBool(true), public: types.PublicKey{8}}
+	other := &peer{started: *atomic.NewBool(true), public: types.PublicKey{7}}
+
+	ann := &rootAnnouncementWithTime{
+		SwitchAnnouncement: types.SwitchAnnouncement{Root: root},
+	}
+	params := virtualSnakeNextHopParams{
+		false,
+		destKey,
+		selfKey,
+		types.VirtualSnakeWatermark{PublicKey: types.FullMask},
+		parent,
+		self,
+		ann,
+		announcementTable{
+			parent: ann,
+			other:  ann,
+		},
+		virtualSnakeTable{},
+		time.Now(),
+		virtualSnakeNeighExpiryPeriod,
+	}
+
+	// Without a summary, traffic for a key above ours heads for the root.
+	if p, _ := getNextHopSNEK(params); p != parent {
+		t.Fatalf("expected traffic to go to the parent")
+	}
+
+	// Once the other peer has told us that it can reach the destination,
+	// traffic goes there instead.
+	other._summary = &snekSummary{
+		root:     root,
+		keys:     []types.PublicKey{destKey},
+		received: time.Now(),
+	}
+	if p, _ := getNextHopSNEK(params); p != other {
+		t.Fatalf("expected traffic to go to the peer with the summary")
+	}
+
+	// A summary from under a different root is ignored.
+	other._summary.root.RootSequence = 2
+	if p, _ := getNextHopSNEK(params); p != parent {
+		t.Fatalf("expected summary from a different root to be ignored")
+	}
+
+	// As is one that has expired.
+	other._summary.root = root
+	other._summary.received = params.now.Add(-virtualSnakeNeighExpiryPeriod)
+	if p, _ := getNextHopSNEK(params); p != parent {
+		t.Fatalf("expected expired summary to be ignored")
+	}
+}
+
+func TestSNEKSummaryFrame(t *testing.T) {
+	s := newTestState(types.PublicKey{5}, systemClock{})
+	newPeer := &peer{started: *atomic.NewBool(true), public: types.PublicKey{7}}
+	oldPeer := &peer{started: *atomic.NewBool(true), public: types.PublicKey{8}}
+	root := s._rootAnnouncement().Root
+	entry := func(key types.PublicKey, source *peer) *virtualSnakeEntry {
+		return &virtualSnakeEntry{
+			virtualSnakeIndex: &virtualSnakeIndex{PublicKey: key},
+			Source:            source,
+			LastSeen:          time.Now(),
+			Root:              root,
+		}
+	}
+	s._table = virtualSnakeTable{
+		{PublicKey: types.PublicKey{1}}: entry(types.PublicKey{1}, oldPeer),
+		{PublicKey: types.PublicKey{3}}: entry(types.PublicKey{3}, newPeer),
+		{PublicKey: types.PublicKey{7}}: entry(types.PublicKey{7}, oldPeer),
+	}
+
+	// The summary includes our own key and our paths, except for those that
+	// would lead straight back to the new peer.
+	f := s._snekSummaryFrame(newPeer)
+	if f == nil || f.Type != types.TypeSNEKSummary {
+		t.Fatalf("expected a summary frame")
+	}
+	var summary types.VirtualSnakeSummary
+	if _, err := summary.UnmarshalBinary(f.Payload); err != nil {
+		t.Fatal(err)
+	}
+	if summary.Root != root {
+		t.Fatalf("expected summary under our root")
+	}
+	if len(summary.Keys) != 2 || summary.Keys[0] != s.r.public || summary.Keys[1] != (types.PublicKey{1}) {
+		t.Fatalf("unexpected keys in summary: %v", summary.Keys)
+	}
+}
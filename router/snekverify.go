@@ -0,0 +1,349 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !minimal
+// +build !minimal
+
+package router
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// A single node can only check its own routing state, which is what the
+// invariant checker does. Whether the SNEK as a whole is correct depends on
+// every node agreeing with the others, so VerifySNEK takes a snapshot of
+// each node in a network that can be seen all at once, like in the
+// simulator or in tests that run routers in-process, and checks that:
+//
+//   - every node's ascending and descending neighbours are the nodes that
+//     come just after and just before it in key order, out of the nodes
+//     that it is connected to;
+//   - no node has a path that isn't continued by the node that it came
+//     from or the node that it goes to, or that was set up by a node that
+//     isn't there;
+//   - every hop of a path is recorded the same way at both ends.
+//
+// Snapshots are taken one node at a time while the network is running, so
+// a network that is still converging can show violations that sort
+// themselves out, and stale paths are only cleaned up when they expire.
+// Callers that expect a clean result should keep checking for a while.
+
+// SNEKPath is a path in the routing table of a node.
+type SNEKPath struct {
+	Path PathID          // The bootstrap that set up the path
+	From types.PublicKey // The peer that the bootstrap came from
+	To   types.PublicKey // The peer that the path goes to, or our own key if it ends with us
+}
+
+// SNEKSnapshot is the SNEK state of one node at a point in time.
+type SNEKSnapshot struct {
+	PublicKey  types.PublicKey
+	Peers      []types.PublicKey // Nodes that we have at least one started peering with
+	Ascending  *SNEKNeighbour
+	Descending *SNEKNeighbour
+	Paths      []SNEKPath // Paths that haven't expired
+}
+
+// SNEKSnapshot returns the SNEK state of this node, for VerifySNEK.
+func (r *Router) SNEKSnapshot() SNEKSnapshot {
+	snapshot := SNEKSnapshot{PublicKey: r.public}
+	phony.Block(r.state, func() {
+		if asc, ok := r.state._ascendingNeighbour(); ok {
+			snapshot.Ascending = &asc
+		}
+		if desc, ok := r.state._descendingNeighbour(); ok {
+			snapshot.Descending = &desc
+		}
+		seen := map[types.PublicKey]struct{}{}
+		for _, p := range r.state._peers {
+			if p == nil || p == r.local || !p.started.Load() {
+				continue
+			}
+			if _, ok := seen[p.public]; !ok {
+				seen[p.public] = struct{}{}
+				snapshot.Peers = append(snapshot.Peers, p.public)
+			}
+		}
+		for _, entry := range r.state._table {
+			if !entry.valid(r.clock.Now(), r.timings.PathExpiry) || entry.Source == nil {
+				continue
+			}
+			path := SNEKPath{
+				Path: PathID{entry.PublicKey, entry.Watermark.Sequence},
+				From: entry.Source.public,
+				To:   r.public,
+			}
+			if entry.Destination != nil && entry.Destination != r.local {
+				path.To = entry.Destination.public
+			}
+			snapshot.Paths = append(snapshot.Paths, path)
+		}
+	})
+	sort.Slice(snapshot.Paths, func(i, j int) bool {
+		return snapshot.Paths[i].Path.PublicKey.CompareTo(snapshot.Paths[j].Path.PublicKey) < 0
+	})
+	return snapshot
+}
+
+// SNEKVerifiable is a node that VerifySNEK can check, which a Router is.
+type SNEKVerifiable interface {
+	SNEKSnapshot() SNEKSnapshot
+	ProtocolHistory(q ProtocolHistoryQuery) []ProtocolEvent
+}
+
+// SNEKViolationKind describes what is wrong in a SNEKViolation.
+type SNEKViolationKind string
+
+const (
+	// SNEKWrongAscending is a node whose ascending neighbour isn't the next
+	// node in key order.
+	SNEKWrongAscending SNEKViolationKind = "wrong_ascending"
+	// SNEKWrongDescending is a node whose descending neighbour isn't the
+	// previous node in key order.
+	SNEKWrongDescending SNEKViolationKind = "wrong_descending"
+	// SNEKOrphanPath is a path that the neighbouring nodes along it don't
+	// know about, or that was set up by a node that isn't connected.
+	SNEKOrphanPath SNEKViolationKind = "orphan_path"
+	// SNEKAsymmetricPath is a hop of a path that the nodes at either end
+	// disagree about.
+	SNEKAsymmetricPath SNEKViolationKind = "asymmetric_path"
+)
+
+// SNEKHistoryEvent is an event from the protocol history of one node.
+type SNEKHistoryEvent struct {
+	Node types.PublicKey // The node that recorded the event
+	ProtocolEvent
+}
+
+// SNEKViolation is something that VerifySNEK found wrong with the network.
+type SNEKViolation struct {
+	Node    types.PublicKey // The node that the violation was found on
+	Kind    SNEKViolationKind
+	Path    *PathID            // The path involved, if any
+	Reason  string             // What was expected and what was found instead
+	History []SNEKHistoryEvent // Events that led up to the violation, oldest first
+}
+
+func (v SNEKViolation) String() string {
+	if v.Path != nil {
+		return fmt.Sprintf("%s on %s for path %s: %s", v.Kind, v.Node, v.Path, v.Reason)
+	}
+	return fmt.Sprintf("%s on %s: %s", v.Kind, v.Node, v.Reason)
+}
+
+// VerifySNEK checks that the SNEK state of the nodes is consistent across
+// the whole network, returning anything that it found wrong along with
+// the protocol history that explains it. Nodes that are only peered with
+// each other and not the rest are checked as a separate network.
+func VerifySNEK(nodes []SNEKVerifiable) []SNEKViolation {
+	snapshots := make(map[types.PublicKey]*SNEKSnapshot, len(nodes))
+	verifiable := make(map[types.PublicKey]SNEKVerifiable, len(nodes))
+	for _, node := range nodes {
+		snapshot := node.SNEKSnapshot()
+		snapshots[snapshot.PublicKey] = &snapshot
+		verifiable[snapshot.PublicKey] = node
+	}
+	components := snekComponents(snapshots)
+
+	var violations []SNEKViolation
+	for _, component := range components {
+		for i, key := range component {
+			violations = append(violations, verifyNeighbours(snapshots[key], component, i)...)
+		}
+	}
+	for _, component := range components {
+		for _, key := range component {
+			violations = append(violations, verifyPaths(snapshots, snapshots[key], component)...)
+		}
+	}
+
+	for i := range violations {
+		violations[i].History = snekViolationHistory(verifiable, &violations[i])
+	}
+	return violations
+}
+
+// snekComponents splits the nodes into groups that are peered with each
+// other, each sorted by key.
+func snekComponents(snapshots map[types.PublicKey]*SNEKSnapshot) [][]types.PublicKey {
+	visited := make(map[types.PublicKey]bool, len(snapshots))
+	var components [][]types.PublicKey
+	for start := range snapshots {
+		if visited[start] {
+			continue
+		}
+		visited[start] = true
+		component := []types.PublicKey{start}
+		for queue := []types.PublicKey{start}; len(queue) > 0; queue = queue[1:] {
+			for _, peer := range snapshots[queue[0]].Peers {
+				if _, ok := snapshots[peer]; ok && !visited[peer] {
+					visited[peer] = true
+					component = append(component, peer)
+					queue = append(queue, peer)
+				}
+			}
+		}
+		sort.Slice(component, func(i, j int) bool {
+			return component[i].CompareTo(component[j]) < 0
+		})
+		components = append(components, component)
+	}
+	sort.Slice(components, func(i, j int) bool {
+		return components[i][0].CompareTo(components[j][0]) < 0
+	})
+	return components
+}
+
+// verifyNeighbours checks the ascending and descending neighbours of the
+// node at the given position in its sorted component.
+func verifyNeighbours(s *SNEKSnapshot, component []types.PublicKey, i int) []SNEKViolation {
+	var violations []SNEKViolation
+	check := func(kind SNEKViolationKind, got *SNEKNeighbour, want *types.PublicKey) {
+		var reason string
+		switch {
+		case want == nil && got != nil:
+			reason = fmt.Sprintf("expected none, got %s", got.PublicKey)
+		case want != nil && got == nil:
+			reason = fmt.Sprintf("expected %s, got none", want)
+		case want != nil && got.PublicKey != *want:
+			reason = fmt.Sprintf("expected %s, got %s", want, got.PublicKey)
+		default:
+			return
+		}
+		violations = append(violations, SNEKViolation{Node: s.PublicKey, Kind: kind, Reason: reason})
+	}
+	var asc, desc *types.PublicKey
+	if i < len(component)-1 {
+		asc = &component[i+1]
+	}
+	if i > 0 {
+		desc = &component[i-1]
+	}
+	check(SNEKWrongAscending, s.Ascending, asc)
+	check(SNEKWrongDescending, s.Descending, desc)
+	return violations
+}
+
+// verifyPaths checks that every path in the node's routing table carries
+// on from the node that it came from and into the node that it goes to.
+// The node that set up a path doesn't have it in its own routing table, so
+// the first hop is only checked from the far end. Each hop is only checked
+// for asymmetry by the node that it starts from, so that it is reported
+// once.
+func verifyPaths(snapshots map[types.PublicKey]*SNEKSnapshot, s *SNEKSnapshot, component []types.PublicKey) []SNEKViolation {
+	var violations []SNEKViolation
+	report := func(kind SNEKViolationKind, path PathID, format string, args ...interface{}) {
+		violations = append(violations, SNEKViolation{
+			Node:   s.PublicKey,
+			Kind:   kind,
+			Path:   &path,
+			Reason: fmt.Sprintf(format, args...),
+		})
+	}
+	inComponent := func(key types.PublicKey) bool {
+		i := sort.Search(len(component), func(i int) bool {
+			return component[i].CompareTo(key) >= 0
+		})
+		return i < len(component) && component[i] == key
+	}
+	for _, p := range s.Paths {
+		if !inComponent(p.Path.PublicKey) {
+			report(SNEKOrphanPath, p.Path, "the node that set up the path isn't connected to us")
+			continue
+		}
+		if p.From != p.Path.PublicKey {
+			switch from, ok := snekPathAt(snapshots, p.From, p.Path.PublicKey); {
+			case !ok:
+				report(SNEKOrphanPath, p.Path, "%s, which the path came from, has no path for the key", p.From)
+			case from.To != s.PublicKey:
+				report(SNEKOrphanPath, p.Path, "%s, which the path came from, sends it to %s instead", p.From, from.To)
+			}
+		}
+		if p.To == s.PublicKey {
+			continue
+		}
+		switch to, ok := snekPathAt(snapshots, p.To, p.Path.PublicKey); {
+		case !ok:
+			report(SNEKOrphanPath, p.Path, "%s, which the path goes to, has no path for the key", p.To)
+		case to.From != s.PublicKey:
+			report(SNEKAsymmetricPath, p.Path, "%s, which the path goes to, has it coming from %s", p.To, to.From)
+		case to.Path.Sequence != p.Path.Sequence:
+			report(SNEKAsymmetricPath, p.Path, "%s, which the path goes to, has sequence %d", p.To, to.Path.Sequence)
+		}
+	}
+	return violations
+}
+
+// snekPathAt returns the path for the given key in the routing table of
+// the given node, if the node and the path are both there.
+func snekPathAt(snapshots map[types.PublicKey]*SNEKSnapshot, node, key types.PublicKey) (SNEKPath, bool) {
+	s, ok := snapshots[node]
+	if !ok {
+		return SNEKPath{}, false
+	}
+	i := sort.Search(len(s.Paths), func(i int) bool {
+		return s.Paths[i].Path.PublicKey.CompareTo(key) >= 0
+	})
+	if i < len(s.Paths) && s.Paths[i].Path.PublicKey == key {
+		return s.Paths[i], true
+	}
+	return SNEKPath{}, false
+}
+
+// snekViolationHistory collects the events that explain a violation. For
+// a path, that is every node's events about the node that set it up, so
+// that older bootstraps which left the path behind are included too. For
+// a neighbour, it is the node's own events about bootstraps, descending
+// nodes and parents, which are what decide its neighbours.
+func snekViolationHistory(nodes map[types.PublicKey]SNEKVerifiable, v *SNEKViolation) []SNEKHistoryEvent {
+	var history []SNEKHistoryEvent
+	collect := func(node types.PublicKey, q ProtocolHistoryQuery) {
+		for _, e := range nodes[node].ProtocolHistory(q) {
+			history = append(history, SNEKHistoryEvent{Node: node, ProtocolEvent: e})
+		}
+	}
+	if v.Path != nil {
+		keys := make([]types.PublicKey, 0, len(nodes))
+		for key := range nodes {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i].CompareTo(keys[j]) < 0
+		})
+		for _, key := range keys {
+			collect(key, ProtocolHistoryQuery{Key: v.Path.PublicKey})
+		}
+	} else {
+		collect(v.Node, ProtocolHistoryQuery{})
+		keep := history[:0]
+		for _, e := range history {
+			if e.Kind == ProtocolDescendingChanged || e.Kind == ProtocolDescendingRefused ||
+				e.Kind == ProtocolBootstrapSent || e.Kind == ProtocolBootstrapConfirmed ||
+				e.Kind == ProtocolBootstrapFailed || e.Kind == ProtocolConfirmIgnored ||
+				e.Kind == ProtocolParentChanged {
+				keep = append(keep, e)
+			}
+		}
+		history = keep
+	}
+	sort.SliceStable(history, func(i, j int) bool {
+		return history[i].Time.Before(history[j].Time)
+	})
+	return history
+}
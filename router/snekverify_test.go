@@ -0,0 +1,111 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !minimal
+// +build !minimal
+
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+type testSNEKNode struct {
+	snapshot SNEKSnapshot
+	history  []ProtocolEvent
+}
+
+func (n *testSNEKNode) SNEKSnapshot() SNEKSnapshot { return n.snapshot }
+
+func (n *testSNEKNode) ProtocolHistory(q ProtocolHistoryQuery) []ProtocolEvent {
+	var events []ProtocolEvent
+	for i := range n.history {
+		if q.matches(&n.history[i]) {
+			events = append(events, n.history[i])
+		}
+	}
+	return events
+}
+
+func TestVerifySNEK(t *testing.T) {
+	// A line of three nodes, 1 - 2 - 3, in key order. Node 1 bootstraps
+	// through 2 to 3, which is wrong, and 2 bootstraps to 3.
+	var k1, k2, k3 types.PublicKey
+	k1[0], k2[0], k3[0] = 1, 2, 3
+	path1 := PathID{k1, 1}
+	path2 := PathID{k2, 1}
+	n1 := &testSNEKNode{snapshot: SNEKSnapshot{
+		PublicKey: k1,
+		Peers:     []types.PublicKey{k2},
+		Ascending: &SNEKNeighbour{PublicKey: k2},
+	}}
+	n2 := &testSNEKNode{snapshot: SNEKSnapshot{
+		PublicKey: k2,
+		Peers:     []types.PublicKey{k1, k3},
+		Ascending: &SNEKNeighbour{PublicKey: k3},
+		Paths:     []SNEKPath{{Path: path1, From: k1, To: k3}},
+	}}
+	n3 := &testSNEKNode{snapshot: SNEKSnapshot{
+		PublicKey:  k3,
+		Peers:      []types.PublicKey{k2},
+		Descending: &SNEKNeighbour{PublicKey: k2},
+		Paths:      []SNEKPath{{Path: PathID{k1, 0}, From: k2, To: k3}, {Path: path2, From: k2, To: k3}},
+	}}
+	n3.history = []ProtocolEvent{
+		{Time: time.Now(), Kind: ProtocolPathInstalled, Key: k1, Path: &path1},
+		{Time: time.Now(), Kind: ProtocolPathInstalled, Key: k2, Path: &path2},
+	}
+
+	violations := VerifySNEK([]SNEKVerifiable{n1, n2, n3})
+	if len(violations) != 2 {
+		t.Fatalf("expected 2 violations, got %v", violations)
+	}
+	if v := violations[0]; v.Kind != SNEKWrongDescending || v.Node != k2 {
+		t.Fatalf("expected node 2 to be missing its descending node, got %s", v)
+	}
+	v := violations[1]
+	if v.Kind != SNEKAsymmetricPath || v.Node != k2 || v.Path == nil || *v.Path != path1 {
+		t.Fatalf("expected the path from node 1 to have a different sequence at node 3, got %s", v)
+	}
+	if len(v.History) != 1 || v.History[0].Node != k3 || v.History[0].Key != k1 {
+		t.Fatalf("expected the history of the path from node 1, got %+v", v.History)
+	}
+
+	// Once node 2 takes node 1 as its descending node and node 3 drops
+	// the path, the only thing wrong is that node 2 has nowhere to send it.
+	n2.snapshot.Descending = &SNEKNeighbour{PublicKey: k1}
+	n3.snapshot.Paths = n3.snapshot.Paths[1:]
+	violations = VerifySNEK([]SNEKVerifiable{n1, n2, n3})
+	if len(violations) != 1 || violations[0].Kind != SNEKOrphanPath || violations[0].Node != k2 {
+		t.Fatalf("expected an orphan path on node 2, got %v", violations)
+	}
+
+	// Splitting node 3 off makes node 2 the highest key in its network,
+	// and leaves node 3 with a path from a node that it can't reach.
+	n2.snapshot.Peers = []types.PublicKey{k1}
+	n2.snapshot.Ascending, n2.snapshot.Paths = nil, nil
+	n3.snapshot.Peers, n3.snapshot.Descending = nil, nil
+	violations = VerifySNEK([]SNEKVerifiable{n1, n2, n3})
+	if len(violations) != 1 || violations[0].Kind != SNEKOrphanPath || violations[0].Node != k3 {
+		t.Fatalf("expected an orphan path on node 3, got %v", violations)
+	}
+
+	n3.snapshot.Paths = nil
+	if violations = VerifySNEK([]SNEKVerifiable{n1, n2, n3}); len(violations) != 0 {
+		t.Fatalf("expected no violations, got %v", violations)
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// Socket options are applied to the connection using whichever of these
+// interfaces it implements, so they work for TCP and unix sockets but are
+// quietly ignored for connections that don't support them, e.g. pipes or
+// websockets.
+
+type socketReadBuffer interface {
+	SetReadBuffer(bytes int) error
+}
+
+type socketWriteBuffer interface {
+	SetWriteBuffer(bytes int) error
+}
+
+type socketNoDelay interface {
+	SetNoDelay(noDelay bool) error
+}
+
+type socketKeepAlive interface {
+	SetKeepAlive(keepalive bool) error
+	SetKeepAlivePeriod(d time.Duration) error
+}
+
+// applySocketOptions applies the given socket options to the connection, or
+// to the underlying connection if it is wrapped, e.g. by a *tls.Conn.
+func applySocketOptions(conn net.Conn, o ConnectionSocketOptions) error {
+	if c, ok := conn.(interface{ NetConn() net.Conn }); ok {
+		conn = c.NetConn()
+	}
+	if s, ok := conn.(socketReadBuffer); ok && o.ReadBuffer > 0 {
+		if err := s.SetReadBuffer(o.ReadBuffer); err != nil {
+			return fmt.Errorf("conn.SetReadBuffer: %w", err)
+		}
+	}
+	if s, ok := conn.(socketWriteBuffer); ok && o.WriteBuffer > 0 {
+		if err := s.SetWriteBuffer(o.WriteBuffer); err != nil {
+			return fmt.Errorf("conn.SetWriteBuffer: %w", err)
+		}
+	}
+	if s, ok := conn.(socketNoDelay); ok && o.Nagle {
+		if err := s.SetNoDelay(false); err != nil {
+			return fmt.Errorf("conn.SetNoDelay: %w", err)
+		}
+	}
+	if s, ok := conn.(socketKeepAlive); ok && o.KeepAlive != 0 {
+		if err := s.SetKeepAlive(o.KeepAlive > 0); err != nil {
+			return fmt.Errorf("conn.SetKeepAlive: %w", err)
+		}
+		if o.KeepAlive > 0 {
+			if err := s.SetKeepAlivePeriod(o.KeepAlive); err != nil {
+				return fmt.Errorf("conn.SetKeepAlivePeriod: %w", err)
+			}
+		}
+	}
+	return nil
+}
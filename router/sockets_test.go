@@ -0,0 +1,128 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestApplySocketOptions(t *testing.T) {
+	options := ConnectionSocketOptions{
+		ReadBuffer:  32 * 1024,
+		WriteBuffer: 32 * 1024,
+		Nagle:       true,
+		KeepAlive:   time.Second * 30,
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	c, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := applySocketOptions(c, options); err != nil {
+		t.Fatalf("failed to apply socket options to TCP connection: %v", err)
+	}
+
+	// Connections without sockets should be left alone.
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	if err := applySocketOptions(a, options); err != nil {
+		t.Fatalf("failed to ignore socket options on pipe: %v", err)
+	}
+}
+
+// flushConn records each write to the connection, which for a coalescing
+// peering is each time that the buffer is flushed.
+type flushConn struct {
+	net.Conn
+	flushes chan []byte
+}
+
+func (c *flushConn) Write(b []byte) (int, error) {
+	c.flushes <- append([]byte(nil), b...)
+	return len(b), nil
+}
+
+func TestWriteCoalescing(t *testing.T) {
+	_, _, p := newTransitState()
+	conn := &flushConn{flushes: make(chan []byte, 8)}
+	p.conn = conn
+	p.coalesce = bufio.NewWriterSize(conn, 16)
+	write := func(b string) {
+		if _, err := p._writeFrame([]byte(b)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect := func(writes ...string) {
+		t.Helper()
+		var got []string
+		for len(conn.flushes) > 0 {
+			got = append(got, string(<-conn.flushes))
+		}
+		if !reflect.DeepEqual(got, writes) {
+			t.Fatalf("expected writes %q, got %q", writes, got)
+		}
+	}
+
+	// Frames stay in the buffer while there are more waiting to be sent,
+	// and go out together after the last one.
+	waiting := getFrame()
+	p.proto.push(waiting)
+	write("ab")
+	write("cd")
+	expect()
+	p.proto.ack(<-p.proto.pop())
+	write("ef")
+	expect("abcdef")
+
+	// A frame that doesn't fit in the buffer isn't held back.
+	p.proto.push(waiting)
+	write("0123456789abcdef0123")
+	expect("0123456789abcdef0123")
+
+	// Anything left in the buffer is flushed before the writer waits for
+	// more frames to send.
+	write("gh")
+	p.proto.ack(<-p.proto.pop())
+	expect()
+	ctx, cancel := context.WithCancel(context.Background())
+	p.context = ctx
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p._write()
+	}()
+	select {
+	case b := <-conn.flushes:
+		if string(b) != "gh" {
+			t.Fatalf("expected the buffered frame to be flushed, got %q", b)
+		}
+	case <-time.After(time.Second * 10):
+		t.Fatalf("buffered frame wasn't flushed before waiting")
+	}
+	cancel()
+	<-done
+}
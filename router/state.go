@@ -15,6 +15,7 @@
 package router
 
 import (
+	"bufio"
 	"context"
 	"encoding/hex"
 	"fmt"
@@ -45,15 +46,85 @@ type state struct {
 	_table          virtualSnakeTable                  // Virtual snake DHT entries
 	_ordering       uint64                             // Used to order incoming tree announcements
 	_sequence       uint64                             // Used to sequence our root tree announcements
-	_treetimer      *time.Timer                        // Tree maintenance timer
-	_snaketimer     *time.Timer                        // Virtual snake maintenance timer
-	_broadcastTimer *time.Timer                        // Wakeup Broadcast maintenance timer
+	_treetimer      Timer                              // Tree maintenance timer
+	_snaketimer     Timer                              // Virtual snake maintenance timer
+	_broadcastTimer Timer                              // Wakeup Broadcast maintenance timer
 	_seenBroadcasts map[types.PublicKey]broadcastEntry // Cache of previously seen wakeup broadcasts
 	_lastbootstrap  time.Time                          // When did we last bootstrap?
 	_waiting        bool                               // Is the tree waiting to reparent?
 	_filterPacket   FilterFn                           // Function called when forwarding packets
-	_bandwidthTimer *time.Timer
+	_filterRoute    RouteFilterFn                      // Function called with the next-hop for packets
+	_bandwidthTimer Timer
 	_coordsCache    coordsCacheTable
+	_coordsTimer    Timer
+
+	_handshakeFailures map[types.PublicKey]uint64 // Attributable handshake failures by key
+	_handshakeDecay    time.Time                  // When handshake failures were last decayed
+	_qualityTimer      Timer                      // Peer quality maintenance timer
+	_queueAlarmTimer   Timer                      // Queue alarm maintenance timer
+	_watchdogTimer     Timer                      // Watchdog maintenance timer
+	_slowPeerTimer     Timer                      // Slow peer maintenance timer
+	_serviceTimer      Timer                      // Service advertisement timer
+	_continuityTimer   Timer                      // Continuity record publishing timer
+	_loadShedTimer     Timer                      // Load shedding maintenance timer
+	_timeSyncTimer     Timer                      // Time sync maintenance timer
+	_reserved          []ReservedPeer             // Peerings that are exempt from the peer cap
+	_powerMode         PowerMode                  // Controls the maintenance cadence
+	_announcePending   bool                       // Tree announcements are waiting to be flushed
+	_suspended         bool                       // Maintenance is suspended
+	_suspendedAt       time.Time                  // When maintenance was suspended
+	_bootstrapSequence types.Varu64               // The sequence of our last bootstrap
+	_echoes            map[uint64]*pendingEcho    // Lookups waiting for an echo reply
+	_echoSequence      uint64                     // Used to identify our echo requests
+	_rtts              rttTable                   // Round trip times to destinations
+	_pathStats         pathStatsTable             // Path lengths and loops to destinations
+	_services          map[string]uint64          // Services that we advertise, with capacity
+	_serviceSequence   types.Varu64               // Used to sequence our service advertisements
+	_seenServices      serviceTable               // Services advertised by other nodes
+	_predecessors      continuityTable            // Records linking our old keys to us
+	_continuity        continuityTable            // Records linking old keys to new keys
+	_revocations       *types.RevocationList      // The current revocation list, if any
+	_revoked           revokedKeys                // Keys in the current revocation list
+	_forwardFilter     ForwardFilterFn            // Function called for frames that we relay
+	_forwardLimits     forwardLimits              // Rate limits applied by the forward filter
+	_droppedTraffic    DroppedTrafficFn           // Told about our traffic dropped from stopped peerings
+	_taps              tapTable                   // Consumers of copies of our frames
+	_pendingBootstraps pendingBootstrapTable      // Bootstraps waiting to be acknowledged
+	_bootstrapConfirm  *bootstrapConfirmation     // The last confirmation of one of our bootstraps
+	_bootstrapAttempts *bootstrapTracker          // Our bootstraps that haven't been resolved yet
+	_refresh           *snekRefreshPath           // Our confirmed path, if it can be refreshed
+	_lastReachability  time.Time                  // When did we last send reachability filters?
+	_routeFeeds        routeFeedTable             // Subscribers to routing table changes
+	_custody           *custodyStore              // Bundles that we hold in delay-tolerant mode
+	_history           *protocolHistory           // Recent protocol events, nil if disabled
+	_stateLog          *stateLogger               // Protocol events to write to the log, nil if disabled
+	_convergence       convergenceTracker         // How long it takes to find our SNEK neighbours
+	_treeStats         treeStatsTracker           // Recent changes to the spanning tree
+	_selfRoot          rootAnnouncementWithTime   // Reused by _lookupRoot when we are the root
+	_keyspace          keyspaceTracker            // Recent changes to our SNEK neighbours
+	_rootWatch         rootWatch                  // Roots that we have seen and how they behaved
+	_adjacency         adjacencyTracker           // Statements from other nodes about their neighbours
+	_load              LoadStatus                 // The last load sample and how much load has been shed
+	_links             map[types.PublicKey]int    // How many running links we have to each neighbour
+	_routeTracer       *routeTracer               // Traces of how frames were routed, if enabled
+	_analyzer          *frameAnalyzer             // Counts of the frames that we handled, if enabled
+	_latency           *forwardLatency            // How long frames took to forward, if enabled
+	_health            healthTracker              // What the invariant checker has found
+	_rollups           *statsRollups              // Recent counts of forwarded frames, drops and so on
+	_nodeInfo          nodeInfoState              // Node info queries that we sent or answered
+	_debugQueries      debugQueryState            // Debug queries that we sent or answered
+	_searches          searchState                // Searches waiting for a response
+	_amplification     amplificationState         // Bytes sent to and received from unverified sources
+	_fallbacks         RoutingFallbacks           // Traffic that was routed the other way
+	_draining          bool                       // Are we about to leave the network?
+	_trafficPolicy     *trafficPolicy             // Rules for the traffic that we send and forward, nil if none
+	_sendQueues        sendQueueTable             // Our traffic waiting for a next hop, by destination
+	_sendHeld          uint64                     // Payload bytes in _sendQueues
+	_sendStats         SendQueueStats             // Our traffic that has waited for a next hop
+
+	// The announcement store, see announcements.go.
+	_announcementMemory uint64            // Estimated bytes held by _announcements
+	_announcementStats  AnnouncementStats // Announcements evicted and refused
 }
 
 type coordsCacheTable map[types.PublicKey]coordsCacheEntry
@@ -65,38 +136,65 @@ type coordsCacheEntry struct {
 
 // _start resets the state and starts tree and virtual snake maintenance.
 func (s *state) _start() {
-	s._setParent(nil)
+	s._setParent(nil, "routing state reset")
 	s._setDescendingNode(nil)
+	for k, v := range s._table {
+		s._recordPathEvent(ProtocolPathRemoved, PathID{k.PublicKey, v.Watermark.Sequence}, v.Source, "routing state reset")
+	}
 
 	s._ordering = 0
 	s._waiting = false
 
 	s._announcements = make(announcementTable, portCount)
+	s._announcementMemory = 0
 	s._table = virtualSnakeTable{}
 	s._coordsCache = coordsCacheTable{}
+	s._echoes = make(map[uint64]*pendingEcho)
+	s._rtts = rttTable{}
+	s._pathStats = pathStatsTable{}
+	s._seenServices = serviceTable{}
+	s._continuity = continuityTable{}
+	if s._predecessors == nil {
+		s._predecessors = continuityTable{}
+	}
+	if s._services == nil {
+		s._services = map[string]uint64{}
+	}
+	if s._custody == nil {
+		s._custody = newCustodyStore(s.r.clock.Now())
+	}
+	if s._routeFeeds == nil {
+		s._routeFeeds = routeFeedTable{}
+	} else {
+		// The routing tables have been reset, so subscribers need to
+		// start again from an empty snapshot.
+		s._publishRoute(s._routingSnapshot())
+	}
 	s._seenBroadcasts = make(map[types.PublicKey]broadcastEntry)
+	s._pendingBootstraps = pendingBootstrapTable{}
+	s._bootstrapAttempts = newBootstrapTracker()
+	s._refresh = nil
 
 	if s._treetimer == nil {
-		s._treetimer = time.AfterFunc(announcementInterval, func() {
+		s._treetimer = s.r.clock.AfterFunc(s.r.timings.AnnouncementInterval, func() {
 			s.Act(nil, s._maintainTree)
 		})
 	}
 
 	if s._snaketimer == nil {
-		s._snaketimer = time.AfterFunc(time.Second, func() {
+		s._snaketimer = s.r.clock.AfterFunc(time.Second, func() {
 			s.Act(nil, s._maintainSnake)
 		})
 	}
 
 	if s._broadcastTimer == nil {
-		s._broadcastTimer = time.AfterFunc(wakeupBroadcastInterval, func() {
+		s._broadcastTimer = s.r.clock.AfterFunc(wakeupBroadcastInterval, func() {
 			s.Act(nil, s._maintainBroadcasts)
 		})
 	}
 
 	if s._bandwidthTimer == nil {
-		s._bandwidthTimer = time.AfterFunc(time.Until(
-			time.Now().Round(time.Minute).Add(BWReportingInterval)),
+		s._bandwidthTimer = s.r.clock.AfterFunc(s._untilBandwidthReport(BWReportingInterval),
 			func() {
 				s.Act(nil, s._reportBandwidth)
 			})
@@ -104,72 +202,103 @@ func (s *state) _start() {
 
 	s._maintainTreeIn(0)
 	s._maintainSnakeIn(0)
-	time.AfterFunc(coordsCacheMaintainInterval, func() {
-		s.Act(nil, s._cleanCachedCoords)
-	})
+	if s._coordsTimer == nil {
+		s._coordsTimer = s.r.clock.AfterFunc(coordsCacheMaintainInterval, func() {
+			s.Act(nil, s._cleanCachedCoords)
+		})
+	}
+	if s._qualityTimer == nil {
+		s._qualityTimer = s.r.clock.AfterFunc(peerQualityInterval, func() {
+			s.Act(nil, s._maintainPeerQuality)
+		})
+	}
+	if s._serviceTimer == nil {
+		s._serviceTimer = s.r.clock.AfterFunc(serviceAdvertisementInterval, func() {
+			s.Act(nil, s._maintainServices)
+		})
+	}
+	if s._continuityTimer == nil {
+		s._continuityTimer = s.r.clock.AfterFunc(continuityPublishInterval, func() {
+			s.Act(nil, s._maintainContinuity)
+		})
+	}
+	if s.r.watchdog > 0 && s._watchdogTimer == nil {
+		s._watchdogTimer = s.r.clock.AfterFunc(s.r.watchdog/2, func() {
+			s.Act(nil, s._maintainWatchdog)
+		})
+	}
+	if s.r.slowPeers.enabled() && s._slowPeerTimer == nil {
+		s._slowPeerTimer = s.r.clock.AfterFunc(s.r.slowPeers.checkInterval(), func() {
+			s.Act(nil, s._maintainSlowPeers)
+		})
+	}
+	if s.r.queueAlarm.enabled() && s._queueAlarmTimer == nil {
+		s._queueAlarmTimer = s.r.clock.AfterFunc(s.r.queueAlarm.checkInterval(), func() {
+			s.Act(nil, s._maintainQueueAlarms)
+		})
+	}
+	if s.r.loadShedding != nil && s._loadShedTimer == nil {
+		s._loadShedTimer = s.r.clock.AfterFunc(s.r.loadShedding.interval, func() {
+			s.Act(nil, s._maintainLoadShedding)
+		})
+	}
+	if s.r.timeSync > 0 && s._timeSyncTimer == nil {
+		s._timeSyncTimer = s.r.clock.AfterFunc(time.Second, func() {
+			s.Act(nil, s._maintainTimeSync)
+		})
+	}
 }
 
 // _maintainTreeIn resets the tree maintenance timer to the specified
 // duration.
 func (s *state) _maintainTreeIn(d time.Duration) {
-	if !s._treetimer.Stop() {
-		select {
-		case <-s._treetimer.C:
-		default:
-		}
-	}
 	s._treetimer.Reset(d)
 }
 
 // _maintainSnakeIn resets the virtual snake maintenance timer to the
 // specified duration.
 func (s *state) _maintainSnakeIn(d time.Duration) {
-	if !s._snaketimer.Stop() {
-		select {
-		case <-s._snaketimer.C:
-		default:
-		}
-	}
 	s._snaketimer.Reset(d)
 }
 
 // _cleanCachedCoords clears old entries out of the coordinate cache.
 func (s *state) _cleanCachedCoords() {
+	if s._suspended {
+		// Resume will restart maintenance.
+		return
+	}
 	for k, v := range s._coordsCache {
-		if time.Since(v.lastSeen) >= coordsCacheLifetime {
+		if since(s.r.clock, v.lastSeen) >= coordsCacheLifetime {
 			delete(s._coordsCache, k)
 		}
 	}
-	time.AfterFunc(coordsCacheMaintainInterval, func() {
-		s.Act(nil, s._cleanCachedCoords)
-	})
+	s._coordsTimer.Reset(coordsCacheMaintainInterval)
 }
 
 // _sendBroadcastIn resets the wakeup broadcast maintenance timer to the
 // specified duration.
 func (s *state) _sendBroadcastIn(d time.Duration) {
-	if !s._broadcastTimer.Stop() {
-		select {
-		case <-s._broadcastTimer.C:
-		default:
-		}
-	}
 	s._broadcastTimer.Reset(d)
 }
 
 // _reportBandwidthIn resets the bandwidth reporting timer to the
 // specified duration.
 func (s *state) _reportBandwidthIn(d time.Duration) {
-	if !s._bandwidthTimer.Stop() {
-		select {
-		case <-s._bandwidthTimer.C:
-		default:
-		}
-	}
-	s._bandwidthTimer.Reset(time.Until(time.Now().Round(time.Minute).Add(d)))
+	s._bandwidthTimer.Reset(s._untilBandwidthReport(d))
+}
+
+// _untilBandwidthReport returns how long it is until the next bandwidth
+// report, which is aligned to the minute.
+func (s *state) _untilBandwidthReport(d time.Duration) time.Duration {
+	now := s.r.clock.Now()
+	return now.Round(time.Minute).Add(d).Sub(now)
 }
 
 func (s *state) _reportBandwidth() {
+	if s._suspended {
+		// Resume will restart maintenance.
+		return
+	}
 	select {
 	case <-s.r.context.Done():
 		return
@@ -180,12 +309,8 @@ func (s *state) _reportBandwidth() {
 	peerBandwidth := make(map[string]events.PeerBandwidthUsage)
 	for _, peer := range s._peers {
 		if peer != nil && peer != s.r.local && peer.started.Load() {
-			var txProto, txTraffic uint64
-			var rxProto, rxTraffic uint64
-			phony.Block(&peer.statistics, func() {
-				txProto, txTraffic = peer.statistics._bytesTxProto, peer.statistics._bytesTxTraffic
-				rxProto, rxTraffic = peer.statistics._bytesRxProto, peer.statistics._bytesRxTraffic
-			})
+			txProto, txTraffic := peer.statistics.bytesTxProto.Load(), peer.statistics.bytesTxTraffic.Load()
+			rxProto, rxTraffic := peer.statistics.bytesRxProto.Load(), peer.statistics.bytesRxTraffic.Load()
 			peerBandwidth[peer.public.String()] = events.PeerBandwidthUsage{
 				Protocol: struct {
 					Rx uint64
@@ -206,7 +331,7 @@ func (s *state) _reportBandwidth() {
 		}
 	}
 
-	captureTime := uint64(time.Now().Round(time.Minute).UnixNano())
+	captureTime := uint64(s.r.clock.Now().Round(time.Minute).UnixNano())
 	s.r.Act(nil, func() {
 		s.r._publish(events.BandwidthReport{
 			CaptureTime: captureTime,
@@ -216,7 +341,22 @@ func (s *state) _reportBandwidth() {
 }
 
 // _addPeer creates a new Peer and adds it to the switch in the next available port
-func (s *state) _addPeer(conn net.Conn, public types.PublicKey, uri ConnectionURI, zone ConnectionZone, peertype ConnectionPeerType, keepalives bool) (types.SwitchPortID, error) {
+func (s *state) _addPeer(conn net.Conn, public types.PublicKey, uri ConnectionURI, zone ConnectionZone, peertype ConnectionPeerType, keepalives bool, fastDetection ConnectionFastFailureDetection, tags PeerTags, pacing *pacer, egress *egressLimiter, coalesce, jumbo int, compact bool, locality string, handshook negotiated) (types.SwitchPortID, error) {
+	if s._isRevoked(public) {
+		return 0, fmt.Errorf("%w: peer key has been revoked", ErrNotAuthorized)
+	}
+	if s._draining {
+		return 0, ErrDraining
+	}
+	if err := s._refusePeering(); err != nil {
+		return 0, err
+	}
+	if err := s._tagLimitReached(tags); err != nil {
+		return 0, err
+	}
+	if err := s._makeRoomForPeer(public, uri); err != nil {
+		return 0, err
+	}
 	var new *peer
 	for i, p := range s._peers {
 		if i == 0 || p != nil {
@@ -229,6 +369,7 @@ func (s *state) _addPeer(conn net.Conn, public types.PublicKey, uri ConnectionUR
 		if peertype == ConnectionPeerType(PeerTypeBluetooth) {
 			queues = 16
 		}
+		budget := s.r.memory.forPeer()
 		new = &peer{
 			router:     s.r,
 			port:       types.SwitchPortID(i),
@@ -238,28 +379,81 @@ func (s *state) _addPeer(conn net.Conn, public types.PublicKey, uri ConnectionUR
 			zone:       zone,
 			peertype:   peertype,
 			keepalives: keepalives,
+			keepalive:  s.r.keepaliveConfigFor(peertype).negotiate(handshook.keepalive),
+			tags:       tags,
+			noParent:   s.r.tagPolicies.neverParent(tags),
+			pacer:      pacing,
+			egress:     egress,
+			jumbo:      jumbo,
+			compact:    compact,
+			locality:   locality,
+			handshook:  handshook,
+			faults:     s.r.faults,
 			context:    ctx,
 			cancel:     cancel,
-			proto:      newFIFOQueue(fifoNoMax, s.r.log),
-			traffic:    newFairFIFOQueue(queues, s.r.log),
+			budget:     budget,
+			control:    newFIFOQueue(fifoNoMax, s.r.log, s.r.clock).withBudget(budget, true),
+			proto:      newFIFOQueue(fifoNoMax, s.r.log, s.r.clock).withBudget(budget, true),
+			traffic:    newFairFIFOQueue(queues, s.r.log, s.r.clock).withBudget(budget).withPriority(s.r.priority),
+
+			fastDetection: bool(fastDetection),
+		}
+		if s.r.scheduler != nil {
+			new.traffic = newCustomQueue(ctx, s.r.scheduler.NewQueue(QueuePeer{
+				Port:      new.port,
+				PublicKey: public,
+				PeerType:  peertype,
+				Zone:      zone,
+			}), s.r.clock).withBudget(budget)
+		}
+		new.scheduler = newScheduler(new.control, new.proto, new.traffic, schedulerProtoBurst)
+		if keepalives {
+			new.readTimer = newConnDeadline(s.r.clock, conn.SetReadDeadline)
+			new.writeTimer = newConnDeadline(s.r.clock, conn.SetWriteDeadline)
+		}
+		if coalesce > 0 {
+			new.coalesce = bufio.NewWriterSize(conn, coalesce)
 		}
 		s._peers[i] = new
 		s.r.log.Println("Connected to peer", new.public.String(), "on port", new.port)
 		v, _ := s.r.active.LoadOrStore(hex.EncodeToString(new.public[:])+string(zone), atomic.NewUint64(0))
 		v.(*atomic.Uint64).Inc()
 
-		new.proto.push(s.r.state._rootAnnouncement().forPeer(new))
+		new.control.push(s.r.state._rootAnnouncement().forPeer(new))
+		if f, err := s._revocationFrame(); err == nil {
+			new.proto.push(f)
+		}
+		if f := s._snekSummaryFrame(new); f != nil {
+			new.proto.push(f)
+		}
+		if f := s._reachabilityFrame(new); f != nil {
+			new.proto.push(f)
+		}
+		s._retryCustodySoon()
+		now := s.r.clock.Now()
+		new.lastRead.Store(now)
+		new.lastWrite.Store(now)
 		new.started.Store(true)
+		s._flushSendQueues()
+		s._linkUp(new)
 		new.reader.Act(nil, new._read)
 		new.writer.Act(nil, new._write)
 
+		if new.fastDetection {
+			interval := s.r.fastDetection.interval
+			if interval == 0 {
+				interval = fastFailureDetectionInterval
+			}
+			s._setProbeInterval(new, interval)
+		}
+
 		s.r.Act(nil, func() {
 			s.r._publish(events.PeerAdded{Port: types.SwitchPortID(i), PeerID: new.public.String()})
 		})
 		return types.SwitchPortID(i), nil
 	}
 
-	return 0, fmt.Errorf("no free switch ports")
+	return 0, fmt.Errorf("%w: no free switch ports", ErrPeerLimitReached)
 }
 
 // _removePeer removes the Peer from the specified switch port
@@ -271,13 +465,25 @@ func (s *state) _removePeer(port types.SwitchPortID) {
 	})
 }
 
-func (s *state) _setParent(peer *peer) {
+func (s *state) _setParent(peer *peer, reason string) {
+	if peer != s._parent {
+		var key types.PublicKey
+		if peer != nil {
+			key = peer.public
+		}
+		s._recordEvent(ProtocolParentChanged, key, peer, reason)
+		s._count(rollupParentChanges)
+		s._convergenceStarted()
+		s._observeParentChange()
+	}
 	oldAnnouncement := s._rootAnnouncement()
+	s._updateParentProbes(s._parent, peer)
 	s._parent = peer
 
 	if s._rootAnnouncement().RootPublicKey != oldAnnouncement.RootPublicKey {
 		s._rootChanged()
 	}
+	s._observeRoot()
 
 	s.r.Act(nil, func() {
 		peerID := ""
@@ -298,11 +504,15 @@ func (s *state) _rootChanged() {
 }
 
 func (s *state) _setDescendingNode(node *virtualSnakeEntry) {
+	if (s._descending == nil) != (node == nil) || (node != nil && s._descending.PublicKey != node.PublicKey) {
+		s._observeDescendingChange()
+	}
 	switch {
 	case s._descending == nil || node == nil:
 		fallthrough
 	case s._descending != nil && node != nil && s._descending.PublicKey != node.PublicKey:
 		s._bootstrapSoon()
+		s._neighbourChanged()
 	}
 
 	s._descending = node
@@ -318,15 +528,27 @@ func (s *state) _setDescendingNode(node *virtualSnakeEntry) {
 }
 
 func (s *state) _addRouteEntry(index virtualSnakeIndex, entry *virtualSnakeEntry) {
+	change := events.RouteAdded
+	if _, ok := s._table[index]; ok {
+		change = events.RouteUpdated
+	}
 	s._table[index] = entry
+	s._publishRoute(events.SnakeRouteChanged{Change: change, Route: snakeRoute(entry)})
 
 	s.r.Act(nil, func() {
 		s.r._publish(events.SnakeEntryAdded{EntryID: index.PublicKey.String(), PeerID: entry.Source.public.String()})
 	})
 }
 
-func (s *state) _removeRouteEntry(index virtualSnakeIndex) {
+func (s *state) _removeRouteEntry(index virtualSnakeIndex, reason string) {
+	if entry, ok := s._table[index]; ok {
+		s._recordPathEvent(ProtocolPathRemoved, PathID{index.PublicKey, entry.Watermark.Sequence}, entry.Source, reason)
+	}
 	delete(s._table, index)
+	s._publishRoute(events.SnakeRouteChanged{
+		Change: events.RouteRemoved,
+		Route:  events.SnakeRoute{PublicKey: index.PublicKey},
+	})
 
 	s.r.Act(nil, func() {
 		s.r._publish(events.SnakeEntryRemoved{EntryID: index.PublicKey.String()})
@@ -336,6 +558,7 @@ func (s *state) _removeRouteEntry(index virtualSnakeIndex) {
 // _portDisconnected is called when a peer disconnects.
 func (s *state) _portDisconnected(peer *peer) {
 	peercount := 0
+	s._dropPendingAnnouncement(peer)
 
 	// Work out how many peers are connected now that this peer has
 	// disconnected.
@@ -354,13 +577,17 @@ func (s *state) _portDisconnected(peer *peer) {
 	}
 
 	// Delete the last tree announcement that we received from this peer.
-	delete(s._announcements, peer)
+	s._forgetAnnouncement(peer)
+	s._publishRoute(events.TreeAnnouncementChanged{
+		Change:       events.RouteRemoved,
+		Announcement: events.TreeAnnouncement{Port: peer.port, PeerID: peer.public.String()},
+	})
 
 	// Scan the local routing table for any routes that transited this now-dead
 	// peering and remove them from the routing table.
 	for k, v := range s._table {
 		if v.Source == peer || v.Destination == peer {
-			s._removeRouteEntry(k)
+			s._removeRouteEntry(k, fmt.Sprintf("peer on port %d disconnected", peer.port))
 		}
 	}
 
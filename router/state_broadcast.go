@@ -15,7 +15,6 @@
 package router
 
 import (
-	"crypto/ed25519"
 	"fmt"
 	"time"
 
@@ -31,8 +30,8 @@ type broadcastEntry struct {
 // valid returns true if the broadcast hasn't expired, or false if it has. It is
 // required for broadcasts to time out eventually, in the case that nodes leave
 // the network and return later.
-func (e *broadcastEntry) valid() bool {
-	return time.Since(e.LastSeen) < broadcastExpiryPeriod
+func (e *broadcastEntry) valid(now time.Time) bool {
+	return now.Sub(e.LastSeen) < broadcastExpiryPeriod
 }
 
 // NOTE: Functions prefixed with an underscore (_) are only safe to be called
@@ -41,6 +40,10 @@ func (e *broadcastEntry) valid() bool {
 // _maintainBroadcasts sends out wakeup broadcasts to let local nodes know
 // of our presence in the network.
 func (s *state) _maintainBroadcasts() {
+	if s._suspended {
+		// Resume will restart maintenance.
+		return
+	}
 	select {
 	case <-s.r.context.Done():
 		return
@@ -50,11 +53,16 @@ func (s *state) _maintainBroadcasts() {
 
 	// Clean up any broadcasts that are older than the expiry period.
 	for k, v := range s._seenBroadcasts {
-		if !v.valid() {
+		if !v.valid(s.r.clock.Now()) {
 			delete(s._seenBroadcasts, k)
 		}
 	}
 
+	// Wakeup broadcasts are only an optimisation, so we don't send them
+	// when we're trying to save power or are suspended.
+	if s._powerMode == PowerModeLowPower || s._suspended {
+		return
+	}
 	s._sendWakeupBroadcasts()
 }
 
@@ -63,7 +71,7 @@ func (s *state) _createBroadcastFrame() (*types.Frame, error) {
 	b := frameBufferPool.Get().(*[types.MaxFrameSize]byte)
 	defer frameBufferPool.Put(b)
 	broadcast := types.WakeupBroadcast{
-		Sequence: types.Varu64(time.Now().UnixMilli()),
+		Sequence: types.Varu64(s.r.clock.Now().UnixMilli()),
 		Root:     s._rootAnnouncement().Root,
 	}
 	if s.r.secure {
@@ -73,7 +81,7 @@ func (s *state) _createBroadcastFrame() (*types.Frame, error) {
 		}
 		copy(
 			broadcast.Signature[:],
-			ed25519.Sign(s.r.private[:], protected),
+			s.r.sign(protected),
 		)
 	}
 	n, err := broadcast.MarshalBinary(b[:])
@@ -103,7 +111,7 @@ func (s *state) _sendWakeupBroadcasts() {
 func (s *state) _handleBroadcast(p *peer, f *types.Frame) error {
 	// Unmarshall the broadcast
 	var broadcast types.WakeupBroadcast
-	if _, err := broadcast.UnmarshalBinary(f.Payload); err != nil {
+	if _, err := types.Decode(&broadcast, f.Payload); err != nil {
 		return fmt.Errorf("broadcast unmarshal failed: %w", err)
 	}
 
@@ -114,7 +122,7 @@ func (s *state) _handleBroadcast(p *peer, f *types.Frame) error {
 		if err != nil {
 			return fmt.Errorf("broadcast payload invalid: %w", err)
 		}
-		if !ed25519.Verify(
+		if !s.r.verify(
 			f.SourceKey[:],
 			protected,
 			broadcast.Signature[:],
@@ -134,7 +142,7 @@ func (s *state) _handleBroadcast(p *peer, f *types.Frame) error {
 	// If we have seen a higher sequence number before then there is no need
 	// to continue forwarding it.
 	if existing, ok := s._seenBroadcasts[f.SourceKey]; ok {
-		sendingTooFast := time.Since(existing.LastSeen) < broadcastFilterTime
+		sendingTooFast := since(s.r.clock, existing.LastSeen) < broadcastFilterTime
 		repeatedSequence := broadcast.Sequence <= existing.Sequence
 		if sendingTooFast || repeatedSequence {
 			return nil
@@ -142,12 +150,12 @@ func (s *state) _handleBroadcast(p *peer, f *types.Frame) error {
 	}
 	s._seenBroadcasts[f.SourceKey] = broadcastEntry{
 		Sequence: broadcast.Sequence,
-		LastSeen: time.Now(),
+		LastSeen: s.r.clock.Now(),
 	}
 
 	// send event to subscribers about discovered node
 	s.r.Act(nil, func() {
-		s.r._publish(events.BroadcastReceived{PeerID: f.SourceKey.String(), Time: uint64(time.Now().UnixNano())})
+		s.r._publish(events.BroadcastReceived{PeerID: f.SourceKey.String(), Time: uint64(s.r.clock.Now().UnixNano())})
 	})
 
 	if f.HopLimit > 1 {
@@ -16,8 +16,8 @@ package router
 
 import (
 	"fmt"
+	"math"
 	"net"
-	"time"
 
 	"github.com/matrix-org/pinecone/types"
 )
@@ -40,7 +40,7 @@ func (s *state) _nextHopsFor(from *peer, frameType types.FrameType, dest net.Add
 	case types.Coordinates:
 		nexthop = s._nextHopsTree(from, dest)
 	}
-	return nexthop, watermark
+	return s._bestLink(nexthop), watermark
 }
 
 // _forward handles frames received from a given peer. In most cases, this function will
@@ -48,6 +48,13 @@ func (s *state) _nextHopsFor(from *peer, frameType types.FrameType, dest net.Add
 // queue if possible. In some special cases, like tree announcements,
 // special handling will be done before forwarding if needed.
 func (s *state) _forward(p *peer, f *types.Frame) error {
+	if len(s._taps) > 0 {
+		s._tapFrame(p, f)
+	}
+	if s._analyzer != nil {
+		s._analyzer.observe(f, s.r.clock.Now())
+	}
+
 	// Allow overlay loopback traffic by directly forwarding it to the local router.
 	if f.Type.IsTraffic() && f.DestinationKey == s.r.public {
 		if len(f.Source) > 0 {
@@ -56,10 +63,11 @@ func (s *state) _forward(p *peer, f *types.Frame) error {
 			// return traffic to be redirected via a different route. The obvious
 			// solution here is to "seal" the source key and coordinates in the packet
 			// by encrypting them to resist changes or on-path statistical analysis.
-			s._coordsCache[f.SourceKey] = coordsCacheEntry{
-				coordinates: f.Source,
-				lastSeen:    time.Now(),
-			}
+			s._cacheCoords(f.SourceKey, append(types.Coordinates{}, f.Source...))
+		}
+		if f.IsDatagram() {
+			s._deliverDatagram(f)
+			return nil
 		}
 		if !s.r.local.send(f) {
 			framePool.Put(f)
@@ -73,23 +81,31 @@ func (s *state) _forward(p *peer, f *types.Frame) error {
 		return nil
 	}
 
+	if s._trafficPolicyDrops(p, f) {
+		framePool.Put(f)
+		if p == s.r.local {
+			return ErrTrafficPolicy
+		}
+		s._count(rollupDropped)
+		return nil
+	}
+
+	if s.r.routeTracing != nil {
+		s._traceRoute(p, f)
+	}
+
 	var nexthop *peer
 	var watermark types.VirtualSnakeWatermark
 	switch f.Type {
-	case types.TypeTraffic:
-		if len(f.Destination) > 0 {
-			if nexthop, watermark = s._nextHopsFor(p, f.Type, f.Destination, f.Watermark); nexthop != nil {
-				// We found a next-hop on the tree, so use it
-				break
-			}
-		}
-		// Otherwise, we failed to find a tree next-hop, fall back to SNEK routing
-		f.Destination = f.Destination[:0]
-		fallthrough
+	case types.TypeTraffic, types.TypeEchoRequest, types.TypeEchoReply, types.TypeContinuity, types.TypeBootstrapConfirm, types.TypeCustody, types.TypeCustodyReceipt, types.TypeSNEKAdjacency, types.TypeNodeInfoRequest, types.TypeNodeInfoResponse, types.TypeDebugRequest, types.TypeDebugResponse, types.TypeSearchRequest, types.TypeSearchResponse:
+		nexthop, watermark = s._nextHopsTraffic(p, f)
 	case types.TypeBootstrap:
 		nexthop, watermark = s._nextHopsFor(p, f.Type, f.DestinationKey, f.Watermark)
 	}
 	deadend := nexthop == nil || nexthop == p.router.local
+	if s._latency != nil && p != s.r.local {
+		s._latency.route(f)
+	}
 
 	switch f.Type {
 	case types.TypeKeepalive:
@@ -97,9 +113,70 @@ func (s *state) _forward(p *peer, f *types.Frame) error {
 		framePool.Put(f)
 		return nil
 
+	case types.TypeLinkProbe:
+		// Link probes are sent on a peering and are never forwarded.
+		defer framePool.Put(f)
+		if err := s._handleLinkProbe(p, f); err != nil {
+			return fmt.Errorf("s._handleLinkProbe (port %d): %w", p.port, err)
+		}
+		return nil
+
+	case types.TypeBootstrapACK:
+		// Bootstrap acknowledgements are sent on a peering and are never
+		// forwarded.
+		defer framePool.Put(f)
+		if err := s._handleBootstrapACK(p, f); err != nil {
+			return fmt.Errorf("s._handleBootstrapACK (port %d): %w", p.port, err)
+		}
+		return nil
+
+	case types.TypeSNEKSummary:
+		// SNEK summaries are sent on a peering and are never forwarded.
+		defer framePool.Put(f)
+		if err := s._handleSNEKSummary(p, f); err != nil {
+			return fmt.Errorf("s._handleSNEKSummary (port %d): %w", p.port, err)
+		}
+		return nil
+
+	case types.TypeReachability:
+		// Reachability filters are sent on a peering and are never forwarded.
+		defer framePool.Put(f)
+		if err := s._handleReachability(p, f); err != nil {
+			return fmt.Errorf("s._handleReachability (port %d): %w", p.port, err)
+		}
+		return nil
+
+	case types.TypeSNEKRefresh:
+		// Path refreshes are sent on a peering and are passed on by us to
+		// the next hop on the path, rather than being forwarded.
+		defer framePool.Put(f)
+		if err := s._handleSNEKRefresh(p, f); err != nil {
+			return fmt.Errorf("s._handleSNEKRefresh (port %d): %w", p.port, err)
+		}
+		return nil
+
+	case types.TypeTimeSync:
+		// Time sync requests and replies are sent on a peering and are
+		// never forwarded.
+		defer framePool.Put(f)
+		if err := s._handleTimeSync(p, f); err != nil {
+			return fmt.Errorf("s._handleTimeSync (port %d): %w", p.port, err)
+		}
+		return nil
+
+	case types.TypeDeparting:
+		// Departure notices are sent on a peering and are never forwarded.
+		framePool.Put(f)
+		s._handleDeparting(p)
+		return nil
+
 	case types.TypeTreeAnnouncement:
 		// Tree announcements are a special case. The _handleTreeAnnouncement function
 		// will generate new tree announcements and send them to peers if needed.
+		// Bursts of announcements from one peer may be damped first.
+		if s._dampAnnouncement(p, f) {
+			return nil
+		}
 		defer framePool.Put(f)
 		if err := s._handleTreeAnnouncement(p, f); err != nil {
 			return fmt.Errorf("s._handleTreeAnnouncement (port %d): %w", p.port, err)
@@ -107,7 +184,9 @@ func (s *state) _forward(p *peer, f *types.Frame) error {
 		return nil
 
 	case types.TypeBootstrap:
-		// Bootstrap messages are handled at each node along the path.
+		// Bootstrap messages are handled at each node along the path. Let
+		// the peer that sent it know that it arrived.
+		s._acknowledgeBootstrap(p, f)
 		if !s._handleBootstrap(p, nexthop, f) || deadend {
 			framePool.Put(f)
 			return nil
@@ -122,6 +201,11 @@ func (s *state) _forward(p *peer, f *types.Frame) error {
 		return nil
 
 	case types.TypeTraffic:
+		// Traffic that we send ourselves can wait for a next hop, rather
+		// than being dropped, if there isn't one yet.
+		if deadend && p == s.r.local && s._holdForSend(f) {
+			return nil
+		}
 		// Traffic type packets are forwarded normally by falling through unless hop
 		// limiting is enabled.
 		if s.r._hopLimiting.Load() {
@@ -129,10 +213,191 @@ func (s *state) _forward(p *peer, f *types.Frame) error {
 				f.HopLimit -= 1
 			} else {
 				// The packet has reached the hop limit and shouldn't be forwarded.
+				// It has most likely been going round in a loop.
+				s._recordLoop(f.DestinationKey, nexthop)
+				framePool.Put(f)
 				return nil
 			}
 		}
 
+	case types.TypeServiceAdvert:
+		// Service advertisements are flooded like wakeup broadcasts. The
+		// _handleServiceAdvertisement function will forward them if needed.
+		defer framePool.Put(f)
+		if err := s._handleServiceAdvertisement(p, f); err != nil {
+			return fmt.Errorf("s._handleServiceAdvertisement (port %d): %w", p.port, err)
+		}
+		return nil
+
+	case types.TypeEchoRequest, types.TypeEchoReply:
+		// Echo frames are answered or consumed by the node that they are
+		// addressed to. Otherwise they are forwarded like traffic, counting
+		// each hop along the way.
+		if f.DestinationKey == s.r.public {
+			defer framePool.Put(f)
+			if err := s._handleEcho(f); err != nil {
+				return fmt.Errorf("s._handleEcho (port %d): %w", p.port, err)
+			}
+			return nil
+		}
+		if deadend {
+			// If the node that the request was looking for has moved to a
+			// new identity then we might know about it, since continuity
+			// records are stored at the node closest to the old key.
+			answered := false
+			if f.Type == types.TypeEchoRequest {
+				answered = s._answerFromContinuity(f)
+			}
+			framePool.Put(f)
+			if p == s.r.local && !answered && !s._hasPeerings() {
+				return ErrNoNextHop
+			}
+			return nil
+		}
+		if f.Extra < math.MaxUint8 {
+			f.Extra++
+		}
+
+	case types.TypeNodeInfoRequest, types.TypeNodeInfoResponse:
+		// Node info frames are answered or consumed by the node that they
+		// are addressed to. Otherwise they are forwarded like traffic.
+		if f.DestinationKey == s.r.public {
+			defer framePool.Put(f)
+			if err := s._handleNodeInfo(f); err != nil {
+				return fmt.Errorf("s._handleNodeInfo (port %d): %w", p.port, err)
+			}
+			return nil
+		}
+		if deadend {
+			framePool.Put(f)
+			return nil
+		}
+
+	case types.TypeDebugRequest, types.TypeDebugResponse:
+		// Debug frames are handled in the same way as node info frames.
+		if f.DestinationKey == s.r.public {
+			defer framePool.Put(f)
+			if err := s._handleDebugQuery(f); err != nil {
+				return fmt.Errorf("s._handleDebugQuery (port %d): %w", p.port, err)
+			}
+			return nil
+		}
+		if deadend {
+			framePool.Put(f)
+			return nil
+		}
+
+	case types.TypeSearchRequest:
+		// Search requests are answered by the node that they can't go any
+		// further than, which is the closest node to the target.
+		if deadend || f.DestinationKey == s.r.public {
+			defer framePool.Put(f)
+			if err := s._answerSearch(f); err != nil {
+				return fmt.Errorf("s._answerSearch (port %d): %w", p.port, err)
+			}
+			return nil
+		}
+
+	case types.TypeSearchResponse:
+		// Search responses are forwarded like traffic until they reach the
+		// node that searched.
+		if f.DestinationKey == s.r.public {
+			defer framePool.Put(f)
+			if err := s._handleSearchResponse(f); err != nil {
+				return fmt.Errorf("s._handleSearchResponse (port %d): %w", p.port, err)
+			}
+			return nil
+		}
+		if deadend {
+			framePool.Put(f)
+			return nil
+		}
+
+	case types.TypeBootstrapConfirm:
+		// Bootstrap confirmations are forwarded like traffic until they
+		// reach the node that bootstrapped.
+		if f.DestinationKey == s.r.public {
+			defer framePool.Put(f)
+			if err := s._handleBootstrapConfirm(f); err != nil {
+				return fmt.Errorf("s._handleBootstrapConfirm (port %d): %w", p.port, err)
+			}
+			return nil
+		}
+		if deadend {
+			framePool.Put(f)
+			return nil
+		}
+
+	case types.TypeCustody:
+		// Custody bundles are forwarded like traffic, but if there's nowhere
+		// better to send them then we might hold on to them until there is.
+		if f.DestinationKey == s.r.public {
+			defer framePool.Put(f)
+			if err := s._handleBundle(f); err != nil {
+				return fmt.Errorf("s._handleBundle (port %d): %w", p.port, err)
+			}
+			return nil
+		}
+		if deadend {
+			defer framePool.Put(f)
+			if err := s._takeCustody(f); err != nil {
+				return fmt.Errorf("s._takeCustody (port %d): %w", p.port, err)
+			}
+			return nil
+		}
+
+	case types.TypeCustodyReceipt:
+		// Custody receipts are forwarded like traffic until they reach the
+		// custodian.
+		if f.DestinationKey == s.r.public {
+			defer framePool.Put(f)
+			if err := s._handleCustodyReceipt(f); err != nil {
+				return fmt.Errorf("s._handleCustodyReceipt (port %d): %w", p.port, err)
+			}
+			return nil
+		}
+		if deadend {
+			framePool.Put(f)
+			return nil
+		}
+
+	case types.TypeSNEKAdjacency:
+		// Adjacency statements are forwarded like traffic until they reach
+		// the neighbour that they are for.
+		if f.DestinationKey == s.r.public {
+			defer framePool.Put(f)
+			if err := s._handleAdjacency(f); err != nil {
+				return fmt.Errorf("s._handleAdjacency (port %d): %w", p.port, err)
+			}
+			return nil
+		}
+		if deadend {
+			framePool.Put(f)
+			return nil
+		}
+
+	case types.TypeRevocation:
+		// Revocation lists are flooded to the whole network. The
+		// _handleRevocation function will forward them if they are new.
+		defer framePool.Put(f)
+		if err := s._handleRevocation(p, f); err != nil {
+			return fmt.Errorf("s._handleRevocation (port %d): %w", p.port, err)
+		}
+		return nil
+
+	case types.TypeContinuity:
+		// Continuity records are remembered by every node that they pass
+		// through, so that the node closest to the old key in keyspace will
+		// end up storing them.
+		if err := s._handleContinuity(f); err != nil {
+			framePool.Put(f)
+			return fmt.Errorf("s._handleContinuity (port %d): %w", p.port, err)
+		}
+		if f.DestinationKey == s.r.public || deadend {
+			framePool.Put(f)
+			return nil
+		}
+
 	default:
 		// We don't know what type of packet this is so drop it.
 		return nil
@@ -144,6 +409,7 @@ func (s *state) _forward(p *peer, f *types.Frame) error {
 	// the peer we received the ping from so the "loop" is desired.
 	if nexthop == p || watermark.WorseThan(f.Watermark) {
 		// s.r.log.Println("Dropping forwarded packet of type", f.Type)
+		s._count(rollupDropped)
 		framePool.Put(f)
 		return nil
 	}
@@ -151,10 +417,35 @@ func (s *state) _forward(p *peer, f *types.Frame) error {
 	// If there's a suitable next-hop then try sending the packet. If we fail
 	// to queue up the packet then we will log it but there isn't an awful lot
 	// we can do at this point.
+	if s._routeFiltered(nexthop, f) || s._forwardFiltered(p, nexthop, f) || s._shedTransit(p, nexthop, f) {
+		s._count(rollupDropped)
+		framePool.Put(f)
+		return nil
+	}
 	f.Watermark = watermark
-	if nexthop != nil && !nexthop.send(f) {
+	if f.Type.IsTraffic() {
+		nexthop = s._stripeLink(nexthop, f)
+	}
+	if nexthop == s.r.local && f.IsDatagram() {
+		// Datagrams are only for the node that they are addressed to.
+		framePool.Put(f)
+		return nil
+	}
+	if nexthop != nil && f.Type == types.TypeBootstrap {
+		s._trackBootstrap(nexthop, f)
+	}
+	switch {
+	case nexthop == nil:
+		s._count(rollupDropped)
+	case !nexthop.send(f):
 		// s.r.log.Println("Dropping forwarded packet of type", f.Type)
+		s._count(rollupDropped)
 		framePool.Put(f)
+	case nexthop != s.r.local:
+		s._count(rollupForwarded)
+		if s._latency != nil && p != s.r.local {
+			s._latency.queued(f)
+		}
 	}
 
 	return nil
@@ -165,6 +456,9 @@ func (s *state) _forward(p *peer, f *types.Frame) error {
 // Classic flooding works by sending frames to all other peers.
 // Tree flooding works by only sending frames to peers on the same branch.
 func (s *state) _flood(from *peer, f *types.Frame, floodType FloodType) {
+	if s._deferGossip(f.Type) {
+		return
+	}
 	floodCandidates := make(map[types.PublicKey]*peer)
 	for _, newCandidate := range s._peers {
 		if newCandidate == nil || newCandidate.proto == nil || !newCandidate.started.Load() {
@@ -180,6 +474,10 @@ func (s *state) _flood(from *peer, f *types.Frame, floodType FloodType) {
 			continue
 		}
 
+		if s._routeFiltered(newCandidate, f) {
+			continue
+		}
+
 		if floodType == TreeFlood {
 			if coords, err := newCandidate._coords(); err == nil {
 				if coords.DistanceTo(s._coords()) != 1 {
@@ -0,0 +1,240 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// newTransitState returns the state of a root node with two peers, so that
+// frames can be forwarded from one to the other over either the tree or
+// SNEK.
+func newTransitState() (s *state, from, to *peer) {
+	s = newTestState(types.PublicKey{5}, NewManualClock(time.Unix(1000, 0)))
+	s.r.timings = Timings{PathExpiry: time.Minute}
+	s.r._hopLimiting.Store(true)
+	from = addTestPeer(s, types.PublicKey{3})
+	to = addTestPeer(s, types.PublicKey{9})
+	announceTestChild(s, from)
+	announceTestChild(s, to)
+	s._table[virtualSnakeIndex{PublicKey: to.public}] = &virtualSnakeEntry{
+		virtualSnakeIndex: &virtualSnakeIndex{PublicKey: to.public},
+		Source:            to,
+		LastSeen:          s.r.clock.Now(),
+	}
+	return s, from, to
+}
+
+func TestTransitForwardingDoesNotAllocate(t *testing.T) {
+	s, from, to := newTransitState()
+	payload := make([]byte, 1024)
+	for _, tc := range []struct {
+		name   string
+		coords types.Coordinates
+		pref   types.RoutingPreference
+		wire   types.FrameVersion
+	}{
+		{"tree", types.Coordinates{2, 7}, types.RoutingTreeOnly, types.Version0},
+		{"snek", nil, types.RoutingSNEKOnly, types.Version0},
+		{"compact", types.Coordinates{2, 7}, types.RoutingTreeOnly, types.Version2},
+	} {
+		f := getFrame()
+		f.Version = tc.wire
+		f.Type = types.TypeTraffic
+		f.HopLimit = types.MaxHopLimit
+		f.Destination = tc.coords
+		f.DestinationKey = to.public
+		f.Source = types.Coordinates{1, 4}
+		f.SourceKey = from.public
+		f.Watermark = types.VirtualSnakeWatermark{PublicKey: types.FullMask}
+		f.SetRoutingPreference(tc.pref)
+		f.Payload = append(f.Payload[:0], payload...)
+		in := make([]byte, types.MaxFrameSize)
+		n, err := f.MarshalBinary(in)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		framePool.Put(f)
+		in = in[:n]
+
+		// The frame is read from one peer, routed, queued for the other and
+		// taken off the queue again to be written out.
+		out := make([]byte, types.MaxFrameSize)
+		forwarded := uint64(0)
+		allocs := testing.AllocsPerRun(1000, func() {
+			f := getFrame()
+			if _, err := f.UnmarshalBinary(in); err != nil {
+				t.Fatalf("%s: %s", tc.name, err)
+			}
+			if err := s._forward(from, f); err != nil {
+				t.Fatalf("%s: %s", tc.name, err)
+			}
+			frame, q := to.scheduler._next(true)
+			if frame == nil {
+				t.Fatalf("%s: the frame wasn't forwarded", tc.name)
+			}
+			to.scheduler._sent(q, frame)
+			frame.Version = tc.wire
+			if _, err := frame.MarshalBinary(out); err != nil {
+				t.Fatalf("%s: %s", tc.name, err)
+			}
+			framePool.Put(frame)
+			forwarded++
+		})
+		if allocs != 0 {
+			t.Fatalf("%s: expected forwarding not to allocate, got %.0f allocations per frame", tc.name, allocs)
+		}
+		if queued := to.statistics.queued.Load(); queued < forwarded {
+			t.Fatalf("%s: expected %d frames to have been queued, got %d", tc.name, forwarded, queued)
+		}
+	}
+}
+
+func TestMalformedPayloadsAreCounted(t *testing.T) {
+	var routers [2]*Router
+	for i := range routers {
+		_, sk, _ := ed25519.GenerateKey(nil)
+		routers[i] = NewRouter(nil, sk, RouterOptionStrictDecoding(true))
+		r := routers[i]
+		t.Cleanup(func() { _ = r.Close() })
+	}
+	a, b := routers[0], routers[1]
+	if errA, errB := connectTestRouters(t, a, b); errA != nil || errB != nil {
+		t.Fatalf("failed to peer: %v, %v", errA, errB)
+	}
+	peerFor := func(r, with *Router) (p *peer) {
+		phony.Block(r.state, func() {
+			for _, sp := range r.state._peers {
+				if sp != nil && sp.public == with.PublicKey() {
+					p = sp
+				}
+			}
+		})
+		if p == nil {
+			t.Fatalf("expected to be peered")
+		}
+		return
+	}
+	p, remote := peerFor(a, b), peerFor(b, a)
+
+	// The frames are fine but the payloads aren't, so they are dropped.
+	malformed := func(frameType types.FrameType) *types.Frame {
+		f := getFrame()
+		f.Type = frameType
+		f.HopLimit = types.MaxHopLimit
+		f.Payload = append(f.Payload[:0], 1, 2, 3)
+		return f
+	}
+	for _, frameType := range []types.FrameType{types.TypeBootstrapACK, types.TypeContinuity} {
+		var err error
+		phony.Block(a.state, func() {
+			err = a.state._forward(p, malformed(frameType))
+		})
+		if !errors.Is(err, types.ErrMalformed) {
+			t.Fatalf("expected a malformed %s payload error, got %v", frameType, err)
+		}
+	}
+
+	// A continuity record might have come from anywhere, so it doesn't
+	// count against the peer, but a bootstrap ACK can only have come from
+	// the peer itself. Both go through the same queue, so once the ACK
+	// has been counted the record has been handled too.
+	remote.proto.push(malformed(types.TypeContinuity))
+	remote.proto.push(malformed(types.TypeBootstrapACK))
+	deadline := time.Now().Add(time.Second * 5)
+	for p.statistics.malformed.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the malformed payload to be counted")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if malformed := p.statistics.malformed.Load(); malformed != 1 {
+		t.Fatalf("expected only the bootstrap ACK to be counted, got %d", malformed)
+	}
+	if !p.started.Load() {
+		t.Fatalf("expected the peering to still be up")
+	}
+
+	// Old malformed frames are forgotten, so that rare corruption doesn't
+	// eventually add up to a disconnection.
+	p.statistics.recentMalformed.Store(peerMaxMalformedFrames - 1)
+	p.decayMalformed()
+	if recent := p.statistics.recentMalformed.Load(); recent != (peerMaxMalformedFrames-1)/2 {
+		t.Fatalf("expected the recent count to be halved, got %d", recent)
+	}
+	for p.statistics.recentMalformed.Load() < peerMaxMalformedFrames-1 {
+		if p.countMalformed(types.ErrMalformed) {
+			t.Fatalf("expected the peering to survive")
+		}
+	}
+	if !p.countMalformed(types.ErrMalformed) || p.started.Load() {
+		t.Fatalf("expected the peering to be stopped after too many malformed frames")
+	}
+}
+
+func TestMalformedFramesStopPeeringWithoutStrictDecoding(t *testing.T) {
+	s := newTestState(types.PublicKey{1}, NewManualClock(time.Unix(1000, 0)))
+	p := addTestPeer(s, types.PublicKey{2})
+	p.cancel = func() {}
+	if !p.countMalformed(types.ErrMalformed) || p.started.Load() {
+		t.Fatalf("expected the first malformed frame to stop the peering")
+	}
+	if malformed := p.statistics.malformed.Load(); malformed != 1 {
+		t.Fatalf("expected the malformed frame to be counted, got %d", malformed)
+	}
+}
+
+func BenchmarkTransitForwarding(b *testing.B) {
+	s, from, to := newTransitState()
+	f := getFrame()
+	f.Type = types.TypeTraffic
+	f.HopLimit = types.MaxHopLimit
+	f.Destination = types.Coordinates{2, 7}
+	f.DestinationKey = to.public
+	f.Source = types.Coordinates{1, 4}
+	f.SourceKey = from.public
+	f.Payload = append(f.Payload[:0], make([]byte, 1024)...)
+	in := make([]byte, types.MaxFrameSize)
+	n, err := f.MarshalBinary(in)
+	if err != nil {
+		b.Fatal(err)
+	}
+	framePool.Put(f)
+	out := make([]byte, types.MaxFrameSize)
+	b.ReportAllocs()
+	b.SetBytes(int64(n))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f := getFrame()
+		if _, err := f.UnmarshalBinary(in[:n]); err != nil {
+			b.Fatal(err)
+		}
+		if err := s._forward(from, f); err != nil {
+			b.Fatal(err)
+		}
+		frame, q := to.scheduler._next(true)
+		to.scheduler._sent(q, frame)
+		if _, err := frame.MarshalBinary(out); err != nil {
+			b.Fatal(err)
+		}
+		framePool.Put(frame)
+	}
+}
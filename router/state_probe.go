@@ -0,0 +1,169 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+// Fast failure detection works by both sides of a peering agreeing to send
+// frames to each other at a much faster rate than the normal keepalive
+// interval. Any frame counts, so on a busy link there is no extra overhead,
+// and idle links fall back to sending keepalives at the negotiated rate. If
+// nothing arrives within the negotiated interval times the multiplier then
+// the peering is torn down, which will kick off re-parenting and SNEK repair
+// much sooner than the normal keepalive timeout would.
+//
+// Each side advertises the interval that it wants using link probe frames.
+// A node that doesn't want fast failure detection itself advertises zero but
+// will still honour the other side's interval. Peers that don't understand
+// link probes will just drop them, so we never tighten any timers until we
+// have heard a probe back from the remote side.
+
+// fastFailureDetectionConfig holds the negotiated timings for a peering.
+type fastFailureDetectionConfig struct {
+	interval   time.Duration
+	multiplier int
+}
+
+// _setProbeInterval updates the interval that we want for fast failure
+// detection on the given peering, or disables it if the interval is zero,
+// and tells the remote side about it.
+func (s *state) _setProbeInterval(p *peer, interval time.Duration) {
+	if p == nil || p == s.r.local || p._probeLocal == interval {
+		return
+	}
+	p._probeLocal = interval
+	if p._probeSupported || interval > 0 {
+		s._sendLinkProbe(p)
+	}
+	s._recalculateProbe(p)
+}
+
+// _sendLinkProbe sends our currently desired interval to the peer.
+func (s *state) _sendLinkProbe(p *peer) {
+	probe := types.LinkProbe{
+		Interval: types.Varu64(p._probeLocal.Milliseconds()),
+	}
+	frame := getFrame()
+	frame.Type = types.TypeLinkProbe
+	n, err := probe.MarshalBinary(frame.Payload[:cap(frame.Payload)])
+	if err != nil {
+		framePool.Put(frame)
+		return
+	}
+	frame.Payload = frame.Payload[:n]
+	if !p.send(frame) {
+		framePool.Put(frame)
+	}
+}
+
+// _handleLinkProbe is called when a link probe is received from a direct
+// peer.
+func (s *state) _handleLinkProbe(p *peer, f *types.Frame) error {
+	var probe types.LinkProbe
+	if _, err := types.Decode(&probe, f.Payload); err != nil {
+		return fmt.Errorf("probe unmarshal failed: %w", err)
+	}
+	if !p._probeSupported {
+		// This is the first probe from this peer, so reply with our own
+		// interval so that they know that we support it too.
+		p._probeSupported = true
+		s._sendLinkProbe(p)
+	}
+	p._probeRemote = time.Duration(probe.Interval) * time.Millisecond
+	s._recalculateProbe(p)
+	return nil
+}
+
+// _recalculateProbe works out the negotiated interval for the peering and
+// passes it to the peer's reader and writer.
+func (s *state) _recalculateProbe(p *peer) {
+	interval := p._probeLocal
+	if p._probeRemote > interval {
+		// Always go with the slower of the requested rates, since there's
+		// no point in dying faster than the remote side is willing to send.
+		interval = p._probeRemote
+	}
+	if interval > 0 && interval < fastFailureDetectionMinInterval {
+		interval = fastFailureDetectionMinInterval
+	}
+	if !p._probeSupported {
+		interval = 0
+	}
+	if p.probeInterval.Swap(interval) == interval {
+		return
+	}
+	multiplier := s.r.fastDetection.multiplier
+	p.probeTimeout.Store(interval * time.Duration(multiplier))
+
+	// The writer might be waiting on a much longer keepalive interval, so
+	// give it something to send so that it'll pick up the new interval.
+	frame := getFrame()
+	frame.Type = types.TypeKeepalive
+	if !p.send(frame) {
+		framePool.Put(frame)
+	}
+}
+
+// _updateParentProbes moves fast failure detection from the old parent to
+// the new parent, if it is enabled for parent links.
+func (s *state) _updateParentProbes(old, new *peer) {
+	if s.r.fastDetection.interval == 0 || old == new {
+		return
+	}
+	if old != nil && !old.fastDetection {
+		s._setProbeInterval(old, 0)
+	}
+	if new != nil {
+		s._setProbeInterval(new, s.r.fastDetection.interval)
+	}
+}
+
+// idleInterval returns how long the writer should wait for something to
+// send before sending a keepalive instead.
+func (p *peer) idleInterval() time.Duration {
+	if probe := p.probeInterval.Load(); probe > 0 && probe < p.keepalive.interval {
+		return probe
+	}
+	return p.keepalive.interval
+}
+
+// _resetIdleTimer starts the writer's idle timer again, creating it if
+// needed, and returns its channel. This function must be called from the
+// peer's writer actor only.
+func (p *peer) _resetIdleTimer(d time.Duration) <-chan time.Time {
+	if p._idleTimer == nil {
+		p._idleTimer = newClockTimer(p.router.clock, d)
+		return p._idleTimer.C
+	}
+	p._idleTimer.Reset(d)
+	return p._idleTimer.C
+}
+
+// readTimeout returns how long the reader should wait for a frame before
+// assuming that the peer is dead.
+func (p *peer) readTimeout() time.Duration {
+	if probe := p.probeTimeout.Load(); probe > 0 && probe < p.keepalive.timeout {
+		return probe
+	}
+	return p.keepalive.timeout
+}
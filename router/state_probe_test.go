@@ -0,0 +1,98 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestLinkProbeTimeouts(t *testing.T) {
+	s, from, to := newTransitState()
+	s.r.fastDetection = fastFailureDetectionConfig{interval: 200 * time.Millisecond, multiplier: 3}
+	for _, p := range []*peer{from, to} {
+		p.keepalives, p.keepalive = true, defaultKeepaliveConfig
+	}
+	probes := func(p *peer) []time.Duration {
+		var intervals []time.Duration
+		for {
+			select {
+			case f := <-p.control.pop():
+				p.control.ack(f)
+				var probe types.LinkProbe
+				if _, err := types.Decode(&probe, f.Payload); err == nil && f.Type == types.TypeLinkProbe {
+					intervals = append(intervals, time.Duration(probe.Interval)*time.Millisecond)
+				}
+			default:
+				return intervals
+			}
+		}
+	}
+	receiveProbe := func(p *peer, interval time.Duration) {
+		f := getFrame()
+		f.Type = types.TypeLinkProbe
+		probe := types.LinkProbe{Interval: types.Varu64(interval.Milliseconds())}
+		n, err := probe.MarshalBinary(f.Payload[:cap(f.Payload)])
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Payload = f.Payload[:n]
+		if err := s._handleLinkProbe(p, f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect := func(p *peer, interval, timeout time.Duration) {
+		t.Helper()
+		if p.idleInterval() != interval || p.readTimeout() != timeout {
+			t.Fatalf("expected %s/%s, got %s/%s", interval, timeout, p.idleInterval(), p.readTimeout())
+		}
+	}
+
+	// Nothing is tightened until the peer has shown that it understands
+	// link probes.
+	s._updateParentProbes(nil, to)
+	if got := probes(to); len(got) != 1 || got[0] != 200*time.Millisecond {
+		t.Fatalf("expected a probe asking for 200ms, got %v", got)
+	}
+	expect(to, peerKeepaliveInterval, peerKeepaliveTimeout)
+
+	// The slower of the two intervals wins, and the timeout is that times
+	// the multiplier.
+	receiveProbe(to, 500*time.Millisecond)
+	expect(to, 500*time.Millisecond, 1500*time.Millisecond)
+	receiveProbe(to, 0)
+	expect(to, 200*time.Millisecond, 600*time.Millisecond)
+
+	// The peer can ask for fast failure detection even if we don't want it
+	// ourselves, but no faster than the minimum interval.
+	receiveProbe(from, time.Millisecond)
+	if got := probes(from); len(got) != 1 || got[0] != 0 {
+		t.Fatalf("expected a probe reply asking for nothing, got %v", got)
+	}
+	expect(from, fastFailureDetectionMinInterval, 3*fastFailureDetectionMinInterval)
+
+	// Changing parent moves fast failure detection to the new parent, and
+	// the old one goes back to the keepalive timeout.
+	receiveProbe(from, 0)
+	_ = probes(to)
+	s._updateParentProbes(to, from)
+	expect(to, peerKeepaliveInterval, peerKeepaliveTimeout)
+	expect(from, 200*time.Millisecond, 600*time.Millisecond)
+	if got := probes(to); len(got) != 1 || got[0] != 0 {
+		t.Fatalf("expected the old parent to be told, got %v", got)
+	}
+}
@@ -15,7 +15,7 @@
 package router
 
 import (
-	"crypto/ed25519"
+	"fmt"
 	"time"
 
 	"github.com/matrix-org/pinecone/types"
@@ -43,18 +43,29 @@ type virtualSnakeEntry struct {
 // valid returns true if the update hasn't expired, or false if it has. It is
 // required for updates to time out eventually, in the case that paths don't get
 // torn down properly for some reason.
-func (e *virtualSnakeEntry) valid() bool {
-	return time.Since(e.LastSeen) < virtualSnakeNeighExpiryPeriod
+func (e *virtualSnakeEntry) valid(now time.Time, expiry time.Duration) bool {
+	return now.Sub(e.LastSeen) < expiry
+}
+
+// underRoot returns true if the path was set up under the given root. Only
+// the root key matters, since paths are refreshed under new root sequence
+// numbers rather than being set up again, see snekrefresh.go.
+func (e *virtualSnakeEntry) underRoot(root *types.Root) bool {
+	return e.Root.RootPublicKey == root.RootPublicKey
 }
 
 // _maintainSnake is responsible for working out if we need to send bootstraps
 // or to clean up any old paths.
 func (s *state) _maintainSnake() {
+	if s._suspended {
+		// Resume will restart maintenance.
+		return
+	}
 	select {
 	case <-s.r.context.Done():
 		return
 	default:
-		defer s._maintainSnakeIn(virtualSnakeMaintainInterval)
+		defer s._maintainSnakeIn(s._snakeMaintainInterval())
 	}
 
 	// Work out if we are able to bootstrap. If we are the root node then
@@ -66,31 +77,50 @@ func (s *state) _maintainSnake() {
 	// The descending node is the node with the next lowest key.
 	if desc := s._descending; desc != nil {
 		switch {
-		case !desc.valid():
+		case !desc.valid(s.r.clock.Now(), s.r.timings.PathExpiry):
 			fallthrough
-		case !desc.Root.EqualTo(&rootAnn.Root):
+		case !desc.underRoot(&rootAnn.Root):
 			s._setDescendingNode(nil)
 		}
 	}
 
+	// Make sure that nothing was missed when peerings stopped.
+	s._checkInvariants()
+
 	// Clean up any paths that are older than the expiry period.
 	for k, v := range s._table {
-		if !v.valid() {
-			s._removeRouteEntry(k)
+		if !v.valid(s.r.clock.Now(), s.r.timings.PathExpiry) {
+			s._removeRouteEntry(k, "expired")
 		}
 	}
 
+	// See if we have found a stable pair of neighbours since our parent
+	// or root changed.
+	s._checkConvergence()
+
 	// Send a new bootstrap.
-	if time.Since(s._lastbootstrap) >= virtualSnakeBootstrapInterval {
+	if since(s.r.clock, s._lastbootstrap) >= s.r.timings.BootstrapInterval {
 		s._bootstrapNow()
 	}
+
+	// Tell our peers which keys they can reach through us.
+	s._sendReachability()
+
+	// Tell our neighbours who we think our neighbours are.
+	s._sendAdjacency()
+
+	// Try to move on any bundles that we are holding.
+	s._maintainCustody()
+
+	// Send any of our traffic that now has a next hop.
+	s._flushSendQueues()
 }
 
 // _bootstrapSoon will reset the bootstrap timer so that we will bootstrap on
 // the next maintenance interval. This is better than calling _bootstrapNow
 // directly which might cause more protocol traffic than necessary.
 func (s *state) _bootstrapSoon() {
-	s._lastbootstrap = time.Now().Add(-virtualSnakeBootstrapInterval)
+	s._lastbootstrap = s.r.clock.Now().Add(-s.r.timings.BootstrapInterval)
 }
 
 // _bootstrapNow is responsible for sending a bootstrap message to the network.
@@ -101,16 +131,20 @@ func (s *state) _bootstrapNow() {
 	if s._parent == nil {
 		return
 	}
+	// If our last bootstrap was confirmed and nothing has changed since,
+	// refresh the path that it set up instead.
+	if s._refreshPath() {
+		return
+	}
 	// Construct the bootstrap packet. We will include our root key and sequence
 	// number in the update so that the remote side can determine if we are both using
 	// the same root node when processing the update.
 	ann := s._rootAnnouncement()
-	b := frameBufferPool.Get().(*[types.MaxFrameSize]byte)
-	defer frameBufferPool.Put(b)
 	bootstrap := types.VirtualSnakeBootstrap{
 		Root:     ann.Root,
-		Sequence: types.Varu64(time.Now().UnixMilli()),
+		Sequence: types.Varu64(s.r.clock.Now().UnixMilli()),
 	}
+	s._bootstrapSequence = bootstrap.Sequence
 	if s.r.secure {
 		protected, err := bootstrap.ProtectedPayload()
 		if err != nil {
@@ -118,13 +152,9 @@ func (s *state) _bootstrapNow() {
 		}
 		copy(
 			bootstrap.Signature[:],
-			ed25519.Sign(s.r.private[:], protected),
+			s.r.sign(protected),
 		)
 	}
-	n, err := bootstrap.MarshalBinary(b[:])
-	if err != nil {
-		return
-	}
 
 	// Construct the frame. We set the destination key to be our own public key. As
 	// the bootstrap routing defaults to routing towards higher keys, this should
@@ -133,7 +163,10 @@ func (s *state) _bootstrapNow() {
 	send.Type = types.TypeBootstrap
 	send.DestinationKey = s.r.public
 	send.Source = s._coords()
-	send.Payload = append(send.Payload[:0], b[:n]...)
+	if err := send.AppendPayload(&bootstrap); err != nil {
+		framePool.Put(send)
+		return
+	}
 	send.Watermark = types.VirtualSnakeWatermark{
 		PublicKey: types.FullMask,
 		Sequence:  0,
@@ -141,11 +174,19 @@ func (s *state) _bootstrapNow() {
 
 	// Bootstrap messages are routed using SNEK routing with special rules for
 	// bootstrap packets.
+	s._lastbootstrap = s.r.clock.Now()
 	if p, w := s._nextHopsSNEK(send.DestinationKey, types.TypeBootstrap, send.Watermark); p != nil && p.proto != nil {
 		send.Watermark = w
-		p.proto.push(send)
+		s._trackBootstrap(p, send)
+		s._bootstrapSent(bootstrap.Sequence, w.PublicKey, p)
+		s._recordPathEvent(ProtocolBootstrapSent, PathID{s.r.public, bootstrap.Sequence}, p, fmt.Sprintf("routed towards %s", w.PublicKey))
+		s._count(rollupBootstraps)
+		p.queueFor(send.Type).push(send)
+		s._awaitBootstrapConfirm(bootstrap.Sequence)
+	} else {
+		framePool.Put(send)
+		s._bootstrapFailed(bootstrap.Sequence, types.PublicKey{}, "no next-hop")
 	}
-	s._lastbootstrap = time.Now()
 }
 
 type virtualSnakeNextHopParams struct {
@@ -158,6 +199,8 @@ type virtualSnakeNextHopParams struct {
 	lastAnnouncement  *rootAnnouncementWithTime
 	peerAnnouncements announcementTable
 	snakeRoutes       virtualSnakeTable
+	now               time.Time
+	pathExpiry        time.Duration
 }
 
 // _nextHopsSNEK locates the best next-hop for a given SNEK-routed frame.
@@ -169,16 +212,28 @@ func (s *state) _nextHopsSNEK(dest types.PublicKey, frameType types.FrameType, w
 		watermark,
 		s._parent,
 		s.r.local,
-		s._rootAnnouncement(),
+		s._lookupRoot(),
 		s._announcements,
 		s._table,
+		s.r.clock.Now(),
+		s.r.timings.PathExpiry,
 	})
 }
 
 func getNextHopSNEK(params virtualSnakeNextHopParams) (*peer, types.VirtualSnakeWatermark) {
+	return explainNextHopSNEK(params, nil)
+}
+
+// explainNextHopSNEK works in the same way as getNextHopSNEK but, if the
+// explain function is not nil, calls it every time that a new best candidate
+// is chosen, along with the rule that chose it.
+func explainNextHopSNEK(params virtualSnakeNextHopParams, explain func(key types.PublicKey, p *peer, rule string)) (*peer, types.VirtualSnakeWatermark) {
 	// If the message isn't a bootstrap message and the destination is for our
 	// own public key, handle the frame locally — it's basically loopback.
 	if !params.isBootstrap && params.publicKey == params.destinationKey {
+		if explain != nil {
+			explain(params.publicKey, params.selfPeer, "destination is our own key")
+		}
 		return params.selfPeer, params.watermark
 	}
 
@@ -194,17 +249,30 @@ func getNextHopSNEK(params virtualSnakeNextHopParams) (*peer, types.VirtualSnake
 	destKey := params.destinationKey
 
 	// newCandidate updates the best key and best peer with new candidates.
-	newCandidate := func(key types.PublicKey, seq types.Varu64, p *peer) {
+	// New paths aren't set up through peers that are about to leave.
+	newCandidate := func(key types.PublicKey, seq types.Varu64, p *peer, rule string) {
+		if params.isBootstrap && p != nil && p._departing {
+			return
+		}
 		bestKey, bestSeq, bestPeer, bestAnn = key, seq, p, params.peerAnnouncements[p]
+		if explain != nil {
+			explain(key, p, rule)
+		}
 	}
 	// newCheckedCandidate performs some sanity checks on the candidate before
 	// passing it to newCandidate.
-	newCheckedCandidate := func(candidate types.PublicKey, seq types.Varu64, p *peer) {
+	newCheckedCandidate := func(candidate types.PublicKey, seq types.Varu64, p *peer, source string) {
 		switch {
 		case !params.isBootstrap && candidate == destKey && bestKey != destKey:
-			newCandidate(candidate, seq, p)
+			if explain != nil {
+				source += " is the destination"
+			}
+			newCandidate(candidate, seq, p, source)
 		case util.DHTOrdered(destKey, candidate, bestKey):
-			newCandidate(candidate, seq, p)
+			if explain != nil {
+				source += " is closer to the destination"
+			}
+			newCandidate(candidate, seq, p, source)
 		}
 	}
 
@@ -216,18 +284,18 @@ func getNextHopSNEK(params virtualSnakeNextHopParams) (*peer, types.VirtualSnake
 		case params.isBootstrap && bestKey == destKey:
 			// Bootstraps always start working towards thear root so that they
 			// go somewhere rather than getting stuck.
-			fallthrough
+			newCandidate(params.lastAnnouncement.RootPublicKey, 0, params.parentPeer, "bootstraps start towards the root")
 		case util.DHTOrdered(bestKey, destKey, params.lastAnnouncement.RootPublicKey):
 			// The destination key is higher than our own key, so start using
 			// the path to the root as the first candidate.
-			newCandidate(params.lastAnnouncement.RootPublicKey, 0, params.parentPeer)
+			newCandidate(params.lastAnnouncement.RootPublicKey, 0, params.parentPeer, "destination is above us, so start towards the root")
 		}
 
 		// Check our direct ancestors in the tree, that is, all nodes between
 		// ourselves and the root node via the parent port.
 		if ann := params.peerAnnouncements[params.parentPeer]; ann != nil {
 			for _, ancestor := range ann.Signatures {
-				newCheckedCandidate(ancestor.PublicKey, 0, params.parentPeer)
+				newCheckedCandidate(ancestor.PublicKey, 0, params.parentPeer, "ancestor via our parent")
 			}
 		}
 	}
@@ -239,7 +307,7 @@ func getNextHopSNEK(params virtualSnakeNextHopParams) (*peer, types.VirtualSnake
 			continue
 		}
 		for _, hop := range ann.Signatures {
-			newCheckedCandidate(hop.PublicKey, 0, p)
+			newCheckedCandidate(hop.PublicKey, 0, p, "ancestor of a direct peer")
 		}
 	}
 
@@ -255,7 +323,7 @@ func getNextHopSNEK(params virtualSnakeNextHopParams) (*peer, types.VirtualSnake
 		if peerKey := p.public; bestKey == peerKey {
 			// We've seen this key already and we are directly peered, so use
 			// the peering instead of the previous selected port.
-			newCandidate(bestKey, 0, p)
+			newCandidate(bestKey, 0, p, "directly peered with the best key")
 		}
 	}
 
@@ -264,13 +332,44 @@ func getNextHopSNEK(params virtualSnakeNextHopParams) (*peer, types.VirtualSnake
 	// higher one, this is effectively looking for paths that descend through
 	// keyspace toward lower keys rather than ascend toward higher ones.
 	for _, entry := range params.snakeRoutes {
-		if !entry.Source.started.Load() || !entry.valid() {
+		if !entry.Source.started.Load() || !entry.valid(params.now, params.pathExpiry) {
 			continue
 		}
 		if entry.Watermark.WorseThan(params.watermark) {
 			continue
 		}
-		newCheckedCandidate(entry.PublicKey, entry.Watermark.Sequence, entry.Source)
+		newCheckedCandidate(entry.PublicKey, entry.Watermark.Sequence, entry.Source, "SNEK path")
+	}
+
+	// Check the keys that our direct peers told us about when the peering
+	// came up. These are only hints until bootstraps have passed through us,
+	// so they come after our own paths.
+	for p := range params.peerAnnouncements {
+		if !p.started.Load() || p._summary == nil || !p._summary.valid(&params.lastAnnouncement.Root, params.now, params.pathExpiry) {
+			continue
+		}
+		for _, key := range p._summary.keys {
+			newCheckedCandidate(key, 0, p, "summarised by a direct peer")
+		}
+	}
+
+	// If none of the candidates so far are the destination itself, check
+	// whether one of our direct peers has told us that it can reach the
+	// destination. Peers whose filters don't contain it can't help here.
+	if !params.isBootstrap && bestKey != destKey {
+		var hinted *peer
+		for p := range params.peerAnnouncements {
+			switch {
+			case !p.started.Load() || p._reachability == nil:
+			case !p._reachability.valid(&params.lastAnnouncement.Root, params.now):
+			case !p._reachability.filter.Contains(destKey):
+			case hinted == nil || p.port < hinted.port:
+				hinted = p
+			}
+		}
+		if hinted != nil {
+			newCandidate(destKey, 0, hinted, "reachability filter of a direct peer contains the destination")
+		}
 	}
 
 	// Finally, be sure that we're using the best-looking path to our next-hop.
@@ -283,12 +382,12 @@ func getNextHopSNEK(params virtualSnakeNextHopParams) (*peer, types.VirtualSnake
 				continue
 			case p.peertype < bestPeer.peertype:
 				// Prefer faster classes of links if possible.
-				newCandidate(bestKey, bestSeq, p)
+				newCandidate(bestKey, bestSeq, p, "faster link to the same node")
 			case p.peertype == bestPeer.peertype &&
 				ann.Root.EqualTo(&bestAnn.Root) &&
 				ann.receiveOrder < bestAnn.receiveOrder:
 				// Prefer links that have the lowest latency to the root.
-				newCandidate(bestKey, bestSeq, p)
+				newCandidate(bestKey, bestSeq, p, "lower latency link to the same node")
 			}
 		}
 	}
@@ -304,8 +403,24 @@ func getNextHopSNEK(params virtualSnakeNextHopParams) (*peer, types.VirtualSnake
 func (s *state) _handleBootstrap(from, to *peer, rx *types.Frame) bool {
 	// Unmarshal the bootstrap.
 	var bootstrap types.VirtualSnakeBootstrap
-	_, err := bootstrap.UnmarshalBinary(rx.Payload)
+	_, err := types.Decode(&bootstrap, rx.Payload)
 	if err != nil {
+		s._recordEvent(ProtocolPathRejected, rx.DestinationKey, from, "malformed bootstrap")
+		return false
+	}
+	path := PathID{rx.DestinationKey, bootstrap.Sequence}
+	if to == nil || to == s.r.local {
+		s._recordPathEvent(ProtocolBootstrapReceived, path, from, "")
+	}
+	if s._isRevoked(rx.DestinationKey) {
+		// The node that sent the bootstrap has been banned, so don't let it
+		// join the DHT.
+		s._recordPathEvent(ProtocolPathRejected, path, from, "key revoked")
+		return false
+	}
+	if s._draining && to != nil && to != s.r.local {
+		// We're about to leave, so don't let new paths through us.
+		s._recordPathEvent(ProtocolPathRejected, path, from, "draining")
 		return false
 	}
 	if s.r.secure {
@@ -313,22 +428,27 @@ func (s *state) _handleBootstrap(from, to *peer, rx *types.Frame) bool {
 		// to have sent it. Silently drop it if there's a signature problem.
 		protected, err := bootstrap.ProtectedPayload()
 		if err != nil {
+			s._recordPathEvent(ProtocolPathRejected, path, from, "malformed bootstrap")
 			return false
 		}
-		if !ed25519.Verify(
+		if !s.r.verify(
 			rx.DestinationKey[:],
 			protected,
 			bootstrap.Signature[:],
 		) {
+			s._recordPathEvent(ProtocolPathRejected, path, from, "invalid signature")
 			return false
 		}
 	}
 
-	// Check that the root key and sequence number in the update match our
-	// current root, otherwise we won't be able to route back to them using
-	// tree routing anyway. If they don't match, silently drop the bootstrap.
+	// Check that the root key in the update matches our current root,
+	// otherwise we won't be able to route back to them using tree routing
+	// anyway. If it doesn't match, silently drop the bootstrap. The root
+	// sequence number can be different, since one of us may not have seen
+	// the latest root announcement yet.
 	root := s._rootAnnouncement()
-	if !root.Root.EqualTo(&bootstrap.Root) {
+	if root.RootPublicKey != bootstrap.RootPublicKey {
+		s._recordPathEvent(ProtocolPathRejected, path, from, "different root")
 		return false
 	}
 
@@ -338,10 +458,11 @@ func (s *state) _handleBootstrap(from, to *peer, rx *types.Frame) bool {
 	}
 	if existing, ok := s._table[index]; ok {
 		switch {
-		case !existing.Root.EqualTo(&bootstrap.Root):
+		case !existing.underRoot(&bootstrap.Root):
 			break // the root is different
 		case bootstrap.Sequence <= existing.Watermark.Sequence:
 			// TODO: less than-equal to might not be the right thing to do
+			s._recordPathEvent(ProtocolPathRejected, path, from, "old sequence number")
 			return false
 		}
 	}
@@ -350,49 +471,63 @@ func (s *state) _handleBootstrap(from, to *peer, rx *types.Frame) bool {
 		virtualSnakeIndex: &index,
 		Source:            from,
 		Destination:       to,
-		LastSeen:          time.Now(),
-		Root:              bootstrap.Root,
+		LastSeen:          s.r.clock.Now(),
+		Root:              root.Root,
 		Watermark: types.VirtualSnakeWatermark{
 			PublicKey: index.PublicKey,
 			Sequence:  bootstrap.Sequence,
 		},
 	}
 	s._addRouteEntry(index, entry)
+	s._recordPathEvent(ProtocolPathInstalled, path, from, "")
 
 	// Now let's see if this is a suitable descending entry.
-	update := false
+	update, rule := false, ""
 	desc := s._descending
 	switch {
-	case !root.Root.EqualTo(&bootstrap.Root):
+	case root.RootPublicKey != bootstrap.RootPublicKey:
 		// The root key in the bootstrap doesn't match our own key
 		// so it is quite possible that tree routing would fail.
+		rule = "different root"
 	case !util.LessThan(rx.DestinationKey, s.r.public):
 		// The bootstrapping key should be less than ours but it isn't.
-	case desc != nil && desc.valid():
+		rule = "key isn't lower than ours"
+	case desc != nil && desc.valid(s.r.clock.Now(), s.r.timings.PathExpiry):
 		// We already have a descending entry and it hasn't expired.
 		switch {
 		case desc.PublicKey == rx.DestinationKey:
 			// We've received another bootstrap from our direct descending node.
 			// Accept the update as this is OK.
-			update = true
+			update, rule = true, "refreshed by descending node"
 		case util.DHTOrdered(desc.PublicKey, rx.DestinationKey, s.r.public):
 			// The bootstrapping node is closer to us than our previous descending
 			// node was.
-			update = true
+			update, rule = true, "closer than descending node"
+		default:
+			rule = "not closer than descending node"
 		}
-	case desc == nil || !desc.valid():
+	case desc == nil || !desc.valid(s.r.clock.Now(), s.r.timings.PathExpiry):
 		// We don't have a descending entry, or we did but it expired.
 		if util.LessThan(rx.DestinationKey, s.r.public) {
 			// The bootstrapping key is less than ours so we'll acknowledge it.
-			update = true
+			update, rule = true, "no valid descending node"
 		}
 	default:
 		// The bootstrap conditions weren't met. This might just be because
 		// there's a node out there that hasn't converged to a closer node
 		// yet, so we'll just ignore the bootstrap.
+		rule = "conditions not met"
 	}
 	if update {
+		s._recordPathEvent(ProtocolDescendingChanged, path, from, rule)
 		s._setDescendingNode(s._table[index])
+		if to == nil || to == s.r.local {
+			// The bootstrap ends with us, so let the node that sent it
+			// know that its path is live.
+			s._confirmBootstrap(rx, bootstrap.Sequence)
+		}
+	} else if to == nil || to == s.r.local {
+		s._recordPathEvent(ProtocolDescendingRefused, path, from, rule)
 	}
 	return true
 }
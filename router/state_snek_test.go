@@ -96,6 +96,8 @@ func TestSNEKNextHopSelection(t *testing.T) {
 				peers[1]: &parentAnn,
 			},
 			virtualSnakeTable{},
+			time.Now(),
+			virtualSnakeNeighExpiryPeriod,
 		}, peers[1]}, // default peer with no next hop is parent
 		{"TestBootstrapNoValidNextHop", virtualSnakeNextHopParams{
 			false,
@@ -109,6 +111,8 @@ func TestSNEKNextHopSelection(t *testing.T) {
 				peers[1]: &parentAnn,
 			},
 			virtualSnakeTable{},
+			time.Now(),
+			virtualSnakeNeighExpiryPeriod,
 		}, peers[1]}, // default bootstrap peer with no next hop is parent
 		{"TestNotBootstrapDestIsSelf", virtualSnakeNextHopParams{
 			false,
@@ -123,6 +127,8 @@ func TestSNEKNextHopSelection(t *testing.T) {
 				peers[2]: &knowsDestUpAnn,
 			},
 			virtualSnakeTable{},
+			time.Now(),
+			virtualSnakeNeighExpiryPeriod,
 		}, peers[0]},
 		{"TestBootstrapDestIsSelf", virtualSnakeNextHopParams{
 			true,
@@ -136,6 +142,8 @@ func TestSNEKNextHopSelection(t *testing.T) {
 				peers[1]: &parentAnn,
 			},
 			virtualSnakeTable{},
+			time.Now(),
+			virtualSnakeNeighExpiryPeriod,
 		}, peers[1]}, // bootstraps always start working towards root via parent
 		{"TestNotBootstrapPeerIsDestination", virtualSnakeNextHopParams{
 			false,
@@ -150,6 +158,8 @@ func TestSNEKNextHopSelection(t *testing.T) {
 				peers[2]: &knowsDestUpAnn,
 			},
 			virtualSnakeTable{},
+			time.Now(),
+			virtualSnakeNeighExpiryPeriod,
 		}, peers[2]},
 		{"TestBootstrapPeerIsDestination", virtualSnakeNextHopParams{
 			true,
@@ -164,6 +174,8 @@ func TestSNEKNextHopSelection(t *testing.T) {
 				peers[2]: &knowsDestUpAnn,
 			},
 			virtualSnakeTable{},
+			time.Now(),
+			virtualSnakeNeighExpiryPeriod,
 		}, peers[1]}, // bootstraps work their way toward the root
 		{"TestNotBootstrapParentKnowsDestination", virtualSnakeNextHopParams{
 			false,
@@ -177,6 +189,8 @@ func TestSNEKNextHopSelection(t *testing.T) {
 				peers[1]: &knowsDestUpAnn,
 			},
 			virtualSnakeTable{},
+			time.Now(),
+			virtualSnakeNeighExpiryPeriod,
 		}, peers[1]},
 		{"TestNotBootstrapPeerKnowsDestination", virtualSnakeNextHopParams{
 			false,
@@ -191,6 +205,8 @@ func TestSNEKNextHopSelection(t *testing.T) {
 				peers[2]: &knowsDestUpAnn,
 			},
 			virtualSnakeTable{},
+			time.Now(),
+			virtualSnakeNeighExpiryPeriod,
 		}, peers[2]},
 		{"TestBootstrapPeerKnowsDestination", virtualSnakeNextHopParams{
 			true,
@@ -205,6 +221,8 @@ func TestSNEKNextHopSelection(t *testing.T) {
 				peers[2]: &knowsDestUpAnn,
 			},
 			virtualSnakeTable{},
+			time.Now(),
+			virtualSnakeNeighExpiryPeriod,
 		}, peers[1]}, // bootstraps work their way toward the root
 		{"TestNotBootstrapParentKnowsCloser", virtualSnakeNextHopParams{
 			false,
@@ -218,6 +236,8 @@ func TestSNEKNextHopSelection(t *testing.T) {
 				peers[1]: &knowsHigherAnn,
 			},
 			virtualSnakeTable{},
+			time.Now(),
+			virtualSnakeNeighExpiryPeriod,
 		}, peers[1]},
 		{"TestBootstrapParentKnowsCloser", virtualSnakeNextHopParams{
 			true,
@@ -231,6 +251,8 @@ func TestSNEKNextHopSelection(t *testing.T) {
 				peers[1]: &knowsHigherAnn,
 			},
 			virtualSnakeTable{},
+			time.Now(),
+			virtualSnakeNeighExpiryPeriod,
 		}, peers[1]},
 		{"TestNotBootstrapSnakeEntryIsDest", virtualSnakeNextHopParams{
 			false,
@@ -250,6 +272,8 @@ func TestSNEKNextHopSelection(t *testing.T) {
 					//	Active:            true,
 					virtualSnakeIndex: &virtualSnakeIndex{PublicKey: destDownKey},
 				}},
+			time.Now(),
+			virtualSnakeNeighExpiryPeriod,
 		}, peers[3]},
 		{"TestBootstrapSnakeEntryIsDest", virtualSnakeNextHopParams{
 			true,
@@ -269,6 +293,8 @@ func TestSNEKNextHopSelection(t *testing.T) {
 					//	Active:            true,
 					virtualSnakeIndex: &virtualSnakeIndex{PublicKey: destDownKey},
 				}},
+			time.Now(),
+			virtualSnakeNeighExpiryPeriod,
 		}, nil}, // handle a bootstrap received from a lower key node
 	}
 
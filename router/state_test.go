@@ -0,0 +1,92 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"context"
+	"io"
+	"log"
+
+	"github.com/matrix-org/pinecone/types"
+	"go.uber.org/atomic"
+)
+
+// newTestState returns the state of a node with the given key, for tests
+// that call the functions of the state actor directly instead of starting
+// a router. The node has no peerings and is its own root, and its logger
+// throws everything away. Tests set the router options that they need on
+// s.r before using it.
+func newTestState(public types.PublicKey, clock Clock) *state {
+	r := &Router{
+		log:          log.New(io.Discard, "", 0),
+		context:      context.Background(),
+		clock:        clock,
+		public:       public,
+		timings:      DefaultTimings(),
+		_hopLimiting: atomic.NewBool(false),
+	}
+	r.local = &peer{
+		router:  r,
+		public:  public,
+		started: *atomic.NewBool(true),
+	}
+	r.state = &state{
+		r:                  r,
+		_peers:             []*peer{r.local},
+		_table:             virtualSnakeTable{},
+		_announcements:     announcementTable{},
+		_coordsCache:       coordsCacheTable{},
+		_pathStats:         pathStatsTable{},
+		_handshakeFailures: map[types.PublicKey]uint64{},
+		_history:           newProtocolHistory(16),
+		_routeFeeds:        routeFeedTable{},
+		_pendingBootstraps: pendingBootstrapTable{},
+		_bootstrapAttempts: newBootstrapTracker(),
+		_keyspace:          keyspaceTracker{started: clock.Now()},
+	}
+	return r.state
+}
+
+// addTestPeer adds a running peering with the node with the given key on
+// the next port, with queues so that frames can be sent to it.
+func addTestPeer(s *state, public types.PublicKey) *peer {
+	p := &peer{
+		router:  s.r,
+		public:  public,
+		port:    types.SwitchPortID(len(s._peers)),
+		context: s.r.context,
+		started: *atomic.NewBool(true),
+	}
+	p.control = newFIFOQueue(fifoNoMax, s.r.log, s.r.clock)
+	p.proto = newFIFOQueue(fifoNoMax, s.r.log, s.r.clock)
+	p.traffic = newFairFIFOQueue(trafficBuffer, s.r.log, s.r.clock)
+	p.scheduler = newScheduler(p.control, p.proto, p.traffic, schedulerProtoBurst)
+	s._peers = append(s._peers, p)
+	return p
+}
+
+// announceTestChild records a tree announcement from the peer as if we
+// were the root and the peer were our child, at coordinates [port].
+func announceTestChild(s *state, p *peer) {
+	s._announcements[p] = &rootAnnouncementWithTime{
+		SwitchAnnouncement: types.SwitchAnnouncement{
+			Root: types.Root{RootPublicKey: s.r.public},
+			Signatures: []types.SignatureWithHop{
+				{PublicKey: s.r.public, Hop: types.Varu64(p.port)},
+				{PublicKey: p.public},
+			},
+		},
+	}
+}
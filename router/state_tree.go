@@ -32,13 +32,21 @@ type announcementTable map[*peer]*rootAnnouncementWithTime
 // _maintainTree sends out root announcements if we are
 // considering ourselves to be a root node.
 func (s *state) _maintainTree() {
+	if s._suspended {
+		// Resume will restart maintenance.
+		return
+	}
 	select {
 	case <-s.r.context.Done():
 		return
 	default:
-		defer s._maintainTreeIn(announcementInterval)
+		defer s._maintainTreeIn(s.r.timings.AnnouncementInterval)
 	}
 
+	// Clean up any announcements that can't be used anymore, so that they
+	// don't build up over time.
+	s._evictDefunctAnnouncements()
+
 	// If we don't have a parent then we are acting as if we are a root node,
 	// so we need to send tree announcements to our peers. In each instance,
 	// we will update the sequence number so that downstream nodes know that
@@ -51,8 +59,29 @@ func (s *state) _maintainTree() {
 
 type rootAnnouncementWithTime struct {
 	types.SwitchAnnouncement
-	receiveTime  time.Time // when did we receive the update?
-	receiveOrder uint64    // the relative order that the update was received
+	receiveTime  time.Time         // when did we receive the update?
+	receiveOrder uint64            // the relative order that the update was received
+	coords       types.Coordinates // cached by lookupCoords, not to be modified
+	peerCoords   types.Coordinates // cached by lookupPeerCoords, not to be modified
+}
+
+// lookupCoords returns the same as Coords, but only works them out once for
+// each announcement, since next-hop lookups need them for every frame. The
+// coordinates must not be modified or kept.
+func (a *rootAnnouncementWithTime) lookupCoords() types.Coordinates {
+	if a.coords == nil {
+		a.coords = a.Coords()
+	}
+	return a.coords
+}
+
+// lookupPeerCoords returns the same as PeerCoords, in the same way as
+// lookupCoords.
+func (a *rootAnnouncementWithTime) lookupPeerCoords() types.Coordinates {
+	if a.peerCoords == nil {
+		a.peerCoords = a.PeerCoords()
+	}
+	return a.peerCoords
 }
 
 // forPeer generates a frame with a signed root announcement for the given
@@ -72,17 +101,28 @@ func (a *rootAnnouncementWithTime) forPeer(p *peer) *types.Frame {
 			panic("trying to send announcement with loop")
 		}
 	}
-	// Sign the announcement.
-	if err := announcement.Sign(p.router.private[:], p.port); err != nil {
-		panic("failed to sign switch announcement: " + err.Error())
-	}
 	frame := getFrame()
 	frame.Type = types.TypeTreeAnnouncement
-	n, err := announcement.MarshalBinary(frame.Payload[:cap(frame.Payload)])
+	var err error
+	if key := p.router.aggregate; key != nil {
+		// Add our hop to the aggregate signature.
+		if err = announcement.SignAggregate(key, p.router.public, p.port); err != nil {
+			panic("failed to sign switch announcement: " + err.Error())
+		}
+		var n int
+		n, err = announcement.MarshalAggregateBinary(frame.Payload[:cap(frame.Payload)])
+		frame.Payload = frame.Payload[:n]
+	} else {
+		// Sign the announcement.
+		if err = announcement.Sign(p.router.private[:], p.port); err != nil {
+			panic("failed to sign switch announcement: " + err.Error())
+		}
+		err = frame.AppendPayload(&announcement)
+	}
+	p.router.energy.signs.Inc()
 	if err != nil {
 		panic("failed to marshal switch announcement: " + err.Error())
 	}
-	frame.Payload = frame.Payload[:n]
 	return frame
 }
 
@@ -103,6 +143,19 @@ func (s *state) _rootAnnouncement() *rootAnnouncementWithTime {
 	return s._announcements[s._parent]
 }
 
+// _lookupRoot returns the same as _rootAnnouncement, but if we are the root
+// then it fills in and returns an announcement that the state keeps, rather
+// than allocating a new one. It is used for next-hop lookups on every frame
+// and the result must not be kept after the lookup.
+func (s *state) _lookupRoot() *rootAnnouncementWithTime {
+	if s._parent == nil || s._announcements[s._parent] == nil {
+		s._selfRoot.RootPublicKey = s.r.public
+		s._selfRoot.RootSequence = types.Varu64(s._sequence)
+		return &s._selfRoot
+	}
+	return s._announcements[s._parent]
+}
+
 // coords returns our tree coordinates, or an empty array if we are the
 // root. This function is safe to be called from other actors.
 func (s *state) coords() types.Coordinates {
@@ -129,19 +182,30 @@ func (s *state) _becomeRoot() {
 	if s._parent == nil {
 		return
 	}
-	s._setParent(nil)
+	s._setParent(nil, "became root")
 	s._maintainTree()
 }
 
 // sendTreeAnnouncementToPeer signs and sends the given root announcement
 // to a given peer.
 func (s *state) sendTreeAnnouncementToPeer(ann *rootAnnouncementWithTime, p *peer) {
-	p.proto.push(ann.forPeer(p))
+	f := ann.forPeer(p)
+	p.queueFor(f.Type).push(f)
 }
 
 // _sendTreeAnnouncements signs and sends the current root announcement to
-// all of our active peers.
+// all of our active peers. In low power mode the announcements are batched
+// and sent a short time later instead.
 func (s *state) _sendTreeAnnouncements() {
+	if s._batchTreeAnnouncements() {
+		return
+	}
+	s._sendTreeAnnouncementsNow()
+}
+
+// _sendTreeAnnouncementsNow sends our current root announcement to
+// all of our peers without any batching.
+func (s *state) _sendTreeAnnouncementsNow() {
 	ann := s._rootAnnouncement()
 	for _, p := range s._peers {
 		if p == nil || p.port == 0 || !p.started.Load() {
@@ -158,7 +222,7 @@ func (s *state) _sendTreeAnnouncements() {
 
 		var announcementTime int64
 		if ann.RootPublicKey == s.r.public {
-			announcementTime = time.Now().UnixNano()
+			announcementTime = s.r.clock.Now().UnixNano()
 		} else {
 			announcementTime = ann.receiveTime.UnixNano()
 		}
@@ -185,12 +249,13 @@ type treeNextHopParams struct {
 // "from" peer must be supplied in order to prevent routing loops. It is
 // possible for this function to return nil if no next best-hop is available.
 func (s *state) _nextHopsTree(from *peer, dest types.Coordinates) *peer {
+	root := s._lookupRoot()
 	nextHopParams := treeNextHopParams{
 		dest,
-		s._coords(),
+		root.lookupCoords(),
 		from,
 		s.r.local,
-		s._rootAnnouncement(),
+		root,
 		&s._announcements,
 	}
 
@@ -198,8 +263,18 @@ func (s *state) _nextHopsTree(from *peer, dest types.Coordinates) *peer {
 }
 
 func getNextHopTree(params treeNextHopParams) *peer {
+	return explainNextHopTree(params, nil)
+}
+
+// explainNextHopTree works in the same way as getNextHopTree but, if the
+// explain function is not nil, calls it every time that a new best candidate
+// is chosen, along with the rule that chose it.
+func explainNextHopTree(params treeNextHopParams, explain func(p *peer, distance int64, rule string)) *peer {
 	// If it's loopback then don't bother doing anything else.
 	if params.destinationCoords.EqualTo(params.ourCoords) {
+		if explain != nil {
+			explain(params.selfPeer, 0, "destination is our own coordinates")
+		}
 		return params.selfPeer
 	}
 
@@ -212,6 +287,9 @@ func getNextHopTree(params treeNextHopParams) *peer {
 		// It's impossible to get closer so there's a pretty good
 		// chance at this point that the traffic is destined for us.
 		// Pass it up to the router.
+		if explain != nil {
+			explain(params.selfPeer, 0, "no closer node than us")
+		}
 		return params.selfPeer
 	}
 
@@ -225,6 +303,8 @@ func getNextHopTree(params treeNextHopParams) *peer {
 		switch {
 		case !p.started.Load():
 			continue // ignore peers that have stopped
+		case p.congested.Load():
+			continue // ignore peers that can't keep up with their traffic
 		case ann == nil:
 			continue // ignore peers that haven't sent us announcements
 		case p == params.fromPeer:
@@ -235,15 +315,18 @@ func getNextHopTree(params treeNextHopParams) *peer {
 
 		// Look up the coordinates of the peer, and the distance
 		// across the tree to those coordinates.
-		peerCoords := ann.PeerCoords()
+		peerCoords := ann.lookupPeerCoords()
 		peerDist := int64(peerCoords.DistanceTo(params.destinationCoords))
 		peerType := int(p.peertype)
-		if isBetterNextHopCandidate(
+		if better, rule := compareNextHopCandidate(
 			peerType, peerDist, ann.receiveOrder,
 			bestType, bestDist, bestOrdering,
 			bestPeer == p,
-		) {
+		); better {
 			bestPeer, bestDist, bestOrdering, bestType = p, peerDist, ann.receiveOrder, peerType
+			if explain != nil {
+				explain(p, peerDist, rule)
+			}
 		}
 	}
 
@@ -255,25 +338,37 @@ func isBetterNextHopCandidate(
 	bestType int, bestDistance int64, bestOrder uint64,
 	isAnotherLinkToBest bool,
 ) bool {
-	betterCandidate := false
+	betterCandidate, _ := compareNextHopCandidate(
+		peerType, peerDistance, peerOrder,
+		bestType, bestDistance, bestOrder,
+		isAnotherLinkToBest,
+	)
+	return betterCandidate
+}
 
+// compareNextHopCandidate is isBetterNextHopCandidate but also returns the
+// rule that made the peer a better candidate.
+func compareNextHopCandidate(
+	peerType int, peerDistance int64, peerOrder uint64,
+	bestType int, bestDistance int64, bestOrder uint64,
+	isAnotherLinkToBest bool,
+) (bool, string) {
 	switch {
 	case peerDistance < bestDistance:
 		// The peer is closer to the destination.
-		betterCandidate = true
+		return true, "closer to the destination"
 	case peerDistance > bestDistance:
 		// The peer is further away from the destination.
 	case isAnotherLinkToBest && peerType < bestType:
 		// This is another peering to the same node but is
 		// a faster connection medium.
-		betterCandidate = true
+		return true, "faster link to the same node"
 	case isAnotherLinkToBest && peerType == bestType && peerOrder < bestOrder:
 		// This is another peering to the same node but has
 		// a lower path to the root as a last-resort tiebreak.
-		betterCandidate = true
+		return true, "lower latency link to the same node"
 	}
-
-	return betterCandidate
+	return false, ""
 }
 
 type TreeAnnouncementAction int64
@@ -296,12 +391,24 @@ func (s *state) _handleTreeAnnouncement(p *peer, f *types.Frame) error {
 	// signature is from the root, the last signature is from our direct
 	// peer etc.
 	var newUpdate types.SwitchAnnouncement
-	if _, err := newUpdate.UnmarshalBinary(f.Payload); err != nil {
+	if key := s.r.aggregate; key != nil {
+		if _, err := newUpdate.UnmarshalAggregateBinary(f.Payload, key); err != nil {
+			return fmt.Errorf("update unmarshal failed: %w", &types.ParseError{Parser: "aggregate announcement", Err: err})
+		}
+	} else if _, err := types.Decode(&newUpdate, f.Payload); err != nil {
 		return fmt.Errorf("update unmarshal failed: %w", err)
 	}
+	// Unmarshalling checks the signature of every hop, or the aggregate
+	// signature once.
+	if s.r.aggregate != nil {
+		s.r.energy.verifies.Inc()
+	} else {
+		s.r.energy.verifies.Add(uint64(len(newUpdate.Signatures)))
+	}
 	if err := newUpdate.SanityCheck(p.public); err != nil {
 		return fmt.Errorf("update sanity checks failed: %w", err)
 	}
+	s._watchRootAnnouncement(p, &newUpdate)
 
 	isFirstAnnouncement := false
 	shouldSendBroadcast := false
@@ -328,23 +435,40 @@ func (s *state) _handleTreeAnnouncement(p *peer, f *types.Frame) error {
 		}
 	}
 
+	// If the announcement store is full then we can't take on another
+	// peering's announcement, but it isn't the peer's fault.
+	if isFirstAnnouncement && !s._makeRoomForAnnouncement(&newUpdate) {
+		return nil
+	}
+
 	// Get the key of our current root and then work out if the root
-	// key in the new update is stronger, weaker or the same key.
+	// key in the new update is stronger, weaker or the same key. Roots
+	// that we distrust are weaker than any other.
 	lastParentUpdate := s._rootAnnouncement()
-	lastRootKey := s.r.public
+	lastRoot := types.Root{RootPublicKey: s.r.public}
 	if lastParentUpdate != nil {
-		lastRootKey = lastParentUpdate.RootPublicKey
+		lastRoot = lastParentUpdate.Root
 	}
-	rootDelta := newUpdate.RootPublicKey.CompareTo(lastRootKey)
+	lastRootKey := lastRoot.RootPublicKey
+	rootDelta := s._compareRoots(newUpdate.Root, lastRoot)
 
 	// Save the root announcement for the peer. If the update is not
 	// obviously bad then it isn't safe to "skip" storing updates.
 	s._ordering++
-	s._announcements[p] = &rootAnnouncementWithTime{
+	s._storeAnnouncement(p, &rootAnnouncementWithTime{
 		SwitchAnnouncement: newUpdate,
-		receiveTime:        time.Now(),
+		receiveTime:        s.r.clock.Now(),
 		receiveOrder:       s._ordering,
+	})
+	change := events.RouteUpdated
+	if isFirstAnnouncement {
+		change = events.RouteAdded
 	}
+	s._publishRoute(events.TreeAnnouncementChanged{
+		Change:       change,
+		Announcement: treeAnnouncement(p, s._announcements[p]),
+	})
+	s._observeAnnouncement(&newUpdate)
 
 	// If we're currently waiting to re-parent then there is no
 	// further action
@@ -352,6 +476,16 @@ func (s *state) _handleTreeAnnouncement(p *peer, f *types.Frame) error {
 		announcementAction := determineAnnouncementAction(p == s._parent,
 			newUpdate.IsLoopOrChildOf(s.r.public), rootDelta,
 			newUpdate.RootSequence, lastParentUpdate.RootSequence)
+		if announcementAction == AcceptNewParent && (p._demoted || p.noParent || p._departing) {
+			// Let parent selection find the best peer that isn't demoted,
+			// isn't about to leave and is allowed to be our parent.
+			announcementAction = SelectNewParent
+		}
+		if announcementAction == InformPeerOfStrongerRoot && s._rootDistrusted(newUpdate.RootPublicKey) {
+			// The peer trusts a root that we don't, so telling it about
+			// our root would just make it tell us about its root again.
+			announcementAction = DropFrame
+		}
 
 		switch announcementAction {
 		case DropFrame:
@@ -359,7 +493,7 @@ func (s *state) _handleTreeAnnouncement(p *peer, f *types.Frame) error {
 		case AcceptUpdate:
 			s._sendTreeAnnouncements()
 		case AcceptNewParent:
-			s._setParent(p)
+			s._setParent(p, "accepted announcement from new parent")
 			s._sendTreeAnnouncements()
 		case SelectNewParent:
 			if s._selectNewParent() {
@@ -369,7 +503,7 @@ func (s *state) _handleTreeAnnouncement(p *peer, f *types.Frame) error {
 			s._waiting = true
 			s._becomeRoot()
 			// Start the 1 second timer to re-run parent selection.
-			time.AfterFunc(time.Second, func() {
+			s.r.clock.AfterFunc(time.Second, func() {
 				s.Act(nil, func() {
 					s._waiting = false
 					if s._selectNewParent() {
@@ -384,6 +518,13 @@ func (s *state) _handleTreeAnnouncement(p *peer, f *types.Frame) error {
 		}
 	}
 
+	// If our root has changed then we will need to find our place in the
+	// SNEK again.
+	if s._rootAnnouncement().RootPublicKey != lastRootKey {
+		s._convergenceStarted()
+	}
+	s._observeRoot()
+
 	if shouldSendBroadcast {
 		if broadcast, err := s._createBroadcastFrame(); err == nil {
 			p.send(broadcast)
@@ -477,43 +618,63 @@ func (s *state) _selectNewParent() bool {
 	root := s._rootAnnouncement()
 	bestRoot := root.Root
 
-	// If our own key happens to be stronger than our current root for some
-	// reason then we will just compare against our own key instead.
-	if bestRoot.RootPublicKey.CompareTo(s.r.public) < 0 {
-		bestRoot = types.Root{
-			RootPublicKey: s.r.public,
-			RootSequence:  0,
-		}
+	// If we would be a better root than our current root for some reason,
+	// for example if we no longer trust it, then we will just compare
+	// against our own key instead.
+	self := types.Root{
+		RootPublicKey: s.r.public,
+		RootSequence:  0,
+	}
+	if s._compareRoots(bestRoot, self) < 0 {
+		bestRoot = self
 	}
 	bestOrder := uint64(math.MaxUint64)
 	var bestPeer *peer
 
 	// Iterate through all of the announcements received from our peers.
-	// This will exclude any peers that haven't sent us updates yet.
-	for peer, ann := range s._announcements {
-		if !peer.started.Load() {
-			// The peer has been stopped for some reason, possibly due to a
-			// timeout or other protocol handling error.
-			continue
-		}
+	// This will exclude any peers that haven't sent us updates yet. Peers
+	// that are about to leave are only considered if no other peer will do,
+	// since becoming the root in the meantime would be worse than keeping
+	// them as our parent until they go.
+	for _, departing := range []bool{false, true} {
+		for peer, ann := range s._announcements {
+			if !peer.started.Load() {
+				// The peer has been stopped for some reason, possibly due to a
+				// timeout or other protocol handling error.
+				continue
+			}
+			if peer._demoted || peer.congested.Load() || peer.noParent {
+				// The peer has a poor quality score, can't keep its queues
+				// drained or has a tag that rules it out, so we don't want to
+				// route the tree through it, even if it has a better root.
+				continue
+			}
+			if peer._departing != departing {
+				continue
+			}
 
-		if ann != nil {
-			if isBetterParentCandidate(*ann, bestRoot, bestOrder, ann.IsLoopOrChildOf(s.r.public)) {
-				bestRoot = ann.Root
-				bestPeer = peer
-				bestOrder = ann.receiveOrder
+			if ann != nil && !s._rootDistrusted(ann.RootPublicKey) {
+				if isBetterParentCandidate(*ann, bestRoot, bestOrder, ann.IsLoopOrChildOf(s.r.public), s.r.clock.Now(), s.r.timings.AnnouncementTimeout, s.r.rootPolicy) {
+					bestRoot = ann.Root
+					bestPeer = peer
+					bestOrder = ann.receiveOrder
+				}
 			}
 		}
+		if bestPeer != nil {
+			break
+		}
 	}
 
 	// If we found a suitable candidate then we should see if a change needs
 	// to be made.
 	if bestPeer != nil {
+		bestPeer = s._lowerRTTParent(s._nearbyParent(bestPeer))
 		if bestPeer != s._parent {
 			// The chosen candidate is different to our current parent, so we
 			// will update to our new parent and then send tree announcements
 			// to our peers to notify them of the change.
-			s._setParent(bestPeer)
+			s._setParent(bestPeer, "selected better parent")
 			s._sendTreeAnnouncements()
 			return true
 		}
@@ -529,18 +690,18 @@ func (s *state) _selectNewParent() bool {
 }
 
 func isBetterParentCandidate(ann rootAnnouncementWithTime, bestRoot types.Root,
-	bestOrder uint64, containsLoop bool) bool {
+	bestOrder uint64, containsLoop bool, now time.Time, timeout time.Duration, policy RootPolicy) bool {
 	isBetterCandidate := false
 
-	if time.Since(ann.receiveTime) >= announcementTimeout {
+	if now.Sub(ann.receiveTime) >= timeout {
 		// If the announcement has expired then don't consider this peer
 		// as a possible candidate.
 		return false
 	}
 
-	// Work out if the parent's announcement contains a stronger root
-	// key than our current best candidate.
-	keyDelta := ann.RootPublicKey.CompareTo(bestRoot.RootPublicKey)
+	// Work out if the parent's announcement contains a better root than
+	// our current best candidate, according to our root policy.
+	keyDelta := compareRoots(policy, ann.Root, bestRoot)
 	switch {
 	case containsLoop:
 		// The announcement from this peer contains our own public key in
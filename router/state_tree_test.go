@@ -517,7 +517,7 @@ func TestTreeParentSelection(t *testing.T) {
 
 	for _, tc := range cases {
 		t.Run(tc.desc, func(t *testing.T) {
-			actual := isBetterParentCandidate(tc.announcement, tc.bestRoot, tc.bestOrder, tc.containsLoop)
+			actual := isBetterParentCandidate(tc.announcement, tc.bestRoot, tc.bestOrder, tc.containsLoop, time.Now(), announcementTimeout, StrongestKeyRootPolicy{})
 			if actual != tc.expected {
 				t.Fatalf("expected: %t got: %t", tc.expected, actual)
 			}
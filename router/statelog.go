@@ -0,0 +1,139 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+// The protocol events that go into the protocol history can also be written
+// to the log as they happen, one line of key=value pairs per event, so that
+// problems in production can be diagnosed from the logs alone. Each kind of
+// event has a name in a hierarchy, i.e. "tree.parent_changed" or
+// "snek.table.path_removed", and RouterOptionStateLogging turns logging on
+// or off for everything under a prefix of that name. The longest matching
+// prefix wins, or the last one given if they are the same length, so "snek"
+// can be logged in full while the noisier "snek.bootstrap" events are only
+// sampled. Sampling counts the events of each kind separately and logs the
+// first of every so many, so that rare events are always seen even when
+// common ones are being thinned out.
+
+// stateLogCategories places each kind of protocol event in the hierarchy.
+var stateLogCategories = map[ProtocolEventKind]string{
+	ProtocolParentChanged:          "tree",
+	ProtocolRootMisbehaving:        "tree",
+	ProtocolBootstrapSent:          "snek.bootstrap",
+	ProtocolBootstrapReceived:      "snek.bootstrap",
+	ProtocolBootstrapAcknowledged:  "snek.bootstrap",
+	ProtocolBootstrapRetransmitted: "snek.bootstrap",
+	ProtocolBootstrapLost:          "snek.bootstrap",
+	ProtocolBootstrapConfirmed:     "snek.bootstrap",
+	ProtocolBootstrapFailed:        "snek.bootstrap",
+	ProtocolRefreshSent:            "snek.bootstrap",
+	ProtocolConfirmSent:            "snek.bootstrap",
+	ProtocolConfirmIgnored:         "snek.bootstrap",
+	ProtocolDescendingChanged:      "snek.descending",
+	ProtocolDescendingRefused:      "snek.descending",
+	ProtocolPathInstalled:          "snek.table",
+	ProtocolPathRefreshed:          "snek.table",
+	ProtocolPathRejected:           "snek.table",
+	ProtocolPathRemoved:            "snek.table",
+	ProtocolConverged:              "snek",
+	ProtocolAdjacencyInconsistent:  "snek",
+	ProtocolLoadLevelChanged:       "router",
+	ProtocolInvariantViolated:      "router",
+	ProtocolDraining:               "router",
+	ProtocolPeerDeparting:          "router",
+}
+
+// StateLogName returns the name of the kind of event in the state logging
+// hierarchy.
+func (k ProtocolEventKind) StateLogName() string {
+	if category, ok := stateLogCategories[k]; ok {
+		return category + "." + string(k)
+	}
+	return string(k)
+}
+
+// stateLogger decides which events to log. It is owned by the state actor.
+type stateLogger struct {
+	sampleEvery map[ProtocolEventKind]uint64 // Kinds to log, or absent if off
+	seen        map[ProtocolEventKind]uint64 // Events of each kind so far
+}
+
+// newStateLogger works out which kinds of event to log from the options,
+// returning nil if there aren't any.
+func newStateLogger(options []RouterOptionStateLogging) *stateLogger {
+	l := &stateLogger{
+		sampleEvery: map[ProtocolEventKind]uint64{},
+		seen:        map[ProtocolEventKind]uint64{},
+	}
+	for kind := range stateLogCategories {
+		name, longest := kind.StateLogName(), -1
+		for _, o := range options {
+			if len(o.Prefix) < longest || !stateLogMatches(name, o.Prefix) {
+				continue
+			}
+			longest = len(o.Prefix)
+			if o.Off {
+				delete(l.sampleEvery, kind)
+			} else {
+				l.sampleEvery[kind] = o.SampleEvery
+			}
+		}
+	}
+	if len(l.sampleEvery) == 0 {
+		return nil
+	}
+	return l
+}
+
+// stateLogMatches returns true if the prefix is the name or one of its
+// ancestors in the hierarchy.
+func stateLogMatches(name, prefix string) bool {
+	return prefix == "" || name == prefix || strings.HasPrefix(name, prefix+".")
+}
+
+// log writes the event to the log if its kind is enabled and it is one
+// of the sampled events.
+func (l *stateLogger) log(logger types.Logger, e *ProtocolEvent) {
+	every, ok := l.sampleEvery[e.Kind]
+	if !ok {
+		return
+	}
+	seen := l.seen[e.Kind]
+	l.seen[e.Kind] = seen + 1
+	if every > 1 && seen%every != 0 {
+		return
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "State event=%s key=%s", e.Kind.StateLogName(), e.Key)
+	if e.Path != nil {
+		fmt.Fprintf(&b, " path=%s", e.Path)
+	}
+	if e.Port != 0 {
+		fmt.Fprintf(&b, " port=%d", e.Port)
+	}
+	if e.Reason != "" {
+		fmt.Fprintf(&b, " reason=%q", e.Reason)
+	}
+	if every > 1 {
+		fmt.Fprintf(&b, " sampled=1/%d count=%d", every, seen+1)
+	}
+	logger.Println(b.String())
+}
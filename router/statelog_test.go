@@ -0,0 +1,128 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type capturedLog struct {
+	sync.Mutex
+	lines []string
+}
+
+func (l *capturedLog) Println(v ...interface{}) {
+	l.Lock()
+	defer l.Unlock()
+	l.lines = append(l.lines, fmt.Sprint(v...))
+}
+
+func (l *capturedLog) Printf(format string, v ...interface{}) {
+	l.Lock()
+	defer l.Unlock()
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+func (l *capturedLog) matching(substr string) []string {
+	l.Lock()
+	defer l.Unlock()
+	var lines []string
+	for _, line := range l.lines {
+		if strings.Contains(line, substr) {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func TestStateLoggerRules(t *testing.T) {
+	if newStateLogger(nil) != nil {
+		t.Fatalf("expected no logger without any options")
+	}
+	if newStateLogger([]RouterOptionStateLogging{{Prefix: "sn"}}) != nil {
+		t.Fatalf("expected prefixes to match whole names")
+	}
+
+	l := newStateLogger([]RouterOptionStateLogging{
+		{Prefix: "snek"},
+		{Prefix: "snek.bootstrap", SampleEvery: 3},
+		{Prefix: "snek.descending", Off: true},
+		{Prefix: "tree.parent_changed"},
+	})
+	for kind, expected := range map[ProtocolEventKind]bool{
+		ProtocolPathRemoved:       true,
+		ProtocolBootstrapSent:     true,
+		ProtocolDescendingChanged: false,
+		ProtocolParentChanged:     true,
+		ProtocolRootMisbehaving:   false,
+		ProtocolLoadLevelChanged:  false,
+	} {
+		if _, ok := l.sampleEvery[kind]; ok != expected {
+			t.Fatalf("expected %s to be logged: %v", kind.StateLogName(), expected)
+		}
+	}
+
+	log := &capturedLog{}
+	for i := 0; i < 7; i++ {
+		l.log(log, &ProtocolEvent{Kind: ProtocolBootstrapSent})
+		l.log(log, &ProtocolEvent{Kind: ProtocolPathRemoved, Port: 2, Reason: "peer on port 2 disconnected"})
+		l.log(log, &ProtocolEvent{Kind: ProtocolDescendingChanged})
+	}
+	if lines := log.matching("event=snek.bootstrap.bootstrap_sent"); len(lines) != 3 {
+		t.Fatalf("expected 3 sampled bootstraps, got %d", len(lines))
+	}
+	removed := log.matching("event=snek.table.path_removed")
+	if len(removed) != 7 {
+		t.Fatalf("expected every removal to be logged, got %d", len(removed))
+	}
+	if !strings.Contains(removed[0], `port=2 reason="peer on port 2 disconnected"`) {
+		t.Fatalf("unexpected log line: %s", removed[0])
+	}
+	if lines := log.matching("snek.descending"); len(lines) != 0 {
+		t.Fatalf("expected descending changes not to be logged, got %v", lines)
+	}
+}
+
+func TestStateLoggingParentChange(t *testing.T) {
+	logA, logB := &capturedLog{}, &capturedLog{}
+	_, skA, _ := ed25519.GenerateKey(nil)
+	_, skB, _ := ed25519.GenerateKey(nil)
+	a := NewRouter(logA, skA, RouterOptionStateLogging{Prefix: "tree"}, RouterOptionProtocolHistory(-1))
+	b := NewRouter(logB, skB, RouterOptionStateLogging{Prefix: "tree"}, RouterOptionProtocolHistory(-1))
+	t.Cleanup(func() { _ = a.Close(); _ = b.Close() })
+	if errA, errB := connectTestRouters(t, a, b); errA != nil || errB != nil {
+		t.Fatalf("failed to peer: %v, %v", errA, errB)
+	}
+
+	// Whichever of the two nodes has the weaker key takes the other as its
+	// parent, even though the protocol history is off.
+	child, parent, log := a, b, logA
+	if a.PublicKey().CompareTo(b.PublicKey()) > 0 {
+		child, parent, log = b, a, logB
+	}
+	expected := fmt.Sprintf("event=tree.parent_changed key=%s port=", parent.PublicKey())
+	deadline := time.Now().Add(time.Second * 10)
+	for len(log.matching(expected)) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %s to log its parent changing to %s", child.PublicKey(), parent.PublicKey())
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+}
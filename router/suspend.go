@@ -0,0 +1,138 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+// Suspend quiesces the tree, SNEK and other maintenance timers, e.g. before
+// the operating system puts the device to sleep. The router identity and the
+// peerings are left alone. Frames that arrive while suspended are still
+// handled. Call Resume once the device wakes up.
+func (r *Router) Suspend() {
+	phony.Block(r.state, func() {
+		if r.state._suspended {
+			return
+		}
+		r.log.Println("Suspending router")
+		r.state._suspended = true
+		r.state._suspendedAt = r.clock.Now()
+		r.state._treetimer.Stop()
+		r.state._snaketimer.Stop()
+		if r.state._bandwidthTimer != nil {
+			r.state._bandwidthTimer.Stop()
+		}
+		for _, m := range r.state._maintenanceTimers() {
+			m.timer.Stop()
+		}
+	})
+}
+
+// Resume restarts maintenance after Suspend. The tree and SNEK state may
+// be stale after a sleep, so all peerings are sent a keepalive straight
+// away to find out if they're still alive, parent selection is re-run and
+// we re-announce and bootstrap immediately instead of waiting for the
+// next maintenance interval.
+func (r *Router) Resume() {
+	phony.Block(r.state, func() {
+		if !r.state._suspended {
+			return
+		}
+		r.log.Println("Resuming router after", since(r.clock, r.state._suspendedAt).Round(time.Second))
+		r.state._suspended = false
+		r.state._resume()
+	})
+}
+
+// Suspended returns true if the router is currently suspended.
+func (r *Router) Suspended() bool {
+	var suspended bool
+	phony.Block(r.state, func() {
+		suspended = r.state._suspended
+	})
+	return suspended
+}
+
+func (s *state) _resume() {
+	for _, p := range s._peers {
+		if p == nil || p == s.r.local || !p.started.Load() {
+			continue
+		}
+		// Any peering that died during the sleep will fail to write
+		// this, or will hit the read deadline, and will be torn down.
+		frame := getFrame()
+		frame.Type = types.TypeKeepalive
+		if !p.queueFor(frame.Type).push(frame) {
+			framePool.Put(frame)
+		}
+	}
+
+	// If we slept for longer than the announcement timeout then our
+	// parent's announcement will have expired, so parent selection will
+	// pick someone else or make us the root until our peers correct us.
+	s._selectNewParent()
+	s._flushTreeAnnouncements()
+
+	s._bootstrapSoon()
+	s._maintainTreeIn(s.r.timings.AnnouncementInterval)
+	s._maintainSnakeIn(0)
+	if s._bandwidthTimer != nil {
+		s._reportBandwidthIn(BWReportingInterval)
+	}
+	for _, m := range s._maintenanceTimers() {
+		m.timer.Reset(m.interval)
+	}
+}
+
+// maintenanceTimer is the timer of a maintenance loop, along with how long
+// the loop waits between runs.
+type maintenanceTimer struct {
+	timer    Timer
+	interval time.Duration
+}
+
+// _maintenanceTimers returns the timers of the maintenance loops that have
+// been started, other than tree, SNEK and bandwidth maintenance, which have
+// helpers of their own.
+func (s *state) _maintenanceTimers() []maintenanceTimer {
+	all := []maintenanceTimer{
+		{s._broadcastTimer, wakeupBroadcastInterval},
+		{s._coordsTimer, coordsCacheMaintainInterval},
+		{s._qualityTimer, s._peerQualityInterval()},
+		{s._serviceTimer, serviceAdvertisementInterval},
+		{s._continuityTimer, continuityPublishInterval},
+		{s._watchdogTimer, s.r.watchdog / 2},
+		{s._slowPeerTimer, s.r.slowPeers.checkInterval()},
+		{s._queueAlarmTimer, s.r.queueAlarm.checkInterval()},
+		{s._timeSyncTimer, s.r.timeSync},
+	}
+	if s.r.loadShedding != nil {
+		all = append(all, maintenanceTimer{s._loadShedTimer, s.r.loadShedding.interval})
+	}
+	started := all[:0]
+	for _, m := range all {
+		if m.timer != nil {
+			started = append(started, m)
+		}
+	}
+	return started
+}
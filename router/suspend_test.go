@@ -0,0 +1,77 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+)
+
+func TestSuspendResume(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	_, sk, _ := ed25519.GenerateKey(nil)
+	r := NewRouter(nil, sk,
+		RouterOptionClock{Clock: clock},
+		RouterOptionWatchdog(time.Minute),
+		RouterOptionTimeSync(time.Minute),
+	)
+	defer r.Close()
+	phony.Block(r.state, func() {})
+
+	public := r.PublicKey()
+	if r.Suspended() {
+		t.Fatalf("router should not start suspended")
+	}
+	clock.Advance(time.Minute)
+	phony.Block(r.state, func() {})
+	if r.energy.wakeups.Load() == 0 {
+		t.Fatalf("expected maintenance to run before suspending")
+	}
+
+	// Nothing wakes up while the router is suspended, however long it is
+	// suspended for.
+	r.Suspend()
+	if !r.Suspended() {
+		t.Fatalf("router should be suspended")
+	}
+	wakeups := r.energy.wakeups.Load()
+	clock.Advance(time.Hour)
+	phony.Block(r.state, func() {})
+	if woken := r.energy.wakeups.Load() - wakeups; woken != 0 {
+		t.Fatalf("expected no wakeups while suspended, got %d", woken)
+	}
+
+	// Resuming bootstraps straight away and restarts maintenance.
+	r.Resume()
+	if r.Suspended() {
+		t.Fatalf("router should have resumed")
+	}
+	phony.Block(r.state, func() {
+		if since(r.clock, r.state._lastbootstrap) < r.state.r.timings.BootstrapInterval {
+			t.Fatalf("expected a bootstrap to be due")
+		}
+	})
+	clock.Advance(time.Minute)
+	phony.Block(r.state, func() {})
+	if r.energy.wakeups.Load() == wakeups {
+		t.Fatalf("expected maintenance to run again after resuming")
+	}
+	if r.PublicKey() != public {
+		t.Fatalf("router identity should survive suspension")
+	}
+}
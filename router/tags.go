@@ -0,0 +1,113 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+// Well-known peering tags. Embedders are free to use their own tags too,
+// the router doesn't attach any meaning to them.
+const (
+	PeerTagMetered     = "metered"
+	PeerTagHighLatency = "high-latency"
+	PeerTagTrusted     = "trusted"
+)
+
+// Prefixes of the tags that multicast discovery attaches to the peerings
+// that it makes, naming the interface that the peer was found on and the
+// kind of network that it is, i.e. "interface:wlan0" and "zone:lan".
+const (
+	PeerTagInterfacePrefix = "interface:"
+	PeerTagZonePrefix      = "zone:"
+)
+
+// tagPolicies are the restrictions on peerings with each tag, set with
+// RouterOptionTagPolicy.
+type tagPolicies map[string]RouterOptionTagPolicy
+
+// neverParent returns true if a peering with the tags must never be our
+// parent.
+func (t tagPolicies) neverParent(tags PeerTags) bool {
+	for tag := range tags {
+		if t[tag].NeverParent {
+			return true
+		}
+	}
+	return false
+}
+
+// _tagLimitReached returns an error if a new peering with the given tags
+// would go over the limit for any of them.
+func (s *state) _tagLimitReached(tags PeerTags) error {
+	for tag := range tags {
+		max := s.r.tagPolicies[tag].MaxPeers
+		if max <= 0 {
+			continue
+		}
+		count := 0
+		for _, p := range s._peers {
+			if p != nil && p != s.r.local && p.started.Load() && p.tags.Has(tag) {
+				count++
+			}
+		}
+		if count >= max {
+			return fmt.Errorf("%w: already have %d peerings tagged %q", ErrPeerLimitReached, count, tag)
+		}
+	}
+	return nil
+}
+
+// PeerTags is the set of tags attached to a peering when it was connected.
+// It must not be modified after the peering has been added.
+type PeerTags map[string]struct{}
+
+// Has returns true if the tag is attached to the peering.
+func (t PeerTags) Has(tag string) bool {
+	_, ok := t[tag]
+	return ok
+}
+
+// List returns the tags in sorted order.
+func (t PeerTags) List() []string {
+	if len(t) == 0 {
+		return nil
+	}
+	tags := make([]string, 0, len(t))
+	for tag := range t {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// RouteFilterFn is called with the chosen next-hop peering for a frame
+// before the frame is sent to it. Returning true drops the frame. This
+// makes it possible to implement routing policies based on peering tags,
+// for example refusing to send bulk traffic over metered peerings.
+type RouteFilterFn func(nexthop types.PublicKey, tags PeerTags, f *types.Frame) bool
+
+// _routeFiltered returns true if the route filter wants the frame to be
+// dropped instead of being sent to the given peer. Frames for the local
+// router are never filtered.
+func (s *state) _routeFiltered(nexthop *peer, f *types.Frame) bool {
+	if s._filterRoute == nil || nexthop == nil || nexthop == s.r.local {
+		return false
+	}
+	return s._filterRoute(nexthop.public, nexthop.tags, f)
+}
@@ -0,0 +1,112 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestRouteFilterTags(t *testing.T) {
+	s := newTestState(types.PublicKey{}, systemClock{})
+	metered := &peer{tags: PeerTags{PeerTagMetered: {}, PeerTagTrusted: {}}}
+	unmetered := &peer{}
+	f := &types.Frame{Type: types.TypeTraffic}
+
+	if s._routeFiltered(metered, f) {
+		t.Fatalf("nothing should be filtered without a route filter")
+	}
+	s._filterRoute = func(_ types.PublicKey, tags PeerTags, f *types.Frame) bool {
+		return f.Type == types.TypeTraffic && tags.Has(PeerTagMetered)
+	}
+	if !s._routeFiltered(metered, f) {
+		t.Fatalf("expected traffic over metered peer to be filtered")
+	}
+	if s._routeFiltered(unmetered, f) {
+		t.Fatalf("expected traffic over unmetered peer to be allowed")
+	}
+	if s._routeFiltered(s.r.local, f) {
+		t.Fatalf("expected traffic for the local router to be allowed")
+	}
+	if tags := metered.tags.List(); len(tags) != 2 || tags[0] != PeerTagMetered || tags[1] != PeerTagTrusted {
+		t.Fatalf("unexpected tag list %v", tags)
+	}
+}
+
+func TestTagPolicies(t *testing.T) {
+	// A gets the weakest key, so that it would normally take either of the
+	// others as its parent.
+	var keys [3]ed25519.PrivateKey
+	for i := range keys {
+		_, keys[i], _ = ed25519.GenerateKey(nil)
+	}
+	sort.Slice(keys[:], func(i, j int) bool {
+		return bytes.Compare(keys[i].Public().(ed25519.PublicKey), keys[j].Public().(ed25519.PublicKey)) < 0
+	})
+	newRouter := func(sk ed25519.PrivateKey, options ...RouterOption) *Router {
+		r := NewRouter(nil, sk, options...)
+		t.Cleanup(func() { _ = r.Close() })
+		return r
+	}
+	cellular := PeerTagZonePrefix + "cellular"
+	a := newRouter(keys[0], RouterOptionTagPolicy{Tag: cellular, NeverParent: true, MaxPeers: 1})
+	b, c := newRouter(keys[1]), newRouter(keys[2])
+	connect := func(remote *Router) (error, error) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		accepted := make(chan error, 1)
+		go func() {
+			c, err := listener.Accept()
+			if err == nil {
+				_, err = remote.Connect(c)
+			}
+			accepted <- err
+		}()
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, errA := a.Connect(conn, ConnectionTag(cellular))
+		return errA, <-accepted
+	}
+
+	// A must never take B as its parent, even though B is stronger.
+	if errA, errB := connect(b); errA != nil || errB != nil {
+		t.Fatalf("failed to peer: %v, %v", errA, errB)
+	}
+	time.Sleep(time.Second)
+	if coords := a.Coords(); len(coords) != 0 {
+		t.Fatalf("expected A to stay the root, got coordinates %v", coords)
+	}
+	for _, info := range a.Peers() {
+		if info.PublicKey == b.PublicKey().String() && (len(info.Tags) != 1 || info.Tags[0] != cellular) {
+			t.Fatalf("expected the peering to be tagged, got %v", info.Tags)
+		}
+	}
+
+	if errA, _ := connect(c); !errors.Is(errA, ErrPeerLimitReached) {
+		t.Fatalf("expected the second tagged peering to be refused, got %v", errA)
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+// TapOptions controls which frames are sent to a tap.
+type TapOptions struct {
+	HeadersOnly bool              // Don't copy the frame payloads
+	SampleEvery uint64            // Only tap one in every N frames, or all frames if 0
+	Types       []types.FrameType // Only tap these frame types, or all types if empty
+}
+
+// TappedFrame is a copy of a frame that passed through the router.
+type TappedFrame struct {
+	Time        time.Time
+	Port        types.SwitchPortID // The port that the frame arrived on, or 0 if we sent it
+	PayloadSize int                // The size of the payload, even if it wasn't copied
+	Frame       *types.Frame       // A copy of the frame, which the consumer owns
+}
+
+type tapTable map[chan<- TappedFrame]*tap
+
+type tap struct {
+	options TapOptions
+	types   map[types.FrameType]struct{}
+	seen    uint64 // Frames that matched the options, for sampling
+	dropped uint64 // Frames that the consumer wasn't ready for
+}
+
+// Tap starts sending copies of the frames that pass through the router to
+// the given channel, which is useful for live debugging. Frames are dropped
+// rather than waiting if the channel isn't ready, so it should be buffered.
+// The returned function stops the tap and returns how many frames were
+// dropped because the channel was full. The channel isn't closed.
+func (r *Router) Tap(ch chan<- TappedFrame, options TapOptions) (stop func() uint64) {
+	t := &tap{
+		options: options,
+	}
+	if len(options.Types) > 0 {
+		t.types = make(map[types.FrameType]struct{}, len(options.Types))
+		for _, frameType := range options.Types {
+			t.types[frameType] = struct{}{}
+		}
+	}
+	phony.Block(r.state, func() {
+		if r.state._taps == nil {
+			r.state._taps = tapTable{}
+		}
+		r.state._taps[ch] = t
+	})
+	return func() uint64 {
+		var dropped uint64
+		phony.Block(r.state, func() {
+			if r.state._taps[ch] == t {
+				delete(r.state._taps, ch)
+			}
+			dropped = t.dropped
+		})
+		return dropped
+	}
+}
+
+// _tapFrame sends a copy of the frame to any taps that want it.
+func (s *state) _tapFrame(from *peer, f *types.Frame) {
+	now := s.r.clock.Now()
+	for ch, t := range s._taps {
+		if t.types != nil {
+			if _, ok := t.types[f.Type]; !ok {
+				continue
+			}
+		}
+		t.seen++
+		if t.options.SampleEvery > 1 && (t.seen-1)%t.options.SampleEvery != 0 {
+			continue
+		}
+		tapped := TappedFrame{
+			Time:        now,
+			Port:        from.port,
+			PayloadSize: len(f.Payload),
+			Frame: &types.Frame{
+				Version:        f.Version,
+				Type:           f.Type,
+				Extra:          f.Extra,
+				HopLimit:       f.HopLimit,
+				Destination:    append(types.Coordinates{}, f.Destination...),
+				DestinationKey: f.DestinationKey,
+				Source:         append(types.Coordinates{}, f.Source...),
+				SourceKey:      f.SourceKey,
+				Watermark:      f.Watermark,
+			},
+		}
+		if !t.options.HeadersOnly {
+			tapped.Frame.Payload = append([]byte{}, f.Payload...)
+		}
+		select {
+		case ch <- tapped:
+		default:
+			t.dropped++
+		}
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"testing"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestTap(t *testing.T) {
+	_, sk, _ := ed25519.GenerateKey(nil)
+	r := NewRouter(nil, sk)
+	t.Cleanup(func() { _ = r.Close() })
+
+	full := make(chan TappedFrame, 16)
+	sampled := make(chan TappedFrame, 16)
+	other := make(chan TappedFrame, 16)
+	stopFull := r.Tap(full, TapOptions{})
+	stopSampled := r.Tap(sampled, TapOptions{
+		HeadersOnly: true,
+		SampleEvery: 2,
+		Types:       []types.FrameType{types.TypeTraffic},
+	})
+	stopOther := r.Tap(other, TapOptions{
+		Types: []types.FrameType{types.TypeBootstrap},
+	})
+
+	payload := []byte("hello")
+	for i := 0; i < 4; i++ {
+		if _, err := r.WriteTo(payload, r.PublicKey()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stopFull()
+	stopSampled()
+	if dropped := stopOther(); dropped != 0 {
+		t.Fatalf("expected no dropped frames, got %d", dropped)
+	}
+
+	if len(full) != 4 {
+		t.Fatalf("expected 4 frames on the full tap, got %d", len(full))
+	}
+	tapped := <-full
+	if tapped.Port != 0 || tapped.Frame.Type != types.TypeTraffic || !bytes.Equal(tapped.Frame.Payload, payload) {
+		t.Fatalf("wrong frame tapped: %+v", tapped)
+	}
+	if len(sampled) != 2 {
+		t.Fatalf("expected 2 frames on the sampled tap, got %d", len(sampled))
+	}
+	tapped = <-sampled
+	if tapped.Frame.Payload != nil || tapped.PayloadSize != len(payload) {
+		t.Fatalf("expected headers only with payload size %d, got %+v", len(payload), tapped)
+	}
+	if len(other) != 0 {
+		t.Fatalf("expected no frames on the bootstrap tap, got %d", len(other))
+	}
+}
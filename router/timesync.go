@@ -0,0 +1,286 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+// Some things, i.e. expiring records or matching up metrics from different
+// nodes, need clocks that agree to within a few seconds, which the clocks
+// of phones and embedded devices often don't. With RouterOptionTimeSync, we
+// ask each of our peers for its time every so often, in the same way as
+// NTP: the request carries our time and the reply carries the peer's time
+// when the request arrived and when the reply was sent, which gives both
+// how far the peer's clock is from ours and how long the round trip took.
+// Replies are signed by the peer, so nobody else on the link can skew our
+// estimate. We keep the last few samples for each peer and use the one
+// with the shortest round trip, which is the one that queueing upset the
+// least. The median of the estimates for all of our peers is our best
+// guess of how far our clock is from everyone else's, which a few peers
+// with bad clocks can't move very far.
+//
+// This only ever gives hints. Nothing in the router depends on it, and we
+// never change the system clock. We always answer requests, whether or not
+// we ask ourselves, but no more than once a second for each peering.
+
+// clockSample is one estimate of how far a peer's clock is from ours.
+type clockSample struct {
+	offset time.Duration // How far the peer's clock is ahead of ours
+	delay  time.Duration // The round trip, less the time the peer held the request
+	at     time.Time     // When the reply arrived, by our clock
+}
+
+// peerClock is the state of time synchronisation with a peer, owned by the
+// state actor.
+type peerClock struct {
+	nonce   types.Varu64 // The nonce of our request, if one is outstanding
+	sent    time.Time    // When our request was sent, or zero if none is
+	samples [timeSyncSamples]clockSample
+	next    int       // The sample to replace next
+	replied time.Time // When we last answered a request from the peer
+}
+
+// best returns the sample with the shortest round trip that isn't too old.
+func (c *peerClock) best(now time.Time, expiry time.Duration) (clockSample, bool) {
+	var best clockSample
+	found := false
+	for _, sample := range c.samples {
+		if sample.at.IsZero() || now.Sub(sample.at) >= expiry {
+			continue
+		}
+		if !found || sample.delay < best.delay {
+			best, found = sample, true
+		}
+	}
+	return best, found
+}
+
+// PeerClockOffset is what we think of the clock of one of our peers.
+type PeerClockOffset struct {
+	Port      types.SwitchPortID
+	PublicKey types.PublicKey
+	Offset    time.Duration // How far the peer's clock is ahead of ours
+	Delay     time.Duration // The round trip of the sample that the offset came from
+	Age       time.Duration // Time since the sample was taken
+}
+
+// PeerClockOffsets returns how far the clocks of our peers are from ours,
+// for the peers that have answered time sync requests recently.
+func (r *Router) PeerClockOffsets() []PeerClockOffset {
+	var offsets []PeerClockOffset
+	phony.Block(r.state, func() {
+		offsets = r.state._peerClockOffsets()
+	})
+	return offsets
+}
+
+// ClockOffset returns how far ahead of our clock the clocks of our peers
+// are, as the median of their offsets, or false if none of our peers have
+// answered time sync requests recently.
+func (r *Router) ClockOffset() (time.Duration, bool) {
+	var offsets []PeerClockOffset
+	phony.Block(r.state, func() {
+		offsets = r.state._peerClockOffsets()
+	})
+	if len(offsets) == 0 {
+		return 0, false
+	}
+	// Count each neighbour once, using its best link.
+	best := map[types.PublicKey]PeerClockOffset{}
+	for _, o := range offsets {
+		if b, ok := best[o.PublicKey]; !ok || o.Delay < b.Delay {
+			best[o.PublicKey] = o
+		}
+	}
+	values := make([]time.Duration, 0, len(best))
+	for _, o := range best {
+		values = append(values, o.Offset)
+	}
+	sort.Slice(values, func(i, j int) bool {
+		return values[i] < values[j]
+	})
+	middle := len(values) / 2
+	if len(values)%2 == 0 {
+		return (values[middle-1] + values[middle]) / 2, true
+	}
+	return values[middle], true
+}
+
+// NetworkTime returns our clock corrected by ClockOffset, or just our clock
+// if we don't have an offset.
+func (r *Router) NetworkTime() time.Time {
+	offset, _ := r.ClockOffset()
+	return r.clock.Now().Add(offset)
+}
+
+func (s *state) _peerClockOffsets() []PeerClockOffset {
+	var offsets []PeerClockOffset
+	now := s.r.clock.Now()
+	for _, p := range s._peers {
+		if p == nil || p == s.r.local || !p.started.Load() {
+			continue
+		}
+		sample, ok := p._clock.best(now, s._timeSyncExpiry())
+		if !ok {
+			continue
+		}
+		offsets = append(offsets, PeerClockOffset{
+			Port:      p.port,
+			PublicKey: p.public,
+			Offset:    sample.offset,
+			Delay:     sample.delay,
+			Age:       now.Sub(sample.at),
+		})
+	}
+	return offsets
+}
+
+// _timeSyncExpiry returns how long samples are used for.
+func (s *state) _timeSyncExpiry() time.Duration {
+	interval := s.r.timeSync
+	if interval <= 0 {
+		interval = timeSyncInterval
+	}
+	return interval * timeSyncSamples
+}
+
+// _maintainTimeSync asks each of our peers for its time.
+func (s *state) _maintainTimeSync() {
+	if s._suspended {
+		// Resume will restart maintenance.
+		return
+	}
+	select {
+	case <-s.r.context.Done():
+		return
+	default:
+		defer s._timeSyncTimer.Reset(s.r.timeSync)
+	}
+
+	for _, p := range s._peers {
+		if p == nil || p == s.r.local || !p.started.Load() {
+			continue
+		}
+		s._sendTimeSyncRequest(p)
+	}
+}
+
+// timeSyncMillis returns the time in milliseconds since the Unix epoch.
+func timeSyncMillis(t time.Time) types.Varu64 {
+	if ms := t.UnixMilli(); ms > 0 {
+		return types.Varu64(ms)
+	}
+	return 0
+}
+
+// _sendTimeSyncRequest asks the peer for its time. Any request that is
+// still outstanding is given up on.
+func (s *state) _sendTimeSyncRequest(p *peer) {
+	var nonce [8]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return
+	}
+	now := s.r.clock.Now()
+	request := types.TimeSync{
+		// Keep the nonce within the range of a varu64.
+		Nonce:  types.Varu64(binary.BigEndian.Uint64(nonce[:]) >> 1),
+		Origin: timeSyncMillis(now),
+	}
+	send := getFrame()
+	send.Type = types.TypeTimeSync
+	if err := send.AppendPayload(&request); err != nil {
+		framePool.Put(send)
+		return
+	}
+	if !p.send(send) {
+		framePool.Put(send)
+		return
+	}
+	p._clock.nonce, p._clock.sent = request.Nonce, now
+}
+
+// _handleTimeSync is called when a peer asks us for our time or answers
+// one of our requests.
+func (s *state) _handleTimeSync(p *peer, f *types.Frame) error {
+	var sync types.TimeSync
+	if _, err := types.Decode(&sync, f.Payload); err != nil {
+		return fmt.Errorf("sync.UnmarshalBinary: %w", err)
+	}
+	now := s.r.clock.Now()
+	if !sync.Reply {
+		if !p._clock.replied.IsZero() && now.Sub(p._clock.replied) < timeSyncMinReplyInterval {
+			return nil
+		}
+		p._clock.replied = now
+		sync.Reply = true
+		sync.Receive = timeSyncMillis(now)
+		sync.Transmit = sync.Receive
+		protected, err := sync.ProtectedPayload(p.public)
+		if err != nil {
+			return fmt.Errorf("sync.ProtectedPayload: %w", err)
+		}
+		copy(sync.Signature[:], s.r.sign(protected))
+		send := getFrame()
+		send.Type = types.TypeTimeSync
+		if err := send.AppendPayload(&sync); err != nil {
+			framePool.Put(send)
+			return nil
+		}
+		if !p.send(send) {
+			framePool.Put(send)
+		}
+		return nil
+	}
+
+	if p._clock.sent.IsZero() || sync.Nonce != p._clock.nonce {
+		// We didn't ask, or this is the answer to an older request.
+		return nil
+	}
+	protected, err := sync.ProtectedPayload(s.r.public)
+	if err != nil {
+		return fmt.Errorf("sync.ProtectedPayload: %w", err)
+	}
+	if !s.r.verify(p.public[:], protected, sync.Signature[:]) {
+		return nil
+	}
+	// The origin is taken from our own record rather than the reply, in
+	// milliseconds like the peer's times.
+	t1 := int64(timeSyncMillis(p._clock.sent))
+	t2, t3 := int64(sync.Receive), int64(sync.Transmit)
+	t4 := int64(timeSyncMillis(now))
+	delay := (t4 - t1) - (t3 - t2)
+	if delay < 0 {
+		delay = 0
+	}
+	p._clock.samples[p._clock.next] = clockSample{
+		offset: time.Duration((t2-t1)+(t3-t4)) * time.Millisecond / 2,
+		delay:  time.Duration(delay) * time.Millisecond,
+		at:     now,
+	}
+	p._clock.next = (p._clock.next + 1) % timeSyncSamples
+	p._clock.sent = time.Time{}
+	return nil
+}
@@ -0,0 +1,126 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestTimeSync(t *testing.T) {
+	newState := func(clock Clock) *state {
+		_, sk, _ := ed25519.GenerateKey(nil)
+		var public types.PublicKey
+		copy(public[:], sk.Public().(ed25519.PublicKey))
+		s := newTestState(public, clock)
+		s.r.timeSync = timeSyncInterval
+		copy(s.r.private[:], sk)
+		return s
+	}
+	// B's clock is five seconds ahead of A's.
+	start := time.Unix(1_700_000_000, 0)
+	clockA, clockB := NewManualClock(start), NewManualClock(start.Add(5*time.Second))
+	a, b := newState(clockA), newState(clockB)
+	newPeer := func(s *state, remote *state) *peer {
+		return addTestPeer(s, remote.r.public)
+	}
+	toB, toA := newPeer(a, b), newPeer(b, a)
+	receive := func(p *peer) *types.Frame {
+		select {
+		case f := <-p.control.pop():
+			p.control.ack(f)
+			return f
+		default:
+			t.Fatalf("expected a frame to be sent")
+			return nil
+		}
+	}
+
+	if _, ok := a.r.ClockOffset(); ok {
+		t.Fatalf("expected no offset before any samples")
+	}
+
+	// Each leg of the round trip takes 100ms.
+	exchange := func() {
+		a._sendTimeSyncRequest(toB)
+		request := receive(toB)
+		clockA.Advance(100 * time.Millisecond)
+		clockB.Advance(100 * time.Millisecond)
+		if err := b._handleTimeSync(toA, request); err != nil {
+			t.Fatal(err)
+		}
+		reply := receive(toA)
+		clockA.Advance(100 * time.Millisecond)
+		clockB.Advance(100 * time.Millisecond)
+		if err := a._handleTimeSync(toB, reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exchange()
+	offset, ok := a.r.ClockOffset()
+	if !ok || offset != 5*time.Second {
+		t.Fatalf("expected an offset of 5s, got %s (%v)", offset, ok)
+	}
+	offsets := a.r.PeerClockOffsets()
+	if len(offsets) != 1 || offsets[0].Delay != 200*time.Millisecond {
+		t.Fatalf("expected a delay of 200ms, got %+v", offsets)
+	}
+	if now := a.r.NetworkTime(); !now.Equal(clockA.Now().Add(5 * time.Second)) {
+		t.Fatalf("expected network time to be corrected, got %s", now)
+	}
+
+	// Replies are only sent once a second on each peering.
+	a._sendTimeSyncRequest(toB)
+	if err := b._handleTimeSync(toA, receive(toB)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-toA.control.pop():
+		t.Fatalf("expected the request to be ignored")
+	default:
+	}
+
+	// A reply that has been tampered with is ignored.
+	clockB.Advance(time.Second)
+	a._sendTimeSyncRequest(toB)
+	if err := b._handleTimeSync(toA, receive(toB)); err != nil {
+		t.Fatal(err)
+	}
+	reply := receive(toA)
+	var sync types.TimeSync
+	if _, err := types.Decode(&sync, reply.Payload); err != nil {
+		t.Fatal(err)
+	}
+	sync.Receive += 60_000
+	reply.Payload = reply.Payload[:0]
+	if err := reply.AppendPayload(&sync); err != nil {
+		t.Fatal(err)
+	}
+	if err := a._handleTimeSync(toB, reply); err != nil {
+		t.Fatal(err)
+	}
+	if offset, _ := a.r.ClockOffset(); offset != 5*time.Second {
+		t.Fatalf("expected the tampered reply to be ignored, got %s", offset)
+	}
+
+	// Samples expire if the peer stops answering.
+	clockA.Advance(a._timeSyncExpiry())
+	if _, ok := a.r.ClockOffset(); ok {
+		t.Fatalf("expected the samples to have expired")
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"fmt"
+	"time"
+)
+
+// Timings control how often the router maintains the tree and SNEK, and
+// how long it waits before deciding that state has gone stale. Shorter
+// intervals make the network converge faster at the cost of more protocol
+// traffic. The expiry periods depend on how often other nodes refresh their
+// state, so every node in a network should use the same timings.
+//
+// Values outside of the safe ranges below are clamped, and a zero value
+// leaves the default in place.
+type Timings struct {
+	// How often we check whether SNEK maintenance needs to be done.
+	// Between 100ms and 10s, and no longer than the bootstrap interval.
+	SNEKMaintainInterval time.Duration
+	// How often we send bootstraps. Between 1s and 5m.
+	BootstrapInterval time.Duration
+	// How long a SNEK path lasts without being refreshed by a bootstrap.
+	// Between 2 and 10 bootstrap intervals.
+	PathExpiry time.Duration
+	// How often the root sends tree announcements. Between 10s and 2h.
+	AnnouncementInterval time.Duration
+	// How long a peer's tree announcement lasts without being refreshed.
+	// Between 1.5 and 4 announcement intervals.
+	AnnouncementTimeout time.Duration
+}
+
+// DefaultTimings returns the timings that the router uses unless they are
+// changed with RouterOptionTimings.
+func DefaultTimings() Timings {
+	return Timings{
+		SNEKMaintainInterval: virtualSnakeMaintainInterval,
+		BootstrapInterval:    virtualSnakeBootstrapInterval,
+		PathExpiry:           virtualSnakeNeighExpiryPeriod,
+		AnnouncementInterval: announcementInterval,
+		AnnouncementTimeout:  announcementTimeout,
+	}
+}
+
+// withDefaults returns the timings with any zero values replaced by the
+// defaults, and then clamped to the safe ranges. It also returns a
+// description of each value that had to be clamped.
+func (t Timings) withDefaults() (Timings, []string) {
+	defaults := DefaultTimings()
+	if t.SNEKMaintainInterval == 0 {
+		t.SNEKMaintainInterval = defaults.SNEKMaintainInterval
+	}
+	if t.BootstrapInterval == 0 {
+		t.BootstrapInterval = defaults.BootstrapInterval
+	}
+	if t.PathExpiry == 0 {
+		t.PathExpiry = t.BootstrapInterval * 2
+	}
+	if t.AnnouncementInterval == 0 {
+		t.AnnouncementInterval = defaults.AnnouncementInterval
+	}
+	if t.AnnouncementTimeout == 0 {
+		t.AnnouncementTimeout = t.AnnouncementInterval + t.AnnouncementInterval/2
+	}
+	var clamped []string
+	clamp := func(name string, v *time.Duration, min, max time.Duration) {
+		switch {
+		case *v < min:
+			clamped = append(clamped, fmt.Sprintf("%s of %s raised to %s", name, *v, min))
+			*v = min
+		case *v > max:
+			clamped = append(clamped, fmt.Sprintf("%s of %s lowered to %s", name, *v, max))
+			*v = max
+		}
+	}
+	clamp("bootstrap interval", &t.BootstrapInterval, timingsMinBootstrapInterval, timingsMaxBootstrapInterval)
+	maxMaintain := timingsMaxSNEKMaintainInterval
+	if t.BootstrapInterval < maxMaintain {
+		maxMaintain = t.BootstrapInterval
+	}
+	clamp("SNEK maintain interval", &t.SNEKMaintainInterval, timingsMinSNEKMaintainInterval, maxMaintain)
+	clamp("path expiry", &t.PathExpiry, t.BootstrapInterval*2, t.BootstrapInterval*10)
+	clamp("announcement interval", &t.AnnouncementInterval, timingsMinAnnouncementInterval, timingsMaxAnnouncementInterval)
+	clamp("announcement timeout", &t.AnnouncementTimeout, t.AnnouncementInterval+t.AnnouncementInterval/2, t.AnnouncementInterval*4)
+	return t, clamped
+}
+
+// Timings returns the timings that the router is using.
+func (r *Router) Timings() Timings {
+	return r.timings
+}
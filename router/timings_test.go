@@ -0,0 +1,83 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"crypto/ed25519"
+	"testing"
+	"time"
+)
+
+func TestTimingsWithDefaults(t *testing.T) {
+	if got, clamped := (Timings{}).withDefaults(); got != DefaultTimings() || len(clamped) != 0 {
+		t.Fatalf("expected defaults, got %+v %v", got, clamped)
+	}
+
+	// Expiry periods that aren't given follow the intervals.
+	got, clamped := Timings{
+		BootstrapInterval:    time.Second * 20,
+		AnnouncementInterval: time.Minute * 10,
+	}.withDefaults()
+	if len(clamped) != 0 {
+		t.Fatalf("nothing should have been clamped, got %v", clamped)
+	}
+	if got.PathExpiry != time.Second*40 || got.AnnouncementTimeout != time.Minute*15 {
+		t.Fatalf("expiry periods don't follow the intervals: %+v", got)
+	}
+
+	// Values outside of the safe ranges are clamped.
+	got, clamped = Timings{
+		SNEKMaintainInterval: time.Millisecond,
+		BootstrapInterval:    time.Hour,
+		PathExpiry:           time.Second,
+		AnnouncementInterval: time.Second,
+		AnnouncementTimeout:  time.Hour * 24,
+	}.withDefaults()
+	expected := Timings{
+		SNEKMaintainInterval: timingsMinSNEKMaintainInterval,
+		BootstrapInterval:    timingsMaxBootstrapInterval,
+		PathExpiry:           timingsMaxBootstrapInterval * 2,
+		AnnouncementInterval: timingsMinAnnouncementInterval,
+		AnnouncementTimeout:  timingsMinAnnouncementInterval * 4,
+	}
+	if got != expected {
+		t.Fatalf("expected %+v, got %+v", expected, got)
+	}
+	if len(clamped) != 5 {
+		t.Fatalf("expected 5 values to be clamped, got %v", clamped)
+	}
+
+	// SNEK maintenance can't run less often than we bootstrap.
+	got, _ = Timings{
+		SNEKMaintainInterval: time.Second * 10,
+		BootstrapInterval:    time.Second * 2,
+	}.withDefaults()
+	if got.SNEKMaintainInterval != time.Second*2 {
+		t.Fatalf("expected maintain interval to be clamped, got %s", got.SNEKMaintainInterval)
+	}
+}
+
+func TestRouterTimings(t *testing.T) {
+	_, sk, _ := ed25519.GenerateKey(nil)
+	r := NewRouter(nil, sk, RouterOptionTimings{BootstrapInterval: time.Second * 2})
+	defer r.Close()
+	got := r.Timings()
+	if got.BootstrapInterval != time.Second*2 || got.PathExpiry != time.Second*4 {
+		t.Fatalf("unexpected timings %+v", got)
+	}
+	if got.AnnouncementInterval != announcementInterval {
+		t.Fatalf("announcement interval should be the default, got %s", got.AnnouncementInterval)
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"fmt"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+// The router is a net.PacketConn so that the sessions can run QUIC over it,
+// but applications that only want to send the odd message to another node
+// don't need streams, encryption or retransmission, and shouldn't have to
+// deal with net.Addr and read loops to do it. WriteToKey sends a payload in
+// a traffic frame to a node by its key, and HandleTraffic passes the
+// payload of each traffic frame that arrives for us to a function.
+//
+// Delivery is best effort, exactly as for the frames that the sessions send:
+// frames can be lost, duplicated or reordered along the way, nothing is
+// acknowledged, and nothing is encrypted end-to-end, so applications must
+// protect and number their payloads themselves if they need to. Frames that
+// arrive for us wait in the same queue that ReadFrom reads from, so if the
+// handler doesn't keep up then frames are dropped once the queue is full.
+
+// TrafficHandler is called with the sender and payload of each traffic frame
+// that arrives for us. The payload is only valid until the handler returns.
+type TrafficHandler func(from types.PublicKey, payload []byte)
+
+// WriteToKey sends the payload to the node with the given public key in a
+// single traffic frame, using the interactive traffic class and preferring
+// tree routing once the node's coordinates are known. It returns once the
+// frame has been handed to the router, not when it has arrived.
+func (r *Router) WriteToKey(p []byte, key types.PublicKey) (int, error) {
+	return r.WriteToWithPreference(p, key, types.TrafficClassInteractive, types.RoutingPreferTree)
+}
+
+// HandleTraffic starts calling the handler, from a single goroutine and in
+// the order that they arrived, with each traffic frame that arrives for us
+// until the router is closed. Frames that are passed to the handler are no
+// longer returned by ReadFrom, so this can't be used on a router that the
+// sessions are running on. Datagrams still go to ReadDatagram. Only one
+// handler can be set.
+func (r *Router) HandleTraffic(handler TrafficHandler) error {
+	if r.local.traffic == nil {
+		return fmt.Errorf("router is not accepting traffic")
+	}
+	if !r.rawHandler.CAS(false, true) {
+		return fmt.Errorf("traffic handler already set")
+	}
+	go func() {
+		for {
+			select {
+			case <-r.local.context.Done():
+				return
+			case frame := <-r.local.traffic.pop():
+				r.local.traffic.ack(frame)
+				handler(frame.SourceKey, frame.Payload)
+				framePool.Put(frame)
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,80 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestHandleTraffic(t *testing.T) {
+	var routers [2]*Router
+	for i := range routers {
+		_, sk, _ := ed25519.GenerateKey(nil)
+		routers[i] = NewRouter(nil, sk)
+		r := routers[i]
+		t.Cleanup(func() { _ = r.Close() })
+	}
+	a, b := routers[0], routers[1]
+	if errA, errB := connectTestRouters(t, a, b); errA != nil || errB != nil {
+		t.Fatalf("failed to peer: %v, %v", errA, errB)
+	}
+
+	type message struct {
+		from    types.PublicKey
+		payload string
+	}
+	received := make(chan message, 16)
+	if err := b.HandleTraffic(func(from types.PublicKey, payload []byte) {
+		select {
+		case received <- message{from, string(payload)}:
+		default:
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.HandleTraffic(func(types.PublicKey, []byte) {}); err == nil {
+		t.Fatalf("expected a second handler to be refused")
+	}
+
+	deadline := time.After(time.Second * 10)
+	for {
+		if _, err := a.WriteToKey([]byte("hello"), b.PublicKey()); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case m := <-received:
+			if m.from != a.PublicKey() || m.payload != "hello" {
+				t.Fatalf("got %q from %s", m.payload, m.from)
+			}
+			return
+		case <-time.After(time.Millisecond * 100):
+		case <-deadline:
+			t.Fatalf("traffic didn't arrive")
+		}
+	}
+}
+
+func TestHandleTrafficBlackhole(t *testing.T) {
+	_, sk, _ := ed25519.GenerateKey(nil)
+	r := NewRouter(nil, sk, RouterOptionBlackhole(true))
+	t.Cleanup(func() { _ = r.Close() })
+	if err := r.HandleTraffic(func(types.PublicKey, []byte) {}); err == nil {
+		t.Fatalf("expected a handler to be refused when not accepting traffic")
+	}
+}
@@ -0,0 +1,362 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+// The forward and packet filters can do anything, but they have to be
+// written in Go. A traffic policy covers the common cases, i.e. refusing to
+// carry traffic to or from some keys, rate limiting them or moving their
+// traffic into a different class, with a list of rules that can be given
+// as a router option or read from a file. Each rule matches traffic frames
+// by prefixes of their source and destination keys, and can apply to the
+// traffic that we send, the traffic that we forward for other nodes, or
+// both. The first rule that matches a frame decides what happens to it, and
+// frames that don't match any rule are sent as normal. Traffic that is for
+// us is never affected, and neither are protocol frames, since dropping
+// those would break routing rather than moderate it.
+
+// KeyPrefix matches public keys that start with the same hex digits. The
+// zero KeyPrefix matches every key.
+type KeyPrefix struct {
+	key    types.PublicKey
+	digits int
+}
+
+// ParseKeyPrefix parses a prefix of a public key in hex, which can have an
+// odd number of digits. An empty prefix or "*" matches every key.
+func ParseKeyPrefix(s string) (KeyPrefix, error) {
+	var prefix KeyPrefix
+	if s == "" || s == "*" {
+		return prefix, nil
+	}
+	if len(s) > len(prefix.key)*2 {
+		return prefix, fmt.Errorf("key prefix %q is longer than a key", s)
+	}
+	padded := s
+	if len(padded)%2 == 1 {
+		padded += "0"
+	}
+	decoded, err := hex.DecodeString(padded)
+	if err != nil {
+		return prefix, fmt.Errorf("key prefix %q isn't hex", s)
+	}
+	copy(prefix.key[:], decoded)
+	prefix.digits = len(s)
+	return prefix, nil
+}
+
+// Matches returns true if the key starts with the prefix.
+func (p KeyPrefix) Matches(key types.PublicKey) bool {
+	whole := p.digits / 2
+	if !bytes.Equal(p.key[:whole], key[:whole]) {
+		return false
+	}
+	if p.digits%2 == 1 {
+		return p.key[whole]&0xf0 == key[whole]&0xf0
+	}
+	return true
+}
+
+func (p KeyPrefix) String() string {
+	if p.digits == 0 {
+		return "*"
+	}
+	return hex.EncodeToString(p.key[:])[:p.digits]
+}
+
+// TrafficPolicyAction is what a traffic rule does with the frames that it
+// matches.
+type TrafficPolicyAction int
+
+const (
+	TrafficAllow     TrafficPolicyAction = iota // Send the frame as normal
+	TrafficDeny                                 // Drop the frame
+	TrafficRateLimit                            // Send the frame unless the source is over its rate
+	TrafficSetClass                             // Send the frame with a different traffic class
+)
+
+func (a TrafficPolicyAction) String() string {
+	switch a {
+	case TrafficAllow:
+		return "allow"
+	case TrafficDeny:
+		return "deny"
+	case TrafficRateLimit:
+		return "ratelimit"
+	case TrafficSetClass:
+		return "class"
+	default:
+		return "unknown"
+	}
+}
+
+// TrafficPolicyScope is which traffic a traffic rule applies to.
+type TrafficPolicyScope int
+
+const (
+	TrafficScopeAll        TrafficPolicyScope = iota // Traffic that we send or forward
+	TrafficScopeOriginated                           // Traffic that we send
+	TrafficScopeForwarded                            // Traffic that we forward for other nodes
+)
+
+func (s TrafficPolicyScope) String() string {
+	switch s {
+	case TrafficScopeAll:
+		return "all"
+	case TrafficScopeOriginated:
+		return "originated"
+	case TrafficScopeForwarded:
+		return "forwarded"
+	default:
+		return "unknown"
+	}
+}
+
+// TrafficRule is one rule of a traffic policy. Rate is the number of payload
+// bytes per second that TrafficRateLimit allows for each source key that
+// matches the rule, and frames over the rate are dropped rather than
+// delayed. Class is the traffic class that TrafficSetClass gives to frames,
+// which the nodes after us on the path will use too.
+type TrafficRule struct {
+	Source      KeyPrefix
+	Destination KeyPrefix
+	Scope       TrafficPolicyScope
+	Action      TrafficPolicyAction
+	Rate        uint64
+	Class       types.TrafficClass
+}
+
+func (t TrafficRule) String() string {
+	s := fmt.Sprintf("%s src=%s dst=%s scope=%s", t.Action, t.Source, t.Destination, t.Scope)
+	switch t.Action {
+	case TrafficRateLimit:
+		s += fmt.Sprintf(" rate=%d", t.Rate)
+	case TrafficSetClass:
+		s += fmt.Sprintf(" class=%s", t.Class)
+	}
+	return s
+}
+
+func (t *TrafficRule) matches(originated bool, f *types.Frame) bool {
+	switch {
+	case t.Scope == TrafficScopeOriginated && !originated:
+		return false
+	case t.Scope == TrafficScopeForwarded && originated:
+		return false
+	}
+	return t.Source.Matches(f.SourceKey) && t.Destination.Matches(f.DestinationKey)
+}
+
+// ParseTrafficPolicy reads traffic rules, one on each line, in the form
+// returned by TrafficRule.String, i.e.
+//
+//	deny src=ab12
+//	ratelimit dst=cd scope=forwarded rate=65536
+//	class src=ef class=bulk
+//
+// Keys that aren't given match every key, and the scope defaults to all.
+// Blank lines and lines starting with # are ignored.
+func ParseTrafficPolicy(r io.Reader) ([]TrafficRule, error) {
+	var rules []TrafficRule
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		rule, err := parseTrafficRule(fields)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("scanner.Scan: %w", err)
+	}
+	return rules, nil
+}
+
+func parseTrafficRule(fields []string) (TrafficRule, error) {
+	var rule TrafficRule
+	switch fields[0] {
+	case "allow":
+		rule.Action = TrafficAllow
+	case "deny":
+		rule.Action = TrafficDeny
+	case "ratelimit":
+		rule.Action = TrafficRateLimit
+	case "class":
+		rule.Action = TrafficSetClass
+	default:
+		return rule, fmt.Errorf("unknown action %q", fields[0])
+	}
+	var rate, class bool
+	for _, field := range fields[1:] {
+		name, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return rule, fmt.Errorf("%q isn't in the form name=value", field)
+		}
+		var err error
+		switch name {
+		case "src":
+			rule.Source, err = ParseKeyPrefix(value)
+		case "dst":
+			rule.Destination, err = ParseKeyPrefix(value)
+		case "scope":
+			switch value {
+			case "all":
+				rule.Scope = TrafficScopeAll
+			case "originated":
+				rule.Scope = TrafficScopeOriginated
+			case "forwarded":
+				rule.Scope = TrafficScopeForwarded
+			default:
+				err = fmt.Errorf("unknown scope %q", value)
+			}
+		case "rate":
+			rule.Rate, err = strconv.ParseUint(value, 10, 64)
+			rate = err == nil
+		case "class":
+			err = fmt.Errorf("unknown traffic class %q", value)
+			for c := types.TrafficClass(0); c < types.TrafficClasses; c++ {
+				if c.String() == value {
+					rule.Class, err, class = c, nil, true
+				}
+			}
+		default:
+			err = fmt.Errorf("unknown field %q", name)
+		}
+		if err != nil {
+			return rule, err
+		}
+	}
+	switch {
+	case rule.Action == TrafficRateLimit && !rate:
+		return rule, fmt.Errorf("ratelimit needs a rate")
+	case rule.Action == TrafficSetClass && !class:
+		return rule, fmt.Errorf("class needs a class")
+	}
+	return rule, nil
+}
+
+// trafficPolicyLimit identifies the rate limit for one source key under
+// one rule.
+type trafficPolicyLimit struct {
+	rule   int
+	source types.PublicKey
+}
+
+type trafficPolicy struct {
+	rules  []TrafficRule
+	limits map[trafficPolicyLimit]*forwardLimiter
+}
+
+func newTrafficPolicy(rules []TrafficRule) *trafficPolicy {
+	if len(rules) == 0 {
+		return nil
+	}
+	return &trafficPolicy{
+		rules:  append([]TrafficRule(nil), rules...),
+		limits: map[trafficPolicyLimit]*forwardLimiter{},
+	}
+}
+
+// SetTrafficPolicy replaces the traffic policy with the given rules. Passing
+// no rules removes the policy.
+func (r *Router) SetTrafficPolicy(rules []TrafficRule) {
+	policy := newTrafficPolicy(rules)
+	phony.Block(r.state, func() {
+		r.state._trafficPolicy = policy
+	})
+}
+
+// TrafficPolicy returns the rules of the traffic policy.
+func (r *Router) TrafficPolicy() []TrafficRule {
+	var rules []TrafficRule
+	phony.Block(r.state, func() {
+		if policy := r.state._trafficPolicy; policy != nil {
+			rules = append(rules, policy.rules...)
+		}
+	})
+	return rules
+}
+
+// _trafficPolicyDrops applies the traffic policy to a traffic frame that we
+// are sending or forwarding, which might change its class, and returns true
+// if the frame should be dropped.
+func (s *state) _trafficPolicyDrops(from *peer, f *types.Frame) bool {
+	policy := s._trafficPolicy
+	if policy == nil || f.Type != types.TypeTraffic {
+		return false
+	}
+	originated := from == s.r.local
+	for i := range policy.rules {
+		rule := &policy.rules[i]
+		if !rule.matches(originated, f) {
+			continue
+		}
+		switch rule.Action {
+		case TrafficDeny:
+			return true
+		case TrafficRateLimit:
+			return !policy.allow(i, rule.Rate, f, s.r.clock.Now())
+		case TrafficSetClass:
+			f.SetTrafficClass(rule.Class)
+		}
+		return false
+	}
+	return false
+}
+
+func (p *trafficPolicy) allow(rule int, rate uint64, f *types.Frame, now time.Time) bool {
+	key := trafficPolicyLimit{rule, f.SourceKey}
+	limiter, ok := p.limits[key]
+	if !ok {
+		if len(p.limits) >= forwardLimiterMax {
+			for k, v := range p.limits {
+				if now.Sub(v.last) >= forwardLimiterIdle {
+					delete(p.limits, k)
+				}
+			}
+		}
+		if len(p.limits) >= forwardLimiterMax {
+			// We can't keep track of any more sources, so be strict
+			// rather than letting new sources through unlimited.
+			return false
+		}
+		limiter = &forwardLimiter{
+			tokens: forwardLimiterBurst(rate),
+			last:   now,
+		}
+		p.limits[key] = limiter
+	}
+	return limiter.allow(rate, len(f.Payload), now)
+}
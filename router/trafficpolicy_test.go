@@ -0,0 +1,173 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestKeyPrefix(t *testing.T) {
+	key := types.PublicKey{0xab, 0xcd}
+	for prefix, matches := range map[string]bool{
+		"":     true,
+		"*":    true,
+		"a":    true,
+		"ab":   true,
+		"abc":  true,
+		"abcd": true,
+		"abce": false,
+		"b":    false,
+		"ac":   false,
+	} {
+		p, err := ParseKeyPrefix(prefix)
+		if err != nil {
+			t.Fatalf("failed to parse %q: %s", prefix, err)
+		}
+		if p.Matches(key) != matches {
+			t.Fatalf("expected %q matching to be %v", prefix, matches)
+		}
+		if prefix != "" && p.String() != prefix {
+			t.Fatalf("expected %q to be printed the same, got %q", prefix, p.String())
+		}
+	}
+	for _, prefix := range []string{"xy", strings.Repeat("0", 65)} {
+		if _, err := ParseKeyPrefix(prefix); err == nil {
+			t.Fatalf("expected %q to be refused", prefix)
+		}
+	}
+}
+
+func TestParseTrafficPolicy(t *testing.T) {
+	rules, err := ParseTrafficPolicy(strings.NewReader(`
+# Moderation
+deny src=ab12
+ratelimit dst=cd scope=forwarded rate=65536
+
+class src=ef class=bulk
+allow
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"deny src=ab12 dst=* scope=all",
+		"ratelimit src=* dst=cd scope=forwarded rate=65536",
+		"class src=ef dst=* scope=all class=bulk",
+		"allow src=* dst=* scope=all",
+	}
+	if len(rules) != len(expected) {
+		t.Fatalf("expected %d rules, got %v", len(expected), rules)
+	}
+	for i, rule := range rules {
+		if rule.String() != expected[i] {
+			t.Fatalf("expected rule %d to be %q, got %q", i, expected[i], rule.String())
+		}
+		// Each rule can be read back in the form that it is printed in.
+		again, err := ParseTrafficPolicy(strings.NewReader(rule.String()))
+		if err != nil || len(again) != 1 || again[0] != rule {
+			t.Fatalf("expected %q to parse to the same rule, got %v, %v", rule.String(), again, err)
+		}
+	}
+
+	for _, line := range []string{
+		"drop src=ab",
+		"deny src",
+		"deny src=xy",
+		"deny colour=blue",
+		"deny scope=sideways",
+		"ratelimit src=ab",
+		"class src=ab class=urgent",
+	} {
+		if _, err := ParseTrafficPolicy(strings.NewReader(line)); err == nil {
+			t.Fatalf("expected %q to be refused", line)
+		}
+	}
+}
+
+func TestTrafficPolicy(t *testing.T) {
+	rules, err := ParseTrafficPolicy(strings.NewReader(`
+deny src=a1
+allow src=a2 scope=originated
+deny src=a2
+ratelimit dst=b rate=1000
+class dst=c class=background
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := NewManualClock(time.Unix(1000, 0))
+	s := newTestState(types.PublicKey{}, clock)
+	s._trafficPolicy = newTrafficPolicy(rules)
+	local, remote := s.r.local, &peer{port: 1}
+	frame := func(source, destination byte, size int) *types.Frame {
+		f := &types.Frame{
+			Type:           types.TypeTraffic,
+			SourceKey:      types.PublicKey{source},
+			DestinationKey: types.PublicKey{destination},
+			Payload:        make([]byte, size),
+		}
+		f.SetTrafficClass(types.TrafficClassInteractive)
+		return f
+	}
+
+	for _, tc := range []struct {
+		name    string
+		from    *peer
+		source  byte
+		dropped bool
+	}{
+		{"denied source", remote, 0xa1, true},
+		{"denied source sent by us", local, 0xa1, true},
+		{"source only allowed from us", local, 0xa2, false},
+		{"source only allowed from us forwarded", remote, 0xa2, true},
+		{"unmatched source", remote, 0xd0, false},
+	} {
+		if s._trafficPolicyDrops(tc.from, frame(tc.source, 0xd0, 10)) != tc.dropped {
+			t.Fatalf("expected %s to be dropped: %v", tc.name, tc.dropped)
+		}
+	}
+
+	// Protocol frames are never dropped.
+	f := frame(0xa1, 0xd0, 10)
+	f.Type = types.TypeEchoRequest
+	if s._trafficPolicyDrops(remote, f) {
+		t.Fatalf("expected protocol frames to be left alone")
+	}
+
+	// The rate limit is for each source, and allows a maximum-sized payload
+	// to burst through.
+	if s._trafficPolicyDrops(remote, frame(0xd0, 0xb0, types.MaxPayloadSize)) {
+		t.Fatalf("expected the first frame to fit within the burst")
+	}
+	if !s._trafficPolicyDrops(remote, frame(0xd0, 0xb0, 10)) {
+		t.Fatalf("expected the source to be over its rate")
+	}
+	if s._trafficPolicyDrops(remote, frame(0xd1, 0xb0, 10)) {
+		t.Fatalf("expected a different source to have its own rate")
+	}
+	clock.Advance(time.Second)
+	if s._trafficPolicyDrops(remote, frame(0xd0, 0xb0, 1000)) {
+		t.Fatalf("expected the source to be allowed a second's worth again")
+	}
+
+	f = frame(0xd0, 0xc0, 10)
+	if s._trafficPolicyDrops(remote, f) || f.TrafficClass() != types.TrafficClassBackground {
+		t.Fatalf("expected the frame to be moved into the background class, got %s", f.TrafficClass())
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Peerings normally run over a net.Conn, but some platforms only offer a
+// way to send and receive datagrams, like a WebRTC data channel or a radio
+// API. A FrameTransport is the least that such a transport has to provide,
+// and NewTransportConn turns it into a net.Conn that can be given to
+// Connect. Each write to the connection is sent as a single datagram and
+// datagrams are read back as a stream, so the datagrams have to arrive
+// reliably and in order, as they do on a reliable WebRTC data channel. If
+// the transport also implements LinkMTU then writes are split to fit.
+
+// FrameTransport sends and receives datagrams on behalf of a peering.
+type FrameTransport interface {
+	// SendFrame sends the datagram to the remote side. The transport must
+	// not hold onto the slice after returning.
+	SendFrame(b []byte) error
+	// RecvFrame waits for a datagram from the remote side.
+	RecvFrame() ([]byte, error)
+	// Close closes the transport, which must make RecvFrame return.
+	Close() error
+}
+
+// transportAddr is the address of both ends of a transport connection.
+type transportAddr struct{}
+
+func (transportAddr) Network() string { return "transport" }
+func (transportAddr) String() string  { return "transport" }
+
+type transportRecv struct {
+	b   []byte
+	err error
+}
+
+// transportConn reads from and writes to a FrameTransport.
+type transportConn struct {
+	transport FrameTransport
+	recv      chan transportRecv
+	pending   []byte // Left over from the last datagram, only used by Read
+	recvErr   error  // Returned by RecvFrame, only used by Read
+	closed    chan struct{}
+	closeOnce sync.Once
+	mutex     sync.Mutex
+	readTimer *time.Timer   // protected by mutex
+	readDone  chan struct{} // protected by mutex
+	writeBy   time.Time     // protected by mutex
+}
+
+// NewTransportConn returns a connection that runs over the transport, for
+// use with Connect.
+func NewTransportConn(transport FrameTransport) net.Conn {
+	c := &transportConn{
+		transport: transport,
+		recv:      make(chan transportRecv),
+		closed:    make(chan struct{}),
+		readDone:  make(chan struct{}),
+	}
+	go c.receive()
+	return c
+}
+
+// receive passes datagrams from the transport to Read, so that reads can
+// give up when the read deadline passes.
+func (c *transportConn) receive() {
+	for {
+		b, err := c.transport.RecvFrame()
+		select {
+		case c.recv <- transportRecv{b, err}:
+		case <-c.closed:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *transportConn) Read(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		if c.recvErr != nil {
+			return 0, c.recvErr
+		}
+		c.mutex.Lock()
+		deadline := c.readDone
+		c.mutex.Unlock()
+		select {
+		case r := <-c.recv:
+			c.pending, c.recvErr = r.b, r.err
+		case <-deadline:
+			return 0, os.ErrDeadlineExceeded
+		case <-c.closed:
+			return 0, net.ErrClosed
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *transportConn) Write(b []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	c.mutex.Lock()
+	writeBy := c.writeBy
+	c.mutex.Unlock()
+	if !writeBy.IsZero() && !time.Now().Before(writeBy) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	if err := c.transport.SendFrame(b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *transportConn) Close() error {
+	err := net.ErrClosed
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		err = c.transport.Close()
+	})
+	return err
+}
+
+func (c *transportConn) LocalAddr() net.Addr  { return transportAddr{} }
+func (c *transportConn) RemoteAddr() net.Addr { return transportAddr{} }
+
+func (c *transportConn) SetDeadline(t time.Time) error {
+	_ = c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *transportConn) SetReadDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.readTimer != nil {
+		c.readTimer.Stop()
+		c.readTimer = nil
+	}
+	// A new channel is made for every deadline, so that a timer that
+	// fires late can't expire the deadline that replaced it.
+	done := make(chan struct{})
+	c.readDone = done
+	switch {
+	case t.IsZero():
+	case !time.Now().Before(t):
+		close(done)
+	default:
+		c.readTimer = time.AfterFunc(time.Until(t), func() {
+			close(done)
+		})
+	}
+	return nil
+}
+
+// SetWriteDeadline only stops writes from starting after the deadline,
+// since a write that is already in the transport can't be interrupted.
+func (c *transportConn) SetWriteDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.writeBy = t
+	return nil
+}
+
+// LinkMTU returns the MTU of the transport, if it has one.
+func (c *transportConn) LinkMTU() int {
+	if l, ok := c.transport.(LinkMTU); ok {
+		return l.LinkMTU()
+	}
+	return 0
+}
@@ -0,0 +1,143 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/atomic"
+)
+
+// testTransport is one end of an in-memory datagram link.
+type testTransport struct {
+	send      chan<- []byte
+	recv      <-chan []byte
+	mtu       int
+	largest   *atomic.Int64
+	closed    chan struct{}
+	closeOnce *sync.Once
+}
+
+func newTestTransports(mtu int) (*testTransport, *testTransport) {
+	ab, ba := make(chan []byte, 1024), make(chan []byte, 1024)
+	closed, closeOnce := make(chan struct{}), &sync.Once{}
+	largest := &atomic.Int64{}
+	return &testTransport{ab, ba, mtu, largest, closed, closeOnce},
+		&testTransport{ba, ab, mtu, largest, closed, closeOnce}
+}
+
+func (t *testTransport) SendFrame(b []byte) error {
+	if int64(len(b)) > t.largest.Load() {
+		t.largest.Store(int64(len(b)))
+	}
+	select {
+	case t.send <- append([]byte{}, b...):
+		return nil
+	case <-t.closed:
+		return net.ErrClosed
+	}
+}
+
+func (t *testTransport) RecvFrame() ([]byte, error) {
+	select {
+	case b := <-t.recv:
+		return b, nil
+	case <-t.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (t *testTransport) Close() error {
+	t.closeOnce.Do(func() { close(t.closed) })
+	return nil
+}
+
+type testTransportMTU struct {
+	*testTransport
+}
+
+func (t testTransportMTU) LinkMTU() int {
+	return t.mtu
+}
+
+func TestTransportConnPeering(t *testing.T) {
+	for _, mtu := range []int{0, 64} {
+		var routers [2]*Router
+		for i := range routers {
+			_, sk, _ := ed25519.GenerateKey(nil)
+			routers[i] = NewRouter(nil, sk)
+			r := routers[i]
+			t.Cleanup(func() { _ = r.Close() })
+		}
+		a, b := routers[0], routers[1]
+		ta, tb := newTestTransports(mtu)
+		var connA, connB net.Conn
+		if mtu > 0 {
+			connA, connB = NewTransportConn(testTransportMTU{ta}), NewTransportConn(testTransportMTU{tb})
+		} else {
+			connA, connB = NewTransportConn(ta), NewTransportConn(tb)
+		}
+
+		accepted := make(chan error, 1)
+		go func() {
+			_, err := a.Connect(connA)
+			accepted <- err
+		}()
+		if _, err := b.Connect(connB); err != nil {
+			t.Fatalf("failed to peer over the transport: %v", err)
+		}
+		if err := <-accepted; err != nil {
+			t.Fatalf("failed to peer over the transport: %v", err)
+		}
+
+		// The tree can only converge if frames are getting through in
+		// both directions.
+		deadline := time.Now().Add(time.Second * 10)
+		for a.Coords().String() == "[]" && b.Coords().String() == "[]" {
+			if time.Now().After(deadline) {
+				t.Fatalf("tree didn't converge over the transport")
+			}
+			time.Sleep(time.Millisecond * 50)
+		}
+		if largest := ta.largest.Load(); mtu > 0 && largest > int64(mtu) {
+			t.Fatalf("sent a %d byte datagram with an MTU of %d", largest, mtu)
+		}
+	}
+}
+
+func TestTransportConnDeadlines(t *testing.T) {
+	ta, _ := newTestTransports(0)
+	conn := NewTransportConn(ta)
+
+	_ = conn.SetReadDeadline(time.Now().Add(time.Millisecond * 50))
+	if _, err := conn.Read(make([]byte, 8)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected the read deadline to pass, got %v", err)
+	}
+	_ = conn.SetWriteDeadline(time.Now().Add(-time.Second))
+	if _, err := conn.Write([]byte{1}); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected the write deadline to have passed, got %v", err)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	_ = conn.Close()
+	if _, err := conn.Read(make([]byte, 8)); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected the connection to be closed, got %v", err)
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+// The shape of the spanning tree says a lot about the health of the
+// network. A long chain of ancestors makes every path long, several roots
+// in a short time mean that the network is partitioning and merging, and a
+// high rate of announcements or parent changes means that the tree isn't
+// settling down. We keep recent tree announcements and changes for a window
+// of time so that these can be reported.
+
+// treeStatsWindow is how far back the tree statistics look.
+const treeStatsWindow = time.Minute * 10
+
+// treeStatsMaxObservations limits how many observations of each kind are
+// kept, so that a storm of announcements can't use up memory.
+const treeStatsMaxObservations = 4096
+
+// TreeStats describes the shape of the spanning tree and how much it has
+// changed recently. Everything but the depth covers the last Window.
+type TreeStats struct {
+	Depth            int           `json:"depth"`              // The length of our own coordinates
+	MaxDepth         int           `json:"max_depth"`          // The longest ancestor chain seen in an announcement
+	Roots            int           `json:"roots"`              // Distinct root keys seen in announcements
+	Announcements    int           `json:"announcements"`      // Announcements received from our peers
+	Suppressed       int           `json:"suppressed"`         // Announcements replaced by later ones by damping
+	ParentChanges    int           `json:"parent_changes"`     // Times that our parent changed
+	RootChanges      int           `json:"root_changes"`       // Times that our root changed
+	AnnouncementRate float64       `json:"announcement_rate"`  // Announcements received per minute
+	ParentChangeRate float64       `json:"parent_change_rate"` // Parent changes per minute
+	RootChangeRate   float64       `json:"root_change_rate"`   // Root changes per minute
+	Window           time.Duration `json:"window"`             // How far back the statistics look
+}
+
+type treeObservation struct {
+	at    time.Time
+	root  types.PublicKey
+	depth int
+}
+
+type treeStatsTracker struct {
+	started       time.Time
+	root          types.PublicKey   // The root when we last checked
+	announcements []treeObservation // Oldest first
+	suppressed    []time.Time       // Oldest first
+	parentChanges []time.Time       // Oldest first
+	rootChanges   []time.Time       // Oldest first
+}
+
+// prune forgets observations that are older than the window.
+func (t *treeStatsTracker) prune(now time.Time) {
+	cutoff := now.Add(-treeStatsWindow)
+	i := 0
+	for i < len(t.announcements) && t.announcements[i].at.Before(cutoff) {
+		i++
+	}
+	t.announcements = t.announcements[i:]
+	t.suppressed = pruneTimes(t.suppressed, cutoff)
+	t.parentChanges = pruneTimes(t.parentChanges, cutoff)
+	t.rootChanges = pruneTimes(t.rootChanges, cutoff)
+}
+
+func pruneTimes(times []time.Time, cutoff time.Time) []time.Time {
+	i := 0
+	for i < len(times) && times[i].Before(cutoff) {
+		i++
+	}
+	return times[i:]
+}
+
+func appendTime(times []time.Time, at time.Time) []time.Time {
+	if len(times) >= treeStatsMaxObservations {
+		times = times[1:]
+	}
+	return append(times, at)
+}
+
+func (t *treeStatsTracker) stats(now time.Time, depth int) TreeStats {
+	t.prune(now)
+	stats := TreeStats{
+		Depth:         depth,
+		Announcements: len(t.announcements),
+		Suppressed:    len(t.suppressed),
+		ParentChanges: len(t.parentChanges),
+		RootChanges:   len(t.rootChanges),
+		Window:        treeStatsWindow,
+	}
+	roots := map[types.PublicKey]struct{}{}
+	for _, a := range t.announcements {
+		roots[a.root] = struct{}{}
+		if a.depth > stats.MaxDepth {
+			stats.MaxDepth = a.depth
+		}
+	}
+	stats.Roots = len(roots)
+
+	// If we haven't been running for the whole window then the rates are
+	// worked out over the time that we have been running.
+	minutes := treeStatsWindow.Minutes()
+	if running := now.Sub(t.started); running < treeStatsWindow {
+		minutes = running.Minutes()
+	}
+	if minutes > 0 {
+		stats.AnnouncementRate = float64(stats.Announcements) / minutes
+		stats.ParentChangeRate = float64(stats.ParentChanges) / minutes
+		stats.RootChangeRate = float64(stats.RootChanges) / minutes
+	}
+	return stats
+}
+
+// _observeAnnouncement records a tree announcement from one of our peers.
+func (s *state) _observeAnnouncement(ann *types.SwitchAnnouncement) {
+	t := &s._treeStats
+	now := s.r.clock.Now()
+	t.prune(now)
+	if len(t.announcements) >= treeStatsMaxObservations {
+		t.announcements = t.announcements[1:]
+	}
+	t.announcements = append(t.announcements, treeObservation{
+		at:    now,
+		root:  ann.RootPublicKey,
+		depth: len(ann.Signatures),
+	})
+}
+
+// _observeSuppressedAnnouncement records that a tree announcement from one
+// of our peers was replaced by a later one without being handled.
+func (s *state) _observeSuppressedAnnouncement() {
+	s._treeStats.suppressed = appendTime(s._treeStats.suppressed, s.r.clock.Now())
+}
+
+// _observeParentChange records that our parent changed.
+func (s *state) _observeParentChange() {
+	s._treeStats.parentChanges = appendTime(s._treeStats.parentChanges, s.r.clock.Now())
+}
+
+// _observeRoot records a change of root, if there has been one since we
+// last checked.
+func (s *state) _observeRoot() {
+	root := s._rootAnnouncement().Root
+	if root.RootPublicKey != s._treeStats.root {
+		s._treeStats.root = root.RootPublicKey
+		s._treeStats.rootChanges = appendTime(s._treeStats.rootChanges, s.r.clock.Now())
+		s._watchRootAdopted(root)
+	}
+}
+
+// TreeStats returns statistics about the shape of the spanning tree and how
+// much it has changed recently.
+func (r *Router) TreeStats() TreeStats {
+	var stats TreeStats
+	phony.Block(r.state, func() {
+		stats = r.state._treeStats.stats(r.clock.Now(), len(r.state._coords()))
+	})
+	return stats
+}
@@ -0,0 +1,77 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !minimal
+// +build !minimal
+
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestTreeStatsWindow(t *testing.T) {
+	start := time.Now()
+	tracker := treeStatsTracker{started: start}
+	var rootA, rootB types.PublicKey
+	rootA[0], rootB[0] = 1, 2
+	tracker.announcements = []treeObservation{
+		{at: start, root: rootA, depth: 7},
+		{at: start.Add(time.Minute * 5), root: rootA, depth: 2},
+		{at: start.Add(time.Minute * 6), root: rootB, depth: 3},
+	}
+	tracker.parentChanges = []time.Time{start, start.Add(time.Minute * 6)}
+	tracker.rootChanges = []time.Time{start.Add(time.Minute * 6)}
+
+	stats := tracker.stats(start.Add(time.Minute*6), 4)
+	if stats.Depth != 4 || stats.MaxDepth != 7 || stats.Roots != 2 || stats.Announcements != 3 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	if stats.AnnouncementRate != 0.5 || stats.RootChangeRate != 1.0/6 {
+		t.Fatalf("expected rates over the time running, got %+v", stats)
+	}
+
+	// Once the window has passed, the oldest observations are forgotten.
+	stats = tracker.stats(start.Add(time.Minute*12), 4)
+	if stats.MaxDepth != 3 || stats.Roots != 2 || stats.Announcements != 2 || stats.ParentChanges != 1 || stats.RootChanges != 1 {
+		t.Fatalf("unexpected stats after the window: %+v", stats)
+	}
+	if stats.AnnouncementRate != 0.2 {
+		t.Fatalf("expected rates over the window, got %+v", stats)
+	}
+}
+
+func TestTreeStatsObserved(t *testing.T) {
+	low, high := newTestRouterPair(t)
+	deadline := time.Now().Add(time.Second * 10)
+	for len(low.Coords()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("tree didn't converge")
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	stats := low.TreeStats()
+	if stats.Depth != 1 || stats.MaxDepth < 1 || stats.Roots != 1 || stats.Announcements == 0 {
+		t.Fatalf("unexpected stats for the child: %+v", stats)
+	}
+	if stats.ParentChanges != 1 || stats.RootChanges != 1 {
+		t.Fatalf("expected one parent and root change, got %+v", stats)
+	}
+	if stats := high.TreeStats(); stats.Depth != 0 || stats.ParentChanges != 0 || stats.RootChanges != 0 {
+		t.Fatalf("unexpected stats for the root: %+v", stats)
+	}
+}
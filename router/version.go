@@ -17,11 +17,32 @@ package router
 const (
 	capabilityLengthenedRootInterval = 1 << iota
 	capabilityCryptographicSetups
-	capabilitySetupACKs // nolint:deadcode,varcheck
+	capabilitySetupACKs
 	capabilityDedupedCoordinateInfo
 	capabilitySoftState
 	capabilityHybridRouting
+	capabilityPeeringCertificates
+	capabilityAggregateSignatures
 )
 
 const ourVersion uint8 = 1
 const ourCapabilities uint32 = capabilityLengthenedRootInterval | capabilityCryptographicSetups | capabilityDedupedCoordinateInfo | capabilitySoftState | capabilityHybridRouting
+
+// capabilities returns the capabilities that we advertise in the peering
+// handshake. Nodes in a closed network also advertise that they require
+// peering certificates, so that they will refuse to peer with open nodes,
+// and vice versa, before any certificates are exchanged. Likewise nodes that
+// aggregate root announcement signatures can only peer with each other.
+func (r *Router) capabilities() uint32 {
+	if r.wireProfile != nil && r.wireProfile.pinned {
+		return r.wireProfile.capabilities
+	}
+	capabilities := ourCapabilities
+	if r.authority != nil {
+		capabilities |= capabilityPeeringCertificates
+	}
+	if r.aggregate != nil {
+		capabilities |= capabilityAggregateSignatures
+	}
+	return capabilities
+}
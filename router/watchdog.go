@@ -0,0 +1,85 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/pinecone/router/events"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+// The watchdog looks for peerings that have wedged. A writer that hasn't
+// written anything for the watchdog timeout even though there are frames
+// waiting in its queues is stuck, either in a write that will never finish
+// or because it was never woken up. A reader on a peering with keepalives
+// should hear something at least once per keepalive interval, and the read
+// deadline should fire long before the watchdog timeout if it doesn't, so a
+// reader that has been quiet for longer than that is stuck too. In either
+// case traffic to the port would otherwise be silently blackholed, so the
+// peering is torn down, which gives it a chance to reconnect.
+
+// _maintainWatchdog checks all of our peerings for stuck readers or writers.
+func (s *state) _maintainWatchdog() {
+	if s._suspended {
+		// Resume will restart maintenance.
+		return
+	}
+	select {
+	case <-s.r.context.Done():
+		return
+	default:
+		defer s._watchdogTimer.Reset(s.r.watchdog / 2)
+	}
+
+	now := s.r.clock.Now()
+	for _, p := range s._peers {
+		if p == nil || p == s.r.local || !p.started.Load() {
+			continue
+		}
+		if reason := p.stalled(now, s.r.watchdog); reason != "" {
+			s.r.log.Println("Watchdog resetting peer", p.public.String(), "on port", p.port, "because", reason)
+			s.r._publish(events.PeerStalled{
+				Port:   p.port,
+				PeerID: p.public.String(),
+				Reason: reason,
+			})
+			p.stop(fmt.Errorf("watchdog: %s", reason))
+		}
+	}
+}
+
+// stalled returns a description of why the peering appears to be stuck at
+// the given time, or an empty string if it looks healthy.
+func (p *peer) stalled(now time.Time, timeout time.Duration) string {
+	queued := p.proto.queueStats().Depth + p.traffic.queueStats().Depth
+	if p.control != nil {
+		queued += p.control.queueStats().Depth
+	}
+	if queued > 0 {
+		if since := now.Sub(p.lastWrite.Load()); since > timeout {
+			return fmt.Sprintf("writer hasn't drained %d queued frames for %s", queued, since.Round(time.Second))
+		}
+	}
+	if p.keepalives {
+		if since := now.Sub(p.lastRead.Load()); since > timeout {
+			return fmt.Sprintf("reader hasn't received a frame for %s", since.Round(time.Second))
+		}
+	}
+	return ""
+}
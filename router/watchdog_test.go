@@ -0,0 +1,54 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestPeerStalled(t *testing.T) {
+	p := &peer{
+		proto:      newFIFOQueue(fifoNoMax, nil, nil),
+		traffic:    newFairFIFOQueue(1, nil, nil),
+		keepalives: true,
+	}
+	now := time.Unix(1000, 0)
+	p.lastRead.Store(now)
+	p.lastWrite.Store(now.Add(-time.Minute))
+
+	if reason := p.stalled(now, time.Second*10); reason != "" {
+		t.Fatalf("idle writer with empty queues shouldn't be stalled: %s", reason)
+	}
+	p.traffic.push(&types.Frame{})
+	if reason := p.stalled(now, time.Second*10); reason == "" {
+		t.Fatalf("writer with queued frames should be stalled")
+	}
+	p.lastWrite.Store(now)
+	if reason := p.stalled(now, time.Second*10); reason != "" {
+		t.Fatalf("writer that is draining shouldn't be stalled: %s", reason)
+	}
+
+	p.lastRead.Store(now.Add(-time.Minute))
+	if reason := p.stalled(now, time.Second*10); reason == "" {
+		t.Fatalf("quiet reader should be stalled when keepalives are enabled")
+	}
+	p.keepalives = false
+	if reason := p.stalled(now, time.Second*10); reason != "" {
+		t.Fatalf("quiet reader shouldn't be stalled without keepalives: %s", reason)
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sessions
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Bandwidth is estimated by sampling the throughput of each session once
+// every bandwidthSampleInterval and taking the highest rate seen over the
+// last bandwidthWindow samples, in the same spirit as the max filter used
+// by BBR. The estimate can only be as high as the rate at which the
+// application has actually been sending, so an idle or lightly used session
+// will underestimate what the path could carry.
+
+// bandwidthSampleInterval is how often the throughput of a session
+// is sampled.
+const bandwidthSampleInterval = time.Second
+
+// bandwidthWindow is the number of samples that the estimate is
+// taken from.
+const bandwidthWindow = 10
+
+// bandwidthEstimator tracks the throughput in one direction of a session.
+type bandwidthEstimator struct {
+	mutex   sync.Mutex
+	last    uint64                   // byte count at the last sample
+	samples [bandwidthWindow]float64 // bytes per second
+	next    int                      // next sample slot to overwrite
+}
+
+// sample records the throughput since the last sample, given the total
+// number of bytes transferred so far.
+func (b *bandwidthEstimator) sample(total uint64, elapsed time.Duration) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if elapsed <= 0 || total < b.last {
+		return
+	}
+	b.samples[b.next] = float64(total-b.last) / elapsed.Seconds()
+	b.next = (b.next + 1) % bandwidthWindow
+	b.last = total
+}
+
+// estimate returns the estimated bandwidth in bytes per second.
+func (b *bandwidthEstimator) estimate() uint64 {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	var best float64
+	for _, rate := range b.samples {
+		if rate > best {
+			best = rate
+		}
+	}
+	return uint64(best)
+}
+
+// measureBandwidth samples the throughput of the session until it is
+// closed.
+func (s *activeSession) measureBandwidth(ctx context.Context) {
+	ticker := time.NewTicker(bandwidthSampleInterval)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			elapsed := now.Sub(last)
+			last = now
+			s.sendRate.sample(s.bytesSent.Load(), elapsed)
+			s.recvRate.sample(s.bytesReceived.Load(), elapsed)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sessions
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBandwidthEstimator(t *testing.T) {
+	var b bandwidthEstimator
+	if estimate := b.estimate(); estimate != 0 {
+		t.Fatalf("expected no estimate without samples, got %d", estimate)
+	}
+
+	// The estimate is the highest rate in the window, not the latest.
+	b.sample(1000, time.Second)
+	b.sample(5000, time.Second)
+	b.sample(5500, 500*time.Millisecond)
+	if estimate := b.estimate(); estimate != 4000 {
+		t.Fatalf("expected 4000 bytes per second, got %d", estimate)
+	}
+
+	// Samples that can't be right are ignored rather than skewing the
+	// estimate, and don't take up a slot in the window.
+	b.sample(100, time.Second)
+	b.sample(1_000_000, 0)
+	if estimate := b.estimate(); estimate != 4000 {
+		t.Fatalf("expected 4000 bytes per second, got %d", estimate)
+	}
+
+	// Once enough slower samples have been taken, the fast one falls out
+	// of the window.
+	total := uint64(5500)
+	for i := 0; i < bandwidthWindow; i++ {
+		total += 100
+		b.sample(total, time.Second)
+	}
+	if estimate := b.estimate(); estimate != 100 {
+		t.Fatalf("expected 100 bytes per second, got %d", estimate)
+	}
+}
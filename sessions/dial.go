@@ -63,7 +63,7 @@ retry:
 	if !ok {
 		session.Lock()
 		tlsConfig := &tls.Config{
-			NextProtos:         []string{s.proto},
+			NextProtos:         protocolNames(s.proto, s.s.features),
 			InsecureSkipVerify: true,
 			GetClientCertificate: func(info *tls.CertificateRequestInfo) (*tls.Certificate, error) {
 				return s.s.tlsCert, nil
@@ -87,7 +87,25 @@ retry:
 			},
 		}
 
-		session.Connection, err = quic.DialContext(ctx, s.s.r, addr, addrstr, tlsConfig, s.s.quicConfig)
+		var first quic.Stream
+		if s.s.early != nil {
+			tlsConfig.ClientSessionCache = s.tickets
+			var early quic.EarlyConnection
+			if early, err = quic.DialEarlyContext(ctx, s.s.conn, addr, addrstr, tlsConfig, s.dialConfigFor(pk)); err == nil {
+				// If the handshake hasn't finished then we're sending 0-RTT
+				// data, which the remote side only allows with early data.
+				session.Connection = early
+				state := early.ConnectionState().TLS
+				if _, features := parseProtocol(state.NegotiatedProtocol); !state.HandshakeComplete || features&featureEarlyData != 0 {
+					if first, err = s.s.early.openFirst(early); err != nil {
+						_ = early.CloseWithError(0, err.Error())
+						session.Connection = nil
+					}
+				}
+			}
+		} else {
+			session.Connection, err = quic.DialContext(ctx, s.s.conn, addr, addrstr, tlsConfig, s.dialConfigFor(pk))
+		}
 		session.Unlock()
 		if err != nil {
 			if err == context.DeadlineExceeded {
@@ -96,7 +114,10 @@ retry:
 			return nil, fmt.Errorf("quic.Dial: %w", err)
 		}
 
-		go s.sessionlistener(session)
+		go s.sessionlistener(session, false)
+		if first != nil {
+			return &Stream{first, session}, nil
+		}
 	} else {
 		session.RLock()
 		defer session.RUnlock()
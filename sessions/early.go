@@ -0,0 +1,195 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sessions
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// Opening a session normally takes one overlay round trip for the QUIC
+// handshake before the first stream can carry anything, and another for
+// the application to get an answer. With early data, we keep the session
+// tickets that nodes give us, so that the next time we dial one of them
+// the first stream is sent along with the handshake as 0-RTT data and the
+// remote side can answer it straight away.
+//
+// 0-RTT data can be captured and replayed by anyone on the path, since it
+// is sent before the handshake has proven that the sender is live. To stop
+// a replay from being acted on, the first stream of every session that we
+// dial starts with a token made of the time and some random bytes. Early
+// data is a feature that is agreed in the handshake, see features.go, and
+// the token is only sent if the handshake agrees on it, or if we're
+// resuming, since only nodes with early data allow 0-RTT. The remote side
+// only hands a 0-RTT stream to the application straight away if the token
+// is recent and it hasn't seen it before. Otherwise it waits for the
+// handshake to complete, which a replay never does, so a node whose clock
+// is out doesn't lose anything other than the time saved.
+//
+// If the remote side has forgotten the ticket, i.e. because it restarted,
+// then it rejects the 0-RTT data. The stream that was dialled returns
+// quic.Err0RTTRejected, and dialling again does a full handshake.
+
+// defaultEarlyDataWindow is used when early data is enabled without a
+// replay window.
+const defaultEarlyDataWindow = time.Second * 10
+
+// earlyDataProtocolSuffix is added to the name of a protocol when early
+// data is enabled.
+const earlyDataProtocolSuffix = "+early"
+
+// earlyDataTickets is how many session tickets we keep for each protocol.
+// Tickets are kept separately for each protocol, since 0-RTT is refused if
+// the protocol is different to the one that the ticket was issued for.
+const earlyDataTickets = 256
+
+// earlyDataMaxTokens is how many tokens we remember. If more than this
+// arrive within the replay window then the rest wait for the handshake.
+const earlyDataMaxTokens = 4096
+
+// earlyDataTokenTimeout is how long we wait for the token at the start of
+// the first stream of a session.
+const earlyDataTokenTimeout = time.Second * 10
+
+const earlyTokenSize = 16
+
+// earlyToken is the time that the session was dialled, in nanoseconds
+// since the Unix epoch, followed by random bytes.
+type earlyToken [earlyTokenSize]byte
+
+var errEarlyDataReplayed = errors.New("early data was replayed")
+
+type earlyData struct {
+	window time.Duration
+	mutex  sync.Mutex
+	seen   map[earlyToken]time.Time // protected by mutex
+}
+
+func newEarlyData(window time.Duration) *earlyData {
+	if window <= 0 {
+		window = defaultEarlyDataWindow
+	}
+	return &earlyData{
+		window: window,
+		seen:   map[earlyToken]time.Time{},
+	}
+}
+
+// newToken returns a token for a session that we are dialling now.
+func (e *earlyData) newToken(now time.Time) (earlyToken, error) {
+	var token earlyToken
+	binary.BigEndian.PutUint64(token[:8], uint64(now.UnixNano()))
+	if _, err := rand.Read(token[8:]); err != nil {
+		return token, fmt.Errorf("rand.Read: %w", err)
+	}
+	return token, nil
+}
+
+// fresh returns true if the token was made within the replay window and
+// we haven't seen it before, remembering it if so.
+func (e *earlyData) fresh(token earlyToken, now time.Time) bool {
+	made := time.Unix(0, int64(binary.BigEndian.Uint64(token[:8])))
+	if made.Before(now.Add(-e.window)) || made.After(now.Add(e.window)) {
+		return false
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if _, ok := e.seen[token]; ok {
+		return false
+	}
+	if len(e.seen) >= earlyDataMaxTokens {
+		for t, expires := range e.seen {
+			if now.After(expires) {
+				delete(e.seen, t)
+			}
+		}
+		if len(e.seen) >= earlyDataMaxTokens {
+			return false
+		}
+	}
+	// A token can't pass the time check once it's more than a window
+	// old, so it only needs remembering until then.
+	e.seen[token] = made.Add(e.window)
+	return true
+}
+
+// openFirst opens the first stream of a session that we dialled, which
+// goes out with the handshake if we have a ticket for the remote node.
+func (e *earlyData) openFirst(conn quic.EarlyConnection) (quic.Stream, error) {
+	token, err := e.newToken(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	stream, err := conn.OpenStream()
+	if err != nil {
+		return nil, fmt.Errorf("connection.OpenStream: %w", err)
+	}
+	if _, err := stream.Write(token[:]); err != nil {
+		stream.CancelRead(0)
+		_ = stream.Close()
+		return nil, fmt.Errorf("stream.Write: %w", err)
+	}
+	return stream, nil
+}
+
+// acceptFirst accepts the first stream of a session that the remote side
+// dialled and reads the token from the start of it. If the stream came as
+// 0-RTT data with a token that isn't fresh then it waits for the handshake
+// to complete before returning the stream, and fails if it doesn't.
+func (e *earlyData) acceptFirst(ctx context.Context, session *activeSession) (quic.Stream, error) {
+	stream, err := session.AcceptStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var token earlyToken
+	_ = stream.SetReadDeadline(time.Now().Add(earlyDataTokenTimeout))
+	if _, err = io.ReadFull(stream, token[:]); err != nil {
+		stream.CancelRead(0)
+		return nil, fmt.Errorf("io.ReadFull: %w", err)
+	}
+	_ = stream.SetReadDeadline(time.Time{})
+	if !session.ConnectionState().TLS.Used0RTT || e.fresh(token, time.Now()) {
+		return stream, nil
+	}
+	if early, ok := session.Connection.(quic.EarlyConnection); ok {
+		select {
+		case <-early.HandshakeComplete().Done():
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if !session.ConnectionState().TLS.HandshakeComplete {
+		stream.CancelRead(0)
+		return nil, errEarlyDataReplayed
+	}
+	return stream, nil
+}
+
+// earlyListener makes a quic.EarlyListener look like a quic.Listener.
+type earlyListener struct {
+	quic.EarlyListener
+}
+
+func (l earlyListener) Accept(ctx context.Context) (quic.Connection, error) {
+	return l.EarlyListener.Accept(ctx)
+}
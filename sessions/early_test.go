@@ -0,0 +1,231 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sessions
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// earlyTestStream is the first stream of a session in tests. Reads come
+// from r and writes go to written.
+type earlyTestStream struct {
+	quic.Stream
+	r         io.Reader
+	written   bytes.Buffer
+	writeErr  error
+	cancelled bool
+	closed    bool
+}
+
+func (s *earlyTestStream) Read(p []byte) (int, error) {
+	return s.r.Read(p)
+}
+
+func (s *earlyTestStream) Write(p []byte) (int, error) {
+	if s.writeErr != nil {
+		return 0, s.writeErr
+	}
+	return s.written.Write(p)
+}
+
+func (s *earlyTestStream) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+func (s *earlyTestStream) CancelRead(quic.StreamErrorCode) {
+	s.cancelled = true
+}
+
+func (s *earlyTestStream) Close() error {
+	s.closed = true
+	return nil
+}
+
+// earlyTestConn is a session that hands out the one stream. The handshake
+// completes when handshake is done, and state is what the TLS handshake
+// reports.
+type earlyTestConn struct {
+	quic.EarlyConnection
+	stream    *earlyTestStream
+	state     quic.ConnectionState
+	handshake context.Context
+}
+
+func (c *earlyTestConn) AcceptStream(context.Context) (quic.Stream, error) {
+	return c.stream, nil
+}
+
+func (c *earlyTestConn) OpenStream() (quic.Stream, error) {
+	return c.stream, nil
+}
+
+func (c *earlyTestConn) ConnectionState() quic.ConnectionState {
+	return c.state
+}
+
+func (c *earlyTestConn) HandshakeComplete() context.Context {
+	return c.handshake
+}
+
+func TestEarlyDataFreshness(t *testing.T) {
+	e := newEarlyData(0)
+	if e.window != defaultEarlyDataWindow {
+		t.Fatalf("expected the default window, got %s", e.window)
+	}
+	now := time.Now()
+	token, err := e.newToken(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other, _ := e.newToken(now); other == token {
+		t.Fatalf("expected tokens made at the same time to differ")
+	}
+
+	// A token is only fresh the first time that it's seen.
+	if !e.fresh(token, now) {
+		t.Fatalf("expected a new token to be fresh")
+	}
+	if e.fresh(token, now.Add(time.Second)) {
+		t.Fatalf("expected a replayed token not to be fresh")
+	}
+
+	// Tokens from outside the window either way aren't fresh.
+	for _, made := range []time.Time{now.Add(-e.window - time.Second), now.Add(e.window + time.Second)} {
+		token, _ := e.newToken(made)
+		if e.fresh(token, now) {
+			t.Fatalf("expected a token made %s from now not to be fresh", made.Sub(now))
+		}
+	}
+
+	// Once the replay cache is full, new tokens aren't fresh until the
+	// ones in it are too old to pass the time check anyway.
+	e = newEarlyData(time.Second)
+	for i := 0; i < earlyDataMaxTokens; i++ {
+		var token earlyToken
+		binary.BigEndian.PutUint64(token[:8], uint64(now.UnixNano()))
+		binary.BigEndian.PutUint64(token[8:], uint64(i))
+		if !e.fresh(token, now) {
+			t.Fatalf("expected token %d to be fresh", i)
+		}
+	}
+	if token, _ := e.newToken(now); e.fresh(token, now) {
+		t.Fatalf("expected no tokens to be accepted while the cache is full")
+	}
+	later := now.Add(e.window + time.Millisecond)
+	if token, _ := e.newToken(later); !e.fresh(token, later) {
+		t.Fatalf("expected a token to be accepted once the old ones expired")
+	}
+	if len(e.seen) != 1 {
+		t.Fatalf("expected the expired tokens to be forgotten, got %d", len(e.seen))
+	}
+}
+
+func TestEarlyDataOpenFirst(t *testing.T) {
+	e := newEarlyData(0)
+	stream := &earlyTestStream{}
+	if _, err := e.openFirst(&earlyTestConn{stream: stream}); err != nil {
+		t.Fatal(err)
+	}
+	var token earlyToken
+	if n := copy(token[:], stream.written.Bytes()); n != earlyTokenSize || stream.written.Len() != earlyTokenSize {
+		t.Fatalf("expected just the token to be written, got %d bytes", stream.written.Len())
+	}
+	if !e.fresh(token, time.Now()) {
+		t.Fatalf("expected the token that was sent to be fresh")
+	}
+
+	// A stream that can't carry the token isn't handed back.
+	stream = &earlyTestStream{writeErr: quic.Err0RTTRejected}
+	if _, err := e.openFirst(&earlyTestConn{stream: stream}); !errors.Is(err, quic.Err0RTTRejected) {
+		t.Fatalf("expected the 0-RTT rejection, got %v", err)
+	}
+	if !stream.cancelled || !stream.closed {
+		t.Fatalf("expected the stream to be cancelled and closed")
+	}
+}
+
+func TestEarlyDataAcceptFirst(t *testing.T) {
+	e := newEarlyData(0)
+	complete, completed := context.WithCancel(context.Background())
+	completed()
+	pending, stop := context.WithCancel(context.Background())
+	defer stop()
+
+	// accept sends the token on a stream and accepts it, with the handshake
+	// completing when handshake is done.
+	accept := func(ctx context.Context, token earlyToken, used0RTT bool, handshake context.Context) (*earlyTestStream, error) {
+		stream := &earlyTestStream{r: bytes.NewReader(token[:])}
+		conn := &earlyTestConn{stream: stream, handshake: handshake}
+		conn.state.TLS.Used0RTT = used0RTT
+		conn.state.TLS.HandshakeComplete = handshake == complete
+		_, err := e.acceptFirst(ctx, &activeSession{Connection: conn})
+		return stream, err
+	}
+
+	// A fresh token in 0-RTT data gets the stream straight away, even if
+	// the handshake never completes.
+	token, _ := e.newToken(time.Now())
+	if _, err := accept(context.Background(), token, true, pending); err != nil {
+		t.Fatalf("expected a fresh token to be accepted, got %v", err)
+	}
+
+	// The same token again has to wait for the handshake, which a replay
+	// never completes.
+	stream, err := accept(context.Background(), token, true, complete)
+	if err != nil {
+		t.Fatalf("expected the stream once the handshake completed, got %v", err)
+	}
+	if stream.cancelled {
+		t.Fatalf("expected the stream not to be cancelled")
+	}
+	failed, fail := context.WithCancel(context.Background())
+	fail()
+	if stream, err = accept(context.Background(), token, true, failed); !errors.Is(err, errEarlyDataReplayed) {
+		t.Fatalf("expected the replay to be refused, got %v", err)
+	}
+	if !stream.cancelled {
+		t.Fatalf("expected the replayed stream to be cancelled")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = accept(ctx, token, true, pending); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected to stop waiting for the handshake, got %v", err)
+	}
+
+	// Outside of 0-RTT the handshake is already done, so the token doesn't
+	// matter.
+	stale, _ := e.newToken(time.Now().Add(-e.window * 2))
+	if _, err = accept(context.Background(), stale, false, complete); err != nil {
+		t.Fatalf("expected a 1-RTT stream to be accepted, got %v", err)
+	}
+
+	// A stream that ends before the token has been read is refused.
+	stream = &earlyTestStream{r: bytes.NewReader(token[:4])}
+	conn := &earlyTestConn{stream: stream, handshake: complete}
+	if _, err = e.acceptFirst(context.Background(), &activeSession{Connection: conn}); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("expected a short token to be refused, got %v", err)
+	}
+	if !stream.cancelled {
+		t.Fatalf("expected the stream to be cancelled")
+	}
+}
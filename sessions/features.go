@@ -0,0 +1,116 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sessions
+
+import (
+	"math/bits"
+	"sort"
+	"strings"
+
+	"github.com/quic-go/quic-go"
+)
+
+// Some session options change what is sent over the wire, so they can only
+// be used with remote nodes that enable them too. Each protocol is offered
+// in the TLS handshake once for every combination of the features that we
+// have enabled, with a suffix for each feature and the most features
+// first. The TLS server picks the first of its own offers that the client
+// also made, which is the protocol with exactly the features that both
+// sides have. Since the handshake is authenticated, nobody else on the path
+// can turn a feature on or off for a session.
+
+// sessionFeatures is a set of features that change the wire format.
+type sessionFeatures uint8
+
+const (
+	featureEarlyData sessionFeatures = 1 << iota
+	featureReorder
+	featureFEC
+)
+
+// featureSuffixes are added to the name of a protocol, in this order, for
+// the features that are in use.
+var featureSuffixes = [...]struct {
+	feature sessionFeatures
+	suffix  string
+}{
+	{featureEarlyData, earlyDataProtocolSuffix},
+	{featureReorder, "+reorder"},
+	{featureFEC, "+fec"},
+}
+
+// protocolNames returns the names to offer for the protocol in the TLS
+// handshake, for every combination of the features, most features first.
+func protocolNames(proto string, features sessionFeatures) []string {
+	var subsets []sessionFeatures
+	for subset := features; ; subset = (subset - 1) & features {
+		subsets = append(subsets, subset)
+		if subset == 0 {
+			break
+		}
+	}
+	sort.SliceStable(subsets, func(i, j int) bool {
+		return bits.OnesCount8(uint8(subsets[i])) > bits.OnesCount8(uint8(subsets[j]))
+	})
+	names := make([]string, 0, len(subsets))
+	for _, subset := range subsets {
+		name := proto
+		for _, f := range featureSuffixes {
+			if subset&f.feature != 0 {
+				name += f.suffix
+			}
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// parseProtocol splits the name of a protocol that was agreed in the TLS
+// handshake into the protocol and the features.
+func parseProtocol(name string) (string, sessionFeatures) {
+	var features sessionFeatures
+	for i := len(featureSuffixes) - 1; i >= 0; i-- {
+		if f := featureSuffixes[i]; strings.HasSuffix(name, f.suffix) {
+			name = strings.TrimSuffix(name, f.suffix)
+			features |= f.feature
+		}
+	}
+	return name, features
+}
+
+// useFeatures turns on the features that were agreed for a session for as
+// long as the session stays open. It returns once the session is closed.
+func (s *Sessions) useFeatures(conn quic.Connection) {
+	ctx := conn.Context()
+	if early, ok := conn.(quic.EarlyConnection); ok {
+		// 0-RTT data is sent before the handshake has been authenticated.
+		select {
+		case <-early.HandshakeComplete().Done():
+		case <-ctx.Done():
+			return
+		}
+	}
+	_, features := parseProtocol(conn.ConnectionState().TLS.NegotiatedProtocol)
+	addr := conn.RemoteAddr()
+	if s.reorder != nil && features&featureReorder != 0 {
+		s.reorder.sessionOpened(addr)
+		defer s.reorder.sessionClosed(addr)
+	}
+	if s.fec != nil && features&featureFEC != 0 {
+		s.fec.sessionOpened(addr)
+		defer s.fec.sessionClosed(addr)
+	}
+	<-ctx.Done()
+}
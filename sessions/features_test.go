@@ -0,0 +1,62 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sessions
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestProtocolFeatures(t *testing.T) {
+	if names := protocolNames("chat", 0); !reflect.DeepEqual(names, []string{"chat"}) {
+		t.Fatalf("expected just the protocol without features, got %v", names)
+	}
+	names := protocolNames("chat", featureEarlyData|featureReorder)
+	expected := []string{"chat+early+reorder", "chat+reorder", "chat+early", "chat"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("expected %v, got %v", expected, names)
+	}
+	for i, name := range names {
+		proto, features := parseProtocol(name)
+		if proto != "chat" {
+			t.Fatalf("expected the chat protocol, got %q", proto)
+		}
+		if again := protocolNames(proto, features); again[0] != names[i] {
+			t.Fatalf("expected %q to round trip, got %q", names[i], again[0])
+		}
+	}
+
+	// The TLS server picks the first of its own protocols that the client
+	// offered, which should be the features that both sides have.
+	negotiate := func(server, client sessionFeatures) sessionFeatures {
+		for _, s := range protocolNames("chat", server) {
+			for _, c := range protocolNames("chat", client) {
+				if s == c {
+					_, features := parseProtocol(s)
+					return features
+				}
+			}
+		}
+		t.Fatalf("expected the plain protocol to be agreed at least")
+		return 0
+	}
+	for server := sessionFeatures(0); server <= featureEarlyData|featureReorder|featureFEC; server++ {
+		for client := sessionFeatures(0); client <= featureEarlyData|featureReorder|featureFEC; client++ {
+			if got := negotiate(server, client); got != server&client {
+				t.Fatalf("expected %b to be agreed between %b and %b, got %b", server&client, server, client, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,349 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sessions
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+// The first byte of each packet sent by the FEC layer says what it is. As
+// with reorderMarker, QUIC always sets the fixed bit (0x40) in the first
+// byte of its packets, so these can't be mistaken for bare QUIC packets.
+const (
+	fecMarkerData   = 0x02 // group, index, payload
+	fecMarkerParity = 0x03 // group, count, XOR of the lengths and payloads
+)
+
+// fecHeaderLength is the marker byte, the 64-bit group number and either
+// the index of the packet in the group or the number of packets in it.
+const fecHeaderLength = 10
+
+// fecFlushDelay is how long we will wait for a group to fill up before
+// sending the parity packet for the packets that we have so far.
+const fecFlushDelay = time.Millisecond * 20
+
+// fecGroupHistory is how many recent groups from each remote node we will
+// keep around in case their parity packet turns up.
+const fecGroupHistory = 32
+
+// FECStats contains the forward error correction statistics for a remote
+// node.
+type FECStats struct {
+	Enabled    bool   // Has FEC been negotiated with the remote node?
+	ParitySent uint64 // Parity packets that we have sent
+	Recovered  uint64 // Lost packets that we rebuilt from parity packets
+}
+
+// fecConn wraps the packet connection that QUIC uses so that, for every
+// group of packets sent to a remote node, an extra parity packet is sent
+// which is the XOR of the packets in the group. If any one packet in a group
+// is lost then it can be rebuilt from the others and the parity packet,
+// rather than waiting for QUIC to notice and retransmit it. This costs one
+// packet in every group but avoids retransmission storms on lossy links.
+// FEC is only used once a session with the remote node has agreed to use
+// it, see features.go. Data packets are unwrapped whether or not we have
+// such a session yet, since the remote side might finish the handshake
+// first, but we only keep the state needed to rebuild lost packets for
+// remote nodes that we have agreed to use FEC with.
+type fecConn struct {
+	net.PacketConn
+	size    int
+	packets chan datagram
+	mutex   sync.Mutex
+	peers   map[string]*fecPeer // by address
+}
+
+// fecPeer is the state for a remote node that we have sessions with that
+// agreed to use FEC.
+type fecPeer struct {
+	sessions int // open sessions that use FEC
+	encoder  fecEncoder
+	decoder  fecDecoder
+	stats    FECStats
+}
+
+type fecEncoder struct {
+	group  uint64      // the current group number
+	count  uint8       // packets in the current group so far
+	parity []byte      // XOR of the packets in the current group so far
+	timer  *time.Timer // sends the parity for a partial group
+}
+
+type fecDecoder struct {
+	groups map[uint64]*fecGroup
+	newest uint64
+}
+
+type fecGroup struct {
+	received  map[uint8]struct{} // which packets have arrived
+	xor       []byte             // XOR of the packets that have arrived
+	parity    []byte             // the parity packet, if it has arrived
+	count     uint8              // how many packets are in the group
+	recovered bool               // have we already rebuilt the lost packet
+}
+
+func newFECConn(ctx context.Context, conn net.PacketConn, size int) *fecConn {
+	c := &fecConn{
+		PacketConn: conn,
+		size:       size,
+		packets:    make(chan datagram, reorderBacklog),
+		peers:      map[string]*fecPeer{},
+	}
+	go c.reader(ctx)
+	return c
+}
+
+// xorInto XORs the length and contents of the packet into the accumulator,
+// growing it as needed, and returns the accumulator.
+func xorInto(acc []byte, p []byte) []byte {
+	if need := 2 + len(p); len(acc) < need {
+		acc = append(acc, make([]byte, need-len(acc))...)
+	}
+	acc[0] ^= byte(len(p) >> 8)
+	acc[1] ^= byte(len(p))
+	for i, b := range p {
+		acc[2+i] ^= b
+	}
+	return acc
+}
+
+// sessionOpened starts using FEC with the remote node for a session that
+// agreed to use it. It must be matched by a call to sessionClosed when the
+// session ends.
+func (c *fecConn) sessionOpened(addr net.Addr) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	p, ok := c.peers[addr.String()]
+	if !ok {
+		p = &fecPeer{
+			decoder: fecDecoder{groups: map[uint64]*fecGroup{}},
+		}
+		c.peers[addr.String()] = p
+	}
+	p.sessions++
+}
+
+// sessionClosed stops using FEC with the remote node once none of our
+// sessions with it use FEC, and throws away the state for it.
+func (c *fecConn) sessionClosed(addr net.Addr) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	key := addr.String()
+	p, ok := c.peers[key]
+	if !ok {
+		return
+	}
+	if p.sessions--; p.sessions > 0 {
+		return
+	}
+	if p.encoder.timer != nil {
+		p.encoder.timer.Stop()
+	}
+	delete(c.peers, key)
+}
+
+func (c *fecConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.mutex.Lock()
+	peer, ok := c.peers[addr.String()]
+	if !ok {
+		c.mutex.Unlock()
+		return c.PacketConn.WriteTo(p, addr)
+	}
+	e := &peer.encoder
+	buf := make([]byte, fecHeaderLength+len(p))
+	buf[0] = fecMarkerData
+	binary.BigEndian.PutUint64(buf[1:9], e.group)
+	buf[9] = e.count
+	copy(buf[fecHeaderLength:], p)
+	e.parity = xorInto(e.parity, p)
+	e.count++
+	var parity []byte
+	switch {
+	case int(e.count) >= c.size:
+		parity = c._parity(peer)
+	case e.timer == nil:
+		group := e.group
+		e.timer = time.AfterFunc(fecFlushDelay, func() {
+			c.mutex.Lock()
+			var parity []byte
+			if c.peers[addr.String()] == peer && e.group == group {
+				parity = c._parity(peer)
+			}
+			c.mutex.Unlock()
+			c.sendParity(parity, addr)
+		})
+	}
+	c.mutex.Unlock()
+	if _, err := c.PacketConn.WriteTo(buf, addr); err != nil {
+		return 0, err
+	}
+	c.sendParity(parity, addr)
+	return len(p), nil
+}
+
+// _parity returns the parity packet for the current group, if there is
+// anything in it, and starts a new group. It must be called with the mutex
+// held.
+func (c *fecConn) _parity(peer *fecPeer) []byte {
+	e := &peer.encoder
+	if e.timer != nil {
+		e.timer.Stop()
+		e.timer = nil
+	}
+	if e.count == 0 {
+		return nil
+	}
+	buf := make([]byte, fecHeaderLength+len(e.parity))
+	buf[0] = fecMarkerParity
+	binary.BigEndian.PutUint64(buf[1:9], e.group)
+	buf[9] = e.count
+	copy(buf[fecHeaderLength:], e.parity)
+	e.group++
+	e.count = 0
+	e.parity = e.parity[:0]
+	peer.stats.ParitySent++
+	return buf
+}
+
+// sendParity sends a parity packet, if there is one. It must be called
+// without the mutex held.
+func (c *fecConn) sendParity(parity []byte, addr net.Addr) {
+	if parity != nil {
+		_, _ = c.PacketConn.WriteTo(parity, addr)
+	}
+}
+
+func (c *fecConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	packet, ok := <-c.packets
+	if !ok {
+		return 0, nil, fmt.Errorf("connection closed")
+	}
+	return copy(p, packet.data), packet.addr, nil
+}
+
+// reader reads packets from the underlying connection, strips the FEC
+// headers and rebuilds lost packets until the context is cancelled. It is
+// the only thing that hands packets to QUIC, and does so without the mutex
+// held, since QUIC might not be ready for them yet.
+func (c *fecConn) reader(ctx context.Context) {
+	defer close(c.packets)
+	buf := make([]byte, types.MaxPayloadSize)
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(buf)
+		if err != nil || ctx.Err() != nil {
+			return
+		}
+		data := append([]byte(nil), buf[:n]...)
+		if n < fecHeaderLength || (data[0] != fecMarkerData && data[0] != fecMarkerParity) {
+			c.packets <- datagram{data, addr}
+			continue
+		}
+		c.mutex.Lock()
+		delivered, recovered := c._receive(data, addr)
+		c.mutex.Unlock()
+		for _, payload := range [][]byte{delivered, recovered} {
+			if payload != nil {
+				c.packets <- datagram{payload, addr}
+			}
+		}
+	}
+}
+
+// _receive handles a data or parity packet from the remote node. It returns
+// the payload of a data packet, and any lost packet that could be rebuilt.
+// It must be called with the mutex held.
+func (c *fecConn) _receive(data []byte, addr net.Addr) (delivered, recovered []byte) {
+	number, index := binary.BigEndian.Uint64(data[1:9]), data[9]
+	payload := data[fecHeaderLength:]
+	if data[0] == fecMarkerData {
+		delivered = payload
+	}
+	p, ok := c.peers[addr.String()]
+	if !ok {
+		// We haven't agreed to use FEC with the remote node, or not yet,
+		// so there's nothing to rebuild lost packets with.
+		return delivered, nil
+	}
+	d := &p.decoder
+	if number+fecGroupHistory <= d.newest {
+		// The group is too old to be worth keeping track of.
+		return delivered, nil
+	}
+	g, ok := d.groups[number]
+	if !ok {
+		g = &fecGroup{received: map[uint8]struct{}{}}
+		d.groups[number] = g
+		if number > d.newest {
+			d.newest = number
+			for old := range d.groups {
+				if old+fecGroupHistory <= number {
+					delete(d.groups, old)
+				}
+			}
+		}
+	}
+	switch data[0] {
+	case fecMarkerData:
+		if _, ok := g.received[index]; ok {
+			return nil, nil
+		}
+		g.received[index] = struct{}{}
+		g.xor = xorInto(g.xor, payload)
+	case fecMarkerParity:
+		g.parity, g.count = payload, index
+	}
+	if g.recovered || g.parity == nil || len(g.received) != int(g.count)-1 {
+		return delivered, nil
+	}
+	// Exactly one packet from the group is missing, so XORing the parity
+	// with the packets that we did receive gives us the missing packet.
+	missing := append([]byte(nil), g.parity...)
+	for i, b := range g.xor {
+		if i < len(missing) {
+			missing[i] ^= b
+		}
+	}
+	g.recovered = true
+	if len(missing) < 2 {
+		return delivered, nil
+	}
+	length := int(binary.BigEndian.Uint16(missing[:2]))
+	if length > len(missing)-2 {
+		return delivered, nil
+	}
+	p.stats.Recovered++
+	return delivered, missing[2 : 2+length]
+}
+
+// fecStats returns the forward error correction statistics for the given
+// address.
+func (c *fecConn) fecStats(addr net.Addr) FECStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	p, ok := c.peers[addr.String()]
+	if !ok {
+		return FECStats{}
+	}
+	stats := p.stats
+	stats.Enabled = true
+	return stats
+}
@@ -0,0 +1,151 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sessions
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestFECNegotiation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	inner := newTestPacketConn()
+	c := newFECConn(ctx, inner, 2)
+	addr := testAddr(1)
+	write := func() {
+		if _, err := c.WriteTo([]byte{0x40}, addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	markers := func() []byte {
+		var markers []byte
+		for _, packet := range inner.sent() {
+			markers = append(markers, packet.data[0])
+		}
+		return markers
+	}
+
+	// Packets only get FEC headers and parity once a session agrees to
+	// use FEC, and go back to bare QUIC when it closes.
+	write()
+	c.sessionOpened(addr)
+	write()
+	write()
+	c.sessionClosed(addr)
+	write()
+	expected := []byte{0x40, fecMarkerData, fecMarkerData, fecMarkerParity, 0x40}
+	if got := markers(); !bytes.Equal(got, expected) {
+		t.Fatalf("expected markers %v, got %v", expected, got)
+	}
+
+	// Data packets from a remote node that we haven't agreed to use FEC
+	// with are still unwrapped, but don't turn FEC on or keep any state.
+	inner.inbound <- datagram{[]byte{fecMarkerData, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x40}, addr}
+	inner.inbound <- datagram{[]byte{fecMarkerParity, 0, 0, 0, 0, 0, 0, 0, 0, 2, 0, 1, 0x40}, addr}
+	inner.inbound <- datagram{[]byte{0x41}, addr}
+	if got := readPayloads(t, c, 2); !bytes.Equal(got, []byte{0x40, 0x41}) {
+		t.Fatalf("expected the unwrapped data packet and the bare packet, got %v", got)
+	}
+	write()
+	if got := markers(); !bytes.Equal(got, []byte{0x40}) {
+		t.Fatalf("expected FEC to stay off, got markers %v", got)
+	}
+	if stats := c.fecStats(addr); stats.Enabled {
+		t.Fatalf("expected FEC to be off, got %+v", stats)
+	}
+}
+
+func TestFECGroupRecovery(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	senderConn, receiverConn := newTestPacketConn(), newTestPacketConn()
+	sender := newFECConn(ctx, senderConn, 4)
+	receiver := newFECConn(ctx, receiverConn, 4)
+	senderAddr, receiverAddr := testAddr(1), testAddr(2)
+	sender.sessionOpened(receiverAddr)
+	receiver.sessionOpened(senderAddr)
+
+	// send writes the messages and returns the packets that went out.
+	send := func(messages ...string) []datagram {
+		for _, message := range messages {
+			if _, err := sender.WriteTo([]byte(message), receiverAddr); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return senderConn.sent()
+	}
+	// deliver passes on all but one of the packets and reads what comes
+	// out of the other side.
+	deliver := func(packets []datagram, lost int, count int) []string {
+		for i, packet := range packets {
+			if i != lost {
+				receiverConn.inbound <- datagram{packet.data, senderAddr}
+			}
+		}
+		var messages []string
+		buf := make([]byte, types.MaxPayloadSize)
+		for i := 0; i < count; i++ {
+			n, _, err := receiver.ReadFrom(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			messages = append(messages, string(buf[:n]))
+		}
+		return messages
+	}
+
+	// A lost packet of any length in a full group is rebuilt once the
+	// parity packet arrives.
+	packets := send("a", "longer", "the longest of them", "b")
+	if len(packets) != 5 || packets[4].data[0] != fecMarkerParity {
+		t.Fatalf("expected four data packets and a parity packet, got %d packets", len(packets))
+	}
+	got := deliver(packets, 2, 4)
+	expected := []string{"a", "longer", "b", "the longest of them"}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Fatalf("expected %q, got %q", expected, got)
+		}
+	}
+
+	// A group that doesn't fill up gets its parity packet after a delay,
+	// which can rebuild a lost packet in the same way.
+	packets = send("c", "d")
+	for deadline := time.Now().Add(10 * time.Second); len(packets) < 3; {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected a parity packet for the partial group")
+		}
+		time.Sleep(fecFlushDelay)
+		packets = append(packets, senderConn.sent()...)
+	}
+	if parity := packets[2].data; parity[0] != fecMarkerParity || parity[9] != 2 {
+		t.Fatalf("expected a parity packet for two packets")
+	}
+	if got := deliver(packets, 0, 2); got[0] != "d" || got[1] != "c" {
+		t.Fatalf("expected the lost packet to be rebuilt, got %q", got)
+	}
+
+	if stats := receiver.fecStats(senderAddr); !stats.Enabled || stats.Recovered != 2 {
+		t.Fatalf("unexpected receiver statistics %+v", stats)
+	}
+	if stats := sender.fecStats(receiverAddr); !stats.Enabled || stats.ParitySent != 2 {
+		t.Fatalf("unexpected sender statistics %+v", stats)
+	}
+}
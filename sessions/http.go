@@ -15,10 +15,21 @@
 package sessions
 
 import (
+	"crypto/ed25519"
+	"encoding/hex"
 	"net/http"
 	"time"
+
+	"github.com/matrix-org/pinecone/types"
 )
 
+// HTTP requests can be sent over the overlay to URLs whose host is the
+// public key of the remote node in hex, e.g. "http://<key>/path". The port
+// is ignored. Since sessions are always encrypted and authenticated, both
+// http and https URLs are sent over plain session streams, so a handler
+// can tell which node sent a request from Request.RemoteAddr without any
+// certificates.
+
 type HTTP struct {
 	httpServer    *http.Server
 	httpMux       *http.ServeMux
@@ -27,21 +38,9 @@ type HTTP struct {
 }
 
 func (q *SessionProtocol) HTTP() *HTTP {
-	t := &http.Transport{
-		DisableKeepAlives:   true,
-		MaxIdleConnsPerHost: -1,
-		Dial:                q.Dial,
-		DialTLS:             q.DialTLS,
-		DialContext:         q.DialContext,
-		DialTLSContext:      q.DialTLSContext,
-	}
-
+	t := q.httpTransport()
 	h := &HTTP{
-		httpServer: &http.Server{
-			IdleTimeout:  time.Second * 30,
-			ReadTimeout:  time.Second * 10,
-			WriteTimeout: time.Second * 10,
-		},
+		httpServer:    newHTTPServer(),
 		httpMux:       &http.ServeMux{},
 		httpTransport: t,
 	}
@@ -63,3 +62,50 @@ func (h *HTTP) Mux() *http.ServeMux {
 func (h *HTTP) Client() *http.Client {
 	return h.httpClient
 }
+
+// RoundTripper returns an http.RoundTripper that sends requests to other
+// nodes over streams on this protocol, for use as the Transport of an
+// http.Client.
+func (q *SessionProtocol) RoundTripper() http.RoundTripper {
+	return q.httpTransport()
+}
+
+// ServeHandler serves the handler on streams accepted on this protocol,
+// until the protocol is closed. Nothing else should accept streams on the
+// same protocol.
+func (q *SessionProtocol) ServeHandler(handler http.Handler) error {
+	server := newHTTPServer()
+	server.Handler = handler
+	return server.Serve(q)
+}
+
+// RequestPublicKey returns the public key of the node that sent a request
+// to a handler served over the overlay.
+func RequestPublicKey(r *http.Request) (types.PublicKey, bool) {
+	var pk types.PublicKey
+	b, err := hex.DecodeString(r.RemoteAddr)
+	if err != nil || len(b) != ed25519.PublicKeySize {
+		return pk, false
+	}
+	copy(pk[:], b)
+	return pk, true
+}
+
+func (q *SessionProtocol) httpTransport() *http.Transport {
+	return &http.Transport{
+		DisableKeepAlives:   true,
+		MaxIdleConnsPerHost: -1,
+		Dial:                q.Dial,
+		DialTLS:             q.DialTLS,
+		DialContext:         q.DialContext,
+		DialTLSContext:      q.DialTLSContext,
+	}
+}
+
+func newHTTPServer() *http.Server {
+	return &http.Server{
+		IdleTimeout:  time.Second * 30,
+		ReadTimeout:  time.Second * 10,
+		WriteTimeout: time.Second * 10,
+	}
+}
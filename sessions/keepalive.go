@@ -0,0 +1,90 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sessions
+
+import (
+	"errors"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+	"github.com/quic-go/quic-go"
+)
+
+// Keepalives are QUIC pings, sent whenever a session has been idle for the
+// keepalive interval. If nothing at all is heard from the remote side for
+// the timeout then QUIC closes the session, and the application is told
+// that the session died rather than being closed on purpose. The idle
+// timeout is agreed during the handshake and is the lower of the two sides,
+// so a keepalive that is set for a single remote node only takes effect the
+// next time that we dial them. Sessions that the remote side opened use the
+// keepalive from SessionOptionKeepalive.
+
+// keepaliveTimeoutFactor is how many keepalive intervals can go unanswered
+// before a session is considered dead, if no timeout is given.
+const keepaliveTimeoutFactor = 3
+
+type keepalive struct {
+	interval time.Duration
+	timeout  time.Duration
+}
+
+func newKeepalive(interval, timeout time.Duration) keepalive {
+	if interval < 0 {
+		interval = 0
+	}
+	if timeout <= 0 && interval > 0 {
+		timeout = interval * keepaliveTimeoutFactor
+	}
+	return keepalive{interval, timeout}
+}
+
+func (k keepalive) apply(config *quic.Config) {
+	config.KeepAlivePeriod = k.interval
+	if k.timeout > 0 {
+		config.MaxIdleTimeout = k.timeout
+	}
+}
+
+// SetKeepalive sets how often an idle session with the given node is kept
+// alive and how long it can go without hearing from them before it's
+// considered dead, overriding SessionOptionKeepalive. A zero interval turns
+// keepalives off and a zero timeout is a few keepalive intervals. It takes
+// effect the next time that a session is dialled to the node.
+func (p *SessionProtocol) SetKeepalive(public types.PublicKey, interval, timeout time.Duration) {
+	p.keepalive.Store(public, newKeepalive(interval, timeout))
+}
+
+// dialConfigFor returns the QUIC config to use when dialling the given
+// node, with any keepalive that was set for them.
+func (p *SessionProtocol) dialConfigFor(public types.PublicKey) *quic.Config {
+	config := p.s.quicConfigFor(public)
+	v, ok := p.keepalive.Load(public)
+	if !ok {
+		return config
+	}
+	config = config.Clone()
+	v.(keepalive).apply(config)
+	return config
+}
+
+// sessionEnded tells the application if a session died because the remote
+// side stopped answering.
+func (p *SessionProtocol) sessionEnded(public types.PublicKey, err error) {
+	var idle *quic.IdleTimeoutError
+	if p.s.onDead == nil || !errors.As(err, &idle) {
+		return
+	}
+	p.s.onDead(p.proto, public)
+}
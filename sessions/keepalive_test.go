@@ -0,0 +1,90 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sessions
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+	"github.com/quic-go/quic-go"
+)
+
+func TestKeepaliveDefaults(t *testing.T) {
+	for _, tc := range []struct {
+		interval, timeout time.Duration
+		expected          keepalive
+	}{
+		{time.Second, 0, keepalive{time.Second, time.Second * keepaliveTimeoutFactor}},
+		{time.Second, time.Minute, keepalive{time.Second, time.Minute}},
+		{-time.Second, 0, keepalive{0, 0}},
+		{0, time.Minute, keepalive{0, time.Minute}},
+	} {
+		if got := newKeepalive(tc.interval, tc.timeout); got != tc.expected {
+			t.Fatalf("newKeepalive(%s, %s): expected %+v, got %+v", tc.interval, tc.timeout, tc.expected, got)
+		}
+	}
+
+	// Without a timeout, the idle timeout that QUIC already has is kept.
+	config := &quic.Config{MaxIdleTimeout: time.Second * 15}
+	newKeepalive(0, 0).apply(config)
+	if config.KeepAlivePeriod != 0 || config.MaxIdleTimeout != time.Second*15 {
+		t.Fatalf("expected keepalives off and the idle timeout kept, got %s/%s", config.KeepAlivePeriod, config.MaxIdleTimeout)
+	}
+	newKeepalive(time.Second, 0).apply(config)
+	if config.KeepAlivePeriod != time.Second || config.MaxIdleTimeout != time.Second*keepaliveTimeoutFactor {
+		t.Fatalf("expected the keepalive to be applied, got %s/%s", config.KeepAlivePeriod, config.MaxIdleTimeout)
+	}
+}
+
+func TestKeepaliveOptions(t *testing.T) {
+	var dead []types.PublicKey
+	s := NewSessions(nil, newTestRouter(t), []string{"test"}, SessionOptionKeepalive{
+		Interval: time.Second * 5,
+		OnDead: func(proto string, public types.PublicKey) {
+			if proto != "test" {
+				t.Errorf("expected the test protocol, got %q", proto)
+			}
+			dead = append(dead, public)
+		},
+	})
+	defer s.Close() // nolint:errcheck
+	if s.quicConfig.KeepAlivePeriod != time.Second*5 || s.quicConfig.MaxIdleTimeout != time.Second*15 {
+		t.Fatalf("expected the keepalive option to be applied, got %s/%s", s.quicConfig.KeepAlivePeriod, s.quicConfig.MaxIdleTimeout)
+	}
+
+	// A keepalive set for one node only applies when dialling that node,
+	// and doesn't change the config used for everyone else.
+	p := s.Protocol("test")
+	p.SetKeepalive(testAddr(1), time.Second, 0)
+	if config := p.dialConfigFor(testAddr(1)); config.KeepAlivePeriod != time.Second || config.MaxIdleTimeout != time.Second*keepaliveTimeoutFactor {
+		t.Fatalf("expected the keepalive for the node, got %s/%s", config.KeepAlivePeriod, config.MaxIdleTimeout)
+	}
+	if config := p.dialConfigFor(testAddr(2)); config != s.quicConfig || config.KeepAlivePeriod != time.Second*5 {
+		t.Fatalf("expected the default config for another node")
+	}
+
+	// Only sessions that went quiet are reported as dead, and not ones
+	// that were closed for any other reason.
+	p.sessionEnded(testAddr(1), &quic.IdleTimeoutError{})
+	p.sessionEnded(testAddr(2), fmt.Errorf("wrapped: %w", &quic.IdleTimeoutError{}))
+	p.sessionEnded(testAddr(3), errors.New("closed"))
+	p.sessionEnded(testAddr(4), &quic.ApplicationError{})
+	if len(dead) != 2 || dead[0] != testAddr(1) || dead[1] != testAddr(2) {
+		t.Fatalf("expected two dead sessions, got %v", dead)
+	}
+}
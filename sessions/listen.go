@@ -21,6 +21,7 @@ import (
 	"net"
 
 	"github.com/matrix-org/pinecone/types"
+	"github.com/quic-go/quic-go"
 )
 
 func (q *Sessions) listener() {
@@ -29,45 +30,79 @@ func (q *Sessions) listener() {
 		if err != nil {
 			return
 		}
+		go q.accept(con)
+	}
+}
 
-		key := con.RemoteAddr().(types.PublicKey)
-		tls := con.ConnectionState().TLS
-		if c := len(tls.PeerCertificates); c != 1 {
-			continue
-		}
-		cert := tls.PeerCertificates[0]
-		public, ok := cert.PublicKey.(ed25519.PublicKey)
-		if !ok {
-			continue
-		}
-		if !bytes.Equal(public, key[:]) {
-			continue
+// accept checks that a connection that the remote side dialled comes from
+// the node that it claims to, and then starts a session with it.
+func (q *Sessions) accept(con quic.Connection) {
+	key := con.RemoteAddr().(types.PublicKey)
+	tls := con.ConnectionState().TLS
+	if early, ok := con.(quic.EarlyConnection); ok && len(tls.PeerCertificates) == 0 {
+		// The client certificate only arrives at the end of the handshake,
+		// unless the session was resumed from a ticket.
+		select {
+		case <-early.HandshakeComplete().Done():
+		case <-q.context.Done():
+			return
 		}
+		tls = con.ConnectionState().TLS
+	}
+	if c := len(tls.PeerCertificates); c != 1 {
+		_ = con.CloseWithError(0, "expected one peer certificate")
+		return
+	}
+	cert := tls.PeerCertificates[0]
+	public, ok := cert.PublicKey.(ed25519.PublicKey)
+	if !ok || !bytes.Equal(public, key[:]) {
+		_ = con.CloseWithError(0, "remote side returned incorrect public key")
+		return
+	}
 
-		if proto := q.Protocol(con.ConnectionState().TLS.NegotiatedProtocol); proto != nil {
-			entry, ok := proto.getSession(key)
-			entry.Lock()
-			if ok {
-				_ = con.CloseWithError(0, "connection replaced")
-			}
-			entry.Connection = con
-			entry.Unlock()
-			go proto.sessionlistener(entry)
+	name, features := parseProtocol(tls.NegotiatedProtocol)
+	early := q.early != nil && features&featureEarlyData != 0
+	if proto := q.Protocol(name); proto != nil {
+		entry, ok := proto.getSession(key)
+		entry.Lock()
+		if ok {
+			_ = con.CloseWithError(0, "connection replaced")
 		}
+		entry.Connection = con
+		entry.Unlock()
+		go proto.sessionlistener(entry, early)
 	}
 }
 
-func (s *SessionProtocol) sessionlistener(session *activeSession) {
+// sessionlistener hands the streams that the remote side opens to the
+// application. If the remote side dialled the session with early data then
+// the first stream starts with a token, which is checked first.
+func (s *SessionProtocol) sessionlistener(session *activeSession, early bool) {
 	key, ok := session.RemoteAddr().(types.PublicKey)
 	if !ok {
 		return
 	}
 
-	defer s.sessions.Delete(key)
+	var err error
+	defer func() {
+		s.sessions.Delete(key)
+		s.sessionEnded(key, err)
+	}()
 
 	ctx := session.Context()
+	go s.s.useFeatures(session.Connection)
+	go s.s.measureRTT(ctx, s.proto, key, session)
+	go session.measureBandwidth(ctx)
 	for {
-		stream, err := session.AcceptStream(ctx)
+		var stream quic.Stream
+		if early {
+			early = false
+			if stream, err = s.s.early.acceptFirst(ctx, session); err != nil {
+				_ = session.CloseWithError(0, err.Error())
+			}
+		} else {
+			stream, err = session.AcceptStream(ctx)
+		}
 		if err != nil {
 			return
 		}
@@ -0,0 +1,599 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sessions
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+// The mailbox lets nodes send messages to each other when they aren't
+// online at the same time. A message is delivered directly over a session
+// if the recipient can be reached, and otherwise it is deposited with one
+// of our trusted mailbox nodes. Nodes fetch their messages from their own
+// trusted mailboxes whenever they connect to the network, and regularly
+// while connected. Once a message arrives, the recipient sends a delivery
+// receipt back to the sender in the same way. Messages are only delivered
+// to the application once, even if they arrive more than once.
+//
+// The sender of a message that is delivered directly is authenticated by
+// the session. The sender of a message that comes from a mailbox is only
+// as trustworthy as the mailbox, which is why mailboxes must be trusted.
+// All nodes that want to reach each other while offline need to use the
+// same mailboxes.
+
+// MailboxProtocol is the session protocol used for mailboxes. It is added
+// to the protocols automatically when SessionOptionMailbox is given.
+const MailboxProtocol = "pinecone-mailbox"
+
+// MailboxService is the service that nodes holding messages for other
+// nodes advertise, so that they can be found with Router.Services.
+const MailboxService = "mailbox"
+
+// mailboxTimeout is how long we will wait for another node to answer a
+// mailbox request.
+const mailboxTimeout = time.Second * 10
+
+// mailboxFlushInterval is how often we will fetch our messages from our
+// mailboxes while we are connected.
+const mailboxFlushInterval = time.Minute
+
+// mailboxReconnectCheckInterval is how often we check whether we have
+// connected to the network, so that we can fetch our messages right away.
+const mailboxReconnectCheckInterval = time.Second * 2
+
+// mailboxExpiry is how long a mailbox will hold a message, and how long we
+// will remember a message that was delivered to us to drop duplicates.
+const mailboxExpiry = time.Hour * 24 * 7
+
+// mailboxMaxPayload is the largest message that can be sent.
+const mailboxMaxPayload = 1 << 20
+
+// mailboxSenderShare limits a node to this fraction of a mailbox's
+// capacity, so that one node can't fill up a mailbox for everyone else.
+const mailboxSenderShare = 8
+
+// mailboxMaxFetch is the most messages that we will accept from a mailbox
+// in one go.
+const mailboxMaxFetch = 1024
+
+const (
+	mailboxOpDeliver = iota + 1 // a message or receipt for the receiving node
+	mailboxOpDeposit            // a message or receipt to hold for another node
+	mailboxOpFetch              // a request for the messages held for us
+)
+
+const (
+	mailboxKindMessage = iota
+	mailboxKindReceipt
+)
+
+const (
+	mailboxStatusOK = iota
+	mailboxStatusRefused
+)
+
+// ErrMailboxUnavailable is returned when a message couldn't be delivered
+// directly and none of our mailboxes would hold it.
+var ErrMailboxUnavailable = errors.New("recipient and mailboxes unavailable")
+
+// MessageID identifies a message, so that it can be matched up with its
+// delivery receipt.
+type MessageID [16]byte
+
+func (id MessageID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// Message is a message that was sent to us.
+type Message struct {
+	ID      MessageID
+	From    types.PublicKey
+	Payload []byte
+}
+
+// Receipt tells us that a message that we sent was delivered.
+type Receipt struct {
+	ID MessageID
+	By types.PublicKey // The recipient of the message
+}
+
+// MailboxStats describes the messages held by a mailbox for other nodes.
+type MailboxStats struct {
+	Held       int // Messages held for other nodes
+	Recipients int // Nodes that messages are held for
+}
+
+type mailboxRecord struct {
+	kind    byte
+	id      MessageID
+	from    types.PublicKey
+	to      types.PublicKey
+	payload []byte
+	stored  time.Time
+}
+
+// Mailbox sends and receives messages for the application, and holds
+// messages for other nodes if it has capacity.
+type Mailbox struct {
+	s         *Sessions
+	proto     *SessionProtocol
+	capacity  int
+	messages  chan Message
+	receipts  chan Receipt
+	flushNow  chan struct{}
+	mutex     sync.Mutex
+	mailboxes []types.PublicKey                    // protected by mutex
+	held      map[types.PublicKey][]*mailboxRecord // protected by mutex
+	count     int                                  // protected by mutex
+	deposited map[types.PublicKey]int              // protected by mutex
+	seen      map[MessageID]time.Time              // protected by mutex
+}
+
+func newMailbox(s *Sessions, opt SessionOptionMailbox) *Mailbox {
+	m := &Mailbox{
+		s:         s,
+		proto:     s.Protocol(MailboxProtocol),
+		capacity:  opt.Capacity,
+		messages:  make(chan Message, 16),
+		receipts:  make(chan Receipt, 16),
+		flushNow:  make(chan struct{}, 1),
+		mailboxes: append([]types.PublicKey{}, opt.Mailboxes...),
+		held:      map[types.PublicKey][]*mailboxRecord{},
+		deposited: map[types.PublicKey]int{},
+		seen:      map[MessageID]time.Time{},
+	}
+	if m.capacity > 0 {
+		if err := s.r.AdvertiseService(MailboxService, uint64(m.capacity)); err != nil {
+			s.log.Println("Failed to advertise mailbox:", err)
+		}
+	}
+	go m.accept()
+	go m.maintain()
+	return m
+}
+
+// Mailbox returns the mailbox, or nil if SessionOptionMailbox wasn't given.
+func (s *Sessions) Mailbox() *Mailbox {
+	return s.mailbox
+}
+
+// SetMailboxes replaces the mailbox nodes that we trust to hold messages
+// for us and for the nodes that we send messages to.
+func (m *Mailbox) SetMailboxes(mailboxes []types.PublicKey) {
+	m.mutex.Lock()
+	m.mailboxes = append([]types.PublicKey{}, mailboxes...)
+	m.mutex.Unlock()
+	m.Flush()
+}
+
+// Messages returns the channel on which messages sent to us are delivered.
+func (m *Mailbox) Messages() <-chan Message {
+	return m.messages
+}
+
+// Receipts returns the channel on which receipts for the messages that we
+// sent are delivered.
+func (m *Mailbox) Receipts() <-chan Receipt {
+	return m.receipts
+}
+
+// Flush fetches the messages held for us by our mailboxes in the
+// background. This happens automatically when we connect to the network.
+func (m *Mailbox) Flush() {
+	select {
+	case m.flushNow <- struct{}{}:
+	default:
+	}
+}
+
+// Stats returns statistics about the messages held for other nodes.
+func (m *Mailbox) Stats() MailboxStats {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return MailboxStats{
+		Held:       m.count,
+		Recipients: len(m.held),
+	}
+}
+
+// Send sends a message to the given node, directly if it can be reached
+// and otherwise through one of our mailboxes. A receipt with the returned
+// ID arrives on the Receipts channel once the message has been delivered.
+func (m *Mailbox) Send(ctx context.Context, to types.PublicKey, payload []byte) (MessageID, error) {
+	var id MessageID
+	if len(payload) > mailboxMaxPayload {
+		return id, fmt.Errorf("message length %d exceeds maximum %d", len(payload), mailboxMaxPayload)
+	}
+	if _, err := rand.Read(id[:]); err != nil {
+		return id, fmt.Errorf("rand.Read: %w", err)
+	}
+	return id, m.send(ctx, &mailboxRecord{
+		kind:    mailboxKindMessage,
+		id:      id,
+		from:    m.s.r.PublicKey(),
+		to:      to,
+		payload: payload,
+	})
+}
+
+// send delivers a record directly, or deposits it with the first of our
+// mailboxes that will hold it.
+func (m *Mailbox) send(ctx context.Context, rec *mailboxRecord) error {
+	if err := m.request(ctx, rec.to, mailboxOpDeliver, rec); err == nil {
+		return nil
+	}
+	m.mutex.Lock()
+	mailboxes := m.mailboxes
+	m.mutex.Unlock()
+	for _, mailbox := range mailboxes {
+		if mailbox == rec.to || mailbox == m.s.r.PublicKey() {
+			continue
+		}
+		if err := m.request(ctx, mailbox, mailboxOpDeposit, rec); err == nil {
+			return nil
+		}
+	}
+	return ErrMailboxUnavailable
+}
+
+// request sends a delivery or a deposit to another node and waits for it
+// to be accepted.
+func (m *Mailbox) request(ctx context.Context, to types.PublicKey, op byte, rec *mailboxRecord) error {
+	conn, err := m.dial(ctx, to)
+	if err != nil {
+		return err
+	}
+	defer conn.Close() // nolint:errcheck
+	if _, err = conn.Write([]byte{op}); err != nil {
+		return fmt.Errorf("conn.Write: %w", err)
+	}
+	if err = writeMailboxRecord(conn, rec); err != nil {
+		return err
+	}
+	var status [1]byte
+	if _, err = io.ReadFull(conn, status[:]); err != nil {
+		return fmt.Errorf("io.ReadFull: %w", err)
+	}
+	if status[0] != mailboxStatusOK {
+		return fmt.Errorf("request refused")
+	}
+	return nil
+}
+
+func (m *Mailbox) dial(ctx context.Context, to types.PublicKey) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, mailboxTimeout)
+	defer cancel()
+	conn, err := m.proto.DialContext(ctx, "ed25519", net.JoinHostPort(to.String(), "0"))
+	if err != nil {
+		return nil, fmt.Errorf("m.proto.DialContext: %w", err)
+	}
+	if err = conn.SetDeadline(time.Now().Add(mailboxTimeout)); err != nil {
+		conn.Close() // nolint:errcheck
+		return nil, fmt.Errorf("conn.SetDeadline: %w", err)
+	}
+	return conn, nil
+}
+
+// fetch collects the messages held for us by the given mailbox.
+func (m *Mailbox) fetch(ctx context.Context, mailbox types.PublicKey) error {
+	conn, err := m.dial(ctx, mailbox)
+	if err != nil {
+		return err
+	}
+	defer conn.Close() // nolint:errcheck
+	if _, err = conn.Write([]byte{mailboxOpFetch}); err != nil {
+		return fmt.Errorf("conn.Write: %w", err)
+	}
+	var count [4]byte
+	if _, err = io.ReadFull(conn, count[:]); err != nil {
+		return fmt.Errorf("io.ReadFull: %w", err)
+	}
+	n := binary.BigEndian.Uint32(count[:])
+	if n > mailboxMaxFetch {
+		return fmt.Errorf("mailbox sent %d messages", n)
+	}
+	records := make([]*mailboxRecord, 0, n)
+	for i := uint32(0); i < n; i++ {
+		rec, err := readMailboxRecord(conn)
+		if err != nil {
+			return err
+		}
+		records = append(records, rec)
+	}
+	if _, err = conn.Write([]byte{mailboxStatusOK}); err != nil {
+		return fmt.Errorf("conn.Write: %w", err)
+	}
+	for _, rec := range records {
+		m.receive(rec)
+	}
+	return nil
+}
+
+// receive hands a message or receipt that was sent to us to the
+// application, and sends a receipt for messages.
+func (m *Mailbox) receive(rec *mailboxRecord) {
+	switch rec.kind {
+	case mailboxKindMessage:
+		m.mutex.Lock()
+		_, seen := m.seen[rec.id]
+		if !seen {
+			m.seen[rec.id] = time.Now()
+		}
+		m.mutex.Unlock()
+		if seen {
+			return
+		}
+		go func() {
+			ctx, cancel := context.WithTimeout(m.s.context, mailboxTimeout*2)
+			defer cancel()
+			_ = m.send(ctx, &mailboxRecord{
+				kind: mailboxKindReceipt,
+				id:   rec.id,
+				from: m.s.r.PublicKey(),
+				to:   rec.from,
+			})
+		}()
+		select {
+		case m.messages <- Message{ID: rec.id, From: rec.from, Payload: rec.payload}:
+		case <-m.s.context.Done():
+		}
+
+	case mailboxKindReceipt:
+		select {
+		case m.receipts <- Receipt{ID: rec.id, By: rec.from}:
+		case <-m.s.context.Done():
+		}
+	}
+}
+
+// accept handles mailbox requests from other nodes.
+func (m *Mailbox) accept() {
+	for {
+		conn, err := m.proto.Accept()
+		if err != nil {
+			return
+		}
+		go m.serve(conn)
+	}
+}
+
+func (m *Mailbox) serve(conn net.Conn) {
+	defer conn.Close() // nolint:errcheck
+	remote, ok := conn.RemoteAddr().(types.PublicKey)
+	if !ok {
+		return
+	}
+	if err := conn.SetDeadline(time.Now().Add(mailboxTimeout)); err != nil {
+		return
+	}
+	var op [1]byte
+	if _, err := io.ReadFull(conn, op[:]); err != nil {
+		return
+	}
+	switch op[0] {
+	case mailboxOpDeliver:
+		rec, err := readMailboxRecord(conn)
+		if err != nil {
+			return
+		}
+		if rec.to != m.s.r.PublicKey() {
+			_, _ = conn.Write([]byte{mailboxStatusRefused})
+			return
+		}
+		// The session tells us who really sent it.
+		rec.from = remote
+		_, _ = conn.Write([]byte{mailboxStatusOK})
+		m.receive(rec)
+
+	case mailboxOpDeposit:
+		rec, err := readMailboxRecord(conn)
+		if err != nil {
+			return
+		}
+		rec.from, rec.stored = remote, time.Now()
+		status := byte(mailboxStatusRefused)
+		m.mutex.Lock()
+		if m.hold(rec) {
+			status = mailboxStatusOK
+		}
+		m.mutex.Unlock()
+		_, _ = conn.Write([]byte{status})
+
+	case mailboxOpFetch:
+		// Take a copy of the records, since release reuses the slice for
+		// the records that remain.
+		m.mutex.Lock()
+		records := m.held[remote]
+		if len(records) > mailboxMaxFetch {
+			records = records[:mailboxMaxFetch]
+		}
+		records = append([]*mailboxRecord(nil), records...)
+		m.mutex.Unlock()
+		var count [4]byte
+		binary.BigEndian.PutUint32(count[:], uint32(len(records)))
+		if _, err := conn.Write(count[:]); err != nil {
+			return
+		}
+		for _, rec := range records {
+			if err := writeMailboxRecord(conn, rec); err != nil {
+				return
+			}
+		}
+		var ack [1]byte
+		if _, err := io.ReadFull(conn, ack[:]); err != nil || ack[0] != mailboxStatusOK {
+			return
+		}
+		// Only forget the messages that we sent, since more might have
+		// been deposited in the meantime.
+		m.mutex.Lock()
+		m.release(remote, records)
+		m.mutex.Unlock()
+	}
+}
+
+// hold takes a record deposited for another node, unless we are full or
+// the sender has used up their share of our capacity. The mutex must be
+// held.
+func (m *Mailbox) hold(rec *mailboxRecord) bool {
+	quota := m.capacity / mailboxSenderShare
+	if quota < 1 {
+		quota = 1
+	}
+	if m.count >= m.capacity || m.deposited[rec.from] >= quota {
+		return false
+	}
+	m.held[rec.to] = append(m.held[rec.to], rec)
+	m.deposited[rec.from]++
+	m.count++
+	return true
+}
+
+// release forgets the given records held for a node. The mutex must be
+// held.
+func (m *Mailbox) release(to types.PublicKey, records []*mailboxRecord) {
+	released := make(map[*mailboxRecord]struct{}, len(records))
+	for _, rec := range records {
+		released[rec] = struct{}{}
+	}
+	remaining := m.held[to][:0]
+	for _, rec := range m.held[to] {
+		if _, ok := released[rec]; !ok {
+			remaining = append(remaining, rec)
+			continue
+		}
+		if m.deposited[rec.from]--; m.deposited[rec.from] == 0 {
+			delete(m.deposited, rec.from)
+		}
+	}
+	m.count -= len(m.held[to]) - len(remaining)
+	if len(remaining) == 0 {
+		delete(m.held, to)
+	} else {
+		m.held[to] = remaining
+	}
+}
+
+// maintain fetches our messages when we connect to the network and at
+// regular intervals, and expires old messages.
+func (m *Mailbox) maintain() {
+	check := time.NewTicker(mailboxReconnectCheckInterval)
+	defer check.Stop()
+	var connected bool
+	var lastFlush time.Time
+	for {
+		flush := false
+		select {
+		case <-m.s.context.Done():
+			return
+		case <-m.flushNow:
+			flush = true
+		case <-check.C:
+			wasConnected := connected
+			connected = len(m.s.r.Peers()) > 1 // Includes the local port
+			flush = connected && (!wasConnected || time.Since(lastFlush) >= mailboxFlushInterval)
+			m.expire()
+		}
+		if !flush {
+			continue
+		}
+		lastFlush = time.Now()
+		m.mutex.Lock()
+		mailboxes := m.mailboxes
+		m.mutex.Unlock()
+		for _, mailbox := range mailboxes {
+			if mailbox == m.s.r.PublicKey() {
+				continue
+			}
+			if err := m.fetch(m.s.context, mailbox); err != nil {
+				m.s.log.Println("Failed to fetch messages from mailbox", mailbox.String()[:8], err)
+			}
+		}
+	}
+}
+
+// expire forgets messages that have been held or remembered for too long.
+func (m *Mailbox) expire() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for id, at := range m.seen {
+		if time.Since(at) > mailboxExpiry {
+			delete(m.seen, id)
+		}
+	}
+	for to, records := range m.held {
+		var expired []*mailboxRecord
+		for _, rec := range records {
+			if time.Since(rec.stored) > mailboxExpiry {
+				expired = append(expired, rec)
+			}
+		}
+		if len(expired) > 0 {
+			m.release(to, expired)
+		}
+	}
+}
+
+func writeMailboxRecord(w io.Writer, rec *mailboxRecord) error {
+	header := make([]byte, 1+len(rec.id)+len(rec.from)+len(rec.to)+4)
+	header[0] = rec.kind
+	offset := 1
+	offset += copy(header[offset:], rec.id[:])
+	offset += copy(header[offset:], rec.from[:])
+	offset += copy(header[offset:], rec.to[:])
+	binary.BigEndian.PutUint32(header[offset:], uint32(len(rec.payload)))
+	if _, err := w.Write(header); err != nil {
+		return fmt.Errorf("w.Write: %w", err)
+	}
+	if _, err := w.Write(rec.payload); err != nil {
+		return fmt.Errorf("w.Write: %w", err)
+	}
+	return nil
+}
+
+func readMailboxRecord(r io.Reader) (*mailboxRecord, error) {
+	rec := &mailboxRecord{}
+	header := make([]byte, 1+len(rec.id)+len(rec.from)+len(rec.to)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("io.ReadFull: %w", err)
+	}
+	rec.kind = header[0]
+	offset := 1
+	offset += copy(rec.id[:], header[offset:])
+	offset += copy(rec.from[:], header[offset:])
+	offset += copy(rec.to[:], header[offset:])
+	switch length := binary.BigEndian.Uint32(header[offset:]); {
+	case rec.kind != mailboxKindMessage && rec.kind != mailboxKindReceipt:
+		return nil, fmt.Errorf("unknown record kind %d", rec.kind)
+	case length > mailboxMaxPayload:
+		return nil, fmt.Errorf("message length %d exceeds maximum %d", length, mailboxMaxPayload)
+	default:
+		rec.payload = make([]byte, length)
+	}
+	if _, err := io.ReadFull(r, rec.payload); err != nil {
+		return nil, fmt.Errorf("io.ReadFull: %w", err)
+	}
+	return rec, nil
+}
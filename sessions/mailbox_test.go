@@ -0,0 +1,164 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sessions
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+// mailboxTestConn is one end of a pipe that appears to come from the given
+// node, like a session would.
+type mailboxTestConn struct {
+	net.Conn
+	remote types.PublicKey
+}
+
+func (c mailboxTestConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func newTestMailbox(capacity int) *Mailbox {
+	return &Mailbox{
+		capacity:  capacity,
+		held:      map[types.PublicKey][]*mailboxRecord{},
+		deposited: map[types.PublicKey]int{},
+		seen:      map[MessageID]time.Time{},
+	}
+}
+
+// serveTestRequest starts serving a mailbox request from the given node and
+// returns our end of the connection, along with a channel that is closed
+// once the mailbox has finished with the request.
+func serveTestRequest(m *Mailbox, from types.PublicKey, op byte) (net.Conn, <-chan struct{}) {
+	ours, theirs := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.serve(mailboxTestConn{theirs, from})
+	}()
+	_, _ = ours.Write([]byte{op})
+	return ours, done
+}
+
+func deposit(t *testing.T, m *Mailbox, from, to types.PublicKey, id byte) bool {
+	t.Helper()
+	conn, done := serveTestRequest(m, from, mailboxOpDeposit)
+	defer conn.Close() // nolint:errcheck
+	if err := writeMailboxRecord(conn, &mailboxRecord{id: MessageID{id}, to: to, payload: []byte{id}}); err != nil {
+		t.Fatal(err)
+	}
+	var status [1]byte
+	if _, err := io.ReadFull(conn, status[:]); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	return status[0] == mailboxStatusOK
+}
+
+// startFetch fetches the records held for the given node, but leaves it to
+// the caller to acknowledge them.
+func startFetch(t *testing.T, m *Mailbox, to types.PublicKey) ([]*mailboxRecord, net.Conn, <-chan struct{}) {
+	t.Helper()
+	conn, done := serveTestRequest(m, to, mailboxOpFetch)
+	var count [4]byte
+	if _, err := io.ReadFull(conn, count[:]); err != nil {
+		t.Fatal(err)
+	}
+	var records []*mailboxRecord
+	for i := binary.BigEndian.Uint32(count[:]); i > 0; i-- {
+		rec, err := readMailboxRecord(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, rec)
+	}
+	return records, conn, done
+}
+
+func TestMailboxSenderQuota(t *testing.T) {
+	m := newTestMailbox(mailboxSenderShare * 2)
+	alice, bob, carol := testAddr(1), testAddr(2), testAddr(3)
+
+	// Each node can only use its share of the capacity, whoever the
+	// messages are for.
+	for i, expected := range []bool{true, true, false} {
+		if ok := deposit(t, m, alice, types.PublicKey{byte(10 + i)}, byte(i)); ok != expected {
+			t.Fatalf("deposit %d: expected accepted to be %v", i, expected)
+		}
+	}
+	if !deposit(t, m, bob, carol, 3) {
+		t.Fatalf("expected another node's deposit to be accepted")
+	}
+	if stats := m.Stats(); stats.Held != 3 || stats.Recipients != 3 {
+		t.Fatalf("unexpected statistics %+v", stats)
+	}
+
+	// Once the messages are collected, the sender can deposit more.
+	records, conn, done := startFetch(t, m, types.PublicKey{10})
+	if len(records) != 1 || records[0].from != alice {
+		t.Fatalf("expected one message from alice, got %d", len(records))
+	}
+	if _, err := conn.Write([]byte{mailboxStatusOK}); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	if !deposit(t, m, alice, carol, 4) {
+		t.Fatalf("expected the deposit to be accepted once there was room")
+	}
+
+	// Nobody gets less than one message, however small the mailbox.
+	m = newTestMailbox(1)
+	if !deposit(t, m, alice, carol, 5) || deposit(t, m, bob, carol, 6) {
+		t.Fatalf("expected only the first deposit to be accepted")
+	}
+}
+
+func TestMailboxFetchRelease(t *testing.T) {
+	m := newTestMailbox(mailboxSenderShare * 4)
+	alice, bob := testAddr(1), testAddr(2)
+	deposit(t, m, alice, bob, 1)
+	deposit(t, m, alice, bob, 2)
+
+	// Records can be released and deposited while a fetch is waiting for
+	// its acknowledgement, but the fetch should only release the records
+	// that it actually sent.
+	records, conn, done := startFetch(t, m, bob)
+	if len(records) != 2 {
+		t.Fatalf("expected two records, got %d", len(records))
+	}
+	m.mutex.Lock()
+	m.release(bob, m.held[bob][:1])
+	m.mutex.Unlock()
+	deposit(t, m, alice, bob, 3)
+	if _, err := conn.Write([]byte{mailboxStatusOK}); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if held := m.held[bob]; len(held) != 1 || held[0].id != (MessageID{3}) {
+		t.Fatalf("expected only the new record to be held, got %d records", len(held))
+	}
+	if m.count != 1 || m.deposited[alice] != 1 {
+		t.Fatalf("expected the counts to match, got %d held and %d deposited", m.count, m.deposited[alice])
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sessions
+
+import (
+	"context"
+	"sync"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/router/events"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// Sessions are addressed by the public key of the remote node and not by
+// any path or peering, so when the route to the remote node changes, e.g.
+// because our parent changed or a peering along the way went down, the
+// session carries on over the new route without the application having to
+// do anything. We watch for changes to our peerings and our place in the
+// tree, and check the next hop towards each remote node when they happen.
+// When the next hop has changed, the session has migrated to a new path:
+// we forget the tree coordinates that we had cached for the remote node so
+// that traffic is routed by key until it tells us where it is now, measure
+// the round trip time again, and send an events.SessionMigrated event to
+// our subscribers, since the new path may be faster or slower.
+
+// sessionPath is the next hop that a session's traffic was last sent to.
+type sessionPath struct {
+	sync.Mutex
+	known   bool            // protected by mutex
+	nexthop types.PublicKey // protected by mutex
+}
+
+// Subscribe registers a subscriber to session events, such as
+// events.SessionMigrated.
+func (s *Sessions) Subscribe(ch chan<- events.Event) {
+	s.subscribersMutex.Lock()
+	defer s.subscribersMutex.Unlock()
+	if s.subscribers == nil {
+		s.subscribers = map[chan<- events.Event]*phony.Inbox{}
+	}
+	s.subscribers[ch] = &phony.Inbox{}
+}
+
+func (s *Sessions) publish(event events.Event) {
+	s.subscribersMutex.Lock()
+	defer s.subscribersMutex.Unlock()
+	for ch, inbox := range s.subscribers {
+		// Create a copy of the pointer before passing into the lambda
+		chCopy := ch
+		inbox.Act(nil, func() {
+			chCopy <- event
+		})
+	}
+}
+
+// watchPaths checks the paths of all of the open sessions whenever our
+// peerings or our place in the network change.
+func (s *Sessions) watchPaths() {
+	ch := make(chan events.Event, 16)
+	s.r.Subscribe(ch)
+	for {
+		select {
+		case <-s.context.Done():
+			return
+		case event := <-ch:
+			switch event.(type) {
+			case events.PeerAdded, events.PeerRemoved, events.TreeParentUpdate, events.SnakeDescUpdate:
+				s.checkPaths()
+			}
+		}
+	}
+}
+
+// checkPaths checks the path of every open session.
+func (s *Sessions) checkPaths() {
+	for _, proto := range s.protocols {
+		proto.sessions.Range(func(k, v interface{}) bool {
+			pk, ok := k.(types.PublicKey)
+			if !ok {
+				return true
+			}
+			s.checkPath(proto.proto, pk, v.(*activeSession))
+			return true
+		})
+	}
+}
+
+// checkPath looks up the next hop towards the remote node of a session,
+// and handles the session migrating if it has changed.
+func (s *Sessions) checkPath(proto string, pk types.PublicKey, session *activeSession) {
+	explanation, err := s.r.NextHop(pk)
+	if err != nil || !explanation.Found || explanation.Local {
+		return
+	}
+	session.path.Lock()
+	previous, known := session.path.nexthop, session.path.known
+	session.path.nexthop, session.path.known = explanation.PublicKey, true
+	session.path.Unlock()
+	if !known || previous == explanation.PublicKey {
+		return
+	}
+	s.r.ForgetCoordinates(pk)
+	go func() {
+		ctx, cancel := context.WithTimeout(s.context, sessionRTTInterval)
+		defer cancel()
+		_, _ = s.r.Lookup(ctx, pk)
+	}()
+	s.publish(events.SessionMigrated{
+		PeerID:      pk.String(),
+		Protocol:    proto,
+		PreviousHop: previous.String(),
+		NextHop:     explanation.PublicKey.String(),
+	})
+}
@@ -0,0 +1,82 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sessions
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/router/events"
+)
+
+func TestSessionMigration(t *testing.T) {
+	r1, r2 := newTestRouterPair(t)
+	s := newTestSessions(t, r1)
+	ch := make(chan events.Event, 16)
+	s.Subscribe(ch)
+	session := &activeSession{}
+	proto := &SessionProtocol{s: s, proto: "test"}
+	proto.sessions.Store(r2.PublicKey(), session)
+	s.protocols[proto.proto] = proto
+	migrated := func() events.SessionMigrated {
+		t.Helper()
+		select {
+		case event := <-ch:
+			return event.(events.SessionMigrated)
+		case <-time.After(time.Second * 10):
+			t.Fatalf("expected a migration event")
+			return events.SessionMigrated{}
+		}
+	}
+	previous := func(hop byte) {
+		session.path.Lock()
+		session.path.nexthop = testAddr(hop)
+		session.path.Unlock()
+	}
+
+	// The first time that we look, we only learn the path.
+	s.checkPaths()
+	session.path.Lock()
+	known, nexthop := session.path.known, session.path.nexthop
+	session.path.Unlock()
+	if !known || nexthop != r2.PublicKey() {
+		t.Fatalf("expected the next hop to be learned")
+	}
+
+	// The session migrates when the next hop changes, but not when it
+	// stays the same, so the next event is for the second change.
+	previous(1)
+	s.checkPath(proto.proto, r2.PublicKey(), session)
+	event := migrated()
+	if event.PeerID != r2.PublicKey().String() || event.Protocol != proto.proto {
+		t.Fatalf("unexpected migration event %+v", event)
+	}
+	if event.PreviousHop != testAddr(1).String() || event.NextHop != r2.PublicKey().String() {
+		t.Fatalf("expected a migration from %s to %s, got %+v", testAddr(1), r2.PublicKey(), event)
+	}
+	s.checkPaths()
+	previous(2)
+	s.checkPaths()
+	if event := migrated(); event.PreviousHop != testAddr(2).String() {
+		t.Fatalf("expected only the second change to migrate, got %+v", event)
+	}
+
+	// Sessions with ourselves never migrate.
+	local := &activeSession{}
+	s.checkPath(proto.proto, r1.PublicKey(), local)
+	if local.path.known {
+		t.Fatalf("expected no path for a session with ourselves")
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sessions
+
+import (
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+// defaultReorderDepth and defaultReorderTimeout are used when the reorder
+// window is enabled without a depth or timeout.
+const defaultReorderDepth = 16
+const defaultReorderTimeout = time.Millisecond * 50
+
+// SessionOptionReorderWindow enables the reorder buffer, which holds back
+// up to Depth packets that arrived ahead of a missing packet for up to
+// Timeout, so that moderate reordering caused by path changes doesn't look
+// like packet loss. It is only used with remote nodes that also enable it.
+// A zero Depth or Timeout selects the default.
+type SessionOptionReorderWindow struct {
+	Depth   int
+	Timeout time.Duration
+}
+
+// defaultFECGroupSize is used when forward error correction is enabled
+// without a group size. maxFECGroupSize is the largest group that can be
+// described in the packet headers.
+const defaultFECGroupSize = 8
+const maxFECGroupSize = 255
+
+// SessionOptionForwardErrorCorrection enables forward error correction,
+// which sends a parity packet after every GroupSize packets so that any one
+// lost packet in the group can be rebuilt without being retransmitted. This
+// helps on lossy links such as Bluetooth, at the cost of the extra packets.
+// It is only used with remote nodes that also enable it. A zero GroupSize
+// selects the default.
+type SessionOptionForwardErrorCorrection struct {
+	GroupSize int
+}
+
+// SessionOptionMailbox enables the mailbox, which lets us exchange
+// messages with nodes that aren't online at the same time as us. Mailboxes
+// are the nodes that we trust to hold messages for us and for the nodes
+// that we send messages to. If Capacity is more than zero then we will also
+// hold up to that many messages for other nodes, no more than an eighth of
+// them from any one node, and advertise that we do.
+type SessionOptionMailbox struct {
+	Mailboxes []types.PublicKey
+	Capacity  int
+}
+
+// SessionOptionKeepalive keeps idle sessions alive by pinging them every
+// Interval, and considers a session dead if nothing is heard from the remote
+// side for Timeout, which defaults to a few intervals. OnDead is called when
+// a session dies, so that the application can reconnect or give up.
+type SessionOptionKeepalive struct {
+	Interval time.Duration
+	Timeout  time.Duration
+	OnDead   func(proto string, public types.PublicKey)
+}
+
+// SessionOptionEarlyData sends the first stream of a session along with the
+// handshake when dialling a node that we've had a session with before, so
+// that it arrives one overlay round trip sooner. It is only used with
+// remote nodes that also enable it. Streams that arrive as early data are
+// only handed to the application straight away if they were dialled within
+// ReplayWindow of our clock and haven't been seen before, otherwise they
+// wait for the handshake. A zero ReplayWindow selects the default.
+type SessionOptionEarlyData struct {
+	ReplayWindow time.Duration
+}
+
+type SessionOption interface {
+	isSessionOption()
+}
+
+func (o SessionOptionReorderWindow) isSessionOption()          {}
+func (o SessionOptionForwardErrorCorrection) isSessionOption() {}
+func (o SessionOptionMailbox) isSessionOption()                {}
+func (o SessionOptionKeepalive) isSessionOption()              {}
+func (o SessionOptionEarlyData) isSessionOption()              {}
@@ -0,0 +1,375 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sessions
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+// reorderMarker is the first byte of a packet that carries a reorder
+// sequence number. QUIC always sets the fixed bit (0x40) in the first byte
+// of its packets, so a packet starting with the marker can't be mistaken
+// for a bare QUIC packet.
+const reorderMarker = 0x01
+
+// reorderHeaderLength is the marker byte and the 64-bit sequence number.
+const reorderHeaderLength = 9
+
+// reorderRestartDistance is how far behind the expected sequence number a
+// packet must be before we assume that the remote node started counting
+// again, rather than that the packet was just very late.
+const reorderRestartDistance = 1 << 16
+
+// reorderBacklog is how many packets can be waiting to be read by QUIC.
+const reorderBacklog = 64
+
+// reorderMaxBuffers is how many remote nodes we keep receive state for.
+// Anyone can send us tagged packets, so once there are this many, the
+// state for nodes that have gone quiet is thrown away, and if there are
+// still too many then packets from new nodes are passed straight through.
+const reorderMaxBuffers = 1024
+
+// reorderIdleTimeout is how long a remote node has to go without sending
+// us anything before its receive state can be thrown away.
+const reorderIdleTimeout = time.Minute
+
+// ReorderStats contains the reordering statistics for a remote node.
+type ReorderStats struct {
+	Reordered uint64 // Packets that arrived early and were held back
+	Late      uint64 // Packets that arrived after we gave up waiting for them
+	Skipped   uint64 // Gaps that we gave up waiting for
+	MaxDepth  uint64 // Furthest ahead of the expected packet that one arrived
+}
+
+// reorderConn wraps the packet connection that QUIC uses so that packets
+// that arrive out of order, i.e. because the path to the remote node just
+// changed, are put back into order before QUIC sees them. Otherwise QUIC
+// would take the reordering for packet loss and retransmit needlessly.
+// Once a session with a remote node has agreed to use reordering, each
+// packet that we send to it is tagged with a sequence number. Packets that
+// arrive ahead of a gap are held back until either the gap is filled, more
+// than depth packets are held, or the timeout passes. Untagged packets are
+// always passed straight through.
+//
+// Packets are handed to QUIC through a queue, so that the mutex is never
+// held while waiting for QUIC to read them.
+type reorderConn struct {
+	net.PacketConn
+	ctx     context.Context
+	cancel  context.CancelFunc
+	depth   int
+	timeout time.Duration
+	packets chan datagram
+	mutex   sync.Mutex
+	peers   map[string]*reorderPeer   // send state, by address
+	buffers map[string]*reorderBuffer // receive state, by address
+	queue   []datagram                // packets in order, waiting to go to QUIC
+	drainer sync.Mutex                // held while emptying the queue
+}
+
+// datagram is a packet that has been received from a remote node and is
+// waiting to be read by QUIC.
+type datagram struct {
+	data []byte
+	addr net.Addr
+}
+
+// reorderPeer is the send state for a remote node that we have sessions
+// with that agreed to use reordering.
+type reorderPeer struct {
+	sessions int    // open sessions that use reordering
+	next     uint64 // the sequence number to send next
+}
+
+type reorderBuffer struct {
+	addr  net.Addr
+	next  uint64            // the sequence number that we expect next
+	held  map[uint64][]byte // packets that arrived ahead of a gap
+	timer *time.Timer       // gives up on the gap when it fires
+	seen  time.Time         // when the remote node last sent us something
+	stats ReorderStats
+}
+
+func newReorderConn(ctx context.Context, conn net.PacketConn, depth int, timeout time.Duration) *reorderConn {
+	c := &reorderConn{
+		PacketConn: conn,
+		depth:      depth,
+		timeout:    timeout,
+		packets:    make(chan datagram, reorderBacklog),
+		peers:      map[string]*reorderPeer{},
+		buffers:    map[string]*reorderBuffer{},
+	}
+	c.ctx, c.cancel = context.WithCancel(ctx)
+	go c.reader()
+	return c
+}
+
+// sessionOpened starts tagging the packets that we send to the remote node
+// for a session that agreed to use reordering. It must be matched by a call
+// to sessionClosed when the session ends.
+func (c *reorderConn) sessionOpened(addr net.Addr) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	p, ok := c.peers[addr.String()]
+	if !ok {
+		p = &reorderPeer{}
+		c.peers[addr.String()] = p
+	}
+	p.sessions++
+}
+
+// sessionClosed stops tagging the packets that we send to the remote node
+// once none of our sessions with it use reordering. The receive state is
+// thrown away too, so that the next session starts afresh.
+func (c *reorderConn) sessionClosed(addr net.Addr) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	key := addr.String()
+	p, ok := c.peers[key]
+	if !ok {
+		return
+	}
+	if p.sessions--; p.sessions > 0 {
+		return
+	}
+	delete(c.peers, key)
+	if b, ok := c.buffers[key]; ok {
+		c._remove(key, b)
+	}
+}
+
+func (c *reorderConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.mutex.Lock()
+	peer, ok := c.peers[addr.String()]
+	if !ok {
+		c.mutex.Unlock()
+		return c.PacketConn.WriteTo(p, addr)
+	}
+	seq := peer.next
+	peer.next++
+	c.mutex.Unlock()
+	buf := make([]byte, reorderHeaderLength+len(p))
+	buf[0] = reorderMarker
+	binary.BigEndian.PutUint64(buf[1:reorderHeaderLength], seq)
+	copy(buf[reorderHeaderLength:], p)
+	if _, err := c.PacketConn.WriteTo(buf, addr); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *reorderConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case packet := <-c.packets:
+		return copy(p, packet.data), packet.addr, nil
+	case <-c.ctx.Done():
+		return 0, nil, fmt.Errorf("connection closed")
+	}
+}
+
+// reader reads packets from the underlying connection and feeds them
+// through the reorder buffers until the context is cancelled.
+func (c *reorderConn) reader() {
+	defer c.cancel()
+	buf := make([]byte, types.MaxPayloadSize)
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(buf)
+		if err != nil || c.ctx.Err() != nil {
+			return
+		}
+		data := append([]byte(nil), buf[:n]...)
+		c.mutex.Lock()
+		if n < reorderHeaderLength || data[0] != reorderMarker {
+			c.queue = append(c.queue, datagram{data, addr})
+		} else {
+			c._receive(binary.BigEndian.Uint64(data[1:reorderHeaderLength]), data[reorderHeaderLength:], addr, time.Now())
+		}
+		c.mutex.Unlock()
+		c.drain()
+	}
+}
+
+// drain hands the queued packets to QUIC in order. It must be called
+// without the mutex held, since QUIC might not be ready for them yet.
+func (c *reorderConn) drain() {
+	c.drainer.Lock()
+	defer c.drainer.Unlock()
+	for {
+		c.mutex.Lock()
+		if len(c.queue) == 0 {
+			c.mutex.Unlock()
+			return
+		}
+		packet := c.queue[0]
+		c.queue[0] = datagram{}
+		c.queue = c.queue[1:]
+		c.mutex.Unlock()
+		select {
+		case c.packets <- packet:
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// _receive puts a tagged packet into the reorder buffer for the address and
+// queues whatever packets are now in order. It must be called with the
+// mutex held.
+func (c *reorderConn) _receive(seq uint64, data []byte, addr net.Addr, now time.Time) {
+	key := addr.String()
+	b, ok := c.buffers[key]
+	if !ok {
+		if len(c.buffers) >= reorderMaxBuffers {
+			c._expire(now)
+		}
+		if len(c.buffers) >= reorderMaxBuffers {
+			c.queue = append(c.queue, datagram{data, addr})
+			return
+		}
+		b = &reorderBuffer{
+			addr: addr,
+			next: seq,
+			held: map[uint64][]byte{},
+		}
+		c.buffers[key] = b
+	}
+	b.seen = now
+	switch {
+	case seq+reorderRestartDistance < b.next:
+		// The remote node has started counting again, probably because it
+		// restarted, so deliver whatever we were holding and start over.
+		for held, early := range b.held {
+			delete(b.held, held)
+			c.queue = append(c.queue, datagram{early, addr})
+		}
+		c.queue = append(c.queue, datagram{data, addr})
+		b.next = seq + 1
+		c._flush(b)
+	case seq < b.next:
+		// We already gave up waiting for this packet, so hand it over and
+		// let QUIC work out what to do with it.
+		b.stats.Late++
+		c.queue = append(c.queue, datagram{data, addr})
+	case seq == b.next:
+		c.queue = append(c.queue, datagram{data, addr})
+		b.next++
+		c._flush(b)
+	default:
+		b.stats.Reordered++
+		if depth := seq - b.next; depth > b.stats.MaxDepth {
+			b.stats.MaxDepth = depth
+		}
+		b.held[seq] = data
+		if len(b.held) > c.depth {
+			c._skip(b)
+		}
+		c._wait(b)
+	}
+}
+
+// _wait starts the timer that gives up on the current gap, if there is a
+// gap and the timer isn't already running. It must be called with the mutex
+// held.
+func (c *reorderConn) _wait(b *reorderBuffer) {
+	if len(b.held) == 0 || b.timer != nil {
+		return
+	}
+	b.timer = time.AfterFunc(c.timeout, func() {
+		c.mutex.Lock()
+		if c.buffers[b.addr.String()] != b {
+			// The buffer was thrown away after the timer fired.
+			c.mutex.Unlock()
+			return
+		}
+		b.timer = nil
+		c._skip(b)
+		c._wait(b)
+		c.mutex.Unlock()
+		c.drain()
+	})
+}
+
+// _flush queues the held packets that are now in order. It must be called
+// with the mutex held.
+func (c *reorderConn) _flush(b *reorderBuffer) {
+	for {
+		data, ok := b.held[b.next]
+		if !ok {
+			break
+		}
+		delete(b.held, b.next)
+		c.queue = append(c.queue, datagram{data, b.addr})
+		b.next++
+	}
+	if len(b.held) == 0 && b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+}
+
+// _skip gives up on the current gap, moving on to the earliest held packet.
+// It must be called with the mutex held.
+func (c *reorderConn) _skip(b *reorderBuffer) {
+	if len(b.held) == 0 {
+		return
+	}
+	earliest := b.next
+	for seq := range b.held {
+		if earliest == b.next || seq < earliest {
+			earliest = seq
+		}
+	}
+	b.stats.Skipped++
+	b.next = earliest
+	c._flush(b)
+}
+
+// _expire throws away the receive state for remote nodes that haven't sent
+// us anything for a while. It must be called with the mutex held.
+func (c *reorderConn) _expire(now time.Time) {
+	for key, b := range c.buffers {
+		if now.Sub(b.seen) >= reorderIdleTimeout {
+			c._remove(key, b)
+		}
+	}
+}
+
+// _remove throws away the receive state for a remote node, along with any
+// packets that are still being held. It must be called with the mutex held.
+func (c *reorderConn) _remove(key string, b *reorderBuffer) {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	delete(c.buffers, key)
+}
+
+// reorderStats returns the reordering statistics for the given address.
+func (c *reorderConn) reorderStats(addr net.Addr) (ReorderStats, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	b, ok := c.buffers[addr.String()]
+	if !ok {
+		return ReorderStats{}, false
+	}
+	return b.stats, true
+}
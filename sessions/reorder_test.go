@@ -0,0 +1,246 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sessions
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+// testPacketConn is the packet connection underneath the wrappers in
+// tests. Packets put into inbound are read by the wrapper, and packets
+// written by the wrapper are kept in written.
+type testPacketConn struct {
+	net.PacketConn
+	inbound chan datagram
+	mutex   sync.Mutex
+	written []datagram
+}
+
+func newTestPacketConn() *testPacketConn {
+	return &testPacketConn{inbound: make(chan datagram, 1024)}
+}
+
+func (c *testPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	packet := <-c.inbound
+	return copy(p, packet.data), packet.addr, nil
+}
+
+func (c *testPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.written = append(c.written, datagram{append([]byte(nil), p...), addr})
+	return len(p), nil
+}
+
+// sent returns and forgets the packets that have been written.
+func (c *testPacketConn) sent() []datagram {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	written := c.written
+	c.written = nil
+	return written
+}
+
+func testAddr(n byte) types.PublicKey {
+	return types.PublicKey{n}
+}
+
+func reorderPacket(seq uint64, payload byte) []byte {
+	buf := make([]byte, reorderHeaderLength+1)
+	buf[0] = reorderMarker
+	binary.BigEndian.PutUint64(buf[1:reorderHeaderLength], seq)
+	buf[reorderHeaderLength] = payload
+	return buf
+}
+
+// readPayloads reads the given number of packets and returns the first byte
+// of each.
+func readPayloads(t *testing.T, conn net.PacketConn, count int) []byte {
+	t.Helper()
+	payloads := make([]byte, 0, count)
+	buf := make([]byte, types.MaxPayloadSize)
+	for i := 0; i < count; i++ {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n > 0 {
+			payloads = append(payloads, buf[0])
+		}
+	}
+	return payloads
+}
+
+func TestReorderTagging(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	inner := newTestPacketConn()
+	c := newReorderConn(ctx, inner, 4, time.Hour)
+	addr := testAddr(1)
+
+	// Nothing is tagged until a session agrees to use reordering, and the
+	// tags stop when the last such session closes.
+	write := func() {
+		if _, err := c.WriteTo([]byte{0x40}, addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write()
+	c.sessionOpened(addr)
+	c.sessionOpened(addr)
+	write()
+	write()
+	c.sessionClosed(addr)
+	write()
+	c.sessionClosed(addr)
+	write()
+	sent := inner.sent()
+	tagged := []bool{false, true, true, true, false}
+	if len(sent) != len(tagged) {
+		t.Fatalf("expected %d packets, got %d", len(tagged), len(sent))
+	}
+	for i, packet := range sent {
+		if got := packet.data[0] == reorderMarker; got != tagged[i] {
+			t.Fatalf("packet %d: expected tagged to be %v", i, tagged[i])
+		}
+		if tagged[i] {
+			if seq := binary.BigEndian.Uint64(packet.data[1:reorderHeaderLength]); seq != uint64(i-1) {
+				t.Fatalf("packet %d: expected sequence number %d, got %d", i, i-1, seq)
+			}
+		}
+	}
+}
+
+func TestReorderBuffer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	inner := newTestPacketConn()
+	c := newReorderConn(ctx, inner, 2, 200*time.Millisecond)
+	addr := testAddr(1)
+	receive := func(seqs ...uint64) {
+		for _, seq := range seqs {
+			inner.inbound <- datagram{reorderPacket(seq, byte(seq)), addr}
+		}
+	}
+
+	// Packets that arrive ahead of a gap wait for it to be filled, and
+	// untagged packets pass straight through.
+	receive(0, 2, 3)
+	inner.inbound <- datagram{[]byte{0x40}, addr}
+	receive(1)
+	if got := readPayloads(t, c, 5); string(got) != string([]byte{0, 0x40, 1, 2, 3}) {
+		t.Fatalf("expected the packets back in order, got %v", got)
+	}
+
+	// Holding more than the depth gives up on the gap straight away.
+	receive(5, 6, 7)
+	if got := readPayloads(t, c, 3); string(got) != string([]byte{5, 6, 7}) {
+		t.Fatalf("expected the held packets once the depth was passed, got %v", got)
+	}
+
+	// Otherwise the gap is given up on after the timeout, and the missing
+	// packet is passed on as late if it turns up afterwards.
+	receive(9)
+	if got := readPayloads(t, c, 1); got[0] != 9 {
+		t.Fatalf("expected the held packet after the timeout, got %v", got)
+	}
+	receive(8)
+	if got := readPayloads(t, c, 1); got[0] != 8 {
+		t.Fatalf("expected the late packet, got %v", got)
+	}
+
+	stats, ok := c.reorderStats(addr)
+	if !ok {
+		t.Fatalf("expected reordering statistics")
+	}
+	if stats.Reordered != 6 || stats.Skipped != 2 || stats.Late != 1 || stats.MaxDepth != 3 {
+		t.Fatalf("unexpected statistics %+v", stats)
+	}
+}
+
+func TestReorderBackpressure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	inner := newTestPacketConn()
+	c := newReorderConn(ctx, inner, 4, time.Millisecond)
+	addr := testAddr(1)
+	c.sessionOpened(addr)
+
+	// QUIC isn't reading, so the queue backs up, but that mustn't stop us
+	// from sending or from answering stats, including while the timer is
+	// trying to hand over held packets.
+	for seq := uint64(0); seq < reorderBacklog*4; seq += 2 {
+		inner.inbound <- datagram{reorderPacket(seq, 0), addr}
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			_, _ = c.WriteTo([]byte{0x40}, addr)
+			_, _ = c.reorderStats(addr)
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("blocked while QUIC wasn't reading")
+	}
+
+	// Everything is still handed over once QUIC catches up.
+	readPayloads(t, c, reorderBacklog*2)
+}
+
+func TestReorderBufferLimits(t *testing.T) {
+	c := &reorderConn{
+		depth:   4,
+		timeout: time.Hour,
+		peers:   map[string]*reorderPeer{},
+		buffers: map[string]*reorderBuffer{},
+	}
+	now := time.Now()
+	for i := 0; i < reorderMaxBuffers; i++ {
+		var addr types.PublicKey
+		binary.BigEndian.PutUint32(addr[:], uint32(i))
+		c._receive(0, []byte{1}, addr, now)
+	}
+	c.queue = nil
+
+	// Once full, packets from new nodes are passed through untouched until
+	// the state for nodes that have gone quiet can be thrown away.
+	extra := testAddr(0xff)
+	c._receive(1, []byte{1}, extra, now.Add(reorderIdleTimeout/2))
+	if _, ok := c.buffers[extra.String()]; ok || len(c.queue) != 1 {
+		t.Fatalf("expected the packet to be passed through without state")
+	}
+	c._receive(1, []byte{1}, extra, now.Add(reorderIdleTimeout))
+	if _, ok := c.buffers[extra.String()]; !ok || len(c.buffers) != 1 {
+		t.Fatalf("expected the idle state to be replaced, got %d buffers", len(c.buffers))
+	}
+
+	// The receive state goes when the last session using it closes.
+	c.sessionOpened(extra)
+	c.sessionClosed(extra)
+	if len(c.buffers) != 0 || len(c.peers) != 0 {
+		t.Fatalf("expected no state to be left behind")
+	}
+}
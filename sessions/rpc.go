@@ -0,0 +1,361 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sessions
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+// RPC connections carry requests and responses over a single session
+// stream, so that applications can build query protocols without each
+// inventing their own framing. Either end can make calls and many calls
+// can be in flight at once. Each request carries an ID chosen by the end
+// that made it, the name of the method and how long the caller is willing
+// to wait, and the answer is either a response or an error with the same
+// ID. A caller that gives up sends a cancellation, which cancels the
+// context of the handler on the other end.
+//
+// Every frame starts with a header made up of the frame type, the request
+// ID and the length of the body. The body of a request is the length of
+// the method name, the method name, the deadline in milliseconds (zero if
+// there isn't one) and then the payload. The body of a response is the
+// payload and the body of an error is the error message.
+
+const (
+	rpcFrameRequest = iota + 1
+	rpcFrameResponse
+	rpcFrameError
+	rpcFrameCancel
+)
+
+// rpcHeaderSize is the size of the frame type, request ID and body length.
+const rpcHeaderSize = 1 + 4 + 4
+
+// rpcMaxPayload is the largest request or response that can be sent.
+const rpcMaxPayload = 1 << 20
+
+// rpcMaxInflight is how many calls from the remote end we will handle at
+// once. Any more are answered with an error.
+const rpcMaxInflight = 64
+
+// ErrRPCClosed is returned by calls on an RPC connection that has closed.
+var ErrRPCClosed = errors.New("rpc connection closed")
+
+// RPCError is returned by a call when the handler on the remote end
+// returned an error.
+type RPCError struct {
+	Method  string
+	Message string
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("rpc %q: %s", e.Method, e.Message)
+}
+
+// RPCHandler answers calls from the remote end of an RPC connection. The
+// context is cancelled if the caller gives up or its deadline passes. The
+// error, if any, is sent back to the caller as an RPCError.
+type RPCHandler func(ctx context.Context, from types.PublicKey, method string, request []byte) ([]byte, error)
+
+type rpcResult struct {
+	payload []byte
+	err     error
+}
+
+// RPCConn is an RPC connection over a session stream.
+type RPCConn struct {
+	conn      net.Conn
+	remote    types.PublicKey
+	handler   RPCHandler
+	writeLock sync.Mutex // held while writing a frame
+	mutex     sync.Mutex
+	nextID    uint32                        // protected by mutex
+	pending   map[uint32]chan rpcResult     // protected by mutex
+	inflight  map[uint32]context.CancelFunc // protected by mutex
+	methods   map[uint32]string             // protected by mutex
+	err       error                         // protected by mutex
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewRPCConn starts an RPC connection over a stream opened with DialContext
+// or returned by Accept. Calls from the remote end are given to the handler,
+// which can be nil if we only make calls.
+func NewRPCConn(conn net.Conn, handler RPCHandler) *RPCConn {
+	c := &RPCConn{
+		conn:     conn,
+		handler:  handler,
+		pending:  map[uint32]chan rpcResult{},
+		inflight: map[uint32]context.CancelFunc{},
+		methods:  map[uint32]string{},
+		closed:   make(chan struct{}),
+	}
+	if remote, ok := conn.RemoteAddr().(types.PublicKey); ok {
+		c.remote = remote
+	}
+	go c.reader()
+	return c
+}
+
+// DialRPC opens a stream to the given node and starts an RPC connection
+// over it.
+func (s *SessionProtocol) DialRPC(ctx context.Context, to types.PublicKey, handler RPCHandler) (*RPCConn, error) {
+	conn, err := s.DialContext(ctx, "ed25519", net.JoinHostPort(to.String(), "0"))
+	if err != nil {
+		return nil, fmt.Errorf("s.DialContext: %w", err)
+	}
+	return NewRPCConn(conn, handler), nil
+}
+
+// ServeRPC accepts streams on the protocol and starts an RPC connection
+// over each of them with the given handler, until the protocol is closed.
+// Nothing else should accept streams on the same protocol.
+func (s *SessionProtocol) ServeRPC(handler RPCHandler) error {
+	for {
+		conn, err := s.Accept()
+		if err != nil {
+			return err
+		}
+		NewRPCConn(conn, handler)
+	}
+}
+
+// RemotePublicKey returns the public key of the remote end.
+func (c *RPCConn) RemotePublicKey() types.PublicKey {
+	return c.remote
+}
+
+// Done returns a channel that is closed when the connection closes.
+func (c *RPCConn) Done() <-chan struct{} {
+	return c.closed
+}
+
+// Close closes the connection. Calls that are still waiting return
+// ErrRPCClosed and handlers that are still running are cancelled.
+func (c *RPCConn) Close() error {
+	c.close(ErrRPCClosed)
+	return nil
+}
+
+func (c *RPCConn) close(err error) {
+	c.closeOnce.Do(func() {
+		c.mutex.Lock()
+		c.err = err
+		pending := make([]chan rpcResult, 0, len(c.pending))
+		for id, ch := range c.pending {
+			pending = append(pending, ch)
+			delete(c.pending, id)
+		}
+		for id, cancel := range c.inflight {
+			cancel()
+			delete(c.inflight, id)
+		}
+		c.mutex.Unlock()
+		for _, ch := range pending {
+			ch <- rpcResult{err: err}
+		}
+		close(c.closed)
+		_ = c.conn.Close()
+	})
+}
+
+// Call calls the method on the remote end and waits for the answer. The
+// deadline of the context, if any, is sent to the remote end, and the call
+// is cancelled on the remote end if the context ends first.
+func (c *RPCConn) Call(ctx context.Context, method string, request []byte) ([]byte, error) {
+	if len(method) > 255 {
+		return nil, fmt.Errorf("method name length %d exceeds maximum 255", len(method))
+	}
+	if len(request) > rpcMaxPayload {
+		return nil, fmt.Errorf("request length %d exceeds maximum %d", len(request), rpcMaxPayload)
+	}
+	var timeout uint32
+	if deadline, ok := ctx.Deadline(); ok {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, context.DeadlineExceeded
+		}
+		timeout = uint32((remaining + time.Millisecond - 1) / time.Millisecond)
+	}
+
+	result := make(chan rpcResult, 1)
+	c.mutex.Lock()
+	if c.err != nil {
+		c.mutex.Unlock()
+		return nil, c.err
+	}
+	c.nextID++
+	id := c.nextID
+	c.pending[id] = result
+	c.methods[id] = method
+	c.mutex.Unlock()
+	defer func() {
+		c.mutex.Lock()
+		delete(c.pending, id)
+		delete(c.methods, id)
+		c.mutex.Unlock()
+	}()
+
+	body := make([]byte, 0, 1+len(method)+4+len(request))
+	body = append(body, byte(len(method)))
+	body = append(body, method...)
+	body = append(body, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(body[len(body)-4:], timeout)
+	body = append(body, request...)
+	if err := c.writeFrame(rpcFrameRequest, id, body); err != nil {
+		return nil, err
+	}
+
+	select {
+	case res := <-result:
+		return res.payload, res.err
+	case <-ctx.Done():
+		_ = c.writeFrame(rpcFrameCancel, id, nil)
+		return nil, ctx.Err()
+	}
+}
+
+func (c *RPCConn) writeFrame(frameType byte, id uint32, body []byte) error {
+	header := make([]byte, rpcHeaderSize)
+	header[0] = frameType
+	binary.BigEndian.PutUint32(header[1:], id)
+	binary.BigEndian.PutUint32(header[5:], uint32(len(body)))
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if _, err := c.conn.Write(append(header, body...)); err != nil {
+		c.close(fmt.Errorf("%w: %s", ErrRPCClosed, err))
+		return fmt.Errorf("c.conn.Write: %w", err)
+	}
+	return nil
+}
+
+// reader reads frames from the stream until it fails or closes.
+func (c *RPCConn) reader() {
+	header := make([]byte, rpcHeaderSize)
+	for {
+		if _, err := io.ReadFull(c.conn, header); err != nil {
+			c.close(fmt.Errorf("%w: %s", ErrRPCClosed, err))
+			return
+		}
+		frameType := header[0]
+		id := binary.BigEndian.Uint32(header[1:])
+		length := binary.BigEndian.Uint32(header[5:])
+		if length > rpcMaxPayload+256+4 {
+			c.close(fmt.Errorf("%w: frame length %d exceeds maximum", ErrRPCClosed, length))
+			return
+		}
+		body := make([]byte, length)
+		if _, err := io.ReadFull(c.conn, body); err != nil {
+			c.close(fmt.Errorf("%w: %s", ErrRPCClosed, err))
+			return
+		}
+		switch frameType {
+		case rpcFrameRequest:
+			c.handle(id, body)
+		case rpcFrameResponse, rpcFrameError:
+			// Only the first answer to a call is delivered, so that the
+			// result channel never fills up.
+			c.mutex.Lock()
+			result, method := c.pending[id], c.methods[id]
+			delete(c.pending, id)
+			c.mutex.Unlock()
+			if result == nil {
+				// The call has already given up or been answered.
+				continue
+			}
+			if frameType == rpcFrameResponse {
+				result <- rpcResult{payload: body}
+			} else {
+				result <- rpcResult{err: &RPCError{Method: method, Message: string(body)}}
+			}
+		case rpcFrameCancel:
+			c.mutex.Lock()
+			if cancel := c.inflight[id]; cancel != nil {
+				cancel()
+			}
+			c.mutex.Unlock()
+		default:
+			c.close(fmt.Errorf("%w: unknown frame type %d", ErrRPCClosed, frameType))
+			return
+		}
+	}
+}
+
+// handle starts the handler for a request from the remote end.
+func (c *RPCConn) handle(id uint32, body []byte) {
+	if len(body) < 1 || len(body) < 1+int(body[0])+4 {
+		_ = c.writeFrame(rpcFrameError, id, []byte("malformed request"))
+		return
+	}
+	method := string(body[1 : 1+body[0]])
+	timeout := binary.BigEndian.Uint32(body[1+body[0]:])
+	request := body[1+int(body[0])+4:]
+	if c.handler == nil {
+		_ = c.writeFrame(rpcFrameError, id, []byte("not accepting calls"))
+		return
+	}
+
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), time.Duration(timeout)*time.Millisecond)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	c.mutex.Lock()
+	switch {
+	case c.err != nil:
+		c.mutex.Unlock()
+		cancel()
+		return
+	case len(c.inflight) >= rpcMaxInflight:
+		c.mutex.Unlock()
+		cancel()
+		_ = c.writeFrame(rpcFrameError, id, []byte("too many calls in flight"))
+		return
+	}
+	c.inflight[id] = cancel
+	c.mutex.Unlock()
+
+	go func() {
+		defer func() {
+			c.mutex.Lock()
+			delete(c.inflight, id)
+			c.mutex.Unlock()
+			cancel()
+		}()
+		response, err := c.handler(ctx, c.remote, method, request)
+		switch {
+		case ctx.Err() != nil:
+			// The caller has given up, or will have by the time that the
+			// answer reaches them.
+		case err != nil:
+			_ = c.writeFrame(rpcFrameError, id, []byte(err.Error()))
+		case len(response) > rpcMaxPayload:
+			_ = c.writeFrame(rpcFrameError, id, []byte("response too large"))
+		default:
+			_ = c.writeFrame(rpcFrameResponse, id, response)
+		}
+	}()
+}
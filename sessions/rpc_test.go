@@ -0,0 +1,112 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sessions
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// readRPCRequest reads a request frame from the remote end of an RPC
+// connection and returns its ID.
+func readRPCRequest(t *testing.T, conn net.Conn) uint32 {
+	t.Helper()
+	header := make([]byte, rpcHeaderSize)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Fatal(err)
+	}
+	if header[0] != rpcFrameRequest {
+		t.Fatalf("expected a request frame, got type %d", header[0])
+	}
+	body := make([]byte, binary.BigEndian.Uint32(header[5:]))
+	if _, err := io.ReadFull(conn, body); err != nil {
+		t.Fatal(err)
+	}
+	return binary.BigEndian.Uint32(header[1:])
+}
+
+func writeRPCResponse(t *testing.T, conn net.Conn, id uint32, payload string) {
+	t.Helper()
+	frame := make([]byte, rpcHeaderSize, rpcHeaderSize+len(payload))
+	frame[0] = rpcFrameResponse
+	binary.BigEndian.PutUint32(frame[1:], id)
+	binary.BigEndian.PutUint32(frame[5:], uint32(len(payload)))
+	if _, err := conn.Write(append(frame, payload...)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRPCDuplicateResponse(t *testing.T) {
+	ours, theirs := net.Pipe()
+	defer theirs.Close() // nolint:errcheck
+	c := NewRPCConn(ours, nil)
+	defer c.Close() // nolint:errcheck
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	// Answering a call more than once mustn't stop the reader, or the
+	// answers to later calls would never arrive.
+	for _, payload := range []string{"first", "second"} {
+		result := make(chan string, 1)
+		go func() {
+			response, err := c.Call(ctx, "test", nil)
+			if err != nil {
+				response = []byte(err.Error())
+			}
+			result <- string(response)
+		}()
+		id := readRPCRequest(t, theirs)
+		for i := 0; i < 3; i++ {
+			writeRPCResponse(t, theirs, id, payload)
+		}
+		if got := <-result; got != payload {
+			t.Fatalf("expected %q, got %q", payload, got)
+		}
+	}
+}
+
+func TestRPCClosePending(t *testing.T) {
+	ours, theirs := net.Pipe()
+	defer theirs.Close() // nolint:errcheck
+	c := NewRPCConn(ours, nil)
+
+	// Calls that are waiting for an answer give up when the connection
+	// closes.
+	result := make(chan error, 1)
+	go func() {
+		_, err := c.Call(context.Background(), "test", nil)
+		result <- err
+	}()
+	readRPCRequest(t, theirs)
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-result:
+		if !errors.Is(err, ErrRPCClosed) {
+			t.Fatalf("expected ErrRPCClosed, got %v", err)
+		}
+	case <-time.After(time.Second * 10):
+		t.Fatalf("call didn't return after the connection closed")
+	}
+	if _, err := c.Call(context.Background(), "test", nil); !errors.Is(err, ErrRPCClosed) {
+		t.Fatalf("expected ErrRPCClosed for a new call, got %v", err)
+	}
+}
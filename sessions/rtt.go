@@ -0,0 +1,69 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sessions
+
+import (
+	"context"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+	"github.com/quic-go/quic-go"
+)
+
+// sessionRTTInterval is how often we will measure the round trip time
+// to the remote side of an open session.
+const sessionRTTInterval = time.Second * 5
+
+// defaultHandshakeIdleTimeout matches the quic-go default.
+const defaultHandshakeIdleTimeout = time.Second * 5
+
+// measureRTT looks up the remote side of a session at regular intervals
+// until the session is closed, so that the router keeps an up-to-date
+// round trip time estimate for the destination. The path of the session is
+// checked at the same time, in case a change was missed.
+func (s *Sessions) measureRTT(ctx context.Context, proto string, public types.PublicKey, session *activeSession) {
+	ticker := time.NewTicker(sessionRTTInterval)
+	defer ticker.Stop()
+	for {
+		s.checkPath(proto, public, session)
+		lookupCtx, cancel := context.WithTimeout(ctx, sessionRTTInterval)
+		_, _ = s.r.Lookup(lookupCtx, public)
+		cancel()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// quicConfigFor returns the QUIC config to use when dialling the given
+// node. The quic-go retransmission timers are internal to each connection
+// and start from a fixed initial RTT, so if we already know that the path
+// is slow then we extend the handshake timeout to give the handshake a
+// fair chance of completing.
+func (s *Sessions) quicConfigFor(public types.PublicKey) *quic.Config {
+	rtt, ok := s.r.DestinationRTT(public)
+	if !ok {
+		return s.quicConfig
+	}
+	timeout := (rtt.Smoothed + 4*rtt.Variance) * 10
+	if timeout <= defaultHandshakeIdleTimeout {
+		return s.quicConfig
+	}
+	config := s.quicConfig.Clone()
+	config.HandshakeIdleTimeout = timeout
+	return config
+}
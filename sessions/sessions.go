@@ -29,13 +29,19 @@ import (
 	"sync"
 	"time"
 
+	"github.com/Arceliar/phony"
 	"github.com/matrix-org/pinecone/router"
+	"github.com/matrix-org/pinecone/router/events"
 	"github.com/matrix-org/pinecone/types"
 	"github.com/quic-go/quic-go"
+	"go.uber.org/atomic"
 )
 
 type Sessions struct {
 	r            *router.Router
+	conn         net.PacketConn              // the router, or a wrapper around it
+	reorder      *reorderConn                // the reorder buffer, if enabled
+	fec          *fecConn                    // forward error correction, if enabled
 	log          types.Logger                // logger
 	context      context.Context             // router context
 	cancel       context.CancelFunc          // shut down the router
@@ -44,25 +50,54 @@ type Sessions struct {
 	tlsServerCfg *tls.Config                 //
 	quicListener quic.Listener               //
 	quicConfig   *quic.Config                //
+	mailbox      *Mailbox                    // the mailbox, if enabled
+	early        *earlyData                  // early data, if enabled
+	features     sessionFeatures             // features that change the wire format
+
+	subscribersMutex sync.Mutex
+	subscribers      map[chan<- events.Event]*phony.Inbox // protected by subscribersMutex
+
+	onDead func(string, types.PublicKey) // called when a session dies, if set
 }
 
 type SessionProtocol struct {
 	s         *Sessions
 	proto     string
 	streams   chan net.Conn
-	sessions  sync.Map // types.PublicKey -> *activeSession
+	sessions  sync.Map               // types.PublicKey -> *activeSession
+	keepalive sync.Map               // types.PublicKey -> keepalive
+	tickets   tls.ClientSessionCache // session tickets, if early data is enabled
 	closeOnce sync.Once
 }
 
 type activeSession struct {
 	quic.Connection
 	sync.RWMutex
+	bytesSent     atomic.Uint64
+	bytesReceived atomic.Uint64
+	sendRate      bandwidthEstimator
+	recvRate      bandwidthEstimator
+	path          sessionPath
+}
+
+// SessionStats contains statistics about an open session.
+type SessionStats struct {
+	PublicKey        types.PublicKey
+	BytesSent        uint64        // Stream bytes written to the session
+	BytesReceived    uint64        // Stream bytes read from the session
+	SendBandwidth    uint64        // Estimated sending bandwidth in bytes per second
+	ReceiveBandwidth uint64        // Estimated receiving bandwidth in bytes per second
+	RTT              time.Duration // Smoothed round trip time to the remote node
+	RTTVariance      time.Duration // Mean deviation of the round trip time
+	Reordering       ReorderStats  // Reordering of received packets, if enabled
+	FEC              FECStats      // Forward error correction, if enabled
 }
 
-func NewSessions(log types.Logger, r *router.Router, protos []string) *Sessions {
+func NewSessions(log types.Logger, r *router.Router, protos []string, opts ...SessionOption) *Sessions {
 	ctx, cancel := context.WithCancel(context.Background())
 	s := &Sessions{
 		r:         r,
+		conn:      r,
 		log:       log,
 		context:   ctx,
 		cancel:    cancel,
@@ -72,28 +107,90 @@ func NewSessions(log types.Logger, r *router.Router, protos []string) *Sessions
 			DisablePathMTUDiscovery: true,
 		},
 	}
+	fecGroupSize := 0
+	var mailbox *SessionOptionMailbox
+	for _, opt := range opts {
+		switch v := opt.(type) {
+		case SessionOptionReorderWindow:
+			depth, timeout := v.Depth, v.Timeout
+			if depth <= 0 {
+				depth = defaultReorderDepth
+			}
+			if timeout <= 0 {
+				timeout = defaultReorderTimeout
+			}
+			s.reorder = newReorderConn(ctx, s.conn, depth, timeout)
+			s.conn = s.reorder
+			s.features |= featureReorder
+		case SessionOptionForwardErrorCorrection:
+			fecGroupSize = v.GroupSize
+			if fecGroupSize <= 0 {
+				fecGroupSize = defaultFECGroupSize
+			}
+			if fecGroupSize > maxFECGroupSize {
+				fecGroupSize = maxFECGroupSize
+			}
+		case SessionOptionMailbox:
+			mailbox = &v
+		case SessionOptionKeepalive:
+			newKeepalive(v.Interval, v.Timeout).apply(s.quicConfig)
+			s.onDead = v.OnDead
+		case SessionOptionEarlyData:
+			s.early = newEarlyData(v.ReplayWindow)
+			s.features |= featureEarlyData
+		}
+	}
+	if mailbox != nil {
+		protos = append(append([]string{}, protos...), MailboxProtocol)
+	}
+	if fecGroupSize > 0 {
+		// The parity packets have to go through the reorder buffer too,
+		// so forward error correction sits on top of it.
+		s.fec = newFECConn(ctx, s.conn, fecGroupSize)
+		s.conn = s.fec
+		s.features |= featureFEC
+	}
 	for _, proto := range protos {
 		s.protocols[proto] = &SessionProtocol{
 			s:       s,
 			proto:   proto,
 			streams: make(chan net.Conn, 1),
 		}
+		if s.early != nil {
+			s.protocols[proto].tickets = tls.NewLRUClientSessionCache(earlyDataTickets)
+		}
 	}
 
 	s.tlsCert = s.generateTLSCertificate()
 	s.tlsServerCfg = &tls.Config{
 		Certificates: []tls.Certificate{*s.tlsCert},
 		ClientAuth:   tls.RequireAnyClientCert,
-		NextProtos:   protos,
+	}
+	// Each protocol is offered with every combination of our features, so
+	// that we know which ones the remote side has too.
+	for _, proto := range protos {
+		s.tlsServerCfg.NextProtos = append(s.tlsServerCfg.NextProtos, protocolNames(proto, s.features)...)
 	}
 
 	var err error
-	s.quicListener, err = quic.Listen(r, s.tlsServerCfg, s.quicConfig)
+	if s.early != nil {
+		config := s.quicConfig.Clone()
+		config.Allow0RTT = func(net.Addr) bool { return true }
+		var listener quic.EarlyListener
+		listener, err = quic.ListenEarly(s.conn, s.tlsServerCfg, config)
+		s.quicListener = earlyListener{listener}
+	} else {
+		s.quicListener, err = quic.Listen(s.conn, s.tlsServerCfg, s.quicConfig)
+	}
 	if err != nil {
 		panic(fmt.Errorf("quic.NewSocketFromPacketConnNoClose: %w", err))
 	}
 
 	go s.listener()
+	go s.watchPaths()
+	if mailbox != nil {
+		s.mailbox = newMailbox(s, *mailbox)
+	}
 	return s
 }
 
@@ -119,6 +216,37 @@ func (s *SessionProtocol) Sessions() []ed25519.PublicKey {
 	return sessions
 }
 
+// SessionStats returns statistics for all of the open sessions.
+func (s *SessionProtocol) SessionStats() []SessionStats {
+	var stats []SessionStats
+	s.sessions.Range(func(k, v interface{}) bool {
+		pk, ok := k.(types.PublicKey)
+		if !ok {
+			return true
+		}
+		session := v.(*activeSession)
+		info := SessionStats{
+			PublicKey:        pk,
+			BytesSent:        session.bytesSent.Load(),
+			BytesReceived:    session.bytesReceived.Load(),
+			SendBandwidth:    session.sendRate.estimate(),
+			ReceiveBandwidth: session.recvRate.estimate(),
+		}
+		if rtt, ok := s.s.r.DestinationRTT(pk); ok {
+			info.RTT, info.RTTVariance = rtt.Smoothed, rtt.Variance
+		}
+		if s.s.reorder != nil {
+			info.Reordering, _ = s.s.reorder.reorderStats(pk)
+		}
+		if s.s.fec != nil {
+			info.FEC = s.s.fec.fecStats(pk)
+		}
+		stats = append(stats, info)
+		return true
+	})
+	return stats
+}
+
 func (p *SessionProtocol) getSession(pk types.PublicKey) (*activeSession, bool) {
 	v, ok := p.sessions.LoadOrStore(pk, &activeSession{})
 	return v.(*activeSession), ok
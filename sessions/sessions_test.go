@@ -0,0 +1,89 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sessions
+
+import (
+	"context"
+	"crypto/ed25519"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/router"
+)
+
+// newTestRouter starts a router that isn't peered with anything.
+func newTestRouter(t *testing.T) *router.Router {
+	_, sk, _ := ed25519.GenerateKey(nil)
+	r := router.NewRouter(nil, sk)
+	t.Cleanup(func() {
+		_ = r.Close()
+	})
+	return r
+}
+
+// newTestRouterPair starts two routers that are peered with each other and
+// waits until they can route to each other.
+func newTestRouterPair(t *testing.T) (r1, r2 *router.Router) {
+	r1, r2 = newTestRouter(t), newTestRouter(t)
+
+	// net.Pipe is unbuffered, so both sides of the handshake would block
+	// on writing, so use a real loopback connection instead.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		if c, err := listener.Accept(); err == nil {
+			_, _ = r1.Connect(c)
+		}
+	}()
+	c, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r2.Connect(c); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second * 10)
+	for {
+		explanation, err := r1.NextHop(r2.PublicKey())
+		if err == nil && explanation.Found && explanation.PublicKey == r2.PublicKey() {
+			return r1, r2
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("routers didn't find each other")
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+}
+
+// newTestSessions returns sessions on top of the router that don't listen
+// for QUIC connections, for testing what happens around the sessions.
+func newTestSessions(t *testing.T, r *router.Router) *Sessions {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return &Sessions{
+		r:         r,
+		log:       log.New(io.Discard, "", 0),
+		context:   ctx,
+		cancel:    cancel,
+		protocols: map[string]*SessionProtocol{},
+	}
+}
@@ -22,13 +22,25 @@ import (
 
 type Stream struct {
 	quic.Stream
-	connection quic.Connection
+	session *activeSession
+}
+
+func (s *Stream) Read(b []byte) (int, error) {
+	n, err := s.Stream.Read(b)
+	s.session.bytesReceived.Add(uint64(n))
+	return n, err
+}
+
+func (s *Stream) Write(b []byte) (int, error) {
+	n, err := s.Stream.Write(b)
+	s.session.bytesSent.Add(uint64(n))
+	return n, err
 }
 
 func (s *Stream) LocalAddr() net.Addr {
-	return s.connection.LocalAddr()
+	return s.session.LocalAddr()
 }
 
 func (s *Stream) RemoteAddr() net.Addr {
-	return s.connection.RemoteAddr()
+	return s.session.RemoteAddr()
 }
@@ -0,0 +1,165 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+)
+
+// Every hop adds a 64 byte ed25519 signature to a root announcement, so in
+// deep trees the announcements get big. Ed25519 signatures can't be
+// combined, but in a closed deployment where every node holds the same
+// network secret, the hops can instead authenticate the announcement with
+// an aggregate MAC: each hop computes a MAC over the announcement so far
+// using a key derived from the secret and its own public key, and XORs it
+// into a single tag. Anyone with the secret can check the tag by working
+// out the MAC of every hop again. The tag is a fixed size, so each hop
+// only adds its port and public key to the announcement.
+//
+// This only proves that the hops were added by holders of the secret, not
+// by the nodes whose keys they carry, so it is only suitable where every
+// node that holds the secret is trusted, e.g. alongside peering
+// certificates.
+//
+// An aggregated announcement is encoded as the root key and sequence, the
+// tag, and then the port and public key of each hop.
+
+// AggregateSignatureSize is the size of the tag on an aggregated
+// announcement.
+const AggregateSignatureSize = sha256.Size
+
+// AggregateSignature is the tag on an aggregated announcement.
+type AggregateSignature [AggregateSignatureSize]byte
+
+func (s *AggregateSignature) xor(mac []byte) {
+	for i := range s {
+		s[i] ^= mac[i]
+	}
+}
+
+// AggregateKey is the network secret used to authenticate aggregated
+// announcements.
+type AggregateKey []byte
+
+// hopKey returns the key that the node with the given public key uses for
+// its hops.
+func (k AggregateKey) hopKey(public PublicKey) []byte {
+	mac := hmac.New(sha256.New, k)
+	_, _ = mac.Write(public[:])
+	return mac.Sum(nil)
+}
+
+// hopMAC returns the MAC of a hop, which covers the encoded announcement up
+// to and including the hop.
+func (k AggregateKey) hopMAC(public PublicKey, body []byte) []byte {
+	mac := hmac.New(sha256.New, k.hopKey(public))
+	_, _ = mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// SignAggregate adds a hop to the announcement for the given node and
+// port, and folds its MAC into the aggregate signature.
+func (a *SwitchAnnouncement) SignAggregate(key AggregateKey, public PublicKey, forPort SwitchPortID) error {
+	a.Signatures = append(a.Signatures, SignatureWithHop{
+		Hop:       Varu64(forPort),
+		PublicKey: public,
+	})
+	var body [65535]byte
+	n, err := a.MarshalAggregateBinary(body[:])
+	if err != nil {
+		a.Signatures = a.Signatures[:len(a.Signatures)-1]
+		return fmt.Errorf("a.MarshalAggregateBinary: %w", err)
+	}
+	mac := key.hopMAC(public, a.withoutAggregate(body[:n]))
+	a.Aggregate.xor(mac)
+	return nil
+}
+
+// withoutAggregate returns the encoded announcement with the aggregate
+// signature cut out, which is what the MACs cover.
+func (a *SwitchAnnouncement) withoutAggregate(data []byte) []byte {
+	offset := ed25519.PublicKeySize + a.RootSequence.Length()
+	body := make([]byte, 0, len(data)-AggregateSignatureSize)
+	body = append(body, data[:offset]...)
+	return append(body, data[offset+AggregateSignatureSize:]...)
+}
+
+func (a *SwitchAnnouncement) MarshalAggregateBinary(buffer []byte) (int, error) {
+	if len(buffer) < a.Root.Length()+AggregateSignatureSize {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	offset := copy(buffer, a.RootPublicKey[:])
+	n, err := a.RootSequence.MarshalBinary(buffer[offset:])
+	if err != nil {
+		return 0, fmt.Errorf("a.RootSequence.MarshalBinary: %w", err)
+	}
+	offset += n
+	offset += copy(buffer[offset:], a.Aggregate[:])
+	for _, sig := range a.Signatures {
+		n, err := sig.Hop.MarshalBinary(buffer[offset:])
+		if err != nil {
+			return 0, fmt.Errorf("sig.Hop.MarshalBinary: %w", err)
+		}
+		offset += n
+		if len(buffer)-offset < ed25519.PublicKeySize {
+			return 0, fmt.Errorf("buffer too small")
+		}
+		offset += copy(buffer[offset:], sig.PublicKey[:])
+	}
+	return offset, nil
+}
+
+// UnmarshalAggregateBinary decodes an aggregated announcement and checks
+// the aggregate signature with the given key.
+func (a *SwitchAnnouncement) UnmarshalAggregateBinary(data []byte, key AggregateKey) (int, error) {
+	expected := ed25519.PublicKeySize + 1 + AggregateSignatureSize
+	if size := len(data); size < expected {
+		return 0, fmt.Errorf("expecting at least %d bytes, got %d bytes", expected, size)
+	}
+	remaining := data[copy(a.RootPublicKey[:], data):]
+	l, err := a.RootSequence.UnmarshalBinary(remaining)
+	if err != nil {
+		return 0, fmt.Errorf("a.RootSequence.UnmarshalBinary: %w", err)
+	}
+	remaining = remaining[l:]
+	if len(remaining) < AggregateSignatureSize {
+		return 0, fmt.Errorf("expecting aggregate signature")
+	}
+	remaining = remaining[copy(a.Aggregate[:], remaining):]
+	body := a.withoutAggregate(data)
+	var expectedTag AggregateSignature
+	for len(remaining) > 0 {
+		var sig SignatureWithHop
+		l, err := sig.Hop.UnmarshalBinary(remaining)
+		if err != nil {
+			return 0, fmt.Errorf("sig.Hop.UnmarshalBinary: %w", err)
+		}
+		remaining = remaining[l:]
+		if len(remaining) < ed25519.PublicKeySize {
+			return 0, fmt.Errorf("expecting public key for hop %d", sig.Hop)
+		}
+		remaining = remaining[copy(sig.PublicKey[:], remaining):]
+		a.Signatures = append(a.Signatures, sig)
+		mac := key.hopMAC(sig.PublicKey, body[:len(body)-len(remaining)])
+		expectedTag.xor(mac)
+	}
+	if !hmac.Equal(expectedTag[:], a.Aggregate[:]) {
+		return 0, fmt.Errorf("aggregate signature verification failed")
+	}
+	return len(data), nil
+}
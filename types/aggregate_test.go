@@ -0,0 +1,92 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"crypto/ed25519"
+	"testing"
+)
+
+func TestMarshalUnmarshalAggregateAnnouncement(t *testing.T) {
+	key := AggregateKey("network secret")
+	input := &SwitchAnnouncement{
+		Root: Root{
+			RootSequence: 1,
+		},
+	}
+	signed := &SwitchAnnouncement{Root: input.Root}
+	for i := 0; i < 8; i++ {
+		pk, sk, _ := ed25519.GenerateKey(nil)
+		var public PublicKey
+		copy(public[:], pk)
+		if i == 0 {
+			input.RootPublicKey = public
+			signed.RootPublicKey = public
+		}
+		if err := input.SignAggregate(key, public, SwitchPortID(i+1)); err != nil {
+			t.Fatal(err)
+		}
+		if err := signed.Sign(sk, SwitchPortID(i+1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buffer [65535]byte
+	n, err := input.MarshalAggregateBinary(buffer[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var output SwitchAnnouncement
+	if _, err = output.UnmarshalAggregateBinary(buffer[:n], key); err != nil {
+		t.Fatal(err)
+	}
+	if !output.Root.EqualTo(&input.Root) || output.Aggregate != input.Aggregate {
+		t.Fatalf("root or aggregate signature doesn't match")
+	}
+	if !output.Coords().EqualTo(input.Coords()) {
+		t.Fatalf("coords don't match: %v != %v", output.Coords(), input.Coords())
+	}
+	for i := range input.Signatures {
+		if output.Signatures[i].PublicKey != input.Signatures[i].PublicKey {
+			t.Fatalf("public key for hop %d doesn't match", i)
+		}
+	}
+
+	// The aggregate signature is a fixed size, so the announcement should
+	// be much smaller than one with a signature for every hop.
+	s, err := signed.MarshalBinary(buffer[n:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s-n < (len(input.Signatures)-1)*ed25519.SignatureSize {
+		t.Fatalf("aggregated announcement is %d bytes, signed announcement is %d bytes", n, s)
+	}
+
+	// Changing any hop or using the wrong key must fail verification.
+	var wrong SwitchAnnouncement
+	if _, err = wrong.UnmarshalAggregateBinary(buffer[:n], AggregateKey("wrong secret")); err == nil {
+		t.Fatalf("announcement with wrong key should have failed verification")
+	}
+	buffer[n-ed25519.PublicKeySize-1]++
+	wrong = SwitchAnnouncement{}
+	if _, err = wrong.UnmarshalAggregateBinary(buffer[:n], key); err == nil {
+		t.Fatalf("tampered announcement should have failed verification")
+	}
+	buffer[n-ed25519.PublicKeySize-1]--
+	wrong = SwitchAnnouncement{}
+	if _, err = wrong.UnmarshalAggregateBinary(buffer[:n-ed25519.PublicKeySize-1], key); err == nil {
+		t.Fatalf("truncated announcement should have failed verification")
+	}
+}
@@ -35,7 +35,8 @@ func (r *Root) MinLength() int {
 
 type SwitchAnnouncement struct {
 	Root
-	Signatures []SignatureWithHop
+	Signatures []SignatureWithHop `json:"signatures"`
+	Aggregate  AggregateSignature `json:"-"` // Only set on aggregated announcements
 }
 
 func (a *SwitchAnnouncement) Sign(privKey ed25519.PrivateKey, forPort SwitchPortID) error {
@@ -84,21 +85,29 @@ func (a *SwitchAnnouncement) UnmarshalBinary(data []byte) (int, error) {
 }
 
 func (a *SwitchAnnouncement) MarshalBinary(buffer []byte) (int, error) {
-	offset := 0
-	offset += copy(buffer[offset:], a.RootPublicKey[:]) // a.RootPublicKey
-	dn, err := a.RootSequence.MarshalBinary(buffer[offset:])
+	return marshalInto(buffer, a)
+}
+
+func (a *SwitchAnnouncement) AppendBinary(b []byte) ([]byte, error) {
+	b = append(b, a.RootPublicKey[:]...)
+	b, err := a.RootSequence.AppendBinary(b)
 	if err != nil {
-		return 0, fmt.Errorf("a.Sequence.MarshalBinary: %w", err)
+		return nil, fmt.Errorf("a.Sequence.AppendBinary: %w", err)
 	}
-	offset += dn
-	for _, sig := range a.Signatures {
-		n, err := sig.MarshalBinary(buffer[offset:])
-		if err != nil {
-			return 0, fmt.Errorf("sig.MarshalBinary: %w", err)
+	for i := range a.Signatures {
+		if b, err = a.Signatures[i].AppendBinary(b); err != nil {
+			return nil, fmt.Errorf("sig.AppendBinary: %w", err)
 		}
-		offset += n
 	}
-	return offset, nil
+	return b, nil
+}
+
+// Reset clears the announcement so that it can be decoded into again,
+// keeping the room for signatures.
+func (a *SwitchAnnouncement) Reset() {
+	a.Root = Root{}
+	a.Signatures = a.Signatures[:0]
+	a.Aggregate = AggregateSignature{}
 }
 
 func (a *SwitchAnnouncement) SanityCheck(from PublicKey) error {
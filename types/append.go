@@ -0,0 +1,59 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import "fmt"
+
+// The announcements and SNEK payloads are encoded and decoded on every
+// protocol frame on every hop, so they are written to be append-style: the
+// encoding is appended to the given slice and the extended slice returned,
+// in the same way as the strconv.Append functions. Nothing is allocated so
+// long as the slice has room, which it will when it is the payload of a
+// pooled frame, since frames are handed out with a full-sized payload
+// buffer. MarshalBinary is still there for the existing callers, and just
+// appends into the front of the buffer it is given.
+//
+// Decoding the same types doesn't allocate either, other than to grow the
+// slices in the value being decoded into. Values that are reused, e.g. by
+// keeping them in a pool, keep the capacity of their slices when Reset.
+
+// BinaryAppender is a wire type that can append its encoding to a slice.
+type BinaryAppender interface {
+	AppendBinary(b []byte) ([]byte, error)
+}
+
+// marshalInto appends the encoding of the value to the front of the buffer
+// and returns how long it is, or an error if the buffer is too small.
+func marshalInto(buf []byte, a BinaryAppender) (int, error) {
+	b, err := a.AppendBinary(buf[:0:len(buf)])
+	if err != nil {
+		return 0, err
+	}
+	if len(b) > len(buf) {
+		return 0, fmt.Errorf("buffer too small, need %d bytes but have %d", len(b), len(buf))
+	}
+	return len(b), nil
+}
+
+// AppendPayload replaces the payload of the frame with the encoding of the
+// value, reusing the payload buffer of the frame.
+func (f *Frame) AppendPayload(a BinaryAppender) error {
+	payload, err := a.AppendBinary(f.Payload[:0])
+	if err != nil {
+		return err
+	}
+	f.Payload = payload
+	return nil
+}
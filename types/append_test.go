@@ -0,0 +1,160 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"testing"
+)
+
+func testAnnouncement(tb testing.TB, hops int) *SwitchAnnouncement {
+	pkr, _, _ := ed25519.GenerateKey(nil)
+	a := &SwitchAnnouncement{
+		Root: Root{RootSequence: 12345},
+	}
+	copy(a.RootPublicKey[:], pkr)
+	for i := 1; i <= hops; i++ {
+		_, sk, _ := ed25519.GenerateKey(nil)
+		if err := a.Sign(sk, SwitchPortID(i*100)); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return a
+}
+
+func TestAppendBinaryMatchesMarshalBinary(t *testing.T) {
+	var pk PublicKey
+	copy(pk[:], "abcdefghijklmnopqrstuvwxyz123456")
+	values := []interface {
+		BinaryAppender
+		MarshalBinary([]byte) (int, error)
+	}{
+		Varu64(300),
+		Coordinates{1, 2, 300, 70000},
+		testAnnouncement(t, 3),
+		&VirtualSnakeBootstrap{Sequence: 99, Root: Root{RootPublicKey: pk, RootSequence: 7}},
+		&VirtualSnakeBootstrapACK{PublicKey: pk, Sequence: 1 << 40},
+		&VirtualSnakeBootstrapConfirm{Sequence: 5},
+	}
+	for _, v := range values {
+		var buf [MaxFrameSize]byte
+		n, err := v.MarshalBinary(buf[:])
+		if err != nil {
+			t.Fatalf("%T: %s", v, err)
+		}
+		prefix := []byte{0xff}
+		appended, err := v.AppendBinary(prefix)
+		if err != nil {
+			t.Fatalf("%T: %s", v, err)
+		}
+		if !bytes.Equal(appended[1:], buf[:n]) || appended[0] != 0xff {
+			t.Fatalf("%T: appended %x, marshalled %x", v, appended[1:], buf[:n])
+		}
+		if _, err := v.MarshalBinary(buf[:n-1]); err == nil {
+			t.Fatalf("%T: expected an error for a short buffer", v)
+		}
+	}
+}
+
+func TestAppendBinaryDoesNotAllocate(t *testing.T) {
+	announcement := testAnnouncement(t, 4)
+	buf := make([]byte, 0, MaxFrameSize)
+	if allocs := testing.AllocsPerRun(100, func() {
+		_, _ = announcement.AppendBinary(buf)
+	}); allocs != 0 {
+		t.Fatalf("expected no allocations, got %.0f", allocs)
+	}
+	frame := &Frame{Payload: buf}
+	bootstrap := &VirtualSnakeBootstrap{Sequence: 99}
+	if allocs := testing.AllocsPerRun(100, func() {
+		_ = frame.AppendPayload(bootstrap)
+	}); allocs != 0 {
+		t.Fatalf("expected no allocations, got %.0f", allocs)
+	}
+}
+
+func TestSwitchAnnouncementReset(t *testing.T) {
+	payload, err := testAnnouncement(t, 3).AppendBinary(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var a SwitchAnnouncement
+	for i := 0; i < 2; i++ {
+		a.Reset()
+		if _, err := a.UnmarshalBinary(payload); err != nil {
+			t.Fatal(err)
+		}
+		if len(a.Signatures) != 3 {
+			t.Fatalf("expected 3 signatures, got %d", len(a.Signatures))
+		}
+	}
+}
+
+func BenchmarkAnnouncementEncode(b *testing.B) {
+	announcement := testAnnouncement(b, 4)
+	buf := make([]byte, 0, MaxFrameSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := announcement.AppendBinary(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkAnnouncementDecode(b *testing.B) {
+	b.Setenv("PINECONE_DISABLE_SIGNATURES", "1")
+	payload, err := testAnnouncement(b, 4).AppendBinary(nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	var announcement SwitchAnnouncement
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		announcement.Reset()
+		if _, err := announcement.UnmarshalBinary(payload); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkBootstrapEncode(b *testing.B) {
+	bootstrap := &VirtualSnakeBootstrap{Sequence: 1 << 40, Root: Root{RootSequence: 12345}}
+	frame := &Frame{Payload: make([]byte, 0, MaxFrameSize)}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := frame.AppendPayload(bootstrap); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkBootstrapDecode(b *testing.B) {
+	payload, err := (&VirtualSnakeBootstrap{Sequence: 1 << 40, Root: Root{RootSequence: 12345}}).AppendBinary(nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	var bootstrap VirtualSnakeBootstrap
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := bootstrap.UnmarshalBinary(payload); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -20,9 +20,9 @@ import (
 )
 
 type WakeupBroadcast struct {
-	Sequence Varu64
+	Sequence Varu64 `json:"sequence"`
 	Root
-	Signature [ed25519.SignatureSize]byte
+	Signature Signature `json:"signature"`
 }
 
 func (w *WakeupBroadcast) ProtectedPayload() ([]byte, error) {
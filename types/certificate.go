@@ -0,0 +1,186 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"math"
+	"time"
+)
+
+// certificateSigningContext is signed along with certificates, so that the
+// signatures can't be mistaken for ones over anything else.
+const certificateSigningContext = "pinecone certificate"
+
+// Certificate states that the issuer allows the subject to join a closed
+// network. Expiry is in seconds since the Unix epoch, or zero if the
+// certificate never expires.
+type Certificate struct {
+	Subject   PublicKey `json:"subject"`
+	Issuer    PublicKey `json:"issuer"`
+	Expiry    Varu64    `json:"expiry"`
+	Signature Signature `json:"signature"`
+}
+
+// IssueCertificate creates a certificate for the subject signed by the
+// issuer. A zero expiry time means that the certificate never expires.
+func IssueCertificate(issuer PrivateKey, subject PublicKey, expiry time.Time) Certificate {
+	c := Certificate{
+		Subject: subject,
+		Issuer:  issuer.Public(),
+	}
+	if !expiry.IsZero() {
+		c.Expiry = Varu64(expiry.Unix())
+	}
+	copy(c.Signature[:], ed25519.Sign(issuer[:], c.ProtectedPayload()))
+	return c
+}
+
+func (c *Certificate) ProtectedPayload() []byte {
+	buffer := make([]byte, len(certificateSigningContext)+ed25519.PublicKeySize*2+c.Expiry.Length())
+	offset := copy(buffer, certificateSigningContext)
+	offset += copy(buffer[offset:], c.Subject[:])
+	offset += copy(buffer[offset:], c.Issuer[:])
+	n, _ := c.Expiry.MarshalBinary(buffer[offset:])
+	return buffer[:offset+n]
+}
+
+// Verify checks that the certificate was signed by its issuer and that it
+// hasn't expired.
+func (c *Certificate) Verify(now time.Time) error {
+	if !ed25519.Verify(c.Issuer[:], c.ProtectedPayload(), c.Signature[:]) {
+		return fmt.Errorf("certificate for %s has an invalid signature", c.Subject)
+	}
+	if c.Expiry != 0 && now.Unix() >= int64(c.Expiry) {
+		return fmt.Errorf("certificate for %s has expired", c.Subject)
+	}
+	return nil
+}
+
+func (c *Certificate) Length() int {
+	return ed25519.PublicKeySize*2 + c.Expiry.Length() + ed25519.SignatureSize
+}
+
+func (c *Certificate) MarshalBinary(buf []byte) (int, error) {
+	if len(buf) < c.Length() {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	offset := 0
+	offset += copy(buf[offset:], c.Subject[:])
+	offset += copy(buf[offset:], c.Issuer[:])
+	n, err := c.Expiry.MarshalBinary(buf[offset:])
+	if err != nil {
+		return 0, fmt.Errorf("c.Expiry.MarshalBinary: %w", err)
+	}
+	offset += n
+	offset += copy(buf[offset:], c.Signature[:])
+	return offset, nil
+}
+
+func (c *Certificate) UnmarshalBinary(buf []byte) (int, error) {
+	if len(buf) < ed25519.PublicKeySize*2+c.Expiry.MinLength()+ed25519.SignatureSize {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	offset := 0
+	offset += copy(c.Subject[:], buf[offset:])
+	offset += copy(c.Issuer[:], buf[offset:])
+	n, err := c.Expiry.UnmarshalBinary(buf[offset:])
+	if err != nil {
+		return 0, fmt.Errorf("c.Expiry.UnmarshalBinary: %w", err)
+	}
+	offset += n
+	if len(buf) < offset+ed25519.SignatureSize {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	offset += copy(c.Signature[:], buf[offset:])
+	return offset, nil
+}
+
+// CertificateChain is a list of certificates, starting with the one for
+// the node itself, where each certificate is issued by the subject of the
+// next one and the last is issued by the authority.
+type CertificateChain []Certificate
+
+// MaxCertificateChainLength is the longest chain that can be marshalled.
+const MaxCertificateChainLength = math.MaxUint8
+
+// Verify checks that the chain belongs to the given subject and leads back
+// to the given authority.
+func (c CertificateChain) Verify(subject, authority PublicKey, now time.Time) error {
+	if len(c) == 0 {
+		return fmt.Errorf("empty certificate chain")
+	}
+	if c[0].Subject != subject {
+		return fmt.Errorf("certificate chain is for %s, not %s", c[0].Subject, subject)
+	}
+	for i := range c {
+		if err := c[i].Verify(now); err != nil {
+			return err
+		}
+		if i < len(c)-1 && c[i].Issuer != c[i+1].Subject {
+			return fmt.Errorf("certificate chain is broken after %s", c[i].Subject)
+		}
+	}
+	if c[len(c)-1].Issuer != authority {
+		return fmt.Errorf("certificate chain isn't issued by the authority")
+	}
+	return nil
+}
+
+func (c CertificateChain) Length() int {
+	l := 1
+	for i := range c {
+		l += c[i].Length()
+	}
+	return l
+}
+
+func (c CertificateChain) MarshalBinary(buf []byte) (int, error) {
+	if len(c) > MaxCertificateChainLength {
+		return 0, fmt.Errorf("certificate chain too long")
+	}
+	if len(buf) < c.Length() {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	buf[0] = byte(len(c))
+	offset := 1
+	for i := range c {
+		n, err := c[i].MarshalBinary(buf[offset:])
+		if err != nil {
+			return 0, fmt.Errorf("c[%d].MarshalBinary: %w", i, err)
+		}
+		offset += n
+	}
+	return offset, nil
+}
+
+func (c *CertificateChain) UnmarshalBinary(buf []byte) (int, error) {
+	if len(buf) < 1 {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	count := int(buf[0])
+	offset := 1
+	chain := make(CertificateChain, count)
+	for i := range chain {
+		n, err := chain[i].UnmarshalBinary(buf[offset:])
+		if err != nil {
+			return 0, fmt.Errorf("chain[%d].UnmarshalBinary: %w", i, err)
+		}
+		offset += n
+	}
+	*c = chain
+	return offset, nil
+}
@@ -0,0 +1,89 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"crypto/ed25519"
+	"testing"
+	"time"
+)
+
+func newTestKey(t *testing.T) PrivateKey {
+	_, sk, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var key PrivateKey
+	copy(key[:], sk)
+	return key
+}
+
+func TestCertificateChain(t *testing.T) {
+	authority, intermediate, node, other := newTestKey(t), newTestKey(t), newTestKey(t), newTestKey(t)
+	now := time.Now()
+	chain := CertificateChain{
+		IssueCertificate(intermediate, node.Public(), now.Add(time.Hour)),
+		IssueCertificate(authority, intermediate.Public(), time.Time{}),
+	}
+	if err := chain.Verify(node.Public(), authority.Public(), now); err != nil {
+		t.Fatalf("valid chain failed to verify: %s", err)
+	}
+
+	buf := make([]byte, chain.Length())
+	n, err := chain.MarshalBinary(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded CertificateChain
+	if _, err := decoded.UnmarshalBinary(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if err := decoded.Verify(node.Public(), authority.Public(), now); err != nil {
+		t.Fatalf("decoded chain failed to verify: %s", err)
+	}
+
+	if err := chain.Verify(other.Public(), authority.Public(), now); err == nil {
+		t.Fatalf("chain verified for the wrong subject")
+	}
+	if err := chain.Verify(node.Public(), other.Public(), now); err == nil {
+		t.Fatalf("chain verified for the wrong authority")
+	}
+	if err := chain.Verify(node.Public(), authority.Public(), now.Add(time.Hour*2)); err == nil {
+		t.Fatalf("expired chain verified")
+	}
+	if err := chain[:1].Verify(node.Public(), authority.Public(), now); err == nil {
+		t.Fatalf("incomplete chain verified")
+	}
+	forged := CertificateChain{
+		IssueCertificate(other, node.Public(), time.Time{}),
+		chain[1],
+	}
+	if err := forged.Verify(node.Public(), authority.Public(), now); err == nil {
+		t.Fatalf("broken chain verified")
+	}
+	if _, err := decoded.UnmarshalBinary(buf[:n-1]); err == nil {
+		t.Fatalf("truncated chain unmarshalled")
+	}
+
+	// A signature by the authority over the same fields, but for some
+	// other purpose, isn't a certificate.
+	unrelated := Certificate{Subject: node.Public(), Issuer: authority.Public()}
+	fields := append(append([]byte{}, unrelated.Subject[:]...), unrelated.Issuer[:]...)
+	fields, _ = unrelated.Expiry.AppendBinary(fields)
+	copy(unrelated.Signature[:], ed25519.Sign(authority[:], fields))
+	if err := unrelated.Verify(now); err == nil {
+		t.Fatalf("signature without the signing context verified")
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+// TrafficClass tells each node along the path how urgent a traffic frame
+// is. It is carried in the Extra byte of the frame header, which nodes that
+// don't know about traffic classes leave alone, so it survives the whole
+// path. Frames from nodes that don't set a class are interactive.
+type TrafficClass uint8
+
+const (
+	TrafficClassInteractive TrafficClass = iota // e.g. messages and sync, the default
+	TrafficClassControl                         // e.g. session setup and signalling
+	TrafficClassBulk                            // e.g. media and file transfers
+	TrafficClassBackground                      // e.g. backfill and prefetching
+)
+
+// TrafficClasses is the number of traffic classes.
+const TrafficClasses = 4
+
+// trafficClassMask selects the bits of the Extra byte that hold the class,
+// leaving the rest free for future use.
+const trafficClassMask = 0x03
+
+// datagramFlag is set in the Extra byte of traffic frames that are
+// datagrams, which are delivered to the application separately from the
+// traffic read with ReadFrom.
+const datagramFlag = 0x04
+
+// routingPreferenceMask selects the bits of the Extra byte that hold the
+// routing preference of traffic frames.
+const routingPreferenceMask = 0x18
+
+// routingPreferenceShift is how far the routing preference is shifted up
+// within the Extra byte.
+const routingPreferenceShift = 3
+
+// RoutingPreference tells each node along the path how to route a traffic
+// frame that carries both tree coordinates and a public key. Like the
+// traffic class, it is carried in the Extra byte of the frame header.
+// Frames from nodes that don't set a preference prefer the tree.
+type RoutingPreference uint8
+
+const (
+	RoutingPreferTree RoutingPreference = iota // Tree if the coordinates are known, otherwise SNEK, the default
+	RoutingPreferSNEK                          // SNEK, falling back to the tree if SNEK has nowhere to go
+	RoutingTreeOnly                            // Tree only, dropped if the tree has nowhere to go
+	RoutingSNEKOnly                            // SNEK only, the coordinates are ignored
+)
+
+func (p RoutingPreference) String() string {
+	switch p {
+	case RoutingPreferTree:
+		return "prefer_tree"
+	case RoutingPreferSNEK:
+		return "prefer_snek"
+	case RoutingTreeOnly:
+		return "tree_only"
+	case RoutingSNEKOnly:
+		return "snek_only"
+	default:
+		return "unknown"
+	}
+}
+
+func (c TrafficClass) String() string {
+	switch c {
+	case TrafficClassInteractive:
+		return "interactive"
+	case TrafficClassControl:
+		return "control"
+	case TrafficClassBulk:
+		return "bulk"
+	case TrafficClassBackground:
+		return "background"
+	default:
+		return "unknown"
+	}
+}
+
+// TrafficClass returns the traffic class of a traffic frame. Custody frames
+// can wait, so they are background traffic, and protocol frames are always
+// treated as control traffic.
+func (f *Frame) TrafficClass() TrafficClass {
+	switch f.Type {
+	case TypeTraffic:
+	case TypeCustody:
+		return TrafficClassBackground
+	default:
+		return TrafficClassControl
+	}
+	return TrafficClass(f.Extra & trafficClassMask)
+}
+
+// SetTrafficClass sets the traffic class of a traffic frame.
+func (f *Frame) SetTrafficClass(c TrafficClass) {
+	if f.Type != TypeTraffic {
+		return
+	}
+	f.Extra = (f.Extra &^ trafficClassMask) | (byte(c) & trafficClassMask)
+}
+
+// IsDatagram returns true if the traffic frame is a datagram.
+func (f *Frame) IsDatagram() bool {
+	return f.Type == TypeTraffic && f.Extra&datagramFlag != 0
+}
+
+// SetDatagram marks a traffic frame as a datagram.
+func (f *Frame) SetDatagram() {
+	if f.Type != TypeTraffic {
+		return
+	}
+	f.Extra |= datagramFlag
+}
+
+// RoutingPreference returns the routing preference of a traffic frame.
+// Other frames always prefer the tree.
+func (f *Frame) RoutingPreference() RoutingPreference {
+	if f.Type != TypeTraffic {
+		return RoutingPreferTree
+	}
+	return RoutingPreference((f.Extra & routingPreferenceMask) >> routingPreferenceShift)
+}
+
+// SetRoutingPreference sets the routing preference of a traffic frame.
+func (f *Frame) SetRoutingPreference(p RoutingPreference) {
+	if f.Type != TypeTraffic {
+		return
+	}
+	f.Extra = (f.Extra &^ routingPreferenceMask) | ((byte(p) << routingPreferenceShift) & routingPreferenceMask)
+}
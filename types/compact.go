@@ -0,0 +1,236 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// Compact frames are an alternative encoding for the frames that carry
+// coordinates, which are most of the frames on a busy network. They use
+// Version2 and the same header as a Version0 frame, but after the header:
+//
+//   - the payload length is a Varu64 rather than 16 bits
+//   - a flags byte says whether the watermark is included
+//   - the destination coordinates are a Varu64 count of Varu64 ports
+//   - the source coordinates are a Varu64 count of the ports that they
+//     share with the start of the destination coordinates, followed by the
+//     rest of the ports in the same form as the destination coordinates
+//   - the keys follow as usual
+//   - the watermark is left out if it is the default, i.e. the full mask
+//     and sequence number zero, since the receiver can fill that in
+//
+// Both sets of coordinates come from the same tree, so they often share a
+// long prefix. Compact frames must only be sent to peers that agreed to
+// accept them in the handshake.
+
+// compactWatermark is set in the flags of a compact frame if the watermark
+// is included.
+const compactWatermark = 1 << 0
+
+// HasCompactEncoding returns true if frames of this type can be sent as
+// compact frames.
+func (t FrameType) HasCompactEncoding() bool {
+	switch t {
+	case TypeTraffic, TypeEchoRequest, TypeEchoReply, TypeContinuity, TypeBootstrapConfirm, TypeCustody, TypeCustodyReceipt, TypeSNEKAdjacency, TypeNodeInfoRequest, TypeNodeInfoResponse, TypeDebugRequest, TypeDebugResponse, TypeSearchRequest, TypeSearchResponse:
+		return true
+	default:
+		return false
+	}
+}
+
+func (f *Frame) marshalCompact(buffer []byte) (int, error) {
+	if !f.Type.HasCompactEncoding() {
+		return 0, fmt.Errorf("frame type %s has no compact encoding", f.Type)
+	}
+	if len(f.Payload) > MaxPayloadSize {
+		return 0, fmt.Errorf("payload length %d exceeds maximum %d", len(f.Payload), MaxPayloadSize)
+	}
+	copy(buffer[:4], FrameMagicBytes)
+	buffer[4], buffer[5] = byte(f.Version), byte(f.Type)
+	buffer[6] = f.Extra
+	buffer[7] = f.HopLimit
+	w := compactWriter{buf: buffer, offset: FrameHeaderLength}
+	w.varu64(uint64(len(f.Payload)))
+	var flags byte
+	watermark := len(f.Destination) == 0 && (f.Watermark.PublicKey != FullMask || f.Watermark.Sequence != 0)
+	if watermark {
+		flags |= compactWatermark
+	}
+	w.bytes([]byte{flags})
+	w.coords(f.Destination)
+	shared := 0
+	for shared < len(f.Source) && shared < len(f.Destination) && f.Source[shared] == f.Destination[shared] {
+		shared++
+	}
+	w.varu64(uint64(shared))
+	w.coords(f.Source[shared:])
+	w.bytes(f.DestinationKey[:ed25519.PublicKeySize])
+	w.bytes(f.SourceKey[:ed25519.PublicKeySize])
+	if watermark {
+		w.bytes(f.Watermark.PublicKey[:ed25519.PublicKeySize])
+		w.varu64(uint64(f.Watermark.Sequence))
+	}
+	w.bytes(f.Payload)
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.offset > math.MaxUint16 {
+		return 0, fmt.Errorf("frame contents too large")
+	}
+	binary.BigEndian.PutUint16(buffer[FrameHeaderLength-2:FrameHeaderLength], uint16(w.offset))
+	return w.offset, nil
+}
+
+func (f *Frame) unmarshalCompact(data []byte) (int, error) {
+	f.Version, f.Type = FrameVersion(data[4]), FrameType(data[5])
+	f.Extra = data[6]
+	f.HopLimit = data[7]
+	payload, err := f.decodeCompact(data)
+	if err != nil {
+		return 0, err
+	}
+	if len(payload) > cap(f.Payload) {
+		return 0, fmt.Errorf("payload length exceeds frame capacity")
+	}
+	f.Payload = f.Payload[:len(payload)]
+	copy(f.Payload, payload)
+	return len(data), nil
+}
+
+// decodeCompact decodes the body of a compact frame, apart from the
+// payload, which is returned instead. The frame length in the header must
+// already have been checked.
+func (f *Frame) decodeCompact(data []byte) ([]byte, error) {
+	if t := FrameType(data[5]); !t.HasCompactEncoding() {
+		return nil, &UnknownFrameTypeError{t}
+	}
+	r := strictReader{data: data, offset: FrameHeaderLength}
+	payloadLen := r.varu64("payload length")
+	start := r.offset
+	r.skip("flags", 1)
+	if r.err != nil {
+		return nil, r.err
+	}
+	flags := data[start]
+	f.useCoordsRoom()
+	f.Destination = r.compactCoords("destination coordinates", f.Destination, nil)
+	shared := r.varu64("shared source coordinates")
+	if r.err == nil && shared > uint64(len(f.Destination)) {
+		return nil, fmt.Errorf("source shares %d ports with %d destination ports", shared, len(f.Destination))
+	}
+	f.Source = r.compactCoords("source coordinates", f.Source, f.Destination[:shared])
+	if r.err == nil {
+		f.keepCoordsRoom()
+	}
+	start = r.offset
+	r.skip("destination key", ed25519.PublicKeySize)
+	r.skip("source key", ed25519.PublicKeySize)
+	if r.err != nil {
+		return nil, r.err
+	}
+	copy(f.DestinationKey[:], data[start:])
+	copy(f.SourceKey[:], data[start+ed25519.PublicKeySize:])
+	f.Watermark = VirtualSnakeWatermark{
+		PublicKey: FullMask,
+		Sequence:  0,
+	}
+	if flags&compactWatermark != 0 {
+		start = r.offset
+		r.skip("watermark key", ed25519.PublicKeySize)
+		sequence := r.varu64("watermark sequence")
+		if r.err != nil {
+			return nil, r.err
+		}
+		copy(f.Watermark.PublicKey[:], data[start:])
+		f.Watermark.Sequence = Varu64(sequence)
+	}
+	if payloadLen > MaxPayloadSize {
+		return nil, fmt.Errorf("payload length %d exceeds maximum %d", payloadLen, MaxPayloadSize)
+	}
+	start = r.offset
+	r.skip("payload", int(payloadLen))
+	if r.err != nil {
+		return nil, r.err
+	}
+	if remaining := len(data) - r.offset; remaining > 0 {
+		return nil, &TrailingBytesError{"frame", remaining}
+	}
+	return data[start:r.offset], nil
+}
+
+// compactCoords reads a count of ports followed by the ports themselves,
+// and returns them after the given prefix, reusing the room in into.
+func (r *strictReader) compactCoords(field string, into, prefix Coordinates) Coordinates {
+	count := r.count(field)
+	if r.err != nil {
+		return nil
+	}
+	coords := into[:0]
+	if cap(coords) < len(prefix)+count {
+		coords = make(Coordinates, 0, len(prefix)+count)
+	}
+	coords = append(coords, prefix...)
+	for i := 0; i < count; i++ {
+		port := r.varu64(field)
+		if r.err != nil {
+			return nil
+		}
+		coords = append(coords, SwitchPortID(port))
+	}
+	return coords
+}
+
+// compactWriter builds up an encoded structure, remembering the first
+// error that it encounters so that the callers don't have to check after
+// every step.
+type compactWriter struct {
+	buf    []byte
+	offset int
+	err    error
+}
+
+func (w *compactWriter) bytes(b []byte) {
+	if w.err != nil {
+		return
+	}
+	if len(w.buf)-w.offset < len(b) {
+		w.err = fmt.Errorf("buffer too small")
+		return
+	}
+	w.offset += copy(w.buf[w.offset:], b)
+}
+
+func (w *compactWriter) varu64(v uint64) {
+	if w.err != nil {
+		return
+	}
+	n, err := Varu64(v).MarshalBinary(w.buf[w.offset:])
+	if err != nil {
+		w.err = fmt.Errorf("Varu64.MarshalBinary: %w", err)
+		return
+	}
+	w.offset += n
+}
+
+func (w *compactWriter) coords(c Coordinates) {
+	w.varu64(uint64(len(c)))
+	for _, port := range c {
+		w.varu64(uint64(port))
+	}
+}
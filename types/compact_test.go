@@ -0,0 +1,164 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"testing"
+)
+
+func TestMarshalUnmarshalCompactFrame(t *testing.T) {
+	src, _, _ := ed25519.GenerateKey(nil)
+	dst, _, _ := ed25519.GenerateKey(nil)
+	for _, tc := range []struct {
+		destination Coordinates
+		source      Coordinates
+		watermark   VirtualSnakeWatermark
+	}{
+		{Coordinates{1, 2, 3, 4}, Coordinates{1, 2, 5}, VirtualSnakeWatermark{PublicKey: FullMask}},
+		{Coordinates{1, 2}, Coordinates{1, 2, 3, 4}, VirtualSnakeWatermark{PublicKey: FullMask}},
+		{Coordinates{}, Coordinates{7, 300, 1}, VirtualSnakeWatermark{PublicKey: FullMask}},
+		{Coordinates{}, Coordinates{}, VirtualSnakeWatermark{Sequence: 9}},
+	} {
+		input := Frame{
+			Version:     Version2,
+			Type:        TypeTraffic,
+			HopLimit:    4,
+			Destination: tc.destination,
+			Source:      tc.source,
+			Watermark:   tc.watermark,
+			Payload:     []byte("HELLO!"),
+		}
+		copy(input.DestinationKey[:], dst)
+		copy(input.SourceKey[:], src)
+		if tc.watermark.PublicKey != FullMask {
+			copy(input.Watermark.PublicKey[:], src)
+		}
+
+		buf := make([]byte, MaxFrameSize)
+		n, err := input.MarshalBinary(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := checkFrame(buf[:n]); err != nil {
+			t.Fatalf("strict check failed: %v", err)
+		}
+
+		output := Frame{Payload: make([]byte, 0, MaxPayloadSize)}
+		if _, err := output.UnmarshalBinary(buf[:n]); err != nil {
+			t.Fatal(err)
+		}
+		if output.Version != Version2 || output.Type != TypeTraffic || output.HopLimit != 4 {
+			t.Fatalf("header wasn't decoded properly")
+		}
+		if !output.Destination.EqualTo(input.Destination) || !output.Source.EqualTo(input.Source) {
+			t.Fatalf("coordinates weren't decoded properly: %v %v", output.Destination, output.Source)
+		}
+		if output.DestinationKey != input.DestinationKey || output.SourceKey != input.SourceKey {
+			t.Fatalf("keys weren't decoded properly")
+		}
+		if len(tc.destination) == 0 && output.Watermark != input.Watermark {
+			t.Fatalf("watermark wasn't decoded properly")
+		}
+		if !bytes.Equal(output.Payload, input.Payload) {
+			t.Fatalf("payload wasn't decoded properly")
+		}
+	}
+}
+
+func TestCompactFrameIsSmaller(t *testing.T) {
+	input := Frame{
+		Type:        TypeTraffic,
+		Destination: Coordinates{1, 4, 2, 7, 3},
+		Source:      Coordinates{1, 4, 2, 6},
+		Watermark:   VirtualSnakeWatermark{PublicKey: FullMask},
+		Payload:     []byte("HELLO!"),
+	}
+	buf := make([]byte, MaxFrameSize)
+	input.Version = Version0
+	normal, err := input.MarshalBinary(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input.Version = Version2
+	compact, err := input.MarshalBinary(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if compact >= normal {
+		t.Fatalf("compact frame is %d bytes, normal frame is %d bytes", compact, normal)
+	}
+
+	// Without coordinates the normal encoding always carries the
+	// watermark, which the compact one leaves out if it is the default.
+	input.Destination = nil
+	input.Version = Version0
+	normal, _ = input.MarshalBinary(buf)
+	input.Version = Version2
+	compact, _ = input.MarshalBinary(buf)
+	if normal-compact < ed25519.PublicKeySize {
+		t.Fatalf("compact frame is %d bytes, normal frame is %d bytes", compact, normal)
+	}
+}
+
+func TestCompactFrameRejectsBadInput(t *testing.T) {
+	input := Frame{
+		Version:     Version2,
+		Type:        TypeTraffic,
+		Destination: Coordinates{1, 2},
+		Source:      Coordinates{1, 2, 3},
+		Payload:     []byte("HELLO!"),
+	}
+	buf := make([]byte, MaxFrameSize)
+	n, err := input.MarshalBinary(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var output Frame
+	output.Payload = make([]byte, 0, MaxPayloadSize)
+
+	// The source can't share more ports than the destination has. The
+	// shared count comes after the length, flags and destination.
+	bad := append([]byte{}, buf[:n]...)
+	bad[FrameHeaderLength+1+1+3] = 3
+	if _, err := output.UnmarshalBinary(bad); err == nil {
+		t.Fatalf("frame with too many shared ports shouldn't have been unmarshalled")
+	}
+	if err := checkFrame(bad); err == nil {
+		t.Fatalf("frame with too many shared ports shouldn't have passed strict checks")
+	}
+
+	// Truncated frames must be rejected.
+	bad = append([]byte{}, buf[:n-1]...)
+	bad[FrameHeaderLength-1]--
+	if _, err := output.UnmarshalBinary(bad); err == nil {
+		t.Fatalf("truncated frame shouldn't have been unmarshalled")
+	}
+	if err := checkFrame(bad); err == nil {
+		t.Fatalf("truncated frame shouldn't have passed strict checks")
+	}
+
+	// Only frames that carry coordinates have a compact encoding.
+	input.Type = TypeBootstrap
+	if _, err := input.MarshalBinary(buf); err == nil {
+		t.Fatalf("compact bootstrap frame shouldn't have been marshalled")
+	}
+	bad = append([]byte{}, buf[:n]...)
+	bad[5] = byte(TypeBootstrap)
+	if err := checkFrame(bad); err == nil {
+		t.Fatalf("compact bootstrap frame shouldn't have passed strict checks")
+	}
+}
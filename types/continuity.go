@@ -0,0 +1,111 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"time"
+)
+
+// continuitySigningContext is signed along with continuity records, so
+// that the signatures can't be mistaken for ones over anything else.
+const continuitySigningContext = "pinecone continuity"
+
+// ContinuityRecord links a retired node identity to the identity that
+// replaced it. It is signed by both keys, so it can only be made by someone
+// who holds both private keys. Issued is in milliseconds since the Unix
+// epoch and is used to choose between conflicting records.
+type ContinuityRecord struct {
+	Old          PublicKey `json:"old"`
+	New          PublicKey `json:"new"`
+	Issued       Varu64    `json:"issued"`
+	OldSignature Signature `json:"old_signature"`
+	NewSignature Signature `json:"new_signature"`
+}
+
+// NewContinuityRecord creates a record linking the old key to the new key.
+func NewContinuityRecord(old, new PrivateKey, issued time.Time) ContinuityRecord {
+	r := ContinuityRecord{
+		Old:    old.Public(),
+		New:    new.Public(),
+		Issued: Varu64(issued.UnixMilli()),
+	}
+	protected := r.ProtectedPayload()
+	copy(r.OldSignature[:], ed25519.Sign(old[:], protected))
+	copy(r.NewSignature[:], ed25519.Sign(new[:], protected))
+	return r
+}
+
+func (r *ContinuityRecord) ProtectedPayload() []byte {
+	buffer := make([]byte, len(continuitySigningContext)+ed25519.PublicKeySize*2+r.Issued.Length())
+	offset := copy(buffer, continuitySigningContext)
+	offset += copy(buffer[offset:], r.Old[:])
+	offset += copy(buffer[offset:], r.New[:])
+	n, _ := r.Issued.MarshalBinary(buffer[offset:])
+	return buffer[:offset+n]
+}
+
+// Verify checks that the record was signed by both keys.
+func (r *ContinuityRecord) Verify() error {
+	if r.Old == r.New {
+		return fmt.Errorf("continuity record links a key to itself")
+	}
+	protected := r.ProtectedPayload()
+	if !ed25519.Verify(r.Old[:], protected, r.OldSignature[:]) {
+		return fmt.Errorf("continuity record has an invalid signature from the old key")
+	}
+	if !ed25519.Verify(r.New[:], protected, r.NewSignature[:]) {
+		return fmt.Errorf("continuity record has an invalid signature from the new key")
+	}
+	return nil
+}
+
+func (r *ContinuityRecord) MarshalBinary(buf []byte) (int, error) {
+	if len(buf) < ed25519.PublicKeySize*2+r.Issued.Length()+ed25519.SignatureSize*2 {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	offset := 0
+	offset += copy(buf[offset:], r.Old[:])
+	offset += copy(buf[offset:], r.New[:])
+	n, err := r.Issued.MarshalBinary(buf[offset:])
+	if err != nil {
+		return 0, fmt.Errorf("r.Issued.MarshalBinary: %w", err)
+	}
+	offset += n
+	offset += copy(buf[offset:], r.OldSignature[:])
+	offset += copy(buf[offset:], r.NewSignature[:])
+	return offset, nil
+}
+
+func (r *ContinuityRecord) UnmarshalBinary(buf []byte) (int, error) {
+	if len(buf) < ed25519.PublicKeySize*2+r.Issued.MinLength()+ed25519.SignatureSize*2 {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	offset := 0
+	offset += copy(r.Old[:], buf[offset:])
+	offset += copy(r.New[:], buf[offset:])
+	n, err := r.Issued.UnmarshalBinary(buf[offset:])
+	if err != nil {
+		return 0, fmt.Errorf("r.Issued.UnmarshalBinary: %w", err)
+	}
+	offset += n
+	if len(buf) < offset+ed25519.SignatureSize*2 {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	offset += copy(r.OldSignature[:], buf[offset:])
+	offset += copy(r.NewSignature[:], buf[offset:])
+	return offset, nil
+}
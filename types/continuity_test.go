@@ -0,0 +1,64 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"crypto/ed25519"
+	"testing"
+	"time"
+)
+
+func TestContinuityRecord(t *testing.T) {
+	old, new, other := newTestKey(t), newTestKey(t), newTestKey(t)
+	record := NewContinuityRecord(old, new, time.Now())
+	if err := record.Verify(); err != nil {
+		t.Fatalf("valid record failed to verify: %s", err)
+	}
+
+	buf := make([]byte, 512)
+	n, err := record.MarshalBinary(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded ContinuityRecord
+	if _, err := decoded.UnmarshalBinary(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if decoded != record {
+		t.Fatalf("wrong record (got %+v, expected %+v)", decoded, record)
+	}
+
+	forged := record
+	forged.New = other.Public()
+	if err := forged.Verify(); err == nil {
+		t.Fatalf("record with a substituted new key verified")
+	}
+	hijacked := NewContinuityRecord(other, new, time.Now())
+	hijacked.Old = old.Public()
+	if err := hijacked.Verify(); err == nil {
+		t.Fatalf("record without the old key's signature verified")
+	}
+
+	// Signatures by both keys over the same fields, but for some other
+	// purpose, aren't a continuity record.
+	unrelated := ContinuityRecord{Old: old.Public(), New: new.Public(), Issued: record.Issued}
+	fields := append(append([]byte{}, unrelated.Old[:]...), unrelated.New[:]...)
+	fields, _ = unrelated.Issued.AppendBinary(fields)
+	copy(unrelated.OldSignature[:], ed25519.Sign(old[:], fields))
+	copy(unrelated.NewSignature[:], ed25519.Sign(new[:], fields))
+	if err := unrelated.Verify(); err == nil {
+		t.Fatalf("signatures without the signing context verified")
+	}
+}
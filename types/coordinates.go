@@ -16,7 +16,9 @@ package types
 
 import (
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"strconv"
 	"strings"
 )
 
@@ -48,19 +50,36 @@ func (s Coordinates) String() string {
 }
 
 func (p Coordinates) MarshalBinary(buf []byte) (int, error) {
-	l := 2
+	// This doesn't use marshalInto, since converting the slice to an
+	// interface would allocate, and coordinates are marshalled twice for
+	// every frame that is routed on the tree.
+	b, err := p.AppendBinary(buf[:0:len(buf)])
+	if err != nil {
+		return 0, err
+	}
+	if len(b) > len(buf) {
+		return 0, fmt.Errorf("buffer too small, need %d bytes but have %d", len(b), len(buf))
+	}
+	return len(b), nil
+}
+
+func (p Coordinates) AppendBinary(b []byte) ([]byte, error) {
+	start := len(b)
+	b = append(b, 0, 0)
 	for _, a := range p {
-		n, err := Varu64(a).MarshalBinary(buf[l:])
-		if err != nil {
-			return 0, fmt.Errorf("Varu64(a).MarshalBinary: %w", err)
+		var err error
+		if b, err = Varu64(a).AppendBinary(b); err != nil {
+			return nil, fmt.Errorf("Varu64(a).AppendBinary: %w", err)
 		}
-		l += n
 	}
-	binary.BigEndian.PutUint16(buf[:2], uint16(l-2))
-	return l, nil
+	binary.BigEndian.PutUint16(b[start:start+2], uint16(len(b)-start-2))
+	return b, nil
 }
 
 func (p *Coordinates) UnmarshalBinary(b []byte) (int, error) {
+	if rl := len(b); rl < 2 {
+		return 0, fmt.Errorf("expecting at least 2 bytes but got %d bytes", rl)
+	}
 	l := int(binary.BigEndian.Uint16(b[:2]))
 	if l == 0 {
 		return 2, nil
@@ -68,7 +87,12 @@ func (p *Coordinates) UnmarshalBinary(b []byte) (int, error) {
 	if rl := len(b); rl < 2+l {
 		return 0, fmt.Errorf("expecting %d bytes but got %d bytes", 2+l, rl)
 	}
-	ports := make(Coordinates, 0, l)
+	// Reuse the room in the coordinates that we are decoding into, if
+	// there is any. There can't be more ports than there are bytes.
+	ports := (*p)[:0]
+	if cap(ports) < l {
+		ports = make(Coordinates, 0, l)
+	}
 	read := 2
 	b = b[read : l+2]
 	for {
@@ -96,6 +120,33 @@ func (p Coordinates) MarshalJSON() ([]byte, error) {
 	return []byte(`"[` + strings.Join(s, " ") + `]"`), nil
 }
 
+// UnmarshalJSON accepts either the string form produced by MarshalJSON,
+// e.g. "[1 2 3]", or a plain JSON array of port numbers.
+func (p *Coordinates) UnmarshalJSON(data []byte) error {
+	var ports []SwitchPortID
+	if err := json.Unmarshal(data, &ports); err == nil {
+		*p = append(Coordinates{}, ports...)
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	if !strings.HasPrefix(s, "[") || !strings.HasSuffix(s, "]") {
+		return fmt.Errorf("coordinates %q not enclosed in brackets", s)
+	}
+	coords := Coordinates{}
+	for _, f := range strings.Fields(s[1 : len(s)-1]) {
+		port, err := strconv.ParseUint(f, 10, 64)
+		if err != nil {
+			return fmt.Errorf("strconv.ParseUint: %w", err)
+		}
+		coords = append(coords, SwitchPortID(port))
+	}
+	*p = coords
+	return nil
+}
+
 func (p Coordinates) EqualTo(o Coordinates) bool {
 	if len(p) != len(o) {
 		return false
@@ -112,12 +163,17 @@ func (a *Coordinates) Copy() Coordinates {
 	return append(Coordinates{}, *a...)
 }
 
+// DistanceTo returns the number of hops across the tree between the two
+// coordinates, going up to their common ancestor and back down again.
 func (a Coordinates) DistanceTo(b Coordinates) int {
-	ancestor := getCommonPrefix(a, b)
+	ancestor := a.CommonPrefixLength(b)
 	return len(a) + len(b) - 2*ancestor
 }
 
-func getCommonPrefix(a, b Coordinates) int {
+// CommonPrefixLength returns the number of leading ports that the two
+// coordinates have in common, which is the depth of their closest common
+// ancestor in the tree.
+func (a Coordinates) CommonPrefixLength(b Coordinates) int {
 	c := 0
 	l := len(a)
 	if len(b) < l {
@@ -131,3 +187,68 @@ func getCommonPrefix(a, b Coordinates) int {
 	}
 	return c
 }
+
+// CommonAncestor returns the coordinates of the closest node in the tree
+// that is an ancestor of, or equal to, both coordinates.
+func (a Coordinates) CommonAncestor(b Coordinates) Coordinates {
+	return append(Coordinates{}, a[:a.CommonPrefixLength(b)]...)
+}
+
+// Depth returns how many hops the coordinates are away from the root.
+func (a Coordinates) Depth() int {
+	return len(a)
+}
+
+// IsRoot returns true if the coordinates are those of the root node.
+func (a Coordinates) IsRoot() bool {
+	return len(a) == 0
+}
+
+// Parent returns the coordinates of the parent node in the tree. The root
+// node has no parent, in which case false is returned.
+func (a Coordinates) Parent() (Coordinates, bool) {
+	if len(a) == 0 {
+		return nil, false
+	}
+	return append(Coordinates{}, a[:len(a)-1]...), true
+}
+
+// Child returns the coordinates of the child that is reached through the
+// given port of this node.
+func (a Coordinates) Child(port SwitchPortID) Coordinates {
+	child := make(Coordinates, len(a), len(a)+1)
+	copy(child, a)
+	return append(child, port)
+}
+
+// IsAncestorOf returns true if the node with these coordinates is on the
+// path from the root to the node with the other coordinates. A node is not
+// considered to be an ancestor of itself.
+func (a Coordinates) IsAncestorOf(b Coordinates) bool {
+	return len(a) < len(b) && a.CommonPrefixLength(b) == len(a)
+}
+
+// IsDescendantOf returns true if the node with the other coordinates is an
+// ancestor of the node with these coordinates.
+func (a Coordinates) IsDescendantOf(b Coordinates) bool {
+	return b.IsAncestorOf(a)
+}
+
+// Compare orders coordinates by their ports, as in a depth-first walk of
+// the tree where lower ports are visited first. It returns -1, 0 or +1.
+func (a Coordinates) Compare(b Coordinates) int {
+	c := a.CommonPrefixLength(b)
+	switch {
+	case c < len(a) && c < len(b):
+		if a[c] < b[c] {
+			return -1
+		}
+		return 1
+	case len(a) < len(b):
+		return -1
+	case len(a) > len(b):
+		return 1
+	default:
+		return 0
+	}
+}
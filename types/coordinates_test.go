@@ -16,6 +16,7 @@ package types
 
 import (
 	"bytes"
+	"encoding/json"
 	"testing"
 )
 
@@ -66,3 +67,92 @@ func TestSwitchPortDistances(t *testing.T) {
 		t.Fatalf("distance from root to other should be 7, got %d", dist)
 	}
 }
+
+func TestCoordinatesJSON(t *testing.T) {
+	input := Coordinates{1, 2, 3, 4000}
+	j, err := json.Marshal(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var output Coordinates
+	if err := json.Unmarshal(j, &output); err != nil {
+		t.Fatal(err)
+	}
+	if !input.EqualTo(output) {
+		t.Fatalf("Expected %v, got %v", input, output)
+	}
+	if err := json.Unmarshal([]byte(`[5, 6]`), &output); err != nil {
+		t.Fatal(err)
+	}
+	if !output.EqualTo(Coordinates{5, 6}) {
+		t.Fatalf("Expected [5 6], got %v", output)
+	}
+}
+
+func TestCoordinatesCommonAncestor(t *testing.T) {
+	a := Coordinates{1, 2, 3, 4}
+	b := Coordinates{1, 2, 5}
+	if l := a.CommonPrefixLength(b); l != 2 {
+		t.Fatalf("expected common prefix length 2, got %d", l)
+	}
+	if c := a.CommonAncestor(b); !c.EqualTo(Coordinates{1, 2}) {
+		t.Fatalf("expected common ancestor [1 2], got %v", c)
+	}
+	if c := a.CommonAncestor(Coordinates{}); !c.IsRoot() {
+		t.Fatalf("expected common ancestor with root to be root, got %v", c)
+	}
+	if c := a.CommonAncestor(a); !c.EqualTo(a) {
+		t.Fatalf("expected common ancestor with self to be self, got %v", c)
+	}
+}
+
+func TestCoordinatesParentChild(t *testing.T) {
+	us := Coordinates{1, 2, 3}
+	parent, ok := us.Parent()
+	if !ok || !parent.EqualTo(Coordinates{1, 2}) {
+		t.Fatalf("expected parent [1 2], got %v", parent)
+	}
+	if _, ok := (Coordinates{}).Parent(); ok {
+		t.Fatal("root should not have a parent")
+	}
+	child := us.Child(7)
+	if !child.EqualTo(Coordinates{1, 2, 3, 7}) {
+		t.Fatalf("expected child [1 2 3 7], got %v", child)
+	}
+	if !us.EqualTo(Coordinates{1, 2, 3}) {
+		t.Fatalf("deriving a child modified the original coordinates: %v", us)
+	}
+	if child.Depth() != 4 {
+		t.Fatalf("expected child depth 4, got %d", child.Depth())
+	}
+	if !parent.IsAncestorOf(child) || !child.IsDescendantOf(parent) {
+		t.Fatal("parent should be an ancestor of the child")
+	}
+	if child.IsAncestorOf(parent) || us.IsAncestorOf(us) {
+		t.Fatal("unexpected ancestry")
+	}
+	if (Coordinates{1, 3}).IsAncestorOf(child) {
+		t.Fatal("sibling branch should not be an ancestor")
+	}
+}
+
+func TestCoordinatesCompare(t *testing.T) {
+	for _, tc := range []struct {
+		a, b     Coordinates
+		expected int
+	}{
+		{Coordinates{}, Coordinates{}, 0},
+		{Coordinates{1, 2}, Coordinates{1, 2}, 0},
+		{Coordinates{}, Coordinates{1}, -1},
+		{Coordinates{1}, Coordinates{1, 1}, -1},
+		{Coordinates{1, 2}, Coordinates{1, 1, 5}, 1},
+		{Coordinates{2}, Coordinates{1, 9, 9}, 1},
+	} {
+		if got := tc.a.Compare(tc.b); got != tc.expected {
+			t.Fatalf("%v compared to %v: expected %d, got %d", tc.a, tc.b, tc.expected, got)
+		}
+		if got := tc.b.Compare(tc.a); got != -tc.expected {
+			t.Fatalf("%v compared to %v: expected %d, got %d", tc.b, tc.a, -tc.expected, got)
+		}
+	}
+}
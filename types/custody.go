@@ -0,0 +1,154 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"crypto/ed25519"
+	"fmt"
+)
+
+// CustodyBundle is the payload of a custody frame, which carries traffic
+// that can be held by custodians along the way until the destination can
+// be reached. The source key and sequence number identify the bundle.
+type CustodyBundle struct {
+	Sequence  Varu64    `json:"sequence"`  // Chosen by the source
+	Expiry    Varu64    `json:"expiry"`    // Unix time in seconds
+	Custodian PublicKey `json:"custodian"` // The node that holds the bundle now
+	Payload   []byte    `json:"payload"`
+}
+
+// CustodyBundleOverhead is the most that the bundle headers can add to
+// the payload.
+const CustodyBundleOverhead = 9 + 9 + ed25519.PublicKeySize
+
+func (c *CustodyBundle) MarshalBinary(buf []byte) (int, error) {
+	if len(buf) < c.Sequence.Length()+c.Expiry.Length()+ed25519.PublicKeySize+len(c.Payload) {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	offset, err := c.Sequence.MarshalBinary(buf)
+	if err != nil {
+		return 0, fmt.Errorf("c.Sequence.MarshalBinary: %w", err)
+	}
+	n, err := c.Expiry.MarshalBinary(buf[offset:])
+	if err != nil {
+		return 0, fmt.Errorf("c.Expiry.MarshalBinary: %w", err)
+	}
+	offset += n
+	offset += copy(buf[offset:], c.Custodian[:])
+	offset += copy(buf[offset:], c.Payload)
+	return offset, nil
+}
+
+// UnmarshalBinary decodes a bundle. The payload refers to the given
+// buffer rather than being copied.
+func (c *CustodyBundle) UnmarshalBinary(buf []byte) (int, error) {
+	offset, err := c.Sequence.UnmarshalBinary(buf)
+	if err != nil {
+		return 0, fmt.Errorf("c.Sequence.UnmarshalBinary: %w", err)
+	}
+	n, err := c.Expiry.UnmarshalBinary(buf[offset:])
+	if err != nil {
+		return 0, fmt.Errorf("c.Expiry.UnmarshalBinary: %w", err)
+	}
+	offset += n
+	if len(buf) < offset+ed25519.PublicKeySize {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	offset += copy(c.Custodian[:], buf[offset:])
+	c.Payload = buf[offset:]
+	return len(buf), nil
+}
+
+// custodySigningContext is signed along with custody receipts, so that the
+// signatures can't be mistaken for ones over anything else.
+const custodySigningContext = "pinecone custody receipt"
+
+// CustodyReceipt is sent back to the custodian of a bundle by the node
+// that took custody of it next, or by the destination once it has been
+// delivered, so that the custodian can stop holding it.
+type CustodyReceipt struct {
+	Source    PublicKey `json:"source"`    // The source of the bundle
+	Sequence  Varu64    `json:"sequence"`  // The sequence of the bundle
+	Delivered bool      `json:"delivered"` // True if sent by the destination
+	Signature Signature `json:"signature"` // Signed by the sender of the receipt
+}
+
+// ProtectedPayload returns the part of the receipt that is signed, which
+// also covers the key of the custodian that the receipt is for.
+func (c *CustodyReceipt) ProtectedPayload(custodian PublicKey) ([]byte, error) {
+	buffer := make([]byte, len(custodySigningContext)+ed25519.PublicKeySize*2+c.Sequence.Length()+1)
+	offset := copy(buffer, custodySigningContext)
+	offset += copy(buffer[offset:], custodian[:])
+	n, err := c.marshalUnsigned(buffer[offset:])
+	if err != nil {
+		return nil, err
+	}
+	return buffer[:offset+n], nil
+}
+
+func (c *CustodyReceipt) marshalUnsigned(buf []byte) (int, error) {
+	if len(buf) < ed25519.PublicKeySize+c.Sequence.Length()+1 {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	offset := copy(buf, c.Source[:])
+	n, err := c.Sequence.MarshalBinary(buf[offset:])
+	if err != nil {
+		return 0, fmt.Errorf("c.Sequence.MarshalBinary: %w", err)
+	}
+	offset += n
+	buf[offset] = 0
+	if c.Delivered {
+		buf[offset] = 1
+	}
+	return offset + 1, nil
+}
+
+func (c *CustodyReceipt) MarshalBinary(buf []byte) (int, error) {
+	offset, err := c.marshalUnsigned(buf)
+	if err != nil {
+		return 0, err
+	}
+	if len(buf) < offset+ed25519.SignatureSize {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	offset += copy(buf[offset:], c.Signature[:])
+	return offset, nil
+}
+
+func (c *CustodyReceipt) UnmarshalBinary(buf []byte) (int, error) {
+	if len(buf) < ed25519.PublicKeySize+c.Sequence.MinLength()+1+ed25519.SignatureSize {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	offset := copy(c.Source[:], buf)
+	n, err := c.Sequence.UnmarshalBinary(buf[offset:])
+	if err != nil {
+		return 0, fmt.Errorf("c.Sequence.UnmarshalBinary: %w", err)
+	}
+	offset += n
+	if len(buf) < offset+1+ed25519.SignatureSize {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	switch buf[offset] {
+	case 0:
+		c.Delivered = false
+	case 1:
+		c.Delivered = true
+	default:
+		return 0, fmt.Errorf("invalid delivered flag %d", buf[offset])
+	}
+	offset++
+	offset += copy(c.Signature[:], buf[offset:])
+	return offset, nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"testing"
+)
+
+func TestMarshalUnmarshalCustodyBundle(t *testing.T) {
+	input := CustodyBundle{
+		Sequence:  1234567890,
+		Expiry:    1700000000,
+		Custodian: PublicKey{1, 2, 3},
+		Payload:   []byte("HELLO!"),
+	}
+	buf := make([]byte, len(input.Payload)+CustodyBundleOverhead)
+	n, err := input.MarshalBinary(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var output CustodyBundle
+	if _, err := output.UnmarshalBinary(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if output.Sequence != input.Sequence || output.Expiry != input.Expiry || output.Custodian != input.Custodian {
+		t.Fatalf("bundle headers weren't decoded properly")
+	}
+	if !bytes.Equal(output.Payload, input.Payload) {
+		t.Fatalf("bundle payload wasn't decoded properly")
+	}
+	if _, err := output.UnmarshalBinary(buf[:4]); err == nil {
+		t.Fatalf("truncated bundle shouldn't have been decoded")
+	}
+}
+
+func TestMarshalUnmarshalCustodyReceipt(t *testing.T) {
+	pk, sk, _ := ed25519.GenerateKey(nil)
+	custodian := PublicKey{9}
+	input := CustodyReceipt{
+		Source:    PublicKey{1, 2, 3},
+		Sequence:  42,
+		Delivered: true,
+	}
+	protected, err := input.ProtectedPayload(custodian)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(input.Signature[:], ed25519.Sign(sk, protected))
+
+	buf := make([]byte, 128)
+	n, err := input.MarshalBinary(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var output CustodyReceipt
+	if _, err := output.UnmarshalBinary(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if output != input {
+		t.Fatalf("receipt wasn't decoded properly")
+	}
+	protected, err = output.ProtectedPayload(custodian)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ed25519.Verify(pk, protected, output.Signature[:]) {
+		t.Fatalf("receipt signature didn't verify")
+	}
+	if protected, _ = output.ProtectedPayload(PublicKey{8}); ed25519.Verify(pk, protected, output.Signature[:]) {
+		t.Fatalf("receipt signature shouldn't verify for another custodian")
+	}
+	bare := make([]byte, len(protected))
+	offset := copy(bare, custodian[:])
+	if n, err = output.marshalUnsigned(bare[offset:]); err != nil {
+		t.Fatal(err)
+	}
+	if ed25519.Verify(pk, bare[:offset+n], output.Signature[:]) {
+		t.Fatalf("receipt signature shouldn't verify without the signing context")
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"crypto/ed25519"
+	"fmt"
+)
+
+// debugSigningContext is signed along with debug requests and responses,
+// so that the signatures can't be mistaken for ones over node info frames.
+const debugSigningContext = "pinecone debug query"
+
+// DebugRequest is the payload of a debug request frame. The signature is
+// made by the node asking, over the key of the node being asked, the ID and
+// the time, so that the node being asked can check that the key is allowed
+// to ask and that the request isn't an old one being replayed.
+type DebugRequest struct {
+	ID        Varu64    `json:"id"`        // Chosen by the node asking, to match up the response
+	Timestamp Varu64    `json:"timestamp"` // When the request was made, in Unix milliseconds
+	Signature Signature `json:"signature"`
+}
+
+// ProtectedPayload returns the part of the request that is signed.
+func (r *DebugRequest) ProtectedPayload(to PublicKey) ([]byte, error) {
+	return r.appendUnsigned(append([]byte(debugSigningContext), to[:]...))
+}
+
+func (r *DebugRequest) appendUnsigned(b []byte) ([]byte, error) {
+	b, err := r.ID.AppendBinary(b)
+	if err != nil {
+		return nil, fmt.Errorf("r.ID.AppendBinary: %w", err)
+	}
+	if b, err = r.Timestamp.AppendBinary(b); err != nil {
+		return nil, fmt.Errorf("r.Timestamp.AppendBinary: %w", err)
+	}
+	return b, nil
+}
+
+func (r *DebugRequest) MarshalBinary(buf []byte) (int, error) {
+	return marshalInto(buf, r)
+}
+
+func (r *DebugRequest) AppendBinary(b []byte) ([]byte, error) {
+	b, err := r.appendUnsigned(b)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, r.Signature[:]...), nil
+}
+
+func (r *DebugRequest) UnmarshalBinary(buf []byte) (int, error) {
+	n, err := r.ID.UnmarshalBinary(buf)
+	if err != nil {
+		return 0, fmt.Errorf("r.ID.UnmarshalBinary: %w", err)
+	}
+	l, err := r.Timestamp.UnmarshalBinary(buf[n:])
+	if err != nil {
+		return 0, fmt.Errorf("r.Timestamp.UnmarshalBinary: %w", err)
+	}
+	n += l
+	if len(buf) < n+ed25519.SignatureSize {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	n += copy(r.Signature[:], buf[n:])
+	return n, nil
+}
+
+// DebugPeer describes one of the peerings of the node that sent a debug
+// response.
+type DebugPeer struct {
+	PublicKey PublicKey    `json:"public_key"`
+	Port      SwitchPortID `json:"port"`
+	PeerType  uint8        `json:"peer_type"`
+}
+
+// DebugResponse is the payload of a debug response frame, which summarises
+// the routing state of the node that sent it. The signature is made by that
+// node, over the key of the node that asked and everything else in the
+// response.
+type DebugResponse struct {
+	ID         Varu64      `json:"id"` // From the request
+	Root       Root        `json:"root"`
+	Coords     Coordinates `json:"coords"`
+	Parent     PublicKey   `json:"parent"`     // Zero if we are the root
+	Ascending  PublicKey   `json:"ascending"`  // Zero if there isn't one
+	Descending PublicKey   `json:"descending"` // Zero if there isn't one
+	Paths      Varu64      `json:"paths"`      // Entries in the SNEK routing table
+	Peers      []DebugPeer `json:"peers"`
+	Signature  Signature   `json:"signature"`
+}
+
+// ProtectedPayload returns the part of the response that is signed.
+func (d *DebugResponse) ProtectedPayload(to PublicKey) ([]byte, error) {
+	return d.appendUnsigned(append([]byte(debugSigningContext), to[:]...))
+}
+
+func (d *DebugResponse) appendUnsigned(b []byte) ([]byte, error) {
+	b, err := d.ID.AppendBinary(b)
+	if err != nil {
+		return nil, fmt.Errorf("d.ID.AppendBinary: %w", err)
+	}
+	b = append(b, d.Root.RootPublicKey[:]...)
+	if b, err = d.Root.RootSequence.AppendBinary(b); err != nil {
+		return nil, fmt.Errorf("d.Root.RootSequence.AppendBinary: %w", err)
+	}
+	if b, err = d.Coords.AppendBinary(b); err != nil {
+		return nil, fmt.Errorf("d.Coords.AppendBinary: %w", err)
+	}
+	b = append(b, d.Parent[:]...)
+	b = append(b, d.Ascending[:]...)
+	b = append(b, d.Descending[:]...)
+	if b, err = d.Paths.AppendBinary(b); err != nil {
+		return nil, fmt.Errorf("d.Paths.AppendBinary: %w", err)
+	}
+	if b, err = Varu64(len(d.Peers)).AppendBinary(b); err != nil {
+		return nil, fmt.Errorf("Varu64.AppendBinary: %w", err)
+	}
+	for _, p := range d.Peers {
+		b = append(b, p.PublicKey[:]...)
+		if b, err = Varu64(p.Port).AppendBinary(b); err != nil {
+			return nil, fmt.Errorf("Varu64.AppendBinary: %w", err)
+		}
+		b = append(b, p.PeerType)
+	}
+	return b, nil
+}
+
+func (d *DebugResponse) MarshalBinary(buf []byte) (int, error) {
+	return marshalInto(buf, d)
+}
+
+func (d *DebugResponse) AppendBinary(b []byte) ([]byte, error) {
+	b, err := d.appendUnsigned(b)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, d.Signature[:]...), nil
+}
+
+func (d *DebugResponse) UnmarshalBinary(buf []byte) (int, error) {
+	offset, err := d.ID.UnmarshalBinary(buf)
+	if err != nil {
+		return 0, fmt.Errorf("d.ID.UnmarshalBinary: %w", err)
+	}
+	if len(buf) < offset+ed25519.PublicKeySize {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	offset += copy(d.Root.RootPublicKey[:], buf[offset:])
+	l, err := d.Root.RootSequence.UnmarshalBinary(buf[offset:])
+	if err != nil {
+		return 0, fmt.Errorf("d.Root.RootSequence.UnmarshalBinary: %w", err)
+	}
+	offset += l
+	if l, err = d.Coords.UnmarshalBinary(buf[offset:]); err != nil {
+		return 0, fmt.Errorf("d.Coords.UnmarshalBinary: %w", err)
+	}
+	offset += l
+	if len(buf) < offset+ed25519.PublicKeySize*3 {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	offset += copy(d.Parent[:], buf[offset:])
+	offset += copy(d.Ascending[:], buf[offset:])
+	offset += copy(d.Descending[:], buf[offset:])
+	if l, err = d.Paths.UnmarshalBinary(buf[offset:]); err != nil {
+		return 0, fmt.Errorf("d.Paths.UnmarshalBinary: %w", err)
+	}
+	offset += l
+	var count Varu64
+	if l, err = count.UnmarshalBinary(buf[offset:]); err != nil {
+		return 0, fmt.Errorf("count.UnmarshalBinary: %w", err)
+	}
+	offset += l
+	// Each peer takes up at least a key, a port and a peer type.
+	if uint64(count) > uint64(len(buf)-offset)/(ed25519.PublicKeySize+2) {
+		return 0, fmt.Errorf("peer count %d is too large", count)
+	}
+	d.Peers = make([]DebugPeer, count)
+	for i := range d.Peers {
+		p := &d.Peers[i]
+		if len(buf) < offset+ed25519.PublicKeySize {
+			return 0, fmt.Errorf("buffer too small")
+		}
+		offset += copy(p.PublicKey[:], buf[offset:])
+		var port Varu64
+		if l, err = port.UnmarshalBinary(buf[offset:]); err != nil {
+			return 0, fmt.Errorf("port.UnmarshalBinary: %w", err)
+		}
+		offset += l
+		if len(buf) < offset+1 {
+			return 0, fmt.Errorf("buffer too small")
+		}
+		p.Port, p.PeerType = SwitchPortID(port), buf[offset]
+		offset++
+	}
+	if len(buf) < offset+ed25519.SignatureSize {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	offset += copy(d.Signature[:], buf[offset:])
+	return offset, nil
+}
@@ -0,0 +1,71 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMarshalUnmarshalDebugResponse(t *testing.T) {
+	input := DebugResponse{
+		ID:         3,
+		Root:       Root{RootPublicKey: PublicKey{1}, RootSequence: 99},
+		Coords:     Coordinates{1, 2, 300},
+		Parent:     PublicKey{2},
+		Descending: PublicKey{3},
+		Paths:      17,
+		Peers: []DebugPeer{
+			{PublicKey: PublicKey{4}, Port: 1, PeerType: 0},
+			{PublicKey: PublicKey{5}, Port: 200, PeerType: 2},
+		},
+		Signature: Signature{6},
+	}
+	b, err := input.AppendBinary(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var output DebugResponse
+	n, err := output.UnmarshalBinary(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(b) || !reflect.DeepEqual(input, output) {
+		t.Fatalf("expected %+v, got %+v", input, output)
+	}
+	if _, err := output.UnmarshalBinary(b[:len(b)-1]); err == nil {
+		t.Fatalf("expected a truncated response to fail")
+	}
+
+	request := DebugRequest{ID: 1 << 20, Timestamp: 1_650_000_000_000, Signature: Signature{9}}
+	if b, err = request.AppendBinary(nil); err != nil {
+		t.Fatal(err)
+	}
+	var decoded DebugRequest
+	if n, err = decoded.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	if n != len(b) || decoded != request {
+		t.Fatalf("expected %+v, got %+v", request, decoded)
+	}
+
+	// The request must not be signed over the same bytes as a node info
+	// request, or one could be passed off as the other.
+	debug, _ := (&DebugRequest{ID: 1}).ProtectedPayload(PublicKey{7})
+	info, _ := (&NodeInfoRequest{ID: 1}).ProtectedPayload(PublicKey{7})
+	if reflect.DeepEqual(debug, info) {
+		t.Fatalf("expected debug and node info requests to be signed differently")
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Everything that a peer sends us has to be decoded before it can be
+// trusted, so the errors from decoding fall into a small number of kinds
+// that callers can tell apart with errors.Is and errors.As:
+//
+//   - Every error from Decode is a *ParseError, naming the type that was
+//     being decoded, and matches ErrMalformed. Callers should drop the
+//     input and may count it against whoever sent it, but it is never a
+//     reason to crash.
+//   - A *LengthError means that a length, given on the wire or implied by
+//     the structure, doesn't fit into the data that is available.
+//   - A *TrailingBytesError means that there are bytes left over once the
+//     structure has been decoded.
+//   - A *NonCanonicalVaru64Error means that a varu64 is unterminated, not
+//     in its shortest form or overflows 64 bits.
+//   - A *MagicBytesError means that a frame doesn't start with the frame
+//     magic bytes.
+//   - An *UnknownFrameTypeError means that the frame type isn't one that
+//     we know how to decode.
+//   - A *PanicError means that the parser panicked, which is always a bug
+//     in the parser. Decode recovers from it so that the caller survives.
+//
+// The length, trailing bytes, varu64, magic bytes and frame type errors come
+// from strict decoding, and they match ErrMalformed too. Anything else that
+// a parser returns, i.e. a failed signature check, is wrapped as it is in a
+// *ParseError.
+
+// ErrMalformed is matched by every error from decoding input that came
+// from the network.
+var ErrMalformed = errors.New("malformed input")
+
+// Unmarshaler is implemented by the frame and by every payload type.
+type Unmarshaler interface {
+	UnmarshalBinary(data []byte) (int, error)
+}
+
+// ParseError is returned by Decode when the input can't be decoded.
+type ParseError struct {
+	Parser string // The type that was being decoded, i.e. "*types.Frame"
+	Err    error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Parser, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ParseError) Is(target error) bool {
+	return target == ErrMalformed
+}
+
+// PanicError is returned by Decode when the parser panics.
+type PanicError struct {
+	Value interface{}
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("parser panicked: %v", e.Value)
+}
+
+func (e *PanicError) Is(target error) bool {
+	return target == ErrMalformed
+}
+
+// Decode decodes data into v, returning a *ParseError if it can't be
+// decoded for any reason, including the parser panicking or claiming to
+// have read more data than there was. The parser can't see beyond the end
+// of data, even if there is room in the slice. It should be used for
+// anything that came from the network.
+func Decode(v Unmarshaler, data []byte) (n int, err error) {
+	data = data[:len(data):len(data)]
+	defer func() {
+		if r := recover(); r != nil {
+			n, err = 0, &ParseError{parserName(v), &PanicError{r}}
+		}
+	}()
+	if n, err = v.UnmarshalBinary(data); err != nil {
+		return 0, &ParseError{parserName(v), err}
+	}
+	if n < 0 || n > len(data) {
+		return 0, &ParseError{parserName(v), &LengthError{"input", n, len(data)}}
+	}
+	return n, nil
+}
+
+func parserName(v Unmarshaler) string {
+	return fmt.Sprintf("%T", v)
+}
@@ -0,0 +1,65 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import "fmt"
+
+// Echo is the payload of an echo request or reply frame. ID is chosen by
+// the requesting node so that it can match up the replies. In a reply,
+// Hops contains the number of hops that the request took to reach the
+// responding node. Each node that forwards an echo frame, including the
+// node that sent it, increments the Extra byte in the frame header, so
+// that the length of the path taken by either frame can be observed by
+// its recipient.
+type Echo struct {
+	ID   Varu64 `json:"id"`
+	Hops Varu64 `json:"hops"`
+}
+
+func (e *Echo) MarshalBinary(buf []byte) (int, error) {
+	if len(buf) < e.ID.Length()+e.Hops.Length() {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	offset := 0
+	n, err := e.ID.MarshalBinary(buf[offset:])
+	if err != nil {
+		return 0, fmt.Errorf("e.ID.MarshalBinary: %w", err)
+	}
+	offset += n
+	n, err = e.Hops.MarshalBinary(buf[offset:])
+	if err != nil {
+		return 0, fmt.Errorf("e.Hops.MarshalBinary: %w", err)
+	}
+	offset += n
+	return offset, nil
+}
+
+func (e *Echo) UnmarshalBinary(buf []byte) (int, error) {
+	if len(buf) < e.ID.MinLength()+e.Hops.MinLength() {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	offset := 0
+	n, err := e.ID.UnmarshalBinary(buf[offset:])
+	if err != nil {
+		return 0, fmt.Errorf("e.ID.UnmarshalBinary: %w", err)
+	}
+	offset += n
+	n, err = e.Hops.UnmarshalBinary(buf[offset:])
+	if err != nil {
+		return 0, fmt.Errorf("e.Hops.UnmarshalBinary: %w", err)
+	}
+	offset += n
+	return offset, nil
+}
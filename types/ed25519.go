@@ -18,6 +18,7 @@ import (
 	"bytes"
 	"crypto/ed25519"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 )
 
@@ -66,6 +67,36 @@ func (a PublicKey) MarshalJSON() ([]byte, error) {
 	return []byte(`"` + a.String() + `"`), nil
 }
 
+func (a *PublicKey) UnmarshalJSON(data []byte) error {
+	return unmarshalHexJSON(data, a[:])
+}
+
+func (a Signature) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + hex.EncodeToString(a[:]) + `"`), nil
+}
+
+func (a *Signature) UnmarshalJSON(data []byte) error {
+	return unmarshalHexJSON(data, a[:])
+}
+
+// unmarshalHexJSON decodes a hex-encoded JSON string into the given
+// fixed-size buffer, which must be filled exactly.
+func unmarshalHexJSON(data []byte, into []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return fmt.Errorf("hex.DecodeString: %w", err)
+	}
+	if len(b) != len(into) {
+		return fmt.Errorf("expected %d bytes, got %d bytes", len(into), len(b))
+	}
+	copy(into, b)
+	return nil
+}
+
 func (a PublicKey) Network() string {
 	return "ed25519"
 }
@@ -18,6 +18,7 @@ import (
 	"bytes"
 	"crypto/ed25519"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"math"
 )
@@ -39,6 +40,28 @@ const (
 	TypeBootstrap                         // protocol frame, forwarded using SNEK
 	TypeTraffic                           // traffic frame, forwarded using tree or SNEK
 	TypeWakeupBroadcast                   // protocol frame, special broadcast forwarding
+	TypeLinkProbe                         // protocol frame, direct to peers only
+	TypeEchoRequest                       // protocol frame, forwarded using tree or SNEK
+	TypeEchoReply                         // protocol frame, forwarded using tree or SNEK
+	TypeServiceAdvert                     // protocol frame, special broadcast forwarding
+	TypeContinuity                        // protocol frame, forwarded using tree or SNEK
+	TypeRevocation                        // protocol frame, special broadcast forwarding
+	TypeBootstrapACK                      // protocol frame, direct to peers only
+	TypeBootstrapConfirm                  // protocol frame, forwarded using tree or SNEK
+	TypeSNEKSummary                       // protocol frame, direct to peers only
+	TypeReachability                      // protocol frame, direct to peers only
+	TypeCustody                           // traffic frame, forwarded using SNEK, held by custodians
+	TypeCustodyReceipt                    // protocol frame, forwarded using SNEK
+	TypeSNEKAdjacency                     // protocol frame, forwarded using tree or SNEK
+	TypeNodeInfoRequest                   // protocol frame, forwarded using tree or SNEK
+	TypeNodeInfoResponse                  // protocol frame, forwarded using tree or SNEK
+	TypeDebugRequest                      // protocol frame, forwarded using tree or SNEK
+	TypeDebugResponse                     // protocol frame, forwarded using tree or SNEK
+	TypeSearchRequest                     // protocol frame, forwarded using SNEK
+	TypeSearchResponse                    // protocol frame, forwarded using tree or SNEK
+	TypeSNEKRefresh                       // protocol frame, direct to peers only
+	TypeDeparting                         // protocol frame, direct to peers only
+	TypeTimeSync                          // protocol frame, direct to peers only
 )
 
 func (t FrameType) IsTraffic() bool {
@@ -47,6 +70,8 @@ func (t FrameType) IsTraffic() bool {
 
 const (
 	Version0 FrameVersion = iota
+	Version1              // jumbo traffic frame, only sent to peers that accept them
+	Version2              // compact frame, only sent to peers that accept them
 )
 
 var FrameMagicBytes = []byte{0x70, 0x69, 0x6e, 0x65}
@@ -70,20 +95,39 @@ type Frame struct {
 	SourceKey      PublicKey
 	Watermark      VirtualSnakeWatermark
 	Payload        []byte
+
+	// Room for decoded coordinates, which is kept when the frame is Reset
+	// so that decoding into a pooled frame doesn't allocate. It is kept
+	// apart from Destination and Source since those are often pointed at
+	// coordinates that belong to someone else.
+	destinationRoom Coordinates
+	sourceRoom      Coordinates
 }
 
 func (f *Frame) Reset() {
 	f.Version, f.Type = 0, 0
 	f.Extra = 0
 	f.HopLimit = 0
-	f.Destination = Coordinates{}
+	f.Destination = f.destinationRoom[:0]
 	f.DestinationKey = PublicKey{}
-	f.Source = Coordinates{}
+	f.Source = f.sourceRoom[:0]
 	f.SourceKey = PublicKey{}
 	f.Watermark = VirtualSnakeWatermark{}
 	f.Payload = f.Payload[:0]
 }
 
+// useCoordsRoom points the coordinates at the room that the frame keeps for
+// them, ready to be decoded into.
+func (f *Frame) useCoordsRoom() {
+	f.Destination, f.Source = f.destinationRoom[:0], f.sourceRoom[:0]
+}
+
+// keepCoordsRoom remembers the decoded coordinates as the room for next
+// time, in case decoding them had to make more room.
+func (f *Frame) keepCoordsRoom() {
+	f.destinationRoom, f.sourceRoom = f.Destination[:0], f.Source[:0]
+}
+
 func (f *Frame) CopyInto(t *Frame) {
 	t.Version = f.Version
 	t.Type = f.Type
@@ -92,11 +136,16 @@ func (f *Frame) CopyInto(t *Frame) {
 	t.DestinationKey = f.DestinationKey
 	t.SourceKey = f.SourceKey
 	t.Watermark = f.Watermark
-	t.Payload = t.Payload[:len(f.Payload)]
-	copy(t.Payload, f.Payload)
+	t.Payload = append(t.Payload[:0], f.Payload...)
 }
 
 func (f *Frame) MarshalBinary(buffer []byte) (int, error) {
+	switch f.Version {
+	case Version1:
+		return f.marshalJumbo(buffer)
+	case Version2:
+		return f.marshalCompact(buffer)
+	}
 	copy(buffer[:4], FrameMagicBytes)
 	buffer[4], buffer[5] = byte(f.Version), byte(f.Type)
 	buffer[6] = f.Extra
@@ -105,7 +154,7 @@ func (f *Frame) MarshalBinary(buffer []byte) (int, error) {
 	switch f.Type {
 	case TypeKeepalive:
 
-	case TypeTreeAnnouncement:
+	case TypeTreeAnnouncement, TypeLinkProbe, TypeBootstrapACK, TypeSNEKSummary, TypeReachability, TypeSNEKRefresh, TypeDeparting, TypeTimeSync:
 		payloadLen := len(f.Payload)
 		binary.BigEndian.PutUint16(buffer[offset+0:offset+2], uint16(payloadLen))
 		offset += 2
@@ -130,7 +179,7 @@ func (f *Frame) MarshalBinary(buffer []byte) (int, error) {
 			offset += copy(buffer[offset:], f.Payload[:payloadLen])
 		}
 
-	case TypeWakeupBroadcast: // source = key
+	case TypeWakeupBroadcast, TypeServiceAdvert, TypeRevocation: // source = key
 		payloadLen := len(f.Payload)
 		binary.BigEndian.PutUint16(buffer[offset+0:offset+2], uint16(payloadLen))
 		offset += 2
@@ -140,7 +189,7 @@ func (f *Frame) MarshalBinary(buffer []byte) (int, error) {
 			offset += copy(buffer[offset:], f.Payload[:payloadLen])
 		}
 
-	case TypeTraffic:
+	case TypeTraffic, TypeEchoRequest, TypeEchoReply, TypeContinuity, TypeBootstrapConfirm, TypeCustody, TypeCustodyReceipt, TypeSNEKAdjacency, TypeNodeInfoRequest, TypeNodeInfoResponse, TypeDebugRequest, TypeDebugResponse, TypeSearchRequest, TypeSearchResponse:
 		payloadLen := len(f.Payload)
 		binary.BigEndian.PutUint16(buffer[offset+0:offset+2], uint16(payloadLen))
 		dn, err := f.Destination.MarshalBinary(buffer[offset+2:])
@@ -186,6 +235,9 @@ func (f *Frame) UnmarshalBinary(data []byte) (int, error) {
 	if !bytes.Equal(data[:4], FrameMagicBytes) {
 		return 0, fmt.Errorf("frame doesn't contain magic bytes")
 	}
+	if IsJumboFrame(data) {
+		return f.unmarshalJumbo(data)
+	}
 	f.Version, f.Type = FrameVersion(data[4]), FrameType(data[5])
 	f.Extra = data[6]
 	f.HopLimit = data[7]
@@ -193,22 +245,34 @@ func (f *Frame) UnmarshalBinary(data []byte) (int, error) {
 	if len(data) != framelen {
 		return 0, fmt.Errorf("frame length incorrect")
 	}
+	if f.Version == Version2 {
+		return f.unmarshalCompact(data)
+	}
 	offset := FrameHeaderLength
 	switch f.Type {
 	case TypeKeepalive:
 		return offset, nil
 
-	case TypeTreeAnnouncement:
+	case TypeTreeAnnouncement, TypeLinkProbe, TypeBootstrapACK, TypeSNEKSummary, TypeReachability, TypeSNEKRefresh, TypeDeparting, TypeTimeSync:
+		if len(data) < offset+2 {
+			return 0, fmt.Errorf("frame is not long enough to include payload length")
+		}
 		payloadLen := int(binary.BigEndian.Uint16(data[offset+0 : offset+2]))
 		if payloadLen > cap(f.Payload) {
 			return 0, fmt.Errorf("payload length exceeds frame capacity")
 		}
 		offset += 2
+		if size := offset + payloadLen; len(data) != size {
+			return 0, fmt.Errorf("frame expecting %d total bytes, got %d bytes", size, len(data))
+		}
 		f.Payload = f.Payload[:payloadLen]
 		offset += copy(f.Payload, data[offset:])
-		return offset + payloadLen, nil
+		return offset, nil
 
 	case TypeBootstrap: // destination = key, source = coords
+		if len(data) < offset+2 {
+			return 0, fmt.Errorf("frame is not long enough to include payload length")
+		}
 		payloadLen := int(binary.BigEndian.Uint16(data[offset+0 : offset+2]))
 		if payloadLen > cap(f.Payload) {
 			return 0, fmt.Errorf("payload length exceeds frame capacity")
@@ -225,7 +289,10 @@ func (f *Frame) UnmarshalBinary(data []byte) (int, error) {
 		offset += copy(f.Payload[:payloadLen], data[offset:])
 		return offset, nil
 
-	case TypeWakeupBroadcast: // source = key
+	case TypeWakeupBroadcast, TypeServiceAdvert, TypeRevocation: // source = key
+		if len(data) < offset+2 {
+			return 0, fmt.Errorf("frame is not long enough to include payload length")
+		}
 		payloadLen := int(binary.BigEndian.Uint16(data[offset+0 : offset+2]))
 		if payloadLen > cap(f.Payload) {
 			return 0, fmt.Errorf("payload length exceeds frame capacity")
@@ -236,12 +303,16 @@ func (f *Frame) UnmarshalBinary(data []byte) (int, error) {
 		offset += copy(f.Payload[:payloadLen], data[offset:])
 		return offset, nil
 
-	case TypeTraffic:
+	case TypeTraffic, TypeEchoRequest, TypeEchoReply, TypeContinuity, TypeBootstrapConfirm, TypeCustody, TypeCustodyReceipt, TypeSNEKAdjacency, TypeNodeInfoRequest, TypeNodeInfoResponse, TypeDebugRequest, TypeDebugResponse, TypeSearchRequest, TypeSearchResponse:
+		if len(data) < offset+2 {
+			return 0, fmt.Errorf("frame is not long enough to include payload length")
+		}
 		payloadLen := int(binary.BigEndian.Uint16(data[offset+0 : offset+2]))
 		if payloadLen > cap(f.Payload) {
 			return 0, fmt.Errorf("payload length exceeds frame capacity")
 		}
 		offset += 2
+		f.useCoordsRoom()
 		dstLen, dstErr := f.Destination.UnmarshalBinary(data[offset:])
 		if dstErr != nil {
 			return 0, fmt.Errorf("f.Destination.UnmarshalBinary: %w", dstErr)
@@ -252,6 +323,7 @@ func (f *Frame) UnmarshalBinary(data []byte) (int, error) {
 			return 0, fmt.Errorf("f.Source.UnmarshalBinary: %w", srcErr)
 		}
 		offset += srcLen
+		f.keepCoordsRoom()
 		offset += copy(f.DestinationKey[:], data[offset:])
 		offset += copy(f.SourceKey[:], data[offset:])
 		f.Watermark = VirtualSnakeWatermark{
@@ -271,13 +343,63 @@ func (f *Frame) UnmarshalBinary(data []byte) (int, error) {
 		}
 		f.Payload = f.Payload[:payloadLen]
 		offset += copy(f.Payload, data[offset:])
-		return offset + payloadLen, nil
+		return offset, nil
 
 	default:
 		return 0, nil
 	}
 }
 
+// frameJSON is the JSON representation of a frame. The payload is
+// base64-encoded, as is the default for byte slices.
+type frameJSON struct {
+	Version        FrameVersion          `json:"version"`
+	Type           FrameType             `json:"type"`
+	Extra          byte                  `json:"extra,omitempty"`
+	HopLimit       uint8                 `json:"hop_limit,omitempty"`
+	Destination    Coordinates           `json:"destination"`
+	DestinationKey PublicKey             `json:"destination_key"`
+	Source         Coordinates           `json:"source"`
+	SourceKey      PublicKey             `json:"source_key"`
+	Watermark      VirtualSnakeWatermark `json:"watermark"`
+	Payload        []byte                `json:"payload,omitempty"`
+}
+
+func (f *Frame) MarshalJSON() ([]byte, error) {
+	return json.Marshal(frameJSON{
+		Version:        f.Version,
+		Type:           f.Type,
+		Extra:          f.Extra,
+		HopLimit:       f.HopLimit,
+		Destination:    f.Destination,
+		DestinationKey: f.DestinationKey,
+		Source:         f.Source,
+		SourceKey:      f.SourceKey,
+		Watermark:      f.Watermark,
+		Payload:        f.Payload,
+	})
+}
+
+func (f *Frame) UnmarshalJSON(data []byte) error {
+	var j frameJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	if len(j.Payload) > MaxPayloadSize {
+		return fmt.Errorf("payload length %d exceeds maximum %d", len(j.Payload), MaxPayloadSize)
+	}
+	f.Version, f.Type = j.Version, j.Type
+	f.Extra = j.Extra
+	f.HopLimit = j.HopLimit
+	f.Destination = j.Destination
+	f.DestinationKey = j.DestinationKey
+	f.Source = j.Source
+	f.SourceKey = j.SourceKey
+	f.Watermark = j.Watermark
+	f.Payload = append(f.Payload[:0], j.Payload...)
+	return nil
+}
+
 func (t FrameType) String() string {
 	switch t {
 	case TypeKeepalive:
@@ -290,6 +412,50 @@ func (t FrameType) String() string {
 		return "WakeupBroadcast"
 	case TypeTraffic:
 		return "OverlayTraffic"
+	case TypeLinkProbe:
+		return "LinkProbe"
+	case TypeEchoRequest:
+		return "EchoRequest"
+	case TypeEchoReply:
+		return "EchoReply"
+	case TypeServiceAdvert:
+		return "ServiceAdvertisement"
+	case TypeContinuity:
+		return "Continuity"
+	case TypeRevocation:
+		return "RevocationList"
+	case TypeBootstrapACK:
+		return "VirtualSnakeBootstrapACK"
+	case TypeBootstrapConfirm:
+		return "VirtualSnakeBootstrapConfirm"
+	case TypeSNEKSummary:
+		return "VirtualSnakeSummary"
+	case TypeReachability:
+		return "Reachability"
+	case TypeCustody:
+		return "Custody"
+	case TypeCustodyReceipt:
+		return "CustodyReceipt"
+	case TypeSNEKAdjacency:
+		return "VirtualSnakeAdjacency"
+	case TypeNodeInfoRequest:
+		return "NodeInfoRequest"
+	case TypeNodeInfoResponse:
+		return "NodeInfoResponse"
+	case TypeDebugRequest:
+		return "DebugRequest"
+	case TypeDebugResponse:
+		return "DebugResponse"
+	case TypeSearchRequest:
+		return "SearchRequest"
+	case TypeSearchResponse:
+		return "SearchResponse"
+	case TypeSNEKRefresh:
+		return "VirtualSnakeRefresh"
+	case TypeDeparting:
+		return "Departing"
+	case TypeTimeSync:
+		return "TimeSync"
 	default:
 		return "Unknown"
 	}
@@ -17,6 +17,7 @@ package types
 import (
 	"bytes"
 	"crypto/ed25519"
+	"encoding/json"
 	"fmt"
 	"testing"
 )
@@ -255,3 +256,231 @@ func TestMarshalUnmarshalSNEKBootstrapFrame(t *testing.T) {
 		t.Fatal("wrong payload")
 	}
 }
+
+func TestMarshalUnmarshalFrameJSON(t *testing.T) {
+	src, _, _ := ed25519.GenerateKey(nil)
+	input := Frame{
+		Version:     Version0,
+		Type:        TypeTraffic,
+		HopLimit:    5,
+		Destination: Coordinates{1, 2, 3},
+		Source:      Coordinates{4, 3, 2, 1},
+		Payload:     []byte("ABCDEFG"),
+	}
+	copy(input.SourceKey[:], src)
+	copy(input.Watermark.PublicKey[:], src)
+	j, err := json.Marshal(&input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var output Frame
+	if err := json.Unmarshal(j, &output); err != nil {
+		t.Fatal(err)
+	}
+	if output.Type != input.Type || output.HopLimit != input.HopLimit {
+		t.Fatal("wrong header fields")
+	}
+	if !output.Destination.EqualTo(input.Destination) || !output.Source.EqualTo(input.Source) {
+		t.Fatal("wrong coordinates")
+	}
+	if output.SourceKey != input.SourceKey || output.Watermark != input.Watermark {
+		t.Fatal("wrong keys")
+	}
+	if !bytes.Equal(input.Payload, output.Payload) {
+		t.Fatal("wrong payload")
+	}
+}
+
+func TestMarshalUnmarshalFrameEcho(t *testing.T) {
+	src, _, _ := ed25519.GenerateKey(nil)
+	dst, _, _ := ed25519.GenerateKey(nil)
+	echo := Echo{ID: 123456, Hops: 4}
+	payload := make([]byte, 16)
+	pn, err := echo.MarshalBinary(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := Frame{
+		Version: Version0,
+		Type:    TypeEchoReply,
+		Extra:   3,
+		Source:  Coordinates{4, 3, 2, 1},
+		Payload: payload[:pn],
+	}
+	copy(input.DestinationKey[:], dst)
+	copy(input.SourceKey[:], src)
+	input.Watermark.PublicKey = FullMask
+	buf := make([]byte, 65535)
+	n, err := input.MarshalBinary(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkFrame(buf[:n]); err != nil {
+		t.Fatalf("strict decoding rejected echo frame: %s", err)
+	}
+	output := Frame{
+		Payload: make([]byte, 0, MaxPayloadSize),
+	}
+	if _, err := output.UnmarshalBinary(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if output.Type != TypeEchoReply {
+		t.Fatalf("wrong type (got %s, expected %s)", output.Type, TypeEchoReply)
+	}
+	if output.Extra != 3 {
+		t.Fatalf("wrong hop count (got %d, expected 3)", output.Extra)
+	}
+	if !output.Source.EqualTo(input.Source) {
+		t.Fatalf("wrong source coordinates (got %v, expected %v)", output.Source, input.Source)
+	}
+	if output.DestinationKey != input.DestinationKey || output.SourceKey != input.SourceKey {
+		t.Fatal("wrong keys")
+	}
+	var decoded Echo
+	if _, err := decoded.UnmarshalBinary(output.Payload); err != nil {
+		t.Fatal(err)
+	}
+	if decoded != echo {
+		t.Fatalf("wrong echo payload (got %+v, expected %+v)", decoded, echo)
+	}
+}
+
+func TestMarshalUnmarshalServiceAdvertisement(t *testing.T) {
+	pk, sk, _ := ed25519.GenerateKey(nil)
+	input := ServiceAdvertisement{
+		Sequence: 42,
+		Service:  "relay",
+		Capacity: 1000,
+	}
+	protected, err := input.ProtectedPayload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(input.Signature[:], ed25519.Sign(sk, protected))
+	buf := make([]byte, 1024)
+	n, err := input.MarshalBinary(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var output ServiceAdvertisement
+	if _, err := output.UnmarshalBinary(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if output != input {
+		t.Fatalf("wrong advertisement (got %+v, expected %+v)", output, input)
+	}
+	protected, err = output.ProtectedPayload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ed25519.Verify(pk, protected, output.Signature[:]) {
+		t.Fatal("signature didn't verify")
+	}
+	if _, err := output.UnmarshalBinary(buf[:n-1]); err == nil {
+		t.Fatal("expected truncated advertisement to fail")
+	}
+}
+
+func TestFrameTrafficClass(t *testing.T) {
+	input := Frame{
+		Version:     Version0,
+		Type:        TypeTraffic,
+		Destination: Coordinates{1, 2},
+		Payload:     []byte("bulk"),
+	}
+	if input.TrafficClass() != TrafficClassInteractive {
+		t.Fatalf("expected default class to be interactive, got %s", input.TrafficClass())
+	}
+	input.SetTrafficClass(TrafficClassBulk)
+	buf := make([]byte, 65535)
+	n, err := input.MarshalBinary(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := Frame{
+		Payload: make([]byte, 0, MaxPayloadSize),
+	}
+	if _, err := output.UnmarshalBinary(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if output.TrafficClass() != TrafficClassBulk {
+		t.Fatalf("wrong traffic class (got %s, expected %s)", output.TrafficClass(), TrafficClassBulk)
+	}
+
+	proto := Frame{Type: TypeBootstrap, Extra: byte(TrafficClassBackground)}
+	if proto.TrafficClass() != TrafficClassControl {
+		t.Fatalf("expected protocol frames to be control traffic, got %s", proto.TrafficClass())
+	}
+}
+
+func TestFrameDatagram(t *testing.T) {
+	input := Frame{
+		Version:     Version0,
+		Type:        TypeTraffic,
+		Destination: Coordinates{1, 2},
+		Payload:     []byte("media"),
+	}
+	input.SetTrafficClass(TrafficClassBulk)
+	input.SetDatagram()
+	buf := make([]byte, 65535)
+	n, err := input.MarshalBinary(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := Frame{
+		Payload: make([]byte, 0, MaxPayloadSize),
+	}
+	if _, err := output.UnmarshalBinary(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if !output.IsDatagram() || output.TrafficClass() != TrafficClassBulk {
+		t.Fatalf("expected a bulk datagram, got class %s and datagram %v", output.TrafficClass(), output.IsDatagram())
+	}
+
+	proto := Frame{Type: TypeBootstrap}
+	proto.SetDatagram()
+	if proto.IsDatagram() {
+		t.Fatalf("expected protocol frames not to be datagrams")
+	}
+}
+
+func TestFrameReusesCoordinates(t *testing.T) {
+	input := Frame{
+		Type:        TypeTraffic,
+		Destination: Coordinates{1, 2, 3},
+		Source:      Coordinates{1, 2, 4},
+		Payload:     []byte("hello"),
+	}
+	buf := make([]byte, 65535)
+	for _, version := range []FrameVersion{Version0, Version2} {
+		input.Version = version
+		n, err := input.MarshalBinary(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		output := Frame{
+			Payload: make([]byte, 0, MaxPayloadSize),
+		}
+		if allocs := testing.AllocsPerRun(100, func() {
+			output.Reset()
+			_, _ = output.UnmarshalBinary(buf[:n])
+		}); allocs != 0 {
+			t.Fatalf("version %d: expected decoding into a reused frame not to allocate, got %.0f", version, allocs)
+		}
+		if !output.Destination.EqualTo(input.Destination) || !output.Source.EqualTo(input.Source) {
+			t.Fatalf("version %d: got coordinates %v and %v", version, output.Destination, output.Source)
+		}
+
+		// Coordinates that were pointed at from elsewhere aren't written
+		// over by the next frame that is decoded into the same frame.
+		theirs := Coordinates{9, 9, 9, 9}
+		output.Destination = theirs
+		output.Reset()
+		if _, err := output.UnmarshalBinary(buf[:n]); err != nil {
+			t.Fatal(err)
+		}
+		if !theirs.EqualTo(Coordinates{9, 9, 9, 9}) {
+			t.Fatalf("version %d: decoding wrote over coordinates that belong to someone else: %v", version, theirs)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+// FuzzTarget is an entry point for fuzzing one of the parsers for input
+// that comes from the network.
+type FuzzTarget struct {
+	Name  string
+	Parse func(data []byte) error
+}
+
+// FuzzTargets are the entry points for fuzzing every frame and payload
+// parser, for use with "go test -fuzz" or any other fuzzer that feeds bytes
+// to a function. Each one decodes the data in the same way as the router
+// does and returns the error, which is always a *ParseError, so a fuzzer
+// only has to look out for panics, which Parse doesn't recover from. The
+// names are stable, so that a corpus can be kept for each of them.
+var FuzzTargets = []FuzzTarget{
+	{"frame", func(data []byte) error { return fuzzDecode(&Frame{}, data) }},
+	{"frame-strict", func(data []byte) error {
+		f := &Frame{}
+		if _, err := f.UnmarshalBinaryStrict(data[:len(data):len(data)]); err != nil {
+			return &ParseError{parserName(f), err}
+		}
+		return nil
+	}},
+	{"coordinates", func(data []byte) error { return fuzzDecode(&Coordinates{}, data) }},
+	{"varu64", func(data []byte) error { return fuzzDecode(new(Varu64), data) }},
+	{"signature-hop", func(data []byte) error { return fuzzDecode(&SignatureWithHop{}, data) }},
+	{"announcement", func(data []byte) error { return fuzzDecode(&SwitchAnnouncement{}, data) }},
+	{"bootstrap", func(data []byte) error { return fuzzDecode(&VirtualSnakeBootstrap{}, data) }},
+	{"bootstrap-ack", func(data []byte) error { return fuzzDecode(&VirtualSnakeBootstrapACK{}, data) }},
+	{"bootstrap-confirm", func(data []byte) error { return fuzzDecode(&VirtualSnakeBootstrapConfirm{}, data) }},
+	{"snek-refresh", func(data []byte) error { return fuzzDecode(&VirtualSnakeRefresh{}, data) }},
+	{"snek-summary", func(data []byte) error { return fuzzDecode(&VirtualSnakeSummary{}, data) }},
+	{"snek-adjacency", func(data []byte) error { return fuzzDecode(&VirtualSnakeAdjacency{}, data) }},
+	{"wakeup-broadcast", func(data []byte) error { return fuzzDecode(&WakeupBroadcast{}, data) }},
+	{"link-probe", func(data []byte) error { return fuzzDecode(&LinkProbe{}, data) }},
+	{"time-sync", func(data []byte) error { return fuzzDecode(&TimeSync{}, data) }},
+	{"echo", func(data []byte) error { return fuzzDecode(&Echo{}, data) }},
+	{"reachability", func(data []byte) error { return fuzzDecode(&Reachability{}, data) }},
+	{"service-advertisement", func(data []byte) error { return fuzzDecode(&ServiceAdvertisement{}, data) }},
+	{"search-request", func(data []byte) error { return fuzzDecode(&SearchRequest{}, data) }},
+	{"search-response", func(data []byte) error { return fuzzDecode(&SearchResponse{}, data) }},
+	{"nodeinfo-request", func(data []byte) error { return fuzzDecode(&NodeInfoRequest{}, data) }},
+	{"nodeinfo", func(data []byte) error { return fuzzDecode(&NodeInfo{}, data) }},
+	{"debug-request", func(data []byte) error { return fuzzDecode(&DebugRequest{}, data) }},
+	{"debug-response", func(data []byte) error { return fuzzDecode(&DebugResponse{}, data) }},
+	{"custody-bundle", func(data []byte) error { return fuzzDecode(&CustodyBundle{}, data) }},
+	{"custody-receipt", func(data []byte) error { return fuzzDecode(&CustodyReceipt{}, data) }},
+	{"continuity", func(data []byte) error { return fuzzDecode(&ContinuityRecord{}, data) }},
+	{"certificate", func(data []byte) error { return fuzzDecode(&Certificate{}, data) }},
+	{"certificate-chain", func(data []byte) error { return fuzzDecode(&CertificateChain{}, data) }},
+	{"revocation-list", func(data []byte) error { return fuzzDecode(&RevocationList{}, data) }},
+}
+
+// fuzzDecode decodes the data without recovering from panics, so that the
+// fuzzer sees them, but otherwise checks the result in the same way as
+// Decode.
+func fuzzDecode(v Unmarshaler, data []byte) error {
+	data = data[:len(data):len(data)]
+	n, err := v.UnmarshalBinary(data)
+	switch {
+	case err != nil:
+		return &ParseError{parserName(v), err}
+	case n < 0 || n > len(data):
+		return &ParseError{parserName(v), &LengthError{"input", n, len(data)}}
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"errors"
+	"testing"
+)
+
+// FuzzParsers runs every fuzz target with the first byte choosing which
+// one, i.e. "go test -fuzz FuzzParsers ./types".
+func FuzzParsers(f *testing.F) {
+	frame := &Frame{
+		Version:        Version0,
+		Type:           TypeTraffic,
+		Destination:    Coordinates{1, 2, 3},
+		DestinationKey: PublicKey{1},
+		Source:         Coordinates{4, 5},
+		SourceKey:      PublicKey{2},
+		Payload:        []byte("hello"),
+	}
+	buf := make([]byte, MaxFrameSize)
+	n, err := frame.MarshalBinary(buf)
+	if err != nil {
+		f.Fatal(err)
+	}
+	bootstrap, err := (&VirtualSnakeBootstrap{Sequence: 1, Root: Root{RootSequence: 2}}).AppendBinary(nil)
+	if err != nil {
+		f.Fatal(err)
+	}
+	for i, target := range FuzzTargets {
+		f.Add(uint8(i), []byte{})
+		switch target.Name {
+		case "frame", "frame-strict":
+			f.Add(uint8(i), buf[:n])
+		case "bootstrap":
+			f.Add(uint8(i), bootstrap)
+		}
+	}
+	f.Fuzz(func(t *testing.T, which uint8, data []byte) {
+		target := FuzzTargets[int(which)%len(FuzzTargets)]
+		if err := target.Parse(data); err != nil && !errors.Is(err, ErrMalformed) {
+			t.Fatalf("%s: expected a malformed input error, got %v", target.Name, err)
+		}
+	})
+}
+
+type panickingParser struct{}
+
+func (panickingParser) UnmarshalBinary(data []byte) (int, error) {
+	return 0, []error{}[len(data)]
+}
+
+type overreadingParser struct{}
+
+func (overreadingParser) UnmarshalBinary(data []byte) (int, error) {
+	return len(data) + 1, nil
+}
+
+func TestDecodeErrors(t *testing.T) {
+	var parseErr *ParseError
+	var panicErr *PanicError
+	if _, err := Decode(panickingParser{}, nil); !errors.As(err, &parseErr) || !errors.As(err, &panicErr) {
+		t.Fatalf("expected the panic to be recovered, got %v", err)
+	}
+	if parseErr.Parser != "types.panickingParser" {
+		t.Fatalf("unexpected parser name %q", parseErr.Parser)
+	}
+	var lengthErr *LengthError
+	if _, err := Decode(overreadingParser{}, []byte{1}); !errors.As(err, &lengthErr) || !errors.Is(err, ErrMalformed) {
+		t.Fatalf("expected a length error, got %v", err)
+	}
+	if _, err := Decode(&VirtualSnakeBootstrapACK{}, []byte{1}); !errors.Is(err, ErrMalformed) {
+		t.Fatalf("expected a malformed input error, got %v", err)
+	}
+	var frame Frame
+	if _, err := frame.UnmarshalBinaryStrict([]byte{1, 2}); !errors.Is(err, ErrMalformed) {
+		t.Fatalf("expected strict decoding errors to be malformed input, got %v", err)
+	}
+}
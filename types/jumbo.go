@@ -0,0 +1,199 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"fmt"
+)
+
+// Jumbo frames are traffic frames whose payload is too big for the 16-bit
+// lengths in a Version0 frame. They use Version1, which has the same layout
+// as a Version0 traffic frame except that the frame length and payload
+// length are 32 bits wide, making the header two bytes longer. They must
+// only be sent to peers that agreed to accept them in the handshake.
+
+// JumboFrameHeaderLength is the length of the header of a jumbo frame:
+// 4 magic bytes, 1 byte version, 1 byte type, 2 bytes extra, 4 bytes frame
+// length.
+const JumboFrameHeaderLength = 12
+
+// MaxJumboPayloadSize is the largest payload that a jumbo frame can carry.
+const MaxJumboPayloadSize = 1024 * 1024
+
+// MaxJumboFrameSize is the largest that a jumbo frame can be, including all
+// headers.
+const MaxJumboFrameSize = MaxJumboPayloadSize + MaxFrameSize
+
+// IsJumboFrame returns true if the given frame header belongs to a jumbo
+// frame. At least FrameHeaderLength bytes must be given.
+func IsJumboFrame(header []byte) bool {
+	return FrameVersion(header[4]) == Version1
+}
+
+// JumboFrameLength returns the total length of a jumbo frame from its
+// header. At least JumboFrameHeaderLength bytes must be given.
+func JumboFrameLength(header []byte) int {
+	return int(binary.BigEndian.Uint32(header[FrameHeaderLength-2 : JumboFrameHeaderLength]))
+}
+
+func (f *Frame) marshalJumbo(buffer []byte) (int, error) {
+	if f.Type != TypeTraffic {
+		return 0, fmt.Errorf("jumbo frames can only carry traffic")
+	}
+	payloadLen := len(f.Payload)
+	if payloadLen > MaxJumboPayloadSize {
+		return 0, fmt.Errorf("payload length %d exceeds maximum %d", payloadLen, MaxJumboPayloadSize)
+	}
+	copy(buffer[:4], FrameMagicBytes)
+	buffer[4], buffer[5] = byte(f.Version), byte(f.Type)
+	buffer[6] = f.Extra
+	buffer[7] = f.HopLimit
+	offset := JumboFrameHeaderLength
+	binary.BigEndian.PutUint32(buffer[offset:offset+4], uint32(payloadLen))
+	offset += 4
+	dn, err := f.Destination.MarshalBinary(buffer[offset:])
+	if err != nil {
+		return 0, fmt.Errorf("f.Destination.MarshalBinary: %w", err)
+	}
+	offset += dn
+	sn, err := f.Source.MarshalBinary(buffer[offset:])
+	if err != nil {
+		return 0, fmt.Errorf("f.Source.MarshalBinary: %w", err)
+	}
+	offset += sn
+	offset += copy(buffer[offset:], f.DestinationKey[:ed25519.PublicKeySize])
+	offset += copy(buffer[offset:], f.SourceKey[:ed25519.PublicKeySize])
+	if len(f.Destination) == 0 {
+		offset += copy(buffer[offset:], f.Watermark.PublicKey[:ed25519.PublicKeySize])
+		n, err := f.Watermark.Sequence.MarshalBinary(buffer[offset:])
+		if err != nil {
+			return 0, fmt.Errorf("f.WatermarkSeq.MarshalBinary: %w", err)
+		}
+		offset += n
+	}
+	if len(buffer[offset:]) < payloadLen {
+		return 0, fmt.Errorf("buffer too small for payload")
+	}
+	offset += copy(buffer[offset:], f.Payload)
+	binary.BigEndian.PutUint32(buffer[FrameHeaderLength-2:JumboFrameHeaderLength], uint32(offset))
+	return offset, nil
+}
+
+func (f *Frame) unmarshalJumbo(data []byte) (int, error) {
+	if len(data) < JumboFrameHeaderLength {
+		return 0, fmt.Errorf("frame is not long enough to include metadata")
+	}
+	if len(data) != JumboFrameLength(data) {
+		return 0, fmt.Errorf("frame length incorrect")
+	}
+	f.Version, f.Type = FrameVersion(data[4]), FrameType(data[5])
+	f.Extra = data[6]
+	f.HopLimit = data[7]
+	if f.Type != TypeTraffic {
+		return 0, fmt.Errorf("jumbo frames can only carry traffic")
+	}
+	offset := JumboFrameHeaderLength
+	if len(data) < offset+4 {
+		return 0, fmt.Errorf("frame is not long enough to include payload length")
+	}
+	payloadLen := int(binary.BigEndian.Uint32(data[offset : offset+4]))
+	if payloadLen > MaxJumboPayloadSize {
+		return 0, fmt.Errorf("payload length %d exceeds maximum %d", payloadLen, MaxJumboPayloadSize)
+	}
+	offset += 4
+	f.useCoordsRoom()
+	dstLen, err := f.Destination.UnmarshalBinary(data[offset:])
+	if err != nil {
+		return 0, fmt.Errorf("f.Destination.UnmarshalBinary: %w", err)
+	}
+	offset += dstLen
+	srcLen, err := f.Source.UnmarshalBinary(data[offset:])
+	if err != nil {
+		return 0, fmt.Errorf("f.Source.UnmarshalBinary: %w", err)
+	}
+	offset += srcLen
+	f.keepCoordsRoom()
+	offset += copy(f.DestinationKey[:], data[offset:])
+	offset += copy(f.SourceKey[:], data[offset:])
+	f.Watermark = VirtualSnakeWatermark{
+		PublicKey: FullMask,
+		Sequence:  0,
+	}
+	if len(f.Destination) == 0 {
+		offset += copy(f.Watermark.PublicKey[:], data[offset:])
+		n, err := f.Watermark.Sequence.UnmarshalBinary(data[offset:])
+		if err != nil {
+			return 0, fmt.Errorf("f.WatermarkSeq.UnmarshalBinary: %w", err)
+		}
+		offset += n
+	}
+	if size := offset + payloadLen; len(data) != size {
+		return 0, fmt.Errorf("frame expecting %d total bytes, got %d bytes", size, len(data))
+	}
+	if payloadLen > cap(f.Payload) {
+		f.Payload = make([]byte, payloadLen)
+	}
+	f.Payload = f.Payload[:payloadLen]
+	offset += copy(f.Payload, data[offset:])
+	return offset, nil
+}
+
+func checkJumboFrame(data []byte) error {
+	if len(data) < JumboFrameHeaderLength {
+		return &LengthError{"frame header", JumboFrameHeaderLength, len(data)}
+	}
+	if !bytes.Equal(data[:4], FrameMagicBytes) {
+		return fmt.Errorf("frame doesn't contain magic bytes")
+	}
+	switch framelen := JumboFrameLength(data); {
+	case framelen < JumboFrameHeaderLength:
+		return &LengthError{"frame header", JumboFrameHeaderLength, framelen}
+	case len(data) < framelen:
+		return &LengthError{"frame", framelen, len(data)}
+	case len(data) > framelen:
+		return &TrailingBytesError{"frame", len(data) - framelen}
+	}
+	if t := FrameType(data[5]); t != TypeTraffic {
+		return &UnknownFrameTypeError{t}
+	}
+	r := strictReader{data: data, offset: JumboFrameHeaderLength}
+	r.skip("payload length", 4)
+	if r.err != nil {
+		return r.err
+	}
+	payloadLen := int(binary.BigEndian.Uint32(data[r.offset-4 : r.offset]))
+	if payloadLen > MaxJumboPayloadSize {
+		return fmt.Errorf("payload length %d exceeds maximum %d", payloadLen, MaxJumboPayloadSize)
+	}
+	dstLen := r.coords("destination coordinates")
+	r.coords("source coordinates")
+	r.skip("destination key", ed25519.PublicKeySize)
+	r.skip("source key", ed25519.PublicKeySize)
+	if dstLen == 0 {
+		r.skip("watermark key", ed25519.PublicKeySize)
+		r.varu64("watermark sequence")
+	}
+	r.skip("payload", payloadLen)
+	if r.err != nil {
+		return r.err
+	}
+	if remaining := len(data) - r.offset; remaining > 0 {
+		return &TrailingBytesError{"frame", remaining}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"testing"
+)
+
+func TestMarshalUnmarshalJumboFrame(t *testing.T) {
+	src, _, _ := ed25519.GenerateKey(nil)
+	dst, _, _ := ed25519.GenerateKey(nil)
+	payload := make([]byte, MaxPayloadSize*3)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	for _, coords := range []Coordinates{{1, 2, 3}, {}} {
+		input := Frame{
+			Version:     Version1,
+			Type:        TypeTraffic,
+			HopLimit:    4,
+			Destination: coords,
+			Source:      Coordinates{4, 3, 2, 1},
+			Watermark:   VirtualSnakeWatermark{Sequence: 7},
+			Payload:     payload,
+		}
+		copy(input.DestinationKey[:], dst)
+		copy(input.SourceKey[:], src)
+		copy(input.Watermark.PublicKey[:], src)
+
+		buf := make([]byte, MaxJumboFrameSize)
+		n, err := input.MarshalBinary(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !IsJumboFrame(buf[:n]) || JumboFrameLength(buf[:n]) != n {
+			t.Fatalf("jumbo frame header is wrong")
+		}
+		if err := checkFrame(buf[:n]); err != nil {
+			t.Fatalf("strict check failed: %v", err)
+		}
+
+		// Frames from the pool only have room for a normal payload, so
+		// the payload must grow to fit.
+		output := Frame{Payload: make([]byte, 0, MaxPayloadSize)}
+		if _, err := output.UnmarshalBinary(buf[:n]); err != nil {
+			t.Fatal(err)
+		}
+		if output.Version != Version1 || output.HopLimit != 4 {
+			t.Fatalf("header wasn't decoded properly")
+		}
+		if !output.Destination.EqualTo(input.Destination) || !output.Source.EqualTo(input.Source) {
+			t.Fatalf("coordinates weren't decoded properly")
+		}
+		if output.DestinationKey != input.DestinationKey || output.SourceKey != input.SourceKey {
+			t.Fatalf("keys weren't decoded properly")
+		}
+		if len(coords) == 0 && output.Watermark != input.Watermark {
+			t.Fatalf("watermark wasn't decoded properly")
+		}
+		if !bytes.Equal(output.Payload, payload) {
+			t.Fatalf("payload wasn't decoded properly")
+		}
+	}
+}
+
+func TestJumboFrameOnlyCarriesTraffic(t *testing.T) {
+	input := Frame{
+		Version: Version1,
+		Type:    TypeBootstrap,
+	}
+	buf := make([]byte, MaxJumboFrameSize)
+	if _, err := input.MarshalBinary(buf); err == nil {
+		t.Fatalf("jumbo bootstrap frame shouldn't have been marshalled")
+	}
+
+	input.Type = TypeTraffic
+	n, err := input.MarshalBinary(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf[5] = byte(TypeBootstrap)
+	var output Frame
+	if _, err := output.UnmarshalBinary(buf[:n]); err == nil {
+		t.Fatalf("jumbo bootstrap frame shouldn't have been unmarshalled")
+	}
+	if err := checkFrame(buf[:n]); err == nil {
+		t.Fatalf("jumbo bootstrap frame shouldn't have passed strict checks")
+	}
+}
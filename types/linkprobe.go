@@ -0,0 +1,47 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import "fmt"
+
+// LinkProbe is exchanged between direct peers to negotiate fast failure
+// detection on a peering. Interval is the rate, in milliseconds, at which
+// the sender would like to receive frames from the remote side, or zero
+// if the sender doesn't want fast failure detection itself.
+type LinkProbe struct {
+	Interval Varu64 `json:"interval_ms"`
+}
+
+func (l *LinkProbe) MarshalBinary(buf []byte) (int, error) {
+	if len(buf) < l.Interval.Length() {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	n, err := l.Interval.MarshalBinary(buf)
+	if err != nil {
+		return 0, fmt.Errorf("l.Interval.MarshalBinary: %w", err)
+	}
+	return n, nil
+}
+
+func (l *LinkProbe) UnmarshalBinary(buf []byte) (int, error) {
+	if len(buf) < l.Interval.MinLength() {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	n, err := l.Interval.UnmarshalBinary(buf)
+	if err != nil {
+		return 0, fmt.Errorf("l.Interval.UnmarshalBinary: %w", err)
+	}
+	return n, nil
+}
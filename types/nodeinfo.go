@@ -0,0 +1,164 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"fmt"
+	"unicode/utf8"
+)
+
+// MaxNodeInfoFieldLength is the longest that each of the text fields of a
+// node info response can be.
+const MaxNodeInfoFieldLength = 64
+
+// nodeInfoSigningContext is signed along with node info requests and
+// responses, so that the signatures can't be mistaken for ones over debug
+// frames or anything else signed with the same key.
+const nodeInfoSigningContext = "pinecone node info"
+
+// NodeInfoRequest is the payload of a node info request frame. The
+// signature is made by the node asking, over the key of the node being
+// asked and the ID, so that the node being asked knows who is asking.
+type NodeInfoRequest struct {
+	ID        Varu64    `json:"id"` // Chosen by the node asking, to match up the response
+	Signature Signature `json:"signature"`
+}
+
+// ProtectedPayload returns the part of the request that is signed.
+func (r *NodeInfoRequest) ProtectedPayload(to PublicKey) ([]byte, error) {
+	b := append([]byte(nodeInfoSigningContext), to[:]...)
+	return r.ID.AppendBinary(b)
+}
+
+func (r *NodeInfoRequest) MarshalBinary(buf []byte) (int, error) {
+	return marshalInto(buf, r)
+}
+
+func (r *NodeInfoRequest) AppendBinary(b []byte) ([]byte, error) {
+	b, err := r.ID.AppendBinary(b)
+	if err != nil {
+		return nil, fmt.Errorf("r.ID.AppendBinary: %w", err)
+	}
+	return append(b, r.Signature[:]...), nil
+}
+
+func (r *NodeInfoRequest) UnmarshalBinary(buf []byte) (int, error) {
+	n, err := r.ID.UnmarshalBinary(buf)
+	if err != nil {
+		return 0, fmt.Errorf("r.ID.UnmarshalBinary: %w", err)
+	}
+	if len(buf) < n+ed25519.SignatureSize {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	n += copy(r.Signature[:], buf[n:])
+	return n, nil
+}
+
+// NodeInfo is the payload of a node info response frame, which describes
+// the node that sent it. The signature is made by that node, over the key
+// of the node that asked and everything else in the response.
+type NodeInfo struct {
+	ID           Varu64    `json:"id"` // From the request
+	Version      uint8     `json:"version"`
+	Capabilities uint32    `json:"capabilities"`
+	Peers        Varu64    `json:"peers"`
+	Uptime       Varu64    `json:"uptime"` // In seconds
+	Name         string    `json:"name"`
+	Software     string    `json:"software"`
+	Contact      string    `json:"contact"`
+	Signature    Signature `json:"signature"`
+}
+
+// ProtectedPayload returns the part of the response that is signed.
+func (i *NodeInfo) ProtectedPayload(to PublicKey) ([]byte, error) {
+	return i.appendUnsigned(append([]byte(nodeInfoSigningContext), to[:]...))
+}
+
+func (i *NodeInfo) appendUnsigned(b []byte) ([]byte, error) {
+	b, err := i.ID.AppendBinary(b)
+	if err != nil {
+		return nil, fmt.Errorf("i.ID.AppendBinary: %w", err)
+	}
+	b = append(b, i.Version, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(b[len(b)-4:], i.Capabilities)
+	if b, err = i.Peers.AppendBinary(b); err != nil {
+		return nil, fmt.Errorf("i.Peers.AppendBinary: %w", err)
+	}
+	if b, err = i.Uptime.AppendBinary(b); err != nil {
+		return nil, fmt.Errorf("i.Uptime.AppendBinary: %w", err)
+	}
+	for _, field := range []string{i.Name, i.Software, i.Contact} {
+		if len(field) > MaxNodeInfoFieldLength {
+			return nil, fmt.Errorf("field of length %d is too long", len(field))
+		}
+		b = append(b, byte(len(field)))
+		b = append(b, field...)
+	}
+	return b, nil
+}
+
+func (i *NodeInfo) MarshalBinary(buf []byte) (int, error) {
+	return marshalInto(buf, i)
+}
+
+func (i *NodeInfo) AppendBinary(b []byte) ([]byte, error) {
+	b, err := i.appendUnsigned(b)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, i.Signature[:]...), nil
+}
+
+func (i *NodeInfo) UnmarshalBinary(buf []byte) (int, error) {
+	offset, err := i.ID.UnmarshalBinary(buf)
+	if err != nil {
+		return 0, fmt.Errorf("i.ID.UnmarshalBinary: %w", err)
+	}
+	if len(buf) < offset+5 {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	i.Version = buf[offset]
+	i.Capabilities = binary.BigEndian.Uint32(buf[offset+1:])
+	offset += 5
+	for _, n := range []*Varu64{&i.Peers, &i.Uptime} {
+		l, err := n.UnmarshalBinary(buf[offset:])
+		if err != nil {
+			return 0, fmt.Errorf("n.UnmarshalBinary: %w", err)
+		}
+		offset += l
+	}
+	for _, field := range []*string{&i.Name, &i.Software, &i.Contact} {
+		if len(buf) < offset+1 {
+			return 0, fmt.Errorf("buffer too small")
+		}
+		l := int(buf[offset])
+		offset++
+		if l > MaxNodeInfoFieldLength || len(buf) < offset+l {
+			return 0, fmt.Errorf("field of length %d is too long", l)
+		}
+		if !utf8.Valid(buf[offset : offset+l]) {
+			return 0, fmt.Errorf("field isn't valid UTF-8")
+		}
+		*field = string(buf[offset : offset+l])
+		offset += l
+	}
+	if len(buf) < offset+ed25519.SignatureSize {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	offset += copy(i.Signature[:], buf[offset:])
+	return offset, nil
+}
@@ -0,0 +1,102 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"crypto/ed25519"
+	"strings"
+	"testing"
+)
+
+func TestMarshalUnmarshalNodeInfo(t *testing.T) {
+	input := NodeInfo{
+		ID:           7,
+		Version:      2,
+		Capabilities: 0xdeadbeef,
+		Peers:        12,
+		Uptime:       86400,
+		Name:         "relay-1",
+		Software:     "pinecone/1.0",
+		Contact:      "@ops:example.org",
+		Signature:    Signature{1, 2, 3},
+	}
+	b, err := input.AppendBinary(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var output NodeInfo
+	n, err := output.UnmarshalBinary(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(b) || output != input {
+		t.Fatalf("expected %+v, got %+v", input, output)
+	}
+	if _, err := output.UnmarshalBinary(b[:len(b)-1]); err == nil {
+		t.Fatalf("expected a truncated response to fail")
+	}
+	input.Contact = strings.Repeat("a", MaxNodeInfoFieldLength+1)
+	if _, err := input.AppendBinary(nil); err == nil {
+		t.Fatalf("expected a field that is too long to fail")
+	}
+}
+
+func TestMarshalUnmarshalNodeInfoRequest(t *testing.T) {
+	input := NodeInfoRequest{ID: 1 << 20, Signature: Signature{9}}
+	var buf [128]byte
+	n, err := input.MarshalBinary(buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var output NodeInfoRequest
+	if _, err := output.UnmarshalBinary(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if output != input {
+		t.Fatalf("expected %+v, got %+v", input, output)
+	}
+}
+
+func TestNodeInfoSigningContext(t *testing.T) {
+	sk := newTestKey(t)
+	to := PublicKey{7}
+	request := NodeInfoRequest{ID: 3}
+	payload, err := request.ProtectedPayload(to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(request.Signature[:], ed25519.Sign(sk[:], payload))
+
+	// A signature over a node info request isn't valid for a debug request
+	// with the same ID, or for the request without the signing context.
+	debug := DebugRequest{ID: request.ID}
+	debugPayload, err := debug.ProtectedPayload(to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bare, err := request.ID.AppendBinary(append([]byte{}, to[:]...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	public := ed25519.PrivateKey(sk[:]).Public().(ed25519.PublicKey)
+	switch {
+	case !ed25519.Verify(public, payload, request.Signature[:]):
+		t.Fatalf("expected the node info request signature to verify")
+	case ed25519.Verify(public, debugPayload, request.Signature[:]):
+		t.Fatalf("node info request signature verified as a debug request")
+	case ed25519.Verify(public, bare, request.Signature[:]):
+		t.Fatalf("signature without the signing context verified")
+	}
+}
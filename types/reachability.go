@@ -0,0 +1,101 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"fmt"
+	"hash/fnv"
+)
+
+// ReachabilityFilterSize is the size of a reachability filter in bytes.
+const ReachabilityFilterSize = 1024
+
+// reachabilityFilterHashes is how many bits are set in the filter for
+// each key.
+const reachabilityFilterHashes = 4
+
+// ReachabilityFilter is a bloom filter of the keys that a node can reach.
+// It can return false positives but never false negatives.
+type ReachabilityFilter [ReachabilityFilterSize]byte
+
+// reachabilityFilterBits returns the bits in the filter that represent the
+// given key, using double hashing to derive them from a single hash.
+func reachabilityFilterBits(key PublicKey) [reachabilityFilterHashes]uint32 {
+	h := fnv.New64a()
+	_, _ = h.Write(key[:])
+	sum := h.Sum64()
+	h1, h2 := uint32(sum), uint32(sum>>32)|1
+	var bits [reachabilityFilterHashes]uint32
+	for i := range bits {
+		bits[i] = (h1 + uint32(i)*h2) % (ReachabilityFilterSize * 8)
+	}
+	return bits
+}
+
+// Add adds the key to the filter.
+func (f *ReachabilityFilter) Add(key PublicKey) {
+	for _, bit := range reachabilityFilterBits(key) {
+		f[bit/8] |= 1 << (bit % 8)
+	}
+}
+
+// Contains returns true if the key might be in the filter, or false if it
+// definitely isn't.
+func (f *ReachabilityFilter) Contains(key PublicKey) bool {
+	for _, bit := range reachabilityFilterBits(key) {
+		if f[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Reachability is sent periodically to each direct peer with a filter of
+// the keys that can be reached through us, under the given root.
+type Reachability struct {
+	Root
+	Filter ReachabilityFilter `json:"filter"`
+}
+
+func (r *Reachability) MarshalBinary(buf []byte) (int, error) {
+	if len(buf) < r.Root.Length()+ReachabilityFilterSize {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	offset := copy(buf, r.RootPublicKey[:])
+	n, err := r.RootSequence.MarshalBinary(buf[offset:])
+	if err != nil {
+		return 0, fmt.Errorf("r.RootSequence.MarshalBinary: %w", err)
+	}
+	offset += n
+	offset += copy(buf[offset:], r.Filter[:])
+	return offset, nil
+}
+
+func (r *Reachability) UnmarshalBinary(buf []byte) (int, error) {
+	if len(buf) < r.Root.MinLength()+ReachabilityFilterSize {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	offset := copy(r.RootPublicKey[:], buf)
+	n, err := r.RootSequence.UnmarshalBinary(buf[offset:])
+	if err != nil {
+		return 0, fmt.Errorf("r.RootSequence.UnmarshalBinary: %w", err)
+	}
+	offset += n
+	if len(buf) < offset+ReachabilityFilterSize {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	offset += copy(r.Filter[:], buf[offset:])
+	return offset, nil
+}
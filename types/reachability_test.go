@@ -0,0 +1,71 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"crypto/ed25519"
+	"testing"
+)
+
+func TestReachabilityFilter(t *testing.T) {
+	var filter ReachabilityFilter
+	var added []PublicKey
+	for i := 0; i < 500; i++ {
+		pk, _, _ := ed25519.GenerateKey(nil)
+		var key PublicKey
+		copy(key[:], pk)
+		filter.Add(key)
+		added = append(added, key)
+	}
+	for _, key := range added {
+		if !filter.Contains(key) {
+			t.Fatalf("filter should contain %s", key)
+		}
+	}
+	falsePositives := 0
+	for i := 0; i < 1000; i++ {
+		pk, _, _ := ed25519.GenerateKey(nil)
+		var key PublicKey
+		copy(key[:], pk)
+		if filter.Contains(key) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 20 {
+		t.Fatalf("too many false positives: %d of 1000", falsePositives)
+	}
+}
+
+func TestMarshalUnmarshalReachability(t *testing.T) {
+	input := &Reachability{
+		Root: Root{RootPublicKey: PublicKey{9}, RootSequence: 300},
+	}
+	input.Filter.Add(PublicKey{1})
+	var buffer [65535]byte
+	n, err := input.MarshalBinary(buffer[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var output Reachability
+	if _, err = output.UnmarshalBinary(buffer[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if output != *input {
+		t.Fatalf("reachability doesn't match")
+	}
+	if _, err = output.UnmarshalBinary(buffer[:n-1]); err == nil {
+		t.Fatalf("expected truncated reachability to fail")
+	}
+}
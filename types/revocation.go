@@ -0,0 +1,134 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"fmt"
+)
+
+// revocationSigningContext is signed along with revocation lists, so that
+// the signatures can't be mistaken for certificates or anything else signed
+// by the same authority.
+const revocationSigningContext = "pinecone revocation list"
+
+// RevocationList is a list of node keys that have been banned by the
+// authority of a deployment. Each new list replaces the previous one
+// entirely, so the sequence must increase every time that it changes.
+type RevocationList struct {
+	Sequence  Varu64      `json:"sequence"`
+	Keys      []PublicKey `json:"keys"`
+	Signature Signature   `json:"signature"`
+}
+
+// MaxRevokedKeys is the largest number of keys that a revocation list can
+// contain, so that the list fits into a single frame.
+const MaxRevokedKeys = 1024
+
+// NewRevocationList creates a revocation list signed by the authority.
+func NewRevocationList(authority PrivateKey, sequence uint64, keys []PublicKey) (RevocationList, error) {
+	l := RevocationList{
+		Sequence: Varu64(sequence),
+		Keys:     append([]PublicKey{}, keys...),
+	}
+	protected, err := l.ProtectedPayload()
+	if err != nil {
+		return RevocationList{}, err
+	}
+	copy(l.Signature[:], ed25519.Sign(authority[:], protected))
+	return l, nil
+}
+
+func (l *RevocationList) ProtectedPayload() ([]byte, error) {
+	buffer := make([]byte, len(revocationSigningContext)+l.Sequence.Length()+2+len(l.Keys)*ed25519.PublicKeySize)
+	offset := copy(buffer, revocationSigningContext)
+	n, err := l.marshalProtected(buffer[offset:])
+	if err != nil {
+		return nil, err
+	}
+	return buffer[:offset+n], nil
+}
+
+func (l *RevocationList) marshalProtected(buf []byte) (int, error) {
+	if len(l.Keys) > MaxRevokedKeys {
+		return 0, fmt.Errorf("too many revoked keys")
+	}
+	offset := 0
+	n, err := l.Sequence.MarshalBinary(buf[offset:])
+	if err != nil {
+		return 0, fmt.Errorf("l.Sequence.MarshalBinary: %w", err)
+	}
+	offset += n
+	binary.BigEndian.PutUint16(buf[offset:], uint16(len(l.Keys)))
+	offset += 2
+	for _, key := range l.Keys {
+		offset += copy(buf[offset:], key[:])
+	}
+	return offset, nil
+}
+
+// Verify checks that the list was signed by the given authority.
+func (l *RevocationList) Verify(authority PublicKey) error {
+	protected, err := l.ProtectedPayload()
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(authority[:], protected, l.Signature[:]) {
+		return fmt.Errorf("revocation list signature invalid")
+	}
+	return nil
+}
+
+func (l *RevocationList) MarshalBinary(buf []byte) (int, error) {
+	if len(buf) < l.Sequence.Length()+2+len(l.Keys)*ed25519.PublicKeySize+ed25519.SignatureSize {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	offset, err := l.marshalProtected(buf)
+	if err != nil {
+		return 0, err
+	}
+	offset += copy(buf[offset:], l.Signature[:])
+	return offset, nil
+}
+
+func (l *RevocationList) UnmarshalBinary(buf []byte) (int, error) {
+	if len(buf) < l.Sequence.MinLength()+2+ed25519.SignatureSize {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	offset := 0
+	n, err := l.Sequence.UnmarshalBinary(buf[offset:])
+	if err != nil {
+		return 0, fmt.Errorf("l.Sequence.UnmarshalBinary: %w", err)
+	}
+	offset += n
+	if len(buf) < offset+2 {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	count := int(binary.BigEndian.Uint16(buf[offset:]))
+	offset += 2
+	if count > MaxRevokedKeys {
+		return 0, fmt.Errorf("too many revoked keys")
+	}
+	if len(buf) < offset+count*ed25519.PublicKeySize+ed25519.SignatureSize {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	l.Keys = make([]PublicKey, count)
+	for i := range l.Keys {
+		offset += copy(l.Keys[i][:], buf[offset:])
+	}
+	offset += copy(l.Signature[:], buf[offset:])
+	return offset, nil
+}
@@ -0,0 +1,73 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"crypto/ed25519"
+	"testing"
+)
+
+func TestRevocationList(t *testing.T) {
+	authority, other := newTestKey(t), newTestKey(t)
+	keys := []PublicKey{newTestKey(t).Public(), newTestKey(t).Public()}
+	list, err := NewRevocationList(authority, 3, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := list.Verify(authority.Public()); err != nil {
+		t.Fatalf("valid list failed to verify: %s", err)
+	}
+	if err := list.Verify(other.Public()); err == nil {
+		t.Fatalf("list verified against the wrong authority")
+	}
+	bare := make([]byte, MaxPayloadSize)
+	n, err := list.marshalProtected(bare)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if public := authority.Public(); ed25519.Verify(public[:], bare[:n], list.Signature[:]) {
+		t.Fatalf("list verified without the signing context")
+	}
+
+	buf := make([]byte, MaxPayloadSize)
+	n, err = list.MarshalBinary(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded RevocationList
+	if _, err := decoded.UnmarshalBinary(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Sequence != list.Sequence || len(decoded.Keys) != len(keys) {
+		t.Fatalf("wrong list (got %+v, expected %+v)", decoded, list)
+	}
+	for i := range keys {
+		if decoded.Keys[i] != keys[i] {
+			t.Fatalf("wrong key at index %d", i)
+		}
+	}
+	if err := decoded.Verify(authority.Public()); err != nil {
+		t.Fatalf("decoded list failed to verify: %s", err)
+	}
+	if _, err := decoded.UnmarshalBinary(buf[:n-1]); err == nil {
+		t.Fatalf("expected truncated list to fail to decode")
+	}
+
+	tampered := decoded
+	tampered.Keys = tampered.Keys[:1]
+	if err := tampered.Verify(authority.Public()); err == nil {
+		t.Fatalf("tampered list verified")
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"crypto/ed25519"
+	"fmt"
+)
+
+// searchSigningContext is signed along with search responses, so that the
+// signatures can't be mistaken for ones over anything else.
+const searchSigningContext = "pinecone search"
+
+// SearchRequest is the payload of a search request frame. The point in the
+// keyspace that is being searched for is the destination key of the frame.
+type SearchRequest struct {
+	ID Varu64 `json:"id"` // Chosen by the node searching, to match up the response
+}
+
+func (r *SearchRequest) MarshalBinary(buf []byte) (int, error) {
+	return marshalInto(buf, r)
+}
+
+func (r *SearchRequest) AppendBinary(b []byte) ([]byte, error) {
+	return r.ID.AppendBinary(b)
+}
+
+func (r *SearchRequest) UnmarshalBinary(buf []byte) (int, error) {
+	n, err := r.ID.UnmarshalBinary(buf)
+	if err != nil {
+		return 0, fmt.Errorf("r.ID.UnmarshalBinary: %w", err)
+	}
+	return n, nil
+}
+
+// SearchResponse is the payload of a search response frame, which is sent
+// by the node that the search request reached. The signature is made by
+// that node, over the key of the node searching, the target and the ID, so
+// that the node searching knows that the node really exists.
+type SearchResponse struct {
+	ID        Varu64    `json:"id"`     // From the request
+	Target    PublicKey `json:"target"` // The destination key of the request
+	Signature Signature `json:"signature"`
+}
+
+// ProtectedPayload returns the part of the response that is signed.
+func (r *SearchResponse) ProtectedPayload(to PublicKey) ([]byte, error) {
+	b := append([]byte(searchSigningContext), to[:]...)
+	b = append(b, r.Target[:]...)
+	return r.ID.AppendBinary(b)
+}
+
+func (r *SearchResponse) MarshalBinary(buf []byte) (int, error) {
+	return marshalInto(buf, r)
+}
+
+func (r *SearchResponse) AppendBinary(b []byte) ([]byte, error) {
+	b, err := r.ID.AppendBinary(b)
+	if err != nil {
+		return nil, fmt.Errorf("r.ID.AppendBinary: %w", err)
+	}
+	b = append(b, r.Target[:]...)
+	return append(b, r.Signature[:]...), nil
+}
+
+func (r *SearchResponse) UnmarshalBinary(buf []byte) (int, error) {
+	n, err := r.ID.UnmarshalBinary(buf)
+	if err != nil {
+		return 0, fmt.Errorf("r.ID.UnmarshalBinary: %w", err)
+	}
+	if len(buf) < n+ed25519.PublicKeySize+ed25519.SignatureSize {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	n += copy(r.Target[:], buf[n:])
+	n += copy(r.Signature[:], buf[n:])
+	return n, nil
+}
@@ -0,0 +1,40 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import "testing"
+
+func TestMarshalUnmarshalSearchResponse(t *testing.T) {
+	input := SearchResponse{
+		ID:        1234,
+		Target:    PublicKey{1, 2, 3},
+		Signature: Signature{4, 5, 6},
+	}
+	var buf [128]byte
+	n, err := input.MarshalBinary(buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var output SearchResponse
+	if m, err := output.UnmarshalBinary(buf[:n]); err != nil || m != n {
+		t.Fatalf("failed to unmarshal: %v (%d of %d bytes)", err, m, n)
+	}
+	if output != input {
+		t.Fatalf("expected %+v, got %+v", input, output)
+	}
+	if _, err := output.UnmarshalBinary(buf[:n-1]); err == nil {
+		t.Fatalf("expected a truncated response to fail")
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"math"
+)
+
+// serviceSigningContext is signed along with service advertisements and
+// their localities, so that the signatures can't be mistaken for ones over
+// anything else.
+const serviceSigningContext = "pinecone service"
+
+// ServiceAdvertisement is the payload of a service advertisement frame,
+// in which a node tells other nodes that it offers a service, such as a
+// relay or a mailbox, and how much capacity it has for it. The meaning of
+// the capacity is up to the service. The signature is made by the node that
+// sent the advertisement, whose key is the source key of the frame.
+//
+// The advertisement can also carry the locality of the node. This comes
+// after the signature, so that older nodes ignore it, and has a signature
+// of its own which covers the rest of the advertisement too.
+type ServiceAdvertisement struct {
+	Sequence          Varu64    `json:"sequence"`
+	Service           string    `json:"service"`
+	Capacity          Varu64    `json:"capacity"`
+	Signature         Signature `json:"signature"`
+	Locality          string    `json:"locality,omitempty"`
+	LocalitySignature Signature `json:"-"`
+}
+
+// MaxServiceNameLength is the longest service name that can be advertised.
+const MaxServiceNameLength = math.MaxUint8
+
+// MaxLocalityLength is the longest locality hint that a node can give.
+const MaxLocalityLength = 32
+
+func (a *ServiceAdvertisement) ProtectedPayload() ([]byte, error) {
+	buffer := make([]byte, len(serviceSigningContext)+a.Sequence.Length()+1+len(a.Service)+a.Capacity.Length())
+	offset := copy(buffer, serviceSigningContext)
+	n, err := a.marshalProtected(buffer[offset:])
+	if err != nil {
+		return nil, err
+	}
+	return buffer[:offset+n], nil
+}
+
+// LocalityPayload returns the part of the advertisement that is covered by
+// the locality signature.
+func (a *ServiceAdvertisement) LocalityPayload() ([]byte, error) {
+	if len(a.Locality) == 0 || len(a.Locality) > MaxLocalityLength {
+		return nil, fmt.Errorf("invalid locality")
+	}
+	buffer := make([]byte, len(serviceSigningContext)+a.Sequence.Length()+1+len(a.Service)+a.Capacity.Length()+1+len(a.Locality))
+	offset := copy(buffer, serviceSigningContext)
+	n, err := a.marshalProtected(buffer[offset:])
+	if err != nil {
+		return nil, err
+	}
+	offset += n
+	buffer[offset] = byte(len(a.Locality))
+	offset++
+	offset += copy(buffer[offset:], a.Locality)
+	return buffer[:offset], nil
+}
+
+func (a *ServiceAdvertisement) marshalProtected(buf []byte) (int, error) {
+	if len(a.Service) > MaxServiceNameLength {
+		return 0, fmt.Errorf("service name too long")
+	}
+	offset := 0
+	n, err := a.Sequence.MarshalBinary(buf[offset:])
+	if err != nil {
+		return 0, fmt.Errorf("a.Sequence.MarshalBinary: %w", err)
+	}
+	offset += n
+	buf[offset] = byte(len(a.Service))
+	offset++
+	offset += copy(buf[offset:], a.Service)
+	n, err = a.Capacity.MarshalBinary(buf[offset:])
+	if err != nil {
+		return 0, fmt.Errorf("a.Capacity.MarshalBinary: %w", err)
+	}
+	offset += n
+	return offset, nil
+}
+
+func (a *ServiceAdvertisement) MarshalBinary(buf []byte) (int, error) {
+	length := a.Sequence.Length() + 1 + len(a.Service) + a.Capacity.Length() + ed25519.SignatureSize
+	if a.Locality != "" {
+		if len(a.Locality) > MaxLocalityLength {
+			return 0, fmt.Errorf("locality too long")
+		}
+		length += 1 + len(a.Locality) + ed25519.SignatureSize
+	}
+	if len(buf) < length {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	offset, err := a.marshalProtected(buf)
+	if err != nil {
+		return 0, err
+	}
+	offset += copy(buf[offset:], a.Signature[:])
+	if a.Locality != "" {
+		buf[offset] = byte(len(a.Locality))
+		offset++
+		offset += copy(buf[offset:], a.Locality)
+		offset += copy(buf[offset:], a.LocalitySignature[:])
+	}
+	return offset, nil
+}
+
+func (a *ServiceAdvertisement) UnmarshalBinary(buf []byte) (int, error) {
+	if len(buf) < a.Sequence.MinLength()+1+a.Capacity.MinLength()+ed25519.SignatureSize {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	offset := 0
+	n, err := a.Sequence.UnmarshalBinary(buf[offset:])
+	if err != nil {
+		return 0, fmt.Errorf("a.Sequence.UnmarshalBinary: %w", err)
+	}
+	offset += n
+	l := int(buf[offset])
+	offset++
+	if len(buf) < offset+l+a.Capacity.MinLength()+ed25519.SignatureSize {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	a.Service = string(buf[offset : offset+l])
+	offset += l
+	n, err = a.Capacity.UnmarshalBinary(buf[offset:])
+	if err != nil {
+		return 0, fmt.Errorf("a.Capacity.UnmarshalBinary: %w", err)
+	}
+	offset += n
+	if len(buf) < offset+ed25519.SignatureSize {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	offset += copy(a.Signature[:], buf[offset:])
+	a.Locality = ""
+	if len(buf) == offset {
+		return offset, nil
+	}
+	l = int(buf[offset])
+	offset++
+	if l == 0 || l > MaxLocalityLength {
+		return 0, fmt.Errorf("invalid locality length %d", l)
+	}
+	if len(buf) < offset+l+ed25519.SignatureSize {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	a.Locality = string(buf[offset : offset+l])
+	offset += l
+	offset += copy(a.LocalitySignature[:], buf[offset:])
+	return offset, nil
+}
@@ -0,0 +1,100 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"testing"
+)
+
+func TestServiceAdvertisementLocality(t *testing.T) {
+	input := ServiceAdvertisement{
+		Sequence:          7,
+		Service:           "relay",
+		Capacity:          100,
+		Signature:         Signature{1, 2, 3},
+		Locality:          "eu-west",
+		LocalitySignature: Signature{4, 5, 6},
+	}
+	buf := make([]byte, MaxPayloadSize)
+	n, err := input.MarshalBinary(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var output ServiceAdvertisement
+	if _, err := output.UnmarshalBinary(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if output != input {
+		t.Fatalf("wrong advertisement (got %+v, expected %+v)", output, input)
+	}
+	if _, err := output.UnmarshalBinary(buf[:n-1]); err == nil {
+		t.Fatalf("expected truncated locality to fail to decode")
+	}
+
+	// Without a locality, the advertisement is the same as it always was.
+	input.Locality = ""
+	n, err = input.MarshalBinary(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := input.Sequence.Length() + 1 + len(input.Service) + input.Capacity.Length() + len(input.Signature); n != expected {
+		t.Fatalf("expected %d bytes, got %d", expected, n)
+	}
+	if _, err := output.UnmarshalBinary(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if output.Locality != "" {
+		t.Fatalf("expected no locality, got %q", output.Locality)
+	}
+
+	input.Locality = "this-locality-is-much-too-long-to-be-sent"
+	if _, err := input.MarshalBinary(buf); err == nil {
+		t.Fatalf("expected locality that is too long to be rejected")
+	}
+}
+
+func TestServiceAdvertisementSigningContext(t *testing.T) {
+	sk := newTestKey(t)
+	advertisement := ServiceAdvertisement{Sequence: 7, Service: "relay", Capacity: 100, Locality: "eu-west"}
+	payload, err := advertisement.ProtectedPayload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(advertisement.Signature[:], ed25519.Sign(sk[:], payload))
+
+	// The signature doesn't verify without the signing context, and the
+	// locality is signed with it too.
+	bare := make([]byte, len(payload))
+	n, err := advertisement.marshalProtected(bare)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public := ed25519.PrivateKey(sk[:]).Public().(ed25519.PublicKey)
+	switch {
+	case !ed25519.Verify(public, payload, advertisement.Signature[:]):
+		t.Fatalf("expected the advertisement signature to verify")
+	case ed25519.Verify(public, bare[:n], advertisement.Signature[:]):
+		t.Fatalf("signature without the signing context verified")
+	}
+	locality, err := advertisement.LocalityPayload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(locality, payload) || !bytes.HasSuffix(locality, []byte(advertisement.Locality)) {
+		t.Fatalf("expected the locality payload to extend the advertisement payload")
+	}
+}
@@ -20,9 +20,9 @@ import (
 )
 
 type SignatureWithHop struct {
-	Hop       Varu64
-	PublicKey PublicKey
-	Signature Signature
+	Hop       Varu64    `json:"hop"`
+	PublicKey PublicKey `json:"public_key"`
+	Signature Signature `json:"signature"`
 }
 
 const SignatureWithHopMinSize = ed25519.PublicKeySize + ed25519.SignatureSize + 1
@@ -43,14 +43,15 @@ func (a *SignatureWithHop) UnmarshalBinary(data []byte) (int, error) {
 }
 
 func (a *SignatureWithHop) MarshalBinary(data []byte) (int, error) {
-	offset, err := a.Hop.MarshalBinary(data[:])
+	return marshalInto(data, a)
+}
+
+func (a *SignatureWithHop) AppendBinary(b []byte) ([]byte, error) {
+	b, err := a.Hop.AppendBinary(b)
 	if err != nil {
-		return 0, fmt.Errorf("a.Hop.MarshalBinary: %w", err)
-	}
-	if len(data) < SignatureWithHopMinSize {
-		return 0, fmt.Errorf("buffer is not big enough (must be %d bytes)", SignatureWithHopMinSize)
+		return nil, fmt.Errorf("a.Hop.AppendBinary: %w", err)
 	}
-	offset += copy(data[offset:offset+ed25519.PublicKeySize], a.PublicKey[:])
-	offset += copy(data[offset:offset+ed25519.SignatureSize], a.Signature[:])
-	return offset, nil
+	b = append(b, a.PublicKey[:]...)
+	b = append(b, a.Signature[:]...)
+	return b, nil
 }
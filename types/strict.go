@@ -0,0 +1,320 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// maxVaru64Length is the longest possible encoding of a Varu64, since
+// each byte carries 7 bits of the value.
+const maxVaru64Length = 10
+
+// TrailingBytesError is returned by strict decoding when there are bytes
+// left over after the structure has been fully decoded.
+type TrailingBytesError struct {
+	Field    string
+	Trailing int
+}
+
+func (e *TrailingBytesError) Error() string {
+	return fmt.Sprintf("%s has %d trailing bytes", e.Field, e.Trailing)
+}
+
+func (e *TrailingBytesError) Is(target error) bool {
+	return target == ErrMalformed
+}
+
+// LengthError is returned by strict decoding when a length, either given
+// explicitly on the wire or implied by the structure, doesn't fit into the
+// data that is actually available.
+type LengthError struct {
+	Field     string
+	Length    int
+	Available int
+}
+
+func (e *LengthError) Error() string {
+	return fmt.Sprintf("%s needs %d bytes but only %d bytes are available", e.Field, e.Length, e.Available)
+}
+
+func (e *LengthError) Is(target error) bool {
+	return target == ErrMalformed
+}
+
+// NonCanonicalVaru64Error is returned by strict decoding when a Varu64 is
+// not encoded in its shortest form, is unterminated or overflows 64 bits.
+type NonCanonicalVaru64Error struct {
+	Field string
+}
+
+func (e *NonCanonicalVaru64Error) Error() string {
+	return fmt.Sprintf("%s is not a canonical varu64", e.Field)
+}
+
+func (e *NonCanonicalVaru64Error) Is(target error) bool {
+	return target == ErrMalformed
+}
+
+// MagicBytesError is returned by strict decoding when the frame doesn't
+// start with the frame magic bytes.
+type MagicBytesError struct {
+	Found []byte
+}
+
+func (e *MagicBytesError) Error() string {
+	return fmt.Sprintf("frame doesn't contain magic bytes (found %x)", e.Found)
+}
+
+func (e *MagicBytesError) Is(target error) bool {
+	return target == ErrMalformed
+}
+
+// UnknownFrameTypeError is returned by strict decoding when the frame type
+// is not one that we know how to decode.
+type UnknownFrameTypeError struct {
+	Type FrameType
+}
+
+func (e *UnknownFrameTypeError) Error() string {
+	return fmt.Sprintf("unknown frame type %d", e.Type)
+}
+
+func (e *UnknownFrameTypeError) Is(target error) bool {
+	return target == ErrMalformed
+}
+
+// UnmarshalBinaryStrict decodes a Varu64, rejecting encodings that are
+// unterminated, longer than necessary or that overflow 64 bits.
+func (n *Varu64) UnmarshalBinaryStrict(buf []byte) (int, error) {
+	l, err := checkVaru64("varu64", buf)
+	if err != nil {
+		return 0, err
+	}
+	return n.UnmarshalBinary(buf[:l])
+}
+
+// UnmarshalBinaryStrict decodes coordinates, rejecting non-canonical port
+// numbers and lengths which exceed the available data.
+func (p *Coordinates) UnmarshalBinaryStrict(b []byte) (int, error) {
+	r := strictReader{data: b}
+	r.coords("coordinates")
+	if r.err != nil {
+		return 0, r.err
+	}
+	return p.UnmarshalBinary(b)
+}
+
+// UnmarshalBinaryStrict decodes a frame in the same way as UnmarshalBinary
+// but additionally rejects unknown frame types, trailing bytes, lengths that
+// are out of range and non-canonical varints. The returned errors are one of
+// the exported error types in this package so that the caller can tell them
+// apart using errors.As.
+func (f *Frame) UnmarshalBinaryStrict(data []byte) (int, error) {
+	if err := checkFrame(data); err != nil {
+		return 0, err
+	}
+	if _, err := f.UnmarshalBinary(data); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+func checkFrame(data []byte) error {
+	if len(data) < FrameHeaderLength {
+		return &LengthError{"frame header", FrameHeaderLength, len(data)}
+	}
+	if !bytes.Equal(data[:4], FrameMagicBytes) {
+		return &MagicBytesError{append([]byte{}, data[:4]...)}
+	}
+	if IsJumboFrame(data) {
+		return checkJumboFrame(data)
+	}
+	switch framelen := int(binary.BigEndian.Uint16(data[FrameHeaderLength-2 : FrameHeaderLength])); {
+	case framelen < FrameHeaderLength:
+		return &LengthError{"frame header", FrameHeaderLength, framelen}
+	case len(data) < framelen:
+		return &LengthError{"frame", framelen, len(data)}
+	case len(data) > framelen:
+		return &TrailingBytesError{"frame", len(data) - framelen}
+	}
+
+	if FrameVersion(data[4]) == Version2 {
+		var f Frame
+		_, err := f.decodeCompact(data)
+		return err
+	}
+
+	r := strictReader{data: data, offset: FrameHeaderLength}
+	switch t := FrameType(data[5]); t {
+	case TypeKeepalive:
+
+	case TypeTreeAnnouncement, TypeLinkProbe, TypeBootstrapACK, TypeSNEKSummary, TypeReachability, TypeSNEKRefresh, TypeDeparting, TypeTimeSync:
+		payloadLen := r.uint16("payload length")
+		r.skip("payload", payloadLen)
+
+	case TypeBootstrap:
+		payloadLen := r.uint16("payload length")
+		r.skip("destination key", ed25519.PublicKeySize)
+		r.skip("watermark key", ed25519.PublicKeySize)
+		r.varu64("watermark sequence")
+		r.skip("payload", payloadLen)
+
+	case TypeWakeupBroadcast, TypeServiceAdvert, TypeRevocation:
+		payloadLen := r.uint16("payload length")
+		r.skip("source key", ed25519.PublicKeySize)
+		r.skip("payload", payloadLen)
+
+	case TypeTraffic, TypeEchoRequest, TypeEchoReply, TypeContinuity, TypeBootstrapConfirm, TypeCustody, TypeCustodyReceipt, TypeSNEKAdjacency, TypeNodeInfoRequest, TypeNodeInfoResponse, TypeDebugRequest, TypeDebugResponse, TypeSearchRequest, TypeSearchResponse:
+		payloadLen := r.uint16("payload length")
+		dstLen := r.coords("destination coordinates")
+		r.coords("source coordinates")
+		r.skip("destination key", ed25519.PublicKeySize)
+		r.skip("source key", ed25519.PublicKeySize)
+		if dstLen == 0 {
+			r.skip("watermark key", ed25519.PublicKeySize)
+			r.varu64("watermark sequence")
+		}
+		r.skip("payload", payloadLen)
+
+	default:
+		return &UnknownFrameTypeError{t}
+	}
+	if r.err != nil {
+		return r.err
+	}
+	if remaining := len(data) - r.offset; remaining > 0 {
+		return &TrailingBytesError{"frame", remaining}
+	}
+	return nil
+}
+
+// checkVaru64 returns the length of the canonical Varu64 at the start of
+// the buffer, or an error if there isn't one.
+func checkVaru64(field string, buf []byte) (int, error) {
+	if len(buf) == 0 {
+		return 0, &LengthError{field, 1, 0}
+	}
+	if buf[0] == 0x80 {
+		// A leading byte with no value bits set is a zero that could
+		// have been left out entirely.
+		return 0, &NonCanonicalVaru64Error{field}
+	}
+	for i, b := range buf {
+		switch {
+		case i >= maxVaru64Length:
+			return 0, &NonCanonicalVaru64Error{field}
+		case i == maxVaru64Length-1 && buf[0]&0x7f > 1:
+			// The first byte of a ten byte encoding can only carry one
+			// bit, otherwise the value would overflow.
+			return 0, &NonCanonicalVaru64Error{field}
+		case b&0x80 == 0:
+			return i + 1, nil
+		}
+	}
+	return 0, &NonCanonicalVaru64Error{field}
+}
+
+// strictReader walks over an encoded structure, remembering the first
+// error that it encounters so that the callers don't have to check after
+// every step.
+type strictReader struct {
+	data   []byte
+	offset int
+	err    error
+}
+
+func (r *strictReader) skip(field string, n int) {
+	if r.err != nil {
+		return
+	}
+	if available := len(r.data) - r.offset; n > available {
+		r.err = &LengthError{field, n, available}
+		return
+	}
+	r.offset += n
+}
+
+func (r *strictReader) uint16(field string) int {
+	start := r.offset
+	if r.skip(field, 2); r.err != nil {
+		return 0
+	}
+	return int(binary.BigEndian.Uint16(r.data[start:r.offset]))
+}
+
+func (r *strictReader) varu64(field string) uint64 {
+	if r.err != nil {
+		return 0
+	}
+	n, err := checkVaru64(field, r.data[r.offset:])
+	if err != nil {
+		r.err = err
+		return 0
+	}
+	var v Varu64
+	_, _ = v.UnmarshalBinary(r.data[r.offset : r.offset+n])
+	r.offset += n
+	return uint64(v)
+}
+
+// count reads a Varu64 count of items that each take at least one byte,
+// and checks that there are enough bytes left for them.
+func (r *strictReader) count(field string) int {
+	name := field
+	if r.err == nil {
+		if _, err := checkVaru64(field, r.data[r.offset:]); err != nil {
+			// The name of the count is only built when it's needed for the
+			// error, since counts are read for every compact frame.
+			name = field + " count"
+		}
+	}
+	n := r.varu64(name)
+	if r.err != nil {
+		return 0
+	}
+	if available := uint64(len(r.data) - r.offset); n > available {
+		if n > math.MaxInt32 {
+			n = math.MaxInt32
+		}
+		r.err = &LengthError{field, int(n), int(available)}
+		return 0
+	}
+	return int(n)
+}
+
+// coords checks length-prefixed coordinates and returns the number of
+// bytes in the encoded ports.
+func (r *strictReader) coords(field string) int {
+	l := r.uint16(field + " length")
+	start := r.offset
+	if r.skip(field, l); r.err != nil {
+		return 0
+	}
+	ports := r.data[start:r.offset]
+	for len(ports) > 0 {
+		n, err := checkVaru64(field, ports)
+		if err != nil {
+			r.err = err
+			return 0
+		}
+		ports = ports[n:]
+	}
+	return l
+}
@@ -0,0 +1,97 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+func TestUnmarshalBinaryStrictVaru64(t *testing.T) {
+	var num Varu64
+	if _, err := num.UnmarshalBinaryStrict([]byte{137, 82}); err != nil {
+		t.Fatal(err)
+	}
+	if num != 1234 {
+		t.Fatalf("expected 1234, got %d", num)
+	}
+	for _, input := range [][]byte{
+		{0x80, 1},    // leading zero group
+		{0x81, 0x82}, // unterminated
+		{0x82, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x00}, // overflow
+	} {
+		var nce *NonCanonicalVaru64Error
+		if _, err := num.UnmarshalBinaryStrict(input); !errors.As(err, &nce) {
+			t.Fatalf("expected non-canonical error for %v, got %v", input, err)
+		}
+	}
+}
+
+func TestUnmarshalBinaryStrictFrame(t *testing.T) {
+	src, _, _ := ed25519.GenerateKey(nil)
+	dst, _, _ := ed25519.GenerateKey(nil)
+	input := Frame{
+		Version: Version0,
+		Type:    TypeTraffic,
+		Source:  Coordinates{4, 3, 2, 1},
+		Payload: []byte("ABCDEFG"),
+	}
+	copy(input.DestinationKey[:], dst)
+	copy(input.SourceKey[:], src)
+	buf := make([]byte, 65535)
+	n, err := input.MarshalBinary(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := Frame{
+		Payload: make([]byte, 0, MaxPayloadSize),
+	}
+	if _, err := output.UnmarshalBinaryStrict(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+
+	// Append a trailing byte and fix up the frame length so that only the
+	// strict decoder notices.
+	trailing := append([]byte{}, buf[:n+1]...)
+	binary.BigEndian.PutUint16(trailing[FrameHeaderLength-2:FrameHeaderLength], uint16(n+1))
+	var tbe *TrailingBytesError
+	if _, err := output.UnmarshalBinaryStrict(trailing); !errors.As(err, &tbe) {
+		t.Fatalf("expected trailing bytes error, got %v", err)
+	}
+
+	// Claim a payload length longer than the frame.
+	long := append([]byte{}, buf[:n]...)
+	binary.BigEndian.PutUint16(long[FrameHeaderLength:FrameHeaderLength+2], 1000)
+	var le *LengthError
+	if _, err := output.UnmarshalBinaryStrict(long); !errors.As(err, &le) {
+		t.Fatalf("expected length error, got %v", err)
+	}
+
+	magic := append([]byte{}, buf[:n]...)
+	magic[0] ^= 0xff
+	var mbe *MagicBytesError
+	if _, err := output.UnmarshalBinaryStrict(magic); !errors.As(err, &mbe) || !errors.Is(err, ErrMalformed) {
+		t.Fatalf("expected magic bytes error, got %v", err)
+	}
+
+	unknown := append([]byte{}, buf[:n]...)
+	unknown[5] = 0xff
+	var ufe *UnknownFrameTypeError
+	if _, err := output.UnmarshalBinaryStrict(unknown); !errors.As(err, &ufe) {
+		t.Fatalf("expected unknown frame type error, got %v", err)
+	}
+}
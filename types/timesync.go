@@ -0,0 +1,124 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"crypto/ed25519"
+	"fmt"
+)
+
+// timeSyncSigningContext is signed along with time sync replies, so that a
+// peer can't use the nonce and origin that it chose to get our signature
+// over anything else.
+const timeSyncSigningContext = "pinecone time sync"
+
+// TimeSync is exchanged between direct peers to estimate how far apart
+// their clocks are, in the same way as NTP. The request carries the time
+// that it was sent and a nonce, and the reply adds the times that the
+// request arrived and the reply was sent, signed by the node that replied
+// so that nobody else on the link can change them. Times are milliseconds
+// since the Unix epoch.
+type TimeSync struct {
+	Reply     bool      `json:"reply"`
+	Nonce     Varu64    `json:"nonce"`               // Chosen by the node that asked
+	Origin    Varu64    `json:"origin"`              // When the request was sent
+	Receive   Varu64    `json:"receive,omitempty"`   // When the request arrived, only in replies
+	Transmit  Varu64    `json:"transmit,omitempty"`  // When the reply was sent, only in replies
+	Signature Signature `json:"signature,omitempty"` // Of the reply, only in replies
+}
+
+// ProtectedPayload returns the part of a reply that is signed, which
+// includes the key of the node that asked so that the reply can't be
+// passed on to anyone else.
+func (t *TimeSync) ProtectedPayload(asker PublicKey) ([]byte, error) {
+	b := append([]byte(timeSyncSigningContext), asker[:]...)
+	b, err := t.appendTimes(b)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (t *TimeSync) appendTimes(b []byte) ([]byte, error) {
+	var err error
+	if b, err = t.Nonce.AppendBinary(b); err != nil {
+		return nil, fmt.Errorf("t.Nonce.AppendBinary: %w", err)
+	}
+	if b, err = t.Origin.AppendBinary(b); err != nil {
+		return nil, fmt.Errorf("t.Origin.AppendBinary: %w", err)
+	}
+	if !t.Reply {
+		return b, nil
+	}
+	if b, err = t.Receive.AppendBinary(b); err != nil {
+		return nil, fmt.Errorf("t.Receive.AppendBinary: %w", err)
+	}
+	if b, err = t.Transmit.AppendBinary(b); err != nil {
+		return nil, fmt.Errorf("t.Transmit.AppendBinary: %w", err)
+	}
+	return b, nil
+}
+
+func (t *TimeSync) MarshalBinary(buf []byte) (int, error) {
+	return marshalInto(buf, t)
+}
+
+func (t *TimeSync) AppendBinary(b []byte) ([]byte, error) {
+	kind := byte(0)
+	if t.Reply {
+		kind = 1
+	}
+	b, err := t.appendTimes(append(b, kind))
+	if err != nil {
+		return nil, err
+	}
+	if t.Reply {
+		b = append(b, t.Signature[:]...)
+	}
+	return b, nil
+}
+
+func (t *TimeSync) UnmarshalBinary(buf []byte) (int, error) {
+	if len(buf) < 1+t.Nonce.MinLength()+t.Origin.MinLength() {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	switch buf[0] {
+	case 0:
+		t.Reply = false
+	case 1:
+		t.Reply = true
+	default:
+		return 0, fmt.Errorf("unknown time sync kind %d", buf[0])
+	}
+	offset := 1
+	fields := []*Varu64{&t.Nonce, &t.Origin}
+	if t.Reply {
+		fields = append(fields, &t.Receive, &t.Transmit)
+	}
+	for _, field := range fields {
+		n, err := field.UnmarshalBinary(buf[offset:])
+		if err != nil {
+			return 0, fmt.Errorf("Varu64.UnmarshalBinary: %w", err)
+		}
+		offset += n
+	}
+	if t.Reply {
+		if len(buf) < offset+ed25519.SignatureSize {
+			return 0, fmt.Errorf("buffer too small")
+		}
+		offset += copy(t.Signature[:], buf[offset:])
+	}
+	return offset, nil
+}
@@ -0,0 +1,76 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"crypto/ed25519"
+	"testing"
+)
+
+func TestMarshalUnmarshalTimeSync(t *testing.T) {
+	request := &TimeSync{
+		Nonce:  987654321,
+		Origin: 1700000000000,
+	}
+	var buffer [65535]byte
+	n, err := request.MarshalBinary(buffer[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var output TimeSync
+	if m, err := output.UnmarshalBinary(buffer[:n]); err != nil || m != n {
+		t.Fatalf("failed to unmarshal request (%d of %d bytes): %v", m, n, err)
+	}
+	if output != *request {
+		t.Fatalf("expected %+v, got %+v", request, output)
+	}
+
+	pk, sk, _ := ed25519.GenerateKey(nil)
+	asker := PublicKey{7}
+	reply := *request
+	reply.Reply = true
+	reply.Receive, reply.Transmit = 1700000000100, 1700000000101
+	protected, err := reply.ProtectedPayload(asker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(reply.Signature[:], ed25519.Sign(sk, protected))
+	if n, err = reply.MarshalBinary(buffer[:]); err != nil {
+		t.Fatal(err)
+	}
+	output = TimeSync{}
+	if _, err = output.UnmarshalBinary(buffer[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if output != reply {
+		t.Fatalf("expected %+v, got %+v", reply, output)
+	}
+	if protected, err = output.ProtectedPayload(asker); err != nil || !ed25519.Verify(pk, protected, output.Signature[:]) {
+		t.Fatalf("signature doesn't verify")
+	}
+	if protected, _ = output.ProtectedPayload(PublicKey{8}); ed25519.Verify(pk, protected, output.Signature[:]) {
+		t.Fatalf("signature verified for a different node")
+	}
+	if bare, _ := output.appendTimes(append([]byte{}, asker[:]...)); ed25519.Verify(pk, bare, output.Signature[:]) {
+		t.Fatalf("signature without the signing context verified")
+	}
+	if _, err = output.UnmarshalBinary(buffer[:n-1]); err == nil {
+		t.Fatalf("expected truncated reply to fail")
+	}
+	buffer[0] = 2
+	if _, err = output.UnmarshalBinary(buffer[:n]); err == nil {
+		t.Fatalf("expected unknown kind to fail")
+	}
+}
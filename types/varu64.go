@@ -22,14 +22,26 @@ func (n Varu64) MarshalBinary(b []byte) (int, error) {
 	if len(b) < n.Length() {
 		return 0, fmt.Errorf("input slice too small")
 	}
+	n.put(b[:n.Length()])
+	return n.Length(), nil
+}
+
+// AppendBinary appends the encoding of the number to the slice.
+func (n Varu64) AppendBinary(b []byte) ([]byte, error) {
+	var buf [10]byte
 	l := n.Length()
-	i := l - 1
+	n.put(buf[:l])
+	return append(b, buf[:l]...), nil
+}
+
+// put writes the encoding into b, which must be exactly n.Length() long.
+func (n Varu64) put(b []byte) {
+	i := len(b) - 1
 	b[i] = byte(n & 0x7f)
 	for n >>= 7; n != 0; n >>= 7 {
 		i--
 		b[i] = byte(n | 0x80)
 	}
-	return l, nil
 }
 
 func (n *Varu64) UnmarshalBinary(buf []byte) (int, error) {
@@ -6,9 +6,9 @@ import (
 )
 
 type VirtualSnakeBootstrap struct {
-	Sequence Varu64
+	Sequence Varu64 `json:"sequence"`
 	Root
-	Signature [ed25519.SignatureSize]byte
+	Signature Signature `json:"signature"`
 }
 
 type VirtualSnakeWatermark struct {
@@ -39,41 +39,297 @@ func (v *VirtualSnakeBootstrap) ProtectedPayload() ([]byte, error) {
 }
 
 func (v *VirtualSnakeBootstrap) MarshalBinary(buf []byte) (int, error) {
-	if len(buf) < v.Sequence.Length()+v.Root.Length()+ed25519.SignatureSize {
+	return marshalInto(buf, v)
+}
+
+func (v *VirtualSnakeBootstrap) AppendBinary(b []byte) ([]byte, error) {
+	b, err := v.Sequence.AppendBinary(b)
+	if err != nil {
+		return nil, fmt.Errorf("v.Sequence.AppendBinary: %w", err)
+	}
+	b = append(b, v.RootPublicKey[:]...)
+	if b, err = v.RootSequence.AppendBinary(b); err != nil {
+		return nil, fmt.Errorf("v.RootSequence.AppendBinary: %w", err)
+	}
+	return append(b, v.Signature[:]...), nil
+}
+
+func (v *VirtualSnakeBootstrap) UnmarshalBinary(buf []byte) (int, error) {
+	if len(buf) < v.Sequence.MinLength()+v.Root.MinLength()+ed25519.SignatureSize {
 		return 0, fmt.Errorf("buffer too small")
 	}
 	offset := 0
-	n, err := v.Sequence.MarshalBinary(buf[offset:])
+	n, err := v.Sequence.UnmarshalBinary(buf[offset:])
 	if err != nil {
-		return 0, fmt.Errorf("v.Sequence.MarshalBinary: %w", err)
+		return 0, fmt.Errorf("v.Sequence.UnmarshalBinary: %w", err)
 	}
 	offset += n
-	offset += copy(buf[offset:], v.RootPublicKey[:])
-	n, err = v.RootSequence.MarshalBinary(buf[offset:])
+	offset += copy(v.RootPublicKey[:], buf[offset:])
+	n, err = v.RootSequence.UnmarshalBinary(buf[offset:])
 	if err != nil {
-		return 0, fmt.Errorf("v.RootSequence.MarshalBinary: %w", err)
+		return 0, fmt.Errorf("v.RootSequence.UnmarshalBinary: %w", err)
 	}
 	offset += n
-	offset += copy(buf[offset:], v.Signature[:])
+	offset += copy(v.Signature[:], buf[offset:])
 	return offset, nil
 }
 
-func (v *VirtualSnakeBootstrap) UnmarshalBinary(buf []byte) (int, error) {
-	if len(buf) < v.Sequence.MinLength()+v.Root.MinLength()+ed25519.SignatureSize {
+// VirtualSnakeBootstrapACK is sent back to the direct peer that sent us a
+// bootstrap, so that it knows that the bootstrap arrived and doesn't need
+// to be sent again.
+type VirtualSnakeBootstrapACK struct {
+	PublicKey PublicKey `json:"public_key"` // The node that sent the bootstrap
+	Sequence  Varu64    `json:"sequence"`   // The sequence of the bootstrap
+}
+
+func (v *VirtualSnakeBootstrapACK) MarshalBinary(buf []byte) (int, error) {
+	return marshalInto(buf, v)
+}
+
+func (v *VirtualSnakeBootstrapACK) AppendBinary(b []byte) ([]byte, error) {
+	b = append(b, v.PublicKey[:]...)
+	b, err := v.Sequence.AppendBinary(b)
+	if err != nil {
+		return nil, fmt.Errorf("v.Sequence.AppendBinary: %w", err)
+	}
+	return b, nil
+}
+
+func (v *VirtualSnakeBootstrapACK) UnmarshalBinary(buf []byte) (int, error) {
+	if len(buf) < ed25519.PublicKeySize+v.Sequence.MinLength() {
 		return 0, fmt.Errorf("buffer too small")
 	}
-	offset := 0
+	offset := copy(v.PublicKey[:], buf)
 	n, err := v.Sequence.UnmarshalBinary(buf[offset:])
 	if err != nil {
 		return 0, fmt.Errorf("v.Sequence.UnmarshalBinary: %w", err)
 	}
+	return offset + n, nil
+}
+
+// VirtualSnakeBootstrapConfirm is sent back to the node that bootstrapped
+// by the node that accepted the bootstrap at the end of the path, so that
+// the bootstrapping node knows that its path is live end-to-end.
+type VirtualSnakeBootstrapConfirm struct {
+	Sequence  Varu64    `json:"sequence"`  // The sequence of the bootstrap
+	Signature Signature `json:"signature"` // Signed by the confirming node
+}
+
+// ProtectedPayload returns the part of the confirmation that is signed,
+// which also covers the key of the node that bootstrapped.
+func (v *VirtualSnakeBootstrapConfirm) ProtectedPayload(origin PublicKey) ([]byte, error) {
+	buffer := make([]byte, ed25519.PublicKeySize+v.Sequence.Length())
+	offset := copy(buffer, origin[:])
+	n, err := v.Sequence.MarshalBinary(buffer[offset:])
+	if err != nil {
+		return nil, fmt.Errorf("v.Sequence.MarshalBinary: %w", err)
+	}
+	return buffer[:offset+n], nil
+}
+
+func (v *VirtualSnakeBootstrapConfirm) MarshalBinary(buf []byte) (int, error) {
+	return marshalInto(buf, v)
+}
+
+func (v *VirtualSnakeBootstrapConfirm) AppendBinary(b []byte) ([]byte, error) {
+	b, err := v.Sequence.AppendBinary(b)
+	if err != nil {
+		return nil, fmt.Errorf("v.Sequence.AppendBinary: %w", err)
+	}
+	return append(b, v.Signature[:]...), nil
+}
+
+func (v *VirtualSnakeBootstrapConfirm) UnmarshalBinary(buf []byte) (int, error) {
+	if len(buf) < v.Sequence.MinLength()+ed25519.SignatureSize {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	n, err := v.Sequence.UnmarshalBinary(buf)
+	if err != nil {
+		return 0, fmt.Errorf("v.Sequence.UnmarshalBinary: %w", err)
+	}
+	if len(buf) < n+ed25519.SignatureSize {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	n += copy(v.Signature[:], buf[n:])
+	return n, nil
+}
+
+// VirtualSnakeRefresh is sent along an established path by the node that
+// bootstrapped it, from one hop to the next, so that every node on the path
+// knows that the path is still in use without it being set up again.
+type VirtualSnakeRefresh struct {
+	PublicKey PublicKey `json:"public_key"` // The node that bootstrapped
+	Sequence  Varu64    `json:"sequence"`   // The sequence of the bootstrap
+	Root
+	Signature Signature `json:"signature"` // Signed by the node that bootstrapped
+}
+
+// ProtectedPayload returns the part of the refresh that is signed.
+func (v *VirtualSnakeRefresh) ProtectedPayload() ([]byte, error) {
+	buffer := make([]byte, ed25519.PublicKeySize+v.Sequence.Length()+v.Root.Length())
+	offset := copy(buffer, v.PublicKey[:])
+	n, err := v.Sequence.MarshalBinary(buffer[offset:])
+	if err != nil {
+		return nil, fmt.Errorf("v.Sequence.MarshalBinary: %w", err)
+	}
 	offset += n
+	offset += copy(buffer[offset:], v.RootPublicKey[:])
+	n, err = v.RootSequence.MarshalBinary(buffer[offset:])
+	if err != nil {
+		return nil, fmt.Errorf("v.RootSequence.MarshalBinary: %w", err)
+	}
+	return buffer[:offset+n], nil
+}
+
+func (v *VirtualSnakeRefresh) MarshalBinary(buf []byte) (int, error) {
+	return marshalInto(buf, v)
+}
+
+func (v *VirtualSnakeRefresh) AppendBinary(b []byte) ([]byte, error) {
+	b = append(b, v.PublicKey[:]...)
+	b, err := v.Sequence.AppendBinary(b)
+	if err != nil {
+		return nil, fmt.Errorf("v.Sequence.AppendBinary: %w", err)
+	}
+	b = append(b, v.RootPublicKey[:]...)
+	if b, err = v.RootSequence.AppendBinary(b); err != nil {
+		return nil, fmt.Errorf("v.RootSequence.AppendBinary: %w", err)
+	}
+	return append(b, v.Signature[:]...), nil
+}
+
+func (v *VirtualSnakeRefresh) UnmarshalBinary(buf []byte) (int, error) {
+	if len(buf) < ed25519.PublicKeySize+v.Sequence.MinLength()+v.Root.MinLength()+ed25519.SignatureSize {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	offset := copy(v.PublicKey[:], buf)
+	n, err := v.Sequence.UnmarshalBinary(buf[offset:])
+	if err != nil {
+		return 0, fmt.Errorf("v.Sequence.UnmarshalBinary: %w", err)
+	}
+	offset += n
+	if len(buf) < offset+ed25519.PublicKeySize {
+		return 0, fmt.Errorf("buffer too small")
+	}
 	offset += copy(v.RootPublicKey[:], buf[offset:])
 	n, err = v.RootSequence.UnmarshalBinary(buf[offset:])
 	if err != nil {
 		return 0, fmt.Errorf("v.RootSequence.UnmarshalBinary: %w", err)
 	}
 	offset += n
+	if len(buf) < offset+ed25519.SignatureSize {
+		return 0, fmt.Errorf("buffer too small")
+	}
 	offset += copy(v.Signature[:], buf[offset:])
 	return offset, nil
 }
+
+// VirtualSnakeSummary is sent to a peer when the peering comes up, listing
+// keys that can be reached through us under the given root, so that the
+// peer can route towards them before any bootstraps have passed through.
+type VirtualSnakeSummary struct {
+	Root
+	Keys []PublicKey `json:"keys"`
+}
+
+func (v *VirtualSnakeSummary) MarshalBinary(buf []byte) (int, error) {
+	count := Varu64(len(v.Keys))
+	if len(buf) < v.Root.Length()+count.Length()+len(v.Keys)*ed25519.PublicKeySize {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	offset := copy(buf, v.RootPublicKey[:])
+	n, err := v.RootSequence.MarshalBinary(buf[offset:])
+	if err != nil {
+		return 0, fmt.Errorf("v.RootSequence.MarshalBinary: %w", err)
+	}
+	offset += n
+	n, err = count.MarshalBinary(buf[offset:])
+	if err != nil {
+		return 0, fmt.Errorf("count.MarshalBinary: %w", err)
+	}
+	offset += n
+	for _, key := range v.Keys {
+		offset += copy(buf[offset:], key[:])
+	}
+	return offset, nil
+}
+
+func (v *VirtualSnakeSummary) UnmarshalBinary(buf []byte) (int, error) {
+	var count Varu64
+	if len(buf) < v.Root.MinLength()+count.MinLength() {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	offset := copy(v.RootPublicKey[:], buf)
+	n, err := v.RootSequence.UnmarshalBinary(buf[offset:])
+	if err != nil {
+		return 0, fmt.Errorf("v.RootSequence.UnmarshalBinary: %w", err)
+	}
+	offset += n
+	n, err = count.UnmarshalBinary(buf[offset:])
+	if err != nil {
+		return 0, fmt.Errorf("count.UnmarshalBinary: %w", err)
+	}
+	offset += n
+	if uint64(len(buf)-offset)/ed25519.PublicKeySize < uint64(count) {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	v.Keys = make([]PublicKey, count)
+	for i := range v.Keys {
+		offset += copy(v.Keys[i][:], buf[offset:])
+	}
+	return offset, nil
+}
+
+// VirtualSnakeAdjacency is a signed statement from a node about which nodes
+// are its neighbours in the keyspace. Nodes send them to their own
+// neighbours, which can check that the statement agrees with what they
+// know. An empty key means that the node has no neighbour on that side.
+type VirtualSnakeAdjacency struct {
+	Sequence   Varu64    `json:"sequence"`   // Increases with each statement
+	Ascending  PublicKey `json:"ascending"`  // The next higher key
+	Descending PublicKey `json:"descending"` // The next lower key
+	Signature  Signature `json:"signature"`  // Signed by the node making the statement
+}
+
+// ProtectedPayload returns the part of the statement that is signed.
+func (v *VirtualSnakeAdjacency) ProtectedPayload() ([]byte, error) {
+	buffer := make([]byte, v.Sequence.Length()+ed25519.PublicKeySize*2)
+	n, err := v.Sequence.MarshalBinary(buffer)
+	if err != nil {
+		return nil, fmt.Errorf("v.Sequence.MarshalBinary: %w", err)
+	}
+	n += copy(buffer[n:], v.Ascending[:])
+	n += copy(buffer[n:], v.Descending[:])
+	return buffer[:n], nil
+}
+
+func (v *VirtualSnakeAdjacency) MarshalBinary(buf []byte) (int, error) {
+	if len(buf) < v.Sequence.Length()+ed25519.PublicKeySize*2+ed25519.SignatureSize {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	n, err := v.Sequence.MarshalBinary(buf)
+	if err != nil {
+		return 0, fmt.Errorf("v.Sequence.MarshalBinary: %w", err)
+	}
+	n += copy(buf[n:], v.Ascending[:])
+	n += copy(buf[n:], v.Descending[:])
+	n += copy(buf[n:], v.Signature[:])
+	return n, nil
+}
+
+func (v *VirtualSnakeAdjacency) UnmarshalBinary(buf []byte) (int, error) {
+	if len(buf) < v.Sequence.MinLength()+ed25519.PublicKeySize*2+ed25519.SignatureSize {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	n, err := v.Sequence.UnmarshalBinary(buf)
+	if err != nil {
+		return 0, fmt.Errorf("v.Sequence.UnmarshalBinary: %w", err)
+	}
+	if len(buf) < n+ed25519.PublicKeySize*2+ed25519.SignatureSize {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	n += copy(v.Ascending[:], buf[n:])
+	n += copy(v.Descending[:], buf[n:])
+	n += copy(v.Signature[:], buf[n:])
+	return n, nil
+}
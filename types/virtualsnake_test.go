@@ -72,3 +72,146 @@ func TestMarshalUnmarshalBootstrap(t *testing.T) {
 		t.Fatalf("root public key doesn't match")
 	}
 }
+
+func TestMarshalUnmarshalBootstrapACK(t *testing.T) {
+	pk, _, _ := ed25519.GenerateKey(nil)
+	input := &VirtualSnakeBootstrapACK{
+		Sequence: 1234567,
+	}
+	copy(input.PublicKey[:], pk)
+	var buffer [65535]byte
+	n, err := input.MarshalBinary(buffer[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var output VirtualSnakeBootstrapACK
+	if _, err = output.UnmarshalBinary(buffer[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if output != *input {
+		t.Fatalf("expected %+v, got %+v", input, output)
+	}
+}
+
+func TestMarshalUnmarshalBootstrapConfirm(t *testing.T) {
+	pk, sk, _ := ed25519.GenerateKey(nil)
+	var origin PublicKey
+	copy(origin[:], pk)
+	input := &VirtualSnakeBootstrapConfirm{
+		Sequence: 1234567,
+	}
+	protected, err := input.ProtectedPayload(origin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(input.Signature[:], ed25519.Sign(sk, protected))
+	var buffer [65535]byte
+	n, err := input.MarshalBinary(buffer[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var output VirtualSnakeBootstrapConfirm
+	if _, err = output.UnmarshalBinary(buffer[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if output != *input {
+		t.Fatalf("expected %+v, got %+v", input, output)
+	}
+	if _, err = output.UnmarshalBinary(buffer[:n-1]); err == nil {
+		t.Fatalf("expected truncated confirmation to fail")
+	}
+}
+
+func TestMarshalUnmarshalRefresh(t *testing.T) {
+	pk, sk, _ := ed25519.GenerateKey(nil)
+	input := &VirtualSnakeRefresh{
+		Sequence: 1234567,
+		Root: Root{
+			RootPublicKey: PublicKey{9},
+			RootSequence:  300,
+		},
+	}
+	copy(input.PublicKey[:], pk)
+	protected, err := input.ProtectedPayload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(input.Signature[:], ed25519.Sign(sk, protected))
+	var buffer [65535]byte
+	n, err := input.MarshalBinary(buffer[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var output VirtualSnakeRefresh
+	if _, err = output.UnmarshalBinary(buffer[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if output != *input {
+		t.Fatalf("expected %+v, got %+v", input, output)
+	}
+	if !ed25519.Verify(pk, protected, output.Signature[:]) {
+		t.Fatalf("signature doesn't verify")
+	}
+	if _, err = output.UnmarshalBinary(buffer[:n-1]); err == nil {
+		t.Fatalf("expected truncated refresh to fail")
+	}
+}
+
+func TestMarshalUnmarshalSummary(t *testing.T) {
+	input := &VirtualSnakeSummary{
+		Root: Root{
+			RootPublicKey: PublicKey{9},
+			RootSequence:  300,
+		},
+		Keys: []PublicKey{{1}, {2}, {3}},
+	}
+	var buffer [65535]byte
+	n, err := input.MarshalBinary(buffer[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var output VirtualSnakeSummary
+	if _, err = output.UnmarshalBinary(buffer[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if output.Root != input.Root || len(output.Keys) != len(input.Keys) {
+		t.Fatalf("expected %+v, got %+v", input, output)
+	}
+	for i := range input.Keys {
+		if output.Keys[i] != input.Keys[i] {
+			t.Fatalf("key %d doesn't match", i)
+		}
+	}
+	if _, err = output.UnmarshalBinary(buffer[:n-1]); err == nil {
+		t.Fatalf("expected truncated summary to fail")
+	}
+}
+
+func TestMarshalUnmarshalAdjacency(t *testing.T) {
+	_, sk, _ := ed25519.GenerateKey(nil)
+	input := &VirtualSnakeAdjacency{
+		Sequence:   1234567,
+		Ascending:  PublicKey{2},
+		Descending: PublicKey{1},
+	}
+	protected, err := input.ProtectedPayload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(input.Signature[:], ed25519.Sign(sk, protected))
+	var buffer [65535]byte
+	n, err := input.MarshalBinary(buffer[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var output VirtualSnakeAdjacency
+	if _, err = output.UnmarshalBinary(buffer[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if output != *input {
+		t.Fatalf("expected %+v, got %+v", input, output)
+	}
+	if _, err = output.UnmarshalBinary(buffer[:n-1]); err == nil {
+		t.Fatalf("expected truncated statement to fail")
+	}
+}
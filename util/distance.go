@@ -20,6 +20,8 @@ import (
 	"github.com/matrix-org/pinecone/types"
 )
 
+// LessThan returns true if the first key is lower than the second key
+// when both are treated as big-endian 256-bit integers.
 func LessThan(first, second types.PublicKey) bool {
 	for i := 0; i < ed25519.PublicKeySize; i++ {
 		if first[i] < second[i] {
@@ -0,0 +1,119 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"github.com/matrix-org/pinecone/types"
+)
+
+// The keyspace is the ring of all possible public keys, ordered as big-endian
+// 256-bit integers, where the highest key wraps around to the lowest. SNEK
+// routing relies on every node agreeing on these semantics, so anything which
+// reasons about positions in the keyspace should use the functions here rather
+// than comparing keys by hand.
+
+// InWrappedInterval returns true if the key falls within the half-open interval
+// (start, end], travelling upwards through the keyspace from start and wrapping
+// around from the highest key to the lowest if needed. If start and end are the
+// same key then the interval covers the whole keyspace.
+func InWrappedInterval(start, key, end types.PublicKey) bool {
+	if start == end {
+		return true
+	}
+	return key == end || DHTWrappedOrdered(start, key, end)
+}
+
+// KeyspaceDistance returns the distance travelling upwards through the
+// keyspace from one key to the other, wrapping around if needed. The result
+// is a 256-bit big-endian integer in the same form as a public key, so that
+// distances can be compared with LessThan.
+func KeyspaceDistance(from, to types.PublicKey) types.PublicKey {
+	var d types.PublicKey
+	borrow := 0
+	for i := len(d) - 1; i >= 0; i-- {
+		v := int(to[i]) - int(from[i]) - borrow
+		borrow = 0
+		if v < 0 {
+			v += 256
+			borrow = 1
+		}
+		d[i] = byte(v)
+	}
+	return d
+}
+
+// AbsoluteKeyspaceDistance returns the shortest distance between the two keys
+// in either direction around the keyspace.
+func AbsoluteKeyspaceDistance(a, b types.PublicKey) types.PublicKey {
+	up, down := KeyspaceDistance(a, b), KeyspaceDistance(b, a)
+	if LessThan(down, up) {
+		return down
+	}
+	return up
+}
+
+// NearestKey returns the key from the set which is closest to the target in
+// either direction. Ties are broken in favour of the key above the target. If
+// the set is empty then false is returned.
+func NearestKey(target types.PublicKey, keys []types.PublicKey) (types.PublicKey, bool) {
+	var best, bestDist types.PublicKey
+	found := false
+	for _, k := range keys {
+		dist := AbsoluteKeyspaceDistance(target, k)
+		switch {
+		case !found, LessThan(dist, bestDist):
+		case dist == bestDist && KeyspaceDistance(target, k) == dist:
+			// Equidistant, but this candidate is above the target.
+		default:
+			continue
+		}
+		best, bestDist, found = k, dist, true
+	}
+	return best, found
+}
+
+// SuccessorKey returns the first key from the set that is strictly above the
+// target, wrapping around if needed. If the set is empty or contains only the
+// target then false is returned.
+func SuccessorKey(target types.PublicKey, keys []types.PublicKey) (types.PublicKey, bool) {
+	var best types.PublicKey
+	found := false
+	for _, k := range keys {
+		if k == target {
+			continue
+		}
+		if !found || DHTWrappedOrdered(target, k, best) {
+			best, found = k, true
+		}
+	}
+	return best, found
+}
+
+// PredecessorKey returns the first key from the set that is strictly below
+// the target, wrapping around if needed. If the set is empty or contains only
+// the target then false is returned.
+func PredecessorKey(target types.PublicKey, keys []types.PublicKey) (types.PublicKey, bool) {
+	var best types.PublicKey
+	found := false
+	for _, k := range keys {
+		if k == target {
+			continue
+		}
+		if !found || DHTWrappedOrdered(best, k, target) {
+			best, found = k, true
+		}
+	}
+	return best, found
+}
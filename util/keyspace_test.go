@@ -0,0 +1,80 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"testing"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestInWrappedInterval(t *testing.T) {
+	for _, tc := range []struct {
+		start, key, end byte
+		expected        bool
+	}{
+		{2, 3, 5, true},
+		{2, 5, 5, true},
+		{2, 2, 5, false},
+		{2, 6, 5, false},
+		{8, 9, 2, true},
+		{8, 1, 2, true},
+		{8, 5, 2, false},
+		{4, 9, 4, true},
+	} {
+		got := InWrappedInterval(types.PublicKey{tc.start}, types.PublicKey{tc.key}, types.PublicKey{tc.end})
+		if got != tc.expected {
+			t.Fatalf("%d in (%d, %d]: expected %v, got %v", tc.key, tc.start, tc.end, tc.expected, got)
+		}
+	}
+}
+
+func TestKeyspaceDistance(t *testing.T) {
+	a := types.PublicKey{0, 0, 1}
+	b := types.PublicKey{0, 0, 3}
+	if d := KeyspaceDistance(a, b); d != (types.PublicKey{0, 0, 2}) {
+		t.Fatalf("expected distance 2, got %v", d)
+	}
+	// Going downwards wraps all the way around the keyspace.
+	expected := types.PublicKey{0xff, 0xff, 0xfe}
+	if d := KeyspaceDistance(b, a); d != expected {
+		t.Fatalf("expected wrapped distance %v, got %v", expected, d)
+	}
+	if d := AbsoluteKeyspaceDistance(b, a); d != (types.PublicKey{0, 0, 2}) {
+		t.Fatalf("expected absolute distance 2, got %v", d)
+	}
+}
+
+func TestNearestSuccessorPredecessor(t *testing.T) {
+	keys := []types.PublicKey{{1}, {4}, {8}, {0xf0}}
+	if k, ok := NearestKey(types.PublicKey{6}, keys); !ok || k != (types.PublicKey{8}) {
+		t.Fatalf("expected nearest 8, got %v", k[0])
+	}
+	if k, ok := NearestKey(types.PublicKey{0xff}, keys); !ok || k != (types.PublicKey{1}) {
+		t.Fatalf("expected nearest to wrap to 1, got %v", k[0])
+	}
+	if k, ok := SuccessorKey(types.PublicKey{4}, keys); !ok || k != (types.PublicKey{8}) {
+		t.Fatalf("expected successor 8, got %v", k[0])
+	}
+	if k, ok := SuccessorKey(types.PublicKey{0xf0}, keys); !ok || k != (types.PublicKey{1}) {
+		t.Fatalf("expected successor to wrap to 1, got %v", k[0])
+	}
+	if k, ok := PredecessorKey(types.PublicKey{1}, keys); !ok || k != (types.PublicKey{0xf0}) {
+		t.Fatalf("expected predecessor to wrap to f0, got %v", k[0])
+	}
+	if _, ok := NearestKey(types.PublicKey{1}, nil); ok {
+		t.Fatal("expected no nearest key in empty set")
+	}
+}